@@ -0,0 +1,151 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// maxHostNameLength bounds the length of host names, as in RFC 1035.
+const maxHostNameLength = 253
+
+// maxHostLabelLength bounds the length of each dot-separated label of a host
+// name, as in RFC 1035.
+const maxHostLabelLength = 63
+
+// errMissingPort is returned, possibly wrapped, by splitAddress when an
+// address has no port.
+var errMissingPort = errors.New("missing port: expected host:port or [IPv6]:port")
+
+// parseUpstreamAddress parses the address of an upstream, of form
+// host:port. The host is a host name, an IPv4 address, or an IPv6 address
+// in brackets with an optional zone, e.g. "[fe80::1%eth0]:80". If the
+// address has no port, it has defaultPort, unless that is empty. The
+// address is returned in the canonical form of net.JoinHostPort.
+func parseUpstreamAddress(address, defaultPort string) (string, error) {
+	host, port, err := splitAddress(address)
+	if errors.Is(err, errMissingPort) && defaultPort != "" {
+		host, port, err = strings.TrimSuffix(strings.TrimPrefix(address, "["), "]"), defaultPort, nil
+	}
+	if err != nil {
+		return "", err
+	}
+	if host == "" {
+		return "", errors.New("missing host")
+	}
+	if err := checkHost(host, strings.HasPrefix(address, "[")); err != nil {
+		return "", err
+	}
+	if err := checkPort(port, 1); err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, port), nil
+}
+
+// checkListenAddress checks an address to listen on, of form host:port, as
+// parseUpstreamAddress does, except that the host may be empty, to listen
+// on every address, and the port may be 0, to listen on any free port.
+func checkListenAddress(address string) error {
+	host, port, err := splitAddress(address)
+	if err != nil {
+		return err
+	}
+	if host != "" {
+		if err := checkHost(host, strings.HasPrefix(address, "[")); err != nil {
+			return err
+		}
+	}
+	return checkPort(port, 0)
+}
+
+// splitAddress splits address into host and port, as net.SplitHostPort
+// does, but explains the usual mistake of an IPv6 address without
+// brackets.
+func splitAddress(address string) (host, port string, err error) {
+	if address == "" {
+		return "", "", errors.New("empty address")
+	}
+	if !strings.HasPrefix(address, "[") && strings.Count(address, ":") > 1 {
+		return "", "", errors.New("IPv6 addresses must be in brackets, e.g. [::1]:443")
+	}
+	host, port, err = net.SplitHostPort(address)
+	switch {
+	case err == nil:
+		return host, port, nil
+	case isMissingPort(err):
+		return "", "", errMissingPort
+	default:
+		return "", "", errors.New("expected host:port or [IPv6]:port")
+	}
+}
+
+// checkHost checks that host is an IPv4 address or host name or, if it was
+// in brackets, an IPv6 address with an optional zone.
+func checkHost(host string, bracketed bool) error {
+	ip, zone, hasZone := strings.Cut(host, "%")
+	if bracketed {
+		if !strings.Contains(ip, ":") || net.ParseIP(ip) == nil {
+			return fmt.Errorf("%q is in brackets, but is not an IPv6 address", host)
+		}
+		if hasZone && zone == "" {
+			return fmt.Errorf("IPv6 address %q has an empty zone", host)
+		}
+		return nil
+	}
+	if hasZone {
+		return fmt.Errorf("%q has a zone, but only IPv6 addresses may, in brackets, e.g. [fe80::1%%eth0]:443", host)
+	}
+	if net.ParseIP(host) != nil {
+		return nil
+	}
+	return checkHostName(host)
+}
+
+// isMissingPort reports if err, from net.SplitHostPort, is due to the
+// address having no port.
+func isMissingPort(err error) bool {
+	var addrErr *net.AddrError
+	return errors.As(err, &addrErr) && addrErr.Err == "missing port in address"
+}
+
+// checkHostName checks that name is a host name: labels of letters, digits,
+// hyphens and underscores, separated by dots, that do not start or end with
+// a hyphen. A trailing dot, as in a fully qualified name, is allowed.
+func checkHostName(name string) error {
+	trimmed := strings.TrimSuffix(name, ".")
+	if len(trimmed) > maxHostNameLength {
+		return fmt.Errorf("host name %q is longer than %d characters", name, maxHostNameLength)
+	}
+	for _, label := range strings.Split(trimmed, ".") {
+		if label == "" {
+			return fmt.Errorf("host name %q has an empty label", name)
+		}
+		if len(label) > maxHostLabelLength {
+			return fmt.Errorf("host name %q has a label longer than %d characters", name, maxHostLabelLength)
+		}
+		if label[0] == '-' || label[len(label)-1] == '-' {
+			return fmt.Errorf("host name %q has a label that starts or ends with a hyphen", name)
+		}
+		for _, c := range label {
+			if !isHostNameChar(c) {
+				return fmt.Errorf("host name %q contains %q: expected only letters, digits, hyphens and underscores", name, c)
+			}
+		}
+	}
+	return nil
+}
+
+func isHostNameChar(c rune) bool {
+	return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || c == '-' || c == '_'
+}
+
+// checkPort checks that port is a number from min to 65535.
+func checkPort(port string, min uint64) error {
+	n, err := strconv.ParseUint(port, 10, 16)
+	if err != nil || n < min {
+		return fmt.Errorf("port %q must be a number from %d to 65535", port, min)
+	}
+	return nil
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"tcplb/lib/admin"
+	"time"
+)
+
+const (
+	adminCommandName      = "admin"
+	defaultAdminSocket    = "/run/tcplb/admin.sock"
+	defaultAdminTimeout   = time.Minute
+	adminCommandsOverview = `commands:
+  connections [idle]     list live connections, or only idle ones, longest idle first
+  evict <id>             terminate the live connection with the given id
+  evict-client <client> [grace]
+                         end every connection of a client, given as [namespace:]key, after a grace period for data in flight
+  client <client>        show the reservations, limits, class, groups and recent rejections of a client, given as [namespace:]key
+  upstreams              show upstream health and drain state
+  drain <host:port>      stop forwarding new connections to an upstream
+  undrain <host:port>    resume forwarding new connections to an upstream
+  set-upstreams <pool> <host:port>...
+                         replace the upstreams of a pool; removed upstreams are drained.
+                         pools with upstreams listed by an -upstream-group cannot be replaced
+  probe [host:port]      probe an upstream, or all upstreams, now and show the results
+  history [host:port]    show recent health checks of an upstream, or all upstreams
+  limiter                show connection reservations held by each client
+  log-level [level]      show, or set, the minimum log level
+  config                 show the hash of the effective config
+  startup                show the startup report of listeners, pools and limits
+  reload                 reload config by starting a new server process
+`
+)
+
+var InvalidAdminCommand = errors.New("invalid admin command")
+
+// adminRequest is a control request to send to the server.
+type adminRequest struct {
+	method string
+	path   string
+	body   any
+}
+
+// parseAdminCommand converts the command line of an admin command, e.g.
+// ["drain", "10.0.0.1:443"], to the control request it represents.
+func parseAdminCommand(args []string) (adminRequest, error) {
+	if len(args) == 0 {
+		return adminRequest{}, fmt.Errorf("%w: no command given", InvalidAdminCommand)
+	}
+	command, params := args[0], args[1:]
+	wantParams := func(n int) error {
+		if len(params) != n {
+			return fmt.Errorf("%w: %s expects %d argument(s), got %d", InvalidAdminCommand, command, n, len(params))
+		}
+		return nil
+	}
+	switch command {
+	case "connections":
+		switch {
+		case len(params) == 0:
+			return adminRequest{method: http.MethodGet, path: "/connections"}, nil
+		case len(params) == 1 && params[0] == "idle":
+			return adminRequest{method: http.MethodGet, path: "/connections?idle=true"}, nil
+		default:
+			return adminRequest{}, fmt.Errorf("%w: connections expects no argument, or \"idle\"", InvalidAdminCommand)
+		}
+	case "evict":
+		if err := wantParams(1); err != nil {
+			return adminRequest{}, err
+		}
+		if _, err := strconv.ParseUint(params[0], 10, 64); err != nil {
+			return adminRequest{}, fmt.Errorf("%w: connection id must be a positive integer", InvalidAdminCommand)
+		}
+		return adminRequest{method: http.MethodDelete, path: "/connections/" + params[0]}, nil
+	case "evict-client":
+		if len(params) != 1 && len(params) != 2 {
+			return adminRequest{}, fmt.Errorf("%w: evict-client expects 1 or 2 arguments, got %d", InvalidAdminCommand, len(params))
+		}
+		clientID, ok := parseClientID(params[0], true)
+		if !ok {
+			return adminRequest{}, fmt.Errorf("%w: client must be given as [namespace:]key, got %q", InvalidAdminCommand, params[0])
+		}
+		body := admin.EvictClientRequest{Namespace: clientID.Namespace, Key: clientID.Key}
+		if len(params) == 2 {
+			if _, err := time.ParseDuration(params[1]); err != nil {
+				return adminRequest{}, fmt.Errorf("%w: grace must be a duration, e.g. 5s", InvalidAdminCommand)
+			}
+			body.Grace = params[1]
+		}
+		return adminRequest{method: http.MethodPost, path: "/clients/evict", body: body}, nil
+	case "client":
+		if err := wantParams(1); err != nil {
+			return adminRequest{}, err
+		}
+		clientID, ok := parseClientID(params[0], true)
+		if !ok {
+			return adminRequest{}, fmt.Errorf("%w: client must be given as [namespace:]key, got %q", InvalidAdminCommand, params[0])
+		}
+		// Keys may not survive as paths, e.g. SPIFFE IDs, so are sent as queries.
+		query := url.Values{"key": {clientID.Key}}
+		return adminRequest{method: http.MethodGet, path: "/clients/inspect/" + url.PathEscape(clientID.Namespace) + "?" + query.Encode()}, nil
+	case "upstreams":
+		return adminRequest{method: http.MethodGet, path: "/upstreams"}, wantParams(0)
+	case "drain", "undrain":
+		if err := wantParams(1); err != nil {
+			return adminRequest{}, err
+		}
+		body := admin.UpstreamRequest{Network: defaultUpstreamNetwork, Address: params[0]}
+		return adminRequest{method: http.MethodPost, path: "/upstreams/" + command, body: body}, nil
+	case "set-upstreams":
+		if len(params) < 2 {
+			return adminRequest{}, fmt.Errorf("%w: set-upstreams expects a pool and at least 1 upstream, got %d argument(s)", InvalidAdminCommand, len(params))
+		}
+		body := admin.PoolUpstreamsRequest{Pool: params[0]}
+		for _, address := range params[1:] {
+			body.Upstreams = append(body.Upstreams, admin.UpstreamRequest{Network: defaultUpstreamNetwork, Address: address})
+		}
+		return adminRequest{method: http.MethodPut, path: "/pools/upstreams", body: body}, nil
+	case "probe":
+		switch len(params) {
+		case 0:
+			return adminRequest{method: http.MethodPost, path: "/upstreams/probe"}, nil
+		case 1:
+			body := admin.UpstreamRequest{Network: defaultUpstreamNetwork, Address: params[0]}
+			return adminRequest{method: http.MethodPost, path: "/upstreams/probe", body: body}, nil
+		default:
+			return adminRequest{}, fmt.Errorf("%w: probe expects at most 1 argument, got %d", InvalidAdminCommand, len(params))
+		}
+	case "history":
+		switch len(params) {
+		case 0:
+			return adminRequest{method: http.MethodGet, path: "/upstreams/history"}, nil
+		case 1:
+			query := url.Values{"network": {defaultUpstreamNetwork}, "address": {params[0]}}
+			return adminRequest{method: http.MethodGet, path: "/upstreams/history?" + query.Encode()}, nil
+		default:
+			return adminRequest{}, fmt.Errorf("%w: history expects at most 1 argument, got %d", InvalidAdminCommand, len(params))
+		}
+	case "limiter":
+		return adminRequest{method: http.MethodGet, path: "/limiter"}, wantParams(0)
+	case "log-level":
+		switch len(params) {
+		case 0:
+			return adminRequest{method: http.MethodGet, path: "/log-level"}, nil
+		case 1:
+			body := map[string]string{"level": params[0]}
+			return adminRequest{method: http.MethodPut, path: "/log-level", body: body}, nil
+		default:
+			return adminRequest{}, fmt.Errorf("%w: log-level expects at most 1 argument, got %d", InvalidAdminCommand, len(params))
+		}
+	case "config":
+		return adminRequest{method: http.MethodGet, path: "/config"}, wantParams(0)
+	case "startup":
+		return adminRequest{method: http.MethodGet, path: "/startup"}, wantParams(0)
+	case "reload":
+		return adminRequest{method: http.MethodPost, path: "/reload"}, wantParams(0)
+	default:
+		return adminRequest{}, fmt.Errorf("%w: unknown command %q", InvalidAdminCommand, command)
+	}
+}
+
+// runAdmin implements the "tcplb admin" command, which sends a control
+// request to a running server via its control socket, and prints the result.
+func runAdmin(argv []string, stdout, stderr io.Writer) int {
+	flagSet := flag.NewFlagSet(commandName+" "+adminCommandName, flag.ContinueOnError)
+	flagSet.SetOutput(stderr)
+	flagSet.Usage = func() {
+		fmt.Fprintf(stderr, "usage: %s %s [flags] <command> [args]\n\n%s\nflags:\n", commandName, adminCommandName, adminCommandsOverview)
+		flagSet.PrintDefaults()
+	}
+	socket := flagSet.String(
+		"socket",
+		defaultAdminSocket,
+		"path of the server's control socket, as given by its -admin-socket flag.")
+	timeout := flagSet.Duration(
+		"timeout",
+		defaultAdminTimeout,
+		"time limit for the request.")
+	if err := flagSet.Parse(argv[1:]); err != nil {
+		return exitInvalidConfig
+	}
+
+	req, err := parseAdminCommand(flagSet.Args())
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		flagSet.Usage()
+		return exitInvalidConfig
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+	data, err := admin.NewClient(*socket).Do(ctx, req.method, req.path, req.body)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return exitServerError
+	}
+	if len(data) == 0 {
+		fmt.Fprintln(stdout, "ok")
+		return exitOK
+	}
+	var pretty bytes.Buffer
+	if json.Indent(&pretty, bytes.TrimSpace(data), "", "  ") != nil {
+		_, _ = stdout.Write(data)
+		return exitOK
+	}
+	pretty.WriteByte('\n')
+	_, _ = pretty.WriteTo(stdout)
+	return exitOK
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"tcplb/lib/admin"
+	"testing"
+)
+
+func TestParseAdminCommand(t *testing.T) {
+	req, err := parseAdminCommand([]string{"drain", "10.0.0.1:443"})
+	require.NoError(t, err)
+	require.Equal(t, adminRequest{
+		method: http.MethodPost,
+		path:   "/upstreams/drain",
+		body:   admin.UpstreamRequest{Network: "tcp", Address: "10.0.0.1:443"},
+	}, req)
+
+	req, err = parseAdminCommand([]string{"probe"})
+	require.NoError(t, err)
+	require.Equal(t, adminRequest{method: http.MethodPost, path: "/upstreams/probe"}, req)
+
+	req, err = parseAdminCommand([]string{"evict", "42"})
+	require.NoError(t, err)
+	require.Equal(t, adminRequest{method: http.MethodDelete, path: "/connections/42"}, req)
+
+	req, err = parseAdminCommand([]string{"connections", "idle"})
+	require.NoError(t, err)
+	require.Equal(t, adminRequest{method: http.MethodGet, path: "/connections?idle=true"}, req)
+
+	req, err = parseAdminCommand([]string{"set-upstreams", "web", "10.0.0.1:80", "10.0.0.2:80"})
+	require.NoError(t, err)
+	require.Equal(t, adminRequest{
+		method: http.MethodPut,
+		path:   "/pools/upstreams",
+		body: admin.PoolUpstreamsRequest{Pool: "web", Upstreams: []admin.UpstreamRequest{
+			{Network: "tcp", Address: "10.0.0.1:80"},
+			{Network: "tcp", Address: "10.0.0.2:80"},
+		}},
+	}, req)
+
+	req, err = parseAdminCommand([]string{"evict-client", "spiffe://example.com/web", "10s"})
+	require.NoError(t, err)
+	require.Equal(t, adminRequest{
+		method: http.MethodPost,
+		path:   "/clients/evict",
+		body:   admin.EvictClientRequest{Namespace: "spiffe", Key: "spiffe://example.com/web", Grace: "10s"},
+	}, req)
+
+	req, err = parseAdminCommand([]string{"client", "spiffe://example.com/web"})
+	require.NoError(t, err)
+	require.Equal(t, adminRequest{method: http.MethodGet, path: "/clients/inspect/spiffe?key=spiffe%3A%2F%2Fexample.com%2Fweb"}, req)
+
+	// Namespaces are not mistaken for other client endpoints.
+	req, err = parseAdminCommand([]string{"client", "evict:alice"})
+	require.NoError(t, err)
+	require.Equal(t, adminRequest{method: http.MethodGet, path: "/clients/inspect/evict?key=alice"}, req)
+
+	req, err = parseAdminCommand([]string{"log-level"})
+	require.NoError(t, err)
+	require.Equal(t, http.MethodGet, req.method)
+
+	req, err = parseAdminCommand([]string{"history", "10.0.0.1:443"})
+	require.NoError(t, err)
+	require.Equal(t, adminRequest{method: http.MethodGet, path: "/upstreams/history?address=10.0.0.1%3A443&network=tcp"}, req)
+
+	req, err = parseAdminCommand([]string{"config"})
+	require.NoError(t, err)
+	require.Equal(t, adminRequest{method: http.MethodGet, path: "/config"}, req)
+
+	req, err = parseAdminCommand([]string{"startup"})
+	require.NoError(t, err)
+	require.Equal(t, adminRequest{method: http.MethodGet, path: "/startup"}, req)
+}
+
+func TestParseAdminCommandErrors(t *testing.T) {
+	for _, args := range [][]string{
+		{},
+		{"explode"},
+		{"connections", "busy"},
+		{"evict"},
+		{"evict", "-1"},
+		{"set-upstreams", "web"},
+		{"evict-client"},
+		{"evict-client", ":alice"},
+		{"evict-client", "alice", "soon"},
+		{"client"},
+		{"client", ":alice"},
+		{"reload", "now"},
+		{"config", "now"},
+		{"startup", "now"},
+		{"log-level", "debug", "info"},
+		{"probe", "a:1", "b:1"},
+		{"history", "a:1", "b:1"},
+	} {
+		_, err := parseAdminCommand(args)
+		require.ErrorIs(t, err, InvalidAdminCommand, args)
+	}
+}
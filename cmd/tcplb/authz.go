@@ -0,0 +1,429 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"tcplb/lib/authn"
+	"tcplb/lib/authz"
+	"tcplb/lib/core"
+	"tcplb/lib/forwarder"
+	"tcplb/lib/geoip"
+	"tcplb/lib/metrics"
+)
+
+const (
+	// allUpstreamsGroupName is the reserved upstream group of the upstreams
+	// of every pool. Clients listed without groups are granted it.
+	allUpstreamsGroupName = "all"
+
+	// defaultAuthorizedClients grants the anonymous client every upstream.
+	// TODO replace placeholder default once clients are authenticated by mTLS.
+	defaultAuthorizedClients = "test/anonymous"
+
+	// defaultAuthzCacheSize bounds the clients whose authorized upstreams
+	// are cached.
+	defaultAuthzCacheSize = 10000
+)
+
+// UpstreamGroupConfig configures a named group of upstreams that clients
+// may be authorized to access.
+type UpstreamGroupConfig struct {
+	Name      string
+	Upstreams []core.Upstream
+	Selector  core.Labels // Selector is optional. If set, the group also has the upstreams of pools whose labels match it.
+}
+
+// members returns the upstreams of g: those listed, and those of upstreams
+// whose labels, given by labels, match the Selector of g, if it has one.
+func (g UpstreamGroupConfig) members(upstreams core.UpstreamSet, labels map[core.Upstream]core.Labels) core.UpstreamSet {
+	members := core.NewUpstreamSet(g.Upstreams...)
+	if len(g.Selector) == 0 {
+		return members
+	}
+	for u := range upstreams {
+		if l, ok := labels[u]; ok && l.Matches(g.Selector) {
+			members[u] = struct{}{}
+		}
+	}
+	return members
+}
+
+// UpstreamGroupListValue is a flag.Value that collects upstream groups.
+type UpstreamGroupListValue struct {
+	Groups      []UpstreamGroupConfig
+	DefaultPort string // DefaultPort is optional. If set, it is the port of upstreams given without one.
+}
+
+func (v *UpstreamGroupListValue) String() string {
+	tokens := make([]string, len(v.Groups))
+	for i, g := range v.Groups {
+		members := make([]string, 0, len(g.Upstreams)+len(g.Selector))
+		for _, u := range g.Upstreams {
+			members = append(members, u.Address)
+		}
+		members = append(members, strings.Fields(g.Selector.String())...)
+		tokens[i] = g.Name + "=" + strings.Join(members, ",")
+	}
+	return strings.Join(tokens, "; ")
+}
+
+// Set parses an upstream group from its name and members, each an upstream
+// or a key=value label that upstreams must all have to be selected, e.g.
+// "web=10.0.0.1:80,10.0.0.2:80" or "eu=zone=eu-west-1,tier=primary".
+func (v *UpstreamGroupListValue) Set(s string) error {
+	name, list, ok := strings.Cut(s, "=")
+	if !ok || name == "" || list == "" {
+		return fmt.Errorf("expected upstream group of form name=host:port,... or name=key=value,... but got %q", s)
+	}
+	g := UpstreamGroupConfig{Name: name}
+	var addresses []string
+	for _, member := range splitList(list) {
+		key, value, isLabel := strings.Cut(member, "=")
+		if !isLabel {
+			addresses = append(addresses, member)
+			continue
+		}
+		if key == "" || value == "" {
+			return fmt.Errorf("upstream group %q: expected label of form key=value but got %q", name, member)
+		}
+		if g.Selector == nil {
+			g.Selector = make(core.Labels)
+		}
+		g.Selector[key] = value
+	}
+	if len(addresses) > 0 {
+		upstreams := &UpstreamListValue{DefaultPort: v.DefaultPort}
+		if err := upstreams.Set(strings.Join(addresses, ",")); err != nil {
+			return fmt.Errorf("upstream group %q: %w", name, err)
+		}
+		g.Upstreams = upstreams.Upstreams
+	}
+	v.Groups = append(v.Groups, g)
+	return nil
+}
+
+// UpstreamGroupCountriesValue is a flag.Value that collects the countries
+// that upstream groups are restricted to.
+type UpstreamGroupCountriesValue struct {
+	Countries map[string][]string
+}
+
+func (v *UpstreamGroupCountriesValue) String() string {
+	tokens := make([]string, 0, len(v.Countries))
+	for name, countries := range v.Countries {
+		tokens = append(tokens, name+"="+strings.Join(countries, ","))
+	}
+	sort.Strings(tokens)
+	return strings.Join(tokens, "; ")
+}
+
+// Set parses an upstream group name and the countries its clients must be
+// located in, e.g. "eu=DE,FR".
+func (v *UpstreamGroupCountriesValue) Set(s string) error {
+	name, list, ok := strings.Cut(s, "=")
+	countries := splitList(list)
+	if !ok || name == "" || len(countries) == 0 {
+		return fmt.Errorf("expected upstream group countries of form name=CC,... but got %q", s)
+	}
+	if v.Countries == nil {
+		v.Countries = make(map[string][]string)
+	}
+	if _, ok := v.Countries[name]; ok {
+		return fmt.Errorf("countries of upstream group %q are given more than once", name)
+	}
+	v.Countries[name] = countries
+	return nil
+}
+
+// UpstreamGroupFingerprintsValue is a flag.Value that collects the TLS
+// fingerprints that upstream groups are restricted to.
+type UpstreamGroupFingerprintsValue struct {
+	Fingerprints map[string][]string
+}
+
+func (v *UpstreamGroupFingerprintsValue) String() string {
+	tokens := make([]string, 0, len(v.Fingerprints))
+	for name, fingerprints := range v.Fingerprints {
+		tokens = append(tokens, name+"="+strings.Join(fingerprints, ","))
+	}
+	sort.Strings(tokens)
+	return strings.Join(tokens, "; ")
+}
+
+// Set parses an upstream group name and the TLS fingerprints its clients
+// must have, e.g. "admin=t13d1516h2_8daaf6152771_e5627efa2ab1".
+func (v *UpstreamGroupFingerprintsValue) Set(s string) error {
+	name, list, ok := strings.Cut(s, "=")
+	fingerprints := splitList(list)
+	if !ok || name == "" || len(fingerprints) == 0 {
+		return fmt.Errorf("expected upstream group fingerprints of form name=fingerprint,... but got %q", s)
+	}
+	if v.Fingerprints == nil {
+		v.Fingerprints = make(map[string][]string)
+	}
+	if _, ok := v.Fingerprints[name]; ok {
+		return fmt.Errorf("fingerprints of upstream group %q are given more than once", name)
+	}
+	v.Fingerprints[name] = fingerprints
+	return nil
+}
+
+// ClientGrant authorizes a client to access the upstreams of groups.
+type ClientGrant struct {
+	ClientID core.ClientID
+	Groups   []string // Groups are the names of the upstream groups granted. The client is also a member of client groups of the same names, for routing.
+}
+
+// parseClientGrants parses a comma-separated list of clients, each
+// optionally followed by "=" and the "+"-separated upstream groups it is
+// granted, e.g. "alice=web+db,bob". Clients without groups are granted all
+// upstreams. Clients are given as for parseClientID.
+func parseClientGrants(s string, namespaced bool) ([]ClientGrant, error) {
+	var grants []ClientGrant
+	for _, token := range splitList(s) {
+		client, groups, hasGroups := strings.Cut(token, "=")
+		if client == "" {
+			return nil, fmt.Errorf("expected client of form %s[=group+...] but got %q", clientIDForm(namespaced), token)
+		}
+		clientID, ok := parseClientID(client, namespaced)
+		if !ok {
+			return nil, fmt.Errorf("expected client of form %s[=group+...] but got %q", clientIDForm(namespaced), token)
+		}
+		grant := ClientGrant{ClientID: clientID}
+		if !hasGroups {
+			grant.Groups = []string{allUpstreamsGroupName}
+		} else {
+			for _, g := range strings.Split(groups, "+") {
+				if g == "" {
+					return nil, fmt.Errorf("client %q: empty upstream group name in %q", client, groups)
+				}
+				grant.Groups = append(grant.Groups, g)
+			}
+		}
+		grants = append(grants, grant)
+	}
+	return grants, nil
+}
+
+// parseClientID parses a client given as namespace/key, as clients are
+// logged, or as a key alone in the namespace of clients authenticated by
+// certificate. If namespaced, clients may also be given as namespace:key,
+// e.g. ip:10.0.0.5, and a client given as a URI, e.g.
+// spiffe://example.com/web, is in the namespace of its scheme, with the whole
+// URI as its key. Otherwise a client containing ':' is a common name, e.g.
+// host:8443. It reports false if the namespace or key is empty, or, if
+// namespaced, the namespace is not a word of letters, digits and the
+// characters "+-._".
+func parseClientID(s string, namespaced bool) (core.ClientID, bool) {
+	if !namespaced {
+		if namespace, key, ok := strings.Cut(s, "/"); ok {
+			return core.ClientID{Namespace: namespace, Key: key}, namespace != "" && key != ""
+		}
+		return core.ClientID{Namespace: authn.DefaultNamespace, Key: s}, s != ""
+	}
+	colon := strings.IndexByte(s, ':')
+	slash := strings.IndexByte(s, '/')
+	switch {
+	case colon >= 0 && (slash < 0 || colon < slash):
+		namespace, key := s[:colon], s[colon+1:]
+		if strings.HasPrefix(key, "//") {
+			key = s
+		}
+		return core.ClientID{Namespace: namespace, Key: key}, isClientNamespace(namespace) && key != ""
+	case slash >= 0:
+		namespace, key := s[:slash], s[slash+1:]
+		return core.ClientID{Namespace: namespace, Key: key}, isClientNamespace(namespace) && key != ""
+	default:
+		return core.ClientID{Namespace: authn.DefaultNamespace, Key: s}, s != ""
+	}
+}
+
+// clientIDForm describes the form of the clients parsed by parseClientID.
+func clientIDForm(namespaced bool) string {
+	if namespaced {
+		return "[namespace:]key"
+	}
+	return "[namespace/]key"
+}
+
+// isClientNamespace reports if s may be the namespace of a client given to
+// parseClientID.
+func isClientNamespace(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, c := range s {
+		if !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || strings.ContainsRune("+-._", c)) {
+			return false
+		}
+	}
+	return true
+}
+
+// parseClientIDs parses a comma-separated list of clients, each given as
+// for parseClientID.
+func parseClientIDs(s string, namespaced bool) ([]core.ClientID, error) {
+	var clientIDs []core.ClientID
+	for _, token := range splitList(s) {
+		clientID, ok := parseClientID(token, namespaced)
+		if !ok {
+			return nil, fmt.Errorf("expected client of form %s but got %q", clientIDForm(namespaced), token)
+		}
+		clientIDs = append(clientIDs, clientID)
+	}
+	return clientIDs, nil
+}
+
+// validateAuthz checks the upstream groups and the clients granted them.
+func validateAuthz(c *Config) error {
+	violations := &InvalidConfig{}
+	upstreams := allUpstreams(c.Pools)
+	groups := map[string]bool{allUpstreamsGroupName: true}
+	for i, g := range c.UpstreamGroups {
+		field := indexedField("upstream-group", g.Name, i)
+		switch {
+		case g.Name == allUpstreamsGroupName:
+			violations.addf(field, "upstream group name %q is reserved", g.Name)
+		case groups[g.Name]:
+			violations.addf(field, "upstream group %q is defined more than once", g.Name)
+		}
+		groups[g.Name] = true
+		for _, u := range g.Upstreams {
+			if _, ok := upstreams[u]; !ok {
+				violations.addf(field, "upstream group %q has %s, which is not an upstream of any pool", g.Name, u.Address)
+			}
+		}
+		if len(g.Selector) > 0 && len(g.members(upstreams, c.UpstreamLabels)) == 0 {
+			violations.addf(field, "upstream group %q selects no upstream: no upstream of any pool has labels %s", g.Name, g.Selector)
+		}
+	}
+	restricted := make([]string, 0, len(c.UpstreamGroupCountries))
+	for name := range c.UpstreamGroupCountries {
+		restricted = append(restricted, name)
+	}
+	sort.Strings(restricted)
+	for _, name := range restricted {
+		if !groups[name] {
+			violations.addf("upstream-group-countries", "countries given for undefined upstream group %q", name)
+		}
+	}
+	restricted = restricted[:0]
+	for name := range c.UpstreamGroupFingerprints {
+		restricted = append(restricted, name)
+	}
+	sort.Strings(restricted)
+	for _, name := range restricted {
+		if !groups[name] {
+			violations.addf("upstream-group-fingerprints", "fingerprints given for undefined upstream group %q", name)
+		}
+	}
+	clients := make(map[core.ClientID]bool, len(c.AuthorizedClients))
+	for _, grant := range c.AuthorizedClients {
+		if clients[grant.ClientID] {
+			violations.addf("authzd-clients", "client %s is listed more than once", grant.ClientID)
+		}
+		clients[grant.ClientID] = true
+		for _, g := range grant.Groups {
+			if !groups[g] {
+				violations.addf("authzd-clients", "client %s is granted undefined upstream group %q", grant.ClientID, g)
+			}
+		}
+	}
+	if len(c.AuthorizedClients) == 0 {
+		violations.addf("authzd-clients", "no clients are authorized to access any upstream")
+	}
+	for _, g := range c.LimitExemptGroups {
+		if !groups[g] {
+			violations.addf("limit-exempt-groups", "limit exemption refers to undefined client group %q", g)
+		}
+	}
+	classes := make(map[string]bool, len(c.PriorityClasses))
+	for _, g := range c.PriorityClasses {
+		switch {
+		case g == forwarder.DefaultPriorityClass:
+			violations.addf("priority-classes", "priority class name %q is reserved", g)
+		case !groups[g]:
+			violations.addf("priority-classes", "priority class refers to undefined client group %q", g)
+		case classes[g]:
+			violations.addf("priority-classes", "priority class %q is listed more than once", g)
+		}
+		classes[g] = true
+	}
+	return violations.err()
+}
+
+// makeLimitExemptionsFromConfig returns the LimitExemptions of the clients
+// and client groups exempt from per-client limits, resolving groups with
+// groups, or nil if no client is exempt.
+func makeLimitExemptionsFromConfig(cfg *Config, groups forwarder.GroupResolver, registry *metrics.Registry) *forwarder.LimitExemptions {
+	if len(cfg.LimitExemptClients) == 0 && len(cfg.LimitExemptGroups) == 0 {
+		return nil
+	}
+	exemptions := &forwarder.LimitExemptions{
+		Clients:  make(map[core.ClientID]bool, len(cfg.LimitExemptClients)),
+		Groups:   make(map[string]bool, len(cfg.LimitExemptGroups)),
+		Resolver: groups,
+		Metrics:  forwarder.NewExemptionMetrics(registry),
+	}
+	for _, c := range cfg.LimitExemptClients {
+		exemptions.Clients[c] = true
+	}
+	for _, g := range cfg.LimitExemptGroups {
+		exemptions.Groups[g] = true
+	}
+	return exemptions
+}
+
+// makeAuthorizerFromConfig returns an Authorizer that grants each client the
+// upstreams of its upstream groups, whether listed or selected by their
+// labels, and restricted to clients located in the countries, and running
+// software with the TLS fingerprints, given for them. Each client is also made a member of a
+// client group of the same name as each upstream group, so that routes may
+// match on them. The upstreams of each client are cached as configured by
+// AuthzCacheSize and AuthzCacheTTL.
+func makeAuthorizerFromConfig(cfg *Config, registry *metrics.Registry) (forwarder.Authorizer, error) {
+	authzCfg := authz.Config{
+		GroupsByClientID:      make(map[core.ClientID][]authz.Group, len(cfg.AuthorizedClients)),
+		UpstreamGroupsByGroup: make(map[authz.Group][]authz.UpstreamGroup, len(cfg.UpstreamGroups)+1),
+		UpstreamsByUpstreamGroup: map[authz.UpstreamGroup]core.UpstreamSet{
+			{Key: allUpstreamsGroupName}: allUpstreams(cfg.Pools),
+		},
+	}
+	upstreams := allUpstreams(cfg.Pools)
+	for _, g := range cfg.UpstreamGroups {
+		authzCfg.UpstreamsByUpstreamGroup[authz.UpstreamGroup{Key: g.Name}] = g.members(upstreams, cfg.UpstreamLabels)
+	}
+	for ug := range authzCfg.UpstreamsByUpstreamGroup {
+		authzCfg.UpstreamGroupsByGroup[authz.Group{Key: ug.Key}] = []authz.UpstreamGroup{ug}
+	}
+	if len(cfg.UpstreamGroupCountries) > 0 {
+		authzCfg.GeoPoliciesByUpstreamGroup = make(map[authz.UpstreamGroup]geoip.Policy, len(cfg.UpstreamGroupCountries))
+		for name, countries := range cfg.UpstreamGroupCountries {
+			authzCfg.GeoPoliciesByUpstreamGroup[authz.UpstreamGroup{Key: name}] = geoip.Policy{AllowCountries: countries}
+		}
+	}
+	if len(cfg.UpstreamGroupFingerprints) > 0 {
+		authzCfg.FingerprintsByUpstreamGroup = make(map[authz.UpstreamGroup]map[string]bool, len(cfg.UpstreamGroupFingerprints))
+		for name, fingerprints := range cfg.UpstreamGroupFingerprints {
+			allowed := make(map[string]bool, len(fingerprints))
+			for _, fingerprint := range fingerprints {
+				fingerprint, _ = forwarder.ParseFingerprint(cfg.TLSFingerprintMethod, fingerprint)
+				allowed[fingerprint] = true
+			}
+			authzCfg.FingerprintsByUpstreamGroup[authz.UpstreamGroup{Key: name}] = allowed
+		}
+	}
+	for _, grant := range cfg.AuthorizedClients {
+		groups := make([]authz.Group, len(grant.Groups))
+		for i, g := range grant.Groups {
+			groups[i] = authz.Group{Key: g}
+		}
+		authzCfg.GroupsByClientID[grant.ClientID] = groups
+	}
+	cacheCfg := authz.CacheConfig{
+		MaxClients: cfg.AuthzCacheSize,
+		TTL:        cfg.AuthzCacheTTL,
+	}
+	return authz.NewCachingAuthorizer(authzCfg, cacheCfg, authz.NewCacheMetrics(registry)), nil
+}
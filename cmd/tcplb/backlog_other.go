@@ -0,0 +1,15 @@
+//go:build windows || plan9
+
+package main
+
+import (
+	"errors"
+	"net"
+)
+
+// setListenBacklog sets the length of the queue of connections waiting to
+// be accepted by a listening socket. The backlog cannot be changed once
+// listening on this platform.
+func setListenBacklog(listener net.Listener, backlog int) error {
+	return errors.New("setting the listen backlog is unsupported on this platform")
+}
@@ -0,0 +1,30 @@
+//go:build !windows && !plan9
+
+package main
+
+import (
+	"errors"
+	"net"
+	"syscall"
+)
+
+// setListenBacklog sets the length of the queue of connections waiting to
+// be accepted by a listening socket, by calling listen(2) on it again.
+func setListenBacklog(listener net.Listener, backlog int) error {
+	sc, ok := listener.(syscall.Conn)
+	if !ok {
+		return errors.New("listener does not expose its socket")
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var listenErr error
+	err = raw.Control(func(fd uintptr) {
+		listenErr = syscall.Listen(int(fd), backlog)
+	})
+	if err != nil {
+		return err
+	}
+	return listenErr
+}
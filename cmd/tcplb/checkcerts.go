@@ -0,0 +1,192 @@
+package main
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"strings"
+	"tcplb/lib/certcheck"
+	"time"
+)
+
+const (
+	checkCertsCommandName = "check-certs"
+	checkCertsDescription = `inspects the certificates, private keys and CA bundles configured by the
+server flags given after --, as tcplb would load them: the certificates and
+client CAs of listeners and of the admin listener, and the client
+certificates and CAs of pools. it reports expiry dates, key algorithms,
+subject names, chain completeness and whether each key matches its
+certificate, with hints on how to remedy each problem found. client
+certificates given by -client-cert are checked against the client CA of each
+listener that authenticates clients by certificate. fails if any problem
+would stop tcplb from starting, or clients from connecting.
+
+example:
+  tcplb check-certs -client-cert alice.pem -- -tls-cert server.pem -tls-key server-key.pem -authn mtls -tls-client-ca ca.pem
+`
+)
+
+// checkCertsOptions is the configuration of the "tcplb check-certs"
+// command.
+type checkCertsOptions struct {
+	Config        *Config
+	ClientCerts   []string      // ClientCerts are the paths of client certificates to check against the client CAs of listeners.
+	ExpiryWarning time.Duration // ExpiryWarning is how long before they expire that certificates are warned of.
+	JSON          bool          // JSON writes the reports as JSON.
+}
+
+// parseCheckCertsFlags parses the command line of the "tcplb check-certs"
+// command, with the server flags that follow --.
+func parseCheckCertsFlags(argv []string, stderr io.Writer) (checkCertsOptions, error) {
+	var opts checkCertsOptions
+	flagSet := flag.NewFlagSet(commandName+" "+checkCertsCommandName, flag.ContinueOnError)
+	flagSet.SetOutput(stderr)
+	flagSet.Usage = func() {
+		fmt.Fprintf(stderr, "usage: %s %s [flags] -- [server flags]\n\n%s\nflags:\n", commandName, checkCertsCommandName, checkCertsDescription)
+		flagSet.PrintDefaults()
+	}
+	clientCerts := flagSet.String("client-cert", "", "comma-separated paths of PEM client certificates, each followed by any intermediates, to check against the client CA of each listener that authenticates clients by certificate.")
+	flagSet.DurationVar(&opts.ExpiryWarning, "expiry-warning", certcheck.DefaultExpiryWarning, "warn of certificates that expire within this long.")
+	flagSet.BoolVar(&opts.JSON, "json", false, "write the reports as JSON.")
+	if err := flagSet.Parse(argv[1:]); err != nil {
+		return opts, err
+	}
+	serverArgs := flagSet.Args()
+	if len(serverArgs) > 0 && argv[len(argv)-len(serverArgs)-1] != "--" {
+		return opts, fmt.Errorf("unexpected arguments %q. give server flags after --", serverArgs)
+	}
+	opts.ClientCerts = splitList(*clientCerts)
+	cfg, err := newConfigFromFlags(append([]string{commandName}, serverArgs...))
+	if err != nil {
+		return opts, err
+	}
+	opts.Config = cfg
+	return opts, nil
+}
+
+// checkConfiguredCerts returns a report on each certificate, key pair and
+// CA bundle configured by cfg, and on each of clientCerts checked against
+// the client CAs of listeners. Files configured more than once, e.g. for
+// each pool, are checked once.
+func checkConfiguredCerts(cfg *Config, clientCerts []string, checker *certcheck.Checker) []*certcheck.Report {
+	reports := []*certcheck.Report{}
+	checked := make(map[string]bool)
+	once := func(key string) bool {
+		if checked[key] {
+			return false
+		}
+		checked[key] = true
+		return true
+	}
+	checkCAs := func(name, caFile string) {
+		if caFile != "" && once("ca:"+caFile) {
+			reports = append(reports, checker.CheckCABundle(name, caFile))
+		}
+	}
+	for _, l := range allListeners(cfg) {
+		if !l.TLS.Enabled() {
+			continue
+		}
+		if once("server:" + l.TLS.CertFile + ":" + l.TLS.KeyFile) {
+			reports = append(reports, checker.CheckKeyPair(fmt.Sprintf("listener %q certificate", l.Name), l.TLS.CertFile, l.TLS.KeyFile, x509.ExtKeyUsageServerAuth))
+		}
+		if l.Authn != authnModeMTLS && l.Authn != authnModeOptionalMTLS {
+			continue
+		}
+		checkCAs(fmt.Sprintf("listener %q client CA", l.Name), l.TLS.ClientCAFile)
+		for _, clientCert := range clientCerts {
+			if l.TLS.ClientCAFile != "" && once("client:"+clientCert+":"+l.TLS.ClientCAFile) {
+				reports = append(reports, checker.CheckIssuedBy(fmt.Sprintf("client certificate for listener %q", l.Name), clientCert, l.TLS.ClientCAFile, x509.ExtKeyUsageClientAuth))
+			}
+		}
+	}
+	if cfg.AdminTLS.Enabled() {
+		reports = append(reports, checker.CheckKeyPair("admin listener certificate", cfg.AdminTLS.CertFile, cfg.AdminTLS.KeyFile, x509.ExtKeyUsageServerAuth))
+		checkCAs("admin listener client CA", cfg.AdminTLS.ClientCAFile)
+	}
+	for _, p := range cfg.Pools {
+		if !p.TLS.Enabled {
+			continue
+		}
+		if p.TLS.CertFile != "" && once("upstream-client:"+p.TLS.CertFile+":"+p.TLS.KeyFile) {
+			reports = append(reports, checker.CheckKeyPair(fmt.Sprintf("pool %q client certificate", p.Name), p.TLS.CertFile, p.TLS.KeyFile, x509.ExtKeyUsageClientAuth))
+		}
+		checkCAs(fmt.Sprintf("pool %q upstream CA", p.Name), p.TLS.CAFile)
+	}
+	return reports
+}
+
+// writeCertReports writes reports as text, one finding per line, each
+// problem followed by its hint.
+func writeCertReports(w io.Writer, reports []*certcheck.Report) error {
+	var b strings.Builder
+	var errs, warnings int
+	for _, r := range reports {
+		fmt.Fprintf(&b, "%s: %s", r.Name, r.CertFile)
+		if r.KeyFile != "" {
+			fmt.Fprintf(&b, " (key %s)", r.KeyFile)
+		}
+		b.WriteString("\n")
+		for i, cert := range r.Certificates {
+			fmt.Fprintf(&b, "  certificate %d: %s, issued by %s, %s, valid %s to %s", i, cert.Subject, cert.Issuer, cert.KeyAlgorithm,
+				cert.NotBefore.UTC().Format(time.RFC3339), cert.NotAfter.UTC().Format(time.RFC3339))
+			if names := append(append([]string(nil), cert.DNSNames...), cert.IPAddresses...); len(names) > 0 {
+				fmt.Fprintf(&b, ", names %s", strings.Join(names, ", "))
+			}
+			b.WriteString("\n")
+		}
+		for _, f := range r.Findings {
+			fmt.Fprintf(&b, "  %s: %s\n", f.Severity, f.Message)
+			if f.Hint != "" {
+				fmt.Fprintf(&b, "    hint: %s\n", f.Hint)
+			}
+			switch f.Severity {
+			case certcheck.SeverityError:
+				errs++
+			case certcheck.SeverityWarning:
+				warnings++
+			}
+		}
+	}
+	if len(reports) == 0 {
+		b.WriteString("no certificates are configured. give the server flags after --\n")
+	}
+	fmt.Fprintf(&b, "%d error(s), %d warning(s)\n", errs, warnings)
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// runCheckCerts implements the "tcplb check-certs" command, which diagnoses
+// mistakes in the configured certificates before the server is started.
+func runCheckCerts(argv []string, stdout, stderr io.Writer) int {
+	opts, err := parseCheckCertsFlags(argv, stderr)
+	if errors.Is(err, flag.ErrHelp) {
+		return exitInvalidConfig
+	}
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return exitInvalidConfig
+	}
+
+	reports := checkConfiguredCerts(opts.Config, opts.ClientCerts, &certcheck.Checker{ExpiryWarning: opts.ExpiryWarning})
+	if opts.JSON {
+		enc := json.NewEncoder(stdout)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(reports)
+	} else {
+		err = writeCertReports(stdout, reports)
+	}
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return exitServerError
+	}
+	for _, r := range reports {
+		if !r.OK() {
+			return exitInvalidConfig
+		}
+	}
+	return exitOK
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/stretchr/testify/require"
+	"io"
+	"tcplb/lib/certcheck"
+	"tcplb/lib/testbed"
+	"testing"
+)
+
+func TestRunCheckCerts(t *testing.T) {
+	tb := testbed.New(t)
+	server := tb.Server(t, "tcplb.test")
+	other := tb.Server(t, "other.test")
+	alice := tb.Client(t, "alice")
+	upstreamCA := testbed.New(t)
+	serverArgs := []string{
+		"--",
+		"-upstreams", "10.0.0.1:80",
+		"-authn", "mtls",
+		"-tls-cert", server.CertFile,
+		"-tls-key", server.KeyFile,
+		"-tls-client-ca", tb.CAFile,
+		"-listener", "name=internal,address=127.0.0.1:5000,tls-cert=" + server.CertFile + ",tls-key=" + server.KeyFile,
+		"-upstream-tls",
+		"-upstream-tls-ca", upstreamCA.CAFile,
+	}
+
+	var stdout, stderr bytes.Buffer
+	status := runCheckCerts(append([]string{checkCertsCommandName, "-client-cert", alice.CertFile, "-expiry-warning", "1h", "-json"}, serverArgs...), &stdout, &stderr)
+	require.Equal(t, exitOK, status, stderr.String())
+	var reports []certcheck.Report
+	require.NoError(t, json.Unmarshal(stdout.Bytes(), &reports))
+	var names []string
+	for _, r := range reports {
+		names = append(names, r.Name)
+		require.True(t, r.OK(), r.Findings)
+	}
+	// The certificate shared by both listeners is checked once.
+	require.Equal(t, []string{
+		`listener "main" certificate`,
+		`listener "main" client CA`,
+		`client certificate for listener "main"`,
+		`pool "default" upstream CA`,
+	}, names)
+
+	// A key that does not match its certificate is an error.
+	stdout.Reset()
+	stderr.Reset()
+	serverArgs[8] = other.KeyFile
+	status = runCheckCerts(append([]string{checkCertsCommandName, "-expiry-warning", "1h"}, serverArgs...), &stdout, &stderr)
+	require.Equal(t, exitInvalidConfig, status)
+	require.Contains(t, stdout.String(), "error: private key does not match the certificate")
+	require.Contains(t, stdout.String(), "hint: ")
+
+	// Certificates that expire soon are warned of, but do not fail.
+	stdout.Reset()
+	status = runCheckCerts([]string{checkCertsCommandName, "--", "-tls-cert", server.CertFile, "-tls-key", server.KeyFile}, &stdout, &stderr)
+	require.Equal(t, exitOK, status)
+	require.Contains(t, stdout.String(), "warning: certificate 0, CN=tcplb.test, expires at")
+	require.Contains(t, stdout.String(), "0 error(s), 2 warning(s)")
+}
+
+func TestParseCheckCertsFlagsErrors(t *testing.T) {
+	_, err := parseCheckCertsFlags([]string{checkCertsCommandName, "-tls-cert", "server.pem"}, io.Discard)
+	require.Error(t, err)
+	_, err = parseCheckCertsFlags([]string{checkCertsCommandName, "server.pem"}, io.Discard)
+	require.Error(t, err)
+	opts, err := parseCheckCertsFlags([]string{checkCertsCommandName, "-client-cert", "a.pem,b.pem", "--", "-tls-cert", "server.pem"}, io.Discard)
+	require.NoError(t, err)
+	require.Equal(t, []string{"a.pem", "b.pem"}, opts.ClientCerts)
+	require.Equal(t, "server.pem", opts.Config.ListenTLS.CertFile)
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/netip"
+	"sync"
+	"tcplb/lib/ipfilter"
+	"tcplb/lib/metrics"
+	"tcplb/lib/slog"
+)
+
+// configHash returns a canonical hash of the effective configuration: cfg,
+// together with the IP filter rules in effect, which are reloaded from
+// IPFilterFile while serving. Equal configurations have equal hashes, in
+// any process, however their flags were ordered. Other files named by cfg,
+// e.g. certificates, are identified by path only.
+//
+// Config is hashed via its Go syntax representation, in which maps are
+// sorted by key, so it must not hold pointers.
+func configHash(cfg *Config, rules ipfilter.Rules) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%#v\n", *cfg)
+	writePrefixes := func(kind string, prefixes []netip.Prefix) {
+		for _, p := range prefixes {
+			_, _ = io.WriteString(h, kind+" "+p.String()+"\n")
+		}
+	}
+	writePrefixes("allow", rules.Allow)
+	writePrefixes("deny", rules.Deny)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// configVersion tracks the hash of the effective configuration as the IP
+// filter rules are reloaded, logging each change, and recording the leading
+// 8 bytes of the hash in a gauge, so that operators can check which
+// configuration each instance is running.
+//
+// Multiple goroutines may invoke methods on a configVersion simultaneously.
+type configVersion struct {
+	logger slog.Logger
+	cfg    *Config
+	gauge  *metrics.Gauge
+
+	mu   sync.Mutex // mu guards hash
+	hash string
+}
+
+// newConfigVersion returns the configVersion of cfg with the given initial
+// rules, logging its hash.
+func newConfigVersion(logger slog.Logger, cfg *Config, rules ipfilter.Rules, registry *metrics.Registry) *configVersion {
+	v := &configVersion{logger: logger, cfg: cfg, gauge: registry.Gauge("config_hash")}
+	v.update(rules)
+	return v
+}
+
+// update records the hash of the configuration with the given rules,
+// logging it if it has changed.
+func (v *configVersion) update(rules ipfilter.Rules) {
+	hash := configHash(v.cfg, rules)
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if hash == v.hash {
+		return
+	}
+	v.hash = hash
+	sum, _ := hex.DecodeString(hash)
+	v.gauge.Set(int64(binary.BigEndian.Uint64(sum)))
+	v.logger.Info(&slog.LogRecord{Msg: "effective config hash", Details: hash})
+}
+
+// Hash returns the hash of the effective configuration.
+func (v *configVersion) Hash() string {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return v.hash
+}
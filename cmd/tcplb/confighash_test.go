@@ -0,0 +1,53 @@
+package main
+
+import (
+	"github.com/stretchr/testify/require"
+	"net/netip"
+	"tcplb/lib/ipfilter"
+	"tcplb/lib/metrics"
+	"tcplb/lib/slog"
+	"testing"
+)
+
+func TestConfigHash(t *testing.T) {
+	hashOf := func(args ...string) string {
+		cfg, err := newConfigFromFlags(append([]string{commandName}, args...))
+		require.NoError(t, err)
+		return configHash(cfg, ipfilter.Rules{})
+	}
+	a := hashOf("-upstreams", "10.0.0.1:80", "-upstream-labels", "10.0.0.1:80 zone=a tier=primary", "-dial-timeout", "3s")
+	require.Len(t, a, 64)
+	// The order of flags, and of map entries, does not matter.
+	require.Equal(t, a, hashOf("-dial-timeout", "3s", "-upstream-labels", "10.0.0.1:80 tier=primary zone=a", "-upstreams", "10.0.0.1:80"))
+	require.NotEqual(t, a, hashOf("-upstreams", "10.0.0.1:80", "-upstream-labels", "10.0.0.1:80 zone=b tier=primary", "-dial-timeout", "3s"))
+
+	cfg, err := newConfigFromFlags([]string{commandName, "-upstreams", "10.0.0.1:80"})
+	require.NoError(t, err)
+	rules := ipfilter.Rules{Deny: []netip.Prefix{netip.MustParsePrefix("192.0.2.0/24")}}
+	require.NotEqual(t, configHash(cfg, ipfilter.Rules{}), configHash(cfg, rules))
+	require.Equal(t, configHash(cfg, rules), configHash(cfg, ipfilter.Rules{Deny: []netip.Prefix{netip.MustParsePrefix("192.0.2.0/24")}}))
+}
+
+func TestConfigVersion(t *testing.T) {
+	cfg, err := newConfigFromFlags([]string{commandName, "-upstreams", "10.0.0.1:80"})
+	require.NoError(t, err)
+	logger := &slog.RecordingLogger{}
+	registry := metrics.NewRegistry()
+
+	v := newConfigVersion(logger, cfg, ipfilter.Rules{}, registry)
+	first := v.Hash()
+	require.Equal(t, configHash(cfg, ipfilter.Rules{}), first)
+	require.NotZero(t, registry.Gauge("config_hash").Value())
+	require.Len(t, logger.Events, 1)
+	require.Equal(t, first, logger.Events[0].Details)
+
+	// Reloading unchanged rules is not logged.
+	v.update(ipfilter.Rules{})
+	require.Len(t, logger.Events, 1)
+
+	gauge := registry.Gauge("config_hash").Value()
+	v.update(ipfilter.Rules{Allow: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}})
+	require.NotEqual(t, first, v.Hash())
+	require.NotEqual(t, gauge, registry.Gauge("config_hash").Value())
+	require.Len(t, logger.Events, 2)
+}
@@ -1,9 +1,33 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
 	"github.com/stretchr/testify/require"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"tcplb/lib/accesslog"
+	"tcplb/lib/authn"
+	"tcplb/lib/banlist"
+	"tcplb/lib/conntable"
 	"tcplb/lib/core"
+	"tcplb/lib/dialer"
+	"tcplb/lib/events"
+	"tcplb/lib/forwarder"
+	"tcplb/lib/geoip"
+	"tcplb/lib/healthcheck"
+	"tcplb/lib/ipfilter"
+	"tcplb/lib/limiter"
+	"tcplb/lib/metrics"
+	"tcplb/lib/quota"
+	"tcplb/lib/routing"
+	"tcplb/lib/slog"
+	"tcplb/lib/testbed"
 	"testing"
+	"time"
 )
 
 func TestUpstreamListValueErrorHelp(t *testing.T) {
@@ -12,5 +36,1720 @@ func TestUpstreamListValueErrorHelp(t *testing.T) {
 	}
 	err := v.Set("localhost:443,127.*.*.*,127.0.0.1:9021")
 	require.Error(t, err)
-	require.Equal(t, "expected upstream address of form host:port but got 127.*.*.*", err.Error())
+	require.Equal(t, `invalid upstream address "127.*.*.*": missing port: expected host:port or [IPv6]:port`, err.Error())
+}
+
+func TestParseUpstreamAddress(t *testing.T) {
+	scenarios := []struct {
+		name          string
+		address       string
+		defaultPort   string
+		expected      string
+		expectedError string
+	}{
+		{name: "host name", address: "backend-1.example.com:443", expected: "backend-1.example.com:443"},
+		{name: "fully qualified host name", address: "example.com.:443", expected: "example.com.:443"},
+		{name: "underscore in host name", address: "_svc.example.com:80", expected: "_svc.example.com:80"},
+		{name: "IPv4", address: "10.0.0.1:80", expected: "10.0.0.1:80"},
+		{name: "IPv6", address: "[::1]:80", expected: "[::1]:80"},
+		{name: "IPv6 with zone", address: "[fe80::1%eth0]:80", expected: "[fe80::1%eth0]:80"},
+		{name: "IPv6 with default port", address: "[2001:db8::1]", defaultPort: "8080", expected: "[2001:db8::1]:8080"},
+		{name: "IPv4 with default port", address: "10.0.0.1", defaultPort: "8080", expected: "10.0.0.1:8080"},
+		{name: "empty", address: "", expectedError: "empty address"},
+		{name: "missing port", address: "10.0.0.1", expectedError: "missing port: expected host:port or [IPv6]:port"},
+		{name: "missing host", address: ":80", expectedError: "missing host"},
+		{name: "IPv6 without brackets", address: "::1:80", expectedError: "IPv6 addresses must be in brackets, e.g. [::1]:443"},
+		{name: "IPv6 without brackets or port", address: "2001:db8::1", defaultPort: "80", expectedError: "IPv6 addresses must be in brackets, e.g. [::1]:443"},
+		{name: "not IPv6 in brackets", address: "[example.com]:80", expectedError: `"example.com" is in brackets, but is not an IPv6 address`},
+		{name: "empty zone", address: "[fe80::1%]:80", expectedError: `IPv6 address "fe80::1%" has an empty zone`},
+		{name: "zone without brackets", address: "10.0.0.1%eth0:80", expectedError: `"10.0.0.1%eth0" has a zone, but only IPv6 addresses may, in brackets, e.g. [fe80::1%eth0]:443`},
+		{name: "bad character", address: "exa mple.com:80", expectedError: `host name "exa mple.com" contains ' ': expected only letters, digits, hyphens and underscores`},
+		{name: "empty label", address: "example..com:80", expectedError: `host name "example..com" has an empty label`},
+		{name: "hyphen", address: "-example.com:80", expectedError: `host name "-example.com" has a label that starts or ends with a hyphen`},
+		{name: "long label", address: strings.Repeat("a", 64) + ".com:80", expectedError: "host name \"" + strings.Repeat("a", 64) + ".com\" has a label longer than 63 characters"},
+		{name: "port zero", address: "10.0.0.1:0", expectedError: `port "0" must be a number from 1 to 65535`},
+		{name: "port too large", address: "10.0.0.1:65536", expectedError: `port "65536" must be a number from 1 to 65535`},
+		{name: "named port", address: "10.0.0.1:https", expectedError: `port "https" must be a number from 1 to 65535`},
+	}
+
+	for _, s := range scenarios {
+		t.Run(s.name, func(t *testing.T) {
+			address, err := parseUpstreamAddress(s.address, s.defaultPort)
+			if s.expectedError != "" {
+				require.EqualError(t, err, s.expectedError)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, s.expected, address)
+		})
+	}
+}
+
+func TestCheckListenAddress(t *testing.T) {
+	for _, address := range []string{":4321", "0.0.0.0:0", "[::]:4321", "[fe80::1%lo]:4321", "localhost:4321"} {
+		require.NoError(t, checkListenAddress(address), address)
+	}
+	for _, address := range []string{"", "4321", "::1:4321", "[localhost]:4321", "localhost:65536", "local host:4321"} {
+		require.Error(t, checkListenAddress(address), address)
+	}
+}
+
+func TestConfigFromFlagsPoolsAndRoutes(t *testing.T) {
+	cfg, err := newConfigFromFlags([]string{
+		commandName,
+		"-upstreams", "10.0.0.1:80",
+		"-max-conns-per-client", "7",
+		"-max-clients", "100",
+		"-dial-policy", "p2c",
+		"-max-dial-attempts", "4",
+		"-half-open-timeout", "30s",
+		"-pool", "name=web upstreams=10.0.1.1:80,10.0.1.2:80 max-conns-per-client=3 max-clients=20 healthcheck-interval=0s policy=weighted-round-robin weights=10.0.1.1:80=4 retry-timeout=2s max-dial-attempts=2 half-open-timeout=5s",
+		"-route", "pool=web sni=*.example.com",
+	})
+	require.NoError(t, err)
+	require.NoError(t, cfg.Validate())
+	require.Len(t, cfg.Pools, 2)
+	// Idle connections are not closed unless an idle timeout is given.
+	require.Zero(t, cfg.IdleTimeout)
+
+	defaultPool := cfg.Pools[0]
+	require.Equal(t, defaultPoolName, defaultPool.Name)
+	require.Equal(t, []core.Upstream{{Network: "tcp", Address: "10.0.0.1:80"}}, defaultPool.Upstreams)
+	require.Equal(t, int64(7), defaultPool.MaxConnectionsPerClient)
+	require.Equal(t, int64(100), defaultPool.MaxConcurrentClients)
+	require.Equal(t, defaultHealthCheckInterval, defaultPool.HealthCheckInterval)
+	require.Equal(t, "p2c", defaultPool.Policy)
+	require.Equal(t, defaultRetryTimeout, defaultPool.RetryTimeout)
+	require.Equal(t, 4, defaultPool.MaxDialAttempts)
+	require.Equal(t, 30*time.Second, defaultPool.HalfOpenTimeout)
+
+	web := cfg.Pools[1]
+	require.Equal(t, "web", web.Name)
+	require.Len(t, web.Upstreams, 2)
+	require.Equal(t, int64(3), web.MaxConnectionsPerClient)
+	require.Equal(t, int64(20), web.MaxConcurrentClients)
+	require.Equal(t, time.Duration(0), web.HealthCheckInterval)
+	require.Equal(t, "weighted-round-robin", web.Policy)
+	require.Equal(t, map[core.Upstream]int{{Network: "tcp", Address: "10.0.1.1:80"}: 4}, web.Weights)
+	require.Equal(t, 2*time.Second, web.RetryTimeout)
+	require.Equal(t, 2, web.MaxDialAttempts)
+	require.Equal(t, defaultDialTimeout, web.DialTimeout)
+	require.Equal(t, 5*time.Second, web.HalfOpenTimeout)
+
+	router := makeRouterFromConfig(cfg)
+	pool, ok := router.Route(routing.Request{SNI: "a.example.com"})
+	require.True(t, ok)
+	require.Equal(t, "web", pool)
+	pool, ok = router.Route(routing.Request{})
+	require.True(t, ok)
+	require.Equal(t, defaultPoolName, pool)
+}
+
+func TestConfigFromFlagsUpstreamDefaultPort(t *testing.T) {
+	// The default port applies to upstreams given before it, too.
+	cfg, err := newConfigFromFlags([]string{
+		commandName,
+		"-upstreams", "10.0.0.1,10.0.0.2:8080,[::1]",
+		"-upstream-labels", "10.0.0.1 zone=a",
+		"-upstream-group", "web=10.0.1.1",
+		"-pool", "name=web upstreams=10.0.1.1,10.0.1.2 policy=weighted-round-robin weights=10.0.1.1=3",
+		"-upstream-default-port", "80",
+	})
+	require.NoError(t, err)
+	require.NoError(t, cfg.Validate())
+	a := core.Upstream{Network: "tcp", Address: "10.0.0.1:80"}
+	require.Equal(t, []core.Upstream{
+		a,
+		{Network: "tcp", Address: "10.0.0.2:8080"},
+		{Network: "tcp", Address: "[::1]:80"},
+	}, cfg.Upstreams)
+	require.Equal(t, map[core.Upstream]core.Labels{a: {"zone": "a"}}, cfg.UpstreamLabels)
+	web := core.Upstream{Network: "tcp", Address: "10.0.1.1:80"}
+	require.Equal(t, []core.Upstream{web}, cfg.UpstreamGroups[0].Upstreams)
+	require.Equal(t, []core.Upstream{web, {Network: "tcp", Address: "10.0.1.2:80"}}, cfg.Pools[1].Upstreams)
+	require.Equal(t, map[core.Upstream]int{web: 3}, cfg.Pools[1].Weights)
+
+	for _, args := range [][]string{
+		{"-upstreams", "10.0.0.1"},
+		{"-upstreams", "10.0.0.1", "-upstream-default-port", "http"},
+		{"-upstreams", "10.0.0.1", "-upstream-default-port", "0"},
+		{"-upstreams", "10.0.0.1:80", "-pool", "name=web upstreams=10.0.1.1"},
+	} {
+		_, err := newConfigFromFlags(append([]string{commandName}, args...))
+		require.Error(t, err, args)
+	}
+}
+
+func TestConfigValidatePools(t *testing.T) {
+	scenarios := map[string][]string{
+		"no upstreams":     {},
+		"undefined pool":   {"-upstreams", "10.0.0.1:80", "-route", "pool=web"},
+		"duplicate pool":   {"-pool", "name=web upstreams=10.0.0.1:80", "-pool", "name=web upstreams=10.0.0.2:80"},
+		"empty pool":       {"-pool", "name=web"},
+		"unknown policy":   {"-pool", "name=web upstreams=10.0.0.1:80 policy=psychic"},
+		"unnamed pool":     {"-pool", "upstreams=10.0.0.1:80"},
+		"unknown default":  {"-upstreams", "10.0.0.1:80", "-dial-policy", "psychic"},
+		"foreign weight":   {"-pool", "name=web upstreams=10.0.0.1:80 weights=10.0.0.2:80=2"},
+		"zero weight":      {"-pool", "name=web upstreams=10.0.0.1:80 weights=10.0.0.1:80=0"},
+		"no dial timeout":  {"-pool", "name=web upstreams=10.0.0.1:80 dial-timeout=0s"},
+		"bad attempts":     {"-pool", "name=web upstreams=10.0.0.1:80 max-dial-attempts=-1"},
+		"shadows default":  {"-upstreams", "10.0.0.1:80", "-pool", "name=default upstreams=10.0.0.2:80"},
+		"bad proxy":        {"-pool", "name=web upstreams=10.0.0.1:80 proxy=socks4://10.0.0.9:1080"},
+		"bad proxy proto":  {"-pool", "name=web upstreams=10.0.0.1:80 proxy-protocol=v1"},
+		"tls cert no key":  {"-pool", "name=web upstreams=10.0.0.1:80 tls=true tls-cert=cert.pem"},
+		"bad tlvs":         {"-proxy-protocol", "v2", "-pool", "name=web upstreams=10.0.0.1:80 proxy-protocol-tlvs=colour=0xe0"},
+		"alpn without tls": {"-upstreams", "10.0.0.1:80", "-tls-alpn", "h2"},
+	}
+	for name, args := range scenarios {
+		cfg, err := newConfigFromFlags(append([]string{commandName}, args...))
+		require.NoError(t, err, name)
+		require.Error(t, cfg.Validate(), name)
+	}
+}
+
+func TestConfigValidateReportsAllViolations(t *testing.T) {
+	cfg, err := newConfigFromFlags([]string{
+		commandName,
+		"-upstreams", "10.0.0.1:80",
+		"-pool", "name=web upstreams=10.0.0.2:80 dial-timeout=0s retry-backoff=-1s",
+		"-route", "pool=nope",
+		"-trace-sample-ratio", "2",
+		"-log-level", "loud",
+	})
+	require.NoError(t, err)
+	err = cfg.Validate()
+	var invalid *InvalidConfig
+	require.ErrorAs(t, err, &invalid)
+	fields := make([]string, len(invalid.Violations))
+	for i, v := range invalid.Violations {
+		fields[i] = v.Field
+	}
+	require.Equal(t, []string{
+		"pool[web].dial-timeout",
+		"pool[web].retry-backoff",
+		"route[0]",
+		"trace-sample-ratio",
+		"log-level",
+	}, fields)
+	require.ErrorContains(t, err, "5 configuration violation(s): pool[web].dial-timeout: dial timeout must be positive; ")
+}
+
+func TestConfigValidateListenAddresses(t *testing.T) {
+	cfg, err := newConfigFromFlags([]string{
+		commandName,
+		"-upstreams", "[2001:db8::1]:80",
+		"-listen-address", "::1:4321",
+		"-listener", "name=internal address=[fe80::1%]:4322",
+		"-admin-listen-address", "[::1]:65536",
+	})
+	require.NoError(t, err)
+	err = cfg.Validate()
+	var invalid *InvalidConfig
+	require.ErrorAs(t, err, &invalid)
+	require.Len(t, invalid.Violations, 3)
+	require.EqualError(t, invalid.Violations[0], "listener[main].address: IPv6 addresses must be in brackets, e.g. [::1]:443")
+	require.EqualError(t, invalid.Violations[1], `listener[internal].address: IPv6 address "fe80::1%" has an empty zone`)
+	require.EqualError(t, invalid.Violations[2], `admin-listen-address: port "65536" must be a number from 0 to 65535`)
+}
+
+func TestConfigFromFlagsEgressProxy(t *testing.T) {
+	cfg, err := newConfigFromFlags([]string{
+		commandName,
+		"-upstreams", "10.0.0.1:80",
+		"-egress-proxy", "socks5://10.0.0.9:1080",
+		"-pool", "name=web upstreams=10.0.1.1:80 proxy=http://10.0.0.9:3128",
+	})
+	require.NoError(t, err)
+	require.NoError(t, cfg.Validate())
+	require.Equal(t, "socks5://10.0.0.9:1080", cfg.Pools[0].EgressProxy)
+	require.Equal(t, "http://10.0.0.9:3128", cfg.Pools[1].EgressProxy)
+
+	upstreamDialer, err := makeUpstreamDialerFromConfig(&cfg.Pools[1], time.Second)
+	require.NoError(t, err)
+	proxyDialer, ok := upstreamDialer.(*dialer.ProxyDialer)
+	require.True(t, ok)
+	require.Equal(t, dialer.ProxyHTTPConnect, proxyDialer.Proxy.Scheme)
+	require.Equal(t, "10.0.0.9:3128", proxyDialer.Proxy.Host)
+
+	cfg.Pools[1].EgressProxy = ""
+	upstreamDialer, err = makeUpstreamDialerFromConfig(&cfg.Pools[1], time.Second)
+	require.NoError(t, err)
+	require.IsType(t, &dialer.TimeoutDialer{}, upstreamDialer)
+}
+
+func TestConfigFromFlagsDebugListenAddressAlias(t *testing.T) {
+	cfg, err := newConfigFromFlags([]string{commandName, "-upstreams", "10.0.0.1:80", "-debug-listen-address", "127.0.0.1:9090"})
+	require.NoError(t, err)
+	require.Equal(t, "127.0.0.1:9090", cfg.AdminListenAddress)
+}
+
+func TestConfigFromFlagsProxyProtocol(t *testing.T) {
+	cfg, err := newConfigFromFlags([]string{
+		commandName,
+		"-upstreams", "10.0.0.1:80",
+		"-proxy-protocol", "v2",
+		"-proxy-protocol-tlvs", "client-id=0xe0,conn-id=0xe1",
+		"-pool", "name=web upstreams=10.0.1.1:80 proxy-protocol=none",
+		"-pool", "name=api upstreams=10.0.2.1:80 proxy-protocol-tlvs=alpn=0x01",
+	})
+	require.NoError(t, err)
+	require.NoError(t, cfg.Validate())
+
+	pools, err := makePoolsFromConfig(cfg, &slog.RecordingLogger{}, nil, nil, metrics.NewRegistry())
+	require.NoError(t, err)
+	require.Equal(t, &forwarder.ProxyHeaderConfig{TLVs: forwarder.ProxyHeaderTLVs{ClientID: 0xe0, ConnID: 0xe1}}, pools[defaultPoolName].ProxyHeader)
+	require.Nil(t, pools["web"].ProxyHeader)
+	require.Equal(t, &forwarder.ProxyHeaderConfig{TLVs: forwarder.ProxyHeaderTLVs{ALPN: 0x01}}, pools["api"].ProxyHeader)
+}
+
+func TestConfigFromFlagsUpstreamTLS(t *testing.T) {
+	tb := testbed.New(t)
+	client := tb.Client(t, "tcplb")
+	cfg, err := newConfigFromFlags([]string{
+		commandName,
+		"-upstreams", "10.0.0.1:443",
+		"-upstream-tls",
+		"-upstream-tls-ca", tb.CAFile,
+		"-pool", "name=web upstreams=10.0.1.1:443 tls-cert=" + client.CertFile + " tls-key=" + client.KeyFile + " tls-server-name=web.internal",
+		"-pool", "name=plain upstreams=10.0.2.1:80 tls=false",
+	})
+	require.NoError(t, err)
+	require.NoError(t, cfg.Validate())
+	require.Equal(t, PoolTLSConfig{Enabled: true, CAFile: tb.CAFile, Verify: "full"}, cfg.Pools[0].TLS)
+	require.Equal(t, PoolTLSConfig{Enabled: true, CertFile: client.CertFile, KeyFile: client.KeyFile, CAFile: tb.CAFile, ServerName: "web.internal", Verify: "full"}, cfg.Pools[1].TLS)
+	require.False(t, cfg.Pools[2].TLS.Enabled)
+
+	_, err = makePoolsFromConfig(cfg, &slog.RecordingLogger{}, nil, nil, metrics.NewRegistry())
+	require.NoError(t, err)
+
+	// Files are loaded when the pools are made.
+	cfg.Pools[1].TLS.KeyFile = client.CertFile
+	_, err = makePoolsFromConfig(cfg, &slog.RecordingLogger{}, nil, nil, metrics.NewRegistry())
+	require.ErrorContains(t, err, `pool "web"`)
+}
+
+func TestConfigFromFlagsUpstreamTLSVerify(t *testing.T) {
+	pin := "47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU="
+	cfg, err := newConfigFromFlags([]string{
+		commandName,
+		"-upstreams", "10.0.0.1:443",
+		"-upstream-tls",
+		"-upstream-tls-verify", "spki-pinned",
+		"-upstream-tls-spki-pins", pin,
+		"-pool", "name=lab upstreams=10.0.1.1:443 tls-verify=insecure-skip-verify",
+	})
+	require.NoError(t, err)
+	require.NoError(t, cfg.Validate())
+	require.Equal(t, PoolTLSConfig{Enabled: true, Verify: "spki-pinned", SPKIPins: []string{pin}}, cfg.Pools[0].TLS)
+	require.Equal(t, "insecure-skip-verify", cfg.Pools[1].TLS.Verify)
+
+	// Disabling verification is loudly logged.
+	logger := &slog.RecordingLogger{}
+	_, err = makePoolsFromConfig(cfg, logger, nil, nil, metrics.NewRegistry())
+	require.NoError(t, err)
+	require.Len(t, logger.Events, 1)
+	require.Equal(t, slog.WarnLevel, logger.Events[0].Level)
+	require.Contains(t, logger.Events[0].Msg, "INSECURE")
+
+	// The verify modes are reported at startup.
+	report := newStartupReport(cfg, "abc", nil)
+	require.Equal(t, "spki-pinned", report.Pools[0].TLSVerify)
+	require.Equal(t, "insecure-skip-verify", report.Pools[1].TLSVerify)
+
+	for name, spec := range map[string]string{
+		"unknown mode": "name=web upstreams=10.0.1.1:443 tls=true tls-verify=trusting",
+		"no CA":        "name=web upstreams=10.0.1.1:443 tls=true tls-verify=ca-pinned",
+		"no pins":      "name=web upstreams=10.0.1.1:443 tls=true tls-verify=spki-pinned tls-spki-pins=",
+		"bad pin":      "name=web upstreams=10.0.1.1:443 tls=true tls-spki-pins=abc",
+	} {
+		cfg, err := newConfigFromFlags([]string{commandName, "-pool", spec})
+		if err == nil {
+			err = cfg.Validate()
+		}
+		require.Error(t, err, name)
+	}
+}
+
+func TestConfigFromFlagsDNSCache(t *testing.T) {
+	cfg, err := newConfigFromFlags([]string{commandName, "-upstreams", "web.internal:80"})
+	require.NoError(t, err)
+	require.Nil(t, makeDNSCacheFromConfig(cfg, metrics.NewRegistry()))
+
+	cfg, err = newConfigFromFlags([]string{
+		commandName,
+		"-upstreams", "web.internal:80",
+		"-dns-cache-ttl", "30s",
+		"-dns-negative-ttl", "5s",
+		"-dns-timeout", "1s",
+		"-pool", "name=proxied upstreams=api.internal:80 proxy=socks5://10.0.0.9:1080",
+	})
+	require.NoError(t, err)
+	require.Equal(t, 30*time.Second, cfg.DNSCacheTTL)
+	require.Equal(t, 5*time.Second, cfg.DNSNegativeTTL)
+	require.Equal(t, time.Second, cfg.DNSTimeout)
+	dns := makeDNSCacheFromConfig(cfg, metrics.NewRegistry())
+	require.NotNil(t, dns)
+
+	d, err := makeDialerFromConfig(&cfg.Pools[0], nil, &slog.RecordingLogger{}, nil, nil, nil, nil, dns)
+	require.NoError(t, err)
+	require.IsType(t, &dialer.ResolvingDialer{}, d.(*dialer.RetryDialer).Dialer)
+	// Upstreams dialed through an egress proxy are resolved by the proxy.
+	d, err = makeDialerFromConfig(&cfg.Pools[1], nil, &slog.RecordingLogger{}, nil, nil, nil, nil, dns)
+	require.NoError(t, err)
+	require.IsType(t, &dialer.ProxyDialer{}, d.(*dialer.RetryDialer).Dialer)
+}
+
+func TestConfigFromFlagsDeniedClientLimit(t *testing.T) {
+	cfg, err := newConfigFromFlags([]string{commandName, "-upstreams", "10.0.0.1:80"})
+	require.NoError(t, err)
+	require.Equal(t, defaultDeniedConnHold, cfg.DeniedConnHold)
+	require.Nil(t, makeDeniedClientLimiterFromConfig(cfg, nil, metrics.NewRegistry()))
+
+	cfg, err = newConfigFromFlags([]string{
+		commandName,
+		"-upstreams", "10.0.0.1:80",
+		"-max-denied-conns-per-client", "2",
+		"-denied-conn-hold", "5s",
+	})
+	require.NoError(t, err)
+	limiter := makeDeniedClientLimiterFromConfig(cfg, nil, metrics.NewRegistry())
+	require.NotNil(t, limiter)
+	require.Equal(t, 2, limiter.MaxPerClient)
+	require.Equal(t, 5*time.Second, limiter.Hold)
+	require.Nil(t, limiter.Banner)
+
+	bans := banlist.New(banlist.Config{Threshold: 3})
+	limiter = makeDeniedClientLimiterFromConfig(cfg, bans, metrics.NewRegistry())
+	require.Equal(t, bans, limiter.Banner)
+}
+
+func TestPoolUpstreamReplacer(t *testing.T) {
+	web1 := core.Upstream{Network: "tcp", Address: "10.0.0.1:80"}
+	web2 := core.Upstream{Network: "tcp", Address: "10.0.0.2:80"}
+	api1 := core.Upstream{Network: "tcp", Address: "10.0.1.1:80"}
+	ctx := context.Background()
+	cfg, err := newConfigFromFlags([]string{
+		commandName,
+		"-upstreams", "10.0.0.1:80",
+		"-pool", "name=api upstreams=10.0.1.1:80",
+	})
+	require.NoError(t, err)
+	require.NoError(t, cfg.Validate())
+	authorizer, err := makeAuthorizerFromConfig(cfg, metrics.NewRegistry())
+	require.NoError(t, err)
+	tracker, probePools, err := makeHealthTrackerFromConfig(cfg, nil)
+	require.NoError(t, err)
+	pools, err := makePoolsFromConfig(cfg, &slog.RecordingLogger{}, tracker, nil, metrics.NewRegistry())
+	require.NoError(t, err)
+	replacer := &poolUpstreamReplacer{
+		logger:     &slog.RecordingLogger{},
+		pools:      pools,
+		tracker:    tracker,
+		probePools: probePools,
+		authorizer: authorizer,
+	}
+
+	added, removed, err := replacer.ReplaceUpstreams(defaultPoolName, core.NewUpstreamSet(web2))
+	require.NoError(t, err)
+	require.Equal(t, core.NewUpstreamSet(web2), added)
+	require.Equal(t, core.NewUpstreamSet(web1), removed)
+	require.Equal(t, core.NewUpstreamSet(web2), pools[defaultPoolName].CurrentUpstreams())
+	// The removed upstream drains, and the added one is tracked and granted.
+	require.True(t, tracker.Drained(web1))
+	require.True(t, tracker.Upstreams().Contains(web2))
+	require.False(t, tracker.Drained(web2))
+	require.False(t, tracker.Drained(api1))
+	upstreams, err := authorizer.AuthorizedUpstreams(ctx, anonymousTestClientID)
+	require.NoError(t, err)
+	require.Equal(t, core.NewUpstreamSet(web2, api1), upstreams)
+
+	_, _, err = replacer.ReplaceUpstreams("nope", core.NewUpstreamSet(web2))
+	require.ErrorIs(t, err, forwarder.NoSuchPool)
+	_, _, err = replacer.ReplaceUpstreams("api", core.EmptyUpstreamSet())
+	require.Error(t, err)
+	require.Equal(t, core.NewUpstreamSet(api1), pools["api"].CurrentUpstreams())
+
+	// Retired upstreams are forgotten once upstreams are replaced again.
+	_, _, err = replacer.ReplaceUpstreams(defaultPoolName, core.NewUpstreamSet(web2))
+	require.NoError(t, err)
+	require.False(t, tracker.Upstreams().Contains(web1))
+}
+
+func TestPoolUpstreamReplacerUpdatesUpstreamGroups(t *testing.T) {
+	web1 := core.Upstream{Network: "tcp", Address: "10.0.0.1:80"}
+	web2 := core.Upstream{Network: "tcp", Address: "10.0.0.2:80"}
+	api1 := core.Upstream{Network: "tcp", Address: "10.0.1.1:80"}
+	api2 := core.Upstream{Network: "tcp", Address: "10.0.1.2:80"}
+	ctx := context.Background()
+	cfg, err := newConfigFromFlags([]string{
+		commandName,
+		"-upstreams", "10.0.0.1:80,10.0.0.2:80",
+		"-pool", "name=api upstreams=10.0.1.1:80",
+		"-upstream-labels", "10.0.0.1:80 zone=eu",
+		"-upstream-labels", "10.0.0.2:80 zone=eu",
+		"-upstream-group", "eu=zone=eu",
+		"-upstream-group", "api=10.0.1.1:80",
+		"-authzd-clients", "alice=eu,bob=api",
+	})
+	require.NoError(t, err)
+	require.NoError(t, cfg.Validate())
+	authorizer, err := makeAuthorizerFromConfig(cfg, metrics.NewRegistry())
+	require.NoError(t, err)
+	tracker, probePools, err := makeHealthTrackerFromConfig(cfg, nil)
+	require.NoError(t, err)
+	pools, err := makePoolsFromConfig(cfg, &slog.RecordingLogger{}, tracker, nil, metrics.NewRegistry())
+	require.NoError(t, err)
+	replacer := &poolUpstreamReplacer{
+		logger:     &slog.RecordingLogger{},
+		pools:      pools,
+		tracker:    tracker,
+		probePools: probePools,
+		authorizer: authorizer,
+		groups:     cfg.UpstreamGroups,
+		labels:     cfg.UpstreamLabels,
+	}
+	authorized := func(key string) core.UpstreamSet {
+		upstreams, err := authorizer.AuthorizedUpstreams(ctx, core.ClientID{Namespace: authn.DefaultNamespace, Key: key})
+		require.NoError(t, err)
+		return upstreams
+	}
+
+	// Groups with selectors no longer grant removed upstreams.
+	require.Equal(t, core.NewUpstreamSet(web1, web2), authorized("alice"))
+	_, _, err = replacer.ReplaceUpstreams(defaultPoolName, core.NewUpstreamSet(web2))
+	require.NoError(t, err)
+	require.Equal(t, core.NewUpstreamSet(web2), authorized("alice"))
+
+	// Pools with upstreams listed by groups cannot be replaced.
+	_, _, err = replacer.ReplaceUpstreams("api", core.NewUpstreamSet(api2))
+	require.Error(t, err)
+	require.Equal(t, core.NewUpstreamSet(api1), pools["api"].CurrentUpstreams())
+	require.Equal(t, core.NewUpstreamSet(api1), authorized("bob"))
+}
+
+func TestParsePoolConfigErrors(t *testing.T) {
+	for _, spec := range []string{
+		"name=web upstreams=nope",
+		"name=web max-conns-per-client=many",
+		"name=web healthcheck-interval=soon",
+		"name=web colour=blue",
+		"name=web weights=10.0.0.1:80",
+		"name=web weights=10.0.0.1:80=heavy",
+		"name=web retry-backoff=later",
+		"name=web max-dial-attempts=lots",
+		"name",
+	} {
+		_, err := parsePoolConfig(spec, PoolConfig{})
+		require.Error(t, err, spec)
+	}
+}
+
+func TestConfigFromFlagsUpstreamLabels(t *testing.T) {
+	cfg, err := newConfigFromFlags([]string{
+		commandName,
+		"-upstreams", "10.0.0.1:80,10.0.0.2:80",
+		"-upstream-labels", "10.0.0.1:80 zone=a weight=3",
+	})
+	require.NoError(t, err)
+	require.NoError(t, cfg.Validate())
+	a := core.Upstream{Network: "tcp", Address: "10.0.0.1:80"}
+	require.Equal(t, map[core.Upstream]core.Labels{a: {"zone": "a", "weight": "3"}}, cfg.UpstreamLabels)
+	require.Equal(t, core.NewUpstreamSet(a), makeUpstreamRegistryFromConfig(cfg).Select(core.Labels{"zone": "a"}))
+
+	cfg, err = newConfigFromFlags([]string{commandName, "-upstreams", "10.0.0.1:80", "-upstream-labels", "10.0.0.9:80 zone=a"})
+	require.NoError(t, err)
+	require.Error(t, cfg.Validate())
+
+	for _, s := range []string{"", "10.0.0.1:80 zone", "10.0.0.1:80 weight=heavy", "nope zone=a"} {
+		require.Error(t, (&UpstreamLabelsValue{}).Set(s), s)
+	}
+}
+
+func TestConfigFromFlagsGeoIP(t *testing.T) {
+	cfg, err := newConfigFromFlags([]string{
+		commandName,
+		"-upstreams", "10.0.0.1:80",
+		"-geoip-db", "country.mmdb, asn.mmdb",
+		"-geoip-allow-countries", "NZ,AU",
+		"-geoip-deny-asns", "AS64500,64501",
+	})
+	require.NoError(t, err)
+	require.NoError(t, cfg.Validate())
+	require.Equal(t, []string{"country.mmdb", "asn.mmdb"}, cfg.GeoIPDatabases)
+	require.Equal(t, geoip.Policy{AllowCountries: []string{"NZ", "AU"}, DenyASNs: []uint32{64500, 64501}}, cfg.GeoIPPolicy)
+
+	// Rules are useless without a database to locate clients with.
+	cfg, err = newConfigFromFlags([]string{commandName, "-upstreams", "10.0.0.1:80", "-geoip-deny-countries", "AU"})
+	require.NoError(t, err)
+	require.Error(t, cfg.Validate())
+
+	_, err = newConfigFromFlags([]string{commandName, "-upstreams", "10.0.0.1:80", "-geoip-deny-asns", "lots"})
+	require.Error(t, err)
+}
+
+func TestConfigFromFlagsUpstreamGroupCountries(t *testing.T) {
+	web := core.Upstream{Network: "tcp", Address: "10.0.0.1:80"}
+	eu := core.Upstream{Network: "tcp", Address: "10.0.0.2:80"}
+	alice := core.ClientID{Namespace: authn.DefaultNamespace, Key: "alice"}
+	cfg, err := newConfigFromFlags([]string{commandName, "-upstreams", "10.0.0.1:80,10.0.0.2:80",
+		"-geoip-db", "country.mmdb",
+		"-upstream-group", "web=10.0.0.1:80",
+		"-upstream-group", "eu=10.0.0.2:80",
+		"-upstream-group-countries", "eu=DE,FR",
+		"-authzd-clients", "alice=web+eu",
+	})
+	require.NoError(t, err)
+	require.NoError(t, cfg.Validate())
+	require.Equal(t, map[string][]string{"eu": {"DE", "FR"}}, cfg.UpstreamGroupCountries)
+	authorizer, err := makeAuthorizerFromConfig(cfg, metrics.NewRegistry())
+	require.NoError(t, err)
+	for country, expected := range map[string]core.UpstreamSet{
+		"FR": core.NewUpstreamSet(web, eu),
+		"US": core.NewUpstreamSet(web),
+	} {
+		ctx := geoip.NewContextWithLocation(context.Background(), geoip.Location{Country: country})
+		upstreams, err := authorizer.AuthorizedUpstreams(ctx, alice)
+		require.NoError(t, err)
+		require.Equal(t, expected, upstreams, country)
+	}
+
+	for _, args := range [][]string{
+		// Clients cannot be located without a database.
+		{"-upstream-group", "eu=10.0.0.1:80", "-upstream-group-countries", "eu=DE"},
+		{"-geoip-db", "country.mmdb", "-upstream-group-countries", "eu=DE"},
+	} {
+		cfg, err = newConfigFromFlags(append([]string{commandName, "-upstreams", "10.0.0.1:80"}, args...))
+		require.NoError(t, err)
+		require.Error(t, cfg.Validate(), args)
+	}
+	for _, s := range []string{"eu", "eu=", "=DE"} {
+		require.Error(t, (&UpstreamGroupCountriesValue{}).Set(s), s)
+	}
+}
+
+func TestConfigFromFlagsListeners(t *testing.T) {
+	cfg, err := newConfigFromFlags([]string{
+		commandName,
+		"-upstreams", "10.0.0.1:80",
+		"-pool", "name=web upstreams=10.0.1.1:80",
+		"-listener", "name=internal address=127.0.0.1:4322 pool=web max-conns-per-client=100",
+		"-listener", "name=socks address=127.0.0.1:1080 frontend=socks5",
+		"-route", "pool=default",
+	})
+	require.NoError(t, err)
+	require.NoError(t, cfg.Validate())
+	require.Equal(t, []ListenerConfig{{
+		Name:                    "internal",
+		Network:                 "tcp",
+		Address:                 "127.0.0.1:4322",
+		Pool:                    "web",
+		Authn:                   authnModeAnonymous,
+		Frontend:                frontendNone,
+		MaxConnectionsPerClient: 100,
+	}, {
+		Name:     "socks",
+		Network:  "tcp",
+		Address:  "127.0.0.1:1080",
+		Authn:    authnModeAnonymous,
+		Frontend: frontendSOCKS5,
+	}}, cfg.Listeners)
+	require.Len(t, allListeners(cfg), 3)
+
+	// The listener's pool binding takes priority over the routes.
+	router := makeRouterFromConfig(cfg)
+	pool, ok := router.Route(routing.Request{Listener: "internal"})
+	require.True(t, ok)
+	require.Equal(t, "web", pool)
+	pool, ok = router.Route(routing.Request{Listener: mainListenerName})
+	require.True(t, ok)
+	require.Equal(t, defaultPoolName, pool)
+
+	for name, spec := range map[string]string{
+		"undefined pool":   "name=internal address=127.0.0.1:4322 pool=api",
+		"no address":       "name=internal",
+		"unnamed":          "address=127.0.0.1:4322",
+		"main name":        "name=main address=127.0.0.1:4322",
+		"unknown authn":    "name=internal address=127.0.0.1:4322 authn=psychic",
+		"unknown frontend": "name=internal address=127.0.0.1:4322 frontend=http",
+	} {
+		cfg, err := newConfigFromFlags([]string{commandName, "-upstreams", "10.0.0.1:80", "-listener", spec})
+		require.NoError(t, err, name)
+		require.Error(t, cfg.Validate(), name)
+	}
+	for _, spec := range []string{"name", "name=internal colour=blue", "name=internal max-conns-per-client=many"} {
+		require.Error(t, (&ListenerListValue{}).Set(spec), spec)
+	}
+}
+
+func TestConfigFromFlagsPortMap(t *testing.T) {
+	cfg, err := newConfigFromFlags([]string{
+		commandName,
+		"-pool", "name=postgres upstreams=10.0.1.1:5432",
+		"-pool", "name=redis upstreams=10.0.2.1:6379",
+		"-port-map", "5432=postgres,127.0.0.1:6379=redis",
+	})
+	require.NoError(t, err)
+	require.NoError(t, cfg.Validate())
+	require.Equal(t, []ListenerConfig{{
+		Name:     "port-5432",
+		Network:  "tcp",
+		Address:  ":5432",
+		Pool:     "postgres",
+		Authn:    authnModeAnonymous,
+		Frontend: frontendNone,
+	}, {
+		Name:     "port-6379",
+		Network:  "tcp",
+		Address:  "127.0.0.1:6379",
+		Pool:     "redis",
+		Authn:    authnModeAnonymous,
+		Frontend: frontendNone,
+	}}, cfg.Listeners)
+
+	// Each port is routed to its pool.
+	router := makeRouterFromConfig(cfg)
+	pool, ok := router.Route(routing.Request{Listener: "port-6379"})
+	require.True(t, ok)
+	require.Equal(t, "redis", pool)
+
+	cfg, err = newConfigFromFlags([]string{commandName, "-pool", "name=postgres upstreams=10.0.1.1:5432", "-port-map", "5432=postgres,10.0.0.1:5432=postgres"})
+	require.NoError(t, err)
+	require.Error(t, cfg.Validate(), "listener names clash")
+	for _, spec := range []string{"5432", "5432=", "::1:5432=postgres"} {
+		require.Error(t, (&PortMapValue{Listeners: &ListenerListValue{}}).Set(spec), spec)
+	}
+}
+
+func TestConfigFromFlagsListenerTLS(t *testing.T) {
+	tb := testbed.New(t)
+	server := tb.Server(t, "tcplb.test")
+	cfg, err := newConfigFromFlags([]string{
+		commandName,
+		"-upstreams", "10.0.0.1:80",
+		"-authn", authnModeOptionalMTLS,
+		"-tls-cert", server.CertFile,
+		"-tls-key", server.KeyFile,
+		"-tls-client-ca", tb.CAFile,
+		"-listener", "name=internal address=127.0.0.1:4322 authn=mtls tls-cert=" + server.CertFile + " tls-key=" + server.KeyFile + " tls-client-ca=" + tb.CAFile,
+		"-listener", "name=public address=127.0.0.1:4323 tls-cert=" + server.CertFile + " tls-key=" + server.KeyFile,
+		"-authzd-clients", "CommonName/alice,Unauthenticated/anonymous",
+	})
+	require.NoError(t, err)
+	require.NoError(t, cfg.Validate())
+	require.Equal(t, authn.Unauthenticated, cfg.AuthorizedClients[1].ClientID)
+
+	clientAuth := map[string]tls.ClientAuthType{}
+	for _, lc := range allListeners(cfg) {
+		tlsConfig, err := lc.loadTLSConfig()
+		require.NoError(t, err, lc.Name)
+		require.NotNil(t, tlsConfig, lc.Name)
+		clientAuth[lc.Name] = tlsConfig.ClientAuth
+	}
+	require.Equal(t, map[string]tls.ClientAuthType{
+		mainListenerName: tls.VerifyClientCertIfGiven,
+		"internal":       tls.RequireAndVerifyClientCert,
+		"public":         tls.NoClientCert,
+	}, clientAuth)
+
+	plain := ListenerConfig{Name: "plain", Address: "127.0.0.1:4324", Authn: authnModeAnonymous}
+	tlsConfig, err := plain.loadTLSConfig()
+	require.NoError(t, err)
+	require.Nil(t, tlsConfig)
+
+	missing := ListenerConfig{Name: "missing", Authn: authnModeMTLS, TLS: ListenerTLSConfig{CertFile: server.CertFile, KeyFile: server.KeyFile, ClientCAFile: server.CertFile + ".missing"}}
+	_, err = missing.loadTLSConfig()
+	require.Error(t, err)
+
+	tlsKeys := "tls-cert=" + server.CertFile + " tls-key=" + server.KeyFile
+	for name, spec := range map[string]string{
+		"mtls without tls":         "name=internal address=127.0.0.1:4322 authn=mtls",
+		"mtls without client ca":   "name=internal address=127.0.0.1:4322 authn=optional-mtls " + tlsKeys,
+		"client ca without mtls":   "name=internal address=127.0.0.1:4322 tls-client-ca=" + tb.CAFile + " " + tlsKeys,
+		"cert without key":         "name=internal address=127.0.0.1:4322 tls-cert=" + server.CertFile,
+		"key without cert":         "name=internal address=127.0.0.1:4322 tls-key=" + server.KeyFile,
+		"mtls with only client ca": "name=internal address=127.0.0.1:4322 authn=mtls tls-client-ca=" + tb.CAFile,
+	} {
+		cfg, err := newConfigFromFlags([]string{commandName, "-upstreams", "10.0.0.1:80", "-listener", spec})
+		require.NoError(t, err, name)
+		require.Error(t, cfg.Validate(), name)
+	}
+}
+
+func TestStartupReport(t *testing.T) {
+	tb := testbed.New(t)
+	server := tb.Server(t, "tcplb.test")
+	args := []string{
+		commandName,
+		"-upstreams", "10.0.0.1:80,10.0.0.2:80",
+		"-pool", "name=web upstreams=10.0.1.1:80",
+		"-upstream-group", "web=10.0.1.1:80",
+		"-authn", authnModeMTLS,
+		"-tls-cert", server.CertFile,
+		"-tls-key", server.KeyFile,
+		"-tls-client-ca", tb.CAFile,
+		"-max-conns-per-client", "7",
+		"-authzd-clients", "CommonName/alice=web,CommonName/bob",
+	}
+	cfg, err := newConfigFromFlags(args)
+	require.NoError(t, err)
+	require.NoError(t, cfg.Validate())
+
+	lc := allListeners(cfg)[0]
+	tlsConfig, err := lc.loadTLSConfig()
+	require.NoError(t, err)
+	addr := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 4321}
+	report := newStartupReport(cfg, "abc", []listenerReport{newListenerReport(&lc, addr, tlsConfig)})
+
+	require.Equal(t, "abc", report.ConfigHash)
+	require.Len(t, report.AuthzHash, 64)
+	require.Equal(t, listenerReport{
+		Name:        mainListenerName,
+		Network:     "tcp",
+		Address:     "127.0.0.1:4321",
+		Authn:       authnModeMTLS,
+		Frontend:    frontendNone,
+		TLS:         true,
+		TLSVersions: []string{"TLS 1.2", "TLS 1.3"},
+		ClientAuth:  "required",
+	}, report.Listeners[0])
+	require.Len(t, report.Pools, 2)
+	require.Equal(t, 2, report.Pools[0].Upstreams)
+	require.Equal(t, "web", report.Pools[1].Name)
+	require.Equal(t, int64(7), report.Limits.MaxConnectionsPerClient)
+	require.Equal(t, startupAuthzStats{UpstreamGroups: 1, AuthorizedClients: 2}, report.Authz)
+
+	// The authorization policy hash ignores the order of grants, but not
+	// the grants themselves.
+	reordered, err := newConfigFromFlags(append(args, "-authzd-clients", "CommonName/bob,CommonName/alice=web"))
+	require.NoError(t, err)
+	require.Equal(t, report.AuthzHash, authzHash(reordered))
+	changed, err := newConfigFromFlags(append(args, "-authzd-clients", "CommonName/alice,CommonName/bob=web"))
+	require.NoError(t, err)
+	require.NotEqual(t, report.AuthzHash, authzHash(changed))
+}
+
+func TestConfigValidateReservationLeaseTTL(t *testing.T) {
+	cfg, err := newConfigFromFlags([]string{commandName, "-upstreams", "10.0.0.1:80", "-max-conns-per-client", "2", "-reservation-lease-ttl", "1ns"})
+	require.NoError(t, err)
+	require.Error(t, cfg.Validate())
+
+	cfg.ReservationLeaseTTL = minReservationLeaseTTL
+	require.NoError(t, cfg.Validate())
+	cfg.ReservationLeaseTTL = 0
+	require.NoError(t, cfg.Validate())
+}
+
+func TestConfigValidateUDP(t *testing.T) {
+	cfg, err := newConfigFromFlags([]string{commandName, "-upstreams", "10.0.0.1:53", "-udp-listen-address", "127.0.0.1:5353"})
+	require.NoError(t, err)
+	require.NoError(t, cfg.Validate())
+	require.Equal(t, defaultPoolName, cfg.UDPPool)
+	require.Equal(t, defaultUDPMaxSessions, cfg.UDPMaxSessions)
+
+	cfg, err = newConfigFromFlags([]string{commandName, "-upstreams", "10.0.0.1:53", "-udp-listen-address", "127.0.0.1:5353", "-udp-pool", "dns"})
+	require.NoError(t, err)
+	require.Error(t, cfg.Validate())
+
+	cfg, err = newConfigFromFlags([]string{commandName, "-upstreams", "10.0.0.1:53", "-udp-listen-address", "127.0.0.1:5353", "-udp-idle-timeout", "0s"})
+	require.NoError(t, err)
+	require.Error(t, cfg.Validate())
+}
+
+func TestStartUDPProxyFromConfigInheritsSocket(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer conn.Close()
+	cfg, err := newConfigFromFlags([]string{commandName, "-upstreams", "10.0.0.1:53", "-udp-listen-address", conn.LocalAddr().String()})
+	require.NoError(t, err)
+	require.NoError(t, cfg.Validate())
+
+	// A new process must not bind the address the old process serves on.
+	_, err = startUDPProxyFromConfig(cfg, &slog.RecordingLogger{}, metrics.NewRegistry(), nil)
+	require.Error(t, err)
+
+	inherited := map[string]net.PacketConn{udpListenerName: conn}
+	proxy, err := startUDPProxyFromConfig(cfg, &slog.RecordingLogger{}, metrics.NewRegistry(), inherited)
+	require.NoError(t, err)
+	require.Same(t, conn, proxy.Conn)
+	require.Empty(t, inherited)
+	require.NoError(t, proxy.Close())
+}
+
+// newTestHandlerDeps returns the handler dependencies of cfg, as serve
+// makes them.
+func newTestHandlerDeps(t *testing.T, cfg *Config, registry *metrics.Registry) *handlerDeps {
+	logger := &slog.RecordingLogger{}
+	authorizer, err := makeAuthorizerFromConfig(cfg, registry)
+	require.NoError(t, err)
+	tracker, _, err := makeHealthTrackerFromConfig(cfg, logger)
+	require.NoError(t, err)
+	upstreamRegistry := makeUpstreamRegistryFromConfig(cfg)
+	pools, err := makePoolsFromConfig(cfg, logger, tracker, upstreamRegistry, registry)
+	require.NoError(t, err)
+	deps, err := makeHandlerDepsFromConfig(cfg, logger, registry, conntable.NewTable(conntable.Config{}), authorizer, pools, upstreamRegistry, nil)
+	require.NoError(t, err)
+	return deps
+}
+
+func TestMakeServerFromConfigInheritsListener(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+	cfg, err := newConfigFromFlags([]string{commandName, "-upstreams", "10.0.0.1:80", "-listen-address", listener.Addr().String()})
+	require.NoError(t, err)
+	require.NoError(t, cfg.Validate())
+	registry := metrics.NewRegistry()
+	deps := newTestHandlerDeps(t, cfg, registry)
+	lc := allListeners(cfg)[0]
+
+	// A new process must not bind the address the old process serves on.
+	_, _, _, err = makeServerFromConfig(cfg, &lc, deps, nil, nil, nil, registry, nil)
+	require.Error(t, err)
+
+	inherited := map[string]net.Listener{lc.Name: listener}
+	s, bound, report, err := makeServerFromConfig(cfg, &lc, deps, nil, nil, nil, registry, inherited)
+	require.NoError(t, err)
+	require.NotNil(t, s)
+	require.Same(t, listener, bound)
+	require.Empty(t, inherited)
+	require.Equal(t, listener.Addr().String(), report.Address)
+}
+
+func TestMakeListenerReserverFromConfig(t *testing.T) {
+	cfg, err := newConfigFromFlags([]string{
+		commandName,
+		"-upstreams", "10.0.0.1:80",
+		"-listener", "name=limited address=127.0.0.1:0 max-conns-per-client=2",
+	})
+	require.NoError(t, err)
+	require.NoError(t, cfg.Validate())
+	listeners := allListeners(cfg)
+	shared := forwarder.PoolReserver{}
+
+	reserver, stop, err := makeListenerReserverFromConfig(cfg, &listeners[0], shared, nil, metrics.NewRegistry())
+	require.NoError(t, err)
+	stop()
+	require.Equal(t, shared, reserver)
+
+	reserver, stop, err = makeListenerReserverFromConfig(cfg, &listeners[1], shared, nil, metrics.NewRegistry())
+	require.NoError(t, err)
+	stop()
+	bounded, ok := reserver.(*limiter.UniformlyBoundedClientReserver)
+	require.True(t, ok)
+	require.Equal(t, int64(2), bounded.MaxReservationsPerClient)
+}
+
+func TestStartLoadSheddingFromConfig(t *testing.T) {
+	cfg, err := newConfigFromFlags([]string{commandName, "-upstreams", "10.0.0.1:80"})
+	require.NoError(t, err)
+	registry := metrics.NewRegistry()
+	deps := newTestHandlerDeps(t, cfg, registry)
+	stop, err := startLoadSheddingFromConfig(cfg, &slog.RecordingLogger{}, registry, deps)
+	require.NoError(t, err)
+	stop()
+	require.Nil(t, deps.memory)
+	require.Nil(t, deps.shedder)
+
+	cfg, err = newConfigFromFlags([]string{
+		commandName,
+		"-upstreams", "10.0.0.1:80",
+		"-max-connections", "10",
+		"-memory-limit", "1000000000",
+		"-memory-shed-threshold", "800000000",
+	})
+	require.NoError(t, err)
+	require.NoError(t, cfg.Validate())
+	stop, err = startLoadSheddingFromConfig(cfg, &slog.RecordingLogger{}, registry, deps)
+	require.NoError(t, err)
+	stop()
+	require.NotNil(t, deps.memory)
+	require.NotNil(t, deps.shedder)
+	require.NotNil(t, deps.shedMetrics)
+}
+
+func TestStartIPFilterFromConfig(t *testing.T) {
+	cfg, err := newConfigFromFlags([]string{commandName, "-upstreams", "10.0.0.1:80"})
+	require.NoError(t, err)
+	rules, err := loadIPFilterRulesFromConfig(cfg)
+	require.NoError(t, err)
+	deps := &handlerDeps{}
+	startIPFilterFromConfig(cfg, &slog.RecordingLogger{}, nil, rules, deps)()
+	require.Nil(t, deps.ipFilter)
+
+	cfg, err = newConfigFromFlags([]string{commandName, "-upstreams", "10.0.0.1:80", "-ip-deny", "192.0.2.0/24"})
+	require.NoError(t, err)
+	rules, err = loadIPFilterRulesFromConfig(cfg)
+	require.NoError(t, err)
+	startIPFilterFromConfig(cfg, &slog.RecordingLogger{}, nil, rules, deps)()
+	filter, ok := deps.ipFilter.(*ipfilter.Filter)
+	require.True(t, ok)
+	require.False(t, filter.AllowConn(&net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 1234}))
+}
+
+func TestConfigFromFlagsHandlerStages(t *testing.T) {
+	cfg, err := newConfigFromFlags([]string{commandName, "-upstreams", "10.0.0.1:80"})
+	require.NoError(t, err)
+	require.Equal(t, optionalStages, cfg.HandlerStages)
+
+	cfg, err = newConfigFromFlags([]string{
+		commandName,
+		"-upstreams", "10.0.0.1:80",
+		"-handler-stages", "pre-auth-deadline,ban,early-dial",
+		"-ban-threshold", "3",
+	})
+	require.NoError(t, err)
+	require.NoError(t, cfg.Validate())
+	chain, err := makeHandlerChain(cfg, &allListeners(cfg)[0], &handlerDeps{bans: banlist.New(banlist.Config{Threshold: 3})}, nil)
+	require.NoError(t, err)
+	// Early dial is listed but not enabled.
+	require.Equal(t, []string{
+		forwarder.StageClose, forwarder.StageReasonMetrics, forwarder.StageConnTable, forwarder.StagePreAuthDeadline, forwarder.StageBan,
+		forwarder.StageAuthn, forwarder.StageRoute, forwarder.StageRateLimit, forwarder.StageAuthz,
+	}, chain.Names())
+
+	for _, stages := range []string{"ban,ban", "authn", "recoverer"} {
+		cfg.HandlerStages = splitList(stages)
+		require.Error(t, cfg.Validate(), stages)
+	}
+}
+
+func TestConfigFromFlagsRecoverAndIPFilterStages(t *testing.T) {
+	cfg, err := newConfigFromFlags([]string{commandName, "-upstreams", "10.0.0.1:80", "-ip-deny", "192.0.2.0/24"})
+	require.NoError(t, err)
+	require.NoError(t, cfg.Validate())
+	deps := &handlerDeps{ipFilter: ipfilter.NewFilter(ipfilter.Rules{})}
+	chain, err := makeHandlerChain(cfg, &allListeners(cfg)[0], deps, nil)
+	require.NoError(t, err)
+	names := chain.Names()
+	require.Equal(t, []string{forwarder.StageRecover, forwarder.StageIPFilter}, names[3:5])
+
+	// The IP filter may be ordered after other stages, but not disabled
+	// while it has rules.
+	cfg.HandlerStages = []string{forwarder.StageBan, forwarder.StageIPFilter}
+	require.NoError(t, cfg.Validate())
+	cfg.HandlerStages = []string{forwarder.StageRecover, forwarder.StageBan}
+	require.Error(t, cfg.Validate())
+}
+
+func TestConfigFromFlagsMirror(t *testing.T) {
+	cfg, err := newConfigFromFlags([]string{commandName, "-upstreams", "10.0.0.1:80"})
+	require.NoError(t, err)
+	require.Equal(t, defaultMirrorMaxBuffered, cfg.MirrorMaxBuffered)
+	chain, err := makeHandlerChain(cfg, &allListeners(cfg)[0], &handlerDeps{}, nil)
+	require.NoError(t, err)
+	require.NotContains(t, chain.Names(), forwarder.StageMirror)
+
+	cfg, err = newConfigFromFlags([]string{commandName, "-upstreams", "10.0.0.1:80", "-mirror-address", "10.0.0.9:80"})
+	require.NoError(t, err)
+	require.NoError(t, cfg.Validate())
+	chain, err = makeHandlerChain(cfg, &allListeners(cfg)[0], &handlerDeps{}, nil)
+	require.NoError(t, err)
+	names := chain.Names()
+	require.Equal(t, forwarder.StageMirror, names[len(names)-1], "only authorized clients are mirrored")
+
+	cfg.MirrorMaxBuffered = 0
+	require.Error(t, cfg.Validate())
+	cfg.MirrorMaxBuffered = defaultMirrorMaxBuffered
+	cfg.MirrorAddress = "10.0.0.9"
+	require.Error(t, cfg.Validate())
+}
+
+func TestConfigFromFlagsBanTarpit(t *testing.T) {
+	cfg, err := newConfigFromFlags([]string{commandName, "-upstreams", "10.0.0.1:80", "-ban-threshold", "3"})
+	require.NoError(t, err)
+	require.Equal(t, defaultBanTarpitMaxConns, cfg.BanTarpitMaxConns)
+	require.Nil(t, makeTarpitFromConfig(cfg, metrics.NewRegistry()))
+
+	cfg, err = newConfigFromFlags([]string{commandName, "-upstreams", "10.0.0.1:80", "-ban-threshold", "3", "-ban-tarpit", "10s", "-ban-tarpit-max-conns", "5"})
+	require.NoError(t, err)
+	require.NoError(t, cfg.Validate())
+	tarpit := makeTarpitFromConfig(cfg, metrics.NewRegistry())
+	require.Equal(t, 10*time.Second, tarpit.Duration)
+	require.Equal(t, int32(5), tarpit.MaxConns)
+
+	cfg.BanTarpitMaxConns = 0
+	require.Error(t, cfg.Validate())
+}
+
+func TestConfigFromFlagsTLSFingerprint(t *testing.T) {
+	cfg, err := newConfigFromFlags([]string{commandName, "-upstreams", "10.0.0.1:80"})
+	require.NoError(t, err)
+	chain, err := makeHandlerChain(cfg, &allListeners(cfg)[0], &handlerDeps{}, nil)
+	require.NoError(t, err)
+	require.NotContains(t, chain.Names(), forwarder.StageFingerprint)
+
+	// Denying fingerprints implies computing them.
+	cfg, err = newConfigFromFlags([]string{commandName, "-upstreams", "10.0.0.1:80", "-tls-fingerprint-deny", "e7d705a3286e19ea42f587b344ee6865, 6734F37431670B3AB4292B8F60F29984"})
+	require.NoError(t, err)
+	require.NoError(t, cfg.Validate())
+	require.Len(t, cfg.TLSFingerprintDeny, 2)
+	chain, err = makeHandlerChain(cfg, &allListeners(cfg)[0], &handlerDeps{}, nil)
+	require.NoError(t, err)
+	require.Contains(t, chain.Names(), forwarder.StageFingerprint)
+
+	cfg.TLSFingerprintDeny = []string{"curl"}
+	require.Error(t, cfg.Validate())
+
+	// Fingerprints must be of the kind computed.
+	cfg, err = newConfigFromFlags([]string{commandName, "-upstreams", "10.0.0.1:80", "-tls-fingerprint-method", "ja4", "-tls-fingerprint-deny", "t13d1516h2_8daaf6152771_e5627efa2ab1"})
+	require.NoError(t, err)
+	require.NoError(t, cfg.Validate())
+	cfg.TLSFingerprintDeny = []string{"e7d705a3286e19ea42f587b344ee6865"}
+	require.Error(t, cfg.Validate())
+	cfg.TLSFingerprintDeny = nil
+	cfg.TLSFingerprintMethod = "ja5"
+	require.Error(t, cfg.Validate())
+}
+
+func TestConfigFromFlagsUpstreamGroupFingerprints(t *testing.T) {
+	web := core.Upstream{Network: "tcp", Address: "10.0.0.1:80"}
+	admin := core.Upstream{Network: "tcp", Address: "10.0.0.2:80"}
+	alice := core.ClientID{Namespace: authn.DefaultNamespace, Key: "alice"}
+	cfg, err := newConfigFromFlags([]string{commandName, "-upstreams", "10.0.0.1:80,10.0.0.2:80",
+		"-upstream-group", "web=10.0.0.1:80",
+		"-upstream-group", "admin=10.0.0.2:80",
+		"-tls-fingerprint-method", "ja4",
+		"-upstream-group-fingerprints", "admin=t13d1516h2_8daaf6152771_e5627efa2ab1",
+		"-authzd-clients", "alice=web+admin",
+	})
+	require.NoError(t, err)
+	require.NoError(t, cfg.Validate())
+	require.Equal(t, map[string][]string{"admin": {"t13d1516h2_8daaf6152771_e5627efa2ab1"}}, cfg.UpstreamGroupFingerprints)
+
+	// Restricting groups by fingerprint implies computing fingerprints.
+	chain, err := makeHandlerChain(cfg, &allListeners(cfg)[0], &handlerDeps{}, nil)
+	require.NoError(t, err)
+	require.Contains(t, chain.Names(), forwarder.StageFingerprint)
+
+	authorizer, err := makeAuthorizerFromConfig(cfg, metrics.NewRegistry())
+	require.NoError(t, err)
+	for fingerprint, expected := range map[string]core.UpstreamSet{
+		"t13d1516h2_8daaf6152771_e5627efa2ab1": core.NewUpstreamSet(web, admin),
+		"t13d1715h2_5b57614c22b0_3d5424432f57": core.NewUpstreamSet(web),
+	} {
+		ctx := core.NewContextWithTLSFingerprint(context.Background(), fingerprint)
+		upstreams, err := authorizer.AuthorizedUpstreams(ctx, alice)
+		require.NoError(t, err)
+		require.Equal(t, expected, upstreams, fingerprint)
+	}
+
+	for _, args := range [][]string{
+		{"-upstream-group-fingerprints", "admin=e7d705a3286e19ea42f587b344ee6865", "-tls-fingerprint-method", "ja4"},
+		{"-upstream-group-fingerprints", "web=t13d1516h2_8daaf6152771_e5627efa2ab1", "-tls-fingerprint-method", "ja4"},
+	} {
+		cfg, err = newConfigFromFlags(append([]string{commandName, "-upstreams", "10.0.0.1:80", "-upstream-group", "admin=10.0.0.1:80"}, args...))
+		require.NoError(t, err)
+		require.Error(t, cfg.Validate(), args)
+	}
+	for _, s := range []string{"admin", "admin=", "=t13d1516h2_8daaf6152771_e5627efa2ab1"} {
+		require.Error(t, (&UpstreamGroupFingerprintsValue{}).Set(s), s)
+	}
+}
+
+func TestConfigFromFlagsMemory(t *testing.T) {
+	cfg, err := newConfigFromFlags([]string{commandName, "-upstreams", "10.0.0.1:80"})
+	require.NoError(t, err)
+	require.Nil(t, makeMemoryWatchdogFromConfig(cfg, &slog.RecordingLogger{}, metrics.NewRegistry()))
+
+	cfg, err = newConfigFromFlags([]string{
+		commandName,
+		"-upstreams", "10.0.0.1:80",
+		"-gc-percent", "50",
+		"-memory-limit", "1000000000",
+		"-memory-shed-threshold", "800000000",
+	})
+	require.NoError(t, err)
+	require.NoError(t, cfg.Validate())
+	require.Equal(t, 50, cfg.GCPercent)
+	require.Equal(t, int64(1000000000), cfg.MemoryLimit)
+	watchdog := makeMemoryWatchdogFromConfig(cfg, &slog.RecordingLogger{}, metrics.NewRegistry())
+	require.NotNil(t, watchdog)
+	require.Equal(t, uint64(800000000), watchdog.Threshold)
+
+	chain, err := makeHandlerChain(cfg, &allListeners(cfg)[0], &handlerDeps{memory: watchdog}, nil)
+	require.NoError(t, err)
+	require.Equal(t, []string{
+		forwarder.StageClose, forwarder.StageReasonMetrics, forwarder.StageConnTable, forwarder.StageMemoryShed, forwarder.StageRecover, forwarder.StagePreAuthDeadline, forwarder.StageSniff,
+		forwarder.StageHandshakeLimit, forwarder.StageAuthn, forwarder.StageRoute, forwarder.StageRateLimit, forwarder.StageAuthz,
+	}, chain.Names())
+
+	cfg.MemoryShedThreshold = cfg.MemoryLimit
+	require.Error(t, cfg.Validate())
+
+	// Garbage collection may only be disabled if the heap is bounded.
+	cfg.MemoryShedThreshold = 800000000
+	cfg.GCPercent = -1
+	require.NoError(t, cfg.Validate())
+	cfg.MemoryLimit = 0
+	require.Error(t, cfg.Validate())
+}
+
+func TestConfigValidateCircuitBreaker(t *testing.T) {
+	cfg, err := newConfigFromFlags([]string{commandName, "-upstreams", "10.0.0.1:80", "-circuit-breaker-failure-ratio", "0.5"})
+	require.NoError(t, err)
+	require.NoError(t, cfg.Validate())
+	require.NotNil(t, makeCircuitBreakerFromConfig(cfg, metrics.NewRegistry()))
+
+	for _, args := range [][]string{
+		{"-circuit-breaker-failure-ratio", "1.5"},
+		{"-circuit-breaker-failure-ratio", "0.5", "-circuit-breaker-window", "0s"},
+		{"-circuit-breaker-failure-ratio", "0.5", "-circuit-breaker-open-duration", "0s"},
+	} {
+		cfg, err = newConfigFromFlags(append([]string{commandName, "-upstreams", "10.0.0.1:80"}, args...))
+		require.NoError(t, err)
+		require.Error(t, cfg.Validate(), args)
+	}
+
+	cfg, err = newConfigFromFlags([]string{commandName, "-upstreams", "10.0.0.1:80"})
+	require.NoError(t, err)
+	require.Nil(t, makeCircuitBreakerFromConfig(cfg, metrics.NewRegistry()))
+}
+
+func TestConfigFromFlagsQuotas(t *testing.T) {
+	cfg, err := newConfigFromFlags([]string{commandName, "-upstreams", "10.0.0.1:80",
+		"-quota", "window=1h hard-bytes=1000",
+		"-quota", "window=24h soft-bytes=5000 soft-conn-seconds=60 hard-conn-seconds=120",
+	})
+	require.NoError(t, err)
+	require.NoError(t, cfg.Validate())
+	require.Equal(t, []quota.Window{
+		{Duration: time.Hour, HardBytes: 1000},
+		{Duration: 24 * time.Hour, SoftBytes: 5000, SoftConnectionSeconds: 60, HardConnectionSeconds: 120},
+	}, cfg.Quotas)
+
+	for _, spec := range []string{"hard-bytes=1000", "window=1h", "window=1h bytes=10", "window=1h hard-bytes", "window=0s hard-bytes=1"} {
+		_, err := parseQuotaWindow(spec)
+		require.Error(t, err, spec)
+	}
+
+	cfg, err = newConfigFromFlags([]string{commandName, "-upstreams", "10.0.0.1:80",
+		"-quota", "window=1h hard-bytes=1000", "-quota-state-file", "quota.json", "-quota-persist-interval", "0s",
+	})
+	require.NoError(t, err)
+	require.Error(t, cfg.Validate())
+}
+
+func TestConfigFromFlagsHealthState(t *testing.T) {
+	cfg, err := newConfigFromFlags([]string{commandName, "-upstreams", "10.0.0.1:80"})
+	require.NoError(t, err)
+	require.Empty(t, cfg.HealthStateFile)
+	require.Equal(t, defaultHealthStateMaxAge, cfg.HealthStateMaxAge)
+
+	// Beliefs saved by a previous process are loaded at startup.
+	path := filepath.Join(t.TempDir(), "health.json")
+	web := core.Upstream{Network: "tcp", Address: "10.0.0.1:80"}
+	store := &healthcheck.FileStore{Path: path}
+	require.NoError(t, store.Save(healthcheck.State{
+		Time:      time.Now(),
+		Upstreams: []healthcheck.UpstreamState{{Upstream: web, Belief: healthcheck.BeliefUnhealthy}},
+	}))
+	cfg, err = newConfigFromFlags([]string{commandName, "-upstreams", "10.0.0.1:80", "-health-state-file", path, "-health-state-max-age", "1h"})
+	require.NoError(t, err)
+	require.NoError(t, cfg.Validate())
+	require.Equal(t, path, cfg.HealthStateFile)
+	require.Equal(t, time.Hour, cfg.HealthStateMaxAge)
+	tracker, _, err := makeHealthTrackerFromConfig(cfg, nil)
+	require.NoError(t, err)
+	require.Equal(t, healthcheck.BeliefUnhealthy, tracker.Belief(web))
+
+	// A corrupt state file is logged, and ignored: beliefs start unknown.
+	require.NoError(t, os.WriteFile(path, []byte("{"), 0o600))
+	logger := &slog.RecordingLogger{}
+	tracker, _, err = makeHealthTrackerFromConfig(cfg, logger)
+	require.NoError(t, err)
+	require.Equal(t, healthcheck.BeliefUnknown, tracker.Belief(web))
+	require.Len(t, logger.Events, 1)
+	require.Equal(t, slog.WarnLevel, logger.Events[0].Level)
+}
+
+func TestConfigValidateAdminListener(t *testing.T) {
+	base := []string{commandName, "-upstreams", "10.0.0.1:80", "-listen-address", "0.0.0.0:4321",
+		"-listener", "name=internal address=127.0.0.1:4322"}
+	for args, valid := range map[string]bool{
+		"-admin-listen-address 127.0.0.1:6060": true,
+		"-admin-listen-address 0.0.0.0:6060":   false,
+		// Control endpoints must never share a data-plane port.
+		"-admin-listen-address 127.0.0.1:4321":                                                                                                  false,
+		"-admin-listen-address 127.0.0.1:4322":                                                                                                  false,
+		"-admin-listen-address 10.0.0.2:6060 -admin-tls-cert c.pem -admin-tls-key k.pem":                                                        false,
+		"-admin-listen-address 10.0.0.2:6060 -admin-tls-cert c.pem -admin-tls-key k.pem -admin-tls-client-ca ca.pem":                            true,
+		"-admin-listen-address 10.0.0.2:4322 -admin-tls-cert c.pem -admin-tls-key k.pem -admin-tls-client-ca ca.pem":                            true,
+		"-admin-listen-address 10.0.0.2:4321 -admin-tls-cert c.pem -admin-tls-key k.pem -admin-tls-client-ca ca.pem":                            false,
+		"-admin-listen-address 10.0.0.2:6060 -admin-tls-cert c.pem -admin-tls-key k.pem -admin-tls-client-ca ca.pem -admin-allowed-clients ops": true,
+		"-admin-listen-address 127.0.0.1:6060 -admin-tls-cert c.pem":                                                                            false,
+	} {
+		cfg, err := newConfigFromFlags(append(append([]string{}, base...), strings.Fields(args)...))
+		require.NoError(t, err)
+		if valid {
+			require.NoError(t, cfg.Validate(), args)
+		} else {
+			require.Error(t, cfg.Validate(), args)
+		}
+	}
+}
+
+func TestConfigFromFlagsEventSocket(t *testing.T) {
+	cfg, err := newConfigFromFlags([]string{commandName, "-upstreams", "10.0.0.1:80"})
+	require.NoError(t, err)
+	require.Empty(t, cfg.EventSocket)
+	require.Equal(t, events.DefaultBuffer, cfg.EventBuffer)
+
+	cfg, err = newConfigFromFlags([]string{commandName, "-upstreams", "10.0.0.1:80", "-event-socket", "/run/tcplb/events.sock", "-event-buffer", "64"})
+	require.NoError(t, err)
+	require.NoError(t, cfg.Validate())
+	require.Equal(t, "/run/tcplb/events.sock", cfg.EventSocket)
+	require.Equal(t, 64, cfg.EventBuffer)
+
+	cfg, err = newConfigFromFlags([]string{commandName, "-upstreams", "10.0.0.1:80", "-event-socket", "/run/tcplb/admin.sock", "-admin-socket", "/run/tcplb/admin.sock"})
+	require.NoError(t, err)
+	require.Error(t, cfg.Validate())
+}
+
+func TestConfigFromFlagsAcceptQueue(t *testing.T) {
+	base := []string{commandName, "-upstreams", "10.0.0.1:80"}
+	cfg, err := newConfigFromFlags(base)
+	require.NoError(t, err)
+	require.NoError(t, cfg.Validate())
+	require.Equal(t, 0, cfg.MaxHandlers)
+	require.Equal(t, defaultAcceptQueueLength, cfg.AcceptQueueLength)
+	require.Equal(t, "queue", cfg.AcceptQueueOverflow)
+
+	cfg, err = newConfigFromFlags(append(base, "-listen-backlog", "4096", "-max-handlers", "100",
+		"-accept-queue-length", "0", "-accept-queue-overflow", "reject"))
+	require.NoError(t, err)
+	require.NoError(t, cfg.Validate())
+	require.Equal(t, 4096, cfg.ListenBacklog)
+	require.Equal(t, 100, cfg.MaxHandlers)
+	require.Equal(t, 0, cfg.AcceptQueueLength)
+	require.Equal(t, "reject", cfg.AcceptQueueOverflow)
+
+	for _, args := range [][]string{
+		{"-accept-queue-overflow", "drop"},
+		{"-accept-queue-length", "-1"},
+		{"-listen-backlog", "-1"},
+	} {
+		cfg, err := newConfigFromFlags(append(append([]string{}, base...), args...))
+		require.NoError(t, err)
+		require.Error(t, cfg.Validate(), args)
+	}
+}
+
+func TestConfigFromFlagsSlowConsumer(t *testing.T) {
+	base := []string{commandName, "-upstreams", "10.0.0.1:80"}
+	cfg, err := newConfigFromFlags(base)
+	require.NoError(t, err)
+	require.NoError(t, cfg.Validate())
+	require.Equal(t, time.Duration(0), cfg.SlowConsumerTimeout)
+	fwder, err := makeForwarderFromConfig(cfg, metrics.NewRegistry())
+	require.NoError(t, err)
+	require.Equal(t, forwarder.SlowConsumerConfig{}, fwder.(forwarder.MediocreForwarder).SlowConsumer)
+
+	cfg, err = newConfigFromFlags(append(base, "-slow-consumer-timeout", "5s",
+		"-slow-consumer-policy", "buffer", "-slow-consumer-buffer", "65536"))
+	require.NoError(t, err)
+	require.NoError(t, cfg.Validate())
+	fwder, err = makeForwarderFromConfig(cfg, metrics.NewRegistry())
+	require.NoError(t, err)
+	slow := fwder.(forwarder.MediocreForwarder).SlowConsumer
+	require.Equal(t, 5*time.Second, slow.WriteTimeout)
+	require.Equal(t, forwarder.SlowConsumerBuffer, slow.Policy)
+	require.Equal(t, 65536, slow.BufferSize)
+	require.NotNil(t, slow.Metrics)
+
+	for _, args := range [][]string{
+		{"-slow-consumer-policy", "drop"},
+		{"-slow-consumer-policy", "buffer", "-slow-consumer-buffer", "0"},
+	} {
+		cfg, err := newConfigFromFlags(append(append([]string{}, base...), args...))
+		require.NoError(t, err)
+		require.Error(t, cfg.Validate(), args)
+	}
+}
+
+func TestConfigFromFlagsBudgetWarnings(t *testing.T) {
+	base := []string{commandName, "-upstreams", "10.0.0.1:80"}
+	cfg, err := newConfigFromFlags(base)
+	require.NoError(t, err)
+	require.NoError(t, cfg.Validate())
+	require.Equal(t, 0.8, cfg.BudgetWarningFraction)
+	warnings := makeBudgetWarningsFromConfig(cfg, &slog.RecordingLogger{}, nil, metrics.NewRegistry())
+	require.NotNil(t, warnings)
+	require.Equal(t, budgetWarningInterval, warnings.Interval)
+	reserver, err := makeClientReserverFromConfig(&cfg.Pools[0], metrics.NewRegistry())
+	require.NoError(t, err)
+	warnOfReservations(cfg, reserver, warnings)
+	bounded := reserver.(*limiter.UniformlyBoundedClientReserver)
+	require.Equal(t, 0.8, bounded.WarnFraction)
+	require.Same(t, warnings, bounded.Warner)
+
+	cfg, err = newConfigFromFlags(append(base, "-budget-warning-fraction", "0"))
+	require.NoError(t, err)
+	require.NoError(t, cfg.Validate())
+	require.Nil(t, makeBudgetWarningsFromConfig(cfg, &slog.RecordingLogger{}, nil, metrics.NewRegistry()))
+
+	cfg, err = newConfigFromFlags(append(base, "-budget-warning-fraction", "1.5"))
+	require.NoError(t, err)
+	require.Error(t, cfg.Validate())
+}
+
+func TestConfigFromFlagsUpstreamBandwidth(t *testing.T) {
+	base := []string{commandName, "-upstreams", "10.0.0.1:80"}
+	cfg, err := newConfigFromFlags(base)
+	require.NoError(t, err)
+	require.NoError(t, cfg.Validate())
+	require.Equal(t, limiter.DefaultBandwidthQuantum, cfg.BandwidthQuantum)
+	fwder, err := makeForwarderFromConfig(cfg, metrics.NewRegistry())
+	require.NoError(t, err)
+	require.Nil(t, fwder.(forwarder.MediocreForwarder).Bandwidth)
+
+	cfg, err = newConfigFromFlags(append(base, "-upstream-bandwidth", "1048576", "-bandwidth-quantum", "4096"))
+	require.NoError(t, err)
+	require.NoError(t, cfg.Validate())
+	require.Equal(t, int64(1048576), cfg.UpstreamBandwidth)
+	require.Equal(t, 4096, cfg.BandwidthQuantum)
+	fwder, err = makeForwarderFromConfig(cfg, metrics.NewRegistry())
+	require.NoError(t, err)
+	require.IsType(t, &limiter.FairBandwidthScheduler{}, fwder.(forwarder.MediocreForwarder).Bandwidth)
+
+	cfg, err = newConfigFromFlags(append(base, "-upstream-bandwidth", "1048576", "-bandwidth-quantum", "0"))
+	require.NoError(t, err)
+	require.Error(t, cfg.Validate())
+}
+
+func TestConfigFromFlagsHandshakeStartRate(t *testing.T) {
+	base := []string{commandName, "-upstreams", "10.0.0.1:80"}
+	cfg, err := newConfigFromFlags(base)
+	require.NoError(t, err)
+	require.Nil(t, makeHandshakeStartLimiterFromConfig(cfg))
+
+	cfg, err = newConfigFromFlags(append(base, "-handshake-start-rate", "0.5", "-handshake-start-burst", "2"))
+	require.NoError(t, err)
+	require.NoError(t, cfg.Validate())
+	require.Equal(t, 0.5, cfg.HandshakeStartRate)
+	require.Equal(t, 2, cfg.HandshakeStartBurst)
+	starts := makeHandshakeStartLimiterFromConfig(cfg)
+	require.NotNil(t, starts)
+	require.True(t, starts.Allow())
+	require.True(t, starts.Allow())
+	require.False(t, starts.Allow())
+}
+
+func TestConfigFromFlagsAuthz(t *testing.T) {
+	web1 := core.Upstream{Network: "tcp", Address: "10.0.0.1:80"}
+	web2 := core.Upstream{Network: "tcp", Address: "10.0.0.2:80"}
+	db := core.Upstream{Network: "tcp", Address: "10.0.0.3:5432"}
+	ctx := context.Background()
+
+	// By default, the anonymous client is granted every upstream.
+	cfg, err := newConfigFromFlags([]string{commandName, "-upstreams", "10.0.0.1:80,10.0.0.2:80"})
+	require.NoError(t, err)
+	require.NoError(t, cfg.Validate())
+	authorizer, err := makeAuthorizerFromConfig(cfg, metrics.NewRegistry())
+	require.NoError(t, err)
+	upstreams, err := authorizer.AuthorizedUpstreams(ctx, anonymousTestClientID)
+	require.NoError(t, err)
+	require.Equal(t, core.NewUpstreamSet(web1, web2), upstreams)
+
+	cfg, err = newConfigFromFlags([]string{commandName, "-upstreams", "10.0.0.1:80,10.0.0.2:80,10.0.0.3:5432",
+		"-upstream-group", "web=10.0.0.1:80,10.0.0.2:80",
+		"-upstream-group", "db=10.0.0.3:5432",
+		"-authzd-clients", "alice=web,bob=web+db,ops/carol",
+	})
+	require.NoError(t, err)
+	require.NoError(t, cfg.Validate())
+	authorizer, err = makeAuthorizerFromConfig(cfg, metrics.NewRegistry())
+	require.NoError(t, err)
+	for client, expected := range map[core.ClientID]core.UpstreamSet{
+		{Namespace: authn.DefaultNamespace, Key: "alice"}: core.NewUpstreamSet(web1, web2),
+		{Namespace: authn.DefaultNamespace, Key: "bob"}:   core.NewUpstreamSet(web1, web2, db),
+		{Namespace: "ops", Key: "carol"}:                  core.NewUpstreamSet(web1, web2, db),
+		anonymousTestClientID:                             core.EmptyUpstreamSet(),
+	} {
+		upstreams, err := authorizer.AuthorizedUpstreams(ctx, client)
+		require.NoError(t, err)
+		require.Equal(t, expected, upstreams, client)
+	}
+	groups, err := authorizer.(forwarder.GroupResolver).ClientGroups(ctx, core.ClientID{Namespace: authn.DefaultNamespace, Key: "bob"})
+	require.NoError(t, err)
+	require.Equal(t, []string{"web", "db"}, groups)
+
+	for _, args := range [][]string{
+		{"-authzd-clients", "alice=web"},
+		{"-authzd-clients", "alice,alice"},
+		{"-authzd-clients", ""},
+		{"-upstream-group", "all=10.0.0.1:80"},
+		{"-upstream-group", "web=10.0.0.9:80"},
+		{"-upstream-group", "web=10.0.0.1:80", "-upstream-group", "web=10.0.0.1:80"},
+	} {
+		cfg, err = newConfigFromFlags(append([]string{commandName, "-upstreams", "10.0.0.1:80"}, args...))
+		require.NoError(t, err)
+		require.Error(t, cfg.Validate(), args)
+	}
+	for _, s := range []string{"alice=web+", "=web", "/alice", "alice/=web"} {
+		_, err := parseClientGrants(s, false)
+		require.Error(t, err, s)
+	}
+	for _, s := range []string{"web", "web=", "web=10.0.0.1", "web=zone=", "web==a"} {
+		require.Error(t, (&UpstreamGroupListValue{}).Set(s), s)
+	}
+}
+
+func TestConfigFromFlagsUpstreamGroupSelectors(t *testing.T) {
+	a := core.Upstream{Network: "tcp", Address: "10.0.0.1:80"}
+	b := core.Upstream{Network: "tcp", Address: "10.0.0.2:80"}
+	c := core.Upstream{Network: "tcp", Address: "10.0.0.3:80"}
+	cfg, err := newConfigFromFlags([]string{commandName, "-upstreams", "10.0.0.1:80,10.0.0.2:80,10.0.0.3:80",
+		"-upstream-labels", "10.0.0.1:80 zone=eu tier=primary",
+		"-upstream-labels", "10.0.0.2:80 zone=eu tier=secondary",
+		"-upstream-labels", "10.0.0.3:80 zone=us tier=primary",
+		"-upstream-group", "eu=zone=eu",
+		"-upstream-group", "eu-primary=zone=eu,tier=primary,10.0.0.3:80",
+		"-authzd-clients", "alice=eu,bob=eu-primary",
+	})
+	require.NoError(t, err)
+	require.NoError(t, cfg.Validate())
+	authorizer, err := makeAuthorizerFromConfig(cfg, metrics.NewRegistry())
+	require.NoError(t, err)
+	for client, expected := range map[string]core.UpstreamSet{
+		"alice": core.NewUpstreamSet(a, b),
+		"bob":   core.NewUpstreamSet(a, c),
+	} {
+		upstreams, err := authorizer.AuthorizedUpstreams(context.Background(), core.ClientID{Namespace: authn.DefaultNamespace, Key: client})
+		require.NoError(t, err)
+		require.Equal(t, expected, upstreams, client)
+	}
+
+	// Selectors that match no upstream are most likely mistaken.
+	cfg, err = newConfigFromFlags([]string{commandName, "-upstreams", "10.0.0.1:80", "-upstream-group", "eu=zone=eu", "-authzd-clients", "alice=eu"})
+	require.NoError(t, err)
+	require.Error(t, cfg.Validate())
+}
+
+func TestConfigFromFlagsAuthzCache(t *testing.T) {
+	cfg, err := newConfigFromFlags([]string{commandName, "-upstreams", "10.0.0.1:80"})
+	require.NoError(t, err)
+	require.Equal(t, defaultAuthzCacheSize, cfg.AuthzCacheSize)
+	require.Zero(t, cfg.AuthzCacheTTL)
+
+	cfg, err = newConfigFromFlags([]string{commandName, "-upstreams", "10.0.0.1:80", "-authz-cache-size", "5", "-authz-cache-ttl", "1m"})
+	require.NoError(t, err)
+	require.Equal(t, 5, cfg.AuthzCacheSize)
+	require.Equal(t, time.Minute, cfg.AuthzCacheTTL)
+
+	registry := metrics.NewRegistry()
+	authorizer, err := makeAuthorizerFromConfig(cfg, registry)
+	require.NoError(t, err)
+	for i := 0; i < 2; i++ {
+		_, err = authorizer.AuthorizedUpstreams(context.Background(), anonymousTestClientID)
+		require.NoError(t, err)
+	}
+	require.Equal(t, int64(1), registry.Counter("authz_cache_hits_total").Value())
+	require.Equal(t, int64(1), registry.Counter("authz_cache_misses_total").Value())
+}
+
+func TestParseClientID(t *testing.T) {
+	for s, want := range map[string]core.ClientID{
+		"alice":                        {Namespace: authn.DefaultNamespace, Key: "alice"},
+		"ip:10.0.0.5":                  {Namespace: "ip", Key: "10.0.0.5"},
+		"ip:fe80::1":                   {Namespace: "ip", Key: "fe80::1"},
+		"spiffe://example.com/ns/prod": {Namespace: "spiffe", Key: "spiffe://example.com/ns/prod"},
+		"monitor/probe":                {Namespace: "monitor", Key: "probe"},
+		"CommonName/host:8443":         {Namespace: authn.DefaultNamespace, Key: "host:8443"},
+		authn.Unauthenticated.String(): authn.Unauthenticated,
+		"test/anonymous":               anonymousTestClientID,
+		"x-509.sha256+v1:ab/cd":        {Namespace: "x-509.sha256+v1", Key: "ab/cd"},
+	} {
+		clientID, ok := parseClientID(s, true)
+		require.True(t, ok, s)
+		require.Equal(t, want, clientID, s)
+	}
+	for _, s := range []string{"", "ip:", ":10.0.0.5", "/alice", "monitor/", "a b:c", "tenant 1/alice"} {
+		_, ok := parseClientID(s, true)
+		require.False(t, ok, s)
+	}
+
+	// Unless namespaced, common names containing ':' keep their identity.
+	for s, want := range map[string]core.ClientID{
+		"alice":          {Namespace: authn.DefaultNamespace, Key: "alice"},
+		"host:8443":      {Namespace: authn.DefaultNamespace, Key: "host:8443"},
+		"ip:10.0.0.5":    {Namespace: authn.DefaultNamespace, Key: "ip:10.0.0.5"},
+		"monitor/probe":  {Namespace: "monitor", Key: "probe"},
+		"test/anonymous": anonymousTestClientID,
+	} {
+		clientID, ok := parseClientID(s, false)
+		require.True(t, ok, s)
+		require.Equal(t, want, clientID, s)
+	}
+	for _, s := range []string{"", "/alice", "monitor/"} {
+		_, ok := parseClientID(s, false)
+		require.False(t, ok, s)
+	}
+
+	grants, err := parseClientGrants("spiffe://example.com/web=web+db,ip:10.0.0.5", true)
+	require.NoError(t, err)
+	require.Equal(t, []ClientGrant{
+		{ClientID: core.ClientID{Namespace: "spiffe", Key: "spiffe://example.com/web"}, Groups: []string{"web", "db"}},
+		{ClientID: core.ClientID{Namespace: "ip", Key: "10.0.0.5"}, Groups: []string{allUpstreamsGroupName}},
+	}, grants)
+
+	cfg, err := newConfigFromFlags([]string{commandName, "-authzd-clients", "host:8443", "-limit-exempt-clients", "ip:10.0.0.5"})
+	require.NoError(t, err)
+	require.Equal(t, core.ClientID{Namespace: authn.DefaultNamespace, Key: "host:8443"}, cfg.AuthorizedClients[0].ClientID)
+	require.Equal(t, []core.ClientID{{Namespace: authn.DefaultNamespace, Key: "ip:10.0.0.5"}}, cfg.LimitExemptClients)
+	cfg, err = newConfigFromFlags([]string{commandName, "-namespaced-clients", "-authzd-clients", "host:8443", "-limit-exempt-clients", "ip:10.0.0.5"})
+	require.NoError(t, err)
+	require.Equal(t, core.ClientID{Namespace: "host", Key: "8443"}, cfg.AuthorizedClients[0].ClientID)
+	require.Equal(t, []core.ClientID{{Namespace: "ip", Key: "10.0.0.5"}}, cfg.LimitExemptClients)
+}
+
+func TestConfigFromFlagsLimitExemptions(t *testing.T) {
+	ctx := context.Background()
+	cfg, err := newConfigFromFlags([]string{commandName, "-upstreams", "10.0.0.1:80"})
+	require.NoError(t, err)
+	require.Nil(t, makeLimitExemptionsFromConfig(cfg, nil, nil))
+
+	cfg, err = newConfigFromFlags([]string{commandName, "-upstreams", "10.0.0.1:80,10.0.0.2:80",
+		"-upstream-group", "ops=10.0.0.2:80",
+		"-authzd-clients", "alice,bob=ops,monitor/probe",
+		"-limit-exempt-clients", "monitor/probe",
+		"-limit-exempt-groups", "ops",
+	})
+	require.NoError(t, err)
+	require.NoError(t, cfg.Validate())
+	require.Equal(t, []core.ClientID{{Namespace: "monitor", Key: "probe"}}, cfg.LimitExemptClients)
+	authorizer, err := makeAuthorizerFromConfig(cfg, metrics.NewRegistry())
+	require.NoError(t, err)
+	exemptions := makeLimitExemptionsFromConfig(cfg, authorizer.(forwarder.GroupResolver), metrics.NewRegistry())
+	for client, expected := range map[core.ClientID]bool{
+		{Namespace: authn.DefaultNamespace, Key: "alice"}: false,
+		{Namespace: authn.DefaultNamespace, Key: "bob"}:   true,
+		{Namespace: "monitor", Key: "probe"}:              true,
+	} {
+		exempt, err := exemptions.IsExempt(ctx, client)
+		require.NoError(t, err)
+		require.Equal(t, expected, exempt, client)
+	}
+
+	cfg, err = newConfigFromFlags([]string{commandName, "-upstreams", "10.0.0.1:80", "-limit-exempt-groups", "ops"})
+	require.NoError(t, err)
+	require.Error(t, cfg.Validate())
+	_, err = newConfigFromFlags([]string{commandName, "-upstreams", "10.0.0.1:80", "-limit-exempt-clients", "monitor/"})
+	require.Error(t, err)
+}
+
+func TestClientInspector(t *testing.T) {
+	ctx := context.Background()
+	cfg, err := newConfigFromFlags([]string{commandName, "-upstreams", "10.0.0.1:80,10.0.0.2:80",
+		"-upstream-group", "ops=10.0.0.2:80",
+		"-authzd-clients", "alice,bob=ops",
+		"-limit-exempt-groups", "ops",
+		"-priority-classes", "ops",
+		"-max-conns-per-client", "3",
+	})
+	require.NoError(t, err)
+	require.NoError(t, cfg.Validate())
+	authorizer, err := makeAuthorizerFromConfig(cfg, metrics.NewRegistry())
+	require.NoError(t, err)
+	tracker, _, err := makeHealthTrackerFromConfig(cfg, nil)
+	require.NoError(t, err)
+	pools, err := makePoolsFromConfig(cfg, &slog.RecordingLogger{}, tracker, nil, metrics.NewRegistry())
+	require.NoError(t, err)
+	groups := authorizer.(forwarder.GroupResolver)
+	inspector := &clientInspector{
+		reserver:   forwarder.PoolReserver{Pools: pools},
+		authorizer: authorizer,
+		classes:    &forwarder.PriorityClasses{Classes: cfg.PriorityClasses, Resolver: groups},
+		exemptions: makeLimitExemptionsFromConfig(cfg, groups, metrics.NewRegistry()),
+		rejections: &forwarder.ClientRejections{},
+	}
+	bob := core.ClientID{Namespace: authn.DefaultNamespace, Key: "bob"}
+	require.NoError(t, pools[defaultPoolName].Reserver.TryReserve(ctx, bob))
+	inspector.rejections.Record(bob, accesslog.ReasonRateLimited)
+
+	details, err := inspector.InspectClient(ctx, bob)
+	require.NoError(t, err)
+	require.Equal(t, "ops", details.Class)
+	require.True(t, details.Exempt)
+	require.Equal(t, []forwarder.ClientReservations{{ClientID: bob, Pool: defaultPoolName, Reservations: 1, Limit: 3}}, details.Reservations)
+	require.Equal(t, []string{"ops"}, details.Groups)
+	require.Equal(t, []string{"ops"}, details.UpstreamGroups)
+	require.Equal(t, map[accesslog.ReasonCode]int64{accesslog.ReasonRateLimited: 1}, details.Rejections.Counts)
+
+	stranger := core.ClientID{Namespace: authn.DefaultNamespace, Key: "mallory"}
+	details, err = inspector.InspectClient(ctx, stranger)
+	require.NoError(t, err)
+	require.Equal(t, forwarder.DefaultPriorityClass, details.Class)
+	require.False(t, details.Exempt)
+	require.Equal(t, []forwarder.ClientReservations{{ClientID: stranger, Pool: defaultPoolName, Limit: 3}}, details.Reservations)
+	require.Empty(t, details.Groups)
+	require.Empty(t, details.UpstreamGroups)
+	require.Empty(t, details.Rejections.Counts)
+}
+
+func TestConfigFromFlagsPriorityClasses(t *testing.T) {
+	args := []string{commandName, "-upstreams", "10.0.0.1:80,10.0.0.2:80",
+		"-upstream-group", "ops=10.0.0.2:80",
+		"-upstream-group", "staff=10.0.0.1:80",
+		"-authzd-clients", "alice=staff,bob=ops",
+		"-max-connections", "100",
+		"-cpu-overload-threshold", "0.9",
+	}
+	cfg, err := newConfigFromFlags(append(args, "-priority-classes", "ops,staff"))
+	require.NoError(t, err)
+	require.NoError(t, cfg.Validate())
+	require.Equal(t, 100, cfg.MaxConnections)
+	require.Equal(t, []string{"ops", "staff"}, cfg.PriorityClasses)
+	require.Equal(t, 0.9, cfg.CPUOverloadThreshold)
+
+	for _, classes := range []string{"ops,web", "ops,ops", "default"} {
+		cfg, err = newConfigFromFlags(append(args, "-priority-classes", classes))
+		require.NoError(t, err)
+		require.Error(t, cfg.Validate(), classes)
+	}
+	cfg, err = newConfigFromFlags(append(args, "-cpu-overload-threshold", "1.5"))
+	require.NoError(t, err)
+	require.Error(t, cfg.Validate())
+}
+
+func TestConfigFromFlagsPreDrainDelay(t *testing.T) {
+	cfg, err := newConfigFromFlags([]string{commandName, "-upstreams", "10.0.0.1:80", "-pre-drain-delay", "15s"})
+	require.NoError(t, err)
+	require.NoError(t, cfg.Validate())
+	require.Equal(t, 15*time.Second, cfg.PreDrainDelay)
+
+	// The server reports not ready while draining, though its listener is
+	// still bound.
+	cfg.ReadyMinHealthyUpstreams = 0
+	listenerBound, draining := int32(1), int32(0)
+	checks := makeReadinessChecks(cfg, &listenerBound, &draining, nil)
+	for _, check := range checks {
+		require.NoError(t, check())
+	}
+	draining = 1
+	failed := 0
+	for _, check := range checks {
+		if check() != nil {
+			failed++
+		}
+	}
+	require.Equal(t, 1, failed)
+
+	// A signal ends the delay early.
+	signals := make(chan os.Signal, 1)
+	signals <- syscall.SIGTERM
+	awaitPreDrain(&slog.RecordingLogger{}, time.Hour, signals)
+
+	cfg.PreDrainDelay = -time.Second
+	require.Error(t, cfg.Validate())
+}
+
+func TestConfigFromFlagsDrainIdleGrace(t *testing.T) {
+	cfg, err := newConfigFromFlags([]string{commandName, "-upstreams", "10.0.0.1:80", "-conn-idle-after", "1m", "-drain-idle-grace", "5s"})
+	require.NoError(t, err)
+	require.NoError(t, cfg.Validate())
+	require.Equal(t, 5*time.Second, cfg.DrainIdleGrace)
+
+	// Without -conn-idle-after, no connection is idle.
+	cfg.ConnIdleAfter = 0
+	require.Error(t, cfg.Validate())
 }
@@ -0,0 +1,350 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"tcplb/lib/forwarder"
+	"tcplb/lib/routing"
+)
+
+// Client authentication modes.
+const (
+	authnModeAnonymous    = "anonymous"     // authnModeAnonymous treats every client as the same anonymous client.
+	authnModeMTLS         = "mtls"          // authnModeMTLS identifies clients by the certificate they must present.
+	authnModeOptionalMTLS = "optional-mtls" // authnModeOptionalMTLS identifies clients by their certificate, if given, otherwise as authn.Unauthenticated.
+)
+
+// authnModes are the supported client authentication modes.
+var authnModes = []string{authnModeAnonymous, authnModeMTLS, authnModeOptionalMTLS}
+
+// Front-end protocols that clients speak before their data is forwarded.
+const (
+	frontendNone   = "none"   // frontendNone forwards the client's data as is, to an upstream chosen by tcplb.
+	frontendSOCKS5 = "socks5" // frontendSOCKS5 lets clients choose one of their authorized upstreams with a SOCKS5 CONNECT request.
+)
+
+// frontends are the supported front-end protocols.
+var frontends = []string{frontendNone, frontendSOCKS5}
+
+// ListenerTLSConfig configures TLS for a listener.
+type ListenerTLSConfig struct {
+	CertFile     string // CertFile is the path of the PEM server certificate. If empty, clients connect over plain TCP.
+	KeyFile      string // KeyFile is the path of the PEM private key of CertFile.
+	ClientCAFile string // ClientCAFile is the path of PEM CA certificates that client certificates are verified against.
+	ALPN         string // ALPN lists the application protocols offered to clients by TLS ALPN, comma-separated, most preferred first.
+}
+
+// Enabled reports if clients connect over TLS.
+func (c ListenerTLSConfig) Enabled() bool {
+	return c.CertFile != ""
+}
+
+// ListenerConfig configures a listener, together with the policies applied
+// to the client connections it accepts.
+type ListenerConfig struct {
+	Name     string
+	Network  string
+	Address  string
+	Pool     string // Pool is optional. If set, every connection is forwarded to the pool, whatever the routes.
+	Authn    string // Authn is the client authentication mode, one of authnModes.
+	Frontend string // Frontend is the protocol clients speak before their data is forwarded, one of frontends.
+	TLS      ListenerTLSConfig
+
+	// MaxConnectionsPerClient is optional. If positive, each client may make
+	// at most this many connections via the listener, whatever the pool,
+	// instead of being limited by the pools' limits.
+	MaxConnectionsPerClient int64
+}
+
+// Validate checks the listener, given the names of the configured pools.
+// It returns an *InvalidConfig listing every violation, with field paths
+// named after the keys of listener specifications.
+func (l *ListenerConfig) Validate(pools map[string]bool) error {
+	violations := &InvalidConfig{}
+	if l.Name == "" {
+		violations.addf("name", "listener must have a name")
+	}
+	if l.Address == "" {
+		violations.addf("address", "listener must have an address")
+	} else if strings.HasPrefix(l.Network, "tcp") {
+		violations.add("address", checkListenAddress(l.Address))
+	}
+	if l.Pool != "" && !pools[l.Pool] {
+		violations.addf("pool", "listener refers to undefined pool %q", l.Pool)
+	}
+	known := false
+	for _, mode := range authnModes {
+		known = known || l.Authn == mode
+	}
+	if !known {
+		violations.addf("authn", "unknown authn mode %q (expected one of %s)", l.Authn, strings.Join(authnModes, ", "))
+	}
+	known = false
+	for _, frontend := range frontends {
+		known = known || l.Frontend == frontend
+	}
+	if !known {
+		violations.addf("frontend", "unknown frontend %q (expected one of %s)", l.Frontend, strings.Join(frontends, ", "))
+	}
+	if (l.TLS.CertFile == "") != (l.TLS.KeyFile == "") {
+		violations.addf("tls-cert", "TLS certificate and key must be given together")
+	}
+	certAuthn := l.Authn == authnModeMTLS || l.Authn == authnModeOptionalMTLS
+	if certAuthn && (!l.TLS.Enabled() || l.TLS.ClientCAFile == "") {
+		violations.addf("authn", "authn mode %q needs a TLS certificate, key and client CA", l.Authn)
+	}
+	if l.TLS.ALPN != "" && !l.TLS.Enabled() {
+		violations.addf("tls-alpn", "application protocols are only negotiated over TLS")
+	}
+	if !certAuthn && l.TLS.ClientCAFile != "" {
+		violations.addf("tls-client-ca", "a client CA is only used by authn modes %s and %s", authnModeMTLS, authnModeOptionalMTLS)
+	}
+	return violations.err()
+}
+
+// loadTLSConfig returns the TLS config of the listener, or nil if clients
+// connect over plain TCP. Clients must present a certificate issued by the
+// client CA if the authn mode is mtls, and may do so if it is
+// optional-mtls.
+func (l *ListenerConfig) loadTLSConfig() (*tls.Config, error) {
+	if !l.TLS.Enabled() {
+		return nil, nil
+	}
+	cert, err := tls.LoadX509KeyPair(l.TLS.CertFile, l.TLS.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("listener %q: %w", l.Name, err)
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if l.TLS.ALPN != "" {
+		config.NextProtos = strings.Split(l.TLS.ALPN, ",")
+	}
+	switch l.Authn {
+	case authnModeMTLS:
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	case authnModeOptionalMTLS:
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	default:
+		return config, nil
+	}
+	data, err := os.ReadFile(l.TLS.ClientCAFile)
+	if err != nil {
+		return nil, fmt.Errorf("listener %q: %w", l.Name, err)
+	}
+	config.ClientCAs = x509.NewCertPool()
+	if !config.ClientCAs.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("listener %q: no certificates found in %s", l.Name, l.TLS.ClientCAFile)
+	}
+	return config, nil
+}
+
+// ListenerListValue is a flag.Value that collects additional listeners.
+type ListenerListValue struct {
+	Listeners []ListenerConfig
+}
+
+func (v *ListenerListValue) String() string {
+	tokens := make([]string, len(v.Listeners))
+	for i, l := range v.Listeners {
+		tokens[i] = fmt.Sprintf("name=%s address=%s", l.Name, l.Address)
+	}
+	return strings.Join(tokens, "; ")
+}
+
+func (v *ListenerListValue) Set(s string) error {
+	listener, err := parseListenerConfig(s)
+	if err != nil {
+		return err
+	}
+	v.Listeners = append(v.Listeners, listener)
+	return nil
+}
+
+// parseListenerConfig parses a listener from space-separated key=value
+// fields, e.g. "name=internal address=127.0.0.1:4322 pool=web".
+func parseListenerConfig(spec string) (ListenerConfig, error) {
+	listener := ListenerConfig{Network: defaultListenNetwork, Authn: authnModeAnonymous, Frontend: frontendNone}
+	for _, field := range strings.Fields(spec) {
+		key, value, ok := strings.Cut(field, "=")
+		if !ok || value == "" {
+			return ListenerConfig{}, fmt.Errorf("listener %q: expected key=value but got %q", spec, field)
+		}
+		var err error
+		switch key {
+		case "name":
+			listener.Name = value
+		case "network":
+			listener.Network = value
+		case "address":
+			listener.Address = value
+		case "pool":
+			listener.Pool = value
+		case "authn":
+			listener.Authn = value
+		case "frontend":
+			listener.Frontend = value
+		case "tls-cert":
+			listener.TLS.CertFile = value
+		case "tls-key":
+			listener.TLS.KeyFile = value
+		case "tls-client-ca":
+			listener.TLS.ClientCAFile = value
+		case "tls-alpn":
+			listener.TLS.ALPN = value
+		case "max-conns-per-client":
+			listener.MaxConnectionsPerClient, err = strconv.ParseInt(value, 10, 64)
+		default:
+			err = errors.New("unknown key (expected one of name, network, address, pool, authn, frontend, tls-cert, tls-key, tls-client-ca, tls-alpn, max-conns-per-client)")
+		}
+		if err != nil {
+			return ListenerConfig{}, fmt.Errorf("listener %q: %s: %w", spec, key, err)
+		}
+	}
+	return listener, nil
+}
+
+// PortMapValue is a flag.Value that adds a listener for each mapping of a
+// listen address to a pool, e.g. "5432=postgres,127.0.0.1:6379=redis", so
+// that one process may proxy to several pools, each on its own port. An
+// address given as a port alone listens on every interface. Each listener
+// is named after its port, e.g. "port-5432", accepts plain TCP from
+// anonymous clients, and forwards every connection to its pool.
+type PortMapValue struct {
+	Listeners *ListenerListValue // Listeners collects the listeners, in order with those given by -listener.
+}
+
+func (v *PortMapValue) String() string {
+	return ""
+}
+
+func (v *PortMapValue) Set(s string) error {
+	for _, mapping := range splitList(s) {
+		address, pool, ok := strings.Cut(mapping, "=")
+		if !ok || pool == "" {
+			return fmt.Errorf("port mapping %q: expected address=pool", mapping)
+		}
+		if !strings.Contains(address, ":") {
+			address = ":" + address
+		}
+		_, port, err := splitAddress(address)
+		if err != nil {
+			return fmt.Errorf("port mapping %q: %w", mapping, err)
+		}
+		v.Listeners.Listeners = append(v.Listeners.Listeners, ListenerConfig{
+			Name:     "port-" + port,
+			Network:  defaultListenNetwork,
+			Address:  address,
+			Pool:     pool,
+			Authn:    authnModeAnonymous,
+			Frontend: frontendNone,
+		})
+	}
+	return nil
+}
+
+// allListeners returns the main listener, configured by the global flags,
+// followed by the additional listeners.
+func allListeners(cfg *Config) []ListenerConfig {
+	main := ListenerConfig{
+		Name:     mainListenerName,
+		Network:  cfg.ListenNetwork,
+		Address:  cfg.ListenAddress,
+		Authn:    cfg.ListenAuthn,
+		Frontend: frontendNone,
+		TLS:      cfg.ListenTLS,
+	}
+	return append([]ListenerConfig{main}, cfg.Listeners...)
+}
+
+// validateListeners checks the listeners, given the configured pools.
+func validateListeners(cfg *Config) error {
+	pools := make(map[string]bool, len(cfg.Pools))
+	for _, p := range cfg.Pools {
+		pools[p.Name] = true
+	}
+	violations := &InvalidConfig{}
+	names := map[string]bool{adminListenerName: true, controlListenerName: true, eventListenerName: true}
+	for i, l := range allListeners(cfg) {
+		field := indexedField("listener", l.Name, i)
+		violations.add(field, l.Validate(pools))
+		if names[l.Name] {
+			violations.addf(field, "listener name %q is already in use", l.Name)
+		}
+		names[l.Name] = true
+	}
+	return violations.err()
+}
+
+// checkAdminAddressIsolated checks that the admin endpoints would not be
+// served on the address of any data-plane listener, so that they are never
+// exposed to clients.
+func checkAdminAddressIsolated(cfg *Config) error {
+	for _, l := range allListeners(cfg) {
+		if addressesOverlap(cfg.AdminListenAddress, l.Address) {
+			return fmt.Errorf("admin listen address %s overlaps the address %s of listener %q", cfg.AdminListenAddress, l.Address, l.Name)
+		}
+	}
+	return nil
+}
+
+// addressesOverlap reports if the host:port addresses a and b could refer
+// to the same socket: they have the same port, and the same host, or either
+// host is unspecified. Addresses that cannot be parsed, or that listen on
+// an ephemeral port, do not overlap.
+func addressesOverlap(a, b string) bool {
+	aHost, aPort, err := net.SplitHostPort(a)
+	if err != nil {
+		return false
+	}
+	bHost, bPort, err := net.SplitHostPort(b)
+	if err != nil {
+		return false
+	}
+	if aPort != bPort || aPort == "0" {
+		return false
+	}
+	unspecified := func(host string) bool {
+		ip := net.ParseIP(host)
+		return host == "" || (ip != nil && ip.IsUnspecified())
+	}
+	return aHost == bHost || unspecified(aHost) || unspecified(bHost)
+}
+
+// listenerRoutes returns routing rules that bind listeners to their pools.
+// They take priority over the configured routes.
+func listenerRoutes(cfg *Config) []routing.Rule {
+	var rules []routing.Rule
+	for _, l := range cfg.Listeners {
+		if l.Pool != "" {
+			rules = append(rules, routing.Rule{Pool: l.Pool, Listener: l.Name})
+		}
+	}
+	return rules
+}
+
+// validateAcceptQueue checks the bounds on accepting client connections.
+func validateAcceptQueue(cfg *Config) error {
+	violations := &InvalidConfig{}
+	if cfg.ListenBacklog < 0 {
+		violations.addf("listen-backlog", "listen backlog must not be negative")
+	}
+	if cfg.AcceptQueueLength < 0 {
+		violations.addf("accept-queue-length", "accept queue length must not be negative")
+	}
+	known := false
+	for _, policy := range forwarder.OverflowPolicies {
+		known = known || cfg.AcceptQueueOverflow == string(policy)
+	}
+	if !known {
+		violations.addf("accept-queue-overflow", "unknown accept queue overflow policy %q (expected %s or %s)", cfg.AcceptQueueOverflow, forwarder.OverflowQueue, forwarder.OverflowReject)
+	}
+	return violations.err()
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"tcplb/lib/loadgen"
+	"time"
+)
+
+const (
+	loadgenCommandName = "loadgen"
+	loadgenDescription = `opens concurrent client connections to a tcplb server, and sends messages
+over each at a given rate, then reports latency percentiles and error rates.
+the server is expected to forward to an upstream that echoes what it reads.
+interrupt to stop early and report.
+`
+)
+
+// loadgenOptions is the configuration of the "tcplb loadgen" command.
+type loadgenOptions struct {
+	Config       loadgen.Config
+	JSON         bool    // JSON writes the report as JSON.
+	MaxErrorRate float64 // MaxErrorRate is the fraction of failed dials and round trips above which the command fails.
+}
+
+// parseLoadgenFlags parses the command line of the "tcplb loadgen"
+// command, loading its TLS certificates.
+func parseLoadgenFlags(argv []string, stderr io.Writer) (loadgenOptions, error) {
+	var opts loadgenOptions
+	flagSet := flag.NewFlagSet(commandName+" "+loadgenCommandName, flag.ContinueOnError)
+	flagSet.SetOutput(stderr)
+	flagSet.Usage = func() {
+		fmt.Fprintf(stderr, "usage: %s %s [flags]\n\n%s\nflags:\n", commandName, loadgenCommandName, loadgenDescription)
+		flagSet.PrintDefaults()
+	}
+	flagSet.StringVar(&opts.Config.Address, "address", "", "address of the server, as host:port.")
+	flagSet.IntVar(&opts.Config.Connections, "connections", 10, "number of concurrent connections to keep open.")
+	flagSet.IntVar(&opts.Config.MessageSize, "message-size", 64, "size in bytes of each message.")
+	flagSet.Float64Var(&opts.Config.Rate, "rate", 10, "messages per second to send over each connection. if not positive, messages are sent back to back.")
+	flagSet.DurationVar(&opts.Config.Duration, "duration", 10*time.Second, "how long to generate load for.")
+	flagSet.DurationVar(&opts.Config.Timeout, "timeout", 10*time.Second, "time limit for each dial, and for each message to be echoed back.")
+	certFile := flagSet.String("tls-cert", "", "path of the PEM client certificate to authenticate with. if not given, connections are plain TCP.")
+	keyFile := flagSet.String("tls-key", "", "path of the PEM private key of -tls-cert.")
+	caFile := flagSet.String("tls-ca", "", "path of PEM CA certificates to verify the server with. if not given, the system roots are used.")
+	serverName := flagSet.String("tls-server-name", "", "name to verify the server certificate against. defaults to the host of -address.")
+	flagSet.BoolVar(&opts.JSON, "json", false, "write the report as JSON.")
+	flagSet.Float64Var(&opts.MaxErrorRate, "max-error-rate", 1, "fail if the fraction of dials and round trips that fail exceeds this.")
+	if err := flagSet.Parse(argv[1:]); err != nil {
+		return opts, err
+	}
+	if flagSet.NArg() > 0 {
+		return opts, fmt.Errorf("unexpected arguments %q", flagSet.Args())
+	}
+	if opts.Config.Address == "" {
+		return opts, errors.New("-address is required")
+	}
+	if opts.Config.Connections <= 0 || opts.Config.MessageSize <= 0 {
+		return opts, errors.New("-connections and -message-size must be positive")
+	}
+	if (*certFile == "") != (*keyFile == "") {
+		return opts, errors.New("-tls-cert and -tls-key must be given together")
+	}
+	if *certFile == "" {
+		if *caFile != "" || *serverName != "" {
+			return opts, errors.New("-tls-ca and -tls-server-name require -tls-cert")
+		}
+		return opts, nil
+	}
+	cert, err := tls.LoadX509KeyPair(*certFile, *keyFile)
+	if err != nil {
+		return opts, err
+	}
+	opts.Config.TLS = &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ServerName:   *serverName,
+		MinVersion:   tls.VersionTLS12,
+	}
+	if *caFile != "" {
+		data, err := os.ReadFile(*caFile)
+		if err != nil {
+			return opts, err
+		}
+		roots := x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(data) {
+			return opts, fmt.Errorf("no certificates found in %s", *caFile)
+		}
+		opts.Config.TLS.RootCAs = roots
+	}
+	return opts, nil
+}
+
+// runLoadgen implements the "tcplb loadgen" command, which generates load
+// against a running server, and prints a report of how it coped.
+func runLoadgen(argv []string, stdout, stderr io.Writer) int {
+	opts, err := parseLoadgenFlags(argv, stderr)
+	if errors.Is(err, flag.ErrHelp) {
+		return exitInvalidConfig
+	}
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return exitInvalidConfig
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	report := (&loadgen.Generator{Config: opts.Config}).Run(ctx)
+	if opts.JSON {
+		enc := json.NewEncoder(stdout)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(report)
+	} else {
+		err = report.WriteText(stdout)
+	}
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return exitServerError
+	}
+	if rate := report.ErrorRate(); rate > opts.MaxErrorRate {
+		fmt.Fprintf(stderr, "error rate %.4f exceeds -max-error-rate %.4f\n", rate, opts.MaxErrorRate)
+		return exitServerError
+	}
+	return exitOK
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"github.com/stretchr/testify/require"
+	"io"
+	"tcplb/lib/loadgen"
+	"tcplb/lib/testbed"
+	"testing"
+)
+
+func TestRunLoadgen(t *testing.T) {
+	tb := testbed.New(t)
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", tb.ServerTLSConfig(tb.Server(t, "tcplb.test")))
+	require.NoError(t, err)
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+	client := tb.Client(t, "loadgen")
+
+	var stdout, stderr bytes.Buffer
+	status := runLoadgen([]string{
+		loadgenCommandName,
+		"-address", listener.Addr().String(),
+		"-connections", "3",
+		"-rate", "100",
+		"-duration", "100ms",
+		"-tls-cert", client.CertFile,
+		"-tls-key", client.KeyFile,
+		"-tls-ca", tb.CAFile,
+		"-tls-server-name", "tcplb.test",
+		"-max-error-rate", "0",
+		"-json",
+	}, &stdout, &stderr)
+	require.Equal(t, exitOK, status, stderr.String())
+	var report loadgen.Report
+	require.NoError(t, json.Unmarshal(stdout.Bytes(), &report))
+	require.Equal(t, 3, report.Connections)
+	require.Equal(t, 3, report.Dials.Count)
+	require.Positive(t, report.RoundTrips.Count)
+	require.Zero(t, report.ErrorCount())
+
+	// The server hangs up on plain TCP connections, failing every message.
+	stdout.Reset()
+	stderr.Reset()
+	status = runLoadgen([]string{
+		loadgenCommandName,
+		"-address", listener.Addr().String(),
+		"-rate", "100",
+		"-duration", "100ms",
+		"-max-error-rate", "0.1",
+	}, &stdout, &stderr)
+	require.Equal(t, exitServerError, status)
+	require.Contains(t, stderr.String(), "exceeds -max-error-rate")
+}
+
+func TestParseLoadgenFlagsErrors(t *testing.T) {
+	for _, args := range [][]string{
+		{},
+		{"-address", "127.0.0.1:4321", "-connections", "0"},
+		{"-address", "127.0.0.1:4321", "-tls-cert", "client.pem"},
+		{"-address", "127.0.0.1:4321", "-tls-ca", "ca.pem"},
+		{"-address", "127.0.0.1:4321", "-tls-cert", "missing.pem", "-tls-key", "missing-key.pem"},
+		{"-address", "127.0.0.1:4321", "extra"},
+	} {
+		_, err := parseLoadgenFlags(append([]string{loadgenCommandName}, args...), io.Discard)
+		require.Error(t, err, args)
+	}
+	opts, err := parseLoadgenFlags([]string{loadgenCommandName, "-address", "127.0.0.1:4321"}, io.Discard)
+	require.NoError(t, err)
+	require.Nil(t, opts.Config.TLS)
+	require.Equal(t, 10, opts.Config.Connections)
+}
@@ -1,32 +1,87 @@
 package main
 
 import (
+	"errors"
+	"fmt"
 	"os"
 	"tcplb/lib/slog"
 )
 
+const (
+	exitOK             = 0
+	exitServerError    = 1
+	exitInvalidConfig  = 2
+	exitForcedShutdown = 3
+)
+
 func main() {
+	os.Exit(run(os.Args))
+}
+
+func run(argv []string) int {
+	if len(argv) > 1 && argv[1] == adminCommandName {
+		return runAdmin(argv[1:], os.Stdout, os.Stderr)
+	}
+	if len(argv) > 1 && argv[1] == loadgenCommandName {
+		return runLoadgen(argv[1:], os.Stdout, os.Stderr)
+	}
+	if len(argv) > 1 && argv[1] == checkCertsCommandName {
+		return runCheckCerts(argv[1:], os.Stdout, os.Stderr)
+	}
+
 	logger := slog.GetDefaultLogger()
 
-	cfg, err := newConfigFromFlags(os.Args)
+	cfg, err := newConfigFromFlags(argv)
 	if err != nil {
 		logger.Error(&slog.LogRecord{Msg: "failed to parse flags", Error: err})
-		os.Exit(2)
+		return exitInvalidConfig
 	}
 
-	logger.Info(&slog.LogRecord{Msg: "loaded config", Details: cfg})
-
 	err = cfg.Validate()
 	if err != nil {
-		logger.Error(&slog.LogRecord{Msg: "configuration is invalid", Error: err})
-		os.Exit(2)
+		var invalid *InvalidConfig
+		if errors.As(err, &invalid) {
+			for _, v := range invalid.Violations {
+				logger.Error(&slog.LogRecord{Msg: "invalid configuration: " + v.Field, Error: v.Err})
+			}
+			logger.Error(&slog.LogRecord{Msg: fmt.Sprintf("configuration is invalid: %d violation(s)", len(invalid.Violations)), Details: cfg})
+		} else {
+			logger.Error(&slog.LogRecord{Msg: "configuration is invalid", Error: err, Details: cfg})
+		}
+		return exitInvalidConfig
 	}
 
-	err = serve(logger, cfg)
+	configuredLogger, logCloser, err := makeLoggerFromConfig(cfg)
+	if err != nil {
+		logger.Error(&slog.LogRecord{Msg: "failed to open log output", Error: err})
+		return exitInvalidConfig
+	}
+	defer func() {
+		_ = logCloser.Close()
+	}()
+	logger = configuredLogger
+
+	if cfg.LogSampleBurst > 0 {
+		sampler := slog.NewSamplingLogger(logger, slog.SamplingOptions{
+			Burst:    cfg.LogSampleBurst,
+			Interval: cfg.LogSampleInterval,
+		})
+		stopFlusher := sampler.StartFlusher()
+		defer stopFlusher()
+		logger = sampler
+	}
+
+	logger.Info(&slog.LogRecord{Msg: "loaded config", Details: cfg})
+
+	err = serve(logger, configuredLogger, cfg)
+	if errors.Is(err, errForcedShutdown) {
+		logger.Warn(&slog.LogRecord{Msg: "server terminated after forced shutdown"})
+		return exitForcedShutdown
+	}
 	if err != nil {
 		logger.Error(&slog.LogRecord{Msg: "server terminated abnormally", Error: err})
-		os.Exit(1)
+		return exitServerError
 	}
 	logger.Info(&slog.LogRecord{Msg: "server terminated normally"})
-	os.Exit(0)
+	return exitOK
 }
@@ -0,0 +1,12 @@
+//go:build go1.19
+
+package main
+
+import "runtime/debug"
+
+// memoryLimitSupported is true if the runtime supports a memory limit.
+const memoryLimitSupported = true
+
+func setMemoryLimit(limit int64) {
+	debug.SetMemoryLimit(limit)
+}
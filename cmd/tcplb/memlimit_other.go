@@ -0,0 +1,9 @@
+//go:build !go1.19
+
+package main
+
+// memoryLimitSupported is false, as runtimes before Go 1.19 have no memory
+// limit.
+const memoryLimitSupported = false
+
+func setMemoryLimit(limit int64) {}
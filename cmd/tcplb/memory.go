@@ -0,0 +1,40 @@
+package main
+
+import (
+	"fmt"
+	"runtime/debug"
+	"tcplb/lib/limiter"
+	"tcplb/lib/metrics"
+	"tcplb/lib/slog"
+	"time"
+)
+
+// memorySampleInterval is how often the heap is measured by the memory
+// watchdog.
+const memorySampleInterval = time.Second
+
+// applyMemoryTuningFromConfig applies the garbage collection target and the
+// memory limit of cfg to the runtime, in place of those given by the GOGC
+// and GOMEMLIMIT environment variables, if any.
+func applyMemoryTuningFromConfig(cfg *Config, logger slog.Logger) {
+	if cfg.GCPercent != 0 {
+		previous := debug.SetGCPercent(cfg.GCPercent)
+		logger.Info(&slog.LogRecord{Msg: fmt.Sprintf("set GC target percentage to %d, was %d", cfg.GCPercent, previous)})
+	}
+	if cfg.MemoryLimit > 0 {
+		setMemoryLimit(cfg.MemoryLimit)
+		logger.Info(&slog.LogRecord{Msg: fmt.Sprintf("set memory limit to %d bytes", cfg.MemoryLimit)})
+	}
+}
+
+// makeMemoryWatchdogFromConfig returns the watchdog of the heap, or nil if
+// the heap is not monitored.
+func makeMemoryWatchdogFromConfig(cfg *Config, logger slog.Logger, registry *metrics.Registry) *limiter.MemoryWatchdog {
+	if cfg.MemoryShedThreshold <= 0 {
+		return nil
+	}
+	watchdog := limiter.NewMemoryWatchdog(uint64(cfg.MemoryShedThreshold))
+	watchdog.HeapBytes = registry.Gauge("memory_heap_bytes")
+	watchdog.Logger = logger
+	return watchdog
+}
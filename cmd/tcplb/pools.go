@@ -0,0 +1,447 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"tcplb/lib/authz"
+	"tcplb/lib/core"
+	"tcplb/lib/dialer"
+	"tcplb/lib/forwarder"
+	"tcplb/lib/healthcheck"
+	"tcplb/lib/metrics"
+	"tcplb/lib/routing"
+	"tcplb/lib/slog"
+	"time"
+)
+
+const (
+	defaultPoolName   = "default"
+	defaultPoolPolicy = dialer.LeastConnectionsPolicy
+)
+
+// PROXY protocol versions that may be sent to upstreams.
+const (
+	proxyProtocolNone = "none" // proxyProtocolNone sends no PROXY protocol header.
+	proxyProtocolV2   = "v2"   // proxyProtocolV2 sends a PROXY protocol v2 header.
+)
+
+// PoolTLSConfig configures TLS to the upstreams of a pool.
+type PoolTLSConfig struct {
+	Enabled    bool     // Enabled re-encrypts client traffic to upstreams with TLS. If false, upstreams are spoken to over plain TCP.
+	CertFile   string   // CertFile is the path of the PEM client certificate presented to upstreams. If empty, none is presented.
+	KeyFile    string   // KeyFile is the path of the PEM private key of CertFile.
+	CAFile     string   // CAFile is the path of PEM CA certificates that upstream certificates are verified against. If empty, the system's are used.
+	ServerName string   // ServerName is the name upstream certificates must be issued for. If empty, it is the host of each upstream's address.
+	Verify     string   // Verify is how upstream certificates are verified, one of dialer.VerifyModes.
+	SPKIPins   []string // SPKIPins are the base64 SHA-256 hashes of the public keys pinned by the spki-pinned verify mode.
+}
+
+// PoolConfig configures a named pool of upstreams.
+type PoolConfig struct {
+	Name                    string
+	Upstreams               []core.Upstream
+	Policy                  string                // Policy is the name of the dial policy used to choose an upstream.
+	Weights                 map[core.Upstream]int // Weights are used by weighted dial policies. Unlisted upstreams have weight 1.
+	DialTimeout             time.Duration         // DialTimeout bounds each dial of an upstream.
+	RetryTimeout            time.Duration         // RetryTimeout bounds dialing, including retries of other upstreams. If not positive, each upstream is tried once.
+	RetryBackoff            time.Duration         // RetryBackoff is the pause before retrying, once every upstream has failed.
+	MaxDialAttempts         int                   // MaxDialAttempts bounds the upstreams dialed, including retries, before dialing fails. If not positive, no bound.
+	FailFast                bool                  // FailFast gives up once every upstream has failed, without retrying. It is set by the global -dial-fail-fast flag.
+	MaxConnectionsPerClient int64                 // MaxConnectionsPerClient limits connections to the pool per client. If not positive, no limit.
+	ReservationLeaseTTL     time.Duration         // ReservationLeaseTTL is how long a client's reservations last unless renewed by a live connection. If not positive, they last until released. It is set by the global -reservation-lease-ttl flag.
+	MaxConcurrentClients    int64                 // MaxConcurrentClients limits the distinct clients connected to the pool. If not positive, or if MaxConnectionsPerClient is not positive, no limit.
+	HealthCheckInterval     time.Duration         // HealthCheckInterval is the time between probes of each upstream. If not positive, no probes.
+	HealthCheckTimeout      time.Duration         // HealthCheckTimeout bounds each upstream probe.
+	EgressProxy             string                // EgressProxy is the URL of the SOCKS5 or HTTP CONNECT proxy that upstreams are dialed and probed through. If empty, upstreams are dialed directly.
+	UpstreamDefaultPort     string                // UpstreamDefaultPort is the port of upstreams given without one. It is set by the global -upstream-default-port flag.
+	ProxyProtocol           string                // ProxyProtocol is the version of the PROXY protocol header sent to upstreams, proxyProtocolNone or proxyProtocolV2.
+	ProxyProtocolTLVs       string                // ProxyProtocolTLVs lists the TLVs of PROXY protocol v2 headers, as parsed by forwarder.ParseProxyHeaderTLVs. It is unused unless ProxyProtocol is proxyProtocolV2.
+	TLS                     PoolTLSConfig         // TLS configures TLS to the pool's upstreams.
+	HalfOpenTimeout         time.Duration         // HalfOpenTimeout bounds the time a connection is forwarded in one direction after the other has finished. If not positive, no bound.
+}
+
+// Validate checks the pool. It returns an *InvalidConfig listing every
+// violation, with field paths named after the keys of pool specifications.
+func (p *PoolConfig) Validate() error {
+	violations := &InvalidConfig{}
+	if p.Name == "" {
+		violations.addf("name", "pool must have a name")
+	}
+	if len(p.Upstreams) == 0 {
+		violations.addf("upstreams", "pool must be configured with 1 or more upstreams")
+	}
+	if _, err := dialer.NewDialPolicy(dialer.PolicyConfig{Name: p.Policy}); err != nil {
+		violations.add("policy", err)
+	}
+	upstreams := core.NewUpstreamSet(p.Upstreams...)
+	weighted := core.EmptyUpstreamSet()
+	for u := range p.Weights {
+		weighted[u] = struct{}{}
+	}
+	for _, u := range weighted.Sorted() {
+		switch {
+		case !upstreams.Contains(u):
+			violations.addf("weights", "weight given for %s, which is not one of the pool's upstreams", u.Address)
+		case p.Weights[u] <= 0:
+			violations.addf("weights", "weight for %s must be positive", u.Address)
+		}
+	}
+	if p.DialTimeout <= 0 {
+		violations.addf("dial-timeout", "dial timeout must be positive")
+	}
+	if p.RetryBackoff < 0 {
+		violations.addf("retry-backoff", "retry backoff must not be negative")
+	}
+	if p.MaxDialAttempts < 0 {
+		violations.addf("max-dial-attempts", "max dial attempts must not be negative")
+	}
+	if p.HealthCheckInterval > 0 && p.HealthCheckTimeout <= 0 {
+		violations.addf("healthcheck-timeout", "health check timeout must be positive when health checks are enabled")
+	}
+	if p.EgressProxy != "" {
+		if _, err := dialer.ParseProxyURL(p.EgressProxy); err != nil {
+			violations.add("proxy", err)
+		}
+	}
+	if p.ProxyProtocol != proxyProtocolNone && p.ProxyProtocol != proxyProtocolV2 {
+		violations.addf("proxy-protocol", "unknown proxy protocol %q (expected %s or %s)", p.ProxyProtocol, proxyProtocolNone, proxyProtocolV2)
+	}
+	if _, err := forwarder.ParseProxyHeaderTLVs(p.ProxyProtocolTLVs); err != nil {
+		violations.add("proxy-protocol-tlvs", err)
+	}
+	if (p.TLS.CertFile == "") != (p.TLS.KeyFile == "") {
+		violations.addf("tls-cert", "TLS client certificate and key must be given together")
+	}
+	known := false
+	for _, mode := range dialer.VerifyModes {
+		known = known || p.TLS.Verify == string(mode)
+	}
+	if !known {
+		violations.addf("tls-verify", "unknown TLS verify mode %q (expected one of %s, %s, %s or %s)", p.TLS.Verify, dialer.VerifyFull, dialer.VerifyCAPinned, dialer.VerifySPKIPinned, dialer.VerifyInsecure)
+	}
+	if p.TLS.Enabled && p.TLS.Verify == string(dialer.VerifyCAPinned) && p.TLS.CAFile == "" {
+		violations.addf("tls-ca", "TLS verify mode %s needs a CA file", dialer.VerifyCAPinned)
+	}
+	if p.TLS.Enabled && p.TLS.Verify == string(dialer.VerifySPKIPinned) && len(p.TLS.SPKIPins) == 0 {
+		violations.addf("tls-spki-pins", "TLS verify mode %s needs pinned public keys", dialer.VerifySPKIPinned)
+	}
+	for _, pin := range p.TLS.SPKIPins {
+		if _, err := dialer.ParseSPKIPin(pin); err != nil {
+			violations.add("tls-spki-pins", err)
+		}
+	}
+	return violations.err()
+}
+
+// PoolListValue is a flag.Value that collects pool specifications. They
+// are parsed by resolve once all other flags are known, as omitted pool
+// settings default to the values of the corresponding global flags.
+type PoolListValue struct {
+	Specs []string
+}
+
+func (v *PoolListValue) String() string {
+	return strings.Join(v.Specs, "; ")
+}
+
+func (v *PoolListValue) Set(s string) error {
+	v.Specs = append(v.Specs, s)
+	return nil
+}
+
+// resolve parses each pool specification, taking omitted settings from defaults.
+func (v *PoolListValue) resolve(defaults PoolConfig) ([]PoolConfig, error) {
+	pools := make([]PoolConfig, 0, len(v.Specs))
+	for _, spec := range v.Specs {
+		pool, err := parsePoolConfig(spec, defaults)
+		if err != nil {
+			return nil, err
+		}
+		pools = append(pools, pool)
+	}
+	return pools, nil
+}
+
+// parsePoolConfig parses a pool from space-separated key=value fields, e.g.
+// "name=web upstreams=10.0.0.1:80,10.0.0.2:80 max-conns-per-client=5".
+func parsePoolConfig(spec string, defaults PoolConfig) (PoolConfig, error) {
+	pool := defaults
+	pool.Name = ""
+	pool.Upstreams = nil
+	pool.Weights = nil
+	for _, field := range strings.Fields(spec) {
+		key, value, ok := strings.Cut(field, "=")
+		if !ok || value == "" {
+			return PoolConfig{}, fmt.Errorf("pool %q: expected key=value but got %q", spec, field)
+		}
+		var err error
+		switch key {
+		case "name":
+			pool.Name = value
+		case "upstreams":
+			upstreams := &UpstreamListValue{DefaultPort: pool.UpstreamDefaultPort}
+			err = upstreams.Set(value)
+			pool.Upstreams = upstreams.Upstreams
+		case "policy":
+			pool.Policy = value
+		case "weights":
+			pool.Weights, err = parseWeights(value, pool.UpstreamDefaultPort)
+		case "dial-timeout":
+			pool.DialTimeout, err = time.ParseDuration(value)
+		case "retry-timeout":
+			pool.RetryTimeout, err = time.ParseDuration(value)
+		case "retry-backoff":
+			pool.RetryBackoff, err = time.ParseDuration(value)
+		case "max-dial-attempts":
+			pool.MaxDialAttempts, err = strconv.Atoi(value)
+		case "max-conns-per-client":
+			pool.MaxConnectionsPerClient, err = strconv.ParseInt(value, 10, 64)
+		case "max-clients":
+			pool.MaxConcurrentClients, err = strconv.ParseInt(value, 10, 64)
+		case "healthcheck-interval":
+			pool.HealthCheckInterval, err = time.ParseDuration(value)
+		case "healthcheck-timeout":
+			pool.HealthCheckTimeout, err = time.ParseDuration(value)
+		case "proxy":
+			pool.EgressProxy = value
+		case "proxy-protocol":
+			pool.ProxyProtocol = value
+		case "proxy-protocol-tlvs":
+			pool.ProxyProtocolTLVs = value
+		case "tls":
+			pool.TLS.Enabled, err = strconv.ParseBool(value)
+		case "tls-cert":
+			pool.TLS.CertFile = value
+		case "tls-key":
+			pool.TLS.KeyFile = value
+		case "tls-ca":
+			pool.TLS.CAFile = value
+		case "tls-server-name":
+			pool.TLS.ServerName = value
+		case "tls-verify":
+			pool.TLS.Verify = value
+		case "tls-spki-pins":
+			pool.TLS.SPKIPins = splitList(value)
+		case "half-open-timeout":
+			pool.HalfOpenTimeout, err = time.ParseDuration(value)
+		default:
+			err = errors.New("unknown key (expected one of name, upstreams, policy, weights, dial-timeout, retry-timeout, retry-backoff, max-dial-attempts, max-conns-per-client, max-clients, healthcheck-interval, healthcheck-timeout, proxy, proxy-protocol, proxy-protocol-tlvs, tls, tls-cert, tls-key, tls-ca, tls-server-name, tls-verify, tls-spki-pins, half-open-timeout)")
+		}
+		if err != nil {
+			return PoolConfig{}, fmt.Errorf("pool %q: %s: %w", spec, key, err)
+		}
+	}
+	return pool, nil
+}
+
+// parseWeights parses comma-separated upstream weights, e.g.
+// "10.0.0.1:80=3,10.0.0.2:80=1". Upstreams given without a port have
+// defaultPort, if it is not empty.
+func parseWeights(s, defaultPort string) (map[core.Upstream]int, error) {
+	weights := make(map[core.Upstream]int)
+	for _, token := range strings.Split(s, upstreamListSep) {
+		address, weight, ok := strings.Cut(token, "=")
+		if !ok {
+			return nil, fmt.Errorf("expected host:port=weight but got %q", token)
+		}
+		upstreams := &UpstreamListValue{DefaultPort: defaultPort}
+		if err := upstreams.Set(address); err != nil {
+			return nil, err
+		}
+		w, err := strconv.Atoi(weight)
+		if err != nil {
+			return nil, err
+		}
+		weights[upstreams.Upstreams[0]] = w
+	}
+	return weights, nil
+}
+
+// RouteListValue is a flag.Value for an ordered list of routing rules.
+type RouteListValue struct {
+	Rules []routing.Rule
+}
+
+func (v *RouteListValue) String() string {
+	tokens := make([]string, len(v.Rules))
+	for i, r := range v.Rules {
+		tokens[i] = r.String()
+	}
+	return strings.Join(tokens, "; ")
+}
+
+func (v *RouteListValue) Set(s string) error {
+	rule, err := routing.ParseRule(s)
+	if err != nil {
+		return err
+	}
+	v.Rules = append(v.Rules, rule)
+	return nil
+}
+
+// validatePools checks the pools and the routes between them.
+func validatePools(pools []PoolConfig, routes []routing.Rule) error {
+	violations := &InvalidConfig{}
+	names := make(map[string]bool, len(pools))
+	for i := range pools {
+		field := indexedField("pool", pools[i].Name, i)
+		violations.add(field, pools[i].Validate())
+		if names[pools[i].Name] {
+			violations.addf(field, "pool %q is defined more than once", pools[i].Name)
+		}
+		names[pools[i].Name] = true
+	}
+	for i, r := range routes {
+		if !names[r.Pool] {
+			violations.addf(indexedField("route", "", i), "route %q refers to undefined pool %q", r.String(), r.Pool)
+		}
+	}
+	return violations.err()
+}
+
+// findPool returns the pool with the given name, or nil if there is none.
+func findPool(pools []PoolConfig, name string) *PoolConfig {
+	for i := range pools {
+		if pools[i].Name == name {
+			return &pools[i]
+		}
+	}
+	return nil
+}
+
+// allUpstreams returns the union of the upstreams of all pools.
+func allUpstreams(pools []PoolConfig) core.UpstreamSet {
+	result := core.EmptyUpstreamSet()
+	for _, p := range pools {
+		core.UnionUpdate(result, core.NewUpstreamSet(p.Upstreams...))
+	}
+	return result
+}
+
+// makeRouterFromConfig returns the routing table. Connections accepted by a
+// listener bound to a pool are routed to it. Connections that match none of
+// the configured routes are routed to the default pool, if any.
+func makeRouterFromConfig(cfg *Config) *routing.Table {
+	rules := append(listenerRoutes(cfg), cfg.Routes...)
+	for _, p := range cfg.Pools {
+		if p.Name == defaultPoolName {
+			rules = append(rules, routing.Rule{Pool: defaultPoolName})
+			break
+		}
+	}
+	return routing.NewTable(rules...)
+}
+
+func makePoolsFromConfig(cfg *Config, logger slog.Logger, tracker *healthcheck.Tracker, registry *core.UpstreamRegistry, metricsRegistry *metrics.Registry) (map[string]*forwarder.Pool, error) {
+	pools := make(map[string]*forwarder.Pool, len(cfg.Pools))
+	breaker := makeCircuitBreakerFromConfig(cfg, metricsRegistry)
+	latency := dialer.NewLatencyTracker(metricsRegistry)
+	dns := makeDNSCacheFromConfig(cfg, metricsRegistry)
+	for i := range cfg.Pools {
+		pc := &cfg.Pools[i]
+		reserver, err := makeClientReserverFromConfig(pc, metricsRegistry)
+		if err != nil {
+			return nil, err
+		}
+		var proxyHeader *forwarder.ProxyHeaderConfig
+		if pc.ProxyProtocol == proxyProtocolV2 {
+			tlvs, err := forwarder.ParseProxyHeaderTLVs(pc.ProxyProtocolTLVs)
+			if err != nil {
+				return nil, err
+			}
+			proxyHeader = &forwarder.ProxyHeaderConfig{TLVs: tlvs}
+		}
+		poolDialer, err := makeDialerFromConfig(pc, proxyHeader, logger, tracker, registry, breaker, latency, dns)
+		if err != nil {
+			return nil, err
+		}
+		pool := &forwarder.Pool{
+			Name:            pc.Name,
+			Upstreams:       core.NewUpstreamSet(pc.Upstreams...),
+			Dialer:          poolDialer,
+			Reserver:        reserver,
+			ProxyHeader:     proxyHeader,
+			HalfOpenTimeout: pc.HalfOpenTimeout,
+		}
+		pools[pc.Name] = pool
+	}
+	return pools, nil
+}
+
+// upstreamGroupSetter is an Authorizer whose upstream groups may be
+// replaced, e.g. an *authz.Authorizer.
+type upstreamGroupSetter interface {
+	SetUpstreamGroup(ug authz.UpstreamGroup, upstreams core.UpstreamSet)
+}
+
+// poolUpstreamReplacer replaces the upstreams of pools while the server is
+// running. Besides the pool, it updates everything else that knows the
+// upstreams of pools: the health tracker, which drains removed upstreams,
+// the pool's probes, and the upstream groups of the authorizer. The "all"
+// group and groups with selectors are recomputed from the upstreams of every
+// pool. Upstreams listed by name in upstream groups cannot be replaced, as
+// the groups would then grant clients upstreams that are no longer in use,
+// so replacing the upstreams of pools that have any is refused.
+type poolUpstreamReplacer struct {
+	logger     slog.Logger
+	pools      map[string]*forwarder.Pool
+	tracker    *healthcheck.Tracker
+	probePools map[string]*healthcheck.ProbePool
+	authorizer forwarder.Authorizer
+	groups     []UpstreamGroupConfig         // groups are the named upstream groups of the authorizer.
+	labels     map[core.Upstream]core.Labels // labels are the labels of upstreams, matched by the selectors of groups.
+
+	mu sync.Mutex // mu serializes replacements, so that each sees the pools as the last left them.
+}
+
+func (r *poolUpstreamReplacer) ReplaceUpstreams(name string, upstreams core.UpstreamSet) (added, removed core.UpstreamSet, err error) {
+	pool, ok := r.pools[name]
+	if !ok {
+		return nil, nil, fmt.Errorf("%w: %q", forwarder.NoSuchPool, name)
+	}
+	if len(upstreams) == 0 {
+		return nil, nil, fmt.Errorf("pool %q: at least one upstream is required", name)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	current := pool.CurrentUpstreams()
+	for _, g := range r.groups {
+		for _, u := range g.Upstreams {
+			if current.Contains(u) {
+				return nil, nil, fmt.Errorf("pool %q: upstream %s is listed by upstream group %q, so the upstreams of the pool cannot be replaced", name, u.Address, g.Name)
+			}
+		}
+	}
+	// Index added upstreams before they become candidates.
+	if indexer, ok := pool.Dialer.(dialer.UpstreamIndexer); ok {
+		indexer.IndexUpstreams(upstreams)
+	}
+	added, removed = pool.ReplaceUpstreams(upstreams)
+	all := core.EmptyUpstreamSet()
+	for _, p := range r.pools {
+		core.UnionUpdate(all, p.CurrentUpstreams())
+	}
+	// Track added upstreams before the authorizer grants them, so that they
+	// may be drained from the start.
+	r.tracker.Track(all)
+	if setter, ok := r.authorizer.(upstreamGroupSetter); ok {
+		setter.SetUpstreamGroup(authz.UpstreamGroup{Key: allUpstreamsGroupName}, all)
+		for _, g := range r.groups {
+			if len(g.Selector) > 0 {
+				setter.SetUpstreamGroup(authz.UpstreamGroup{Key: g.Name}, g.members(all, r.labels))
+			}
+		}
+	}
+	if probePool, ok := r.probePools[name]; ok {
+		probePool.Update(upstreams)
+	}
+	r.logger.Info(&slog.LogRecord{
+		Msg:     "replaced pool upstreams",
+		Details: fmt.Sprintf("pool %s: %d added, %d removed", name, len(added), len(removed)),
+	})
+	return added, removed, nil
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"tcplb/lib/forwarder"
+	"tcplb/lib/metrics"
+	"tcplb/lib/quota"
+	"tcplb/lib/slog"
+	"time"
+)
+
+const (
+	defaultQuotaPersistInterval = time.Minute
+	quotaRecordInterval         = 10 * time.Second // quotaRecordInterval is how often the usage of live connections is recorded.
+)
+
+// QuotaListValue is a flag.Value for the windows of client quotas.
+type QuotaListValue struct {
+	Windows []quota.Window
+}
+
+func (v *QuotaListValue) String() string {
+	tokens := make([]string, len(v.Windows))
+	for i, w := range v.Windows {
+		tokens[i] = formatQuotaWindow(w)
+	}
+	return strings.Join(tokens, "; ")
+}
+
+func (v *QuotaListValue) Set(s string) error {
+	w, err := parseQuotaWindow(s)
+	if err != nil {
+		return err
+	}
+	v.Windows = append(v.Windows, w)
+	return nil
+}
+
+// parseQuotaWindow parses a quota window from space-separated key=value
+// fields, e.g. "window=24h soft-bytes=1000000000 hard-bytes=2000000000".
+func parseQuotaWindow(spec string) (quota.Window, error) {
+	var w quota.Window
+	for _, field := range strings.Fields(spec) {
+		key, value, ok := strings.Cut(field, "=")
+		if !ok || value == "" {
+			return quota.Window{}, fmt.Errorf("quota %q: expected key=value but got %q", spec, field)
+		}
+		var err error
+		switch key {
+		case "window":
+			w.Duration, err = time.ParseDuration(value)
+		case "soft-bytes":
+			w.SoftBytes, err = strconv.ParseInt(value, 10, 64)
+		case "hard-bytes":
+			w.HardBytes, err = strconv.ParseInt(value, 10, 64)
+		case "soft-conn-seconds":
+			w.SoftConnectionSeconds, err = strconv.ParseInt(value, 10, 64)
+		case "hard-conn-seconds":
+			w.HardConnectionSeconds, err = strconv.ParseInt(value, 10, 64)
+		default:
+			return quota.Window{}, fmt.Errorf("quota %q: unknown key %q", spec, key)
+		}
+		if err != nil {
+			return quota.Window{}, fmt.Errorf("quota %q: %s: %w", spec, key, err)
+		}
+	}
+	if w.Duration <= 0 {
+		return quota.Window{}, fmt.Errorf("quota %q: window must be positive", spec)
+	}
+	if w.SoftBytes <= 0 && w.HardBytes <= 0 && w.SoftConnectionSeconds <= 0 && w.HardConnectionSeconds <= 0 {
+		return quota.Window{}, fmt.Errorf("quota %q: no limits given", spec)
+	}
+	return w, nil
+}
+
+func formatQuotaWindow(w quota.Window) string {
+	fields := []string{"window=" + w.Duration.String()}
+	add := func(key string, limit int64) {
+		if limit > 0 {
+			fields = append(fields, fmt.Sprintf("%s=%d", key, limit))
+		}
+	}
+	add("soft-bytes", w.SoftBytes)
+	add("hard-bytes", w.HardBytes)
+	add("soft-conn-seconds", w.SoftConnectionSeconds)
+	add("hard-conn-seconds", w.HardConnectionSeconds)
+	return strings.Join(fields, " ")
+}
+
+// makeQuotaLedgerFromConfig returns the Ledger of client usage, with any
+// usage saved by a previous process loaded, or nil if no quotas are
+// configured.
+func makeQuotaLedgerFromConfig(cfg *Config, logger slog.Logger, registry *metrics.Registry) (*quota.Ledger, error) {
+	if len(cfg.Quotas) == 0 {
+		return nil, nil
+	}
+	ledger := quota.NewLedger(cfg.Quotas, quota.NewMetrics(registry))
+	ledger.Logger = logger
+	if cfg.QuotaStateFile != "" {
+		ledger.Store = &quota.FileStore{Path: cfg.QuotaStateFile}
+	}
+	if err := ledger.Load(); err != nil {
+		return nil, fmt.Errorf("failed to load quota usage: %w", err)
+	}
+	return ledger, nil
+}
+
+// startQuotasFromConfig sets the quotas dependency of deps to the Ledger of
+// client usage, if quotas are configured, warning clients nearing their
+// quotas with warnings, if not nil, and starts persisting the usage, if
+// it is to be saved. The returned stop function stops persisting it.
+func startQuotasFromConfig(cfg *Config, logger slog.Logger, registry *metrics.Registry, warnings *forwarder.BudgetWarnings, deps *handlerDeps) (stop func(), err error) {
+	ledger, err := makeQuotaLedgerFromConfig(cfg, logger, registry)
+	if err != nil {
+		return nil, err
+	}
+	if ledger == nil {
+		return func() {}, nil
+	}
+	deps.quotas = ledger
+	if warnings != nil {
+		ledger.WarnFraction = cfg.BudgetWarningFraction
+		ledger.Warner = warnings
+	}
+	if ledger.Store == nil {
+		return func() {}, nil
+	}
+	return ledger.StartPersister(cfg.QuotaPersistInterval), nil
+}
@@ -2,14 +2,37 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
+	"expvar"
 	"fmt"
+	"io"
 	"net"
-	"tcplb/lib/authz"
+	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"sync/atomic"
+	"syscall"
+	"tcplb/lib/accesslog"
+	"tcplb/lib/admin"
+	"tcplb/lib/banlist"
+	"tcplb/lib/conntable"
 	"tcplb/lib/core"
+	"tcplb/lib/dialer"
+	"tcplb/lib/events"
 	"tcplb/lib/forwarder"
+	"tcplb/lib/geoip"
+	"tcplb/lib/handoff"
+	"tcplb/lib/healthcheck"
+	"tcplb/lib/ipfilter"
 	"tcplb/lib/limiter"
+	"tcplb/lib/metrics"
+	"tcplb/lib/quota"
+	"tcplb/lib/routing"
 	"tcplb/lib/slog"
+	"tcplb/lib/trace"
+	"tcplb/lib/udp"
 	"time"
 )
 
@@ -19,169 +42,1839 @@ const (
 	defaultListenNetwork               = "tcp"
 	defaultListenAddress               = "0.0.0.0:4321"
 	defaultMaxConnectionsPerClient     = 10
+	defaultBudgetWarningFraction       = 0.8
+	defaultTraceSampleRatio            = 1.0
+	defaultLogLevel                    = string(slog.InfoLevel)
+	defaultLogFormat                   = string(slog.JSONFormat)
+	defaultLogOutput                   = slog.StderrOutput
+	defaultLogSampleBurst              = 20
+	defaultLogSampleInterval           = time.Second
+	traceServiceName                   = "tcplb"
+	metricsExpvarName                  = "tcplb"
+	defaultHealthCheckInterval         = 5 * time.Second
+	defaultHealthCheckTimeout          = time.Second
+	defaultReadyMinHealthyUpstreams    = 1
+	defaultHealthStateMaxAge           = 5 * time.Minute
+	defaultShutdownGracePeriod         = 30 * time.Second
+	defaultEvictGracePeriod            = 5 * time.Second
+	shutdownIdleCheckInterval          = time.Second
+	defaultUpgradeTimeout              = 30 * time.Second
+	clientRejectionWindow              = 15 * time.Minute
+	maxClientRejectionClients          = 10000
+	budgetWarningInterval              = 5 * time.Minute
+	maxBudgetWarningClients            = 10000
+	defaultDialTimeout                 = 5 * time.Second
+	defaultRetryTimeout                = 10 * time.Second
+	defaultRetryBackoff                = 100 * time.Millisecond
+	defaultIdleTimeout                 = 0 // defaultIdleTimeout disables idle timeouts, so long-lived quiet connections are not cut by default.
+	defaultSlowConsumerPolicy          = string(forwarder.SlowConsumerThrottle)
+	defaultSlowConsumerBufferSize      = 1024 * 1024
+	defaultRejectionSignal             = rejectionSignalNone
+	defaultRejectionSignalTimeout      = time.Second
+	defaultAcceptQueueLength           = 128
+	defaultAcceptQueueOverflow         = string(forwarder.OverflowQueue)
+	defaultHandshakeQueueTimeout       = time.Second
+	defaultHandshakeTimeout            = 10 * time.Second
+	defaultSniffTimeout                = 2 * time.Second
+	defaultMaxClientHelloSize          = 16 * 1024
+	defaultTLSFingerprintMethod        = forwarder.FingerprintJA3
+	defaultPreAuthTimeout              = 30 * time.Second
+	defaultUDPIdleTimeout              = 30 * time.Second
+	defaultUDPMaxSessions              = 10000
+	defaultBanWindow                   = time.Minute
+	defaultCircuitBreakerMinDials      = 10
+	defaultCircuitBreakerWindow        = 30 * time.Second
+	defaultCircuitBreakerOpenDuration  = 10 * time.Second
+	defaultCircuitBreakerProbes        = 1
+	defaultBanDuration                 = 10 * time.Minute
+	defaultBanTarpitMaxConns           = 1024
+	defaultMirrorMaxBuffered           = 1 << 20
+	mirrorTimeout                      = 10 * time.Second
+	defaultDeniedConnHold              = time.Second
+	minReservationLeaseTTL             = time.Second // minReservationLeaseTTL bounds how often lapsed leases are swept.
+	upstreamTLSReloadInterval          = 10 * time.Second
+	cpuSampleInterval                  = time.Second
+	mainListenerName                   = "main"
+	adminListenerName                  = "admin"
+	controlListenerName                = "control"
+	eventListenerName                  = "events"
+	udpListenerName                    = "udp"
+	eventWriteTimeout                  = 10 * time.Second
 )
 
+// Ways of signalling rejected connections to clients.
+const (
+	rejectionSignalNone    = "none"    // rejectionSignalNone closes rejected connections without explanation.
+	rejectionSignalMessage = "message" // rejectionSignalMessage writes a one-line reason before closing.
+)
+
+// errForcedShutdown is returned by serve if connections had to be closed
+// because they did not finish within the shutdown grace period.
+var errForcedShutdown = errors.New("forced shutdown: connections did not drain within grace period")
+
 // TODO FIXME insecure
 var anonymousTestClientID = core.ClientID{Namespace: "test", Key: "anonymous"}
 
 type Config struct {
-	ListenNetwork           string
-	ListenAddress           string
-	Upstreams               []core.Upstream
-	MaxConnectionsPerClient int64
+	ListenNetwork             string
+	ListenAddress             string
+	ListenAuthn               string                        // ListenAuthn is the client authentication mode of the main listener, one of authnModes.
+	ListenTLS                 ListenerTLSConfig             // ListenTLS configures TLS for the main listener.
+	Listeners                 []ListenerConfig              // Listeners are the listeners in addition to the main listener.
+	UDPListenAddress          string                        // UDPListenAddress is the address to receive UDP datagrams on. If empty, UDP is not forwarded.
+	UDPPool                   string                        // UDPPool is the pool whose upstreams UDP datagrams are forwarded to.
+	UDPIdleTimeout            time.Duration                 // UDPIdleTimeout is how long a UDP session lasts without datagrams from its client.
+	UDPMaxSessions            int                           // UDPMaxSessions bounds the open UDP sessions. If not positive, no bound.
+	Upstreams                 []core.Upstream               // Upstreams are the upstreams of the default pool.
+	UpstreamDefaultPort       string                        // UpstreamDefaultPort is the port of upstreams given without one. If empty, upstreams must be given with a port.
+	MaxConnectionsPerClient   int64                         // MaxConnectionsPerClient is the default per-pool client connection limit.
+	ReservationLeaseTTL       time.Duration                 // ReservationLeaseTTL is how long client reservations last unless renewed. If not positive, they last until released.
+	MaxConcurrentClients      int64                         // MaxConcurrentClients is the default per-pool limit on distinct connected clients.
+	Quotas                    []quota.Window                // Quotas limit the usage of each client within rolling time windows. If empty, usage is not limited.
+	QuotaStateFile            string                        // QuotaStateFile is where client quota usage is saved. If empty, it is not saved.
+	QuotaPersistInterval      time.Duration                 // QuotaPersistInterval is how often client quota usage is saved.
+	BudgetWarningFraction     float64                       // BudgetWarningFraction is the fraction of a connection limit or hard quota at which clients are warned. If not positive, no warnings.
+	LimitExemptClients        []core.ClientID               // LimitExemptClients are exempt from connection limits and quotas.
+	LimitExemptGroups         []string                      // LimitExemptGroups are client groups whose members are exempt from connection limits and quotas.
+	MaxConnections            int                           // MaxConnections bounds the client connections forwarded at once. Beyond it, connections of lower priority classes are shed. If not positive, no bound.
+	PriorityClasses           []string                      // PriorityClasses are the client groups that are priority classes, from highest priority to lowest.
+	CPUOverloadThreshold      float64                       // CPUOverloadThreshold is the fraction of all CPUs whose use signals overload. If not positive, CPU use is not monitored.
+	GCPercent                 int                           // GCPercent is the garbage collection target percentage, in place of GOGC. If zero, GOGC applies. If negative, garbage collection is disabled.
+	MemoryLimit               int64                         // MemoryLimit is the soft limit on the memory of the runtime, in bytes, in place of GOMEMLIMIT. If not positive, GOMEMLIMIT applies.
+	MemoryShedThreshold       int64                         // MemoryShedThreshold is the heap size, in bytes, above which new connections are dropped. If not positive, the heap is not monitored.
+	DialPolicy                string                        // DialPolicy is the default per-pool policy for choosing an upstream.
+	DialTimeout               time.Duration                 // DialTimeout is the default bound on each upstream dial.
+	RetryTimeout              time.Duration                 // RetryTimeout is the default bound on dialing, including retries.
+	RetryBackoff              time.Duration                 // RetryBackoff is the default pause before retrying upstreams that all failed.
+	MaxDialAttempts           int                           // MaxDialAttempts is the default bound on upstreams dialed, including retries. If not positive, no bound.
+	DialFailFast              bool                          // DialFailFast resets client connections as soon as no upstream can be dialed.
+	EgressProxy               string                        // EgressProxy is the URL of the default per-pool proxy that upstreams are dialed through. If empty, upstreams are dialed directly.
+	ProxyProtocol             string                        // ProxyProtocol is the default per-pool version of the PROXY protocol header sent to upstreams.
+	ProxyProtocolTLVs         string                        // ProxyProtocolTLVs lists the default per-pool TLVs of PROXY protocol v2 headers.
+	UpstreamTLS               PoolTLSConfig                 // UpstreamTLS is the default per-pool configuration of TLS to upstreams.
+	EarlyDial                 bool                          // EarlyDial starts dialing upstreams before clients are authenticated, where the route allows.
+	RedialWindow              time.Duration                 // RedialWindow is how long to watch new upstream connections for failure, redialing if they fail. If not positive, disabled.
+	DNSCacheTTL               time.Duration                 // DNSCacheTTL is how long the addresses of upstream host names are cached. If not positive, they are not cached.
+	DNSNegativeTTL            time.Duration                 // DNSNegativeTTL is how long failures to resolve upstream host names are cached. If not positive, they are not cached.
+	DNSTimeout                time.Duration                 // DNSTimeout bounds each lookup of an upstream host name. If not positive, lookups are bounded only by the resolver.
+	IdleTimeout               time.Duration                 // IdleTimeout bounds the time a forwarded connection may go without data in either direction. If not positive, no bound.
+	ConnIdleAfter             time.Duration                 // ConnIdleAfter is how long a connection must go without data in either direction to be classified as idle, and closed first on shutdown. If not positive, none are idle.
+	MaxConnectionDuration     time.Duration                 // MaxConnectionDuration bounds the time each connection is forwarded for. If not positive, no bound.
+	HalfOpenTimeout           time.Duration                 // HalfOpenTimeout is the default per-pool bound on the time a connection is forwarded in one direction after the other has finished. If not positive, no bound.
+	SlowConsumerTimeout       time.Duration                 // SlowConsumerTimeout is how long a write to a peer may block before the peer is a slow consumer. If not positive, slow consumers are not detected.
+	SlowConsumerPolicy        string                        // SlowConsumerPolicy is what is done about slow consumers.
+	SlowConsumerBufferSize    int                           // SlowConsumerBufferSize bounds the bytes buffered for a slow consumer under the buffer policy.
+	UpstreamBandwidth         int64                         // UpstreamBandwidth is the ceiling on the bytes per second sent to upstreams, shared fairly between clients. If not positive, no ceiling.
+	BandwidthQuantum          int                           // BandwidthQuantum is the bytes each client may send per round while clients wait for bandwidth.
+	CircuitBreakerRatio       float64                       // CircuitBreakerRatio is the fraction of failed dials of an upstream that opens its circuit. If not positive, circuit breaking is disabled.
+	CircuitBreakerMinDials    int                           // CircuitBreakerMinDials is the number of dials of an upstream within the window needed before its circuit may open.
+	CircuitBreakerWindow      time.Duration                 // CircuitBreakerWindow is the period over which dial failures are counted.
+	CircuitBreakerOpen        time.Duration                 // CircuitBreakerOpen is how long an open circuit stops dials before probing the upstream.
+	CircuitBreakerProbes      int                           // CircuitBreakerProbes is the number of successful probe dials that close a circuit.
+	Pools                     []PoolConfig                  // Pools are the named upstream pools, including the default pool if it has upstreams.
+	UpstreamLabels            map[core.Upstream]core.Labels // UpstreamLabels are the labels of upstreams, if any.
+	Routes                    []routing.Rule                // Routes select the pool for each connection. The default pool is the final fallback.
+	UpstreamGroups            []UpstreamGroupConfig         // UpstreamGroups are named groups of upstreams that clients may be granted, besides the reserved group of all upstreams.
+	UpstreamGroupCountries    map[string][]string           // UpstreamGroupCountries restricts upstream groups, by name, to clients located in the given countries.
+	UpstreamGroupFingerprints map[string][]string           // UpstreamGroupFingerprints restricts upstream groups, by name, to clients whose TLS fingerprint is one of those given.
+	AuthorizedClients         []ClientGrant                 // AuthorizedClients are the clients authorized to access upstreams, and the upstream groups each is granted.
+	NamespacedClients         bool                          // NamespacedClients parses AuthorizedClients and LimitExemptClients given as namespace:key or as URIs.
+	AuthzCacheSize            int                           // AuthzCacheSize bounds the clients whose authorized upstreams are cached. If not positive, they are not cached.
+	AuthzCacheTTL             time.Duration                 // AuthzCacheTTL is how long the authorized upstreams of a client are cached. If not positive, until the policy changes.
+	OTLPEndpoint              string                        // OTLPEndpoint is the OTLP/HTTP traces URL. If empty, tracing is disabled.
+	TraceSampleRatio          float64                       // TraceSampleRatio is the fraction of connections to trace.
+	AccessLogSink             string                        // AccessLogSink is where access logs are written. If empty, access logging is disabled.
+	LogLevel                  string                        // LogLevel is the minimum level of operational log records to write.
+	LogFormat                 string                        // LogFormat is the encoding of operational log records.
+	LogOutput                 string                        // LogOutput is where operational log records are written.
+	LogSampleBurst            int                           // LogSampleBurst is the max records per message class per interval. If not positive, no sampling.
+	LogSampleInterval         time.Duration
+	AdminListenAddress        string        // AdminListenAddress is the address for admin and debug endpoints. If empty, they are disabled.
+	AdminSocket               string        // AdminSocket is the path of the unix socket for control endpoints. If empty, they are disabled.
+	EventSocket               string        // EventSocket is the path of the unix socket publishing connection lifecycle events. If empty, no events are published.
+	EventBuffer               int           // EventBuffer is the number of events buffered for each subscriber to the event socket.
+	HealthCheckInterval       time.Duration // HealthCheckInterval is the default time between upstream probes. If not positive, no probes.
+	HealthCheckTimeout        time.Duration // HealthCheckTimeout is the default bound on each upstream probe.
+	HealthStateFile           string        // HealthStateFile is where upstream health beliefs are saved. If empty, they are not saved.
+	HealthStateMaxAge         time.Duration // HealthStateMaxAge is the age beyond which saved health beliefs are not loaded. If not positive, no bound.
+	ReadyMinHealthyUpstreams  int           // ReadyMinHealthyUpstreams is the number of healthy upstreams needed to report ready.
+	WarmupMinReachable        int           // WarmupMinReachable is the number of upstreams that must be reachable at startup to report ready. If not positive, upstreams are not probed at startup.
+	WarmupExit                bool          // WarmupExit exits at startup, instead of reporting unready, if too few upstreams are reachable.
+	ShutdownGracePeriod       time.Duration // ShutdownGracePeriod is how long to wait for connections to drain on shutdown.
+	DrainIdleGrace            time.Duration // DrainIdleGrace is how long idle connections have to close, once told to reconnect on shutdown, before they are closed. If not positive, idle connections are closed at once.
+	PreDrainDelay             time.Duration // PreDrainDelay is how long to report not ready on shutdown, while still accepting connections, before draining. If not positive, draining starts at once.
+	EvictGracePeriod          time.Duration // EvictGracePeriod is how long the connections of an evicted client may finish sending before they are closed, unless the eviction gives its own.
+	UpgradeTimeout            time.Duration // UpgradeTimeout is how long to wait for a new process to become ready during an upgrade.
+	RejectionSignal           string        // RejectionSignal is how clients are told why their connection was rejected.
+	ListenBacklog             int           // ListenBacklog is the length of the kernel's queue of connections for each listener to accept. If not positive, the OS default.
+	MaxHandlers               int           // MaxHandlers bounds the client connections each listener handles at once. If not positive, no bound.
+	AcceptQueueLength         int           // AcceptQueueLength is the number of accepted client connections that may wait for a handler, once MaxHandlers are busy.
+	AcceptQueueOverflow       string        // AcceptQueueOverflow decides what happens to client connections accepted while the accept queue is full.
+	MaxConcurrentHandshakes   int           // MaxConcurrentHandshakes bounds the client TLS handshakes in progress. If not positive, no bound.
+	HandshakeQueueTimeout     time.Duration // HandshakeQueueTimeout is how long a client TLS handshake may wait to start.
+	HandshakeTimeout          time.Duration // HandshakeTimeout bounds each client TLS handshake.
+	SniffTimeout              time.Duration // SniffTimeout bounds the wait for the first bytes of each client TLS connection, which must begin a ClientHello.
+	MaxClientHelloSize        int           // MaxClientHelloSize bounds the size of the ClientHello of each client TLS connection. If not positive, no bound.
+	TLSFingerprint            bool          // TLSFingerprint computes the fingerprint of the ClientHello of each client TLS connection.
+	TLSFingerprintMethod      string        // TLSFingerprintMethod is the fingerprint computed, one of forwarder.FingerprintMethods.
+	TLSFingerprintDeny        []string      // TLSFingerprintDeny are the fingerprints of clients that are not served.
+	HandshakeRate             float64       // HandshakeRate bounds the full client TLS handshakes per second. If not positive, no bound.
+	HandshakeBurst            int           // HandshakeBurst is the most full client TLS handshakes allowed at once within HandshakeRate.
+	ResumedHandshakeRate      float64       // ResumedHandshakeRate bounds the resumed client TLS sessions per second. If not positive, no bound.
+	ResumedHandshakeBurst     int           // ResumedHandshakeBurst is the most resumed client TLS sessions allowed at once within ResumedHandshakeRate.
+	HandshakeStartRate        float64       // HandshakeStartRate bounds the client TLS handshakes started per second, by all clients. If not positive, no bound.
+	HandshakeStartBurst       int           // HandshakeStartBurst is the most client TLS handshakes allowed to start at once within HandshakeStartRate.
+	HandlerStages             []string      // HandlerStages are the optional connection handler stages to enable, from outermost to innermost.
+	PreAuthTimeout            time.Duration // PreAuthTimeout bounds the total time from accepting a client connection until it is forwarded. If not positive, no bound.
+	IPAllowList               string        // IPAllowList is a comma-separated list of CIDR prefixes. If not empty, only clients within them are served.
+	IPDenyList                string        // IPDenyList is a comma-separated list of CIDR prefixes. Clients within them are not served.
+	IPFilterFile              string        // IPFilterFile optionally holds further allow and deny rules. It is reloaded on SIGHUP.
+	MirrorAddress             string        // MirrorAddress is the upstream that is sent a copy of the data of each client. If empty, connections are not mirrored.
+	MirrorMaxBuffered         int           // MirrorMaxBuffered bounds the bytes of each connection waiting to be written to the mirror.
+	GeoIPDatabases            []string      // GeoIPDatabases are paths of MaxMind DB files to locate clients with. If empty, clients are not located.
+	GeoIPPolicy               geoip.Policy  // GeoIPPolicy decides which client locations are served.
+	BanThreshold              int           // BanThreshold is the number of failures from a source IP after which it is banned. If not positive, sources are not banned.
+	BanWindow                 time.Duration // BanWindow is the period over which failures are counted.
+	BanDuration               time.Duration // BanDuration is how long a source stays banned.
+	BanTarpit                 time.Duration // BanTarpit is how long connections from banned sources are held before being dropped. If not positive, they are dropped at once.
+	BanTarpitMaxConns         int           // BanTarpitMaxConns bounds the connections held by BanTarpit at once. Connections beyond it are dropped at once.
+	MaxDeniedConnsPerClient   int           // MaxDeniedConnsPerClient bounds the connections each client not authorized for any upstream may hold open. If not positive, no bound.
+	DeniedConnHold            time.Duration // DeniedConnHold is how long connections of clients not authorized for any upstream are held open, within MaxDeniedConnsPerClient.
+
+	// AdminTLS configures TLS and client authentication for the admin
+	// endpoints. Unless clients are authenticated, AdminListenAddress must
+	// be a loopback address.
+	AdminTLS admin.TLSConfig
 }
 
+// Validate checks the Config. If it is invalid, an *InvalidConfig is
+// returned, listing every violation.
 func (c *Config) Validate() error {
-	if len(c.Upstreams) == 0 {
-		return errors.New("server must be configured with 1 or more upstreams")
+	violations := &InvalidConfig{}
+	if len(c.Pools) == 0 {
+		violations.addf("upstreams", "server must be configured with 1 or more upstreams or pools")
+	}
+	violations.add("", validatePools(c.Pools, c.Routes))
+	violations.add("", validateListeners(c))
+	violations.add("", validateHandlerStages(c.HandlerStages))
+	violations.add("", validateAuthz(c))
+	if c.ReservationLeaseTTL > 0 && c.ReservationLeaseTTL < minReservationLeaseTTL {
+		violations.addf("reservation-lease-ttl", "reservation lease TTL must be at least %s, or not positive to disable leases", minReservationLeaseTTL)
+	}
+	if c.UDPListenAddress != "" {
+		violations.add("udp-listen-address", checkListenAddress(c.UDPListenAddress))
+		if findPool(c.Pools, c.UDPPool) == nil {
+			violations.addf("udp-pool", "UDP pool %q is not defined", c.UDPPool)
+		}
+		if c.UDPIdleTimeout <= 0 {
+			violations.addf("udp-idle-timeout", "UDP idle timeout must be positive")
+		}
+	}
+	upstreams := allUpstreams(c.Pools)
+	labelled := core.EmptyUpstreamSet()
+	for u := range c.UpstreamLabels {
+		labelled[u] = struct{}{}
+	}
+	for _, u := range labelled.Sorted() {
+		if _, ok := upstreams[u]; !ok {
+			violations.addf("upstream-labels", "labels given for %s, which is not an upstream of any pool", u.Address)
+		}
+	}
+	if c.TraceSampleRatio < 0.0 || c.TraceSampleRatio > 1.0 {
+		violations.addf("trace-sample-ratio", "trace sample ratio must be between 0 and 1")
+	}
+	if c.CPUOverloadThreshold > 1.0 {
+		violations.addf("cpu-overload-threshold", "cpu overload threshold must be at most 1")
+	}
+	if c.MemoryLimit > 0 && !memoryLimitSupported {
+		violations.addf("memory-limit", "memory limits are not supported by this build, which needs Go 1.19 or later")
+	}
+	if c.GCPercent < 0 && c.MemoryLimit <= 0 {
+		violations.addf("gc-percent", "garbage collection may only be disabled with a memory limit, without which the heap grows without bound")
+	}
+	if c.MemoryShedThreshold > 0 && c.MemoryLimit > 0 && c.MemoryShedThreshold >= c.MemoryLimit {
+		violations.addf("memory-shed-threshold", "memory shed threshold must be below the memory limit, so that connections are dropped before the limit is reached")
+	}
+	if _, err := slog.ParseLevel(c.LogLevel); err != nil {
+		violations.add("log-level", err)
+	}
+	if _, err := slog.ParseFormat(c.LogFormat); err != nil {
+		violations.add("log-format", err)
+	}
+	if c.LogSampleBurst > 0 && c.LogSampleInterval <= 0 {
+		violations.addf("log-sample-interval", "log sample interval must be positive when log sampling is enabled")
+	}
+	if c.HealthCheckInterval > 0 && c.HealthCheckTimeout <= 0 {
+		violations.addf("healthcheck-timeout", "health check timeout must be positive when health checks are enabled")
+	}
+	if n := len(upstreams); c.WarmupMinReachable > n {
+		violations.addf("warmup-min-reachable-upstreams", "warm-up needs %d reachable upstreams, but there are only %d upstreams", c.WarmupMinReachable, n)
+	}
+	if c.EventSocket != "" && c.EventSocket == c.AdminSocket {
+		violations.addf("event-socket", "event socket must differ from the admin socket")
+	}
+	if c.UpgradeTimeout <= 0 {
+		violations.addf("upgrade-timeout", "upgrade timeout must be positive")
+	}
+	if _, err := makeRejectionSignallerFromConfig(c); err != nil {
+		violations.add("rejection-signal", err)
+	}
+	violations.add("", validateSlowConsumer(c))
+	if c.UpstreamBandwidth > 0 && c.BandwidthQuantum <= 0 {
+		violations.addf("bandwidth-quantum", "bandwidth quantum must be positive when upstream bandwidth is limited")
+	}
+	violations.add("", validateAcceptQueue(c))
+	violations.add("", validateTLSFingerprint(c))
+	if _, err := ipfilter.ParsePrefixList(c.IPAllowList); err != nil {
+		violations.add("ip-allow", fmt.Errorf("invalid IP allowlist: %w", err))
+	}
+	if _, err := ipfilter.ParsePrefixList(c.IPDenyList); err != nil {
+		violations.add("ip-deny", fmt.Errorf("invalid IP denylist: %w", err))
+	}
+	if (c.IPAllowList != "" || c.IPDenyList != "" || c.IPFilterFile != "") && !stageEnabled(c, forwarder.StageIPFilter) {
+		violations.addf("handler-stages", "handler stage %q must be enabled to filter clients by IP address", forwarder.StageIPFilter)
+	}
+	if c.MirrorAddress != "" {
+		if _, err := parseUpstreamAddress(c.MirrorAddress, ""); err != nil {
+			violations.add("mirror-address", fmt.Errorf("invalid mirror address: %w", err))
+		}
+		if c.MirrorMaxBuffered <= 0 {
+			violations.addf("mirror-max-buffered", "mirror max buffered must be positive when connections are mirrored")
+		}
+	}
+	if c.CircuitBreakerRatio > 1.0 {
+		violations.addf("circuit-breaker-failure-ratio", "circuit breaker failure ratio must not exceed 1")
+	}
+	if c.CircuitBreakerRatio > 0 && (c.CircuitBreakerWindow <= 0 || c.CircuitBreakerOpen <= 0) {
+		violations.addf("circuit-breaker-window", "circuit breaker window and open duration must be positive when circuit breaking is enabled")
+	}
+	if c.BudgetWarningFraction > 1.0 {
+		violations.addf("budget-warning-fraction", "budget warning fraction must not exceed 1")
+	}
+	if c.QuotaStateFile != "" && c.QuotaPersistInterval <= 0 {
+		violations.addf("quota-persist-interval", "quota persist interval must be positive when a quota state file is given")
+	}
+	if c.BanThreshold > 0 && (c.BanWindow <= 0 || c.BanDuration <= 0) {
+		violations.addf("ban-window", "ban window and duration must be positive when banning is enabled")
+	}
+	if c.BanTarpit > 0 && c.BanTarpitMaxConns <= 0 {
+		violations.addf("ban-tarpit-max-conns", "ban tarpit max conns must be positive when a ban tarpit is given")
+	}
+	geoRules := len(c.GeoIPPolicy.AllowCountries) + len(c.GeoIPPolicy.DenyCountries) + len(c.GeoIPPolicy.DenyASNs)
+	if len(c.GeoIPDatabases) == 0 && (geoRules > 0 || len(c.UpstreamGroupCountries) > 0) {
+		violations.addf("geoip-db", "geoip country and ASN rules require a geoip database")
+	}
+	if c.ShutdownGracePeriod < 0 {
+		violations.addf("shutdown-grace-period", "shutdown grace period must not be negative")
+	}
+	if c.DrainIdleGrace > 0 && c.ConnIdleAfter <= 0 {
+		violations.addf("drain-idle-grace", "drain idle grace requires -conn-idle-after, which classifies connections as idle")
+	}
+	if c.PreDrainDelay < 0 {
+		violations.addf("pre-drain-delay", "pre-drain delay must not be negative")
+	}
+	if c.EvictGracePeriod < 0 {
+		violations.addf("evict-grace-period", "evict grace period must not be negative")
+	}
+	violations.add("admin-tls-cert", c.AdminTLS.Validate())
+	if c.AdminListenAddress != "" {
+		if err := checkListenAddress(c.AdminListenAddress); err != nil {
+			violations.add("admin-listen-address", err)
+		} else {
+			violations.add("admin-listen-address", admin.CheckListenAddress(c.AdminListenAddress, c.AdminTLS))
+			violations.add("admin-listen-address", checkAdminAddressIsolated(c))
+		}
+	}
+	return violations.err()
+}
+
+// makeGeoIPLocatorFromConfig opens the configured GeoIP databases. If there
+// are none, nil is returned.
+// validateTLSFingerprint checks the fingerprint method, and that the
+// fingerprints given are of that method.
+func validateTLSFingerprint(c *Config) error {
+	violations := &InvalidConfig{}
+	known := false
+	for _, method := range forwarder.FingerprintMethods {
+		known = known || c.TLSFingerprintMethod == method
+	}
+	if !known {
+		violations.addf("tls-fingerprint-method", "unknown TLS fingerprint method %q (expected one of %v)", c.TLSFingerprintMethod, forwarder.FingerprintMethods)
+		return violations.err()
+	}
+	for _, fingerprint := range c.TLSFingerprintDeny {
+		if _, err := forwarder.ParseFingerprint(c.TLSFingerprintMethod, fingerprint); err != nil {
+			violations.add("tls-fingerprint-deny", err)
+		}
+	}
+	groups := make([]string, 0, len(c.UpstreamGroupFingerprints))
+	for name := range c.UpstreamGroupFingerprints {
+		groups = append(groups, name)
 	}
-	return nil
+	sort.Strings(groups)
+	for _, name := range groups {
+		for _, fingerprint := range c.UpstreamGroupFingerprints[name] {
+			if _, err := forwarder.ParseFingerprint(c.TLSFingerprintMethod, fingerprint); err != nil {
+				violations.add("upstream-group-fingerprints", err)
+			}
+		}
+	}
+	return violations.err()
+}
+
+func makeGeoIPLocatorFromConfig(cfg *Config) (geoip.Locator, error) {
+	if len(cfg.GeoIPDatabases) == 0 {
+		return nil, nil
+	}
+	readers := make(geoip.Readers, 0, len(cfg.GeoIPDatabases))
+	for _, path := range cfg.GeoIPDatabases {
+		r, err := geoip.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		readers = append(readers, r)
+	}
+	return readers, nil
+}
+
+// loadIPFilterRulesFromConfig returns the allow and deny rules given by
+// flags, together with those in the IP filter file, if any.
+func loadIPFilterRulesFromConfig(cfg *Config) (ipfilter.Rules, error) {
+	var rules ipfilter.Rules
+	var err error
+	if rules.Allow, err = ipfilter.ParsePrefixList(cfg.IPAllowList); err != nil {
+		return ipfilter.Rules{}, err
+	}
+	if rules.Deny, err = ipfilter.ParsePrefixList(cfg.IPDenyList); err != nil {
+		return ipfilter.Rules{}, err
+	}
+	if cfg.IPFilterFile == "" {
+		return rules, nil
+	}
+	fileRules, err := ipfilter.LoadRules(cfg.IPFilterFile)
+	if err != nil {
+		return ipfilter.Rules{}, err
+	}
+	return rules.Merge(fileRules), nil
+}
+
+// reloadIPFilterOnSignal reloads the rules of filter each time a signal is
+// received from hangups, until stop is closed, updating version to match.
+// If the rules cannot be loaded, the previous rules stay in effect.
+func reloadIPFilterOnSignal(logger slog.Logger, cfg *Config, version *configVersion, filter *ipfilter.Filter, hangups <-chan os.Signal, stop <-chan struct{}) {
+	for {
+		select {
+		case <-stop:
+			return
+		case sig := <-hangups:
+			rules, err := loadIPFilterRulesFromConfig(cfg)
+			if err != nil {
+				logger.Error(&slog.LogRecord{Msg: "failed to reload IP filter rules, keeping previous rules", Details: sig.String(), Error: err})
+				continue
+			}
+			filter.SetRules(rules)
+			logger.Info(&slog.LogRecord{Msg: "reloaded IP filter rules", Details: sig.String()})
+			version.update(rules)
+		}
+	}
+}
+
+func makeLoggerFromConfig(cfg *Config) (*slog.StreamLogger, io.Closer, error) {
+	level, err := slog.ParseLevel(cfg.LogLevel)
+	if err != nil {
+		return nil, nil, err
+	}
+	switch cfg.LogOutput {
+	case slog.SyslogOutput:
+		return slog.NewSyslogLogger(level)
+	case slog.JournaldOutput:
+		return slog.NewJournaldLogger(level)
+	}
+	format, err := slog.ParseFormat(cfg.LogFormat)
+	if err != nil {
+		return nil, nil, err
+	}
+	w, err := slog.OpenOutput(cfg.LogOutput)
+	if err != nil {
+		return nil, nil, err
+	}
+	logger := slog.NewLogger(slog.Options{
+		Level:  level,
+		Format: format,
+		Output: w,
+	})
+	return logger, w, nil
 }
 
-func makeClientReserverFromConfig(cfg *Config) (forwarder.ClientReserver, error) {
+func makeClientReserverFromConfig(cfg *PoolConfig, registry *metrics.Registry) (forwarder.ClientReserver, error) {
 	var reserver forwarder.ClientReserver
 	if cfg.MaxConnectionsPerClient > 0 {
-		reserver = limiter.NewUniformlyBoundedClientReserver(cfg.MaxConnectionsPerClient)
+		bounded := limiter.NewUniformlyBoundedClientReserver(cfg.MaxConnectionsPerClient)
+		bounded.MaxConcurrentClients = cfg.MaxConcurrentClients
+		bounded.Overloaded = registry.Counter("reserver_overloaded_total")
+		bounded.LeaseTTL = cfg.ReservationLeaseTTL
+		bounded.Expired = registry.Counter("reserver_leases_expired_total")
+		reserver = bounded
 	} else {
 		reserver = limiter.UnboundedClientReserver{}
 	}
 	return reserver, nil
 }
 
-func makeAuthorizerFromConfig(cfg *Config) (forwarder.Authorizer, error) {
-	// TODO FIXME begin placeholder demo authorization config
-	urGroup := authz.Group{Key: "ur"}
-	urUpstreamGroup := authz.UpstreamGroup{Key: "ur"}
-	authzCfg := authz.Config{
-		GroupsByClientID: map[core.ClientID][]authz.Group{
-			anonymousTestClientID: {urGroup},
+// startUDPProxyFromConfig starts forwarding UDP datagrams to the upstreams
+// of the configured pool, if UDP is enabled, on the UDP socket inherited
+// from the old process, if any, or else on a new one. The returned Proxy is
+// nil if UDP is not enabled.
+func startUDPProxyFromConfig(cfg *Config, logger slog.Logger, registry *metrics.Registry, inherited map[string]net.PacketConn) (*udp.Proxy, error) {
+	if cfg.UDPListenAddress == "" {
+		return nil, nil
+	}
+	pc := findPool(cfg.Pools, cfg.UDPPool)
+	// Pools are configured with TCP upstreams. UDP is forwarded to the
+	// same addresses.
+	upstreams := core.EmptyUpstreamSet()
+	for _, u := range pc.Upstreams {
+		upstreams[core.Upstream{Network: "udp", Address: u.Address}] = struct{}{}
+	}
+	weights := make(map[core.Upstream]int, len(pc.Weights))
+	for u, w := range pc.Weights {
+		weights[core.Upstream{Network: "udp", Address: u.Address}] = w
+	}
+	policy, err := dialer.NewDialPolicy(dialer.PolicyConfig{Name: pc.Policy, Weights: weights, Upstreams: upstreams})
+	if err != nil {
+		return nil, err
+	}
+	conn, err := listenPacket(inherited, udpListenerName, "udp", cfg.UDPListenAddress)
+	if err != nil {
+		return nil, err
+	}
+	proxy := &udp.Proxy{
+		Logger:      logger,
+		Conn:        conn,
+		Upstreams:   upstreams,
+		Policy:      policy,
+		IdleTimeout: cfg.UDPIdleTimeout,
+		MaxSessions: cfg.UDPMaxSessions,
+		Metrics:     udp.NewProxyMetrics(registry),
+	}
+	go func() {
+		if err := proxy.Serve(); !errors.Is(err, udp.ProxyClosed) {
+			logger.Error(&slog.LogRecord{Msg: "UDP proxy error", Error: err})
+		}
+	}()
+	logger.Info(&slog.LogRecord{Msg: fmt.Sprintf("forwarding UDP on address: %s to pool: %s", cfg.UDPListenAddress, pc.Name)})
+	return proxy, nil
+}
+
+// startLeaseSweeper starts reclaiming the lapsed reservation leases of
+// reserver, if its reservations are leases. The returned stop function
+// stops reclaiming them.
+func startLeaseSweeper(reserver forwarder.ClientReserver) (stop func()) {
+	bounded, ok := reserver.(*limiter.UniformlyBoundedClientReserver)
+	if !ok || bounded.LeaseTTL <= 0 {
+		return func() {}
+	}
+	return bounded.StartLeaseSweeper(bounded.LeaseTTL / 2)
+}
+
+// makeBudgetWarningsFromConfig returns the BudgetWarner that clients nearing
+// their limits are warned by, publishing warnings to publisher, if not nil.
+// It returns nil if warnings are disabled.
+func makeBudgetWarningsFromConfig(cfg *Config, logger slog.Logger, publisher forwarder.BudgetWarningPublisher, registry *metrics.Registry) *forwarder.BudgetWarnings {
+	if cfg.BudgetWarningFraction <= 0 {
+		return nil
+	}
+	return &forwarder.BudgetWarnings{
+		Logger:     logger,
+		Warned:     registry.Counter("budget_warnings_total"),
+		Publisher:  publisher,
+		Interval:   budgetWarningInterval,
+		MaxClients: maxBudgetWarningClients,
+	}
+}
+
+// warnOfReservations has warnings warn clients of reserver, if it limits
+// their reservations, once they hold cfg.BudgetWarningFraction of them.
+func warnOfReservations(cfg *Config, reserver forwarder.ClientReserver, warnings *forwarder.BudgetWarnings) {
+	bounded, ok := reserver.(*limiter.UniformlyBoundedClientReserver)
+	if !ok || warnings == nil {
+		return
+	}
+	bounded.WarnFraction = cfg.BudgetWarningFraction
+	bounded.Warner = warnings
+}
+
+func makeUpstreamRegistryFromConfig(cfg *Config) *core.UpstreamRegistry {
+	registry := core.NewUpstreamRegistry()
+	for u, labels := range cfg.UpstreamLabels {
+		registry.SetLabels(u, labels)
+	}
+	return registry
+}
+
+// makeCircuitBreakerFromConfig returns the CircuitBreaker shared by the
+// dialers of all pools, or nil if circuit breaking is disabled.
+func makeCircuitBreakerFromConfig(cfg *Config, registry *metrics.Registry) *dialer.CircuitBreaker {
+	if cfg.CircuitBreakerRatio <= 0 {
+		return nil
+	}
+	return dialer.NewCircuitBreaker(dialer.CircuitBreakerConfig{
+		FailureRatio: cfg.CircuitBreakerRatio,
+		MinDials:     cfg.CircuitBreakerMinDials,
+		Window:       cfg.CircuitBreakerWindow,
+		OpenDuration: cfg.CircuitBreakerOpen,
+		Probes:       cfg.CircuitBreakerProbes,
+	}, dialer.NewCircuitBreakerMetrics(registry))
+}
+
+func makeDialerFromConfig(cfg *PoolConfig, proxyHeader *forwarder.ProxyHeaderConfig, logger slog.Logger, tracker *healthcheck.Tracker, registry *core.UpstreamRegistry, breaker *dialer.CircuitBreaker, latency *dialer.LatencyTracker, dns *dialer.DNSCache) (forwarder.BestUpstreamDialer, error) {
+	policy, err := dialer.NewDialPolicy(dialer.PolicyConfig{
+		Name:      cfg.Policy,
+		Weights:   cfg.Weights,
+		Registry:  registry,
+		Upstreams: core.NewUpstreamSet(cfg.Upstreams...),
+	})
+	if err != nil {
+		return nil, err
+	}
+	upstreamDialer, err := makeUpstreamDialerFromConfig(cfg, cfg.DialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	var chain dialer.Chain
+	if cfg.TLS.Enabled {
+		upstreamTLS, err := makeUpstreamTLSFromConfig(cfg, logger)
+		if err != nil {
+			return nil, err
+		}
+		chain = append(chain, dialer.WithTLS(upstreamTLS, cfg.DialTimeout))
+	}
+	if proxyHeader != nil {
+		// The PROXY header precedes the TLS handshake on the connection.
+		chain = append(chain, dialer.WithProxyHeader(proxyHeader))
+	}
+	// Egress proxies resolve the host names of upstreams themselves.
+	if dns != nil && cfg.EgressProxy == "" {
+		chain = append(chain, dialer.WithResolver(dns))
+	}
+	return &dialer.RetryDialer{
+		Policy:      policy,
+		Dialer:      chain.Then(upstreamDialer),
+		Timeout:     cfg.RetryTimeout,
+		Backoff:     cfg.RetryBackoff,
+		MaxAttempts: cfg.MaxDialAttempts,
+		FailFast:    cfg.FailFast,
+		Filter: func(u core.Upstream) bool {
+			return !tracker.Drained(u)
 		},
-		UpstreamGroupsByGroup: map[authz.Group][]authz.UpstreamGroup{
-			urGroup: {urUpstreamGroup},
+		Health:  tracker,
+		Breaker: breaker,
+		Latency: latency,
+	}, nil
+}
+
+// makeCPUOverloadSignalFromConfig returns the signal of CPU overload, or nil
+// if CPU use is not monitored.
+func makeCPUOverloadSignalFromConfig(cfg *Config) (*limiter.CPUOverloadSignal, error) {
+	if cfg.CPUOverloadThreshold <= 0 {
+		return nil, nil
+	}
+	return limiter.NewCPUOverloadSignal(cfg.CPUOverloadThreshold)
+}
+
+// makeUpstreamDialerFromConfig returns the dialer of each upstream of the
+// pool, which dials through the pool's egress proxy, if it has one.
+func makeUpstreamDialerFromConfig(cfg *PoolConfig, timeout time.Duration) (forwarder.UpstreamDialer, error) {
+	if cfg.EgressProxy == "" {
+		return &dialer.TimeoutDialer{Timeout: timeout}, nil
+	}
+	proxy, err := dialer.ParseProxyURL(cfg.EgressProxy)
+	if err != nil {
+		return nil, err
+	}
+	return &dialer.ProxyDialer{Proxy: proxy, Timeout: timeout}, nil
+}
+
+// makeTarpitFromConfig returns the tarpit shared by the listeners to hold
+// connections from banned sources, or nil if there is none.
+func makeTarpitFromConfig(cfg *Config, registry *metrics.Registry) *forwarder.Tarpit {
+	if cfg.BanTarpit <= 0 {
+		return nil
+	}
+	return &forwarder.Tarpit{
+		Duration: cfg.BanTarpit,
+		MaxConns: int32(cfg.BanTarpitMaxConns),
+		Full:     registry.Counter("ban_tarpit_full_total"),
+	}
+}
+
+// makeDeniedClientLimiterFromConfig returns the bound on the connections of
+// clients not authorized for any upstream, or nil if they are not bounded.
+// If sources are banned, those of connections beyond the bound are
+// recorded as failing in bans.
+func makeDeniedClientLimiterFromConfig(cfg *Config, bans *banlist.List, registry *metrics.Registry) *forwarder.DeniedClientLimiter {
+	if cfg.MaxDeniedConnsPerClient <= 0 {
+		return nil
+	}
+	limiter := &forwarder.DeniedClientLimiter{
+		MaxPerClient: cfg.MaxDeniedConnsPerClient,
+		Hold:         cfg.DeniedConnHold,
+		Exceeded:     registry.Counter("denied_connections_over_limit_total"),
+	}
+	if bans != nil {
+		limiter.Banner = bans
+	}
+	return limiter
+}
+
+// makeDNSCacheFromConfig returns the cache of the addresses of upstream host
+// names, or nil if dials resolve host names themselves.
+func makeDNSCacheFromConfig(cfg *Config, registry *metrics.Registry) *dialer.DNSCache {
+	if cfg.DNSCacheTTL <= 0 && cfg.DNSNegativeTTL <= 0 && cfg.DNSTimeout <= 0 {
+		return nil
+	}
+	return dialer.NewDNSCache(dialer.DNSCacheConfig{
+		TTL:         cfg.DNSCacheTTL,
+		NegativeTTL: cfg.DNSNegativeTTL,
+		Timeout:     cfg.DNSTimeout,
+	}, dialer.NewDNSCacheMetrics(registry))
+}
+
+// makeUpstreamTLSFromConfig returns the TLS configuration of connections to
+// the upstreams of the pool, whose files are reloaded when they change.
+func makeUpstreamTLSFromConfig(cfg *PoolConfig, logger slog.Logger) (*dialer.UpstreamTLS, error) {
+	upstreamTLS, err := dialer.NewUpstreamTLS(dialer.UpstreamTLSConfig{
+		CertFile:       cfg.TLS.CertFile,
+		KeyFile:        cfg.TLS.KeyFile,
+		CAFile:         cfg.TLS.CAFile,
+		ServerName:     cfg.TLS.ServerName,
+		Verify:         dialer.VerifyMode(cfg.TLS.Verify),
+		SPKIPins:       cfg.TLS.SPKIPins,
+		ReloadInterval: upstreamTLSReloadInterval,
+		ErrorHandler: func(err error) {
+			logger.Warn(&slog.LogRecord{Msg: "UpstreamTLS: reload error", Details: cfg.Name, Error: err})
 		},
-		UpstreamsByUpstreamGroup: map[authz.UpstreamGroup]core.UpstreamSet{
-			urUpstreamGroup: core.NewUpstreamSet(cfg.Upstreams...),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("pool %q: %w", cfg.Name, err)
+	}
+	if cfg.TLS.Verify == string(dialer.VerifyInsecure) {
+		logger.Warn(&slog.LogRecord{Msg: "UpstreamTLS: INSECURE: upstream certificates are not verified, so connections to upstreams may be intercepted. Use only in lab environments", Details: cfg.Name})
+	}
+	return upstreamTLS, nil
+}
+
+// makeRejectionSignallerFromConfig returns the RejectionSignaller to use, or
+// nil if rejected connections are closed without explanation.
+func makeRejectionSignallerFromConfig(cfg *Config) (forwarder.RejectionSignaller, error) {
+	switch cfg.RejectionSignal {
+	case rejectionSignalNone:
+		return nil, nil
+	case rejectionSignalMessage:
+		return forwarder.MessageRejectionSignaller{Timeout: defaultRejectionSignalTimeout}, nil
+	default:
+		return nil, fmt.Errorf("unknown rejection signal %q (expected %s or %s)", cfg.RejectionSignal, rejectionSignalNone, rejectionSignalMessage)
+	}
+}
+
+// validateSlowConsumer checks the handling of slow consumers.
+func validateSlowConsumer(cfg *Config) error {
+	violations := &InvalidConfig{}
+	known := false
+	for _, policy := range forwarder.SlowConsumerPolicies {
+		known = known || cfg.SlowConsumerPolicy == string(policy)
+	}
+	if !known {
+		violations.addf("slow-consumer-policy", "unknown slow consumer policy %q (expected %s, %s or %s)", cfg.SlowConsumerPolicy, forwarder.SlowConsumerThrottle, forwarder.SlowConsumerBuffer, forwarder.SlowConsumerTerminate)
+	}
+	if cfg.SlowConsumerPolicy == string(forwarder.SlowConsumerBuffer) && cfg.SlowConsumerBufferSize <= 0 {
+		violations.addf("slow-consumer-buffer", "slow consumer buffer must be positive for the buffer policy")
+	}
+	return violations.err()
+}
+
+func makeForwarderFromConfig(cfg *Config, registry *metrics.Registry) (forwarder.Forwarder, error) {
+	fwder := forwarder.MediocreForwarder{
+		IdleTimeout:     cfg.IdleTimeout,
+		MaxDuration:     cfg.MaxConnectionDuration,
+		HalfOpenTimeout: cfg.HalfOpenTimeout,
+	}
+	if cfg.SlowConsumerTimeout > 0 {
+		fwder.SlowConsumer = forwarder.SlowConsumerConfig{
+			WriteTimeout: cfg.SlowConsumerTimeout,
+			Policy:       forwarder.SlowConsumerPolicy(cfg.SlowConsumerPolicy),
+			BufferSize:   cfg.SlowConsumerBufferSize,
+			Metrics:      forwarder.NewSlowConsumerMetrics(registry),
+		}
+	}
+	if cfg.UpstreamBandwidth > 0 {
+		fwder.Bandwidth = limiter.NewFairBandwidthScheduler(limiter.FairBandwidthConfig{
+			Rate:    float64(cfg.UpstreamBandwidth),
+			Quantum: cfg.BandwidthQuantum,
+		}, limiter.NewFairBandwidthMetrics(registry))
+	}
+	return fwder, nil
+}
+
+func makeTracerFromConfig(cfg *Config, logger slog.Logger) (*trace.Tracer, error) {
+	if cfg.OTLPEndpoint == "" {
+		return nil, nil
+	}
+	exporter := &trace.OTLPExporter{
+		Endpoint:    cfg.OTLPEndpoint,
+		ServiceName: traceServiceName,
+	}
+	tracer := trace.NewTracer(trace.Config{
+		Exporter: exporter,
+		Sampler:  trace.RatioSampler{Ratio: cfg.TraceSampleRatio},
+		ErrorHandler: func(err error) {
+			logger.Warn(&slog.LogRecord{Msg: "Tracer: span export error", Error: err})
 		},
+	})
+	return tracer, nil
+}
+
+func makeAccessLoggerFromConfig(cfg *Config) (accesslog.Logger, io.Closer, error) {
+	if cfg.AccessLogSink == "" {
+		return nil, nil, nil
+	}
+	w, err := accesslog.OpenSink(cfg.AccessLogSink)
+	if err != nil {
+		return nil, nil, err
+	}
+	return accesslog.NewJSONLogger(w), w, nil
+}
+
+// startAdminServer serves the admin and debug endpoints on
+// cfg.AdminListenAddress, if configured. The returned http.Server is nil
+// if admin endpoints are disabled.
+func startAdminServer(cfg *Config, logger slog.Logger, mux *http.ServeMux, inherited map[string]net.Listener) (*http.Server, net.Listener, error) {
+	if cfg.AdminListenAddress == "" {
+		return nil, nil, nil
+	}
+	listener, err := listen(inherited, adminListenerName, "tcp", cfg.AdminListenAddress)
+	if err != nil {
+		return nil, nil, err
+	}
+	srv := &http.Server{Handler: mux}
+	scheme := "http"
+	if cfg.AdminTLS.Enabled() {
+		tlsConfig, err := cfg.AdminTLS.Load()
+		if err != nil {
+			_ = listener.Close()
+			return nil, nil, err
+		}
+		srv.TLSConfig = tlsConfig
+		scheme = "https"
 	}
-	// TODO FIXME end placeholder demo authorization config
-	return authz.NewStaticAuthorizer(authzCfg), nil
+	go func() {
+		var err error
+		if srv.TLSConfig != nil {
+			err = srv.ServeTLS(listener, "", "")
+		} else {
+			err = srv.Serve(listener)
+		}
+		if err != nil && err != http.ErrServerClosed {
+			logger.Error(&slog.LogRecord{Msg: "admin server terminated abnormally", Error: err})
+		}
+	}()
+	logger.Info(&slog.LogRecord{Msg: fmt.Sprintf("admin endpoints listening on address: %s (%s)", cfg.AdminListenAddress, scheme)})
+	return srv, listener, nil
 }
 
-// PlaceholderDialer attempts to dial an arbitrary candidate and gives up if that fails.
-// This is implementation has various issues:
-// - no timeout
-// - it doesn't attempt to balance load
-// - it doesn't try alternative upstreams if one attempt fails
-// - it doesn't learn anything
-type PlaceholderDialer struct {
-	Logger slog.Logger
+// makeHealthTrackerFromConfig returns a Tracker of the health of the
+// upstreams of all pools, with any beliefs saved by a previous process
+// loaded, and a ProbePool for each pool with health checks enabled. Each
+// ProbePool should be started with the upstreams of its pool.
+func makeHealthTrackerFromConfig(cfg *Config, logger slog.Logger) (*healthcheck.Tracker, map[string]*healthcheck.ProbePool, error) {
+	tracker := healthcheck.NewTracker(healthcheck.TrackerConfig{MaxStateAge: cfg.HealthStateMaxAge}, allUpstreams(cfg.Pools))
+	tracker.Logger = logger
+	if cfg.HealthStateFile != "" {
+		tracker.Store = &healthcheck.FileStore{Path: cfg.HealthStateFile}
+	}
+	// The state file is only a cache of beliefs that probes will find out
+	// again, so a corrupt or outdated one must not prevent startup.
+	if err := tracker.Load(); err != nil && logger != nil {
+		logger.Warn(&slog.LogRecord{Msg: "Tracker: failed to load health state, so beliefs start unknown", Details: cfg.HealthStateFile, Error: err})
+	}
+	probePools := make(map[string]*healthcheck.ProbePool)
+	for _, p := range cfg.Pools {
+		if p.HealthCheckInterval <= 0 {
+			continue
+		}
+		upstreamDialer, err := makeUpstreamDialerFromConfig(&p, p.HealthCheckTimeout)
+		if err != nil {
+			return nil, nil, err
+		}
+		probePools[p.Name] = &healthcheck.ProbePool{
+			Dialer:   &dialer.ProbeDialer{Dialer: upstreamDialer},
+			Reporter: tracker,
+			Interval: p.HealthCheckInterval,
+			Logger:   logger,
+		}
+	}
+	return tracker, probePools, nil
 }
 
-func (d PlaceholderDialer) DialBestUpstream(ctx context.Context, candidates core.UpstreamSet) (core.Upstream, forwarder.DuplexConn, error) {
-	for c := range candidates {
-		conn, err := net.Dial(c.Network, c.Address)
+// makeOnDemandProberFromConfig returns the prober of upstreams that operators
+// may use at any time, whether or not health checks are enabled.
+func makeOnDemandProberFromConfig(cfg *Config, logger slog.Logger, tracker *healthcheck.Tracker) *healthcheck.OnDemandProber {
+	timeout := cfg.HealthCheckTimeout
+	if timeout <= 0 {
+		timeout = defaultHealthCheckTimeout
+	}
+	probeDialer := &poolProbeDialer{
+		Dialers: make(map[core.Upstream]healthcheck.UpstreamDialer),
+		Default: &dialer.ProbeDialer{Dialer: &dialer.TimeoutDialer{Timeout: timeout}},
+	}
+	for i := range cfg.Pools {
+		if cfg.Pools[i].EgressProxy == "" {
+			continue
+		}
+		upstreamDialer, err := makeUpstreamDialerFromConfig(&cfg.Pools[i], timeout)
 		if err != nil {
-			return core.Upstream{}, nil, err
+			continue // Validated by validatePools.
 		}
-		switch upstreamConn := conn.(type) {
-		case *net.TCPConn:
-			return c, upstreamConn, nil
-		default:
-			d.Logger.Error(&slog.LogRecord{Msg: "upstreamConn has unsupported type, closing it"})
-			_ = conn.Close()
-			break
+		for _, u := range cfg.Pools[i].Upstreams {
+			probeDialer.Dialers[u] = &dialer.ProbeDialer{Dialer: upstreamDialer}
 		}
 	}
-	return core.Upstream{}, nil, errors.New("PlaceholderDialer failed to dial")
+	return &healthcheck.OnDemandProber{
+		Dialer:   probeDialer,
+		Reporter: tracker,
+		Logger:   logger,
+	}
 }
 
-func makeDialerFromConfig(cfg *Config, logger slog.Logger) (forwarder.BestUpstreamDialer, error) {
-	// TODO FIXME replace with something better
-	return PlaceholderDialer{Logger: logger}, nil
+// poolProbeDialer probes each upstream the way its pool dials it: through
+// the pool's egress proxy, if it has one.
+type poolProbeDialer struct {
+	Dialers map[core.Upstream]healthcheck.UpstreamDialer
+	Default healthcheck.UpstreamDialer
 }
 
-func makeForwarderFromConfig(cfg *Config) (forwarder.Forwarder, error) {
-	// TODO implement something more robust with timeouts
-	return forwarder.MediocreForwarder{}, nil
+func (d *poolProbeDialer) DialUpstream(ctx context.Context, upstream core.Upstream) (net.Conn, error) {
+	if probe, ok := d.Dialers[upstream]; ok {
+		return probe.DialUpstream(ctx, upstream)
+	}
+	return d.Default.DialUpstream(ctx, upstream)
 }
 
-func serve(logger slog.Logger, cfg *Config) error {
-	// Wire together the forwarder.Server
+// upstreamGroupLister is an Authorizer that can list the upstream groups
+// granted to a client, e.g. an *authz.Authorizer.
+type upstreamGroupLister interface {
+	UpstreamGroups(ctx context.Context, c core.ClientID) ([]string, error)
+}
+
+// clientInspector assembles what the server knows of a client from the
+// limiters, the authorizer and the counts of recent rejections.
+type clientInspector struct {
+	reserver   forwarder.PoolReserver
+	authorizer forwarder.Authorizer
+	classes    *forwarder.PriorityClasses
+	exemptions *forwarder.LimitExemptions // exemptions is optional.
+	rejections *forwarder.ClientRejections
+}
+
+func (i *clientInspector) InspectClient(ctx context.Context, c core.ClientID) (admin.ClientDetails, error) {
+	details := admin.ClientDetails{
+		ClientID:       c,
+		Reservations:   i.reserver.ClientReservations(c),
+		Groups:         []string{},
+		UpstreamGroups: []string{},
+		Rejections:     i.rejections.Rejections(c),
+	}
+	if details.Reservations == nil {
+		details.Reservations = []forwarder.ClientReservations{}
+	}
+	var err error
+	if details.Class, _, err = i.classes.Class(ctx, c); err != nil {
+		return details, err
+	}
+	if details.Exempt, err = i.exemptions.IsExempt(ctx, c); err != nil {
+		return details, err
+	}
+	if resolver, ok := i.authorizer.(forwarder.GroupResolver); ok {
+		if details.Groups, err = resolver.ClientGroups(ctx, c); err != nil {
+			return details, err
+		}
+	}
+	if lister, ok := i.authorizer.(upstreamGroupLister); ok {
+		if details.UpstreamGroups, err = lister.UpstreamGroups(ctx, c); err != nil {
+			return details, err
+		}
+	}
+	return details, nil
+}
+
+func anyHealthChecks(cfg *Config) bool {
+	for _, p := range cfg.Pools {
+		if p.HealthCheckInterval > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// makeReadinessChecks returns the criteria for the server to report ready:
+// the listener must be bound, the server must not be draining, and if
+// health checks are enabled, enough upstreams must be believed to be
+// healthy.
+func makeReadinessChecks(cfg *Config, listenerBound, draining *int32, tracker *healthcheck.Tracker) []admin.ReadinessCheck {
+	checks := []admin.ReadinessCheck{
+		func() error {
+			if atomic.LoadInt32(listenerBound) == 0 {
+				return errors.New("listener not bound")
+			}
+			return nil
+		},
+		func() error {
+			if atomic.LoadInt32(draining) == 1 {
+				return errors.New("draining")
+			}
+			return nil
+		},
+	}
+	if anyHealthChecks(cfg) && cfg.ReadyMinHealthyUpstreams > 0 {
+		checks = append(checks, func() error {
+			n := tracker.CountHealthy()
+			if n < cfg.ReadyMinHealthyUpstreams {
+				return fmt.Errorf("%d healthy upstreams, need at least %d", n, cfg.ReadyMinHealthyUpstreams)
+			}
+			return nil
+		})
+	}
+	return checks
+}
+
+func serve(logger slog.Logger, levels admin.LevelController, cfg *Config) error {
+	started := time.Now()
+	applyMemoryTuningFromConfig(cfg, logger)
+	registry := metrics.NewRegistry()
+	expvar.Publish(metricsExpvarName, registry)
+	table := conntable.NewTable(conntable.Config{IdleAfter: cfg.ConnIdleAfter})
 
-	reserver, err := makeClientReserverFromConfig(cfg)
+	// If this process was started by an upgrade, it serves on the listeners
+	// inherited from the old process instead of binding new ones.
+	inherited, inheritedPacketConns, err := handoff.Inherited()
 	if err != nil {
-		logger.Error(&slog.LogRecord{Msg: "Client rate-limiter error", Error: err})
+		logger.Error(&slog.LogRecord{Msg: "failed to inherit listeners", Error: err})
 		return err
 	}
+	if n := len(inherited) + len(inheritedPacketConns); n > 0 {
+		logger.Info(&slog.LogRecord{Msg: "inherited listeners from parent process", Details: n})
+	}
 
-	authorizer, err := makeAuthorizerFromConfig(cfg)
+	// Wire together the forwarder.Server
+
+	authorizer, err := makeAuthorizerFromConfig(cfg, registry)
 	if err != nil {
 		logger.Error(&slog.LogRecord{Msg: "Authorization configuration error", Error: err})
 		return err
 	}
 
-	dialer, err := makeDialerFromConfig(cfg, logger)
+	tracker, probePools, err := makeHealthTrackerFromConfig(cfg, logger)
 	if err != nil {
-		logger.Error(&slog.LogRecord{Msg: "Dialer configuration error", Error: err})
+		logger.Error(&slog.LogRecord{Msg: "Health check configuration error", Error: err})
 		return err
 	}
+	if tracker.Store != nil {
+		defer tracker.StartPersister()()
+	}
 
-	fwder, err := makeForwarderFromConfig(cfg)
+	upstreamRegistry := makeUpstreamRegistryFromConfig(cfg)
+	pools, err := makePoolsFromConfig(cfg, logger, tracker, upstreamRegistry, registry)
 	if err != nil {
-		logger.Error(&slog.LogRecord{Msg: "Forwarder configuration error", Error: err})
+		logger.Error(&slog.LogRecord{Msg: "Pool configuration error", Error: err})
 		return err
 	}
+	reserver := forwarder.PoolReserver{Pools: pools}
+	for _, pool := range pools {
+		defer startLeaseSweeper(pool.Reserver)()
+	}
 
-	// Compose stack of connection handlers. They are defined
-	// in order from innermost to outermost.
-	forwardingHandler := &forwarder.ForwardingHandler{
-		Logger:    logger,
-		Dialer:    dialer,
-		Forwarder: fwder,
+	for name, probePool := range probePools {
+		probePool.Start(pools[name].Upstreams)
+		defer probePool.Stop()
 	}
-	authzHandler := &forwarder.AuthorizedUpstreamsHandler{
-		Logger:     logger,
-		Authorizer: authorizer,
-		Inner:      forwardingHandler,
+
+	prober := makeOnDemandProberFromConfig(cfg, logger, tracker)
+	warmupChecks, err := warmUpFromConfig(cfg, logger, tracker, prober)
+	if err != nil {
+		return err
 	}
-	rateLimitingHandler := &forwarder.RateLimitingHandler{
-		Logger:   logger,
-		Reserver: reserver,
-		Inner:    authzHandler,
+
+	ipRules, err := loadIPFilterRulesFromConfig(cfg)
+	if err != nil {
+		logger.Error(&slog.LogRecord{Msg: "IP filter configuration error", Error: err})
+		return err
+	}
+	version := newConfigVersion(logger, cfg, ipRules, registry)
+
+	tracer, err := makeTracerFromConfig(cfg, logger)
+	if err != nil {
+		logger.Error(&slog.LogRecord{Msg: "Tracer configuration error", Error: err})
+		return err
+	}
+	defer func() {
+		_ = tracer.Shutdown(context.Background())
+	}()
+
+	accessLogger, accessLogCloser, err := makeAccessLoggerFromConfig(cfg)
+	if err != nil {
+		logger.Error(&slog.LogRecord{Msg: "Access log configuration error", Error: err})
+		return err
 	}
-	// TODO replace placeholder implementation: use mTLS for authn
-	authnHandler := &forwarder.AnonymousAuthenticationHandler{
-		Logger:    logger,
-		Inner:     rateLimitingHandler,
-		Anonymous: anonymousTestClientID,
+	if accessLogCloser != nil {
+		defer func() {
+			_ = accessLogCloser.Close()
+		}()
 	}
-	baseHandler := &forwarder.ConnCloserHandler{
-		Inner: authnHandler,
+
+	var listenerBound int32
+	var draining int32
+	readinessChecks := append(makeReadinessChecks(cfg, &listenerBound, &draining, tracker), warmupChecks...)
+	adminMux := makeAdminMux(started, registry, version, table, readinessChecks)
+	adminServer, adminListener, err := startAdminServer(cfg, logger, adminMux, inherited)
+	if err != nil {
+		logger.Error(&slog.LogRecord{Msg: "Admin server configuration error", Error: err})
+		return err
+	}
+	if adminServer != nil {
+		defer func() {
+			_ = adminServer.Close()
+		}()
 	}
 
-	// TODO replace placeholder implementation: accept TLS instead of TCP.
-	listener, err := net.Listen(cfg.ListenNetwork, cfg.ListenAddress)
+	// Operations that change the server's behaviour are only served on the
+	// control socket, where callers are authenticated by their user.
+	reloads := make(chan chan<- error)
+	replacer := &poolUpstreamReplacer{
+		logger:     logger,
+		pools:      pools,
+		tracker:    tracker,
+		probePools: probePools,
+		authorizer: authorizer,
+		groups:     cfg.UpstreamGroups,
+		labels:     cfg.UpstreamLabels,
+	}
+	controlMux := makeControlMux(cfg, levels, table, tracker, prober, replacer, reserver, version, reloads)
+	controlServer, controlListener, err := startControlServer(cfg, logger, controlMux, inherited)
 	if err != nil {
-		msg := fmt.Sprintf("Listen error with network: %s address: %s", cfg.ListenNetwork, cfg.ListenAddress)
-		logger.Error(&slog.LogRecord{Msg: msg, Error: err})
+		logger.Error(&slog.LogRecord{Msg: "Control socket configuration error", Error: err})
 		return err
 	}
-	defer func() {
-		_ = listener.Close()
+	if controlServer != nil {
+		defer func() {
+			_ = controlServer.Close()
+		}()
+	}
+
+	eventStream, eventListener, err := startEventStream(cfg, logger, registry, inherited)
+	if err != nil {
+		logger.Error(&slog.LogRecord{Msg: "Event socket configuration error", Error: err})
+		return err
+	}
+	if eventStream != nil {
+		defer func() {
+			_ = eventStream.Close()
+		}()
+	}
+
+	deps, err := makeHandlerDepsFromConfig(cfg, logger, registry, table, authorizer, pools, upstreamRegistry, accessLogger)
+	if err != nil {
+		return err
+	}
+	var warningPublisher forwarder.BudgetWarningPublisher
+	if eventStream != nil {
+		deps.events = eventStream
+		warningPublisher = eventStream
+	}
+	budgetWarnings := makeBudgetWarningsFromConfig(cfg, logger, warningPublisher, registry)
+	for _, pool := range pools {
+		warnOfReservations(cfg, pool.Reserver, budgetWarnings)
+	}
+	stopShedding, err := startLoadSheddingFromConfig(cfg, logger, registry, deps)
+	if err != nil {
+		logger.Error(&slog.LogRecord{Msg: "CPU overload signal configuration error", Error: err})
+		return err
+	}
+	defer stopShedding()
+	stopQuotas, err := startQuotasFromConfig(cfg, logger, registry, budgetWarnings, deps)
+	if err != nil {
+		logger.Error(&slog.LogRecord{Msg: "Quota configuration error", Error: err})
+		return err
+	}
+	defer stopQuotas()
+	admin.RegisterClientInspectionHandler(controlMux, &clientInspector{
+		reserver:   reserver,
+		authorizer: authorizer,
+		classes:    deps.priorityClasses,
+		exemptions: deps.exemptions,
+		rejections: deps.rejections,
+	})
+	defer startIPFilterFromConfig(cfg, logger, version, ipRules, deps)()
+	var filters forwarder.ConnFilters
+	if deps.bans != nil && cfg.BanTarpit <= 0 {
+		filters = append(filters, deps.bans)
+	}
+
+	udpProxy, err := startUDPProxyFromConfig(cfg, logger, registry, inheritedPacketConns)
+	if err != nil {
+		logger.Error(&slog.LogRecord{Msg: "UDP configuration error", Error: err})
+		return err
+	}
+	if udpProxy != nil {
+		defer func() {
+			_ = udpProxy.Close()
+		}()
+	}
+
+	var servers []*forwarder.Server
+	var listenerReports []listenerReport
+	listeners := make(map[string]net.Listener)
+	for _, lc := range allListeners(cfg) {
+		lc := lc
+		listenerReserver, stopSweeper, err := makeListenerReserverFromConfig(cfg, &lc, reserver, budgetWarnings, registry)
+		if err != nil {
+			logger.Error(&slog.LogRecord{Msg: "Listener configuration error", Error: err})
+			return err
+		}
+		defer stopSweeper()
+		s, listener, listenerReport, err := makeServerFromConfig(cfg, &lc, deps, listenerReserver, tracer, filters, registry, inherited)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			_ = listener.Close()
+		}()
+		// The raw listener is handed off on reload, not the TLS one.
+		listeners[lc.Name] = listener
+		listenerReports = append(listenerReports, listenerReport)
+		servers = append(servers, s)
+	}
+	atomic.StoreInt32(&listenerBound, 1)
+	report := newStartupReport(cfg, version.Hash(), listenerReports)
+	logger.Info(&slog.LogRecord{Msg: "startup report", Details: report})
+	admin.RegisterStartupHandler(adminMux, report)
+	admin.RegisterStartupHandler(controlMux, report)
+	closeUnusedInherited(logger, inherited, inheritedPacketConns)
+
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(signals)
+
+	serveErr := make(chan error, len(servers))
+	for _, s := range servers {
+		s := s
+		go func() {
+			serveErr <- s.Serve()
+		}()
+	}
+
+	if err := handoff.Ready(); err != nil {
+		logger.Warn(&slog.LogRecord{Msg: "failed to notify parent process of readiness", Error: err})
+	}
+
+	upgrades := make(chan os.Signal, 1)
+	if len(upgradeSignals) > 0 {
+		signal.Notify(upgrades, upgradeSignals...)
+		defer signal.Stop(upgrades)
+	}
+	if adminServer != nil {
+		listeners[adminListenerName] = adminListener
+	}
+	if controlServer != nil {
+		listeners[controlListenerName] = controlListener
+	}
+	if eventStream != nil {
+		listeners[eventListenerName] = eventListener
+	}
+	upgrader := makeUpgraderFromConfig(cfg, listeners, udpProxy)
+
+	upgraded, err := awaitShutdown(logger, serveErr, signals, upgrades, reloads, upgrader)
+	if err != nil {
+		return err
+	}
+	if controlServer != nil && !upgraded {
+		// No new process has taken over the control socket.
+		defer func() {
+			_ = os.Remove(cfg.AdminSocket)
+		}()
+	}
+	if eventStream != nil && !upgraded {
+		defer func() {
+			_ = os.Remove(cfg.EventSocket)
+		}()
+	}
+
+	// Report not ready, stop accepting new connections and stop probing
+	// upstreams, then give in-flight connections a grace period to finish.
+	// Unless a new process has taken over the listeners, keep accepting
+	// for the pre-drain delay, so that load balancers in front of the
+	// server see it is not ready, and stop sending it connections, before
+	// it stops accepting them.
+	atomic.StoreInt32(&draining, 1)
+	if !upgraded {
+		awaitPreDrain(logger, cfg.PreDrainDelay, signals)
+	}
+	atomic.StoreInt32(&listenerBound, 0)
+	for _, probePool := range probePools {
+		probePool.Stop()
+	}
+	var idleTable *conntable.Table
+	if cfg.ConnIdleAfter > 0 {
+		idleTable = table
+	}
+	return shutdownServers(logger, servers, idleTable, cfg.DrainIdleGrace, cfg.ShutdownGracePeriod, signals)
+}
+
+// makeAdminMux returns the mux of the admin and debug endpoints, which only
+// report on the server, so that they may be served without authentication.
+func makeAdminMux(started time.Time, registry *metrics.Registry, version *configVersion, table *conntable.Table, readiness []admin.ReadinessCheck) *http.ServeMux {
+	mux := http.NewServeMux()
+	admin.RegisterDebugHandlers(mux, started, registry)
+	admin.RegisterConfigHandler(mux, version.Hash)
+	admin.RegisterConnectionHandlers(mux, table)
+	admin.RegisterHealthHandlers(mux, readiness...)
+	return mux
+}
+
+// makeControlMux returns the mux of the operations that change the server's
+// behaviour, which are only served on the control socket, where callers are
+// authenticated by their user. Each reload request is sent on reloads, with
+// a channel to send its result on.
+func makeControlMux(cfg *Config, levels admin.LevelController, table *conntable.Table, tracker *healthcheck.Tracker, prober *healthcheck.OnDemandProber, replacer *poolUpstreamReplacer, reserver forwarder.PoolReserver, version *configVersion, reloads chan<- chan<- error) *http.ServeMux {
+	mux := http.NewServeMux()
+	admin.RegisterConnectionHandlers(mux, table)
+	admin.RegisterClientHandlers(mux, table, cfg.EvictGracePeriod)
+	admin.RegisterUpstreamHandlers(mux, tracker)
+	admin.RegisterProbeHandler(mux, tracker, prober)
+	admin.RegisterHistoryHandler(mux, tracker)
+	admin.RegisterPoolHandlers(mux, replacer)
+	admin.RegisterLogLevelHandlers(mux, levels)
+	admin.RegisterLimiterHandlers(mux, reserver)
+	admin.RegisterConfigHandler(mux, version.Hash)
+	admin.RegisterReloadHandler(mux, func(ctx context.Context) error {
+		result := make(chan error, 1)
+		select {
+		case reloads <- result:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		return <-result
+	})
+	return mux
+}
+
+// makeHandlerDepsFromConfig returns the dependencies of the connection
+// handlers shared by every listener. Errors are logged before they are
+// returned. The events, memory, shedder, quotas and ipFilter dependencies
+// are left for the caller to set, as they are started separately.
+func makeHandlerDepsFromConfig(cfg *Config, logger slog.Logger, registry *metrics.Registry, table *conntable.Table, authorizer forwarder.Authorizer, pools map[string]*forwarder.Pool, upstreamRegistry *core.UpstreamRegistry, accessLogger accesslog.Logger) (*handlerDeps, error) {
+	fwder, err := makeForwarderFromConfig(cfg, registry)
+	if err != nil {
+		logger.Error(&slog.LogRecord{Msg: "Forwarder configuration error", Error: err})
+		return nil, err
+	}
+	signaller, err := makeRejectionSignallerFromConfig(cfg)
+	if err != nil {
+		logger.Error(&slog.LogRecord{Msg: "Rejection signal configuration error", Error: err})
+		return nil, err
+	}
+	locator, err := makeGeoIPLocatorFromConfig(cfg)
+	if err != nil {
+		logger.Error(&slog.LogRecord{Msg: "GeoIP configuration error", Error: err})
+		return nil, err
+	}
+	var bans *banlist.List
+	if cfg.BanThreshold > 0 {
+		bans = banlist.New(banlist.Config{Threshold: cfg.BanThreshold, Window: cfg.BanWindow, Duration: cfg.BanDuration})
+	}
+	deps := &handlerDeps{
+		tarpit:             makeTarpitFromConfig(cfg, registry),
+		logger:             logger,
+		table:              table,
+		authorizer:         authorizer,
+		pools:              pools,
+		router:             makeRouterFromConfig(cfg),
+		upstreamRegistry:   upstreamRegistry,
+		forwarder:          fwder,
+		signaller:          signaller,
+		locator:            locator,
+		bans:               bans,
+		accessLogger:       accessLogger,
+		handshakeMetrics:   forwarder.NewHandshakeMetrics(registry),
+		sniffMetrics:       forwarder.NewSniffMetrics(registry),
+		fingerprintMetrics: forwarder.NewFingerprintMetrics(registry),
+		handshakeRates:     makeHandshakeRateLimiterFromConfig(cfg),
+		handshakeStarts:    makeHandshakeStartLimiterFromConfig(cfg),
+		denied:             makeDeniedClientLimiterFromConfig(cfg, bans, registry),
+		reasonMetrics:      forwarder.NewReasonMetrics(registry),
+		rejections:         &forwarder.ClientRejections{Window: clientRejectionWindow, MaxClients: maxClientRejectionClients},
+		priorityClasses:    &forwarder.PriorityClasses{Classes: cfg.PriorityClasses},
+		panics:             registry.Counter("handler_panics_total"),
+		mirrorMetrics:      forwarder.NewMirrorMetrics(registry),
+	}
+	if groups, ok := authorizer.(forwarder.GroupResolver); ok {
+		deps.exemptions = makeLimitExemptionsFromConfig(cfg, groups, registry)
+		deps.priorityClasses.Resolver = groups
+	}
+	return deps, nil
+}
+
+// startLoadSheddingFromConfig starts monitoring the CPU and the heap, if
+// configured, and sets the memory and shedder dependencies of deps to shed
+// load once the server is at capacity or overloaded. The returned stop
+// function stops monitoring.
+func startLoadSheddingFromConfig(cfg *Config, logger slog.Logger, registry *metrics.Registry, deps *handlerDeps) (stop func(), err error) {
+	cpuOverload, err := makeCPUOverloadSignalFromConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	var stops []func()
+	if cpuOverload != nil {
+		cpuOverload.Percent = registry.Gauge("cpu_utilisation_percent")
+		stops = append(stops, cpuOverload.StartSampler(cpuSampleInterval))
+	}
+	if watchdog := makeMemoryWatchdogFromConfig(cfg, logger, registry); watchdog != nil {
+		stops = append(stops, watchdog.StartSampler(memorySampleInterval))
+		deps.memory = watchdog
+		deps.memoryDropped = registry.Counter("memory_shed_total")
+	}
+	if cfg.MaxConnections > 0 || cpuOverload != nil {
+		shedder := limiter.NewPriorityShedder(cfg.MaxConnections, nil)
+		if cpuOverload != nil {
+			shedder.Overload = cpuOverload
+		}
+		shedder.Active = registry.Gauge("priority_active_connections")
+		deps.shedder = shedder
+		deps.shedMetrics = forwarder.NewShedMetrics(registry, deps.priorityClasses.Names())
+	}
+	return func() {
+		for _, stop := range stops {
+			stop()
+		}
+	}, nil
+}
+
+// startIPFilterFromConfig sets the ipFilter dependency of deps, if IP
+// filter rules are configured, and starts reloading the rules from
+// cfg.IPFilterFile on reload signals, if any. The returned stop function
+// stops reloading them.
+func startIPFilterFromConfig(cfg *Config, logger slog.Logger, version *configVersion, rules ipfilter.Rules, deps *handlerDeps) (stop func()) {
+	if rules.Empty() && cfg.IPFilterFile == "" {
+		return func() {}
+	}
+	filter := ipfilter.NewFilter(rules)
+	deps.ipFilter = filter
+	if cfg.IPFilterFile == "" || len(reloadSignals) == 0 {
+		return func() {}
+	}
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, reloadSignals...)
+	stopReloading := make(chan struct{})
+	go reloadIPFilterOnSignal(logger, cfg, version, filter, hangups, stopReloading)
+	return func() {
+		signal.Stop(hangups)
+		close(stopReloading)
+	}
+}
+
+// makeListenerReserverFromConfig returns the reserver that limits the
+// clients of the listener lc: its own, if it limits the connections of each
+// client, or else reserver. The returned stop function stops reclaiming the
+// lapsed leases of its own reserver.
+func makeListenerReserverFromConfig(cfg *Config, lc *ListenerConfig, reserver forwarder.ClientReserver, warnings *forwarder.BudgetWarnings, registry *metrics.Registry) (forwarder.ClientReserver, func(), error) {
+	if lc.MaxConnectionsPerClient <= 0 {
+		return reserver, func() {}, nil
+	}
+	listenerReserver, err := makeClientReserverFromConfig(&PoolConfig{
+		MaxConnectionsPerClient: lc.MaxConnectionsPerClient,
+		MaxConcurrentClients:    cfg.MaxConcurrentClients,
+		ReservationLeaseTTL:     cfg.ReservationLeaseTTL,
+	}, registry)
+	if err != nil {
+		return nil, nil, err
+	}
+	warnOfReservations(cfg, listenerReserver, warnings)
+	return listenerReserver, startLeaseSweeper(listenerReserver), nil
+}
+
+// makeServerFromConfig binds the listener lc, on the listener inherited
+// from the old process, if any, and returns the Server that forwards the
+// connections it accepts, limiting clients with reserver. The returned
+// net.Listener is the bound one, beneath any TLS, which the caller must
+// close. Errors are logged before they are returned.
+func makeServerFromConfig(cfg *Config, lc *ListenerConfig, deps *handlerDeps, reserver forwarder.ClientReserver, tracer *trace.Tracer, filters forwarder.ConnFilters, registry *metrics.Registry, inherited map[string]net.Listener) (*forwarder.Server, net.Listener, listenerReport, error) {
+	logger := deps.logger
+	handler, err := makeConnHandler(cfg, lc, deps, reserver)
+	if err != nil {
+		logger.Error(&slog.LogRecord{Msg: "Listener configuration error", Error: err})
+		return nil, nil, listenerReport{}, err
+	}
+
+	tlsConfig, err := lc.loadTLSConfig()
+	if err != nil {
+		logger.Error(&slog.LogRecord{Msg: "Listener TLS configuration error", Error: err})
+		return nil, nil, listenerReport{}, err
+	}
+
+	rawListener, err := listen(inherited, lc.Name, lc.Network, lc.Address)
+	if err != nil {
+		msg := fmt.Sprintf("Listen error for listener: %s with network: %s address: %s", lc.Name, lc.Network, lc.Address)
+		logger.Error(&slog.LogRecord{Msg: msg, Error: err})
+		return nil, nil, listenerReport{}, err
+	}
+	if cfg.ListenBacklog > 0 {
+		if err := setListenBacklog(rawListener, cfg.ListenBacklog); err != nil {
+			_ = rawListener.Close()
+			logger.Error(&slog.LogRecord{Msg: fmt.Sprintf("failed to set listen backlog of listener %s", lc.Name), Error: err})
+			return nil, nil, listenerReport{}, err
+		}
+	}
+	logger.Info(&slog.LogRecord{Msg: fmt.Sprintf("listener %s listening on network: %s address: %s", lc.Name, lc.Network, lc.Address)})
+	report := newListenerReport(lc, rawListener.Addr(), tlsConfig)
+	listener := rawListener
+	if tlsConfig != nil {
+		// Connections are accepted as PeekConns so that the sniff stage
+		// may inspect their first bytes before the TLS handshake.
+		listener = tls.NewListener(&forwarder.PeekListener{Listener: listener}, tlsConfig)
+	}
+
+	opts := []forwarder.ServerOption{
+		forwarder.WithAcceptQueue(cfg.MaxHandlers, cfg.AcceptQueueLength, forwarder.OverflowPolicy(cfg.AcceptQueueOverflow)),
+		forwarder.WithName(lc.Name),
+		forwarder.WithLogger(logger),
+		forwarder.WithHandler(handler),
+		forwarder.WithListener(listener),
+		forwarder.WithAcceptErrorCooldown(defaultAcceptErrorCooldownDuration),
+		forwarder.WithTracer(tracer),
+		forwarder.WithMetrics(forwarder.NewServerMetrics(registry)),
+	}
+	if len(filters) > 0 {
+		opts = append(opts, forwarder.WithConnFilter(filters))
+	}
+	if deps.accessLogger != nil {
+		// The access log records the TCP options of each connection.
+		opts = append(opts, forwarder.WithTCPInfo())
+	}
+	s, err := forwarder.NewServer(opts...)
+	if err != nil {
+		_ = rawListener.Close()
+		return nil, nil, listenerReport{}, err
+	}
+	return s, rawListener, report, nil
+}
+
+// closeUnusedInherited closes the listeners and packet sockets inherited
+// from the old process that the current config no longer uses.
+func closeUnusedInherited(logger slog.Logger, listeners map[string]net.Listener, packetConns map[string]net.PacketConn) {
+	for name, unused := range listeners {
+		logger.Warn(&slog.LogRecord{Msg: fmt.Sprintf("closing unused inherited listener %q", name)})
+		_ = unused.Close()
+	}
+	for name, unused := range packetConns {
+		logger.Warn(&slog.LogRecord{Msg: fmt.Sprintf("closing unused inherited packet socket %q", name)})
+		_ = unused.Close()
+	}
+}
+
+// makeUpgraderFromConfig returns the Upgrader that hands listeners, and the
+// socket of udpProxy, if not nil, over to a new process on upgrade.
+func makeUpgraderFromConfig(cfg *Config, listeners map[string]net.Listener, udpProxy *udp.Proxy) *handoff.Upgrader {
+	upgrader := &handoff.Upgrader{
+		Listeners: listeners,
+		Argv:      os.Args,
+		Timeout:   cfg.UpgradeTimeout,
+	}
+	if udpProxy != nil {
+		upgrader.PacketConns = map[string]net.PacketConn{udpListenerName: udpProxy.Conn}
+	}
+	return upgrader
+}
+
+// makeHandshakeRateLimiterFromConfig returns the limiter of client TLS
+// handshake rates, or nil if neither full nor resumed handshakes are
+// limited. The budgets are shared by every listener, as they bound the
+// server's own costs.
+func makeHandshakeRateLimiterFromConfig(cfg *Config) forwarder.HandshakeRateLimiter {
+	if cfg.HandshakeRate <= 0 && cfg.ResumedHandshakeRate <= 0 {
+		return nil
+	}
+	l := &limiter.HandshakeRateLimiter{}
+	if cfg.HandshakeRate > 0 {
+		l.Full = limiter.NewTokenBucket(cfg.HandshakeRate, cfg.HandshakeBurst)
+	}
+	if cfg.ResumedHandshakeRate > 0 {
+		l.Resumed = limiter.NewTokenBucket(cfg.ResumedHandshakeRate, cfg.ResumedHandshakeBurst)
+	}
+	return l
+}
+
+// makeHandshakeStartLimiterFromConfig returns the limiter of the rate at
+// which client TLS handshakes start, or nil if it is not limited. Like the
+// handshake rate limiter, it is shared by every listener.
+func makeHandshakeStartLimiterFromConfig(cfg *Config) forwarder.HandshakeStartLimiter {
+	if cfg.HandshakeStartRate <= 0 {
+		return nil
+	}
+	return limiter.NewTokenBucket(cfg.HandshakeStartRate, cfg.HandshakeStartBurst)
+}
+
+// handlerDeps are the parts of the connection handler stack that are shared
+// by every listener.
+type handlerDeps struct {
+	logger             slog.Logger
+	table              *conntable.Table
+	authorizer         forwarder.Authorizer
+	pools              map[string]*forwarder.Pool
+	router             *routing.Table
+	upstreamRegistry   *core.UpstreamRegistry
+	forwarder          forwarder.Forwarder
+	signaller          forwarder.RejectionSignaller // signaller is optional.
+	locator            geoip.Locator                // locator is optional.
+	bans               *banlist.List                // bans is optional.
+	ipFilter           forwarder.ConnFilter         // ipFilter is optional.
+	panics             *metrics.Counter
+	mirrorMetrics      *forwarder.MirrorMetrics
+	tarpit             *forwarder.Tarpit              // tarpit is optional.
+	accessLogger       accesslog.Logger               // accessLogger is optional.
+	events             forwarder.ConnEventPublisher   // events is optional.
+	memory             forwarder.MemoryPressureSignal // memory is optional.
+	memoryDropped      *metrics.Counter
+	handshakeMetrics   *forwarder.HandshakeMetrics
+	sniffMetrics       *forwarder.SniffMetrics
+	fingerprintMetrics *forwarder.FingerprintMetrics
+	handshakeRates     forwarder.HandshakeRateLimiter  // handshakeRates is optional.
+	handshakeStarts    forwarder.HandshakeStartLimiter // handshakeStarts is optional.
+	denied             *forwarder.DeniedClientLimiter  // denied is optional.
+	reasonMetrics      *forwarder.ReasonMetrics
+	rejections         *forwarder.ClientRejections
+	quotas             forwarder.QuotaAccountant  // quotas is optional.
+	exemptions         *forwarder.LimitExemptions // exemptions is optional.
+	shedder            forwarder.LoadShedder      // shedder is optional.
+	shedMetrics        *forwarder.ShedMetrics
+	priorityClasses    *forwarder.PriorityClasses
+}
+
+// makeConnHandler composes the stack of connection handlers for the
+// listener lc, limiting clients with reserver.
+func makeConnHandler(cfg *Config, lc *ListenerConfig, deps *handlerDeps, reserver forwarder.ClientReserver) (forwarder.Handler, error) {
+	chain, err := makeHandlerChain(cfg, lc, deps, reserver)
+	if err != nil {
+		return nil, err
+	}
+	return chain.Then(&forwarder.ForwardingHandler{
+		Logger:          deps.logger,
+		Dialer:          forwarder.PoolDialer{},
+		Forwarder:       deps.forwarder,
+		Registry:        deps.upstreamRegistry,
+		RedialWindow:    cfg.RedialWindow,
+		FailureReporter: forwarder.PoolDialer{},
+	}), nil
+}
+
+// awaitShutdown blocks until the server should shut down: either a shutdown
+// signal was received, or an upgrade was requested and a new process has
+// taken over the listeners, in which case upgraded is true. Upgrades are
+// requested by signal, or by sending a reply channel on reloads. If the
+// server fails, its error is returned.
+func awaitShutdown(logger slog.Logger, serveErr <-chan error, signals, upgrades <-chan os.Signal, reloads <-chan chan<- error, upgrader *handoff.Upgrader) (upgraded bool, err error) {
+	upgrade := func() error {
+		err := upgrader.Upgrade(context.Background())
+		if err != nil {
+			logger.Error(&slog.LogRecord{Msg: "upgrade failed, continuing to serve", Error: err})
+			return err
+		}
+		logger.Info(&slog.LogRecord{Msg: "new process is ready, shutting down"})
+		return nil
+	}
+	for {
+		select {
+		case err := <-serveErr:
+			return false, err
+		case sig := <-signals:
+			logger.Info(&slog.LogRecord{Msg: "received signal, shutting down", Details: sig.String()})
+			return false, nil
+		case sig := <-upgrades:
+			logger.Info(&slog.LogRecord{Msg: "received signal, starting new process", Details: sig.String()})
+			if upgrade() == nil {
+				return true, nil
+			}
+		case result := <-reloads:
+			logger.Info(&slog.LogRecord{Msg: "reload requested, starting new process"})
+			err := upgrade()
+			result <- err
+			if err == nil {
+				return true, nil
+			}
+		}
+	}
+}
+
+// startControlServer serves the control endpoints on a unix domain socket,
+// if one is configured.
+func startControlServer(cfg *Config, logger slog.Logger, mux *http.ServeMux, inherited map[string]net.Listener) (*http.Server, *net.UnixListener, error) {
+	if cfg.AdminSocket == "" {
+		return nil, nil, nil
+	}
+	var listener *net.UnixListener
+	if l, ok := inherited[controlListenerName]; ok {
+		delete(inherited, controlListenerName)
+		listener, ok = l.(*net.UnixListener)
+		if !ok {
+			_ = l.Close()
+			return nil, nil, fmt.Errorf("inherited control listener has unexpected type %T", l)
+		}
+	} else {
+		var err error
+		listener, err = admin.ListenUnix(cfg.AdminSocket)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	srv := &http.Server{Handler: mux}
+	go func() {
+		err := srv.Serve(admin.AuthenticatePeers(listener, logger))
+		if err != nil && err != http.ErrServerClosed {
+			logger.Error(&slog.LogRecord{Msg: "control server terminated abnormally", Error: err})
+		}
+	}()
+	logger.Info(&slog.LogRecord{Msg: fmt.Sprintf("control endpoints listening on socket: %s", cfg.AdminSocket)})
+	return srv, listener, nil
+}
+
+// startEventStream publishes connection lifecycle events to subscribers of
+// a unix domain socket, if one is configured.
+func startEventStream(cfg *Config, logger slog.Logger, registry *metrics.Registry, inherited map[string]net.Listener) (*events.Stream, *net.UnixListener, error) {
+	if cfg.EventSocket == "" {
+		return nil, nil, nil
+	}
+	var listener *net.UnixListener
+	if l, ok := inherited[eventListenerName]; ok {
+		delete(inherited, eventListenerName)
+		listener, ok = l.(*net.UnixListener)
+		if !ok {
+			_ = l.Close()
+			return nil, nil, fmt.Errorf("inherited event listener has unexpected type %T", l)
+		}
+	} else {
+		var err error
+		listener, err = admin.ListenUnix(cfg.EventSocket)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	stream := events.NewStream(events.StreamConfig{Buffer: cfg.EventBuffer, WriteTimeout: eventWriteTimeout}, events.NewStreamMetrics(registry))
+	go func() {
+		err := stream.Serve(admin.AuthenticatePeers(listener, logger))
+		if err != nil && err != events.StreamClosed {
+			logger.Error(&slog.LogRecord{Msg: "event stream terminated abnormally", Error: err})
+		}
 	}()
+	logger.Info(&slog.LogRecord{Msg: fmt.Sprintf("connection events published on socket: %s", cfg.EventSocket)})
+	return stream, listener, nil
+}
+
+// listen returns the listener inherited from a parent process under name,
+// if any, otherwise it listens on the given network and address.
+func listen(inherited map[string]net.Listener, name, network, address string) (net.Listener, error) {
+	if listener, ok := inherited[name]; ok {
+		delete(inherited, name)
+		return listener, nil
+	}
+	return net.Listen(network, address)
+}
 
-	// TODO graceful shutdown upon receiving interrupt
-	// - stop accepting new connections
-	// - wait for currently forwarded connections to terminate (hard cut off after timeout?)
-	// - stop healthcheck probes of upstreams (if applicable)
+// listenPacket returns the packet socket inherited under name, if any, or
+// else a new one bound to address.
+func listenPacket(inherited map[string]net.PacketConn, name, network, address string) (net.PacketConn, error) {
+	if conn, ok := inherited[name]; ok {
+		delete(inherited, name)
+		return conn, nil
+	}
+	return net.ListenPacket(network, address)
+}
 
-	logger.Info(&slog.LogRecord{Msg: fmt.Sprintf("listening on network: %s address: %s", cfg.ListenNetwork, cfg.ListenAddress)})
+// awaitPreDrain waits for delay before draining begins. A signal ends the
+// wait early.
+func awaitPreDrain(logger slog.Logger, delay time.Duration, signals <-chan os.Signal) {
+	if delay <= 0 {
+		return
+	}
+	logger.Info(&slog.LogRecord{Msg: "reporting not ready, waiting before draining", Details: delay.String()})
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case sig := <-signals:
+		logger.Warn(&slog.LogRecord{Msg: "received second signal, draining at once", Details: sig.String()})
+	}
+}
 
-	s := &forwarder.Server{
-		Logger:                      logger,
-		Handler:                     baseHandler,
-		Listener:                    listener,
-		AcceptErrorCooldownDuration: defaultAcceptErrorCooldownDuration,
+// shutdownServers drains servers together, waiting up to gracePeriod for
+// in-flight connections to finish. If the grace period expires, or another signal is
+// received, remaining connections are closed and errForcedShutdown is returned.
+//
+// If idleTable is not nil, its idle connections are closed at once, and as
+// others become idle, rather than holding up the drain while doing nothing.
+// If idleGrace is positive, idle connections are closed gracefully instead:
+// their clients are told the connection is closing, e.g. by a TLS
+// close_notify alert, so that they reconnect elsewhere, and the connections
+// are closed once idleGrace passes.
+func shutdownServers(logger slog.Logger, servers []*forwarder.Server, idleTable *conntable.Table, idleGrace, gracePeriod time.Duration, signals <-chan os.Signal) error {
+	ctx, cancel := context.WithTimeout(context.Background(), gracePeriod)
+	defer cancel()
+	go func() {
+		select {
+		case sig := <-signals:
+			logger.Warn(&slog.LogRecord{Msg: "received second signal, closing connections", Details: sig.String()})
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	if idleTable != nil {
+		go func() {
+			ticker := time.NewTicker(shutdownIdleCheckInterval)
+			defer ticker.Stop()
+			for {
+				if idleGrace > 0 {
+					if n := idleTable.DrainIdle(idleGrace); n > 0 {
+						logger.Info(&slog.LogRecord{Msg: "told idle connections to reconnect to drain", Details: n})
+					}
+				} else if n := idleTable.TerminateIdle(); n > 0 {
+					logger.Info(&slog.LogRecord{Msg: "closed idle connections to drain", Details: n})
+				}
+				select {
+				case <-ticker.C:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+
+	errs := make(chan error, len(servers))
+	for _, s := range servers {
+		s := s
+		go func() {
+			errs <- s.Shutdown(ctx)
+		}()
+	}
+	var err error
+	for range servers {
+		if e := <-errs; e != nil && err == nil {
+			err = e
+		}
+	}
+	if err == nil {
+		logger.Info(&slog.LogRecord{Msg: "drained all connections"})
+		return nil
+	}
+	logger.Warn(&slog.LogRecord{Msg: "shutdown grace period ended, closing connections", Error: err})
+	for _, s := range servers {
+		_ = s.Close()
 	}
-	return s.Serve()
+	return errForcedShutdown
 }
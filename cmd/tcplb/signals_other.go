@@ -0,0 +1,13 @@
+//go:build windows || plan9
+
+package main
+
+import "os"
+
+// upgradeSignals trigger a zero-downtime binary upgrade. Upgrades rely on
+// passing sockets between processes, which is unsupported on this platform.
+var upgradeSignals []os.Signal
+
+// reloadSignals trigger a reload of the IP filter rules file. There is no
+// conventional reload signal on this platform.
+var reloadSignals []os.Signal
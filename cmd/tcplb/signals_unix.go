@@ -0,0 +1,14 @@
+//go:build !windows && !plan9
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// upgradeSignals trigger a zero-downtime binary upgrade.
+var upgradeSignals = []os.Signal{syscall.SIGUSR2}
+
+// reloadSignals trigger a reload of the IP filter rules file.
+var reloadSignals = []os.Signal{syscall.SIGHUP}
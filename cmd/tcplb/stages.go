@@ -0,0 +1,272 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"tcplb/lib/accesslog"
+	"tcplb/lib/authn"
+	"tcplb/lib/core"
+	"tcplb/lib/dialer"
+	"tcplb/lib/forwarder"
+)
+
+// optionalStages are the stages that may be enabled and ordered by
+// Config.HandlerStages. They sit between the connection table and client
+// authentication, and each works in any order relative to the others.
+// Stages that also need other configuration, e.g. bans, are included only
+// if that is given too. The recover stage only recovers panics of the
+// stages inside it.
+var optionalStages = []string{forwarder.StageRecover, forwarder.StageIPFilter, forwarder.StageBan, forwarder.StageGeoIP, forwarder.StagePreAuthDeadline, forwarder.StageSniff, forwarder.StageFingerprint, forwarder.StageHandshakeLimit, forwarder.StageEarlyDial}
+
+// defaultHandlerStages are the optional stages enabled by default, from
+// outermost to innermost.
+var defaultHandlerStages = strings.Join(optionalStages, ",")
+
+// validateHandlerStages checks that stages are distinct optional stages.
+func validateHandlerStages(stages []string) error {
+	violations := &InvalidConfig{}
+	seen := make(map[string]bool, len(stages))
+	for _, name := range stages {
+		known := false
+		for _, s := range optionalStages {
+			known = known || s == name
+		}
+		if !known {
+			violations.addf("handler-stages", "unknown handler stage %q, expected one of %s", name, strings.Join(optionalStages, ", "))
+		}
+		if seen[name] {
+			violations.addf("handler-stages", "handler stage %q is given more than once", name)
+		}
+		seen[name] = true
+	}
+	return violations.err()
+}
+
+// stageEnabled reports if the optional stage name is enabled by cfg.
+func stageEnabled(cfg *Config, name string) bool {
+	for _, s := range cfg.HandlerStages {
+		if s == name {
+			return true
+		}
+	}
+	return false
+}
+
+// makeHandlerChain returns the chain of handler stages applied to client
+// connections accepted by the listener, from outermost to innermost.
+func makeHandlerChain(cfg *Config, lc *ListenerConfig, deps *handlerDeps, reserver forwarder.ClientReserver) (*forwarder.Chain, error) {
+	logger := deps.logger
+	chain, err := forwarder.NewChain(forwarder.Stage{Name: forwarder.StageClose, Middleware: func(inner forwarder.Handler) forwarder.Handler {
+		return &forwarder.ConnCloserHandler{Inner: inner}
+	}})
+	if err != nil {
+		return nil, err
+	}
+	var stages []forwarder.Stage
+	add := func(name string, m forwarder.Middleware) {
+		stages = append(stages, forwarder.Stage{Name: name, Middleware: m})
+	}
+
+	if deps.accessLogger != nil {
+		add(forwarder.StageAccessLog, func(inner forwarder.Handler) forwarder.Handler {
+			return &forwarder.AccessLogHandler{AccessLogger: deps.accessLogger, Inner: inner}
+		})
+	}
+	if deps.events != nil {
+		add(forwarder.StageEvents, func(inner forwarder.Handler) forwarder.Handler {
+			return &forwarder.EventPublishingHandler{Publisher: deps.events, Inner: inner}
+		})
+	}
+	add(forwarder.StageReasonMetrics, func(inner forwarder.Handler) forwarder.Handler {
+		return &forwarder.ReasonMetricsHandler{Metrics: deps.reasonMetrics, Rejections: deps.rejections, Inner: inner}
+	})
+	if deps.signaller != nil || cfg.DialFailFast || cfg.MaxConcurrentHandshakes > 0 {
+		add(forwarder.StageSignal, func(inner forwarder.Handler) forwarder.Handler {
+			signallingHandler := &forwarder.RejectionSignallingHandler{
+				Logger:     logger,
+				Signaller:  deps.signaller,
+				Signallers: make(map[accesslog.ReasonCode]forwarder.RejectionSignaller),
+				Inner:      inner,
+			}
+			if cfg.DialFailFast {
+				signallingHandler.Signallers[accesslog.ReasonDialFailed] = forwarder.ResetRejectionSignaller{}
+				signallingHandler.Signallers[accesslog.ReasonNoUpstream] = forwarder.ResetRejectionSignaller{}
+			}
+			if cfg.MaxConcurrentHandshakes > 0 {
+				// Writing a message would itself require the handshake that
+				// could not be afforded.
+				signallingHandler.Signallers[accesslog.ReasonHandshakeLimited] = forwarder.ResetRejectionSignaller{}
+			}
+			return signallingHandler
+		})
+	}
+	add(forwarder.StageConnTable, func(inner forwarder.Handler) forwarder.Handler {
+		return &forwarder.ConnTableHandler{Table: deps.table, Logger: deps.logger, Inner: inner}
+	})
+	if deps.memory != nil {
+		add(forwarder.StageMemoryShed, func(inner forwarder.Handler) forwarder.Handler {
+			return &forwarder.MemoryShedHandler{Signal: deps.memory, Dropped: deps.memoryDropped, Inner: inner}
+		})
+	}
+
+	for _, name := range cfg.HandlerStages {
+		switch name {
+		case forwarder.StageRecover:
+			add(name, func(inner forwarder.Handler) forwarder.Handler {
+				return &forwarder.RecoveringHandler{Logger: logger, Panics: deps.panics, Inner: inner}
+			})
+		case forwarder.StageIPFilter:
+			if deps.ipFilter != nil {
+				add(name, func(inner forwarder.Handler) forwarder.Handler {
+					return &forwarder.ConnFilterHandler{Filter: deps.ipFilter, Inner: inner}
+				})
+			}
+		case forwarder.StageBan:
+			if deps.bans != nil {
+				add(name, func(inner forwarder.Handler) forwarder.Handler {
+					return &forwarder.BanningHandler{Logger: logger, Banner: deps.bans, Tarpit: deps.tarpit, Inner: inner}
+				})
+			}
+		case forwarder.StageGeoIP:
+			if deps.locator != nil {
+				add(name, func(inner forwarder.Handler) forwarder.Handler {
+					return &forwarder.GeoIPHandler{Logger: logger, Locator: deps.locator, Policy: cfg.GeoIPPolicy, Inner: inner}
+				})
+			}
+		case forwarder.StagePreAuthDeadline:
+			add(name, func(inner forwarder.Handler) forwarder.Handler {
+				return &forwarder.PreAuthDeadlineHandler{Logger: logger, Budget: cfg.PreAuthTimeout, Inner: inner}
+			})
+		case forwarder.StageSniff:
+			if cfg.SniffTimeout > 0 || cfg.MaxClientHelloSize > 0 {
+				add(name, func(inner forwarder.Handler) forwarder.Handler {
+					return &forwarder.SniffingHandler{
+						Logger:             logger,
+						Timeout:            cfg.SniffTimeout,
+						MaxClientHelloSize: cfg.MaxClientHelloSize,
+						Metrics:            deps.sniffMetrics,
+						Inner:              inner,
+					}
+				})
+			}
+		case forwarder.StageFingerprint:
+			if cfg.TLSFingerprint || len(cfg.TLSFingerprintDeny) > 0 || len(cfg.UpstreamGroupFingerprints) > 0 {
+				denied := make(map[string]bool, len(cfg.TLSFingerprintDeny))
+				for _, fingerprint := range cfg.TLSFingerprintDeny {
+					fingerprint, _ = forwarder.ParseFingerprint(cfg.TLSFingerprintMethod, fingerprint)
+					denied[fingerprint] = true
+				}
+				add(name, func(inner forwarder.Handler) forwarder.Handler {
+					return &forwarder.FingerprintingHandler{
+						Logger:  logger,
+						Timeout: cfg.SniffTimeout,
+						Method:  cfg.TLSFingerprintMethod,
+						Denied:  denied,
+						Metrics: deps.fingerprintMetrics,
+						Inner:   inner,
+					}
+				})
+			}
+		case forwarder.StageHandshakeLimit:
+			add(name, func(inner forwarder.Handler) forwarder.Handler {
+				return &forwarder.HandshakeLimitingHandler{
+					Logger:        logger,
+					MaxConcurrent: cfg.MaxConcurrentHandshakes,
+					QueueTimeout:  cfg.HandshakeQueueTimeout,
+					Timeout:       cfg.HandshakeTimeout,
+					Metrics:       deps.handshakeMetrics,
+					RateLimiter:   deps.handshakeRates,
+					StartLimiter:  deps.handshakeStarts,
+					Inner:         inner,
+				}
+			})
+		case forwarder.StageEarlyDial:
+			if cfg.EarlyDial {
+				add(name, func(inner forwarder.Handler) forwarder.Handler {
+					return &forwarder.EarlyDialHandler{Router: deps.router, Pools: deps.pools, Inner: inner}
+				})
+			}
+		default:
+			return nil, fmt.Errorf("unknown handler stage %q", name)
+		}
+	}
+
+	switch lc.Authn {
+	case authnModeAnonymous:
+		add(forwarder.StageAuthn, func(inner forwarder.Handler) forwarder.Handler {
+			return &forwarder.AnonymousAuthenticationHandler{Logger: logger, Anonymous: anonymousTestClientID, Inner: inner}
+		})
+	case authnModeMTLS:
+		add(forwarder.StageAuthn, func(inner forwarder.Handler) forwarder.Handler {
+			return &forwarder.MTLSAuthenticationHandler{Logger: logger, Inner: inner}
+		})
+	case authnModeOptionalMTLS:
+		add(forwarder.StageAuthn, func(inner forwarder.Handler) forwarder.Handler {
+			return &forwarder.MTLSAuthenticationHandler{Logger: logger, Unauthenticated: &authn.Unauthenticated, Inner: inner}
+		})
+	default:
+		return nil, fmt.Errorf("listener %q: unknown authn mode %q", lc.Name, lc.Authn)
+	}
+	if deps.shedder != nil {
+		add(forwarder.StagePriority, func(inner forwarder.Handler) forwarder.Handler {
+			return &forwarder.PrioritizingHandler{Logger: logger, Shedder: deps.shedder, Classes: deps.priorityClasses, Metrics: deps.shedMetrics, Inner: inner}
+		})
+	}
+	if deps.quotas != nil {
+		add(forwarder.StageQuota, func(inner forwarder.Handler) forwarder.Handler {
+			return &forwarder.QuotaHandler{Logger: logger, Accountant: deps.quotas, Interval: quotaRecordInterval, Exemptions: deps.exemptions, Inner: inner}
+		})
+	}
+	add(forwarder.StageRoute, func(inner forwarder.Handler) forwarder.Handler {
+		routingHandler := &forwarder.RoutingHandler{
+			Logger: logger,
+			Router: deps.router,
+			Pools:  deps.pools,
+			Inner:  inner,
+		}
+		if groups, ok := deps.authorizer.(forwarder.GroupResolver); ok {
+			routingHandler.Groups = groups
+		}
+		return routingHandler
+	})
+	add(forwarder.StageRateLimit, func(inner forwarder.Handler) forwarder.Handler {
+		return &forwarder.RateLimitingHandler{
+			Logger:   logger,
+			Reserver: reserver,
+			Inner:    inner,
+			// Renew leases several times per TTL, so that a late renewal does
+			// not let the lease of a live connection lapse.
+			RenewInterval: cfg.ReservationLeaseTTL / 3,
+			Exemptions:    deps.exemptions,
+		}
+	})
+	add(forwarder.StageAuthz, func(inner forwarder.Handler) forwarder.Handler {
+		return &forwarder.AuthorizedUpstreamsHandler{Logger: logger, Authorizer: deps.authorizer, Denied: deps.denied, Inner: inner}
+	})
+	if lc.Frontend == frontendSOCKS5 {
+		add(forwarder.StageSOCKS5, func(inner forwarder.Handler) forwarder.Handler {
+			return &forwarder.SOCKS5Handler{Logger: logger, Inner: inner}
+		})
+	}
+	if cfg.MirrorAddress != "" {
+		// The mirror is sent only the data of authorized clients, after any
+		// SOCKS5 request.
+		mirror := core.Upstream{Network: "tcp", Address: cfg.MirrorAddress}
+		add(forwarder.StageMirror, func(inner forwarder.Handler) forwarder.Handler {
+			return &forwarder.MirroringHandler{
+				Logger:      logger,
+				Dialer:      &dialer.TimeoutDialer{Timeout: cfg.DialTimeout},
+				Mirror:      mirror,
+				MaxBuffered: cfg.MirrorMaxBuffered,
+				Timeout:     mirrorTimeout,
+				Metrics:     deps.mirrorMetrics,
+				Inner:       inner,
+			}
+		})
+	}
+
+	if err := chain.Append(stages...); err != nil {
+		return nil, err
+	}
+	return chain, nil
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"sort"
+	"tcplb/lib/core"
+)
+
+// startupReport summarizes the effective security posture and limits of
+// the server once its listeners are bound, so that operators can confirm
+// at a glance what a process is running with. It is logged once at startup
+// and served by the admin endpoints.
+type startupReport struct {
+	ConfigHash string            `json:"config_hash"`
+	AuthzHash  string            `json:"authz_hash"`
+	Listeners  []listenerReport  `json:"listeners"`
+	Pools      []poolReport      `json:"pools"`
+	Limits     startupLimits     `json:"limits"`
+	Stages     []string          `json:"handler_stages"`
+	Authz      startupAuthzStats `json:"authz"`
+}
+
+// listenerReport describes a bound listener.
+type listenerReport struct {
+	Name        string   `json:"name"`
+	Network     string   `json:"network"`
+	Address     string   `json:"address"` // Address is the bound address, which may differ from the configured one, e.g. in its port.
+	Pool        string   `json:"pool,omitempty"`
+	Authn       string   `json:"authn"`
+	Frontend    string   `json:"frontend"`
+	TLS         bool     `json:"tls"`
+	TLSVersions []string `json:"tls_versions,omitempty"`
+	ALPN        []string `json:"alpn,omitempty"`
+	ClientAuth  string   `json:"client_auth,omitempty"`
+}
+
+// poolReport describes an upstream pool.
+type poolReport struct {
+	Name          string `json:"name"`
+	Upstreams     int    `json:"upstreams"`
+	Policy        string `json:"policy"`
+	TLS           bool   `json:"tls"`
+	TLSVerify     string `json:"tls_verify,omitempty"` // TLSVerify is how upstream certificates are verified, if TLS is used.
+	ProxyProtocol string `json:"proxy_protocol"`
+}
+
+// startupLimits are the limits on client connections and TLS handshakes.
+// Zero means no limit.
+type startupLimits struct {
+	MaxConnections          int     `json:"max_connections"`
+	MaxConnectionsPerClient int64   `json:"max_connections_per_client"`
+	MaxConcurrentClients    int64   `json:"max_concurrent_clients"`
+	BudgetWarningFraction   float64 `json:"budget_warning_fraction"`
+	MaxHandlers             int     `json:"max_handlers"`
+	MaxConcurrentHandshakes int     `json:"max_concurrent_handshakes"`
+	HandshakeRate           float64 `json:"handshake_rate"`
+	HandshakeStartRate      float64 `json:"handshake_start_rate"`
+	QuotaWindows            int     `json:"quota_windows"`
+	IdleTimeout             string  `json:"idle_timeout"`
+	MaxConnectionDuration   string  `json:"max_connection_duration"`
+	HalfOpenTimeout         string  `json:"half_open_timeout"`
+	SlowConsumerTimeout     string  `json:"slow_consumer_timeout"`
+	SlowConsumerPolicy      string  `json:"slow_consumer_policy"`
+	UpstreamBandwidth       int64   `json:"upstream_bandwidth"`
+	PreAuthTimeout          string  `json:"pre_auth_timeout"`
+	BanThreshold            int     `json:"ban_threshold"`
+	MaxDeniedConnsPerClient int     `json:"max_denied_conns_per_client"`
+	GCPercent               int     `json:"gc_percent"`
+	MemoryLimit             int64   `json:"memory_limit"`
+	MemoryShedThreshold     int64   `json:"memory_shed_threshold"`
+}
+
+// startupAuthzStats counts the authorization policy hashed by AuthzHash.
+type startupAuthzStats struct {
+	UpstreamGroups    int `json:"upstream_groups"`
+	AuthorizedClients int `json:"authorized_clients"`
+}
+
+// newListenerReport returns the report of the listener lc, bound to addr,
+// serving TLS with tlsConfig, or plain TCP if it is nil.
+func newListenerReport(lc *ListenerConfig, addr net.Addr, tlsConfig *tls.Config) listenerReport {
+	r := listenerReport{
+		Name:     lc.Name,
+		Network:  lc.Network,
+		Address:  addr.String(),
+		Pool:     lc.Pool,
+		Authn:    lc.Authn,
+		Frontend: lc.Frontend,
+	}
+	if tlsConfig == nil {
+		return r
+	}
+	r.TLS = true
+	r.TLSVersions = tlsVersionNames(tlsConfig)
+	r.ALPN = tlsConfig.NextProtos
+	switch tlsConfig.ClientAuth {
+	case tls.RequireAndVerifyClientCert:
+		r.ClientAuth = "required"
+	case tls.VerifyClientCertIfGiven:
+		r.ClientAuth = "optional"
+	default:
+		r.ClientAuth = "none"
+	}
+	return r
+}
+
+// tlsVersions are the TLS versions that tlsVersionNames reports, from
+// oldest to newest.
+var tlsVersions = []struct {
+	version uint16
+	name    string
+}{
+	{tls.VersionTLS10, "TLS 1.0"},
+	{tls.VersionTLS11, "TLS 1.1"},
+	{tls.VersionTLS12, "TLS 1.2"},
+	{tls.VersionTLS13, "TLS 1.3"},
+}
+
+// tlsVersionNames returns the names of the TLS versions that config
+// accepts, where zero bounds are taken to be the oldest and newest
+// versions.
+func tlsVersionNames(config *tls.Config) []string {
+	min, max := config.MinVersion, config.MaxVersion
+	if min == 0 {
+		min = tls.VersionTLS10
+	}
+	if max == 0 {
+		max = tls.VersionTLS13
+	}
+	var names []string
+	for _, v := range tlsVersions {
+		if v.version >= min && v.version <= max {
+			names = append(names, v.name)
+		}
+	}
+	return names
+}
+
+// newStartupReport returns the startup report of cfg, whose effective
+// configuration hash is configHash, and which has bound the given
+// listeners.
+func newStartupReport(cfg *Config, configHash string, listeners []listenerReport) *startupReport {
+	r := &startupReport{
+		ConfigHash: configHash,
+		AuthzHash:  authzHash(cfg),
+		Listeners:  listeners,
+		Pools:      make([]poolReport, 0, len(cfg.Pools)),
+		Limits: startupLimits{
+			MaxConnections:          cfg.MaxConnections,
+			MaxConnectionsPerClient: cfg.MaxConnectionsPerClient,
+			MaxConcurrentClients:    cfg.MaxConcurrentClients,
+			BudgetWarningFraction:   cfg.BudgetWarningFraction,
+			MaxHandlers:             cfg.MaxHandlers,
+			MaxConcurrentHandshakes: cfg.MaxConcurrentHandshakes,
+			HandshakeRate:           cfg.HandshakeRate,
+			HandshakeStartRate:      cfg.HandshakeStartRate,
+			QuotaWindows:            len(cfg.Quotas),
+			IdleTimeout:             cfg.IdleTimeout.String(),
+			MaxConnectionDuration:   cfg.MaxConnectionDuration.String(),
+			HalfOpenTimeout:         cfg.HalfOpenTimeout.String(),
+			SlowConsumerTimeout:     cfg.SlowConsumerTimeout.String(),
+			SlowConsumerPolicy:      cfg.SlowConsumerPolicy,
+			UpstreamBandwidth:       cfg.UpstreamBandwidth,
+			PreAuthTimeout:          cfg.PreAuthTimeout.String(),
+			BanThreshold:            cfg.BanThreshold,
+			MaxDeniedConnsPerClient: cfg.MaxDeniedConnsPerClient,
+			GCPercent:               cfg.GCPercent,
+			MemoryLimit:             cfg.MemoryLimit,
+			MemoryShedThreshold:     cfg.MemoryShedThreshold,
+		},
+		Stages: cfg.HandlerStages,
+		Authz: startupAuthzStats{
+			UpstreamGroups:    len(cfg.UpstreamGroups),
+			AuthorizedClients: len(cfg.AuthorizedClients),
+		},
+	}
+	for _, pc := range cfg.Pools {
+		pr := poolReport{
+			Name:          pc.Name,
+			Upstreams:     len(pc.Upstreams),
+			Policy:        pc.Policy,
+			TLS:           pc.TLS.Enabled,
+			ProxyProtocol: pc.ProxyProtocol,
+		}
+		if pc.TLS.Enabled {
+			pr.TLSVerify = pc.TLS.Verify
+		}
+		r.Pools = append(r.Pools, pr)
+	}
+	return r
+}
+
+// authzHash returns a canonical hash of the authorization policy of cfg:
+// the upstream groups, the upstreams of the reserved group of all
+// upstreams, and the grants of each client. Equal policies have equal
+// hashes, however their flags were ordered.
+func authzHash(cfg *Config) string {
+	h := sha256.New()
+	for _, u := range allUpstreams(cfg.Pools).Sorted() {
+		fmt.Fprintf(h, "upstream %s %s\n", u.Network, u.Address)
+	}
+	groups := make([]string, 0, len(cfg.UpstreamGroups))
+	for _, g := range cfg.UpstreamGroups {
+		members := core.NewUpstreamSet(g.Upstreams...)
+		groups = append(groups, fmt.Sprintf("group %q %v", g.Name, members.Sorted()))
+	}
+	sort.Strings(groups)
+	grants := make([]string, 0, len(cfg.AuthorizedClients))
+	for _, grant := range cfg.AuthorizedClients {
+		names := append([]string(nil), grant.Groups...)
+		sort.Strings(names)
+		grants = append(grants, fmt.Sprintf("client %q %v", grant.ClientID.String(), names))
+	}
+	sort.Strings(grants)
+	for _, line := range append(groups, grants...) {
+		fmt.Fprintln(h, line)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ConfigViolation is one way in which a Config is invalid.
+type ConfigViolation struct {
+	Field string // Field is the path of the offending setting, named after its flag, e.g. "pool[web].dial-timeout".
+	Err   error
+}
+
+func (v *ConfigViolation) Error() string {
+	return v.Field + ": " + v.Err.Error()
+}
+
+func (v *ConfigViolation) Unwrap() error {
+	return v.Err
+}
+
+// InvalidConfig is the error returned by Config.Validate. It lists every
+// violation found, rather than only the first, so that operators can fix
+// them all before restarting.
+type InvalidConfig struct {
+	Violations []*ConfigViolation
+}
+
+func (e *InvalidConfig) Error() string {
+	msgs := make([]string, len(e.Violations))
+	for i, v := range e.Violations {
+		msgs[i] = v.Error()
+	}
+	return fmt.Sprintf("%d configuration violation(s): %s", len(e.Violations), strings.Join(msgs, "; "))
+}
+
+// Unwrap returns the violations, following the multi-error convention of
+// errors.Join.
+func (e *InvalidConfig) Unwrap() []error {
+	errs := make([]error, len(e.Violations))
+	for i, v := range e.Violations {
+		errs[i] = v
+	}
+	return errs
+}
+
+// Is reports if any violation matches target. Like the AggregateError of
+// tcplb/lib/errors, it lets errors.Is inspect violations when built with Go
+// versions before 1.20.
+func (e *InvalidConfig) Is(target error) bool {
+	for _, v := range e.Violations {
+		if errors.Is(v, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// add records that field is invalid because of err, unless err is nil. If
+// err is an *InvalidConfig, its violations are added, beneath field.
+func (e *InvalidConfig) add(field string, err error) {
+	if err == nil {
+		return
+	}
+	var nested *InvalidConfig
+	if !errors.As(err, &nested) {
+		e.Violations = append(e.Violations, &ConfigViolation{Field: field, Err: err})
+		return
+	}
+	for _, v := range nested.Violations {
+		e.Violations = append(e.Violations, &ConfigViolation{Field: joinFieldPath(field, v.Field), Err: v.Err})
+	}
+}
+
+// addf records that field is invalid, for the reason given by format and
+// args, as by fmt.Errorf.
+func (e *InvalidConfig) addf(field, format string, args ...any) {
+	e.add(field, fmt.Errorf(format, args...))
+}
+
+// err returns e if any violation was recorded, or nil otherwise.
+func (e *InvalidConfig) err() error {
+	if len(e.Violations) == 0 {
+		return nil
+	}
+	return e
+}
+
+// joinFieldPath returns the path of field within parent.
+func joinFieldPath(parent, field string) string {
+	switch {
+	case parent == "":
+		return field
+	case field == "":
+		return parent
+	default:
+		return parent + "." + field
+	}
+}
+
+// indexedField returns the path of an element of a repeated setting, e.g.
+// "pool[web]", identified by its name if it has one, or its index.
+func indexedField(field, name string, index int) string {
+	if name == "" {
+		return fmt.Sprintf("%s[%d]", field, index)
+	}
+	return fmt.Sprintf("%s[%s]", field, name)
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"tcplb/lib/admin"
+	"tcplb/lib/healthcheck"
+	"tcplb/lib/slog"
+)
+
+// errWarmupFailed is returned by serve if too few upstreams are reachable at
+// startup, and the server is configured to exit rather than report unready.
+var errWarmupFailed = errors.New("too few upstreams reachable at startup")
+
+// warmUpstreams probes every upstream once, recording the results in the
+// tracker of prober, and returns the number of upstreams that are reachable.
+func warmUpstreams(ctx context.Context, logger slog.Logger, cfg *Config, prober *healthcheck.OnDemandProber) int {
+	reachable := 0
+	for _, report := range prober.ProbeUpstreams(ctx, allUpstreams(cfg.Pools).Sorted()) {
+		if report.Result == healthcheck.CheckPass {
+			reachable++
+			continue
+		}
+		logger.Warn(&slog.LogRecord{Msg: "warm-up: upstream unreachable", Upstream: &report.Upstream, Error: report.Symptom})
+	}
+	return reachable
+}
+
+// warmUpFromConfig probes every upstream once, if warm-up is configured, and
+// returns the readiness checks that must pass before the server reports
+// ready. If too few upstreams are reachable, and the server is configured
+// to exit then, errWarmupFailed is returned.
+func warmUpFromConfig(cfg *Config, logger slog.Logger, tracker *healthcheck.Tracker, prober *healthcheck.OnDemandProber) ([]admin.ReadinessCheck, error) {
+	if cfg.WarmupMinReachable <= 0 {
+		return nil, nil
+	}
+	reachable := warmUpstreams(context.Background(), logger, cfg, prober)
+	if reachable < cfg.WarmupMinReachable {
+		if cfg.WarmupExit {
+			logger.Error(&slog.LogRecord{Msg: fmt.Sprintf("warm-up: %d reachable upstreams, need at least %d", reachable, cfg.WarmupMinReachable)})
+			return nil, errWarmupFailed
+		}
+		logger.Warn(&slog.LogRecord{Msg: fmt.Sprintf("warm-up: %d reachable upstreams, need at least %d. not ready until enough are healthy", reachable, cfg.WarmupMinReachable)})
+	}
+	return []admin.ReadinessCheck{makeWarmupReadinessCheck(cfg, tracker, reachable)}, nil
+}
+
+// makeWarmupReadinessCheck returns a ReadinessCheck that fails until
+// cfg.WarmupMinReachable upstreams are known to be reachable,
+// either because they were at startup, or because they have since been
+// believed healthy, e.g. after operators re-probe them. Once passed, the
+// check passes for good: it guards startup only.
+func makeWarmupReadinessCheck(cfg *Config, tracker *healthcheck.Tracker, reachable int) admin.ReadinessCheck {
+	var passed int32
+	if reachable >= cfg.WarmupMinReachable {
+		passed = 1
+	}
+	return func() error {
+		if atomic.LoadInt32(&passed) == 1 {
+			return nil
+		}
+		n := tracker.CountHealthy()
+		if n < cfg.WarmupMinReachable {
+			return fmt.Errorf("warm-up: %d reachable upstreams, need at least %d", n, cfg.WarmupMinReachable)
+		}
+		atomic.StoreInt32(&passed, 1)
+		return nil
+	}
+}
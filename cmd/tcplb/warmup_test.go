@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"github.com/stretchr/testify/require"
+	"net"
+	"tcplb/lib/core"
+	"tcplb/lib/healthcheck"
+	"tcplb/lib/slog"
+	"testing"
+	"time"
+)
+
+func TestWarmup(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	require.NoError(t, closed.Close())
+	down := core.Upstream{Network: "tcp", Address: closed.Addr().String()}
+
+	cfg, err := newConfigFromFlags([]string{
+		commandName,
+		"-upstreams", listener.Addr().String() + "," + closed.Addr().String(),
+		"-warmup-min-reachable-upstreams", "2",
+	})
+	require.NoError(t, err)
+	require.NoError(t, cfg.Validate())
+	tracker, _, err := makeHealthTrackerFromConfig(cfg, nil)
+	require.NoError(t, err)
+
+	logger := &slog.RecordingLogger{}
+	reachable := warmUpstreams(context.Background(), logger, cfg, makeOnDemandProberFromConfig(cfg, nil, tracker))
+	require.Equal(t, 1, reachable)
+	check := makeWarmupReadinessCheck(cfg, tracker, reachable)
+	require.ErrorContains(t, check(), "1 reachable upstreams, need at least 2")
+
+	// Once enough upstreams are healthy, the check passes for good.
+	tracker.ReportHealth(healthcheck.HealthReport{Upstream: down, Result: healthcheck.CheckPass, Time: time.Now()})
+	require.NoError(t, check())
+	for i := 0; i < 2; i++ {
+		tracker.ReportHealth(healthcheck.HealthReport{Upstream: down, Result: healthcheck.CheckFail, Time: time.Now()})
+	}
+	require.NoError(t, check())
+
+	cfg.WarmupMinReachable = 3
+	require.Error(t, cfg.Validate())
+}
+
+func TestWarmUpFromConfig(t *testing.T) {
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	require.NoError(t, closed.Close())
+	cfg, err := newConfigFromFlags([]string{commandName, "-upstreams", closed.Addr().String()})
+	require.NoError(t, err)
+	tracker, _, err := makeHealthTrackerFromConfig(cfg, nil)
+	require.NoError(t, err)
+	prober := makeOnDemandProberFromConfig(cfg, nil, tracker)
+	checks, err := warmUpFromConfig(cfg, &slog.RecordingLogger{}, tracker, prober)
+	require.NoError(t, err)
+	require.Empty(t, checks)
+
+	// Too few upstreams are reachable, so the server is not ready.
+	cfg.WarmupMinReachable = 1
+	checks, err = warmUpFromConfig(cfg, &slog.RecordingLogger{}, tracker, prober)
+	require.NoError(t, err)
+	require.Len(t, checks, 1)
+	require.Error(t, checks[0]())
+
+	// Unless it is to exit instead.
+	cfg.WarmupExit = true
+	_, err = warmUpFromConfig(cfg, &slog.RecordingLogger{}, tracker, prober)
+	require.ErrorIs(t, err, errWarmupFailed)
+}
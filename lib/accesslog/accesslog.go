@@ -0,0 +1,401 @@
+// Package accesslog emits one structured record per completed client
+// connection, for consumers interested in per-connection accounting
+// (who connected, where they were forwarded, how much data was moved,
+// and why the connection ended). It is deliberately separate from
+// the operational log messages written via package slog.
+//
+// Handlers record details of a connection as it moves through the handler
+// stack by updating the Record stored in the connection's context. As with
+// package trace, all methods of a nil *Record are no-ops, so handlers need
+// not check whether access logging is enabled.
+package accesslog
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"sync"
+	"tcplb/lib/core"
+	"time"
+)
+
+// ReasonCode identifies why a connection was terminated. It is
+// core.ReasonCode, so that packages that log reasons need not depend on
+// this package.
+type ReasonCode = core.ReasonCode
+
+// Termination reasons recorded against connections. Every handler that
+// ends a connection records one, so that connections can be aggregated by
+// why they ended.
+const (
+	ReasonForwarded            ReasonCode = "forwarded"              // ReasonForwarded means forwarding completed normally.
+	ReasonForwardError         ReasonCode = "forward_error"          // ReasonForwardError means forwarding terminated with an error.
+	ReasonAuthnFailed          ReasonCode = "authn_failed"           // ReasonAuthnFailed means the client could not be authenticated.
+	ReasonRateLimited          ReasonCode = "rate_limited"           // ReasonRateLimited means the client exceeded its connection limit.
+	ReasonReserverOverloaded   ReasonCode = "reserver_overloaded"    // ReasonReserverOverloaded means too many distinct clients held connections to admit another.
+	ReasonNotAuthorized        ReasonCode = "not_authorized"         // ReasonNotAuthorized means the client is not authorized for any upstream.
+	ReasonDialFailed           ReasonCode = "dial_failed"            // ReasonDialFailed means no upstream could be dialed.
+	ReasonNoUpstream           ReasonCode = "no_upstream_available"  // ReasonNoUpstream means no upstream was available to dial, e.g. all were drained.
+	ReasonInternalError        ReasonCode = "internal_error"         // ReasonInternalError means the server encountered an internal error.
+	ReasonTerminated           ReasonCode = "terminated"             // ReasonTerminated means an operator terminated the connection.
+	ReasonAdminEvicted         ReasonCode = "admin_evicted"          // ReasonAdminEvicted means an operator evicted the client, e.g. as its key was compromised.
+	ReasonDrained              ReasonCode = "drained"                // ReasonDrained means the connection was idle as the server drained, so the client was told to reconnect.
+	ReasonNoRoute              ReasonCode = "no_route"               // ReasonNoRoute means no routing rule selected a pool for the connection.
+	ReasonBanned               ReasonCode = "banned"                 // ReasonBanned means the client's source address is banned after repeated failures.
+	ReasonFiltered             ReasonCode = "filtered"               // ReasonFiltered means the client's source address is not allowed by the IP filter.
+	ReasonGeoDenied            ReasonCode = "geo_denied"             // ReasonGeoDenied means the client's country or autonomous system is not served.
+	ReasonHandshakeLimited     ReasonCode = "handshake_limited"      // ReasonHandshakeLimited means too many TLS handshakes were in progress to start another.
+	ReasonHandshakeRateLimited ReasonCode = "handshake_rate_limited" // ReasonHandshakeRateLimited means the budget for TLS handshakes of the client's kind, full or resumed, was spent.
+	ReasonHandshakeThrottled   ReasonCode = "handshake_throttled"    // ReasonHandshakeThrottled means TLS handshakes were starting faster than the server-wide rate allows, so the connection was dropped before its handshake.
+	ReasonPreAuthTimeout       ReasonCode = "pre_auth_timeout"       // ReasonPreAuthTimeout means the connection was not forwarded within the pre-authentication budget.
+	ReasonQuotaExceeded        ReasonCode = "quota_exceeded"         // ReasonQuotaExceeded means the client used up a hard limit of its usage quota.
+	ReasonNotTLS               ReasonCode = "not_tls"                // ReasonNotTLS means the client's first bytes were not a TLS ClientHello, or did not arrive in time.
+	ReasonFingerprintDenied    ReasonCode = "fingerprint_denied"     // ReasonFingerprintDenied means the fingerprint of the client's TLS ClientHello is denied.
+	ReasonSOCKSError           ReasonCode = "socks_error"            // ReasonSOCKSError means the client did not send a SOCKS5 CONNECT request that could be served.
+	ReasonOverloaded           ReasonCode = "overloaded"             // ReasonOverloaded means the server was at capacity or overloaded, and the client's priority too low to admit it.
+	ReasonShed                 ReasonCode = "shed"                   // ReasonShed means the connection was dropped to admit a connection of higher priority.
+	ReasonMemoryPressure       ReasonCode = "memory_pressure"        // ReasonMemoryPressure means the server's heap exceeded its threshold, so no new connections were taken on.
+	ReasonIdleTimeout          ReasonCode = "idle_timeout"           // ReasonIdleTimeout means no data was forwarded in either direction within the idle timeout.
+	ReasonMaxDuration          ReasonCode = "max_duration"           // ReasonMaxDuration means the connection was forwarded for the longest time allowed.
+	ReasonHalfOpenTimeout      ReasonCode = "half_open_timeout"      // ReasonHalfOpenTimeout means one side closed its end, and the other did not finish within the half-open timeout.
+	ReasonSlowConsumer         ReasonCode = "slow_consumer"          // ReasonSlowConsumer means the client or upstream did not take data as fast as the other sent it, so forwarding stopped.
+	ReasonUpstreamReset        ReasonCode = "upstream_reset"         // ReasonUpstreamReset means the upstream reset the connection, so the client's connection was reset too.
+	ReasonUnknown              ReasonCode = "unknown"                // ReasonUnknown means no handler recorded a reason.
+)
+
+// ReasonCodes are all the termination reasons, in the order defined.
+var ReasonCodes = []ReasonCode{
+	ReasonForwarded,
+	ReasonForwardError,
+	ReasonAuthnFailed,
+	ReasonRateLimited,
+	ReasonReserverOverloaded,
+	ReasonNotAuthorized,
+	ReasonDialFailed,
+	ReasonNoUpstream,
+	ReasonInternalError,
+	ReasonTerminated,
+	ReasonAdminEvicted,
+	ReasonDrained,
+	ReasonNoRoute,
+	ReasonBanned,
+	ReasonFiltered,
+	ReasonGeoDenied,
+	ReasonHandshakeLimited,
+	ReasonHandshakeRateLimited,
+	ReasonHandshakeThrottled,
+	ReasonPreAuthTimeout,
+	ReasonQuotaExceeded,
+	ReasonNotTLS,
+	ReasonFingerprintDenied,
+	ReasonSOCKSError,
+	ReasonOverloaded,
+	ReasonShed,
+	ReasonMemoryPressure,
+	ReasonIdleTimeout,
+	ReasonMaxDuration,
+	ReasonHalfOpenTimeout,
+	ReasonSlowConsumer,
+	ReasonUpstreamReset,
+	ReasonUnknown,
+}
+
+// Record holds the access log data for a single client connection.
+//
+// Multiple goroutines may invoke methods on a Record simultaneously.
+type Record struct {
+	mu      sync.Mutex
+	payload recordPayload
+	start   time.Time
+}
+
+type recordPayload struct {
+	Time            string         `json:"time"`                      // Time is when the connection ended, RFC3339.
+	SourceAddr      string         `json:"source_addr,omitempty"`     // SourceAddr is the client's remote address.
+	LocalAddr       string         `json:"local_addr,omitempty"`      // LocalAddr is the address the client connected to, if known.
+	TCPOptions      []string       `json:"tcp_options,omitempty"`     // TCPOptions are the TCP options negotiated with the client, if known.
+	SNI             string         `json:"sni,omitempty"`             // SNI is the TLS server name requested by the client.
+	Country         string         `json:"country,omitempty"`         // Country is the client's ISO 3166-1 alpha-2 country code, if known.
+	ASN             uint32         `json:"asn,omitempty"`             // ASN is the client's autonomous system number, if known.
+	HandshakeError  string         `json:"handshake_error,omitempty"` // HandshakeError is the class of TLS handshake failure, if the handshake failed.
+	TLSFingerprint  string         `json:"tls_fingerprint,omitempty"` // TLSFingerprint is the JA3 or JA4 fingerprint of the client's TLS ClientHello, if computed.
+	ClientID        *core.ClientID `json:"clientid,omitempty"`        // ClientID is the authenticated client, if known.
+	Pool            string         `json:"pool,omitempty"`            // Pool is the upstream pool the connection was routed to, if any.
+	Upstream        *core.Upstream `json:"upstream,omitempty"`        // Upstream is the upstream forwarded to, if any.
+	UpstreamLabels  core.Labels    `json:"upstream_labels,omitempty"` // UpstreamLabels are the labels of the upstream, if any.
+	BytesFromClient int64          `json:"bytes_from_client"`         // BytesFromClient is the number of bytes forwarded client->upstream.
+	BytesToClient   int64          `json:"bytes_to_client"`           // BytesToClient is the number of bytes forwarded upstream->client.
+	DurationMillis  int64          `json:"duration_ms"`               // DurationMillis is the lifetime of the connection.
+	Reason          ReasonCode     `json:"reason"`                    // Reason is why the connection was terminated.
+}
+
+// NewRecord returns a new Record for a connection from sourceAddr
+// accepted at the given start time.
+func NewRecord(sourceAddr string, start time.Time) *Record {
+	return &Record{
+		payload: recordPayload{SourceAddr: sourceAddr},
+		start:   start,
+	}
+}
+
+// SetClientID records the authenticated ClientID of the connection.
+func (r *Record) SetClientID(c core.ClientID) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.payload.ClientID = &c
+}
+
+// SetSocket records the local address that the client connected to, and
+// the TCP options negotiated with it.
+func (r *Record) SetSocket(localAddr string, tcpOptions []string) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.payload.LocalAddr = localAddr
+	r.payload.TCPOptions = tcpOptions
+}
+
+// SetSNI records the TLS server name requested by the client.
+func (r *Record) SetSNI(sni string) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.payload.SNI = sni
+}
+
+// SetLocation records the country code and autonomous system number of
+// the client's address. Either may be zero if unknown.
+func (r *Record) SetLocation(country string, asn uint32) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.payload.Country = country
+	r.payload.ASN = asn
+}
+
+// SetHandshakeError records the class of failure of the client's TLS
+// handshake.
+func (r *Record) SetHandshakeError(class string) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.payload.HandshakeError = class
+}
+
+// HandshakeError returns the class of failure of the client's TLS
+// handshake recorded so far, or the empty string if there is none.
+func (r *Record) HandshakeError() string {
+	if r == nil {
+		return ""
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.payload.HandshakeError
+}
+
+// SetTLSFingerprint records the JA3 or JA4 fingerprint of the client's TLS
+// ClientHello.
+func (r *Record) SetTLSFingerprint(fingerprint string) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.payload.TLSFingerprint = fingerprint
+}
+
+// SetPool records the name of the upstream pool the connection was routed to.
+func (r *Record) SetPool(pool string) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.payload.Pool = pool
+}
+
+// SetUpstream records the upstream the connection was forwarded to.
+func (r *Record) SetUpstream(u core.Upstream) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.payload.Upstream = &u
+}
+
+// SetUpstreamLabels records the labels of the upstream the connection was forwarded to.
+func (r *Record) SetUpstreamLabels(labels core.Labels) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.payload.UpstreamLabels = labels
+}
+
+// SetReason records why the connection was terminated. Only the first
+// reason set is kept, as it is closest to the root cause.
+func (r *Record) SetReason(reason ReasonCode) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.payload.Reason == "" {
+		r.payload.Reason = reason
+	}
+}
+
+// Reason returns the termination reason recorded so far, or the empty
+// string if there is none.
+func (r *Record) Reason() ReasonCode {
+	if r == nil {
+		return ""
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.payload.Reason
+}
+
+// AddBytesFromClient increments the count of bytes forwarded from the client.
+func (r *Record) AddBytesFromClient(n int64) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.payload.BytesFromClient += n
+}
+
+// AddBytesToClient increments the count of bytes forwarded to the client.
+func (r *Record) AddBytesToClient(n int64) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.payload.BytesToClient += n
+}
+
+// Bytes returns the number of bytes forwarded so far in both directions.
+func (r *Record) Bytes() int64 {
+	if r == nil {
+		return 0
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.payload.BytesFromClient + r.payload.BytesToClient
+}
+
+// Summary is the outcome of a connection as recorded so far, for consumers
+// of Records other than access logs.
+type Summary struct {
+	ClientID        *core.ClientID // ClientID is the authenticated client, if known.
+	Pool            string         // Pool is the upstream pool the connection was routed to, if any.
+	Upstream        *core.Upstream // Upstream is the upstream forwarded to, if any.
+	BytesFromClient int64
+	BytesToClient   int64
+	Reason          ReasonCode // Reason is ReasonUnknown if no reason was recorded.
+}
+
+// Summary returns the outcome of the connection as recorded so far.
+func (r *Record) Summary() Summary {
+	if r == nil {
+		return Summary{Reason: ReasonUnknown}
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	s := Summary{
+		ClientID:        r.payload.ClientID,
+		Pool:            r.payload.Pool,
+		Upstream:        r.payload.Upstream,
+		BytesFromClient: r.payload.BytesFromClient,
+		BytesToClient:   r.payload.BytesToClient,
+		Reason:          r.payload.Reason,
+	}
+	if s.Reason == "" {
+		s.Reason = ReasonUnknown
+	}
+	return s
+}
+
+// finish stamps the end time and duration and returns a copy of the payload.
+func (r *Record) finish(end time.Time) recordPayload {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.payload.Time = end.UTC().Format(time.RFC3339Nano)
+	r.payload.DurationMillis = end.Sub(r.start).Milliseconds()
+	if r.payload.Reason == "" {
+		r.payload.Reason = ReasonUnknown
+	}
+	return r.payload
+}
+
+type recordContextKeyType struct{}
+
+var recordContextKey = recordContextKeyType{}
+
+// NewContextWithRecord returns a child context of parent that carries record.
+func NewContextWithRecord(parent context.Context, record *Record) context.Context {
+	return context.WithValue(parent, recordContextKey, record)
+}
+
+// RecordFromContext returns the Record stored in ctx, or nil if there is none.
+func RecordFromContext(ctx context.Context) *Record {
+	record, _ := ctx.Value(recordContextKey).(*Record)
+	return record
+}
+
+// SetReason records reason against the Record stored in ctx, if any.
+func SetReason(ctx context.Context, reason ReasonCode) {
+	RecordFromContext(ctx).SetReason(reason)
+}
+
+// Logger writes completed access log Records to some sink.
+//
+// Multiple goroutines may invoke methods on a Logger simultaneously.
+type Logger interface {
+	// Log completes the given Record, stamping the end time, and writes it.
+	Log(record *Record)
+}
+
+// JSONLogger writes each Record as a single line of JSON to an io.Writer.
+type JSONLogger struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// NewJSONLogger returns a JSONLogger that writes to w.
+func NewJSONLogger(w io.Writer) *JSONLogger {
+	return &JSONLogger{w: w}
+}
+
+func (l *JSONLogger) Log(record *Record) {
+	if record == nil {
+		return
+	}
+	payload := record.finish(time.Now())
+	data, err := json.Marshal(&payload)
+	if err != nil {
+		return
+	}
+	data = append(data, '\n')
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	// Access logging is best-effort: a failing sink must not impede forwarding.
+	_, _ = l.w.Write(data)
+}
+
+var _ Logger = (*JSONLogger)(nil) // type check
@@ -0,0 +1,78 @@
+package accesslog
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/stretchr/testify/require"
+	"tcplb/lib/core"
+	"testing"
+	"time"
+)
+
+func TestNilRecordIsNoop(t *testing.T) {
+	record := RecordFromContext(context.Background())
+	require.Nil(t, record)
+
+	// Methods on nil records must not panic.
+	record.SetClientID(core.ClientID{Namespace: "accesslog_test", Key: "a"})
+	record.SetSNI("example.com")
+	record.SetSocket("127.0.0.1:4321", []string{"sack"})
+	record.SetUpstream(core.Upstream{Network: "tcp", Address: "a:1"})
+	record.SetReason(ReasonForwarded)
+	record.AddBytesFromClient(1)
+	record.AddBytesToClient(1)
+	SetReason(context.Background(), ReasonForwarded)
+}
+
+func TestSetReasonKeepsFirstReason(t *testing.T) {
+	record := NewRecord("127.0.0.1:1234", time.Now())
+	ctx := NewContextWithRecord(context.Background(), record)
+	SetReason(ctx, ReasonDialFailed)
+	SetReason(ctx, ReasonForwarded)
+	payload := record.finish(time.Now())
+	require.Equal(t, ReasonDialFailed, payload.Reason)
+}
+
+func TestJSONLoggerWritesOneLinePerRecord(t *testing.T) {
+	var buf bytes.Buffer
+	logger := NewJSONLogger(&buf)
+
+	clientID := core.ClientID{Namespace: "accesslog_test", Key: "alice"}
+	upstream := core.Upstream{Network: "tcp", Address: "upstream:1"}
+
+	start := time.Now().Add(-time.Second)
+	record := NewRecord("127.0.0.1:1234", start)
+	record.SetClientID(clientID)
+	record.SetUpstream(upstream)
+	record.SetSocket("127.0.0.1:4321", []string{"timestamps", "sack"})
+	record.AddBytesFromClient(10)
+	record.AddBytesFromClient(5)
+	record.AddBytesToClient(7)
+	record.SetReason(ReasonForwarded)
+	logger.Log(record)
+
+	logger.Log(NewRecord("127.0.0.1:5678", time.Now()))
+
+	lines := bytes.Split(bytes.TrimSpace(buf.Bytes()), []byte("\n"))
+	require.Len(t, lines, 2)
+
+	var got recordPayload
+	require.NoError(t, json.Unmarshal(lines[0], &got))
+	require.Equal(t, "127.0.0.1:1234", got.SourceAddr)
+	require.Equal(t, "127.0.0.1:4321", got.LocalAddr)
+	require.Equal(t, []string{"timestamps", "sack"}, got.TCPOptions)
+	require.Equal(t, &clientID, got.ClientID)
+	require.Equal(t, &upstream, got.Upstream)
+	require.Equal(t, int64(15), got.BytesFromClient)
+	require.Equal(t, int64(7), got.BytesToClient)
+	require.GreaterOrEqual(t, got.DurationMillis, int64(1000))
+	require.Equal(t, ReasonForwarded, got.Reason)
+	_, err := time.Parse(time.RFC3339Nano, got.Time)
+	require.NoError(t, err)
+
+	var second recordPayload
+	require.NoError(t, json.Unmarshal(lines[1], &second))
+	require.Equal(t, ReasonUnknown, second.Reason)
+	require.Nil(t, second.ClientID)
+}
@@ -0,0 +1,40 @@
+package accesslog
+
+import (
+	"errors"
+	"io"
+	"os"
+)
+
+// Names of the non-file sinks accepted by OpenSink.
+const (
+	SinkStdout = "stdout"
+	SinkStderr = "stderr"
+	SinkSyslog = "syslog"
+)
+
+var SyslogUnsupported = errors.New("syslog access log sink is not supported on this platform")
+
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error { return nil }
+
+// OpenSink opens the named access log sink for writing. The sink is one of
+// SinkStdout, SinkStderr, SinkSyslog, or otherwise is interpreted as the
+// path of a file to append to.
+//
+// The caller is responsible for closing the returned io.WriteCloser.
+func OpenSink(sink string) (io.WriteCloser, error) {
+	switch sink {
+	case SinkStdout:
+		return nopCloser{os.Stdout}, nil
+	case SinkStderr:
+		return nopCloser{os.Stderr}, nil
+	case SinkSyslog:
+		return openSyslogSink()
+	default:
+		return os.OpenFile(sink, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	}
+}
@@ -0,0 +1,9 @@
+//go:build windows || plan9
+
+package accesslog
+
+import "io"
+
+func openSyslogSink() (io.WriteCloser, error) {
+	return nil, SyslogUnsupported
+}
@@ -0,0 +1,14 @@
+//go:build !windows && !plan9
+
+package accesslog
+
+import (
+	"io"
+	"log/syslog"
+)
+
+const syslogTag = "tcplb-access"
+
+func openSyslogSink() (io.WriteCloser, error) {
+	return syslog.New(syslog.LOG_INFO|syslog.LOG_LOCAL0, syslogTag)
+}
@@ -0,0 +1,518 @@
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/stretchr/testify/require"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"tcplb/lib/accesslog"
+	"tcplb/lib/conntable"
+	"tcplb/lib/core"
+	"tcplb/lib/dialer"
+	"tcplb/lib/forwarder"
+	"tcplb/lib/healthcheck"
+	"tcplb/lib/limiter"
+	"tcplb/lib/metrics"
+	"tcplb/lib/slog"
+	"tcplb/lib/testbed"
+	"testing"
+	"time"
+)
+
+func TestRequireLoopback(t *testing.T) {
+	require.NoError(t, RequireLoopback("127.0.0.1:6060"))
+	require.NoError(t, RequireLoopback("[::1]:6060"))
+	require.NoError(t, RequireLoopback("localhost:6060"))
+
+	err := RequireLoopback("0.0.0.0:6060")
+	require.ErrorAs(t, err, &NotLoopbackAddress{})
+	err = RequireLoopback("example.com:6060")
+	require.ErrorAs(t, err, &NotLoopbackAddress{})
+	err = RequireLoopback("127.0.0.1")
+	require.Error(t, err)
+}
+
+func TestDebugSummaryIncludesMetrics(t *testing.T) {
+	registry := metrics.NewRegistry()
+	registry.Gauge("server_connections_active").Set(3)
+
+	mux := http.NewServeMux()
+	RegisterDebugHandlers(mux, time.Now(), registry)
+
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/debug/summary", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	var got Summary
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &got))
+	require.Positive(t, got.NumGoroutine)
+	require.Equal(t, int64(3), got.Metrics["server_connections_active"])
+}
+
+func TestDebugPprofIndex(t *testing.T) {
+	mux := http.NewServeMux()
+	RegisterDebugHandlers(mux, time.Now(), nil)
+
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/debug/pprof/", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Contains(t, rec.Body.String(), "goroutine")
+}
+
+func TestConfigHandler(t *testing.T) {
+	hash := "abc"
+	mux := http.NewServeMux()
+	RegisterConfigHandler(mux, func() string { return hash })
+
+	for _, expected := range []string{"abc", "def"} {
+		hash = expected
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/config", nil))
+		require.Equal(t, http.StatusOK, rec.Code)
+		require.JSONEq(t, `{"hash":"`+expected+`"}`, rec.Body.String())
+	}
+}
+
+func TestStartupHandler(t *testing.T) {
+	mux := http.NewServeMux()
+	RegisterStartupHandler(mux, map[string]int{"listeners": 2})
+
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/startup", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.JSONEq(t, `{"listeners":2}`, rec.Body.String())
+}
+
+func TestConnectionHandlers(t *testing.T) {
+	table := conntable.NewTable(conntable.Config{})
+	terminated := false
+	entry := table.Register("127.0.0.1:1234", time.Now(), func() { terminated = true })
+
+	mux := http.NewServeMux()
+	RegisterConnectionHandlers(mux, table)
+
+	do := func(method, path string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(method, path, nil))
+		return rec
+	}
+
+	rec := do(http.MethodGet, "/connections")
+	require.Equal(t, http.StatusOK, rec.Code)
+	var infos []conntable.Info
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &infos))
+	require.Len(t, infos, 1)
+	require.Equal(t, "127.0.0.1:1234", infos[0].SourceAddr)
+
+	rec = do(http.MethodGet, "/connections?idle=true")
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.JSONEq(t, `[]`, rec.Body.String())
+	rec = do(http.MethodGet, "/connections?idle=false")
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &infos))
+	require.Len(t, infos, 1)
+	require.Equal(t, http.StatusBadRequest, do(http.MethodGet, "/connections?idle=maybe").Code)
+
+	path := fmt.Sprintf("/connections/%d", entry.ID())
+	rec = do(http.MethodGet, path)
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	require.Equal(t, http.StatusBadRequest, do(http.MethodGet, "/connections/abc").Code)
+	require.Equal(t, http.StatusNotFound, do(http.MethodGet, "/connections/999").Code)
+	require.Equal(t, http.StatusMethodNotAllowed, do(http.MethodPost, path).Code)
+
+	rec = do(http.MethodDelete, path)
+	require.Equal(t, http.StatusNoContent, rec.Code)
+	require.True(t, terminated)
+}
+
+func TestClientHandlers(t *testing.T) {
+	table := conntable.NewTable(conntable.Config{})
+	clientID := core.ClientID{Namespace: "admin-test", Key: "alice"}
+	var graces []time.Duration
+	entry := table.Register("127.0.0.1:1234", time.Now(), func() {})
+	entry.SetClientID(clientID)
+	entry.SetEvict(func(grace time.Duration) { graces = append(graces, grace) })
+
+	mux := http.NewServeMux()
+	RegisterClientHandlers(mux, table, 5*time.Second)
+	client := startControlServer(t, mux)
+	ctx := context.Background()
+
+	data, err := client.Do(ctx, http.MethodPost, "/clients/evict", EvictClientRequest{Namespace: "admin-test", Key: "alice"})
+	require.NoError(t, err)
+	require.JSONEq(t, fmt.Sprintf(`{"clientid":{"Namespace":"admin-test","Key":"alice"},"connections":[%d]}`, entry.ID()), string(data))
+	_, err = client.Do(ctx, http.MethodPost, "/clients/evict", EvictClientRequest{Namespace: "admin-test", Key: "alice", Grace: "0s"})
+	require.NoError(t, err)
+	require.Equal(t, []time.Duration{5 * time.Second, 0}, graces)
+
+	data, err = client.Do(ctx, http.MethodPost, "/clients/evict", EvictClientRequest{Namespace: "admin-test", Key: "bob"})
+	require.NoError(t, err)
+	require.Contains(t, string(data), `"connections":[]`)
+
+	var failed RequestFailed
+	for _, req := range []EvictClientRequest{{Namespace: "admin-test"}, {Key: "alice", Grace: "soon"}, {Key: "alice", Grace: "-1s"}} {
+		_, err = client.Do(ctx, http.MethodPost, "/clients/evict", req)
+		require.ErrorAs(t, err, &failed)
+		require.Equal(t, http.StatusBadRequest, failed.Status)
+	}
+}
+
+func TestHealthHandlers(t *testing.T) {
+	ready := false
+	check := func() error {
+		if !ready {
+			return errors.New("listener not bound")
+		}
+		return nil
+	}
+	mux := http.NewServeMux()
+	RegisterHealthHandlers(mux, check)
+
+	do := func(path string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		return rec
+	}
+
+	require.Equal(t, http.StatusOK, do("/healthz").Code)
+	rec := do("/readyz")
+	require.Equal(t, http.StatusServiceUnavailable, rec.Code)
+	require.Contains(t, rec.Body.String(), "listener not bound")
+
+	ready = true
+	require.Equal(t, http.StatusOK, do("/readyz").Code)
+}
+
+type stubReservationLister []limiter.ClientReservations
+
+func (l stubReservationLister) Reservations() []limiter.ClientReservations {
+	return l
+}
+
+func startControlServer(t *testing.T, mux *http.ServeMux) *Client {
+	path := filepath.Join(t.TempDir(), "control.sock")
+	listener, err := ListenUnix(path)
+	require.NoError(t, err)
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	srv := &http.Server{Handler: mux}
+	go func() {
+		_ = srv.Serve(AuthenticatePeers(listener, &slog.RecordingLogger{}))
+	}()
+	t.Cleanup(func() { _ = srv.Close() })
+	return NewClient(path)
+}
+
+func TestControlHandlers(t *testing.T) {
+	a := core.Upstream{Network: "tcp", Address: "a:1"}
+	alice := core.ClientID{Namespace: "test", Key: "alice"}
+	tracker := healthcheck.NewTracker(healthcheck.TrackerConfig{}, core.NewUpstreamSet(a))
+	logger := slog.NewLogger(slog.Options{Output: io.Discard})
+	reloads := 0
+
+	mux := http.NewServeMux()
+	RegisterLogLevelHandlers(mux, logger)
+	RegisterUpstreamHandlers(mux, tracker)
+	RegisterLimiterHandlers(mux, stubReservationLister{{ClientID: alice, Reservations: 1, Limit: 2}})
+	RegisterReloadHandler(mux, func(ctx context.Context) error {
+		reloads++
+		if reloads > 1 {
+			return errors.New("reload failed")
+		}
+		return nil
+	})
+	client := startControlServer(t, mux)
+	ctx := context.Background()
+
+	data, err := client.Do(ctx, http.MethodPut, "/log-level", map[string]string{"level": "debug"})
+	require.NoError(t, err)
+	require.JSONEq(t, `{"level":"debug"}`, string(data))
+	require.Equal(t, slog.DebugLevel, logger.Level())
+	_, err = client.Do(ctx, http.MethodPut, "/log-level", map[string]string{"level": "loud"})
+	require.ErrorAs(t, err, &RequestFailed{})
+
+	_, err = client.Do(ctx, http.MethodPost, "/upstreams/drain", UpstreamRequest{Address: "a:1"})
+	require.NoError(t, err)
+	require.True(t, tracker.Drained(a))
+	data, err = client.Do(ctx, http.MethodGet, "/upstreams", nil)
+	require.NoError(t, err)
+	require.Contains(t, string(data), `"drained":true`)
+	_, err = client.Do(ctx, http.MethodPost, "/upstreams/undrain", UpstreamRequest{Address: "a:1"})
+	require.NoError(t, err)
+	require.False(t, tracker.Drained(a))
+	_, err = client.Do(ctx, http.MethodPost, "/upstreams/drain", UpstreamRequest{Address: "nope:1"})
+	var failed RequestFailed
+	require.ErrorAs(t, err, &failed)
+	require.Equal(t, http.StatusNotFound, failed.Status)
+	require.Equal(t, healthcheck.NoSuchUpstream.Error(), failed.Message)
+
+	data, err = client.Do(ctx, http.MethodGet, "/limiter", nil)
+	require.NoError(t, err)
+	require.JSONEq(t, `[{"clientid":{"Namespace":"test","Key":"alice"},"reservations":1,"limit":2}]`, string(data))
+
+	_, err = client.Do(ctx, http.MethodPost, "/reload", nil)
+	require.NoError(t, err)
+	_, err = client.Do(ctx, http.MethodPost, "/reload", nil)
+	require.ErrorAs(t, err, &failed)
+	require.Equal(t, "reload failed", failed.Message)
+}
+
+func TestHistoryHandler(t *testing.T) {
+	a := core.Upstream{Network: "tcp", Address: "a:1"}
+	b := core.Upstream{Network: "tcp", Address: "b:1"}
+	tracker := healthcheck.NewTracker(healthcheck.TrackerConfig{}, core.NewUpstreamSet(a, b))
+	tracker.ReportHealth(healthcheck.HealthReport{Upstream: a, Result: healthcheck.CheckFail, Symptom: errors.New("refused"), Time: time.Unix(1000, 0).UTC()})
+
+	mux := http.NewServeMux()
+	RegisterHistoryHandler(mux, tracker)
+	client := startControlServer(t, mux)
+	ctx := context.Background()
+
+	data, err := client.Do(ctx, http.MethodGet, "/upstreams/history?address=a:1", nil)
+	require.NoError(t, err)
+	require.JSONEq(t, `[{"upstream":{"Network":"tcp","Address":"a:1"},"history":[{"time":"1970-01-01T00:16:40Z","result":"fail","symptom":"refused","belief":"unknown"}]}]`, string(data))
+
+	// Without an address, the history of every upstream is shown.
+	data, err = client.Do(ctx, http.MethodGet, "/upstreams/history", nil)
+	require.NoError(t, err)
+	var results []map[string]any
+	require.NoError(t, json.Unmarshal(data, &results))
+	require.Len(t, results, 2)
+	require.Equal(t, map[string]any{"upstream": map[string]any{"Network": "tcp", "Address": "b:1"}, "history": []any{}}, results[1])
+
+	_, err = client.Do(ctx, http.MethodGet, "/upstreams/history?address=nope:1", nil)
+	var failed RequestFailed
+	require.ErrorAs(t, err, &failed)
+	require.Equal(t, http.StatusNotFound, failed.Status)
+}
+
+func TestProbeHandler(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	require.NoError(t, closed.Close())
+	up := core.Upstream{Network: "tcp", Address: listener.Addr().String()}
+	down := core.Upstream{Network: "tcp", Address: closed.Addr().String()}
+	tracker := healthcheck.NewTracker(healthcheck.TrackerConfig{UnhealthyThreshold: 1}, core.NewUpstreamSet(up, down))
+	require.NoError(t, tracker.SetDrained(up, true))
+
+	mux := http.NewServeMux()
+	RegisterProbeHandler(mux, tracker, &healthcheck.OnDemandProber{
+		Dialer:   &dialer.ProbeDialer{Dialer: &dialer.TimeoutDialer{Timeout: time.Second}},
+		Reporter: tracker,
+	})
+	client := startControlServer(t, mux)
+	ctx := context.Background()
+
+	data, err := client.Do(ctx, http.MethodPost, "/upstreams/probe", UpstreamRequest{Address: up.Address})
+	require.NoError(t, err)
+	var results []map[string]any
+	require.NoError(t, json.Unmarshal(data, &results))
+	require.Len(t, results, 1)
+	require.Equal(t, "pass", results[0]["result"])
+	require.Equal(t, "healthy", results[0]["belief"])
+	require.Equal(t, healthcheck.BeliefHealthy, tracker.Belief(up))
+	// Probing does not undrain the upstream.
+	require.Equal(t, true, results[0]["drained"])
+
+	// Without an upstream, every upstream is probed.
+	data, err = client.Do(ctx, http.MethodPost, "/upstreams/probe", nil)
+	require.NoError(t, err)
+	require.Contains(t, string(data), `"result":"fail"`)
+	require.Contains(t, string(data), `"belief":"unhealthy"`)
+	require.Equal(t, healthcheck.BeliefUnhealthy, tracker.Belief(down))
+
+	_, err = client.Do(ctx, http.MethodPost, "/upstreams/probe", UpstreamRequest{Address: "nope:1"})
+	var failed RequestFailed
+	require.ErrorAs(t, err, &failed)
+	require.Equal(t, http.StatusNotFound, failed.Status)
+}
+
+type stubPoolReplacer map[string]*forwarder.Pool
+
+func (r stubPoolReplacer) ReplaceUpstreams(name string, upstreams core.UpstreamSet) (added, removed core.UpstreamSet, err error) {
+	pool, ok := r[name]
+	if !ok {
+		return nil, nil, forwarder.NoSuchPool
+	}
+	if len(upstreams) == 0 {
+		return nil, nil, errors.New("at least one upstream is required")
+	}
+	added, removed = pool.ReplaceUpstreams(upstreams)
+	return added, removed, nil
+}
+
+// stubClientInspector shows every client as holding one reservation of
+// two, and remembers the clients inspected.
+type stubClientInspector struct {
+	inspected []core.ClientID
+}
+
+func (s *stubClientInspector) InspectClient(ctx context.Context, c core.ClientID) (ClientDetails, error) {
+	s.inspected = append(s.inspected, c)
+	if c.Key == "broken" {
+		return ClientDetails{}, errors.New("inspection failed")
+	}
+	return ClientDetails{
+		ClientID:       c,
+		Class:          forwarder.DefaultPriorityClass,
+		Reservations:   []forwarder.ClientReservations{{ClientID: c, Pool: "web", Reservations: 1, Limit: 2}},
+		Groups:         []string{"staff"},
+		UpstreamGroups: []string{"all"},
+		Rejections:     forwarder.RecentRejections{Counts: map[accesslog.ReasonCode]int64{}},
+	}, nil
+}
+
+func TestClientInspectionHandler(t *testing.T) {
+	inspector := &stubClientInspector{}
+	mux := http.NewServeMux()
+	RegisterClientHandlers(mux, conntable.NewTable(conntable.Config{}), time.Second)
+	RegisterClientInspectionHandler(mux, inspector)
+	client := startControlServer(t, mux)
+	ctx := context.Background()
+
+	data, err := client.Do(ctx, http.MethodGet, "/clients/inspect/admin-test/alice", nil)
+	require.NoError(t, err)
+	require.JSONEq(t, `{
+		"clientid": {"Namespace": "admin-test", "Key": "alice"},
+		"class": "default",
+		"exempt": false,
+		"reservations": [{"clientid": {"Namespace": "admin-test", "Key": "alice"}, "pool": "web", "reservations": 1, "limit": 2}],
+		"groups": ["staff"],
+		"upstream_groups": ["all"],
+		"rejections": {"since": "0001-01-01T00:00:00Z", "counts": {}}
+	}`, string(data))
+	_, err = client.Do(ctx, http.MethodGet, "/clients/inspect/spiffe?key="+url.QueryEscape("spiffe://example.com/web"), nil)
+	require.NoError(t, err)
+	_, err = client.Do(ctx, http.MethodGet, "/clients/inspect/x509/ops/alice", nil)
+	require.NoError(t, err)
+	require.Equal(t, []core.ClientID{
+		{Namespace: "admin-test", Key: "alice"},
+		{Namespace: "spiffe", Key: "spiffe://example.com/web"},
+		{Namespace: "x509", Key: "ops/alice"},
+	}, inspector.inspected)
+
+	var failed RequestFailed
+	for path, status := range map[string]int{
+		"/clients/inspect/admin-test":        http.StatusBadRequest,
+		"/clients/inspect/admin-test/":       http.StatusBadRequest,
+		"/clients/inspect/admin-test/broken": http.StatusInternalServerError,
+	} {
+		_, err = client.Do(ctx, http.MethodGet, path, nil)
+		require.ErrorAs(t, err, &failed, path)
+		require.Equal(t, status, failed.Status, path)
+	}
+	_, err = client.Do(ctx, http.MethodDelete, "/clients/inspect/admin-test/alice", nil)
+	require.ErrorAs(t, err, &failed)
+	require.Equal(t, http.StatusMethodNotAllowed, failed.Status)
+	// Evictions are still served by their own endpoint, and clients of a
+	// namespace of the same name may be inspected.
+	_, err = client.Do(ctx, http.MethodPost, "/clients/evict", EvictClientRequest{Key: "alice"})
+	require.NoError(t, err)
+	_, err = client.Do(ctx, http.MethodGet, "/clients/inspect/evict?key=alice", nil)
+	require.NoError(t, err)
+	require.Equal(t, core.ClientID{Namespace: "evict", Key: "alice"}, inspector.inspected[len(inspector.inspected)-1])
+}
+
+func TestPoolHandlers(t *testing.T) {
+	a := core.Upstream{Network: "tcp", Address: "a:1"}
+	pool := &forwarder.Pool{Name: "web", Upstreams: core.NewUpstreamSet(a)}
+	mux := http.NewServeMux()
+	RegisterPoolHandlers(mux, stubPoolReplacer{"web": pool})
+	client := startControlServer(t, mux)
+	ctx := context.Background()
+
+	req := PoolUpstreamsRequest{Pool: "web", Upstreams: []UpstreamRequest{{Address: "b:1"}, {Network: "tcp", Address: "c:1"}}}
+	data, err := client.Do(ctx, http.MethodPut, "/pools/upstreams", req)
+	require.NoError(t, err)
+	require.JSONEq(t, `{"pool":"web","added":[{"Network":"tcp","Address":"b:1"},{"Network":"tcp","Address":"c:1"}],"removed":[{"Network":"tcp","Address":"a:1"}]}`, string(data))
+	require.Len(t, pool.CurrentUpstreams(), 2)
+
+	var failed RequestFailed
+	_, err = client.Do(ctx, http.MethodPut, "/pools/upstreams", PoolUpstreamsRequest{Pool: "api", Upstreams: req.Upstreams})
+	require.ErrorAs(t, err, &failed)
+	require.Equal(t, http.StatusNotFound, failed.Status)
+	_, err = client.Do(ctx, http.MethodPut, "/pools/upstreams", PoolUpstreamsRequest{Pool: "web"})
+	require.ErrorAs(t, err, &failed)
+	require.Equal(t, http.StatusBadRequest, failed.Status)
+	_, err = client.Do(ctx, http.MethodGet, "/pools/upstreams", nil)
+	require.ErrorAs(t, err, &failed)
+	require.Equal(t, http.StatusMethodNotAllowed, failed.Status)
+}
+
+func TestListenUnixRefusesToReplaceRegularFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "not-a-socket")
+	require.NoError(t, os.WriteFile(path, nil, 0600))
+	_, err := ListenUnix(path)
+	require.Error(t, err)
+}
+
+func TestTLSConfigAuthenticatesClients(t *testing.T) {
+	tb := testbed.New(t)
+	server := tb.Server(t, "admin")
+	cfg := TLSConfig{
+		CertFile:       server.CertFile,
+		KeyFile:        server.KeyFile,
+		ClientCAFile:   tb.CAFile,
+		AllowedClients: []string{"ops"},
+	}
+	require.True(t, cfg.AuthenticatesClients())
+	tlsConfig, err := cfg.Load()
+	require.NoError(t, err)
+
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	srv.TLS = tlsConfig
+	srv.Config.ErrorLog = log.New(io.Discard, "", 0)
+	srv.StartTLS()
+	defer srv.Close()
+
+	get := func(name string) error {
+		var client testbed.Identity
+		if name != "" {
+			client = tb.Client(t, name)
+		}
+		httpClient := &http.Client{Transport: &http.Transport{TLSClientConfig: tb.ClientTLSConfig(client)}}
+		resp, err := httpClient.Get(srv.URL)
+		if err != nil {
+			return err
+		}
+		_ = resp.Body.Close()
+		require.Equal(t, http.StatusNoContent, resp.StatusCode)
+		return nil
+	}
+	require.NoError(t, get("ops"))
+	require.Error(t, get("intruder"))
+	require.Error(t, get(""))
+}
+
+func TestTLSConfigValidate(t *testing.T) {
+	require.NoError(t, TLSConfig{}.Validate())
+	require.NoError(t, TLSConfig{CertFile: "c", KeyFile: "k"}.Validate())
+	require.Error(t, TLSConfig{CertFile: "c"}.Validate())
+	require.Error(t, TLSConfig{ClientCAFile: "ca"}.Validate())
+	require.Error(t, TLSConfig{CertFile: "c", KeyFile: "k", AllowedClients: []string{"ops"}}.Validate())
+}
+
+func TestCheckListenAddress(t *testing.T) {
+	require.NoError(t, CheckListenAddress("127.0.0.1:6060", TLSConfig{}))
+	require.ErrorAs(t, CheckListenAddress("0.0.0.0:6060", TLSConfig{}), &NotLoopbackAddress{})
+	// TLS alone does not make it safe to serve on a public address.
+	require.ErrorAs(t, CheckListenAddress("0.0.0.0:6060", TLSConfig{CertFile: "c", KeyFile: "k"}), &NotLoopbackAddress{})
+	require.NoError(t, CheckListenAddress("0.0.0.0:6060", TLSConfig{CertFile: "c", KeyFile: "k", ClientCAFile: "ca"}))
+}
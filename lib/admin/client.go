@@ -0,0 +1,76 @@
+package admin
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+)
+
+// RequestFailed is returned by Client when the server responds to a
+// control request with an error status.
+type RequestFailed struct {
+	Status  int
+	Message string
+}
+
+func (e RequestFailed) Error() string {
+	return fmt.Sprintf("admin request failed with status %d: %s", e.Status, e.Message)
+}
+
+// Client sends control requests to a server over its unix domain socket.
+type Client struct {
+	http *http.Client
+}
+
+// NewClient returns a Client that connects to the control socket at path.
+func NewClient(path string) *Client {
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", path)
+		},
+	}
+	return &Client{http: &http.Client{Transport: transport}}
+}
+
+// Do sends a control request with the given method and path. If body is
+// not nil, it is sent encoded as JSON. The raw response body is returned.
+func (c *Client) Do(ctx context.Context, method, path string, body any) ([]byte, error) {
+	var reqBody io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reqBody = bytes.NewReader(data)
+	}
+	// The host is ignored, as the transport always dials the control socket.
+	req, err := http.NewRequestWithContext(ctx, method, "http://tcplb"+path, reqBody)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		var e errorResponse
+		if json.Unmarshal(data, &e) != nil || e.Error == "" {
+			e.Error = string(data)
+		}
+		return nil, RequestFailed{Status: resp.StatusCode, Message: e.Error}
+	}
+	return data, nil
+}
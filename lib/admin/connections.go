@@ -0,0 +1,189 @@
+package admin
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+	"tcplb/lib/conntable"
+	"tcplb/lib/core"
+	"tcplb/lib/forwarder"
+	"time"
+)
+
+const (
+	connectionsPath = "/connections"
+	clientsPath     = "/clients"
+	// inspectPath is apart from the other client endpoints, so that no
+	// client namespace, e.g. "evict", is mistaken for one of them.
+	inspectPath = clientsPath + "/inspect"
+)
+
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+func writeError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, errorResponse{Error: msg})
+}
+
+// RegisterConnectionHandlers registers the connection table endpoints on mux:
+//
+//	GET    /connections           list all live connections
+//	GET    /connections?idle=true list idle connections, longest idle first
+//	GET    /connections/{id}      show a single live connection
+//	DELETE /connections/{id}      forcibly terminate a live connection
+func RegisterConnectionHandlers(mux *http.ServeMux, table *conntable.Table) {
+	mux.HandleFunc(connectionsPath, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		if raw := r.URL.Query().Get("idle"); raw != "" {
+			idle, err := strconv.ParseBool(raw)
+			if err != nil {
+				writeError(w, http.StatusBadRequest, "idle must be true or false")
+				return
+			}
+			if idle {
+				writeJSON(w, http.StatusOK, table.Idle())
+				return
+			}
+			active := []conntable.Info{}
+			for _, info := range table.List() {
+				if !info.Idle {
+					active = append(active, info)
+				}
+			}
+			writeJSON(w, http.StatusOK, active)
+			return
+		}
+		writeJSON(w, http.StatusOK, table.List())
+	})
+	mux.HandleFunc(connectionsPath+"/", func(w http.ResponseWriter, r *http.Request) {
+		rawID := strings.TrimPrefix(r.URL.Path, connectionsPath+"/")
+		n, err := strconv.ParseUint(rawID, 10, 64)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "connection id must be a positive integer")
+			return
+		}
+		id := conntable.ID(n)
+		switch r.Method {
+		case http.MethodGet:
+			info, err := table.Get(id)
+			if err != nil {
+				writeError(w, http.StatusNotFound, err.Error())
+				return
+			}
+			writeJSON(w, http.StatusOK, info)
+		case http.MethodDelete:
+			err := table.Terminate(id)
+			if err != nil {
+				writeError(w, http.StatusNotFound, err.Error())
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		}
+	})
+}
+
+// EvictClientRequest is the body of a request to evict a client. Grace is
+// a duration, e.g. "5s". If empty, the default grace period is used.
+type EvictClientRequest struct {
+	Namespace string `json:"namespace"`
+	Key       string `json:"key"`
+	Grace     string `json:"grace,omitempty"`
+}
+
+// EvictClientResponse lists the connections of an evicted client.
+type EvictClientResponse struct {
+	ClientID    core.ClientID  `json:"clientid"`
+	Connections []conntable.ID `json:"connections"`
+}
+
+// RegisterClientHandlers registers the client endpoints on mux:
+//
+//	POST /clients/evict evict every connection of a client
+//
+// The request body is an EvictClientRequest. Each connection of the client
+// is closed for writing at once, then closed once the grace period passes,
+// or defaultGrace if the request gives none.
+func RegisterClientHandlers(mux *http.ServeMux, table *conntable.Table, defaultGrace time.Duration) {
+	mux.HandleFunc("/clients/evict", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		var req EvictClientRequest
+		if err := decodeJSON(r, &req); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if req.Key == "" {
+			writeError(w, http.StatusBadRequest, "client key is required")
+			return
+		}
+		grace := defaultGrace
+		if req.Grace != "" {
+			var err error
+			grace, err = time.ParseDuration(req.Grace)
+			if err != nil || grace < 0 {
+				writeError(w, http.StatusBadRequest, "grace must be a non-negative duration")
+				return
+			}
+		}
+		clientID := core.ClientID{Namespace: req.Namespace, Key: req.Key}
+		writeJSON(w, http.StatusOK, EvictClientResponse{ClientID: clientID, Connections: table.EvictClient(clientID, grace)})
+	})
+}
+
+// ClientDetails is what the server knows of a client, to help investigate
+// why it is, or is not, served.
+type ClientDetails struct {
+	ClientID       core.ClientID                  `json:"clientid"`
+	Class          string                         `json:"class"`           // Class is the priority class of the client.
+	Exempt         bool                           `json:"exempt"`          // Exempt is set if the client is exempt from connection limits and quotas.
+	Reservations   []forwarder.ClientReservations `json:"reservations"`    // Reservations are those held by the client in each pool, with their limits.
+	Groups         []string                       `json:"groups"`          // Groups are the client groups the client belongs to.
+	UpstreamGroups []string                       `json:"upstream_groups"` // UpstreamGroups are the upstream groups the client is authorized for.
+	Rejections     forwarder.RecentRejections     `json:"rejections"`      // Rejections counts the recent rejections of the client's connections.
+}
+
+// ClientInspector assembles the ClientDetails of a client from the
+// subsystems that limit and authorize it.
+type ClientInspector interface {
+	InspectClient(ctx context.Context, c core.ClientID) (ClientDetails, error)
+}
+
+// RegisterClientInspectionHandler registers the client inspection endpoint
+// on mux:
+//
+//	GET /clients/inspect/{namespace}/{key} show the details of a client
+//	GET /clients/inspect/{namespace}?key=  the same, for keys that are not valid paths, e.g. SPIFFE IDs
+//
+// The response is a ClientDetails. Clients that the server knows nothing
+// of are shown all the same, as holding no reservations.
+func RegisterClientInspectionHandler(mux *http.ServeMux, inspector ClientInspector) {
+	mux.HandleFunc(inspectPath+"/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		namespace, key, found := strings.Cut(strings.TrimPrefix(r.URL.Path, inspectPath+"/"), "/")
+		if !found {
+			key = r.URL.Query().Get("key")
+		}
+		if namespace == "" || key == "" {
+			writeError(w, http.StatusBadRequest, "client must be given as /clients/inspect/{namespace}/{key}, or /clients/inspect/{namespace}?key={key}")
+			return
+		}
+		details, err := inspector.InspectClient(r.Context(), core.ClientID{Namespace: namespace, Key: key})
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, details)
+	})
+}
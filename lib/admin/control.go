@@ -0,0 +1,314 @@
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"tcplb/lib/core"
+	"tcplb/lib/forwarder"
+	"tcplb/lib/healthcheck"
+	"tcplb/lib/limiter"
+	"tcplb/lib/slog"
+)
+
+// LevelController gets and sets the minimum level of operational log
+// records that are written, e.g. a *slog.StreamLogger.
+type LevelController interface {
+	Level() slog.Level
+	SetLevel(level slog.Level)
+}
+
+// ReservationLister reports the reservations currently held by clients,
+// e.g. a *limiter.UniformlyBoundedClientReserver.
+type ReservationLister interface {
+	Reservations() []limiter.ClientReservations
+}
+
+// UpstreamProber probes upstreams on demand, and records the results as
+// health checks, e.g. a *healthcheck.OnDemandProber.
+type UpstreamProber interface {
+	ProbeUpstreams(ctx context.Context, upstreams []core.Upstream) []healthcheck.HealthReport
+}
+
+// PoolUpstreamReplacer replaces the upstreams of pools while the server is
+// running, returning the upstreams added and removed. It returns an error
+// wrapping forwarder.NoSuchPool if there is no such pool.
+type PoolUpstreamReplacer interface {
+	ReplaceUpstreams(pool string, upstreams core.UpstreamSet) (added, removed core.UpstreamSet, err error)
+}
+
+// ReloadFunc reloads the server's configuration, returning an error if the
+// new configuration could not be applied.
+type ReloadFunc func(ctx context.Context) error
+
+type levelMessage struct {
+	Level slog.Level `json:"level"`
+}
+
+// UpstreamRequest identifies an upstream in the body of a control request.
+// If Network is empty, "tcp" is assumed.
+type UpstreamRequest struct {
+	Network string `json:"network,omitempty"`
+	Address string `json:"address"`
+}
+
+func (u UpstreamRequest) upstream() core.Upstream {
+	network := u.Network
+	if network == "" {
+		network = "tcp"
+	}
+	return core.Upstream{Network: network, Address: u.Address}
+}
+
+// maxRequestBodyBytes bounds the size of control request bodies.
+const maxRequestBodyBytes = 1 << 16
+
+func decodeJSON(r *http.Request, v any) error {
+	return json.NewDecoder(http.MaxBytesReader(nil, r.Body, maxRequestBodyBytes)).Decode(v)
+}
+
+// RegisterLogLevelHandlers registers the log level endpoints on mux:
+//
+//	GET /log-level show the minimum level of log records written
+//	PUT /log-level change the minimum level, given {"level": "debug"}
+func RegisterLogLevelHandlers(mux *http.ServeMux, levels LevelController) {
+	mux.HandleFunc("/log-level", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			writeJSON(w, http.StatusOK, levelMessage{Level: levels.Level()})
+		case http.MethodPut:
+			var msg levelMessage
+			if err := decodeJSON(r, &msg); err != nil {
+				writeError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			level, err := slog.ParseLevel(string(msg.Level))
+			if err != nil {
+				writeError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			levels.SetLevel(level)
+			writeJSON(w, http.StatusOK, levelMessage{Level: level})
+		default:
+			writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		}
+	})
+}
+
+// RegisterUpstreamHandlers registers the upstream endpoints on mux:
+//
+//	GET  /upstreams         show the health and drain state of each upstream
+//	POST /upstreams/drain   stop forwarding new connections to an upstream
+//	POST /upstreams/undrain resume forwarding new connections to an upstream
+//
+// Drain and undrain requests identify the upstream with an UpstreamRequest.
+func RegisterUpstreamHandlers(mux *http.ServeMux, tracker *healthcheck.Tracker) {
+	mux.HandleFunc("/upstreams", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		writeJSON(w, http.StatusOK, tracker.Snapshot())
+	})
+	setDrained := func(drained bool) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodPost {
+				writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+				return
+			}
+			var req UpstreamRequest
+			if err := decodeJSON(r, &req); err != nil {
+				writeError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			if err := tracker.SetDrained(req.upstream(), drained); err != nil {
+				writeError(w, http.StatusNotFound, err.Error())
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}
+	mux.HandleFunc("/upstreams/drain", setDrained(true))
+	mux.HandleFunc("/upstreams/undrain", setDrained(false))
+}
+
+// PoolUpstreamsRequest is the body of a request to replace the upstreams
+// of a pool.
+type PoolUpstreamsRequest struct {
+	Pool      string            `json:"pool"`
+	Upstreams []UpstreamRequest `json:"upstreams"`
+}
+
+// PoolUpstreamsChange reports the upstreams added to and removed from a
+// pool by a replacement. Removed upstreams are drained: their connections
+// continue, but no new connections are forwarded to them.
+type PoolUpstreamsChange struct {
+	Pool    string          `json:"pool"`
+	Added   []core.Upstream `json:"added"`
+	Removed []core.Upstream `json:"removed"`
+}
+
+// RegisterPoolHandlers registers the pool endpoints on mux:
+//
+//	PUT /pools/upstreams replace the upstreams of a pool
+//
+// The request body is a PoolUpstreamsRequest, and the response a
+// PoolUpstreamsChange.
+func RegisterPoolHandlers(mux *http.ServeMux, replacer PoolUpstreamReplacer) {
+	mux.HandleFunc("/pools/upstreams", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPut {
+			writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		var req PoolUpstreamsRequest
+		if err := decodeJSON(r, &req); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		upstreams := core.EmptyUpstreamSet()
+		for _, u := range req.Upstreams {
+			upstreams[u.upstream()] = struct{}{}
+		}
+		added, removed, err := replacer.ReplaceUpstreams(req.Pool, upstreams)
+		switch {
+		case errors.Is(err, forwarder.NoSuchPool):
+			writeError(w, http.StatusNotFound, err.Error())
+			return
+		case err != nil:
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, PoolUpstreamsChange{Pool: req.Pool, Added: added.Sorted(), Removed: removed.Sorted()})
+	})
+}
+
+// UpstreamHistory is the history of recent health checks of an upstream.
+type UpstreamHistory struct {
+	Upstream core.Upstream             `json:"upstream"`
+	History  []healthcheck.HealthEvent `json:"history"`
+}
+
+// RegisterHistoryHandler registers the health history endpoint on mux:
+//
+//	GET /upstreams/history show the recent health checks of each upstream
+//
+// The upstream may be identified with the address and network query
+// parameters, as in an UpstreamRequest. If address is not given, the
+// history of every tracked upstream is shown.
+func RegisterHistoryHandler(mux *http.ServeMux, tracker *healthcheck.Tracker) {
+	mux.HandleFunc("/upstreams/history", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		var upstreams []core.Upstream
+		query := r.URL.Query()
+		if address := query.Get("address"); address != "" {
+			upstreams = []core.Upstream{UpstreamRequest{Network: query.Get("network"), Address: address}.upstream()}
+		} else {
+			upstreams = tracker.Upstreams().Sorted()
+		}
+		results := make([]UpstreamHistory, 0, len(upstreams))
+		for _, u := range upstreams {
+			history, err := tracker.History(u)
+			if err != nil {
+				writeError(w, http.StatusNotFound, err.Error())
+				return
+			}
+			results = append(results, UpstreamHistory{Upstream: u, History: history})
+		}
+		writeJSON(w, http.StatusOK, results)
+	})
+}
+
+// ProbeResult is the result of an on-demand probe of an upstream, together
+// with the tracked health of the upstream once the result is recorded.
+type ProbeResult struct {
+	Upstream core.Upstream           `json:"upstream"`
+	Result   healthcheck.CheckResult `json:"result"`
+	Symptom  string                  `json:"symptom,omitempty"`
+	Belief   healthcheck.Belief      `json:"belief"`
+	Drained  bool                    `json:"drained"`
+}
+
+// RegisterProbeHandler registers the probe endpoint on mux:
+//
+//	POST /upstreams/probe probe upstreams now, and show the results
+//
+// The request body is an UpstreamRequest identifying the upstream to probe.
+// If the body is empty, every tracked upstream is probed, concurrently.
+// The response is sent once every probe has finished.
+func RegisterProbeHandler(mux *http.ServeMux, tracker *healthcheck.Tracker, prober UpstreamProber) {
+	mux.HandleFunc("/upstreams/probe", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		var upstreams []core.Upstream
+		var req UpstreamRequest
+		switch err := decodeJSON(r, &req); err {
+		case io.EOF:
+			upstreams = tracker.Upstreams().Sorted()
+		case nil:
+			u := req.upstream()
+			if _, ok := tracker.Upstreams()[u]; !ok {
+				writeError(w, http.StatusNotFound, healthcheck.NoSuchUpstream.Error())
+				return
+			}
+			upstreams = []core.Upstream{u}
+		default:
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		reports := prober.ProbeUpstreams(r.Context(), upstreams)
+		results := make([]ProbeResult, len(reports))
+		for i, report := range reports {
+			results[i] = ProbeResult{
+				Upstream: report.Upstream,
+				Result:   report.Result,
+				Belief:   tracker.Belief(report.Upstream),
+				Drained:  tracker.Drained(report.Upstream),
+			}
+			if report.Symptom != nil {
+				results[i].Symptom = report.Symptom.Error()
+			}
+		}
+		writeJSON(w, http.StatusOK, results)
+	})
+}
+
+// RegisterLimiterHandlers registers the limiter endpoint on mux:
+//
+//	GET /limiter show the reservations held by each client
+func RegisterLimiterHandlers(mux *http.ServeMux, lister ReservationLister) {
+	mux.HandleFunc("/limiter", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		reservations := lister.Reservations()
+		if reservations == nil {
+			reservations = []limiter.ClientReservations{}
+		}
+		writeJSON(w, http.StatusOK, reservations)
+	})
+}
+
+// RegisterReloadHandler registers the reload endpoint on mux:
+//
+//	POST /reload reload the server's configuration
+func RegisterReloadHandler(mux *http.ServeMux, reload ReloadFunc) {
+	mux.HandleFunc("/reload", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		if err := reload(r.Context()); err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
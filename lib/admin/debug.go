@@ -0,0 +1,121 @@
+// Package admin implements the HTTP endpoints used by operators to inspect
+// and control a running server. These endpoints are intended to be served
+// on a separate control-plane listener, never on the public data-plane
+// listener: either bound to a loopback address, or serving TLS to clients
+// authenticated by certificate.
+package admin
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"tcplb/lib/metrics"
+	"time"
+)
+
+// NotLoopbackAddress is returned by RequireLoopback when given an address
+// that is reachable from other hosts.
+type NotLoopbackAddress struct {
+	Address string
+}
+
+func (e NotLoopbackAddress) Error() string {
+	return fmt.Sprintf("admin listen address %s must be a loopback address", e.Address)
+}
+
+// RequireLoopback checks that the host:port address refers to a loopback
+// interface, so that the endpoints served on it are only reachable locally.
+func RequireLoopback(address string) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if host == "localhost" {
+		return nil
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !ip.IsLoopback() {
+		return NotLoopbackAddress{Address: address}
+	}
+	return nil
+}
+
+// Summary is a snapshot of the runtime state of the server process.
+type Summary struct {
+	GoVersion      string           `json:"go_version"`
+	NumCPU         int              `json:"num_cpu"`
+	NumGoroutine   int              `json:"num_goroutine"`
+	UptimeSeconds  float64          `json:"uptime_seconds"`
+	HeapAllocBytes uint64           `json:"heap_alloc_bytes"`
+	HeapObjects    uint64           `json:"heap_objects"`
+	NumGC          uint32           `json:"num_gc"`
+	Metrics        map[string]int64 `json:"metrics"`
+}
+
+// NewSummary returns a Summary of the current process state, including all
+// metrics in the given Registry.
+func NewSummary(started time.Time, registry *metrics.Registry) *Summary {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	return &Summary{
+		GoVersion:      runtime.Version(),
+		NumCPU:         runtime.NumCPU(),
+		NumGoroutine:   runtime.NumGoroutine(),
+		UptimeSeconds:  time.Since(started).Seconds(),
+		HeapAllocBytes: mem.HeapAlloc,
+		HeapObjects:    mem.HeapObjects,
+		NumGC:          mem.NumGC,
+		Metrics:        registry.Snapshot(),
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+// RegisterDebugHandlers registers the debug endpoints on mux:
+//
+//	/debug/pprof/  net/http/pprof profiles
+//	/debug/vars    expvar variables, including published metrics
+//	/debug/summary goroutine, memory and connection summary as JSON
+func RegisterDebugHandlers(mux *http.ServeMux, started time.Time, registry *metrics.Registry) {
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.Handle("/debug/vars", expvar.Handler())
+	mux.HandleFunc("/debug/summary", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, NewSummary(started, registry))
+	})
+}
+
+type configResponse struct {
+	Hash string `json:"hash"`
+}
+
+// RegisterConfigHandler registers the config endpoint on mux:
+//
+//	/config the hash of the effective configuration, as JSON
+//
+// hash is called on each request, as the configuration may be reloaded.
+func RegisterConfigHandler(mux *http.ServeMux, hash func() string) {
+	mux.HandleFunc("/config", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, configResponse{Hash: hash()})
+	})
+}
+
+// RegisterStartupHandler registers the startup endpoint on mux:
+//
+//	/startup the report of the effective configuration logged at startup, as JSON
+func RegisterStartupHandler(mux *http.ServeMux, report any) {
+	mux.HandleFunc("/startup", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, report)
+	})
+}
@@ -0,0 +1,33 @@
+package admin
+
+import (
+	"net/http"
+)
+
+// ReadinessCheck reports nil if the server is ready to accept traffic, or
+// an error describing why it is not.
+type ReadinessCheck func() error
+
+type healthResponse struct {
+	Status string `json:"status"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// RegisterHealthHandlers registers the orchestrator health endpoints on mux:
+//
+//	/healthz liveness: always OK while the process is serving
+//	/readyz  readiness: OK only if every ReadinessCheck passes
+func RegisterHealthHandlers(mux *http.ServeMux, checks ...ReadinessCheck) {
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, healthResponse{Status: "ok"})
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		for _, check := range checks {
+			if err := check(); err != nil {
+				writeJSON(w, http.StatusServiceUnavailable, healthResponse{Status: "not ready", Reason: err.Error()})
+				return
+			}
+		}
+		writeJSON(w, http.StatusOK, healthResponse{Status: "ready"})
+	})
+}
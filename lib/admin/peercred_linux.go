@@ -0,0 +1,34 @@
+package admin
+
+import (
+	"net"
+	"os"
+	"syscall"
+)
+
+func umask(mask int) int {
+	return syscall.Umask(mask)
+}
+
+// checkPeer checks the credentials of the process at the other end of conn.
+func checkPeer(conn *net.UnixConn) error {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var cred *syscall.Ucred
+	var credErr error
+	err = raw.Control(func(fd uintptr) {
+		cred, credErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	})
+	if err != nil {
+		return err
+	}
+	if credErr != nil {
+		return credErr
+	}
+	if cred.Uid != 0 && int(cred.Uid) != os.Getuid() {
+		return PeerNotAuthorized{UID: cred.Uid}
+	}
+	return nil
+}
@@ -0,0 +1,113 @@
+package admin
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// ClientNotAuthorized is returned when a client presents a certificate to
+// the admin listener that is valid, but names a client that is not allowed.
+type ClientNotAuthorized struct {
+	Name string
+}
+
+func (e ClientNotAuthorized) Error() string {
+	return fmt.Sprintf("admin client %q is not authorized", e.Name)
+}
+
+// TLSConfig configures TLS, and authentication of clients by certificate,
+// for the admin listener, independently of any data-plane listener.
+type TLSConfig struct {
+	CertFile string // CertFile is the PEM server certificate chain. If empty, TLS is disabled.
+	KeyFile  string // KeyFile is the PEM private key of the server certificate.
+
+	// ClientCAFile is optional. If set, clients must present a certificate
+	// signed by one of the PEM CA certificates in it.
+	ClientCAFile string
+
+	// AllowedClients is optional. If not empty, clients must present a
+	// certificate whose subject common name is one of these.
+	AllowedClients []string
+}
+
+// Enabled reports if the admin listener serves TLS.
+func (c TLSConfig) Enabled() bool {
+	return c.CertFile != ""
+}
+
+// AuthenticatesClients reports if the admin listener only serves clients
+// that present a trusted certificate.
+func (c TLSConfig) AuthenticatesClients() bool {
+	return c.Enabled() && c.ClientCAFile != ""
+}
+
+// Validate checks that the settings are consistent, without loading files.
+func (c TLSConfig) Validate() error {
+	if c.Enabled() != (c.KeyFile != "") {
+		return errors.New("admin TLS certificate and key must be given together")
+	}
+	if c.ClientCAFile != "" && !c.Enabled() {
+		return errors.New("admin client CA requires an admin TLS certificate")
+	}
+	if len(c.AllowedClients) > 0 && c.ClientCAFile == "" {
+		return errors.New("admin allowed clients require an admin client CA")
+	}
+	return nil
+}
+
+// Load returns the tls.Config for the admin listener, loading the
+// certificate, key and client CAs from their files.
+func (c TLSConfig) Load() (*tls.Config, error) {
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load admin TLS certificate: %w", err)
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if c.ClientCAFile == "" {
+		return config, nil
+	}
+	pem, err := os.ReadFile(c.ClientCAFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load admin client CA: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("failed to load admin client CA: no certificates in %s", c.ClientCAFile)
+	}
+	config.ClientCAs = pool
+	config.ClientAuth = tls.RequireAndVerifyClientCert
+	if len(c.AllowedClients) > 0 {
+		allowed := make(map[string]bool, len(c.AllowedClients))
+		for _, name := range c.AllowedClients {
+			allowed[name] = true
+		}
+		config.VerifyConnection = func(cs tls.ConnectionState) error {
+			name := cs.PeerCertificates[0].Subject.CommonName
+			if !allowed[name] {
+				return ClientNotAuthorized{Name: name}
+			}
+			return nil
+		}
+	}
+	return config, nil
+}
+
+// CheckListenAddress checks that endpoints may be served on the host:port
+// address with the TLS configuration c. Unless clients are authenticated
+// by certificate, the address must be a loopback address, so that the
+// endpoints are only reachable locally.
+func CheckListenAddress(address string, c TLSConfig) error {
+	if c.AuthenticatesClients() {
+		return nil
+	}
+	return RequireLoopback(address)
+}
@@ -0,0 +1,85 @@
+package admin
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"tcplb/lib/slog"
+)
+
+// PeerNotAuthorized is returned when a process connecting to the control
+// socket runs as a user other than the server's own user or root.
+type PeerNotAuthorized struct {
+	UID uint32
+}
+
+func (e PeerNotAuthorized) Error() string {
+	return fmt.Sprintf("control socket peer with uid %d is not authorized", e.UID)
+}
+
+// ListenUnix listens on a unix domain socket at path for control requests.
+// Any stale socket left at path by an earlier process is removed first. The
+// socket is only accessible to the server's own user.
+//
+// The socket file is not removed when the listener is closed, so that the
+// listener may be handed off to a new process during an upgrade. Use
+// os.Remove once the socket is no longer needed.
+func ListenUnix(path string) (*net.UnixListener, error) {
+	info, err := os.Lstat(path)
+	if err == nil {
+		if info.Mode()&fs.ModeSocket == 0 {
+			return nil, fmt.Errorf("refusing to replace %s: not a socket", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	// Restrict permissions before the socket file is created, to avoid a
+	// window where other users could connect.
+	oldMask := umask(0177)
+	listener, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	umask(oldMask)
+	if err != nil {
+		return nil, err
+	}
+	listener.SetUnlinkOnClose(false)
+	if err := os.Chmod(path, 0600); err != nil {
+		_ = listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
+
+// peerCheckingListener is a net.Listener that drops connections from peers
+// that fail checkPeer.
+type peerCheckingListener struct {
+	*net.UnixListener
+	logger slog.Logger
+}
+
+// AuthenticatePeers wraps a unix domain socket listener so that connections
+// from processes running as a different user, other than root, are dropped.
+// On platforms where the peer's credentials are unavailable, access to the
+// socket is controlled by its file permissions alone.
+func AuthenticatePeers(listener *net.UnixListener, logger slog.Logger) net.Listener {
+	return &peerCheckingListener{UnixListener: listener, logger: logger}
+}
+
+func (l *peerCheckingListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.UnixListener.AcceptUnix()
+		if err != nil {
+			return nil, err
+		}
+		if err := checkPeer(conn); err != nil {
+			l.logger.Warn(&slog.LogRecord{Msg: "rejected control socket connection", Error: err})
+			_ = conn.Close()
+			continue
+		}
+		return conn, nil
+	}
+}
@@ -10,8 +10,16 @@ import (
 
 const (
 	DefaultNamespace = "CommonName"
+
+	// UnauthenticatedNamespace is the namespace of Unauthenticated.
+	UnauthenticatedNamespace = "Unauthenticated"
 )
 
+// Unauthenticated identifies clients that connected without presenting a
+// certificate, where presenting one is optional. It is never extracted from
+// a certificate, as it is not in DefaultNamespace.
+var Unauthenticated = core.ClientID{Namespace: UnauthenticatedNamespace, Key: "anonymous"}
+
 var NoVerifiedChainError = errors.New("authentication failure - no verified chain")
 var InvalidClientIDError = errors.New("authentication failure - invalid client id")
 
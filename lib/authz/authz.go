@@ -2,7 +2,13 @@ package authz
 
 import (
 	"context"
+	"sort"
+	"sync"
+	"tcplb/lib/clock"
 	"tcplb/lib/core"
+	"tcplb/lib/geoip"
+	"tcplb/lib/metrics"
+	"time"
 )
 
 // Group is a value type that represents a logical group of clients.
@@ -20,33 +26,222 @@ type Config struct {
 	GroupsByClientID         map[core.ClientID][]Group
 	UpstreamGroupsByGroup    map[Group][]UpstreamGroup
 	UpstreamsByUpstreamGroup map[UpstreamGroup]core.UpstreamSet
+
+	// GeoPoliciesByUpstreamGroup is optional. Clients are only authorized
+	// for the upstreams of an upstream group that has a policy if it allows
+	// the Location of the client, as found by geoip.LocationFromContext.
+	// Clients whose Location is unknown are judged by the zero Location.
+	GeoPoliciesByUpstreamGroup map[UpstreamGroup]geoip.Policy
+
+	// FingerprintsByUpstreamGroup is optional. Clients are only authorized
+	// for the upstreams of an upstream group listed here if the fingerprint
+	// of their TLS ClientHello, as found by core.TLSFingerprintFromContext,
+	// is one of those of the group. Clients without a fingerprint are not.
+	FingerprintsByUpstreamGroup map[UpstreamGroup]map[string]bool
+}
+
+// CacheConfig configures the cache of the upstreams that each client is
+// authorized to access.
+type CacheConfig struct {
+	// MaxClients bounds the clients whose upstreams are cached. Once it is
+	// reached, an arbitrary client is evicted to cache another. If not
+	// positive, nothing is cached.
+	MaxClients int
+	// TTL is how long the upstreams of a client are cached. If not
+	// positive, they are cached until the policy changes.
+	TTL   time.Duration
+	Clock clock.Clock // Clock is optional. If nil, the Real clock is used.
+}
+
+// CacheMetrics holds the metrics recorded by the cache of an Authorizer.
+type CacheMetrics struct {
+	Hits          *metrics.Counter // Hits counts lookups answered by the cache.
+	Misses        *metrics.Counter // Misses counts lookups that evaluated the policy.
+	Evictions     *metrics.Counter // Evictions counts clients evicted to cache others.
+	Invalidations *metrics.Counter // Invalidations counts changes of the policy that emptied the cache.
+	Size          *metrics.Gauge   // Size is the number of clients cached.
+}
+
+// NewCacheMetrics returns CacheMetrics registered in the given Registry.
+func NewCacheMetrics(r *metrics.Registry) *CacheMetrics {
+	return &CacheMetrics{
+		Hits:          r.Counter("authz_cache_hits_total"),
+		Misses:        r.Counter("authz_cache_misses_total"),
+		Evictions:     r.Counter("authz_cache_evictions_total"),
+		Invalidations: r.Counter("authz_cache_invalidations_total"),
+		Size:          r.Gauge("authz_cache_clients"),
+	}
 }
 
 // Authorizer is a static forwarding authorization policy that
 // controls which clients are allowed to forward connections to which upstreams.
 //
-// Authorization data is static and is stored locally in memory.
+// Authorization data is static and is stored locally in memory, except
+// that the upstreams of an upstream group may be replaced with
+// SetUpstreamGroup.
+//
+// With large policies, evaluating the upstreams of a client unions many
+// sets, so an Authorizer may cache them per client. The cache is emptied
+// whenever the policy changes.
 //
 // Multiple goroutines may invoke methods on an Authorizer simultaneously.
 type Authorizer struct {
+	cache   CacheConfig
+	metrics *CacheMetrics
+
+	mu     sync.RWMutex // mu guards config.UpstreamsByUpstreamGroup
 	config Config
+
+	// cacheMu guards cached. It is acquired while holding mu, so that the
+	// upstreams cached are those of the policy in effect.
+	cacheMu sync.RWMutex
+	cached  map[core.ClientID]cachedUpstreams
+}
+
+// cachedUpstreams are the upstreams a client is authorized to access, as
+// cached until expires, or indefinitely if it is zero.
+type cachedUpstreams struct {
+	upstreams core.UpstreamSet
+	expires   time.Time
+}
+
+func (e cachedUpstreams) live(now time.Time) bool {
+	return e.expires.IsZero() || now.Before(e.expires)
 }
 
 // NewStaticAuthorizer creates a new static Authorizer from the given config.
 func NewStaticAuthorizer(config Config) *Authorizer {
+	return NewCachingAuthorizer(config, CacheConfig{}, nil)
+}
+
+// NewCachingAuthorizer creates a new static Authorizer from the given
+// config, which caches the upstreams of clients as configured by cache. m
+// is optional. If nil, no metrics are recorded.
+func NewCachingAuthorizer(config Config, cache CacheConfig, m *CacheMetrics) *Authorizer {
+	if m == nil {
+		m = &CacheMetrics{}
+	}
 	return &Authorizer{
-		config: config,
+		cache:   cache,
+		metrics: m,
+		config:  config,
+		cached:  make(map[core.ClientID]cachedUpstreams),
+	}
+}
+
+// ClientGroups returns the keys of the groups that client c belongs to.
+func (a *Authorizer) ClientGroups(ctx context.Context, c core.ClientID) ([]string, error) {
+	groups := a.config.GroupsByClientID[c]
+	keys := make([]string, len(groups))
+	for i, g := range groups {
+		keys[i] = g.Key
 	}
+	return keys, nil
 }
 
-// AuthorizedUpstreams returns an UpstreamSet of upstreams that the ClientID c
-// is authorized to access. If c is not authorized to access any upstreams,
-// implementations should return an empty UpstreamSet and nil.
+// UpstreamGroups returns the keys of the upstream groups that client c is
+// granted, through the groups it belongs to, in sorted order.
+func (a *Authorizer) UpstreamGroups(ctx context.Context, c core.ClientID) ([]string, error) {
+	seen := make(map[UpstreamGroup]bool)
+	keys := []string{}
+	for _, g := range a.config.GroupsByClientID[c] {
+		for _, ug := range a.config.UpstreamGroupsByGroup[g] {
+			if !seen[ug] {
+				seen[ug] = true
+				keys = append(keys, ug.Key)
+			}
+		}
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// AuthorizedUpstreams returns the upstreams that client c is authorized to
+// access, which may be cached, so are shared between callers and must not
+// be modified. Upstream groups whose geo policy does not allow the
+// Location of the client in ctx, or whose fingerprints do not include that
+// of the client in ctx, are excluded.
 func (a *Authorizer) AuthorizedUpstreams(ctx context.Context, c core.ClientID) (core.UpstreamSet, error) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	if excluded := a.excluded(ctx); len(excluded) > 0 {
+		// The upstreams depend on where the client is, or on its software,
+		// so are not cached.
+		return a.evaluate(c, excluded), nil
+	}
+	if a.cache.MaxClients <= 0 {
+		return a.evaluate(c, nil), nil
+	}
+	now := clock.Or(a.cache.Clock).Now()
+	a.cacheMu.RLock()
+	entry, ok := a.cached[c]
+	a.cacheMu.RUnlock()
+	if ok && entry.live(now) {
+		a.metrics.Hits.Inc()
+		return entry.upstreams, nil
+	}
+
+	a.cacheMu.Lock()
+	defer a.cacheMu.Unlock()
+	if entry, ok := a.cached[c]; ok && entry.live(now) {
+		a.metrics.Hits.Inc()
+		return entry.upstreams, nil
+	}
+	a.metrics.Misses.Inc()
+	result := a.evaluate(c, nil)
+	if _, ok := a.cached[c]; !ok && len(a.cached) >= a.cache.MaxClients {
+		for evicted := range a.cached {
+			delete(a.cached, evicted)
+			a.metrics.Evictions.Inc()
+			break
+		}
+	}
+	entry = cachedUpstreams{upstreams: result}
+	if a.cache.TTL > 0 {
+		entry.expires = now.Add(a.cache.TTL)
+	}
+	a.cached[c] = entry
+	a.metrics.Size.Set(int64(len(a.cached)))
+	return result, nil
+}
+
+// excluded returns the upstream groups whose geo policy does not allow the
+// Location of the client in ctx, or whose fingerprints do not include that
+// of the client in ctx.
+func (a *Authorizer) excluded(ctx context.Context) map[UpstreamGroup]bool {
+	if len(a.config.GeoPoliciesByUpstreamGroup) == 0 && len(a.config.FingerprintsByUpstreamGroup) == 0 {
+		return nil
+	}
+	var excluded map[UpstreamGroup]bool
+	exclude := func(ug UpstreamGroup) {
+		if excluded == nil {
+			excluded = make(map[UpstreamGroup]bool)
+		}
+		excluded[ug] = true
+	}
+	loc, _ := geoip.LocationFromContext(ctx)
+	for ug, policy := range a.config.GeoPoliciesByUpstreamGroup {
+		if !policy.Allowed(loc) {
+			exclude(ug)
+		}
+	}
+	fingerprint, ok := core.TLSFingerprintFromContext(ctx)
+	for ug, fingerprints := range a.config.FingerprintsByUpstreamGroup {
+		if !ok || !fingerprints[fingerprint] {
+			exclude(ug)
+		}
+	}
+	return excluded
+}
+
+// evaluate returns the upstreams that client c is authorized to access,
+// according to the policy, except those of excluded upstream groups. The
+// caller must hold a.mu.
+func (a *Authorizer) evaluate(c core.ClientID, excluded map[UpstreamGroup]bool) core.UpstreamSet {
 	result := core.EmptyUpstreamSet()
 	groups, exists := a.config.GroupsByClientID[c]
 	if !exists {
-		return result, nil
+		return result
 	}
 	for _, g := range groups {
 		upstreamGroups, exists := a.config.UpstreamGroupsByGroup[g]
@@ -54,6 +249,9 @@ func (a *Authorizer) AuthorizedUpstreams(ctx context.Context, c core.ClientID) (
 			continue
 		}
 		for _, ug := range upstreamGroups {
+			if excluded[ug] {
+				continue
+			}
 			us, exists := a.config.UpstreamsByUpstreamGroup[ug]
 			if !exists {
 				continue
@@ -61,5 +259,25 @@ func (a *Authorizer) AuthorizedUpstreams(ctx context.Context, c core.ClientID) (
 			result = core.UnionUpdate(result, us)
 		}
 	}
-	return result, nil
+	return result
+}
+
+// SetUpstreamGroup replaces the upstreams of upstream group ug with
+// upstreams, e.g. once the upstreams of pools are replaced. Clients of the
+// groups granted ug are authorized for the new upstreams from then on.
+func (a *Authorizer) SetUpstreamGroup(ug UpstreamGroup, upstreams core.UpstreamSet) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.config.UpstreamsByUpstreamGroup == nil {
+		a.config.UpstreamsByUpstreamGroup = make(map[UpstreamGroup]core.UpstreamSet)
+	}
+	a.config.UpstreamsByUpstreamGroup[ug] = upstreams
+
+	a.cacheMu.Lock()
+	defer a.cacheMu.Unlock()
+	if len(a.cached) > 0 {
+		a.cached = make(map[core.ClientID]cachedUpstreams)
+		a.metrics.Invalidations.Inc()
+		a.metrics.Size.Set(0)
+	}
 }
@@ -2,8 +2,12 @@ package authz
 
 import (
 	"context"
+	"tcplb/lib/clock"
 	"tcplb/lib/core"
+	"tcplb/lib/geoip"
+	"tcplb/lib/metrics"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 )
@@ -111,3 +115,170 @@ func TestAuthorizer(t *testing.T) {
 		})
 	}
 }
+
+func TestAuthorizerUpstreamGroups(t *testing.T) {
+	alice := DummyClientID("alice")
+	bob := DummyClientID("bob")
+	alpha := Group{Key: "alpha"}
+	beta := Group{Key: "beta"}
+	a := NewStaticAuthorizer(Config{
+		GroupsByClientID: map[core.ClientID][]Group{alice: {beta, alpha}},
+		UpstreamGroupsByGroup: map[Group][]UpstreamGroup{
+			alpha: {{Key: "worker"}, {Key: "web"}},
+			beta:  {{Key: "web"}},
+		},
+	})
+	ctx := context.Background()
+
+	groups, err := a.UpstreamGroups(ctx, alice)
+	require.NoError(t, err)
+	require.Equal(t, []string{"web", "worker"}, groups)
+	groups, err = a.UpstreamGroups(ctx, bob)
+	require.NoError(t, err)
+	require.Empty(t, groups)
+}
+
+func TestAuthorizerSetUpstreamGroup(t *testing.T) {
+	alice := DummyClientID("alice")
+	alpha := Group{Key: "alpha"}
+	web := UpstreamGroup{Key: "web"}
+	web1 := DummyUpstream("web1")
+	web2 := DummyUpstream("web2")
+
+	authorizer := NewStaticAuthorizer(Config{
+		GroupsByClientID:      map[core.ClientID][]Group{alice: {alpha}},
+		UpstreamGroupsByGroup: map[Group][]UpstreamGroup{alpha: {web}},
+	})
+	upstreams, err := authorizer.AuthorizedUpstreams(context.Background(), alice)
+	require.NoError(t, err)
+	require.Empty(t, upstreams)
+
+	authorizer.SetUpstreamGroup(web, core.NewUpstreamSet(web1))
+	authorizer.SetUpstreamGroup(web, core.NewUpstreamSet(web2))
+	upstreams, err = authorizer.AuthorizedUpstreams(context.Background(), alice)
+	require.NoError(t, err)
+	require.Equal(t, core.NewUpstreamSet(web2), upstreams)
+}
+
+func TestAuthorizerGeoPolicies(t *testing.T) {
+	alice := DummyClientID("alice")
+	alpha := Group{Key: "alpha"}
+	web, eu := UpstreamGroup{Key: "web"}, UpstreamGroup{Key: "eu"}
+	web1, eu1 := DummyUpstream("web1"), DummyUpstream("eu1")
+
+	authorizer := NewCachingAuthorizer(Config{
+		GroupsByClientID:      map[core.ClientID][]Group{alice: {alpha}},
+		UpstreamGroupsByGroup: map[Group][]UpstreamGroup{alpha: {web, eu}},
+		UpstreamsByUpstreamGroup: map[UpstreamGroup]core.UpstreamSet{
+			web: core.NewUpstreamSet(web1),
+			eu:  core.NewUpstreamSet(eu1),
+		},
+		GeoPoliciesByUpstreamGroup: map[UpstreamGroup]geoip.Policy{eu: {AllowCountries: []string{"DE", "FR"}}},
+	}, CacheConfig{MaxClients: 10}, nil)
+	authorized := func(ctx context.Context) core.UpstreamSet {
+		upstreams, err := authorizer.AuthorizedUpstreams(ctx, alice)
+		require.NoError(t, err)
+		return upstreams
+	}
+
+	// Clients located where the policy allows are granted the group.
+	require.Equal(t, core.NewUpstreamSet(web1, eu1), authorized(geoip.NewContextWithLocation(context.Background(), geoip.Location{Country: "DE"})))
+	// Others, including clients of unknown location, are not, even once
+	// the upstreams of the client are cached.
+	require.Equal(t, core.NewUpstreamSet(web1), authorized(geoip.NewContextWithLocation(context.Background(), geoip.Location{Country: "US"})))
+	require.Equal(t, core.NewUpstreamSet(web1), authorized(context.Background()))
+	require.Equal(t, core.NewUpstreamSet(web1, eu1), authorized(geoip.NewContextWithLocation(context.Background(), geoip.Location{Country: "FR"})))
+}
+
+func TestAuthorizerFingerprints(t *testing.T) {
+	alice := DummyClientID("alice")
+	alpha := Group{Key: "alpha"}
+	web, admin := UpstreamGroup{Key: "web"}, UpstreamGroup{Key: "admin"}
+	web1, admin1 := DummyUpstream("web1"), DummyUpstream("admin1")
+
+	authorizer := NewCachingAuthorizer(Config{
+		GroupsByClientID:      map[core.ClientID][]Group{alice: {alpha}},
+		UpstreamGroupsByGroup: map[Group][]UpstreamGroup{alpha: {web, admin}},
+		UpstreamsByUpstreamGroup: map[UpstreamGroup]core.UpstreamSet{
+			web:   core.NewUpstreamSet(web1),
+			admin: core.NewUpstreamSet(admin1),
+		},
+		FingerprintsByUpstreamGroup: map[UpstreamGroup]map[string]bool{admin: {"t13d1516h2_8daaf6152771_e5627efa2ab1": true}},
+	}, CacheConfig{MaxClients: 10}, nil)
+	authorized := func(ctx context.Context) core.UpstreamSet {
+		upstreams, err := authorizer.AuthorizedUpstreams(ctx, alice)
+		require.NoError(t, err)
+		return upstreams
+	}
+
+	// Clients running the listed software are granted the group. Others,
+	// including clients that were not fingerprinted, are not.
+	require.Equal(t, core.NewUpstreamSet(web1, admin1), authorized(core.NewContextWithTLSFingerprint(context.Background(), "t13d1516h2_8daaf6152771_e5627efa2ab1")))
+	require.Equal(t, core.NewUpstreamSet(web1), authorized(core.NewContextWithTLSFingerprint(context.Background(), "t13d1715h2_5b57614c22b0_3d5424432f57")))
+	require.Equal(t, core.NewUpstreamSet(web1), authorized(context.Background()))
+}
+
+func TestCachingAuthorizer(t *testing.T) {
+	ctx := context.Background()
+	alice := DummyClientID("alice")
+	bob := DummyClientID("bob")
+	alpha := Group{Key: "alpha"}
+	web := UpstreamGroup{Key: "web"}
+	web1 := DummyUpstream("web1")
+	web2 := DummyUpstream("web2")
+	config := Config{
+		GroupsByClientID:         map[core.ClientID][]Group{alice: {alpha}, bob: {alpha}},
+		UpstreamGroupsByGroup:    map[Group][]UpstreamGroup{alpha: {web}},
+		UpstreamsByUpstreamGroup: map[UpstreamGroup]core.UpstreamSet{web: core.NewUpstreamSet(web1)},
+	}
+
+	fakeClock := clock.NewFake(time.Unix(0, 0))
+	m := NewCacheMetrics(metrics.NewRegistry())
+	authorizer := NewCachingAuthorizer(config, CacheConfig{MaxClients: 1, TTL: time.Minute, Clock: fakeClock}, m)
+
+	authorize := func(c core.ClientID) core.UpstreamSet {
+		upstreams, err := authorizer.AuthorizedUpstreams(ctx, c)
+		require.NoError(t, err)
+		return upstreams
+	}
+
+	require.Equal(t, core.NewUpstreamSet(web1), authorize(alice))
+	require.Equal(t, core.NewUpstreamSet(web1), authorize(alice))
+	require.Equal(t, int64(1), m.Misses.Value())
+	require.Equal(t, int64(1), m.Hits.Value())
+	require.Equal(t, int64(1), m.Size.Value())
+
+	// Caching bob evicts alice, as only one client fits.
+	require.Equal(t, core.NewUpstreamSet(web1), authorize(bob))
+	require.Equal(t, int64(1), m.Evictions.Value())
+	require.Equal(t, int64(1), m.Size.Value())
+	authorize(alice)
+	require.Equal(t, int64(3), m.Misses.Value())
+
+	// Cached upstreams expire after the TTL.
+	fakeClock.Advance(time.Minute)
+	authorize(alice)
+	require.Equal(t, int64(4), m.Misses.Value())
+	require.Equal(t, int64(2), m.Evictions.Value())
+
+	// Changing the policy invalidates the cache at once.
+	authorizer.SetUpstreamGroup(web, core.NewUpstreamSet(web2))
+	require.Equal(t, int64(1), m.Invalidations.Value())
+	require.Equal(t, int64(0), m.Size.Value())
+	require.Equal(t, core.NewUpstreamSet(web2), authorize(alice))
+	require.Equal(t, int64(5), m.Misses.Value())
+}
+
+func TestStaticAuthorizerDoesNotCache(t *testing.T) {
+	alice := DummyClientID("alice")
+	alpha := Group{Key: "alpha"}
+	web := UpstreamGroup{Key: "web"}
+
+	authorizer := NewStaticAuthorizer(Config{
+		GroupsByClientID:      map[core.ClientID][]Group{alice: {alpha}},
+		UpstreamGroupsByGroup: map[Group][]UpstreamGroup{alpha: {web}},
+	})
+	_, err := authorizer.AuthorizedUpstreams(context.Background(), alice)
+	require.NoError(t, err)
+	require.Empty(t, authorizer.cached)
+}
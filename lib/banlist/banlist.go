@@ -0,0 +1,114 @@
+// Package banlist tracks failures, such as failed TLS handshakes, by the
+// source IP address of client connections, and temporarily bans sources
+// that fail repeatedly.
+package banlist
+
+import (
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// Config configures a List.
+type Config struct {
+	// Threshold is the number of failures within Window after which a
+	// source is banned.
+	Threshold int
+	// Window is the period over which failures are counted.
+	Window time.Duration
+	// Duration is how long a source stays banned. Bans expire automatically.
+	Duration time.Duration
+}
+
+type sourceState struct {
+	windowStart time.Time // windowStart is when the current failure counting window began.
+	failures    int
+	bannedUntil time.Time
+}
+
+// List tracks failures by source IP address, and bans sources that fail
+// Threshold times within Window, for Duration.
+//
+// Multiple goroutines may invoke methods on a List simultaneously.
+type List struct {
+	cfg Config
+	now func() time.Time
+
+	mu        sync.Mutex // mu guards sources and lastSweep
+	sources   map[netip.Addr]*sourceState
+	lastSweep time.Time
+}
+
+// New returns an empty List configured by cfg.
+func New(cfg Config) *List {
+	return &List{
+		cfg:     cfg,
+		now:     time.Now,
+		sources: make(map[netip.Addr]*sourceState),
+	}
+}
+
+// sweepLocked forgets sources that are neither banned nor within a failure
+// counting window, at most once per Window, so that memory use is bounded
+// by the number of recently failing sources.
+func (l *List) sweepLocked(now time.Time) {
+	if now.Sub(l.lastSweep) < l.cfg.Window {
+		return
+	}
+	l.lastSweep = now
+	for addr, s := range l.sources {
+		if now.After(s.bannedUntil) && now.Sub(s.windowStart) >= l.cfg.Window {
+			delete(l.sources, addr)
+		}
+	}
+}
+
+// RecordFailure records a failure by the source addr, and reports if the
+// source is now banned.
+func (l *List) RecordFailure(addr netip.Addr) (banned bool) {
+	addr = addr.Unmap()
+	now := l.now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.sweepLocked(now)
+	s, ok := l.sources[addr]
+	if !ok {
+		s = &sourceState{windowStart: now}
+		l.sources[addr] = s
+	}
+	if now.Before(s.bannedUntil) {
+		return true
+	}
+	if now.Sub(s.windowStart) >= l.cfg.Window {
+		s.windowStart, s.failures = now, 0
+	}
+	s.failures++
+	if s.failures < l.cfg.Threshold {
+		return false
+	}
+	s.bannedUntil = now.Add(l.cfg.Duration)
+	s.windowStart, s.failures = now, 0
+	return true
+}
+
+// Banned reports if the source addr is currently banned.
+func (l *List) Banned(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	now := l.now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	s, ok := l.sources[addr]
+	return ok && now.Before(s.bannedUntil)
+}
+
+// AllowConn reports if the connection from remote should be served, i.e.
+// its source is not banned. Sources that are not IP addresses are never
+// banned.
+func (l *List) AllowConn(remote net.Addr) bool {
+	tcpAddr, ok := remote.(*net.TCPAddr)
+	if !ok {
+		return true
+	}
+	return !l.Banned(tcpAddr.AddrPort().Addr())
+}
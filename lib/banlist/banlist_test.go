@@ -0,0 +1,74 @@
+package banlist
+
+import (
+	"github.com/stretchr/testify/require"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+type fakeClock struct {
+	t time.Time
+}
+
+func (c *fakeClock) Now() time.Time { return c.t }
+
+func newTestList(cfg Config) (*List, *fakeClock) {
+	clock := &fakeClock{t: time.Unix(1000, 0)}
+	l := New(cfg)
+	l.now = clock.Now
+	return l, clock
+}
+
+func TestListBansAfterThreshold(t *testing.T) {
+	l, clock := newTestList(Config{Threshold: 3, Window: time.Minute, Duration: 10 * time.Minute})
+	addr := netip.MustParseAddr("192.0.2.1")
+	other := netip.MustParseAddr("192.0.2.2")
+
+	require.False(t, l.RecordFailure(addr))
+	require.False(t, l.RecordFailure(addr))
+	require.False(t, l.Banned(addr))
+	require.True(t, l.RecordFailure(addr))
+	require.True(t, l.Banned(addr))
+	require.False(t, l.Banned(other))
+
+	// IPv4-mapped IPv6 addresses are the same source.
+	require.True(t, l.Banned(netip.MustParseAddr("::ffff:192.0.2.1")))
+
+	// Bans expire.
+	clock.t = clock.t.Add(10*time.Minute + time.Second)
+	require.False(t, l.Banned(addr))
+}
+
+func TestListForgetsFailuresOutsideWindow(t *testing.T) {
+	l, clock := newTestList(Config{Threshold: 2, Window: time.Minute, Duration: time.Minute})
+	addr := netip.MustParseAddr("2001:db8::1")
+
+	require.False(t, l.RecordFailure(addr))
+	clock.t = clock.t.Add(time.Minute)
+	require.False(t, l.RecordFailure(addr))
+	require.False(t, l.Banned(addr))
+	require.True(t, l.RecordFailure(addr))
+}
+
+func TestListSweepsIdleSources(t *testing.T) {
+	l, clock := newTestList(Config{Threshold: 5, Window: time.Minute, Duration: time.Minute})
+	for i := 0; i < 10; i++ {
+		l.RecordFailure(netip.AddrFrom4([4]byte{192, 0, 2, byte(i)}))
+	}
+	require.Len(t, l.sources, 10)
+	clock.t = clock.t.Add(2 * time.Minute)
+	l.RecordFailure(netip.MustParseAddr("198.51.100.1"))
+	require.Len(t, l.sources, 1)
+}
+
+func TestListAllowConn(t *testing.T) {
+	l, _ := newTestList(Config{Threshold: 1, Window: time.Minute, Duration: time.Minute})
+	banned := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 1234}
+	require.True(t, l.AllowConn(banned))
+	l.RecordFailure(netip.MustParseAddr("192.0.2.1"))
+	require.False(t, l.AllowConn(banned))
+	require.True(t, l.AllowConn(&net.TCPAddr{IP: net.ParseIP("192.0.2.2"), Port: 1234}))
+	require.True(t, l.AllowConn(&net.UnixAddr{Name: "sock", Net: "unix"}))
+}
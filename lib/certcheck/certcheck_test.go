@@ -0,0 +1,142 @@
+package certcheck
+
+import (
+	"crypto/x509"
+	"os"
+	"path/filepath"
+	"strings"
+	"tcplb/lib/clock"
+	"tcplb/lib/testbed"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// requireFinding requires that r has a finding of the given severity whose
+// message contains msg.
+func requireFinding(t *testing.T, r *Report, severity Severity, msg string) {
+	t.Helper()
+	for _, f := range r.Findings {
+		if f.Severity == severity && strings.Contains(f.Message, msg) {
+			if severity != SeverityOK {
+				require.NotEmpty(t, f.Hint, f.Message)
+			}
+			return
+		}
+	}
+	require.Failf(t, "finding not found", "no %s finding %q in %+v", severity, msg, r.Findings)
+}
+
+// concat writes the contents of paths, in order, to a new file in dir.
+func concat(t *testing.T, dir, name string, paths ...string) string {
+	var data []byte
+	for _, path := range paths {
+		b, err := os.ReadFile(path)
+		require.NoError(t, err)
+		data = append(data, b...)
+	}
+	path := filepath.Join(dir, name)
+	require.NoError(t, os.WriteFile(path, data, 0600))
+	return path
+}
+
+func TestCheckKeyPair(t *testing.T) {
+	tb := testbed.New(t)
+	server := tb.Server(t, "server")
+	other := tb.Server(t, "other")
+	client := tb.Client(t, "alice")
+	checker := &Checker{ExpiryWarning: time.Hour, Roots: tb.CertPool()}
+
+	r := checker.CheckKeyPair("server", server.CertFile, server.KeyFile, x509.ExtKeyUsageServerAuth)
+	require.True(t, r.OK(), r.Findings)
+	require.False(t, r.Warnings(), r.Findings)
+	require.Len(t, r.Certificates, 1)
+	require.Equal(t, "ECDSA-P-256", r.Certificates[0].KeyAlgorithm)
+	require.Equal(t, []string{"server", "localhost"}, r.Certificates[0].DNSNames)
+	requireFinding(t, r, SeverityOK, "private key matches the certificate")
+	requireFinding(t, r, SeverityOK, "issued by a trusted root")
+
+	// Without the root, the chain is incomplete.
+	r = (&Checker{ExpiryWarning: time.Hour, Roots: x509.NewCertPool()}).CheckKeyPair("server", server.CertFile, server.KeyFile, x509.ExtKeyUsageServerAuth)
+	require.True(t, r.OK(), r.Findings)
+	requireFinding(t, r, SeverityWarning, "chain may be incomplete")
+	// Unless the file includes it.
+	chain := concat(t, tb.Root, "chain.pem", server.CertFile, tb.CAFile)
+	r = (&Checker{ExpiryWarning: time.Hour, Roots: x509.NewCertPool()}).CheckKeyPair("server", chain, server.KeyFile, x509.ExtKeyUsageServerAuth)
+	require.False(t, r.Warnings(), r.Findings)
+	requireFinding(t, r, SeverityOK, "ends in root")
+
+	// Testbed certificates expire within a day.
+	r = (&Checker{Roots: tb.CertPool()}).CheckKeyPair("server", server.CertFile, server.KeyFile, x509.ExtKeyUsageServerAuth)
+	requireFinding(t, r, SeverityWarning, "expires at")
+	c := clock.NewFake(time.Now().Add(48 * time.Hour))
+	r = (&Checker{Roots: tb.CertPool(), Clock: c}).CheckKeyPair("server", server.CertFile, server.KeyFile, x509.ExtKeyUsageServerAuth)
+	require.False(t, r.OK())
+	requireFinding(t, r, SeverityError, "expired at")
+
+	for _, tc := range []struct {
+		name     string
+		certFile string
+		keyFile  string
+		usage    x509.ExtKeyUsage
+		msg      string
+	}{
+		{"mismatched key", server.CertFile, other.KeyFile, x509.ExtKeyUsageServerAuth, "private key does not match"},
+		{"swapped files", server.KeyFile, server.CertFile, x509.ExtKeyUsageServerAuth, "no certificates found"},
+		{"cert as key", server.CertFile, server.CertFile, x509.ExtKeyUsageServerAuth, "no PEM private key found"},
+		{"missing file", filepath.Join(tb.Root, "missing.pem"), server.KeyFile, x509.ExtKeyUsageServerAuth, "cannot read"},
+		{"client cert as server", client.CertFile, client.KeyFile, x509.ExtKeyUsageServerAuth, "may not be used for serverAuth"},
+		{"out of order", concat(t, tb.Root, "reversed.pem", tb.CAFile, server.CertFile), server.KeyFile, x509.ExtKeyUsageServerAuth, "is not issued by certificate 1"},
+		{"unrelated intermediate", concat(t, tb.Root, "unrelated.pem", server.CertFile, other.CertFile), server.KeyFile, x509.ExtKeyUsageServerAuth, "is not issued by certificate 1"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r := checker.CheckKeyPair(tc.name, tc.certFile, tc.keyFile, tc.usage)
+			require.False(t, r.OK())
+			requireFinding(t, r, SeverityError, tc.msg)
+		})
+	}
+
+	r = checker.CheckKeyPair("client", client.CertFile, client.KeyFile, x509.ExtKeyUsageClientAuth)
+	require.True(t, r.OK(), r.Findings)
+}
+
+func TestCheckCABundle(t *testing.T) {
+	tb := testbed.New(t)
+	server := tb.Server(t, "server")
+	checker := &Checker{ExpiryWarning: time.Hour}
+
+	r := checker.CheckCABundle("client CA", tb.CAFile)
+	require.True(t, r.OK(), r.Findings)
+	require.False(t, r.Warnings(), r.Findings)
+	require.True(t, r.Certificates[0].IsCA)
+
+	r = checker.CheckCABundle("client CA", server.CertFile)
+	require.True(t, r.OK(), r.Findings)
+	requireFinding(t, r, SeverityWarning, "is not a CA certificate")
+
+	r = checker.CheckCABundle("client CA", server.KeyFile)
+	require.False(t, r.OK())
+	requireFinding(t, r, SeverityError, "no certificates found")
+}
+
+func TestCheckIssuedBy(t *testing.T) {
+	tb := testbed.New(t)
+	otherCA := testbed.New(t)
+	client := tb.Client(t, "alice")
+	server := tb.Server(t, "server")
+	checker := &Checker{ExpiryWarning: time.Hour}
+
+	r := checker.CheckIssuedBy("client", client.CertFile, tb.CAFile, x509.ExtKeyUsageClientAuth)
+	require.True(t, r.OK(), r.Findings)
+	requireFinding(t, r, SeverityOK, "is verified by the CAs")
+	requireFinding(t, r, SeverityOK, `identifies client "alice"`)
+
+	r = checker.CheckIssuedBy("client", client.CertFile, otherCA.CAFile, x509.ExtKeyUsageClientAuth)
+	require.False(t, r.OK())
+	requireFinding(t, r, SeverityError, "is not verified by the CAs")
+
+	r = checker.CheckIssuedBy("client", server.CertFile, tb.CAFile, x509.ExtKeyUsageClientAuth)
+	require.False(t, r.OK())
+	requireFinding(t, r, SeverityError, "may not be used for clientAuth")
+}
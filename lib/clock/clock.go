@@ -0,0 +1,290 @@
+// Package clock abstracts the passage of time, so that code that waits on
+// timers and tickers can be tested with a Fake clock instead of real sleeps.
+package clock
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Clock tells the time, and creates timers and tickers that fire as it
+// passes.
+//
+// Multiple goroutines may invoke methods on a Clock simultaneously.
+type Clock interface {
+	Now() time.Time
+	// NewTimer returns a Timer that sends the time on its channel once d
+	// has passed.
+	NewTimer(d time.Duration) Timer
+	// NewTicker returns a Ticker that sends the time on its channel each
+	// time d passes. d must be positive.
+	NewTicker(d time.Duration) Ticker
+	// AfterFunc returns a Timer that calls f in its own goroutine once d
+	// has passed. The Timer's channel is nil.
+	AfterFunc(d time.Duration, f func()) Timer
+}
+
+// Timer is a single event, as with time.Timer.
+type Timer interface {
+	C() <-chan time.Time
+	// Stop prevents the Timer from firing. It returns false if the Timer
+	// already fired or was stopped.
+	Stop() bool
+}
+
+// Ticker is a recurring event, as with time.Ticker.
+type Ticker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+// Real is the Clock of the system, backed by the time package.
+type Real struct{}
+
+func (Real) Now() time.Time {
+	return time.Now()
+}
+
+func (Real) NewTimer(d time.Duration) Timer {
+	return realTimer{time.NewTimer(d)}
+}
+
+func (Real) NewTicker(d time.Duration) Ticker {
+	return realTicker{time.NewTicker(d)}
+}
+
+func (Real) AfterFunc(d time.Duration, f func()) Timer {
+	return realTimer{time.AfterFunc(d, f)}
+}
+
+var _ Clock = Real{} // type check
+
+type realTimer struct {
+	t *time.Timer
+}
+
+func (t realTimer) C() <-chan time.Time { return t.t.C }
+func (t realTimer) Stop() bool          { return t.t.Stop() }
+
+type realTicker struct {
+	t *time.Ticker
+}
+
+func (t realTicker) C() <-chan time.Time { return t.t.C }
+func (t realTicker) Stop()               { t.t.Stop() }
+
+// Or returns c, or the Real clock if c is nil, so that a Clock can be an
+// optional field.
+func Or(c Clock) Clock {
+	if c == nil {
+		return Real{}
+	}
+	return c
+}
+
+// WithTimeout returns a copy of ctx that is cancelled once d has passed by
+// clock c, as by context.WithTimeout. Once it times out, Err returns
+// context.DeadlineExceeded.
+func WithTimeout(ctx context.Context, c Clock, d time.Duration) (context.Context, context.CancelFunc) {
+	if _, ok := Or(c).(Real); ok {
+		return context.WithTimeout(ctx, d)
+	}
+	inner, cancel := context.WithCancel(ctx)
+	t := &timeoutContext{Context: inner, deadline: c.Now().Add(d)}
+	timer := c.AfterFunc(d, func() {
+		t.mu.Lock()
+		if t.Context.Err() == nil {
+			t.expired = true
+		}
+		t.mu.Unlock()
+		cancel()
+	})
+	return t, func() {
+		timer.Stop()
+		cancel()
+	}
+}
+
+// timeoutContext is a context that times out by a Clock other than Real.
+type timeoutContext struct {
+	context.Context
+	deadline time.Time
+
+	mu      sync.Mutex // mu guards expired.
+	expired bool
+}
+
+func (t *timeoutContext) Deadline() (time.Time, bool) {
+	if parent, ok := t.Context.Deadline(); ok && parent.Before(t.deadline) {
+		return parent, true
+	}
+	return t.deadline, true
+}
+
+func (t *timeoutContext) Err() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.expired {
+		return context.DeadlineExceeded
+	}
+	return t.Context.Err()
+}
+
+// Fake is a Clock whose time passes only when it is advanced, by Advance,
+// firing any timers and tickers that fall due. It lets tests of code that
+// waits on timers run deterministically, without real sleeps.
+//
+// Multiple goroutines may invoke methods on a Fake simultaneously.
+type Fake struct {
+	mu      sync.Mutex
+	cond    *sync.Cond // cond is broadcast when waiters change.
+	now     time.Time
+	waiters []*fakeWaiter // waiters are the pending timers and tickers.
+}
+
+// NewFake returns a Fake clock that reads now until advanced.
+func NewFake(now time.Time) *Fake {
+	f := &Fake{now: now}
+	f.cond = sync.NewCond(&f.mu)
+	return f
+}
+
+// fakeWaiter is a timer or ticker of a Fake clock.
+type fakeWaiter struct {
+	clock  *Fake
+	due    time.Time
+	period time.Duration // period is the period of a ticker, or 0 for a timer.
+	c      chan time.Time
+	f      func() // f is the function of a timer created by AfterFunc.
+}
+
+func (f *Fake) Now() time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.now
+}
+
+func (f *Fake) NewTimer(d time.Duration) Timer {
+	return fakeTimer{f.add(&fakeWaiter{due: f.Now().Add(d), c: make(chan time.Time, 1)})}
+}
+
+func (f *Fake) NewTicker(d time.Duration) Ticker {
+	if d <= 0 {
+		panic("clock: non-positive interval for NewTicker")
+	}
+	return fakeTicker{f.add(&fakeWaiter{due: f.Now().Add(d), period: d, c: make(chan time.Time, 1)})}
+}
+
+func (f *Fake) AfterFunc(d time.Duration, fn func()) Timer {
+	return fakeTimer{f.add(&fakeWaiter{due: f.Now().Add(d), f: fn})}
+}
+
+func (f *Fake) add(w *fakeWaiter) *fakeWaiter {
+	w.clock = f
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if w.period == 0 && !w.due.After(f.now) {
+		// As with time.NewTimer, a timer that is already due fires at once.
+		w.fire(f.now)
+		return w
+	}
+	f.waiters = append(f.waiters, w)
+	f.cond.Broadcast()
+	return w
+}
+
+// Advance moves the time forward by d, firing, in order, each timer and
+// tick that falls due.
+func (f *Fake) Advance(d time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	end := f.now.Add(d)
+	for {
+		sort.SliceStable(f.waiters, func(i, j int) bool { return f.waiters[i].due.Before(f.waiters[j].due) })
+		if len(f.waiters) == 0 || f.waiters[0].due.After(end) {
+			break
+		}
+		w := f.waiters[0]
+		if w.due.After(f.now) {
+			f.now = w.due
+		}
+		if w.period > 0 {
+			w.due = w.due.Add(w.period)
+		} else {
+			f.waiters = f.waiters[1:]
+		}
+		w.fire(f.now)
+	}
+	f.now = end
+	f.cond.Broadcast()
+}
+
+// BlockUntil blocks until at least n timers and tickers are pending, e.g. so
+// that a test advances the clock only once the code under test waits on it.
+func (f *Fake) BlockUntil(n int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for len(f.waiters) < n {
+		f.cond.Wait()
+	}
+}
+
+// Pending returns the number of timers and tickers pending.
+func (f *Fake) Pending() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.waiters)
+}
+
+// remove removes w from the pending waiters, and reports if it was pending.
+func (f *Fake) remove(w *fakeWaiter) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for i, pending := range f.waiters {
+		if pending == w {
+			f.waiters = append(f.waiters[:i], f.waiters[i+1:]...)
+			f.cond.Broadcast()
+			return true
+		}
+	}
+	return false
+}
+
+// fire fires w at now. As with time.Ticker, ticks are dropped if the
+// receiver has not kept up.
+func (w *fakeWaiter) fire(now time.Time) {
+	if w.f != nil {
+		go w.f()
+		return
+	}
+	select {
+	case w.c <- now:
+	default:
+	}
+}
+
+func (w *fakeWaiter) C() <-chan time.Time {
+	return w.c
+}
+
+type fakeTimer struct {
+	*fakeWaiter
+}
+
+func (t fakeTimer) Stop() bool {
+	return t.clock.remove(t.fakeWaiter)
+}
+
+type fakeTicker struct {
+	*fakeWaiter
+}
+
+func (t fakeTicker) Stop() {
+	t.clock.remove(t.fakeWaiter)
+}
+
+var _ Clock = (*Fake)(nil)  // type check
+var _ Timer = fakeTimer{}   // type check
+var _ Ticker = fakeTicker{} // type check
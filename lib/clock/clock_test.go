@@ -0,0 +1,86 @@
+package clock
+
+import (
+	"context"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+var epoch = time.Unix(1000, 0)
+
+func TestFakeTimerFiresOnceDue(t *testing.T) {
+	c := NewFake(epoch)
+	timer := c.NewTimer(time.Second)
+
+	c.Advance(999 * time.Millisecond)
+	require.Len(t, timer.C(), 0)
+	c.Advance(time.Millisecond)
+	require.Equal(t, epoch.Add(time.Second), <-timer.C())
+	require.Equal(t, 0, c.Pending())
+	require.False(t, timer.Stop())
+}
+
+func TestFakeTimerAlreadyDueFiresAtOnce(t *testing.T) {
+	c := NewFake(epoch)
+	timer := c.NewTimer(0)
+	require.Equal(t, epoch, <-timer.C())
+	require.Equal(t, 0, c.Pending())
+}
+
+func TestFakeTimerStop(t *testing.T) {
+	c := NewFake(epoch)
+	timer := c.NewTimer(time.Second)
+	require.True(t, timer.Stop())
+	c.Advance(time.Minute)
+	require.Len(t, timer.C(), 0)
+}
+
+func TestFakeTickerTicksEachPeriod(t *testing.T) {
+	c := NewFake(epoch)
+	ticker := c.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	var ticks []time.Time
+	for i := 0; i < 3; i++ {
+		c.Advance(time.Second)
+		ticks = append(ticks, <-ticker.C())
+	}
+	require.Equal(t, []time.Time{epoch.Add(time.Second), epoch.Add(2 * time.Second), epoch.Add(3 * time.Second)}, ticks)
+
+	// As with time.Ticker, ticks are dropped if the receiver falls behind.
+	c.Advance(5 * time.Second)
+	require.Equal(t, epoch.Add(4*time.Second), <-ticker.C())
+	require.Len(t, ticker.C(), 0)
+	require.Equal(t, epoch.Add(8*time.Second), c.Now())
+}
+
+func TestFakeAfterFuncAndBlockUntil(t *testing.T) {
+	c := NewFake(epoch)
+	called := make(chan time.Time)
+	go func() {
+		c.AfterFunc(time.Minute, func() { called <- c.Now() })
+	}()
+	c.BlockUntil(1)
+	c.Advance(time.Hour)
+	require.Equal(t, epoch.Add(time.Hour), <-called)
+}
+
+func TestWithTimeout(t *testing.T) {
+	c := NewFake(epoch)
+	ctx, cancel := WithTimeout(context.Background(), c, time.Second)
+	defer cancel()
+	deadline, ok := ctx.Deadline()
+	require.True(t, ok)
+	require.Equal(t, epoch.Add(time.Second), deadline)
+	require.NoError(t, ctx.Err())
+
+	c.Advance(time.Second)
+	<-ctx.Done()
+	require.ErrorIs(t, ctx.Err(), context.DeadlineExceeded)
+
+	ctx, cancel = WithTimeout(context.Background(), c, time.Second)
+	cancel()
+	require.ErrorIs(t, ctx.Err(), context.Canceled)
+	require.Equal(t, 0, c.Pending())
+}
@@ -0,0 +1,388 @@
+// Package conntable maintains a registry of live client connections, so
+// operators can see who is connected right now and forcibly terminate
+// individual connections.
+//
+// Connections are classified as idle once forwarding has started and no
+// data has been forwarded in either direction for the Table's IdleAfter, so
+// that operators, and eviction and drain logic, can prefer to terminate
+// connections that are not doing anything. Connections that are still being
+// authenticated or dialed are never idle.
+//
+// Handlers record details of a connection as it moves through the handler
+// stack by updating the Entry stored in the connection's context. All
+// methods of a nil *Entry are no-ops, so handlers need not check whether
+// a connection table is in use.
+package conntable
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"tcplb/lib/clock"
+	"tcplb/lib/core"
+	"time"
+)
+
+var NoSuchConnection = errors.New("no such connection")
+
+// ID identifies a connection within a Table.
+type ID uint64
+
+// Info is a point-in-time snapshot of a live connection.
+type Info struct {
+	ID              ID             `json:"id"`
+	SourceAddr      string         `json:"source_addr"`
+	ClientID        *core.ClientID `json:"clientid,omitempty"`
+	Upstream        *core.Upstream `json:"upstream,omitempty"`
+	Started         time.Time      `json:"started"`
+	BytesFromClient int64          `json:"bytes_from_client"`
+	BytesToClient   int64          `json:"bytes_to_client"`
+	LastActive      time.Time      `json:"last_active"` // LastActive is when data was last forwarded in either direction, or else when forwarding, or the connection, started.
+	Idle            bool           `json:"idle"`        // Idle is set if the connection has been forwarding, but inactive, for at least the Table's IdleAfter.
+}
+
+// Entry is the Table's record of a single live connection.
+//
+// Multiple goroutines may invoke methods on an Entry simultaneously.
+type Entry struct {
+	id         ID
+	sourceAddr string
+	started    time.Time
+	terminate  func()
+	table      *Table
+
+	bytesFromClient int64 // accessed atomically
+	bytesToClient   int64 // accessed atomically
+	lastActive      int64 // lastActive is LastActive in Unix nanoseconds, accessed atomically.
+	forwarding      int32 // forwarding is set once forwarding starts, accessed atomically.
+
+	mu       sync.Mutex // mu guards clientID, upstream, evict, drain and drained
+	clientID *core.ClientID
+	upstream *core.Upstream
+	evict    func(grace time.Duration)
+	drain    func(grace time.Duration)
+	drained  bool // drained is set once the connection is drained, so that it is drained only once.
+}
+
+// ID returns the ID of the connection. If e is nil, zero is returned.
+func (e *Entry) ID() ID {
+	if e == nil {
+		return 0
+	}
+	return e.id
+}
+
+// SetClientID records the authenticated ClientID of the connection.
+func (e *Entry) SetClientID(c core.ClientID) {
+	if e == nil {
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.clientID = &c
+}
+
+// SetEvict records how to evict the connection gracefully. evict must stop
+// sending to the client at once, and close the connection once grace has
+// passed, without blocking. If no evict func is set, evicting the
+// connection terminates it.
+func (e *Entry) SetEvict(evict func(grace time.Duration)) {
+	if e == nil {
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.evict = evict
+}
+
+// SetDrain records how to close the connection gracefully when the server
+// drains. Like evict, drain must stop sending to the client at once, and
+// close the connection once grace has passed, without blocking. If no
+// drain func is set, draining the connection terminates it.
+func (e *Entry) SetDrain(drain func(grace time.Duration)) {
+	if e == nil {
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.drain = drain
+}
+
+// SetUpstream records the upstream the connection is forwarded to.
+func (e *Entry) SetUpstream(u core.Upstream) {
+	if e == nil {
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.upstream = &u
+}
+
+// StartForwarding records that forwarding of the connection has started,
+// after which it may be classified as idle.
+func (e *Entry) StartForwarding() {
+	if e == nil {
+		return
+	}
+	atomic.StoreInt64(&e.lastActive, e.table.clock.Now().UnixNano())
+	atomic.StoreInt32(&e.forwarding, 1)
+}
+
+// AddBytesFromClient increments the count of bytes forwarded from the
+// client, and marks the connection as active.
+func (e *Entry) AddBytesFromClient(n int64) {
+	if e == nil {
+		return
+	}
+	atomic.AddInt64(&e.bytesFromClient, n)
+	e.markActive(n)
+}
+
+// AddBytesToClient increments the count of bytes forwarded to the client,
+// and marks the connection as active.
+func (e *Entry) AddBytesToClient(n int64) {
+	if e == nil {
+		return
+	}
+	atomic.AddInt64(&e.bytesToClient, n)
+	e.markActive(n)
+}
+
+func (e *Entry) markActive(n int64) {
+	if n <= 0 {
+		return
+	}
+	atomic.StoreInt64(&e.lastActive, e.table.clock.Now().UnixNano())
+}
+
+// Info returns a snapshot of the connection.
+func (e *Entry) Info() Info {
+	lastActive := time.Unix(0, atomic.LoadInt64(&e.lastActive))
+	idleAfter := e.table.cfg.IdleAfter
+	forwarding := atomic.LoadInt32(&e.forwarding) != 0
+	idle := idleAfter > 0 && forwarding && e.table.clock.Now().Sub(lastActive) >= idleAfter
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return Info{
+		ID:              e.id,
+		SourceAddr:      e.sourceAddr,
+		ClientID:        e.clientID,
+		Upstream:        e.upstream,
+		Started:         e.started,
+		BytesFromClient: atomic.LoadInt64(&e.bytesFromClient),
+		BytesToClient:   atomic.LoadInt64(&e.bytesToClient),
+		LastActive:      lastActive,
+		Idle:            idle,
+	}
+}
+
+// Config configures a Table.
+type Config struct {
+	// IdleAfter is how long a connection must go without data forwarded
+	// in either direction to be classified as idle. If not positive, no
+	// connection is idle.
+	IdleAfter time.Duration
+	Clock     clock.Clock // Clock is optional. If nil, the Real clock is used.
+}
+
+// Table is a registry of live connections.
+//
+// Multiple goroutines may invoke methods on a Table simultaneously.
+type Table struct {
+	cfg   Config
+	clock clock.Clock
+
+	mu      sync.Mutex // mu guards lastID and entries
+	lastID  ID
+	entries map[ID]*Entry
+}
+
+// NewTable returns a new empty Table configured by cfg.
+func NewTable(cfg Config) *Table {
+	return &Table{cfg: cfg, clock: clock.Or(cfg.Clock), entries: make(map[ID]*Entry)}
+}
+
+// Register adds a new live connection from sourceAddr to the table. The
+// terminate func will be called if an operator terminates the connection.
+// It must cause the connection's handler to stop promptly, e.g. by closing
+// the client connection.
+//
+// The caller must Remove the entry once the connection is finished.
+func (t *Table) Register(sourceAddr string, started time.Time, terminate func()) *Entry {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.lastID++
+	e := &Entry{
+		id:         t.lastID,
+		sourceAddr: sourceAddr,
+		started:    started,
+		terminate:  terminate,
+		table:      t,
+		lastActive: started.UnixNano(),
+	}
+	t.entries[e.id] = e
+	return e
+}
+
+// Remove removes the entry for a finished connection from the table.
+func (t *Table) Remove(e *Entry) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.entries, e.id)
+}
+
+// Len returns the number of live connections.
+func (t *Table) Len() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.entries)
+}
+
+// List returns snapshots of all live connections, ordered by ID.
+func (t *Table) List() []Info {
+	t.mu.Lock()
+	entries := make([]*Entry, 0, len(t.entries))
+	for _, e := range t.entries {
+		entries = append(entries, e)
+	}
+	t.mu.Unlock()
+
+	result := make([]Info, len(entries))
+	for i, e := range entries {
+		result[i] = e.Info()
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].ID < result[j].ID })
+	return result
+}
+
+// Idle returns snapshots of the live connections that are idle, ordered
+// from the longest idle to the most recently active, so that callers that
+// must terminate some connections can start with those doing the least.
+func (t *Table) Idle() []Info {
+	result := []Info{}
+	for _, info := range t.List() {
+		if info.Idle {
+			result = append(result, info)
+		}
+	}
+	sort.SliceStable(result, func(i, j int) bool { return result[i].LastActive.Before(result[j].LastActive) })
+	return result
+}
+
+// TerminateIdle forcibly terminates every idle connection, and returns the
+// number terminated.
+func (t *Table) TerminateIdle() int {
+	idle := t.Idle()
+	for _, info := range idle {
+		// The connection may have finished since it was listed.
+		_ = t.Terminate(info.ID)
+	}
+	return len(idle)
+}
+
+// DrainIdle gracefully closes every idle connection that has not already
+// been drained, giving each grace to finish before it is closed, and
+// returns the number drained. The clients of drained connections are told
+// that the connection is closing, e.g. by a TLS close_notify alert, so
+// that well-behaved clients reconnect, perhaps to another server, rather
+// than wait for the connection to be cut.
+func (t *Table) DrainIdle(grace time.Duration) int {
+	n := 0
+	for _, info := range t.Idle() {
+		t.mu.Lock()
+		e, ok := t.entries[info.ID]
+		t.mu.Unlock()
+		if !ok {
+			// The connection finished since it was listed.
+			continue
+		}
+		e.mu.Lock()
+		drained, drain := e.drained, e.drain
+		e.drained = true
+		e.mu.Unlock()
+		if drained {
+			continue
+		}
+		if drain != nil {
+			drain(grace)
+		} else {
+			e.terminate()
+		}
+		n++
+	}
+	return n
+}
+
+// Get returns a snapshot of the connection with the given ID.
+// If there is no such connection, NoSuchConnection is returned.
+func (t *Table) Get(id ID) (Info, error) {
+	t.mu.Lock()
+	e, ok := t.entries[id]
+	t.mu.Unlock()
+	if !ok {
+		return Info{}, NoSuchConnection
+	}
+	return e.Info(), nil
+}
+
+// Terminate forcibly terminates the connection with the given ID.
+// If there is no such connection, NoSuchConnection is returned.
+func (t *Table) Terminate(id ID) error {
+	t.mu.Lock()
+	e, ok := t.entries[id]
+	t.mu.Unlock()
+	if !ok {
+		return NoSuchConnection
+	}
+	e.terminate()
+	return nil
+}
+
+// EvictClient evicts every connection authenticated as c, e.g. once the key
+// of the client is compromised, giving each grace to finish sending data in
+// flight from the client. It returns the IDs of the evicted connections,
+// ordered by ID.
+func (t *Table) EvictClient(c core.ClientID, grace time.Duration) []ID {
+	t.mu.Lock()
+	entries := make([]*Entry, 0)
+	for _, e := range t.entries {
+		entries = append(entries, e)
+	}
+	t.mu.Unlock()
+
+	ids := make([]ID, 0)
+	for _, e := range entries {
+		e.mu.Lock()
+		matches := e.clientID != nil && *e.clientID == c
+		evict := e.evict
+		e.mu.Unlock()
+		if !matches {
+			continue
+		}
+		if evict != nil {
+			evict(grace)
+		} else {
+			e.terminate()
+		}
+		ids = append(ids, e.id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+type entryContextKeyType struct{}
+
+var entryContextKey = entryContextKeyType{}
+
+// NewContextWithEntry returns a child context of parent that carries entry.
+func NewContextWithEntry(parent context.Context, entry *Entry) context.Context {
+	return context.WithValue(parent, entryContextKey, entry)
+}
+
+// EntryFromContext returns the Entry stored in ctx, or nil if there is none.
+func EntryFromContext(ctx context.Context) *Entry {
+	entry, _ := ctx.Value(entryContextKey).(*Entry)
+	return entry
+}
@@ -0,0 +1,180 @@
+package conntable
+
+import (
+	"context"
+	"github.com/stretchr/testify/require"
+	"tcplb/lib/clock"
+	"tcplb/lib/core"
+	"testing"
+	"time"
+)
+
+func TestNilEntryIsNoop(t *testing.T) {
+	entry := EntryFromContext(context.Background())
+	require.Nil(t, entry)
+	require.Zero(t, entry.ID())
+	entry.SetClientID(core.ClientID{Namespace: "conntable_test", Key: "a"})
+	entry.SetUpstream(core.Upstream{Network: "tcp", Address: "a:1"})
+	entry.AddBytesFromClient(1)
+	entry.AddBytesToClient(1)
+}
+
+func TestTableRegisterListRemove(t *testing.T) {
+	table := NewTable(Config{})
+	started := time.Unix(1000, 0)
+
+	a := table.Register("127.0.0.1:1", started, func() {})
+	b := table.Register("127.0.0.1:2", started, func() {})
+	require.NotEqual(t, a.ID(), b.ID())
+	require.Equal(t, 2, table.Len())
+
+	clientID := core.ClientID{Namespace: "conntable_test", Key: "alice"}
+	upstream := core.Upstream{Network: "tcp", Address: "upstream:1"}
+	b.SetClientID(clientID)
+	b.SetUpstream(upstream)
+	b.AddBytesFromClient(3)
+	b.AddBytesToClient(4)
+
+	infos := table.List()
+	require.Len(t, infos, 2)
+	require.Equal(t, a.ID(), infos[0].ID)
+	require.Equal(t, Info{
+		ID:              b.ID(),
+		SourceAddr:      "127.0.0.1:2",
+		ClientID:        &clientID,
+		Upstream:        &upstream,
+		Started:         started,
+		BytesFromClient: 3,
+		BytesToClient:   4,
+		LastActive:      infos[1].LastActive,
+	}, infos[1])
+	require.False(t, infos[1].LastActive.Before(started))
+
+	table.Remove(a)
+	require.Equal(t, 1, table.Len())
+	_, err := table.Get(a.ID())
+	require.ErrorIs(t, err, NoSuchConnection)
+	info, err := table.Get(b.ID())
+	require.NoError(t, err)
+	require.Equal(t, "127.0.0.1:2", info.SourceAddr)
+}
+
+func TestTableTerminate(t *testing.T) {
+	table := NewTable(Config{})
+	terminated := false
+	e := table.Register("127.0.0.1:1", time.Now(), func() { terminated = true })
+
+	require.ErrorIs(t, table.Terminate(e.ID()+1), NoSuchConnection)
+	require.False(t, terminated)
+
+	require.NoError(t, table.Terminate(e.ID()))
+	require.True(t, terminated)
+}
+
+func TestTableClassifiesIdleConnections(t *testing.T) {
+	epoch := time.Unix(1000, 0)
+	c := clock.NewFake(epoch)
+	table := NewTable(Config{IdleAfter: time.Minute, Clock: c})
+	terminated := map[string]bool{}
+	register := func(addr string) *Entry {
+		e := table.Register(addr, c.Now(), func() { terminated[addr] = true })
+		e.StartForwarding()
+		return e
+	}
+
+	quiet := register("127.0.0.1:1")
+	c.Advance(10 * time.Second)
+	busy := register("127.0.0.1:2")
+	later := register("127.0.0.1:3")
+	// Connections that have not started forwarding, e.g. as they are still
+	// being dialed, are not idle.
+	dialing := table.Register("127.0.0.1:4", c.Now(), func() { terminated["127.0.0.1:4"] = true })
+	require.Empty(t, table.Idle())
+
+	c.Advance(time.Minute)
+	busy.AddBytesToClient(1)
+	later.AddBytesFromClient(0) // No data, so no activity.
+	info, err := table.Get(busy.ID())
+	require.NoError(t, err)
+	require.Equal(t, epoch.Add(70*time.Second), info.LastActive)
+	require.False(t, info.Idle)
+
+	idle := table.Idle()
+	require.Len(t, idle, 2)
+	require.Equal(t, quiet.ID(), idle[0].ID)
+	require.Equal(t, epoch, idle[0].LastActive)
+	require.Equal(t, later.ID(), idle[1].ID)
+	require.True(t, idle[1].Idle)
+
+	info, err = table.Get(dialing.ID())
+	require.NoError(t, err)
+	require.False(t, info.Idle)
+
+	require.Equal(t, 2, table.TerminateIdle())
+	require.Equal(t, map[string]bool{"127.0.0.1:1": true, "127.0.0.1:3": true}, terminated)
+
+	// Connections are idle only after IdleAfter from when forwarding starts.
+	dialing.StartForwarding()
+	require.Len(t, table.Idle(), 2)
+	c.Advance(time.Minute)
+	require.Len(t, table.Idle(), 4)
+}
+
+func TestTableWithoutIdleAfterHasNoIdleConnections(t *testing.T) {
+	c := clock.NewFake(time.Unix(1000, 0))
+	table := NewTable(Config{Clock: c})
+	table.Register("127.0.0.1:1", c.Now(), func() {})
+	c.Advance(24 * time.Hour)
+	require.Empty(t, table.Idle())
+	require.Zero(t, table.TerminateIdle())
+}
+
+func TestTableEvictClient(t *testing.T) {
+	table := NewTable(Config{})
+	clientID := core.ClientID{Namespace: "conntable_test", Key: "alice"}
+	other := core.ClientID{Namespace: "conntable_test", Key: "other"}
+	var evicted []time.Duration
+	terminated := 0
+
+	a := table.Register("127.0.0.1:1", time.Now(), func() { terminated++ })
+	a.SetClientID(clientID)
+	a.SetEvict(func(grace time.Duration) { evicted = append(evicted, grace) })
+	b := table.Register("127.0.0.1:2", time.Now(), func() { terminated++ })
+	b.SetClientID(clientID) // Without an evict func, eviction terminates.
+	c := table.Register("127.0.0.1:3", time.Now(), func() { terminated++ })
+	c.SetClientID(other)
+	table.Register("127.0.0.1:4", time.Now(), func() { terminated++ })
+
+	require.Equal(t, []ID{a.ID(), b.ID()}, table.EvictClient(clientID, time.Second))
+	require.Equal(t, []time.Duration{time.Second}, evicted)
+	require.Equal(t, 1, terminated)
+	require.Empty(t, table.EvictClient(core.ClientID{Namespace: "conntable_test", Key: "nobody"}, time.Second))
+}
+
+func TestTableDrainIdle(t *testing.T) {
+	c := clock.NewFake(time.Unix(1000, 0))
+	table := NewTable(Config{IdleAfter: time.Minute, Clock: c})
+	var drained []string
+	terminated := 0
+
+	quiet := table.Register("127.0.0.1:1", c.Now(), func() { terminated++ })
+	quiet.SetDrain(func(grace time.Duration) { drained = append(drained, "127.0.0.1:1") })
+	table.Register("127.0.0.1:2", c.Now(), func() { terminated++ }).StartForwarding() // Without a drain func, draining terminates.
+	busy := table.Register("127.0.0.1:3", c.Now(), func() { terminated++ })
+	busy.SetDrain(func(grace time.Duration) { drained = append(drained, "127.0.0.1:3") })
+	quiet.StartForwarding()
+	busy.StartForwarding()
+
+	c.Advance(2 * time.Minute)
+	busy.AddBytesToClient(1)
+	require.Equal(t, 2, table.DrainIdle(time.Second))
+	require.Equal(t, []string{"127.0.0.1:1"}, drained)
+	require.Equal(t, 1, terminated)
+
+	// Connections are drained only once, though they stay idle until
+	// their clients close them.
+	c.Advance(2 * time.Minute)
+	require.Equal(t, 1, table.DrainIdle(time.Second))
+	require.Equal(t, []string{"127.0.0.1:1", "127.0.0.1:3"}, drained)
+	require.Equal(t, 1, terminated)
+}
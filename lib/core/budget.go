@@ -0,0 +1,51 @@
+package core
+
+import (
+	"context"
+	"math"
+	"time"
+)
+
+// BudgetReservations is the Budget of BudgetWarnings about the connections
+// a client holds at once, as limited by a ClientReserver.
+const BudgetReservations = "reservations"
+
+// BudgetWarning reports that a client has used most of a budget, such as
+// the connections it may hold at once, or the bytes it may forward within
+// a window, so that it may react before it is rejected at the limit.
+type BudgetWarning struct {
+	ClientID ClientID
+	Budget   string        // Budget is what is limited, e.g. BudgetReservations, or a quota resource.
+	Window   time.Duration // Window is the period usage is counted within, if the budget is a quota.
+	Usage    int64         // Usage is the usage of the budget by the client.
+	Limit    int64         // Limit is the usage at which the client is rejected.
+	Time     time.Time     // Time is when the client was warned.
+	ConnID   ConnID        // ConnID identifies the connection that used the budget, if known.
+	Listener string        // Listener is the name of the listener that accepted the connection, if it has one.
+}
+
+// BudgetWarner is warned when clients near the limits of their budgets.
+//
+// WarnBudget is called synchronously from the goroutine handling the
+// connection that used the budget, so implementations must not block.
+//
+// Multiple goroutines may invoke methods on a BudgetWarner simultaneously.
+type BudgetWarner interface {
+	WarnBudget(ctx context.Context, w BudgetWarning)
+}
+
+// BudgetWarningThreshold returns the usage at which a client is warned, if
+// it is warned at fraction of limit, rounded up. If either is not
+// positive, or the usage would be the limit itself, e.g. for small limits,
+// it returns 0, as no warnings apply: a warning at the limit comes no
+// earlier than the rejections it should forestall.
+func BudgetWarningThreshold(limit int64, fraction float64) int64 {
+	if limit <= 0 || fraction <= 0 {
+		return 0
+	}
+	threshold := int64(math.Ceil(fraction * float64(limit)))
+	if threshold >= limit {
+		return 0
+	}
+	return threshold
+}
@@ -1,9 +1,29 @@
 package core
 
+import "hash/fnv"
+
 // ClientID represents the identity of an authenticated client.
+//
+// ClientID is comparable, so it may be used directly as a map key. Hash
+// may be used to spread ClientIDs across the shards of a sharded map.
 type ClientID struct {
 	Namespace string // Namespace is the namespace for the type of identifier
 	Key       string // Key is the canonical identifier for this client
 }
 
-// TODO consider adding a Hash method. C.f. UniformlyBoundedClientReserver
+// Hash returns a hash of the ClientID. Equal ClientIDs have equal hashes.
+// The hash is stable across processes and releases, so it may be used for
+// consistent placement, e.g. of clients onto upstreams.
+func (c ClientID) Hash() uint64 {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(c.Namespace))
+	// Separate the fields so that e.g. {"ab", "c"} and {"a", "bc"} differ.
+	_, _ = h.Write([]byte{0})
+	_, _ = h.Write([]byte(c.Key))
+	return h.Sum64()
+}
+
+// String returns the canonical form of the ClientID for logs, "Namespace/Key".
+func (c ClientID) String() string {
+	return c.Namespace + "/" + c.Key
+}
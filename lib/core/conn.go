@@ -0,0 +1,69 @@
+package core
+
+import (
+	"errors"
+	"net"
+)
+
+// ConnectionTypeUnsupported is returned by AsDuplexConn given a connection
+// whose directions cannot be closed separately.
+var ConnectionTypeUnsupported = errors.New("connection type unsupported")
+
+// ConnID identifies a client connection accepted by a server, for the
+// purpose of correlating lifecycle events of the same connection.
+type ConnID uint64
+
+// CloseWriter represents something that can CloseWrite.
+//
+// Notable implementations in the standard library include:
+// - net.TCPConn
+// - net.UnixConn
+// - tls.Conn
+type CloseWriter interface {
+	CloseWrite() error // CloseWrite shuts down the writer side of a connection.
+}
+
+// DuplexConn is a connection whose writer side can be shut down while its
+// reader side stays open, as needed to forward each direction of a
+// connection until it finishes.
+type DuplexConn interface {
+	net.Conn
+	CloseWriter
+}
+
+// AsDuplexConn returns conn as a DuplexConn, e.g. a *net.TCPConn,
+// *net.UnixConn, *tls.Conn, or a WrappedConn. ConnectionTypeUnsupported is
+// returned if conn cannot CloseWrite.
+func AsDuplexConn(conn net.Conn) (DuplexConn, error) {
+	duplexConn, ok := conn.(DuplexConn)
+	if !ok {
+		return nil, ConnectionTypeUnsupported
+	}
+	return duplexConn, nil
+}
+
+// WrappedConn is embedded by DuplexConns that wrap another, overriding some
+// of its methods, e.g. to count or record the bytes read and written.
+// NetConn exposes the wrapped connection, so that TransportConn sees
+// through the wrapper.
+type WrappedConn struct {
+	DuplexConn
+}
+
+// NetConn returns the connection wrapped by c.
+func (c WrappedConn) NetConn() net.Conn {
+	return c.DuplexConn
+}
+
+// TransportConn returns the connection beneath any wrappers of conn that
+// expose it with a NetConn method, e.g. the TCP connection beneath a
+// *tls.Conn or a WrappedConn.
+func TransportConn(conn net.Conn) net.Conn {
+	for {
+		wrapper, ok := conn.(interface{ NetConn() net.Conn })
+		if !ok {
+			return conn
+		}
+		conn = wrapper.NetConn()
+	}
+}
@@ -0,0 +1,114 @@
+package core
+
+import (
+	"crypto/tls"
+	"github.com/stretchr/testify/require"
+	"net"
+	"testing"
+)
+
+func TestClientIDHashAndString(t *testing.T) {
+	a := ClientID{Namespace: "ab", Key: "c"}
+	b := ClientID{Namespace: "a", Key: "bc"}
+	require.Equal(t, a.Hash(), ClientID{Namespace: "ab", Key: "c"}.Hash())
+	require.NotEqual(t, a.Hash(), b.Hash())
+	require.Equal(t, "ab/c", a.String())
+	require.Equal(t, "a/bc", b.String())
+}
+
+func TestUpstreamRegistry(t *testing.T) {
+	a := Upstream{Network: "tcp", Address: "a:1"}
+	b := Upstream{Network: "tcp", Address: "b:1"}
+	registry := NewUpstreamRegistry()
+	labels := Labels{LabelZone: "z1", LabelWeight: "3"}
+	registry.SetLabels(a, labels)
+	registry.SetLabels(b, Labels{LabelZone: "z2"})
+	labels[LabelZone] = "changed" // the registry holds a copy
+
+	require.Equal(t, Labels{LabelZone: "z1", LabelWeight: "3"}, registry.Labels(a))
+	require.Equal(t, NewUpstreamSet(a), registry.Select(Labels{LabelZone: "z1"}))
+	require.Equal(t, NewUpstreamSet(a, b), registry.Select(nil))
+	require.Equal(t, "weight=3 zone=z1", registry.Labels(a).String())
+
+	weight, ok, err := registry.Labels(a).Weight()
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, 3, weight)
+	_, ok, err = registry.Labels(b).Weight()
+	require.NoError(t, err)
+	require.False(t, ok)
+	_, _, err = Labels{LabelWeight: "-1"}.Weight()
+	require.Error(t, err)
+
+	// Weights are parsed as labels are set.
+	weight, ok = registry.Weight(a)
+	require.True(t, ok)
+	require.Equal(t, 3, weight)
+	_, ok = registry.Weight(b)
+	require.False(t, ok)
+	registry.SetLabels(a, Labels{LabelWeight: "-1"})
+	_, ok = registry.Weight(a)
+	require.False(t, ok)
+
+	var empty *UpstreamRegistry
+	empty.SetLabels(a, Labels{"zone": "a"})
+	require.Nil(t, empty.Labels(a))
+	_, ok = empty.Weight(a)
+	require.False(t, ok)
+	require.Empty(t, empty.Select(nil))
+}
+
+func TestUpstreamSetAlgebra(t *testing.T) {
+	a := Upstream{Network: "tcp", Address: "a:1"}
+	b := Upstream{Network: "tcp", Address: "b:1"}
+	c := Upstream{Network: "tcp", Address: "c:1"}
+	ab := NewUpstreamSet(a, b)
+	bc := NewUpstreamSet(b, c)
+
+	require.Equal(t, NewUpstreamSet(a, b, c), Union(ab, bc))
+	require.Equal(t, NewUpstreamSet(b), Intersection(ab, bc))
+	require.Equal(t, NewUpstreamSet(a), Difference(ab, bc))
+	require.Equal(t, NewUpstreamSet(a, b), ab, "inputs are not modified")
+
+	require.Equal(t, NewUpstreamSet(b), IntersectionUpdate(NewUpstreamSet(a, b), bc))
+	require.Equal(t, NewUpstreamSet(a), DifferenceUpdate(NewUpstreamSet(a, b), bc))
+
+	require.True(t, ab.Equal(NewUpstreamSet(b, a)))
+	require.False(t, ab.Equal(bc))
+	require.False(t, ab.Equal(NewUpstreamSet(a)))
+	require.True(t, ab.Contains(a))
+	require.False(t, ab.Contains(c))
+
+	require.Equal(t, NewUpstreamSet(b, c), NewUpstreamSet(a, b, c).Filter(func(u Upstream) bool { return u != a }))
+	require.Equal(t, []Upstream{a, b, c}, NewUpstreamSet(c, a, b).Sorted())
+	require.Empty(t, EmptyUpstreamSet().Sorted())
+}
+
+func TestAsDuplexConnAndTransportConn(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	duplexConn, err := AsDuplexConn(conn)
+	require.NoError(t, err)
+	tlsConn := tls.Client(conn, &tls.Config{})
+	_, err = AsDuplexConn(tlsConn)
+	require.NoError(t, err)
+	wrapped := &WrappedConn{DuplexConn: tlsConn}
+	_, err = AsDuplexConn(wrapped)
+	require.NoError(t, err)
+
+	// Wrappers are seen through, down to the TCP connection.
+	require.Same(t, conn, TransportConn(wrapped))
+	require.Equal(t, duplexConn, TransportConn(duplexConn))
+
+	// Pipes cannot be closed for writing alone.
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	_, err = AsDuplexConn(client)
+	require.ErrorIs(t, err, ConnectionTypeUnsupported)
+}
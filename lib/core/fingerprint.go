@@ -0,0 +1,21 @@
+package core
+
+import "context"
+
+type tlsFingerprintContextKeyType struct{}
+
+var tlsFingerprintContextKey = tlsFingerprintContextKeyType{}
+
+// NewContextWithTLSFingerprint returns a child context of parent that
+// carries the JA3 or JA4 fingerprint of the client's TLS ClientHello.
+func NewContextWithTLSFingerprint(parent context.Context, fingerprint string) context.Context {
+	return context.WithValue(parent, tlsFingerprintContextKey, fingerprint)
+}
+
+// TLSFingerprintFromContext returns the fingerprint of the client's
+// ClientHello stored in ctx, if any, e.g. so that an Authorizer may judge
+// the client's software.
+func TLSFingerprintFromContext(ctx context.Context) (string, bool) {
+	fingerprint, ok := ctx.Value(tlsFingerprintContextKey).(string)
+	return fingerprint, ok
+}
@@ -0,0 +1,139 @@
+package core
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Well-known Upstream label keys. Any other keys may also be used.
+const (
+	LabelZone    = "zone"    // LabelZone is the failure domain of the upstream, e.g. "us-east-1a".
+	LabelTier    = "tier"    // LabelTier is the priority tier of the upstream, e.g. "primary".
+	LabelVersion = "version" // LabelVersion is the version of the software the upstream runs.
+	LabelWeight  = "weight"  // LabelWeight is the relative capacity of the upstream, a positive integer.
+)
+
+// Labels are key-value attributes describing an Upstream.
+type Labels map[string]string
+
+// Weight returns the value of the LabelWeight label. If the label is
+// absent, ok is false. If it is not a positive integer, an error is returned.
+func (l Labels) Weight() (weight int, ok bool, err error) {
+	value, ok := l[LabelWeight]
+	if !ok {
+		return 0, false, nil
+	}
+	weight, err = strconv.Atoi(value)
+	if err != nil || weight <= 0 {
+		return 0, true, fmt.Errorf("label %s=%s must be a positive integer", LabelWeight, value)
+	}
+	return weight, true, nil
+}
+
+// Matches reports if l has every label of selector, with the same value.
+func (l Labels) Matches(selector Labels) bool {
+	for k, v := range selector {
+		if l[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+// String returns the labels as space-separated key=value pairs, sorted by key.
+func (l Labels) String() string {
+	tokens := make([]string, 0, len(l))
+	for k, v := range l {
+		tokens = append(tokens, k+"="+v)
+	}
+	sort.Strings(tokens)
+	return strings.Join(tokens, " ")
+}
+
+// UpstreamRegistry holds the Labels of Upstreams, as populated from
+// configuration or discovery. Upstreams are used as map keys throughout, so
+// their attributes are kept here rather than in the Upstream itself.
+//
+// All methods of a nil *UpstreamRegistry behave as if it were empty, and
+// SetLabels of a nil *UpstreamRegistry is a no-op.
+//
+// Multiple goroutines may invoke methods on an UpstreamRegistry simultaneously.
+type UpstreamRegistry struct {
+	mu      sync.RWMutex // mu guards labels and weights
+	labels  map[Upstream]Labels
+	weights map[Upstream]int // weights are the valid LabelWeight labels, parsed when set, as they are read on every dial.
+}
+
+// NewUpstreamRegistry returns a new, empty UpstreamRegistry.
+func NewUpstreamRegistry() *UpstreamRegistry {
+	return &UpstreamRegistry{labels: make(map[Upstream]Labels), weights: make(map[Upstream]int)}
+}
+
+// SetLabels replaces the Labels of u with a copy of labels.
+func (r *UpstreamRegistry) SetLabels(u Upstream, labels Labels) {
+	if r == nil {
+		return
+	}
+	copied := make(Labels, len(labels))
+	for k, v := range labels {
+		copied[k] = v
+	}
+	weight, ok, err := copied.Weight()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.labels[u] = copied
+	if ok && err == nil {
+		r.weights[u] = weight
+	} else {
+		delete(r.weights, u)
+	}
+}
+
+// Weight returns the value of the LabelWeight label of u. If u has no such
+// label, or it is not a positive integer, ok is false.
+func (r *UpstreamRegistry) Weight(u Upstream) (weight int, ok bool) {
+	if r == nil {
+		return 0, false
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	weight, ok = r.weights[u]
+	return weight, ok
+}
+
+// Labels returns a copy of the Labels of u, or nil if it has none.
+func (r *UpstreamRegistry) Labels(u Upstream) Labels {
+	if r == nil {
+		return nil
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	labels, ok := r.labels[u]
+	if !ok {
+		return nil
+	}
+	copied := make(Labels, len(labels))
+	for k, v := range labels {
+		copied[k] = v
+	}
+	return copied
+}
+
+// Select returns the Upstreams whose Labels match selector.
+func (r *UpstreamRegistry) Select(selector Labels) UpstreamSet {
+	result := EmptyUpstreamSet()
+	if r == nil {
+		return result
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for u, labels := range r.labels {
+		if labels.Matches(selector) {
+			result[u] = struct{}{}
+		}
+	}
+	return result
+}
@@ -0,0 +1,66 @@
+package core
+
+import (
+	"context"
+	"errors"
+)
+
+// ServerOverloaded is returned, possibly wrapped, by a LoadShedder when a
+// connection is not admitted because the server is at capacity, or
+// overloaded, and no connection of lower priority can be shed in its place.
+var ServerOverloaded = errors.New("server overloaded")
+
+// LoadShedder admits client connections by priority, shedding connections
+// of lower priority to make room for those of higher priority once the
+// server is at capacity or overloaded.
+//
+// Multiple goroutines may invoke methods on a LoadShedder simultaneously.
+type LoadShedder interface {
+	// Admit admits a connection of the given priority, or returns an error
+	// wrapping ServerOverloaded. Higher priorities are more important. If
+	// the connection is admitted, shed may later be called to drop it in
+	// favour of a connection of higher priority, and the caller must call
+	// release once the connection ends.
+	Admit(priority int, shed func()) (release func(), err error)
+}
+
+// HandshakeRateLimiter limits the rate of TLS handshakes, with separate
+// budgets for full handshakes and for resumed sessions.
+//
+// Multiple goroutines may invoke methods on a HandshakeRateLimiter
+// simultaneously.
+type HandshakeRateLimiter interface {
+	// AllowHandshake reports if a handshake may start, charging it
+	// against the budget for full handshakes, as whether it will resume a
+	// session is not yet known.
+	AllowHandshake() bool
+	// AllowResumed reports if a handshake charged by AllowHandshake,
+	// which turned out to resume a session, may proceed, moving its charge
+	// to the budget for resumed sessions.
+	AllowResumed() bool
+}
+
+// HandshakeStartLimiter limits the rate at which TLS handshakes start,
+// across all clients, so that a sudden surge of new clients cannot spend
+// all of the server's CPU on handshakes.
+//
+// Multiple goroutines may invoke methods on a HandshakeStartLimiter
+// simultaneously.
+type HandshakeStartLimiter interface {
+	// Allow reports if a handshake may start now, charging it against the
+	// budget if so.
+	Allow() bool
+}
+
+// BandwidthScheduler shares a ceiling on the bandwidth of data sent to
+// upstreams between the clients sending it, e.g. so that one client's bulk
+// transfer cannot starve the interactive sessions of others.
+//
+// Multiple goroutines may invoke methods on a BandwidthScheduler
+// simultaneously.
+type BandwidthScheduler interface {
+	// WaitBandwidth blocks until some of n bytes from client c may be sent,
+	// returning how many, at least 1 and at most n, or until ctx is done,
+	// returning ctx.Err().
+	WaitBandwidth(ctx context.Context, c ClientID, n int) (int, error)
+}
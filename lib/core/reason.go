@@ -0,0 +1,7 @@
+package core
+
+// ReasonCode identifies why a client connection ended, e.g. because the
+// client was rate limited. Reason codes are short snake_case strings, so
+// that they can be aggregated across access logs, operational logs and
+// metrics. The codes themselves are defined by package accesslog.
+type ReasonCode string
@@ -0,0 +1,51 @@
+package core
+
+import (
+	"context"
+	"errors"
+)
+
+// ReservationLimitExceeded is returned, possibly wrapped, by a ClientReserver
+// when a client already holds as many reservations as it may.
+var ReservationLimitExceeded = errors.New("client reservation limit exceeded")
+
+// ReserverOverloaded is returned, possibly wrapped, by a ClientReserver
+// when it is tracking as many distinct clients as it may, so cannot accept
+// a reservation from another client.
+var ReserverOverloaded = errors.New("client reserver overloaded")
+
+// ClientReserver represents an entity that can limit "reservations"
+// by clients, as an abstraction of client rate limiting.
+//
+// Multiple goroutines may invoke methods on a ClientReserver
+// simultaneously.
+type ClientReserver interface {
+	// TryReserve attempts to acquire a reservation for the given client.
+	// If the attempt succeeds, nil is returned.
+	// If no reservations are available, the attempt returns an error. If
+	// the client has reached its limit, errors.Is(err, ReservationLimitExceeded)
+	// holds. If the reserver is tracking too many clients,
+	// errors.Is(err, ReserverOverloaded) holds. This call does not block.
+	TryReserve(ctx context.Context, c ClientID) error
+
+	// ReleaseReservation releases a reservation that was previously acquired
+	// for the given ClientID c by TryReserve.
+	ReleaseReservation(ctx context.Context, c ClientID) error
+}
+
+// ReservationRenewer is a ClientReserver whose reservations are leases that
+// lapse unless renewed, so that reservations that are never released are
+// eventually reclaimed.
+type ReservationRenewer interface {
+	// RenewReservation renews the lease on the reservations held by the
+	// given ClientID c.
+	RenewReservation(ctx context.Context, c ClientID) error
+}
+
+// ClientReservations is a snapshot of the reservations held by a client.
+type ClientReservations struct {
+	ClientID     ClientID `json:"clientid"`
+	Pool         string   `json:"pool,omitempty"` // Pool is the upstream pool the reservations apply to, if known.
+	Reservations int64    `json:"reservations"`   // Reservations is the number currently held.
+	Limit        int64    `json:"limit"`          // Limit is the maximum that may be held at once.
+}
@@ -1,5 +1,7 @@
 package core
 
+import "sort"
+
 // Upstream represents an upstream that clients can be forwarded to.
 type Upstream struct {
 	Network string
@@ -44,6 +46,95 @@ func UnionUpdate(acc, rhs UpstreamSet) UpstreamSet {
 	return acc
 }
 
-// TODO add UpstreamSet Intersection and IntersectionUpdate
+// Intersection returns a new UpstreamSet that is the intersection of the
+// input UpstreamSets.
+func Intersection(lhs, rhs UpstreamSet) UpstreamSet {
+	result := EmptyUpstreamSet()
+	for k := range lhs {
+		if _, ok := rhs[k]; ok {
+			result[k] = struct{}{}
+		}
+	}
+	return result
+}
+
+// IntersectionUpdate updates the input acc UpstreamSet in-place by taking
+// the intersection with the given rhs UpstreamSet. The modified input acc
+// is returned.
+func IntersectionUpdate(acc, rhs UpstreamSet) UpstreamSet {
+	for k := range acc {
+		if _, ok := rhs[k]; !ok {
+			delete(acc, k)
+		}
+	}
+	return acc
+}
+
+// Difference returns a new UpstreamSet containing the Upstreams of lhs
+// that are not in rhs.
+func Difference(lhs, rhs UpstreamSet) UpstreamSet {
+	result := EmptyUpstreamSet()
+	for k := range lhs {
+		if _, ok := rhs[k]; !ok {
+			result[k] = struct{}{}
+		}
+	}
+	return result
+}
 
-// TODO add UpstreamSet Difference and DifferenceUpdate
+// DifferenceUpdate updates the input acc UpstreamSet in-place by removing
+// the Upstreams of the given rhs UpstreamSet. The modified input acc is
+// returned.
+func DifferenceUpdate(acc, rhs UpstreamSet) UpstreamSet {
+	for k := range rhs {
+		delete(acc, k)
+	}
+	return acc
+}
+
+// Equal reports if the UpstreamSets contain the same Upstreams.
+func (s UpstreamSet) Equal(other UpstreamSet) bool {
+	if len(s) != len(other) {
+		return false
+	}
+	for k := range s {
+		if _, ok := other[k]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// Contains reports if the UpstreamSet contains u.
+func (s UpstreamSet) Contains(u Upstream) bool {
+	_, ok := s[u]
+	return ok
+}
+
+// Filter returns a new UpstreamSet containing the Upstreams of s for which
+// keep returns true.
+func (s UpstreamSet) Filter(keep func(u Upstream) bool) UpstreamSet {
+	result := EmptyUpstreamSet()
+	for k := range s {
+		if keep(k) {
+			result[k] = struct{}{}
+		}
+	}
+	return result
+}
+
+// Sorted returns the Upstreams of s as a new slice, sorted by Network
+// then Address, for deterministic iteration.
+func (s UpstreamSet) Sorted() []Upstream {
+	result := make([]Upstream, 0, len(s))
+	for k := range s {
+		result = append(result, k)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Network != result[j].Network {
+			return result[i].Network < result[j].Network
+		}
+		return result[i].Address < result[j].Address
+	})
+	return result
+}
@@ -0,0 +1,266 @@
+package dialer
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"tcplb/lib/core"
+	"tcplb/lib/forwarder"
+	"tcplb/lib/metrics"
+	"time"
+)
+
+// CircuitOpen is the error returned, wrapped in a forwarder.DialError, when
+// an upstream is not dialed because its circuit is open.
+var CircuitOpen = errors.New("upstream circuit open")
+
+// CircuitState is the state of the circuit of an upstream.
+type CircuitState string
+
+const (
+	CircuitClosed   CircuitState = "closed"    // CircuitClosed means the upstream is dialed as usual.
+	CircuitOpened   CircuitState = "open"      // CircuitOpened means the upstream is not dialed, as too many dials to it failed.
+	CircuitHalfOpen CircuitState = "half_open" // CircuitHalfOpen means the upstream is dialed by probes, to find out if it has recovered.
+)
+
+// CircuitBreakerConfig configures a CircuitBreaker.
+type CircuitBreakerConfig struct {
+	// FailureRatio is the fraction of dials of an upstream within Window
+	// that must fail for its circuit to open, e.g. 0.5.
+	FailureRatio float64
+
+	// MinDials is the number of dials of an upstream within Window needed
+	// before its circuit may open, so that a few failures of a rarely
+	// dialed upstream do not open it.
+	MinDials int
+
+	// Window is the period over which dial outcomes are counted. Counts
+	// start afresh once it has passed.
+	Window time.Duration
+
+	// OpenDuration is how long a circuit stays open before it is half-open.
+	OpenDuration time.Duration
+
+	// Probes is the number of consecutive successful probe dials that close
+	// a half-open circuit. Probes are made one at a time, and any failure
+	// opens the circuit again. If not positive, one probe is needed.
+	Probes int
+}
+
+// CircuitBreakerMetrics holds the metrics recorded by a CircuitBreaker.
+type CircuitBreakerMetrics struct {
+	Opened   *metrics.Counter // Opened counts circuits that opened.
+	Rejected *metrics.Counter // Rejected counts dials not made because the circuit was open.
+}
+
+// NewCircuitBreakerMetrics returns CircuitBreakerMetrics registered in the
+// given Registry.
+func NewCircuitBreakerMetrics(r *metrics.Registry) *CircuitBreakerMetrics {
+	return &CircuitBreakerMetrics{
+		Opened:   r.Counter("circuit_breaker_opened_total"),
+		Rejected: r.Counter("circuit_breaker_rejected_dials_total"),
+	}
+}
+
+// CircuitBreaker stops dials of upstreams whose dials mostly fail, so that
+// an upstream that is down, or accepts connections only to reset them,
+// does not cost a failed attempt on every client connection. Each upstream
+// has a circuit that is closed while it is healthy. It opens once
+// FailureRatio of its dials within Window fail, and no dials are made for
+// OpenDuration. It is then half-open, and probe dials are made one at a
+// time: if Probes succeed in a row it closes, and if any fails it opens
+// again.
+//
+// Unlike a FailureObserver policy, which only prefers other upstreams, an
+// open circuit excludes the upstream entirely.
+//
+// Multiple goroutines may invoke methods on a CircuitBreaker simultaneously.
+type CircuitBreaker struct {
+	cfg     CircuitBreakerConfig
+	metrics *CircuitBreakerMetrics
+	now     func() time.Time
+
+	mu       sync.Mutex // mu guards circuits
+	circuits map[core.Upstream]*circuit
+}
+
+type circuit struct {
+	state       CircuitState
+	windowStart time.Time
+	dials       int
+	failures    int
+	openedAt    time.Time
+	probing     bool // probing is set while a probe dial of a half-open circuit is in progress.
+	successes   int  // successes counts consecutive successful probes of a half-open circuit.
+}
+
+// NewCircuitBreaker returns a CircuitBreaker configured by cfg. m is
+// optional. If nil, no metrics are recorded.
+func NewCircuitBreaker(cfg CircuitBreakerConfig, m *CircuitBreakerMetrics) *CircuitBreaker {
+	if cfg.Probes <= 0 {
+		cfg.Probes = 1
+	}
+	if m == nil {
+		m = &CircuitBreakerMetrics{}
+	}
+	return &CircuitBreaker{
+		cfg:      cfg,
+		metrics:  m,
+		now:      time.Now,
+		circuits: make(map[core.Upstream]*circuit),
+	}
+}
+
+func (b *CircuitBreaker) circuitLocked(u core.Upstream) *circuit {
+	c, ok := b.circuits[u]
+	if !ok {
+		c = &circuit{state: CircuitClosed, windowStart: b.now()}
+		b.circuits[u] = c
+	}
+	return c
+}
+
+// Allow reports if u may be dialed now. If so, the caller must report the
+// outcome of the dial with Report.
+func (b *CircuitBreaker) Allow(u core.Upstream) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	c := b.circuitLocked(u)
+	if c.state == CircuitOpened && b.now().Sub(c.openedAt) >= b.cfg.OpenDuration {
+		c.state = CircuitHalfOpen
+		c.successes = 0
+	}
+	switch c.state {
+	case CircuitOpened:
+		b.metrics.Rejected.Inc()
+		return false
+	case CircuitHalfOpen:
+		if c.probing {
+			b.metrics.Rejected.Inc()
+			return false
+		}
+		c.probing = true
+	}
+	return true
+}
+
+// Report records the outcome of a dial of u that Allow permitted. err is
+// nil if the dial succeeded.
+func (b *CircuitBreaker) Report(u core.Upstream, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	c := b.circuitLocked(u)
+	now := b.now()
+	switch c.state {
+	case CircuitHalfOpen:
+		c.probing = false
+		if err != nil {
+			b.openLocked(c, now)
+			return
+		}
+		c.successes++
+		if c.successes >= b.cfg.Probes {
+			*c = circuit{state: CircuitClosed, windowStart: now}
+		}
+	case CircuitClosed:
+		b.countLocked(c, now, 1, err != nil)
+	}
+}
+
+// Abandon records that a dial of u that Allow permitted was abandoned by
+// its caller, e.g. as the client went away, so its outcome says nothing of
+// the upstream. It is counted neither as failed nor as successful, but
+// lets another probe of a half-open circuit begin.
+func (b *CircuitBreaker) Abandon(u core.Upstream) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	c := b.circuitLocked(u)
+	if c.state == CircuitHalfOpen {
+		c.probing = false
+	}
+}
+
+// ReportConnectionFailure records that a connection to u failed after its
+// dial was reported as successful, e.g. because the upstream accepted the
+// connection only to reset it. The dial is counted as failed instead.
+func (b *CircuitBreaker) ReportConnectionFailure(u core.Upstream) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	c := b.circuitLocked(u)
+	now := b.now()
+	switch c.state {
+	case CircuitHalfOpen:
+		b.openLocked(c, now)
+	case CircuitClosed:
+		dials := 0
+		if c.failures >= c.dials || now.Sub(c.windowStart) >= b.cfg.Window {
+			// The dial was counted in a previous window.
+			dials = 1
+		}
+		b.countLocked(c, now, dials, true)
+	}
+}
+
+// countLocked counts dials and a failure of a closed circuit, and opens it
+// if too many of its dials within the window failed.
+func (b *CircuitBreaker) countLocked(c *circuit, now time.Time, dials int, failed bool) {
+	if now.Sub(c.windowStart) >= b.cfg.Window {
+		c.windowStart = now
+		c.dials = 0
+		c.failures = 0
+	}
+	c.dials += dials
+	if failed {
+		c.failures++
+	}
+	if failed && c.dials >= b.cfg.MinDials && float64(c.failures) >= b.cfg.FailureRatio*float64(c.dials) {
+		b.openLocked(c, now)
+	}
+}
+
+func (b *CircuitBreaker) openLocked(c *circuit, now time.Time) {
+	c.state = CircuitOpened
+	c.openedAt = now
+	c.probing = false
+	c.successes = 0
+	b.metrics.Opened.Inc()
+}
+
+// State returns the state of the circuit of u.
+func (b *CircuitBreaker) State(u core.Upstream) CircuitState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	c, ok := b.circuits[u]
+	if !ok {
+		return CircuitClosed
+	}
+	if c.state == CircuitOpened && b.now().Sub(c.openedAt) >= b.cfg.OpenDuration {
+		return CircuitHalfOpen
+	}
+	return c.state
+}
+
+// CircuitBreakingDialer is an UpstreamDialer that does not dial upstreams
+// whose circuit is open in Breaker, returning a *forwarder.DialError
+// wrapping CircuitOpen instead, and reports the outcome of each dial by
+// Dialer to Breaker. Dials that fail once their context is done are
+// abandoned rather than reported, as the upstream is not at fault.
+type CircuitBreakingDialer struct {
+	Dialer  forwarder.UpstreamDialer
+	Breaker *CircuitBreaker
+}
+
+func (d *CircuitBreakingDialer) DialUpstream(ctx context.Context, upstream core.Upstream) (core.DuplexConn, error) {
+	if !d.Breaker.Allow(upstream) {
+		return nil, &forwarder.DialError{Upstream: upstream, Err: CircuitOpen}
+	}
+	conn, err := d.Dialer.DialUpstream(ctx, upstream)
+	if err != nil && ctx.Err() != nil {
+		d.Breaker.Abandon(upstream)
+		return conn, err
+	}
+	d.Breaker.Report(upstream, err)
+	return conn, err
+}
+
+var _ forwarder.UpstreamDialer = (*CircuitBreakingDialer)(nil) // type check
@@ -0,0 +1,124 @@
+package dialer
+
+import (
+	"context"
+	"net"
+	"tcplb/lib/clock"
+	"tcplb/lib/core"
+	"tcplb/lib/forwarder"
+	"time"
+)
+
+// Middleware returns an UpstreamDialer that does some work before, after or
+// instead of invoking the inner UpstreamDialer, e.g. speaking TLS over the
+// connections it dials.
+type Middleware func(inner forwarder.UpstreamDialer) forwarder.UpstreamDialer
+
+// Chain is an ordered list of Middleware, from outermost to innermost, that
+// composes a stack of UpstreamDialers, e.g.
+//
+//	Chain{WithCircuitBreaker(b), WithTLS(t, timeout), WithProxyHeader(h), WithResolver(dns)}.Then(&TimeoutDialer{Timeout: timeout})
+//
+// dials the resolved addresses of upstreams, sends a PROXY header, then
+// speaks TLS over the connection, unless the circuit of the upstream is
+// open.
+type Chain []Middleware
+
+// Then returns base wrapped in the Middleware of the Chain.
+func (c Chain) Then(base forwarder.UpstreamDialer) forwarder.UpstreamDialer {
+	d := base
+	for i := len(c) - 1; i >= 0; i-- {
+		d = c[i](d)
+	}
+	return d
+}
+
+// TimeoutDialer is an UpstreamDialer that gives up if the connection is
+// not established within Timeout. It is the innermost UpstreamDialer of
+// most Chains, both for forwarding and for health check probes, which
+// adapt it with a ProbeDialer.
+type TimeoutDialer struct {
+	Timeout time.Duration
+}
+
+func (d *TimeoutDialer) DialUpstream(ctx context.Context, upstream core.Upstream) (core.DuplexConn, error) {
+	dialer := net.Dialer{Timeout: d.Timeout}
+	conn, err := dialer.DialContext(ctx, upstream.Network, upstream.Address)
+	if err != nil {
+		return nil, &forwarder.DialError{Upstream: upstream, Err: err}
+	}
+	duplexConn, ok := conn.(core.DuplexConn)
+	if !ok {
+		_ = conn.Close()
+		return nil, &forwarder.DialError{Upstream: upstream, Err: core.ConnectionTypeUnsupported}
+	}
+	return duplexConn, nil
+}
+
+var _ forwarder.UpstreamDialer = (*TimeoutDialer)(nil) // type check
+
+// WithResolver returns Middleware that dials the addresses of upstream host
+// names cached in cache. See ResolvingDialer.
+func WithResolver(cache *DNSCache) Middleware {
+	return func(inner forwarder.UpstreamDialer) forwarder.UpstreamDialer {
+		return &ResolvingDialer{Dialer: inner, Cache: cache}
+	}
+}
+
+// WithTLS returns Middleware that speaks TLS over the dialed connections,
+// with handshakes bounded by timeout. See TLSDialer.
+func WithTLS(upstreamTLS *UpstreamTLS, timeout time.Duration) Middleware {
+	return func(inner forwarder.UpstreamDialer) forwarder.UpstreamDialer {
+		return &TLSDialer{Dialer: inner, TLS: upstreamTLS, Timeout: timeout}
+	}
+}
+
+// WithProxyHeader returns Middleware that sends a PROXY protocol v2 header,
+// as configured by config, on each dialed connection. It belongs beneath
+// WithTLS, so that the header is sent on the transport connection, before
+// the TLS handshake. See ProxyHeaderDialer.
+func WithProxyHeader(config *forwarder.ProxyHeaderConfig) Middleware {
+	return func(inner forwarder.UpstreamDialer) forwarder.UpstreamDialer {
+		return &ProxyHeaderDialer{Dialer: inner, Config: config}
+	}
+}
+
+// ProxyHeaderDialer is an UpstreamDialer that sends a PROXY protocol v2
+// header describing the client connection, as carried by the context of
+// the dial, on each connection that Dialer dials. If the header cannot be
+// sent, the connection is closed and a *forwarder.DialError is returned.
+type ProxyHeaderDialer struct {
+	Dialer forwarder.UpstreamDialer
+	Config *forwarder.ProxyHeaderConfig
+}
+
+func (d *ProxyHeaderDialer) DialUpstream(ctx context.Context, upstream core.Upstream) (core.DuplexConn, error) {
+	conn, err := d.Dialer.DialUpstream(ctx, upstream)
+	if err != nil {
+		return nil, err
+	}
+	if err := d.Config.WriteProxyHeader(ctx, conn); err != nil {
+		_ = conn.Close()
+		return nil, &forwarder.DialError{Upstream: upstream, Err: err}
+	}
+	return conn, nil
+}
+
+var _ forwarder.UpstreamDialer = (*ProxyHeaderDialer)(nil) // type check
+
+// WithCircuitBreaker returns Middleware that does not dial upstreams whose
+// circuit is open in breaker. See CircuitBreakingDialer.
+func WithCircuitBreaker(breaker *CircuitBreaker) Middleware {
+	return func(inner forwarder.UpstreamDialer) forwarder.UpstreamDialer {
+		return &CircuitBreakingDialer{Dialer: inner, Breaker: breaker}
+	}
+}
+
+// WithLatency returns Middleware that records the latency of dials in
+// tracker. See LatencyRecordingDialer. clk is optional. If nil, the Real
+// clock is used.
+func WithLatency(tracker *LatencyTracker, clk clock.Clock) Middleware {
+	return func(inner forwarder.UpstreamDialer) forwarder.UpstreamDialer {
+		return &LatencyRecordingDialer{Dialer: inner, Latency: tracker, Clock: clk}
+	}
+}
@@ -0,0 +1,222 @@
+package dialer
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"tcplb/lib/clock"
+	"tcplb/lib/core"
+	"tcplb/lib/forwarder"
+	"tcplb/lib/metrics"
+	"time"
+)
+
+// HostResolver resolves host names to addresses. *net.Resolver is a
+// HostResolver.
+type HostResolver interface {
+	LookupHost(ctx context.Context, host string) ([]string, error)
+}
+
+var _ HostResolver = (*net.Resolver)(nil) // type check
+
+// DNSCacheConfig configures a DNSCache.
+type DNSCacheConfig struct {
+	Resolver HostResolver // Resolver is optional. If nil, net.DefaultResolver is used.
+	// TTL is how long the addresses of a host are cached once resolved. The
+	// resolver does not report the TTLs of DNS records, so TTL overrides
+	// them. If not positive, addresses are not cached.
+	TTL time.Duration
+	// NegativeTTL is how long a failure to resolve a host is cached, so
+	// that dials fail fast rather than each waiting on DNS. If not
+	// positive, failures are not cached.
+	NegativeTTL time.Duration
+	// Timeout bounds each lookup, separately from the dial that needs it.
+	// If not positive, lookups are bounded only by the resolver.
+	Timeout time.Duration
+	Clock   clock.Clock // Clock is optional. If nil, the Real clock is used.
+}
+
+// DNSCacheMetrics holds the metrics recorded by a DNSCache.
+type DNSCacheMetrics struct {
+	Hits         *metrics.Counter // Hits counts lookups answered by cached addresses.
+	NegativeHits *metrics.Counter // NegativeHits counts lookups answered by a cached failure.
+	Misses       *metrics.Counter // Misses counts lookups that waited on the resolver.
+	Stale        *metrics.Counter // Stale counts resolver failures answered by the addresses of an expired entry.
+	Errors       *metrics.Counter // Errors counts failed lookups of the resolver.
+}
+
+// NewDNSCacheMetrics returns DNSCacheMetrics registered in the given
+// Registry.
+func NewDNSCacheMetrics(r *metrics.Registry) *DNSCacheMetrics {
+	return &DNSCacheMetrics{
+		Hits:         r.Counter("dns_cache_hits_total"),
+		NegativeHits: r.Counter("dns_cache_negative_hits_total"),
+		Misses:       r.Counter("dns_cache_misses_total"),
+		Stale:        r.Counter("dns_cache_stale_total"),
+		Errors:       r.Counter("dns_lookup_errors_total"),
+	}
+}
+
+// DNSCache caches the addresses of host names, so that dials do not each
+// wait on the resolver, and their latency does not vary with it. Concurrent
+// lookups of a host share one query of the resolver. If a host that was
+// resolved before fails to resolve again, e.g. as DNS is briefly
+// unavailable, its previous addresses are used until NegativeTTL passes.
+//
+// Multiple goroutines may invoke methods on a DNSCache simultaneously.
+type DNSCache struct {
+	cfg      DNSCacheConfig
+	metrics  *DNSCacheMetrics
+	resolver HostResolver
+	clock    clock.Clock
+
+	mu      sync.Mutex // mu guards entries
+	entries map[string]*dnsEntry
+}
+
+// dnsEntry is the outcome of resolving a host. While the resolver is
+// queried, done is open, and addrs and err are those of the previous
+// outcome, if any.
+type dnsEntry struct {
+	done    chan struct{}
+	addrs   []string
+	err     error
+	expires time.Time
+}
+
+// NewDNSCache returns a DNSCache configured by cfg. m is optional. If nil,
+// no metrics are recorded.
+func NewDNSCache(cfg DNSCacheConfig, m *DNSCacheMetrics) *DNSCache {
+	if m == nil {
+		m = &DNSCacheMetrics{}
+	}
+	var resolver HostResolver = net.DefaultResolver
+	if cfg.Resolver != nil {
+		resolver = cfg.Resolver
+	}
+	return &DNSCache{
+		cfg:      cfg,
+		metrics:  m,
+		resolver: resolver,
+		clock:    clock.Or(cfg.Clock),
+		entries:  make(map[string]*dnsEntry),
+	}
+}
+
+// LookupHost returns the addresses of host, from the cache if they are
+// there and have not expired, or else from the resolver.
+func (c *DNSCache) LookupHost(ctx context.Context, host string) ([]string, error) {
+	c.mu.Lock()
+	e, ok := c.entries[host]
+	if ok && isClosed(e.done) && c.clock.Now().Before(e.expires) {
+		c.mu.Unlock()
+		if e.err != nil {
+			c.metrics.NegativeHits.Inc()
+		} else {
+			c.metrics.Hits.Inc()
+		}
+		return e.addrs, e.err
+	}
+	c.metrics.Misses.Inc()
+	if !ok || isClosed(e.done) {
+		next := &dnsEntry{done: make(chan struct{})}
+		if ok {
+			next.addrs = e.addrs
+		}
+		c.entries[host] = next
+		e = next
+		go c.resolve(host, e)
+	}
+	c.mu.Unlock()
+
+	select {
+	case <-e.done:
+		return e.addrs, e.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// resolve queries the resolver for the addresses of host, recording the
+// outcome in e.
+func (c *DNSCache) resolve(host string, e *dnsEntry) {
+	ctx := context.Background()
+	if c.cfg.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = clock.WithTimeout(ctx, c.clock, c.cfg.Timeout)
+		defer cancel()
+	}
+	addrs, err := c.resolver.LookupHost(ctx, host)
+	if err == nil && len(addrs) == 0 {
+		err = &net.DNSError{Err: "no addresses", Name: host, IsNotFound: true}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ttl := c.cfg.TTL
+	switch {
+	case err == nil:
+		e.addrs = addrs
+	case len(e.addrs) > 0:
+		c.metrics.Errors.Inc()
+		c.metrics.Stale.Inc()
+		ttl = c.cfg.NegativeTTL
+	default:
+		c.metrics.Errors.Inc()
+		e.err = err
+		ttl = c.cfg.NegativeTTL
+	}
+	e.expires = c.clock.Now().Add(ttl)
+	if ttl <= 0 && c.entries[host] == e {
+		delete(c.entries, host)
+	}
+	close(e.done)
+}
+
+func isClosed(c chan struct{}) bool {
+	select {
+	case <-c:
+		return true
+	default:
+		return false
+	}
+}
+
+// ResolvingDialer is an UpstreamDialer that resolves the host names of
+// upstreams with Cache, then dials their addresses in turn with Dialer
+// until one connects. Upstreams whose address is an IP address are dialed
+// directly.
+type ResolvingDialer struct {
+	Dialer forwarder.UpstreamDialer
+	Cache  *DNSCache
+}
+
+func (d *ResolvingDialer) DialUpstream(ctx context.Context, upstream core.Upstream) (core.DuplexConn, error) {
+	host, port, err := net.SplitHostPort(upstream.Address)
+	if err != nil || net.ParseIP(host) != nil {
+		return d.Dialer.DialUpstream(ctx, upstream)
+	}
+	addrs, err := d.Cache.LookupHost(ctx, host)
+	if err != nil {
+		return nil, &forwarder.DialError{Upstream: upstream, Err: err}
+	}
+	for _, addr := range addrs {
+		var conn core.DuplexConn
+		resolved := core.Upstream{Network: upstream.Network, Address: net.JoinHostPort(addr, port)}
+		conn, err = d.Dialer.DialUpstream(ctx, resolved)
+		if err == nil {
+			return conn, nil
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	var dialErr *forwarder.DialError
+	if errors.As(err, &dialErr) {
+		err = dialErr.Err
+	}
+	return nil, &forwarder.DialError{Upstream: upstream, Err: err}
+}
+
+var _ forwarder.UpstreamDialer = (*ResolvingDialer)(nil) // type check
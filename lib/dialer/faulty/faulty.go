@@ -0,0 +1,331 @@
+// Package faulty injects faults into upstream dials and connections, for
+// chaos testing of the forwarder: latency, failed dials, partial writes,
+// mid-stream resets and slow reads.
+//
+// Each fault is a ConnWrapper that injects it at random, with a given
+// probability per operation. Wrappers compose with Chain, and a Dialer
+// applies them to every connection it dials. Middleware adds a Dialer to a
+// dialer.Chain. Random choices are made by an
+// Injector, which may be seeded so that a failing run can be repeated.
+//
+// This package is intended for use in tests, not in the serving path.
+package faulty
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"sync"
+	"tcplb/lib/core"
+	"tcplb/lib/dialer"
+	"tcplb/lib/forwarder"
+	"time"
+)
+
+// InjectedFault is returned, possibly wrapped, by operations that failed
+// because a fault was injected.
+var InjectedFault = errors.New("injected fault")
+
+// Injector makes the random choices of when and how to inject faults.
+//
+// Multiple goroutines may invoke methods on an Injector simultaneously.
+type Injector struct {
+	mu   sync.Mutex // mu guards rand
+	rand *rand.Rand
+}
+
+// NewInjector returns an Injector whose choices are determined by seed.
+func NewInjector(seed int64) *Injector {
+	return &Injector{rand: rand.New(rand.NewSource(seed))}
+}
+
+// Chance reports true with probability p.
+func (in *Injector) Chance(p float64) bool {
+	if p <= 0 {
+		return false
+	}
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	return in.rand.Float64() < p
+}
+
+// Duration returns a duration chosen uniformly from [0, max].
+func (in *Injector) Duration(max time.Duration) time.Duration {
+	if max <= 0 {
+		return 0
+	}
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	return time.Duration(in.rand.Int63n(int64(max) + 1))
+}
+
+// Intn returns an int chosen uniformly from [0, n).
+func (in *Injector) Intn(n int) int {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	return in.rand.Intn(n)
+}
+
+// ConnWrapper wraps a connection so as to inject a fault into it.
+type ConnWrapper func(conn core.DuplexConn) core.DuplexConn
+
+// Chain returns a ConnWrapper that applies each of wrappers in turn, so
+// that the last is outermost.
+func Chain(wrappers ...ConnWrapper) ConnWrapper {
+	return func(conn core.DuplexConn) core.DuplexConn {
+		for _, wrap := range wrappers {
+			conn = wrap(conn)
+		}
+		return conn
+	}
+}
+
+// sleep waits for d, or until ctx is done.
+func sleep(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// latencyConn delays reads and writes.
+type latencyConn struct {
+	core.WrappedConn
+	in  *Injector
+	p   float64
+	max time.Duration
+}
+
+// Latency returns a ConnWrapper that delays each Read and Write, with
+// probability p, by up to max.
+func Latency(in *Injector, p float64, max time.Duration) ConnWrapper {
+	return func(conn core.DuplexConn) core.DuplexConn {
+		return &latencyConn{WrappedConn: core.WrappedConn{DuplexConn: conn}, in: in, p: p, max: max}
+	}
+}
+
+func (c *latencyConn) delay() {
+	if c.in.Chance(c.p) {
+		_ = sleep(context.Background(), c.in.Duration(c.max))
+	}
+}
+
+func (c *latencyConn) Read(b []byte) (int, error) {
+	c.delay()
+	return c.DuplexConn.Read(b)
+}
+
+func (c *latencyConn) Write(b []byte) (int, error) {
+	c.delay()
+	return c.DuplexConn.Write(b)
+}
+
+// partialWriteConn writes only part of the data of some writes.
+type partialWriteConn struct {
+	core.WrappedConn
+	in *Injector
+	p  float64
+}
+
+// PartialWrites returns a ConnWrapper that, with probability p, writes only
+// a random prefix of the data given to Write, then fails with an error
+// wrapping both io.ErrShortWrite and InjectedFault, as a writer may when
+// the connection breaks.
+func PartialWrites(in *Injector, p float64) ConnWrapper {
+	return func(conn core.DuplexConn) core.DuplexConn {
+		return &partialWriteConn{WrappedConn: core.WrappedConn{DuplexConn: conn}, in: in, p: p}
+	}
+}
+
+func (c *partialWriteConn) Write(b []byte) (int, error) {
+	if len(b) == 0 || !c.in.Chance(c.p) {
+		return c.DuplexConn.Write(b)
+	}
+	n, err := c.DuplexConn.Write(b[:c.in.Intn(len(b))])
+	if err != nil {
+		return n, err
+	}
+	return n, shortWriteError{}
+}
+
+// shortWriteError is an injected short write.
+type shortWriteError struct{}
+
+func (shortWriteError) Error() string { return "injected fault: short write" }
+
+func (shortWriteError) Is(target error) bool {
+	return target == io.ErrShortWrite || target == InjectedFault
+}
+
+// resetConn resets the connection during some reads and writes.
+type resetConn struct {
+	core.WrappedConn
+	in *Injector
+	p  float64
+}
+
+// Resets returns a ConnWrapper that, with probability p, resets the
+// connection instead of performing a Read or Write, which then fails with
+// InjectedFault. TCP connections are closed without lingering, so that the
+// peer sees a reset rather than EOF.
+func Resets(in *Injector, p float64) ConnWrapper {
+	return func(conn core.DuplexConn) core.DuplexConn {
+		return &resetConn{WrappedConn: core.WrappedConn{DuplexConn: conn}, in: in, p: p}
+	}
+}
+
+func (c *resetConn) reset() bool {
+	if !c.in.Chance(c.p) {
+		return false
+	}
+	if tcpConn, ok := c.DuplexConn.(*net.TCPConn); ok {
+		_ = tcpConn.SetLinger(0)
+	}
+	_ = c.DuplexConn.Close()
+	return true
+}
+
+func (c *resetConn) Read(b []byte) (int, error) {
+	if c.reset() {
+		return 0, InjectedFault
+	}
+	return c.DuplexConn.Read(b)
+}
+
+func (c *resetConn) Write(b []byte) (int, error) {
+	if c.reset() {
+		return 0, InjectedFault
+	}
+	return c.DuplexConn.Write(b)
+}
+
+// slowReadConn trickles data to readers.
+type slowReadConn struct {
+	core.WrappedConn
+	in       *Injector
+	p        float64
+	maxBytes int
+	delay    time.Duration
+}
+
+// SlowReads returns a ConnWrapper that, with probability p, makes a Read
+// wait for delay, then return at most maxBytes, as if the data were
+// trickling in over a slow network. Reading slowly also slows the peer, as
+// its writes back up.
+func SlowReads(in *Injector, p float64, maxBytes int, delay time.Duration) ConnWrapper {
+	if maxBytes <= 0 {
+		maxBytes = 1
+	}
+	return func(conn core.DuplexConn) core.DuplexConn {
+		return &slowReadConn{WrappedConn: core.WrappedConn{DuplexConn: conn}, in: in, p: p, maxBytes: maxBytes, delay: delay}
+	}
+}
+
+func (c *slowReadConn) Read(b []byte) (int, error) {
+	if !c.in.Chance(c.p) {
+		return c.DuplexConn.Read(b)
+	}
+	_ = sleep(context.Background(), c.delay)
+	if len(b) > c.maxBytes {
+		b = b[:c.maxBytes]
+	}
+	return c.DuplexConn.Read(b)
+}
+
+// Dialer is a forwarder.UpstreamDialer that injects faults into the dials
+// of the Inner dialer, and into the connections it dials.
+type Dialer struct {
+	Inner    forwarder.UpstreamDialer
+	Injector *Injector
+
+	LatencyRate float64       // LatencyRate is the probability that a dial is delayed.
+	MaxLatency  time.Duration // MaxLatency is the most that a dial is delayed by.
+	FailureRate float64       // FailureRate is the probability that a dial fails with a *forwarder.DialError wrapping InjectedFault.
+
+	// Wrap is optional. If set, it wraps each connection dialed.
+	Wrap ConnWrapper
+}
+
+func (d *Dialer) DialUpstream(ctx context.Context, upstream core.Upstream) (core.DuplexConn, error) {
+	if d.Injector.Chance(d.LatencyRate) {
+		if err := sleep(ctx, d.Injector.Duration(d.MaxLatency)); err != nil {
+			return nil, &forwarder.DialError{Upstream: upstream, Err: err}
+		}
+	}
+	if d.Injector.Chance(d.FailureRate) {
+		return nil, &forwarder.DialError{Upstream: upstream, Err: InjectedFault}
+	}
+	conn, err := d.Inner.DialUpstream(ctx, upstream)
+	if err != nil || d.Wrap == nil {
+		return conn, err
+	}
+	return d.Wrap(conn), nil
+}
+
+var _ forwarder.UpstreamDialer = (*Dialer)(nil) // type check
+
+// Config selects the faults to inject, and how often. Faults whose rate is
+// not positive are not injected.
+type Config struct {
+	Seed int64 // Seed determines the random choices of when and how to inject faults.
+
+	DialLatencyRate float64       // DialLatencyRate is the probability that a dial is delayed.
+	MaxDialLatency  time.Duration // MaxDialLatency is the most that a dial is delayed by.
+	DialFailureRate float64       // DialFailureRate is the probability that a dial fails.
+
+	LatencyRate      float64       // LatencyRate is the probability that a Read or Write is delayed.
+	MaxLatency       time.Duration // MaxLatency is the most that a Read or Write is delayed by.
+	PartialWriteRate float64       // PartialWriteRate is the probability that a Write writes only part of its data, then fails.
+	ResetRate        float64       // ResetRate is the probability that the connection is reset instead of a Read or Write.
+	SlowReadRate     float64       // SlowReadRate is the probability that a Read trickles in.
+	SlowReadBytes    int           // SlowReadBytes is the most that a slow Read returns.
+	SlowReadDelay    time.Duration // SlowReadDelay is how long a slow Read waits before reading.
+}
+
+// NewDialer returns a Dialer that injects the faults selected by cfg into
+// the dials of inner, and into the connections it dials.
+func NewDialer(inner forwarder.UpstreamDialer, cfg Config) *Dialer {
+	in := NewInjector(cfg.Seed)
+	var wrappers []ConnWrapper
+	if cfg.LatencyRate > 0 {
+		wrappers = append(wrappers, Latency(in, cfg.LatencyRate, cfg.MaxLatency))
+	}
+	if cfg.SlowReadRate > 0 {
+		wrappers = append(wrappers, SlowReads(in, cfg.SlowReadRate, cfg.SlowReadBytes, cfg.SlowReadDelay))
+	}
+	if cfg.PartialWriteRate > 0 {
+		wrappers = append(wrappers, PartialWrites(in, cfg.PartialWriteRate))
+	}
+	if cfg.ResetRate > 0 {
+		wrappers = append(wrappers, Resets(in, cfg.ResetRate))
+	}
+	d := &Dialer{
+		Inner:       inner,
+		Injector:    in,
+		LatencyRate: cfg.DialLatencyRate,
+		MaxLatency:  cfg.MaxDialLatency,
+		FailureRate: cfg.DialFailureRate,
+	}
+	if len(wrappers) > 0 {
+		d.Wrap = Chain(wrappers...)
+	}
+	return d
+}
+
+// Middleware returns dialer.Middleware that injects the faults selected by
+// cfg, so that they may be injected at any point of a dialer.Chain, e.g.
+// beneath TLS to corrupt encrypted records, or above it to cut plaintext.
+func Middleware(cfg Config) dialer.Middleware {
+	return func(inner forwarder.UpstreamDialer) forwarder.UpstreamDialer {
+		return NewDialer(inner, cfg)
+	}
+}
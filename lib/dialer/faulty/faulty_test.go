@@ -0,0 +1,141 @@
+package faulty
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/require"
+	"io"
+	"net"
+	"tcplb/lib/core"
+	"tcplb/lib/dialer"
+	"tcplb/lib/forwarder"
+	"testing"
+	"time"
+)
+
+// newTCPConns returns both ends of a loopback TCP connection.
+func newTCPConns(t *testing.T) (*net.TCPConn, *net.TCPConn) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+	a, err := net.Dial("tcp", listener.Addr().String())
+	require.NoError(t, err)
+	b, err := listener.Accept()
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = a.Close()
+		_ = b.Close()
+	})
+	return a.(*net.TCPConn), b.(*net.TCPConn)
+}
+
+func TestInjectorIsDeterministic(t *testing.T) {
+	a, b := NewInjector(42), NewInjector(42)
+	for i := 0; i < 100; i++ {
+		require.Equal(t, a.Chance(0.5), b.Chance(0.5))
+		require.Equal(t, a.Duration(time.Second), b.Duration(time.Second))
+	}
+	require.False(t, a.Chance(0))
+	require.True(t, a.Chance(1))
+}
+
+func TestPartialWrites(t *testing.T) {
+	conn, peer := newTCPConns(t)
+	faulty := PartialWrites(NewInjector(1), 1)(conn)
+	n, err := faulty.Write([]byte("hello world"))
+	require.ErrorIs(t, err, io.ErrShortWrite)
+	require.ErrorIs(t, err, InjectedFault)
+	require.Less(t, n, len("hello world"))
+
+	require.NoError(t, faulty.CloseWrite())
+	data, err := io.ReadAll(peer)
+	require.NoError(t, err)
+	require.Equal(t, "hello world"[:n], string(data))
+}
+
+func TestResets(t *testing.T) {
+	conn, peer := newTCPConns(t)
+	faulty := Resets(NewInjector(1), 1)(conn)
+	_, err := faulty.Read(make([]byte, 1))
+	require.ErrorIs(t, err, InjectedFault)
+
+	// The peer sees a reset rather than EOF.
+	_, err = peer.Read(make([]byte, 1))
+	require.Error(t, err)
+	require.False(t, errors.Is(err, io.EOF))
+}
+
+func TestSlowReadsAndLatency(t *testing.T) {
+	conn, peer := newTCPConns(t)
+	in := NewInjector(1)
+	faulty := Chain(Latency(in, 1, 10*time.Millisecond), SlowReads(in, 1, 2, 10*time.Millisecond))(conn)
+	_, err := peer.Write([]byte("hello"))
+	require.NoError(t, err)
+	require.NoError(t, peer.CloseWrite())
+
+	start := time.Now()
+	buf := make([]byte, 64)
+	var data []byte
+	for {
+		n, err := faulty.Read(buf)
+		require.LessOrEqual(t, n, 2)
+		data = append(data, buf[:n]...)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		require.NoError(t, err)
+	}
+	require.Equal(t, "hello", string(data))
+	// At least three slow reads were needed.
+	require.GreaterOrEqual(t, time.Since(start), 30*time.Millisecond)
+}
+
+// connDialer dials connections to a loopback listener, whatever the
+// upstream.
+type connDialer struct {
+	t *testing.T
+}
+
+func (d connDialer) DialUpstream(ctx context.Context, upstream core.Upstream) (core.DuplexConn, error) {
+	conn, _ := newTCPConns(d.t)
+	return conn, nil
+}
+
+func TestDialer(t *testing.T) {
+	u := core.Upstream{Network: "tcp", Address: "upstream.test:80"}
+	d := NewDialer(connDialer{t: t}, Config{Seed: 1, DialFailureRate: 1})
+	_, err := d.DialUpstream(context.Background(), u)
+	var dialErr *forwarder.DialError
+	require.ErrorAs(t, err, &dialErr)
+	require.ErrorIs(t, err, InjectedFault)
+
+	conn, err := dialer.Chain{Middleware(Config{Seed: 1, ResetRate: 1})}.Then(connDialer{t: t}).DialUpstream(context.Background(), u)
+	require.NoError(t, err)
+	_, err = conn.Write([]byte("hello"))
+	require.ErrorIs(t, err, InjectedFault)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	d = NewDialer(connDialer{t: t}, Config{Seed: 1, DialLatencyRate: 1, MaxDialLatency: time.Hour})
+	_, err = d.DialUpstream(ctx, u)
+	require.ErrorIs(t, err, context.Canceled)
+}
+
+// TestRetryDialerToleratesDialFailures checks that the RetryDialer gets
+// through when most dials fail, as an example of chaos testing.
+func TestRetryDialerToleratesDialFailures(t *testing.T) {
+	candidates := core.NewUpstreamSet(
+		core.Upstream{Network: "tcp", Address: "a.test:80"},
+		core.Upstream{Network: "tcp", Address: "b.test:80"},
+	)
+	d := &dialer.RetryDialer{
+		Policy:  &dialer.RoundRobinDialPolicy{},
+		Dialer:  NewDialer(connDialer{t: t}, Config{Seed: 7, DialFailureRate: 0.8, DialLatencyRate: 0.5, MaxDialLatency: time.Millisecond}),
+		Timeout: 10 * time.Second,
+	}
+	for i := 0; i < 10; i++ {
+		_, conn, err := d.DialBestUpstream(context.Background(), candidates)
+		require.NoError(t, err)
+		require.NoError(t, conn.Close())
+	}
+}
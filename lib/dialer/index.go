@@ -0,0 +1,215 @@
+package dialer
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"tcplb/lib/core"
+)
+
+// UpstreamIndexer is implemented by DialPolicies that index the upstreams
+// of their pool, so that with thousands of upstreams, each choice need not
+// scan and sort every candidate.
+//
+// The candidates of each choice are expected to be indexed upstreams, e.g.
+// those of the pool that are authorized and healthy. Candidates that are
+// not indexed may be passed over while any indexed candidate remains, so
+// the index must be updated as the pool's upstreams are replaced.
+type UpstreamIndexer interface {
+	// IndexUpstreams replaces the indexed upstreams with upstreams.
+	IndexUpstreams(upstreams core.UpstreamSet)
+}
+
+// candidateScanRatio decides between scanning the candidates of a choice and
+// searching the index for them: if the index holds candidateScanRatio times
+// as many upstreams as there are candidates, or more, the few candidates
+// are scanned instead, as the index would mostly hold non-candidates.
+const candidateScanRatio = 4
+
+// sampleAttempts is the number of indexed upstreams sampled at random in
+// search of a candidate, before the search falls back to a scan.
+const sampleAttempts = 8
+
+// upstreamIndex is the upstreams of a pool, sorted by Network then Address.
+// It is not modified once built.
+type upstreamIndex struct {
+	sorted []core.Upstream
+}
+
+func newUpstreamIndex(upstreams core.UpstreamSet) *upstreamIndex {
+	return &upstreamIndex{sorted: upstreams.Sorted()}
+}
+
+// covers reports whether it is worth searching the index for candidates,
+// rather than scanning them.
+func (x *upstreamIndex) covers(candidates core.UpstreamSet) bool {
+	return x != nil && len(candidates)*candidateScanRatio > len(x.sorted)
+}
+
+// sample returns an indexed candidate chosen uniformly at random, other than
+// except, or false if there is none.
+func (x *upstreamIndex) sample(candidates core.UpstreamSet, except *core.Upstream, rng *lockedRand) (core.Upstream, bool) {
+	return sampleMembers(x.sorted, candidates, except, rng)
+}
+
+// sampleMembers returns a member of members that is a candidate, chosen
+// uniformly at random, other than except, or false if there is none.
+func sampleMembers(members []core.Upstream, candidates core.UpstreamSet, except *core.Upstream, rng *lockedRand) (core.Upstream, bool) {
+	eligible := func(u core.Upstream) bool {
+		return candidates.Contains(u) && (except == nil || u != *except)
+	}
+	if len(members) == 0 {
+		return core.Upstream{}, false
+	}
+	for i := 0; i < sampleAttempts; i++ {
+		if u := members[rng.Intn(len(members))]; eligible(u) {
+			return u, true
+		}
+	}
+	// Most members are not candidates. Choose among those that are.
+	var chosen core.Upstream
+	n := 0
+	for _, u := range members {
+		if !eligible(u) {
+			continue
+		}
+		n++
+		if rng.Intn(n) == 0 {
+			chosen = u
+		}
+	}
+	return chosen, n > 0
+}
+
+// loadBuckets groups the upstreams of an index by their number of open
+// connections, so that the least loaded candidates are found without
+// scanning every upstream. As connections open and close one at a time,
+// each moves an upstream to an adjacent bucket.
+type loadBuckets struct {
+	members map[int64][]core.Upstream // members are the upstreams of each count, in no order.
+	slots   map[core.Upstream]int     // slots are the positions of upstreams in their members.
+	levels  []int64                   // levels are the counts of nonempty buckets, ascending.
+}
+
+// newLoadBuckets returns the buckets of the indexed upstreams, whose counts
+// of open connections are counts.
+func newLoadBuckets(index *upstreamIndex, counts map[core.Upstream]int64) *loadBuckets {
+	b := &loadBuckets{
+		members: make(map[int64][]core.Upstream),
+		slots:   make(map[core.Upstream]int, len(index.sorted)),
+	}
+	for _, u := range index.sorted {
+		b.add(u, counts[u])
+	}
+	return b
+}
+
+func (b *loadBuckets) add(u core.Upstream, count int64) {
+	members := b.members[count]
+	if len(members) == 0 {
+		i := sort.Search(len(b.levels), func(i int) bool { return b.levels[i] >= count })
+		b.levels = append(b.levels, 0)
+		copy(b.levels[i+1:], b.levels[i:])
+		b.levels[i] = count
+	}
+	b.slots[u] = len(members)
+	b.members[count] = append(members, u)
+}
+
+func (b *loadBuckets) remove(u core.Upstream, count int64) {
+	members := b.members[count]
+	i := b.slots[u]
+	last := members[len(members)-1]
+	members[i] = last
+	b.slots[last] = i
+	members = members[:len(members)-1]
+	delete(b.slots, u)
+	if len(members) > 0 {
+		b.members[count] = members
+		return
+	}
+	delete(b.members, count)
+	j := sort.Search(len(b.levels), func(j int) bool { return b.levels[j] >= count })
+	b.levels = append(b.levels[:j], b.levels[j+1:]...)
+}
+
+// move records that the count of open connections to u changed from one
+// count to another. Upstreams that are not indexed are ignored.
+func (b *loadBuckets) move(u core.Upstream, from, to int64) {
+	if _, ok := b.slots[u]; !ok || from == to {
+		return
+	}
+	b.remove(u, from)
+	b.add(u, to)
+}
+
+// least returns a candidate with the fewest open connections, chosen
+// uniformly at random among those with as few, or false if no candidate
+// is indexed.
+func (b *loadBuckets) least(candidates core.UpstreamSet, rng *lockedRand) (core.Upstream, bool) {
+	for _, level := range b.levels {
+		if u, ok := sampleMembers(b.members[level], candidates, nil, rng); ok {
+			return u, true
+		}
+	}
+	return core.Upstream{}, false
+}
+
+// hashRingReplicas is the number of points of each upstream on a hashRing.
+// More points spread clients more evenly, in proportion to the square root
+// of their number, at the cost of memory and of time to build the ring.
+const hashRingReplicas = 64
+
+// hashRing places hashRingReplicas points of each upstream of an index on a
+// ring of hashes, so that the upstream of a client is found by a binary
+// search for its hash, rather than by hashing it with every candidate.
+// While the indexed upstreams are unchanged, removing a candidate only
+// moves the clients that chose it.
+type hashRing struct {
+	index  *upstreamIndex
+	points []ringPoint // points are sorted by hash.
+}
+
+type ringPoint struct {
+	hash     uint64
+	upstream int // upstream is the position of the upstream in index.sorted.
+}
+
+func newHashRing(index *upstreamIndex) *hashRing {
+	r := &hashRing{index: index, points: make([]ringPoint, 0, len(index.sorted)*hashRingReplicas)}
+	for i, u := range index.sorted {
+		for replica := 0; replica < hashRingReplicas; replica++ {
+			h := fnv.New64a()
+			_, _ = fmt.Fprintf(h, "%s\x00%s\x00%d", u.Network, u.Address, replica)
+			r.points = append(r.points, ringPoint{hash: mix64(h.Sum64()), upstream: i})
+		}
+	}
+	sort.Slice(r.points, func(i, j int) bool {
+		return r.points[i].hash < r.points[j].hash
+	})
+	return r
+}
+
+// choose returns the first candidate at or after hash on the ring, or
+// false if no candidate is indexed.
+func (r *hashRing) choose(hash uint64, candidates core.UpstreamSet) (core.Upstream, bool) {
+	start := sort.Search(len(r.points), func(i int) bool { return r.points[i].hash >= hash })
+	for i := 0; i < len(r.points); i++ {
+		p := r.points[(start+i)%len(r.points)]
+		if u := r.index.sorted[p.upstream]; candidates.Contains(u) {
+			return u, true
+		}
+	}
+	return core.Upstream{}, false
+}
+
+// mix64 is the finalizer of SplitMix64, which spreads FNV hashes, whose
+// high bits vary little between similar inputs, over the whole ring.
+func mix64(h uint64) uint64 {
+	h ^= h >> 30
+	h *= 0xbf58476d1ce4e5b9
+	h ^= h >> 27
+	h *= 0x94d049bb133111eb
+	h ^= h >> 31
+	return h
+}
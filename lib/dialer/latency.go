@@ -0,0 +1,126 @@
+package dialer
+
+import (
+	"context"
+	"sync"
+	"tcplb/lib/clock"
+	"tcplb/lib/core"
+	"tcplb/lib/forwarder"
+	"tcplb/lib/metrics"
+	"time"
+)
+
+// UpstreamLatency holds the latencies observed for an upstream, in
+// microseconds.
+type UpstreamLatency struct {
+	Dial      metrics.HistogramSnapshot // Dial is the time taken by successful dials.
+	FirstByte metrics.HistogramSnapshot // FirstByte is the time from a dial succeeding until the first byte is read from the upstream.
+}
+
+// LatencyTracker records, for each upstream, the latency of successful dials
+// and the time to the first byte from the upstream once dialed, as
+// histograms. Latency-aware DialPolicies may use it to prefer upstreams that
+// respond quickly.
+//
+// Multiple goroutines may invoke methods on a LatencyTracker simultaneously.
+type LatencyTracker struct {
+	registry *metrics.Registry
+
+	mu         sync.Mutex // mu guards histograms
+	histograms map[core.Upstream]*latencyHistograms
+}
+
+type latencyHistograms struct {
+	dial      *metrics.Histogram
+	firstByte *metrics.Histogram
+}
+
+// NewLatencyTracker returns a LatencyTracker that publishes the histograms
+// of each upstream in registry, which is optional, as
+// upstream_ADDRESS_dial_latency_us and upstream_ADDRESS_first_byte_latency_us.
+func NewLatencyTracker(registry *metrics.Registry) *LatencyTracker {
+	return &LatencyTracker{registry: registry, histograms: make(map[core.Upstream]*latencyHistograms)}
+}
+
+func (t *LatencyTracker) upstream(u core.Upstream) *latencyHistograms {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	h, ok := t.histograms[u]
+	if ok {
+		return h
+	}
+	h = &latencyHistograms{}
+	if t.registry != nil {
+		h.dial = t.registry.Histogram("upstream_"+u.Address+"_dial_latency_us", metrics.LatencyBoundsMicros)
+		h.firstByte = t.registry.Histogram("upstream_"+u.Address+"_first_byte_latency_us", metrics.LatencyBoundsMicros)
+	} else {
+		h.dial = metrics.NewHistogram(metrics.LatencyBoundsMicros)
+		h.firstByte = metrics.NewHistogram(metrics.LatencyBoundsMicros)
+	}
+	t.histograms[u] = h
+	return h
+}
+
+// ObserveDial records that a dial of u succeeded after d.
+func (t *LatencyTracker) ObserveDial(u core.Upstream, d time.Duration) {
+	t.upstream(u).dial.Observe(d.Microseconds())
+}
+
+// ObserveFirstByte records that the first byte was read from u, d after it
+// was dialed.
+func (t *LatencyTracker) ObserveFirstByte(u core.Upstream, d time.Duration) {
+	t.upstream(u).firstByte.Observe(d.Microseconds())
+}
+
+// Latency returns the latencies observed for u so far.
+func (t *LatencyTracker) Latency(u core.Upstream) UpstreamLatency {
+	t.mu.Lock()
+	h, ok := t.histograms[u]
+	t.mu.Unlock()
+	if !ok {
+		return UpstreamLatency{}
+	}
+	return UpstreamLatency{Dial: h.dial.Snapshot(), FirstByte: h.firstByte.Snapshot()}
+}
+
+// LatencyRecordingDialer is an UpstreamDialer that records, in Latency, the
+// latency of each successful dial by Dialer, and the time until the first
+// byte is read from the dialed upstream.
+type LatencyRecordingDialer struct {
+	Dialer  forwarder.UpstreamDialer
+	Latency *LatencyTracker
+	Clock   clock.Clock // Clock is optional. If nil, the Real clock is used.
+}
+
+func (d *LatencyRecordingDialer) DialUpstream(ctx context.Context, upstream core.Upstream) (core.DuplexConn, error) {
+	clk := clock.Or(d.Clock)
+	start := clk.Now()
+	conn, err := d.Dialer.DialUpstream(ctx, upstream)
+	if err != nil {
+		return nil, err
+	}
+	dialed := clk.Now()
+	d.Latency.ObserveDial(upstream, dialed.Sub(start))
+	return &firstByteConn{WrappedConn: core.WrappedConn{DuplexConn: conn}, upstream: upstream, tracker: d.Latency, clock: clk, dialed: dialed}, nil
+}
+
+var _ forwarder.UpstreamDialer = (*LatencyRecordingDialer)(nil) // type check
+
+// firstByteConn reports the time from when it was dialed until its first
+// byte is read to a LatencyTracker.
+type firstByteConn struct {
+	core.WrappedConn
+	upstream core.Upstream
+	tracker  *LatencyTracker
+	clock    clock.Clock
+	dialed   time.Time
+	once     sync.Once
+}
+
+func (c *firstByteConn) Read(p []byte) (int, error) {
+	n, err := c.DuplexConn.Read(p)
+	if n > 0 {
+		c.once.Do(func() { c.tracker.ObserveFirstByte(c.upstream, c.clock.Now().Sub(c.dialed)) })
+	}
+	return n, err
+}
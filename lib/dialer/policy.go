@@ -0,0 +1,609 @@
+// Package dialer chooses which upstream to forward each client connection
+// to, according to a configurable DialPolicy, and dials it, retrying other
+// upstreams if the dial fails.
+package dialer
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"tcplb/lib/core"
+	"tcplb/lib/forwarder"
+	"time"
+)
+
+// NoCandidateUpstreams is returned when there are no upstreams to choose
+// from. It is forwarder.NoUpstreamAvailable, so that handlers recognise it.
+var NoCandidateUpstreams = forwarder.NoUpstreamAvailable
+
+var UnknownPolicy = errors.New("unknown dial policy")
+
+// DialPolicy chooses which of a set of candidate upstreams to dial.
+//
+// Multiple goroutines may invoke methods on a DialPolicy simultaneously.
+type DialPolicy interface {
+	// ChooseUpstream returns the candidate that should be dialed next. If
+	// candidates is empty, NoCandidateUpstreams is returned.
+	ChooseUpstream(ctx context.Context, candidates core.UpstreamSet) (core.Upstream, error)
+}
+
+// LoadObserver is implemented by DialPolicies that take the number of open
+// connections to each upstream into account.
+type LoadObserver interface {
+	// ConnectionOpened is called when a connection to u is established.
+	ConnectionOpened(u core.Upstream)
+	// ConnectionClosed is called when a connection to u is closed.
+	ConnectionClosed(u core.Upstream)
+}
+
+// FailureObserver is implemented by DialPolicies that take failures of
+// upstream connections, after they were established, into account.
+type FailureObserver interface {
+	// UpstreamFailed is called when forwarding to u fails because of an
+	// error on the upstream connection.
+	UpstreamFailed(u core.Upstream)
+}
+
+// ConnectionStats summarises the use of a connection to an upstream, once
+// it is closed.
+type ConnectionStats struct {
+	BytesSent     int64         // BytesSent is the number of bytes written to the upstream, i.e. forwarded from the client.
+	BytesReceived int64         // BytesReceived is the number of bytes read from the upstream, i.e. forwarded to the client.
+	Duration      time.Duration // Duration is the time from when the connection was established until it was closed.
+}
+
+// CompletionObserver is implemented by DialPolicies that learn from the
+// connections they chose once those are finished, e.g. to prefer
+// upstreams that used less bandwidth or served sessions faster, rather
+// than only counting open connections.
+type CompletionObserver interface {
+	// ConnectionCompleted is called when a connection to u is closed, with
+	// statistics of its use.
+	ConnectionCompleted(u core.Upstream, stats ConnectionStats)
+}
+
+// connectionCounts tracks the number of open connections to each upstream.
+type connectionCounts struct {
+	mu      sync.Mutex // mu guards counts, index and buckets
+	counts  map[core.Upstream]int64
+	index   *upstreamIndex // index is nil until IndexUpstreams is called.
+	buckets *loadBuckets   // buckets are optional. If set, they are kept up to date with counts.
+}
+
+func (c *connectionCounts) ConnectionOpened(u core.Upstream) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.counts == nil {
+		c.counts = make(map[core.Upstream]int64)
+	}
+	c.counts[u]++
+	if c.buckets != nil {
+		c.buckets.move(u, c.counts[u]-1, c.counts[u])
+	}
+}
+
+func (c *connectionCounts) ConnectionClosed(u core.Upstream) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := c.counts[u]
+	c.counts[u]--
+	if c.counts[u] <= 0 {
+		delete(c.counts, u)
+	}
+	if c.buckets != nil && n > 0 {
+		c.buckets.move(u, n, n-1)
+	}
+}
+
+// LeastConnectionsDialPolicy chooses the candidate with the fewest open
+// connections. Ties are broken at random. Once upstreams are indexed, the
+// least loaded are found via buckets of upstreams by load.
+type LeastConnectionsDialPolicy struct {
+	connectionCounts
+	rng lockedRand
+}
+
+func (p *LeastConnectionsDialPolicy) ChooseUpstream(ctx context.Context, candidates core.UpstreamSet) (core.Upstream, error) {
+	if len(candidates) == 0 {
+		return core.Upstream{}, NoCandidateUpstreams
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.index.covers(candidates) {
+		if u, ok := p.buckets.least(candidates, &p.rng); ok {
+			return u, nil
+		}
+	}
+	var best core.Upstream
+	var bestCount int64
+	ties := 0
+	for u := range candidates {
+		n := p.counts[u]
+		switch {
+		case ties == 0 || n < bestCount:
+			best, bestCount, ties = u, n, 1
+		case n == bestCount:
+			ties++
+			if p.rng.Intn(ties) == 0 {
+				best = u
+			}
+		}
+	}
+	return best, nil
+}
+
+func (p *LeastConnectionsDialPolicy) IndexUpstreams(upstreams core.UpstreamSet) {
+	index := newUpstreamIndex(upstreams)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.index = index
+	p.buckets = newLoadBuckets(index, p.counts)
+}
+
+// LeastBandwidthDialPolicy chooses the candidate with the least estimated
+// bandwidth in use: its open connections times the average number of bytes
+// forwarded by its completed connections. The average is a moving average,
+// so that it follows changes in the sessions an upstream serves. Upstreams
+// with no completed connections are assumed to be average, among the
+// candidates. Ties are broken at random.
+type LeastBandwidthDialPolicy struct {
+	connectionCounts
+	rng lockedRand
+
+	// averages holds the moving average of bytes per completed connection
+	// to each upstream. It is guarded by connectionCounts.mu.
+	averages map[core.Upstream]float64
+}
+
+// bandwidthSmoothing is the weight of each completed connection in the
+// moving average of bytes per connection.
+const bandwidthSmoothing = 0.125
+
+func (p *LeastBandwidthDialPolicy) ChooseUpstream(ctx context.Context, candidates core.UpstreamSet) (core.Upstream, error) {
+	if len(candidates) == 0 {
+		return core.Upstream{}, NoCandidateUpstreams
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	fallback, known := 0.0, 0
+	for u := range candidates {
+		if avg, ok := p.averages[u]; ok {
+			fallback += avg
+			known++
+		}
+	}
+	if known > 0 {
+		fallback /= float64(known)
+	}
+	var best core.Upstream
+	var bestLoad float64
+	ties := 0
+	for u := range candidates {
+		avg, ok := p.averages[u]
+		if !ok {
+			avg = fallback
+		}
+		// Adding one to the open connections prefers the upstream whose
+		// next connection is expected to add the least, and tells apart
+		// upstreams with no open connections.
+		load := float64(p.counts[u]+1) * (avg + 1)
+		switch {
+		case ties == 0 || load < bestLoad:
+			best, bestLoad, ties = u, load, 1
+		case load == bestLoad:
+			ties++
+			if p.rng.Intn(ties) == 0 {
+				best = u
+			}
+		}
+	}
+	return best, nil
+}
+
+// ConnectionCompleted updates the average bytes per connection to u.
+func (p *LeastBandwidthDialPolicy) ConnectionCompleted(u core.Upstream, stats ConnectionStats) {
+	bytes := float64(stats.BytesSent + stats.BytesReceived)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.averages == nil {
+		p.averages = make(map[core.Upstream]float64)
+	}
+	avg, ok := p.averages[u]
+	if !ok {
+		p.averages[u] = bytes
+		return
+	}
+	p.averages[u] = avg + bandwidthSmoothing*(bytes-avg)
+}
+
+// RoundRobinDialPolicy chooses each candidate in turn. Once upstreams are
+// indexed, candidates are chosen in turn in the order of the index, which
+// need not be sorted for each choice.
+type RoundRobinDialPolicy struct {
+	mu    sync.Mutex // mu guards next and index
+	next  uint64
+	index *upstreamIndex // index is nil until IndexUpstreams is called.
+}
+
+func (p *RoundRobinDialPolicy) ChooseUpstream(ctx context.Context, candidates core.UpstreamSet) (core.Upstream, error) {
+	if len(candidates) == 0 {
+		return core.Upstream{}, NoCandidateUpstreams
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.index.covers(candidates) {
+		sorted := p.index.sorted
+		for i := uint64(0); i < uint64(len(sorted)); i++ {
+			j := (p.next + i) % uint64(len(sorted))
+			if candidates.Contains(sorted[j]) {
+				p.next = j + 1
+				return sorted[j], nil
+			}
+		}
+	}
+	sorted := candidates.Sorted()
+	i := p.next % uint64(len(sorted))
+	p.next++
+	return sorted[i], nil
+}
+
+func (p *RoundRobinDialPolicy) IndexUpstreams(upstreams core.UpstreamSet) {
+	index := newUpstreamIndex(upstreams)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.index = index
+}
+
+// WeightedRoundRobinDialPolicy chooses candidates in turn, in proportion to
+// their weights, interleaving choices smoothly rather than in bursts.
+// Upstreams without a configured weight use their weight label from
+// Registry, if any, or otherwise have weight 1.
+type WeightedRoundRobinDialPolicy struct {
+	Weights  map[core.Upstream]int
+	Registry *core.UpstreamRegistry // Registry is optional.
+
+	mu      sync.Mutex // mu guards current and total
+	current map[core.Upstream]int
+	total   int // total is the weight of the candidates of the latest choice.
+}
+
+func (p *WeightedRoundRobinDialPolicy) weight(u core.Upstream) int {
+	return upstreamWeight(p.Weights, p.Registry, u)
+}
+
+// upstreamWeight returns the weight of u: its weight in weights, if any,
+// or otherwise its weight label in registry, if any, or otherwise 1.
+func upstreamWeight(weights map[core.Upstream]int, registry *core.UpstreamRegistry, u core.Upstream) int {
+	if w, ok := weights[u]; ok && w > 0 {
+		return w
+	}
+	if w, ok := registry.Weight(u); ok {
+		return w
+	}
+	return 1
+}
+
+func (p *WeightedRoundRobinDialPolicy) ChooseUpstream(ctx context.Context, candidates core.UpstreamSet) (core.Upstream, error) {
+	if len(candidates) == 0 {
+		return core.Upstream{}, NoCandidateUpstreams
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.current == nil {
+		p.current = make(map[core.Upstream]int)
+	}
+	// Smooth weighted round robin: every candidate earns its weight, then
+	// the richest candidate is chosen and pays the total.
+	var best core.Upstream
+	total := 0
+	for i, u := range candidates.Sorted() {
+		w := p.weight(u)
+		total += w
+		p.current[u] += w
+		if i == 0 || p.current[u] > p.current[best] {
+			best = u
+		}
+	}
+	p.current[best] -= total
+	p.total = total
+	return best, nil
+}
+
+// UpstreamFailed defers the next choice of u, by charging it the total
+// weight of the latest candidates, as if it had just been chosen.
+func (p *WeightedRoundRobinDialPolicy) UpstreamFailed(u core.Upstream) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.current == nil {
+		p.current = make(map[core.Upstream]int)
+	}
+	total := p.total
+	if total == 0 {
+		total = p.weight(u)
+	}
+	p.current[u] -= total
+}
+
+// PowerOfTwoChoicesDialPolicy chooses two candidates at random, then the one
+// of those with fewer open connections. This approximates least-connections
+// while avoiding herding onto a single upstream. Once upstreams are indexed,
+// the two are sampled from the index.
+type PowerOfTwoChoicesDialPolicy struct {
+	connectionCounts
+	rng lockedRand
+}
+
+func (p *PowerOfTwoChoicesDialPolicy) ChooseUpstream(ctx context.Context, candidates core.UpstreamSet) (core.Upstream, error) {
+	if len(candidates) == 0 {
+		return core.Upstream{}, NoCandidateUpstreams
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	a, b, ok := p.sampleTwo(candidates)
+	if !ok {
+		return a, nil
+	}
+	if p.counts[b] < p.counts[a] {
+		return b, nil
+	}
+	return a, nil
+}
+
+// sampleTwo returns two distinct candidates chosen at random, or a single
+// candidate and false if there is only one. The caller must hold p.mu.
+func (p *PowerOfTwoChoicesDialPolicy) sampleTwo(candidates core.UpstreamSet) (a, b core.Upstream, ok bool) {
+	if len(candidates) > 1 && p.index.covers(candidates) {
+		if a, ok := p.index.sample(candidates, nil, &p.rng); ok {
+			if b, ok := p.index.sample(candidates, &a, &p.rng); ok {
+				return a, b, true
+			}
+		}
+	}
+	sorted := candidates.Sorted()
+	if len(sorted) == 1 {
+		return sorted[0], core.Upstream{}, false
+	}
+	i := p.rng.Intn(len(sorted))
+	j := p.rng.Intn(len(sorted) - 1)
+	if j >= i {
+		j++
+	}
+	return sorted[i], sorted[j], true
+}
+
+func (p *PowerOfTwoChoicesDialPolicy) IndexUpstreams(upstreams core.UpstreamSet) {
+	index := newUpstreamIndex(upstreams)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.index = index
+}
+
+// RandomDialPolicy chooses a candidate uniformly at random. It shares no
+// state between choices, so it is cheap at very high connection rates,
+// where the locking of policies such as LeastConnectionsDialPolicy contends.
+type RandomDialPolicy struct{}
+
+func (p RandomDialPolicy) ChooseUpstream(ctx context.Context, candidates core.UpstreamSet) (core.Upstream, error) {
+	if len(candidates) == 0 {
+		return core.Upstream{}, NoCandidateUpstreams
+	}
+	i := pooledIntn(len(candidates))
+	for u := range candidates {
+		if i == 0 {
+			return u, nil
+		}
+		i--
+	}
+	panic("unreachable")
+}
+
+// WeightedRandomDialPolicy chooses a candidate at random, in proportion to
+// its weight. Upstreams without a configured weight use their weight label
+// from Registry, if any, or otherwise have weight 1. Like RandomDialPolicy,
+// it shares no state between choices.
+type WeightedRandomDialPolicy struct {
+	Weights  map[core.Upstream]int
+	Registry *core.UpstreamRegistry // Registry is optional.
+}
+
+func (p *WeightedRandomDialPolicy) ChooseUpstream(ctx context.Context, candidates core.UpstreamSet) (core.Upstream, error) {
+	if len(candidates) == 0 {
+		return core.Upstream{}, NoCandidateUpstreams
+	}
+	// Weights are read once per dial, as they may be looked up in the
+	// Registry.
+	upstreams := make([]core.Upstream, 0, len(candidates))
+	weights := make([]int, 0, len(candidates))
+	total := 0
+	for u := range candidates {
+		w := upstreamWeight(p.Weights, p.Registry, u)
+		upstreams = append(upstreams, u)
+		weights = append(weights, w)
+		total += w
+	}
+	// Each candidate owns a span of [0, total) as wide as its weight, in
+	// whichever order the candidates are visited.
+	r := pooledIntn(total)
+	for i, w := range weights {
+		r -= w
+		if r < 0 {
+			return upstreams[i], nil
+		}
+	}
+	return upstreams[len(upstreams)-1], nil
+}
+
+// HashDialPolicy consistently chooses the same candidate for the same
+// client, so that repeated connections from a client reach the same
+// upstream while the candidates are unchanged. When candidates are added
+// or removed, only the clients of those upstreams move. Until upstreams are
+// indexed, every candidate is hashed with the client (rendezvous hashing).
+// Once they are, the client's hash is looked up on a ring of the indexed
+// upstreams (consistent hashing), which chooses differently.
+type HashDialPolicy struct {
+	mu   sync.Mutex // mu guards ring
+	ring *hashRing  // ring is nil until IndexUpstreams is called.
+}
+
+func (p *HashDialPolicy) ChooseUpstream(ctx context.Context, candidates core.UpstreamSet) (core.Upstream, error) {
+	if len(candidates) == 0 {
+		return core.Upstream{}, NoCandidateUpstreams
+	}
+	clientID, _ := forwarder.ClientIDFromContext(ctx)
+	p.mu.Lock()
+	ring := p.ring
+	p.mu.Unlock()
+	if ring != nil {
+		if u, ok := ring.choose(mix64(clientID.Hash()), candidates); ok {
+			return u, nil
+		}
+	}
+	var clientHash [8]byte
+	binary.BigEndian.PutUint64(clientHash[:], clientID.Hash())
+	var best core.Upstream
+	var bestScore uint64
+	for i, u := range candidates.Sorted() {
+		h := fnv.New64a()
+		_, _ = h.Write(clientHash[:])
+		_, _ = fmt.Fprintf(h, "%s\x00%s", u.Network, u.Address)
+		score := h.Sum64()
+		if i == 0 || score > bestScore {
+			best, bestScore = u, score
+		}
+	}
+	return best, nil
+}
+
+func (p *HashDialPolicy) IndexUpstreams(upstreams core.UpstreamSet) {
+	ring := newHashRing(newUpstreamIndex(upstreams))
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.ring = ring
+}
+
+// lockedRand is a source of random numbers safe for concurrent use.
+type lockedRand struct {
+	mu  sync.Mutex
+	rng *rand.Rand
+}
+
+func (r *lockedRand) Intn(n int) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.rng == nil {
+		r.rng = rand.New(rand.NewSource(time.Now().UnixNano()))
+	}
+	return r.rng.Intn(n)
+}
+
+// randPool holds sources of random numbers, so that concurrent choices do
+// not contend for a single locked source.
+var randPool = sync.Pool{
+	New: func() any {
+		return rand.New(rand.NewSource(time.Now().UnixNano() + atomic.AddInt64(&randSeeds, 1)))
+	},
+}
+
+// randSeeds distinguishes the seeds of sources created at the same time.
+var randSeeds int64
+
+// pooledIntn returns a random number in [0, n) from a source in randPool.
+func pooledIntn(n int) int {
+	rng := randPool.Get().(*rand.Rand)
+	i := rng.Intn(n)
+	randPool.Put(rng)
+	return i
+}
+
+var _ DialPolicy = (*LeastConnectionsDialPolicy)(nil)        // type check
+var _ LoadObserver = (*LeastConnectionsDialPolicy)(nil)      // type check
+var _ UpstreamIndexer = (*LeastConnectionsDialPolicy)(nil)   // type check
+var _ DialPolicy = (*LeastBandwidthDialPolicy)(nil)          // type check
+var _ LoadObserver = (*LeastBandwidthDialPolicy)(nil)        // type check
+var _ CompletionObserver = (*LeastBandwidthDialPolicy)(nil)  // type check
+var _ DialPolicy = (*RoundRobinDialPolicy)(nil)              // type check
+var _ UpstreamIndexer = (*RoundRobinDialPolicy)(nil)         // type check
+var _ DialPolicy = (*WeightedRoundRobinDialPolicy)(nil)      // type check
+var _ FailureObserver = (*WeightedRoundRobinDialPolicy)(nil) // type check
+var _ DialPolicy = (*PowerOfTwoChoicesDialPolicy)(nil)       // type check
+var _ LoadObserver = (*PowerOfTwoChoicesDialPolicy)(nil)     // type check
+var _ UpstreamIndexer = (*PowerOfTwoChoicesDialPolicy)(nil)  // type check
+var _ DialPolicy = RandomDialPolicy{}                        // type check
+var _ DialPolicy = (*WeightedRandomDialPolicy)(nil)          // type check
+var _ DialPolicy = (*HashDialPolicy)(nil)                    // type check
+var _ UpstreamIndexer = (*HashDialPolicy)(nil)               // type check
+
+// Names of the policies constructed by NewDialPolicy.
+const (
+	LeastConnectionsPolicy   = "least-connections"
+	LeastBandwidthPolicy     = "least-bandwidth"
+	RoundRobinPolicy         = "round-robin"
+	WeightedRoundRobinPolicy = "weighted-round-robin"
+	PowerOfTwoChoicesPolicy  = "p2c"
+	HashPolicy               = "hash"
+	RandomPolicy             = "random"
+	WeightedRandomPolicy     = "weighted-random"
+)
+
+// PolicyNames lists the names accepted by NewDialPolicy.
+var PolicyNames = []string{
+	LeastConnectionsPolicy,
+	LeastBandwidthPolicy,
+	RoundRobinPolicy,
+	WeightedRoundRobinPolicy,
+	PowerOfTwoChoicesPolicy,
+	HashPolicy,
+	RandomPolicy,
+	WeightedRandomPolicy,
+}
+
+// PolicyConfig configures a DialPolicy constructed by NewDialPolicy.
+type PolicyConfig struct {
+	Name     string                 // Name is one of PolicyNames.
+	Weights  map[core.Upstream]int  // Weights are used by weighted policies. Unlisted upstreams use their weight label, or 1.
+	Registry *core.UpstreamRegistry // Registry optionally holds upstream labels.
+	// Upstreams are optional. If set, policies that are UpstreamIndexers
+	// index them.
+	Upstreams core.UpstreamSet
+}
+
+// NewDialPolicy returns a new DialPolicy configured by cfg. Each call
+// returns an independent policy, with its own state.
+func NewDialPolicy(cfg PolicyConfig) (DialPolicy, error) {
+	policy, err := newDialPolicy(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if indexer, ok := policy.(UpstreamIndexer); ok && cfg.Upstreams != nil {
+		indexer.IndexUpstreams(cfg.Upstreams)
+	}
+	return policy, nil
+}
+
+func newDialPolicy(cfg PolicyConfig) (DialPolicy, error) {
+	switch cfg.Name {
+	case LeastConnectionsPolicy:
+		return &LeastConnectionsDialPolicy{}, nil
+	case LeastBandwidthPolicy:
+		return &LeastBandwidthDialPolicy{}, nil
+	case RoundRobinPolicy:
+		return &RoundRobinDialPolicy{}, nil
+	case WeightedRoundRobinPolicy:
+		return &WeightedRoundRobinDialPolicy{Weights: cfg.Weights, Registry: cfg.Registry}, nil
+	case PowerOfTwoChoicesPolicy:
+		return &PowerOfTwoChoicesDialPolicy{}, nil
+	case HashPolicy:
+		return &HashDialPolicy{}, nil
+	case RandomPolicy:
+		return RandomDialPolicy{}, nil
+	case WeightedRandomPolicy:
+		return &WeightedRandomDialPolicy{Weights: cfg.Weights, Registry: cfg.Registry}, nil
+	default:
+		return nil, fmt.Errorf("%w: %q (expected one of %v)", UnknownPolicy, cfg.Name, PolicyNames)
+	}
+}
@@ -0,0 +1,257 @@
+package dialer
+
+import (
+	"context"
+	stderrors "errors"
+	"sync"
+	"sync/atomic"
+	"tcplb/lib/clock"
+	"tcplb/lib/core"
+	"tcplb/lib/errors"
+	"tcplb/lib/forwarder"
+	"tcplb/lib/healthcheck"
+	"time"
+)
+
+// MaxAttemptsExceeded is returned, within an AggregateError, by a
+// RetryDialer that gave up after MaxAttempts dials failed.
+var MaxAttemptsExceeded = stderrors.New("max dial attempts exceeded")
+
+// RetryDialer is a BestUpstreamDialer that uses a DialPolicy to choose
+// which candidate to dial. If a dial fails, another candidate is chosen,
+// until a dial succeeds, the Timeout budget is spent, or MaxAttempts dials
+// have failed. Each failed candidate is excluded from the next choices,
+// until every candidate has failed, after which all candidates may be tried
+// again following Backoff. If Timeout is not positive, or FailFast is set,
+// each candidate is tried at most once.
+type RetryDialer struct {
+	Policy  DialPolicy
+	Dialer  forwarder.UpstreamDialer
+	Timeout time.Duration // Timeout bounds the total time spent dialing.
+	Backoff time.Duration // Backoff is the pause after every candidate has failed, before trying again.
+
+	// MaxAttempts bounds the number of candidates dialed, counting each
+	// retry of a candidate, so that dialing fails promptly even if time
+	// remains in the Timeout budget. Candidates skipped as their circuit is
+	// open are not counted. If not positive, there is no bound.
+	MaxAttempts int
+
+	// FailFast gives up as soon as every candidate has failed once, so that
+	// the client learns of the failure promptly instead of waiting while
+	// candidates are retried.
+	FailFast bool
+
+	// Filter is optional. If set, only candidates for which Filter returns
+	// true are considered, e.g. to skip drained upstreams.
+	Filter func(u core.Upstream) bool
+
+	// Health is optional. If set, failures reported by ReportUpstreamFailure
+	// are also reported to it as failed health checks.
+	Health healthcheck.HealthReporter
+
+	// Breaker is optional. If set, candidates whose circuit is open are not
+	// dialed, and the outcome of each dial, as well as failures reported by
+	// ReportUpstreamFailure, are reported to it.
+	Breaker *CircuitBreaker
+
+	// Latency is optional. If set, the latency of each successful dial, and
+	// the time until the first byte is read from the dialed upstream, are
+	// recorded in it.
+	Latency *LatencyTracker
+
+	// Clock is optional. If nil, the system clock is used.
+	Clock clock.Clock
+}
+
+func (d *RetryDialer) DialBestUpstream(ctx context.Context, candidates core.UpstreamSet) (core.Upstream, core.DuplexConn, error) {
+	if d.Filter != nil {
+		candidates = candidates.Filter(d.Filter)
+	}
+	if len(candidates) == 0 {
+		return core.Upstream{}, nil, NoCandidateUpstreams
+	}
+
+	if d.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = clock.WithTimeout(ctx, d.Clock, d.Timeout)
+		defer cancel()
+	}
+
+	var errs []error
+	remaining := core.Union(candidates, nil)
+	dialed := false // dialed is set once any candidate is dialed in this pass.
+	attempts := 0
+	for {
+		upstream, err := d.Policy.ChooseUpstream(ctx, remaining)
+		if err != nil {
+			errs = append(errs, err)
+			return core.Upstream{}, nil, dialFailed(errs, attempts)
+		}
+		conn, err := d.dial(ctx, upstream)
+		if !stderrors.Is(err, CircuitOpen) {
+			dialed = true
+			attempts++
+		}
+		if err == nil {
+			if observer, ok := d.Policy.(LoadObserver); ok {
+				observer.ConnectionOpened(upstream)
+				conn = &observedConn{WrappedConn: core.WrappedConn{DuplexConn: conn}, upstream: upstream, observer: observer}
+			}
+			if observer, ok := d.Policy.(CompletionObserver); ok {
+				clk := clock.Or(d.Clock)
+				conn = &completionConn{WrappedConn: core.WrappedConn{DuplexConn: conn}, upstream: upstream, observer: observer, clock: clk, opened: clk.Now()}
+			}
+			return upstream, conn, nil
+		}
+		errs = append(errs, err)
+		if ctx.Err() != nil {
+			errs = append(errs, ctx.Err())
+			return core.Upstream{}, nil, dialFailed(errs, attempts)
+		}
+		if d.MaxAttempts > 0 && attempts >= d.MaxAttempts {
+			errs = append(errs, MaxAttemptsExceeded)
+			return core.Upstream{}, nil, &errors.AggregateError{Errors: errs}
+		}
+
+		delete(remaining, upstream)
+		if len(remaining) > 0 {
+			continue
+		}
+		// If every circuit is open, retrying cannot succeed until one is
+		// half-open, which is likely to be long after the Timeout.
+		if d.Timeout <= 0 || d.FailFast || !dialed {
+			return core.Upstream{}, nil, dialFailed(errs, attempts)
+		}
+		dialed = false
+		// Every candidate has failed. Pause, then try them all again.
+		core.UnionUpdate(remaining, candidates)
+		timer := clock.Or(d.Clock).NewTimer(d.Backoff)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			errs = append(errs, ctx.Err())
+			return core.Upstream{}, nil, dialFailed(errs, attempts)
+		case <-timer.C():
+		}
+	}
+}
+
+// dialFailed returns the error of DialBestUpstream giving up with errs,
+// after attempts dials. If no candidate was dialed, e.g. as every circuit is
+// open, it matches NoCandidateUpstreams. Otherwise it does not, even if the
+// Policy found no candidate left to choose, so that callers can tell an
+// upstream failing to accept a connection from no upstream being available.
+func dialFailed(errs []error, attempts int) error {
+	if attempts == 0 {
+		if !stderrors.Is(&errors.AggregateError{Errors: errs}, NoCandidateUpstreams) {
+			errs = append(errs, NoCandidateUpstreams)
+		}
+		return &errors.AggregateError{Errors: errs}
+	}
+	dialErrs := errs[:0:0]
+	for _, err := range errs {
+		if !stderrors.Is(err, NoCandidateUpstreams) {
+			dialErrs = append(dialErrs, err)
+		}
+	}
+	return &errors.AggregateError{Errors: dialErrs}
+}
+
+// dial dials upstream, unless its circuit is open, in which case a
+// *forwarder.DialError wrapping CircuitOpen is returned.
+func (d *RetryDialer) dial(ctx context.Context, upstream core.Upstream) (core.DuplexConn, error) {
+	var chain Chain
+	if d.Breaker != nil {
+		chain = append(chain, WithCircuitBreaker(d.Breaker))
+	}
+	if d.Latency != nil {
+		chain = append(chain, WithLatency(d.Latency, d.Clock))
+	}
+	return chain.Then(d.Dialer).DialUpstream(ctx, upstream)
+}
+
+// ReportUpstreamFailure tells the Policy, if it is a FailureObserver,
+// Health and Breaker, if set, that forwarding to u failed with err. Failures
+// once ctx is done, e.g. on shutdown, are not the upstream's fault, so are
+// not reported.
+func (d *RetryDialer) ReportUpstreamFailure(ctx context.Context, u core.Upstream, err error) {
+	if ctx.Err() != nil {
+		return
+	}
+	if d.Breaker != nil {
+		d.Breaker.ReportConnectionFailure(u)
+	}
+	if observer, ok := d.Policy.(FailureObserver); ok {
+		observer.UpstreamFailed(u)
+	}
+	if d.Health != nil {
+		d.Health.ReportHealth(healthcheck.HealthReport{
+			Upstream: u,
+			Result:   healthcheck.CheckFail,
+			Symptom:  err,
+			Time:     clock.Or(d.Clock).Now(),
+		})
+	}
+}
+
+// IndexUpstreams indexes upstreams in the Policy, if it is an
+// UpstreamIndexer.
+func (d *RetryDialer) IndexUpstreams(upstreams core.UpstreamSet) {
+	if indexer, ok := d.Policy.(UpstreamIndexer); ok {
+		indexer.IndexUpstreams(upstreams)
+	}
+}
+
+var _ forwarder.BestUpstreamDialer = (*RetryDialer)(nil)      // type check
+var _ forwarder.UpstreamFailureReporter = (*RetryDialer)(nil) // type check
+var _ UpstreamIndexer = (*RetryDialer)(nil)                   // type check
+
+// observedConn reports to a LoadObserver when it is first closed.
+type observedConn struct {
+	core.WrappedConn
+	upstream core.Upstream
+	observer LoadObserver
+	once     sync.Once
+}
+
+func (c *observedConn) Close() error {
+	c.once.Do(func() { c.observer.ConnectionClosed(c.upstream) })
+	return c.DuplexConn.Close()
+}
+
+// completionConn counts the bytes written to and read from a connection,
+// and reports them to a CompletionObserver when it is first closed.
+type completionConn struct {
+	sent     int64 // sent is accessed atomically. It is first so that it is 64-bit aligned on 32-bit platforms.
+	received int64 // received is accessed atomically.
+
+	core.WrappedConn
+	upstream core.Upstream
+	observer CompletionObserver
+	clock    clock.Clock
+	opened   time.Time
+	once     sync.Once
+}
+
+func (c *completionConn) Read(p []byte) (int, error) {
+	n, err := c.DuplexConn.Read(p)
+	atomic.AddInt64(&c.received, int64(n))
+	return n, err
+}
+
+func (c *completionConn) Write(p []byte) (int, error) {
+	n, err := c.DuplexConn.Write(p)
+	atomic.AddInt64(&c.sent, int64(n))
+	return n, err
+}
+
+func (c *completionConn) Close() error {
+	c.once.Do(func() {
+		c.observer.ConnectionCompleted(c.upstream, ConnectionStats{
+			BytesSent:     atomic.LoadInt64(&c.sent),
+			BytesReceived: atomic.LoadInt64(&c.received),
+			Duration:      c.clock.Now().Sub(c.opened),
+		})
+	})
+	return c.DuplexConn.Close()
+}
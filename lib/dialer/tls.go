@@ -0,0 +1,338 @@
+package dialer
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"tcplb/lib/clock"
+	"tcplb/lib/core"
+	"tcplb/lib/forwarder"
+	"time"
+)
+
+// VerifyMode is how the certificates of upstreams are verified.
+type VerifyMode string
+
+const (
+	// VerifyFull verifies that upstream certificates chain to the CAs, and
+	// are issued for the server name.
+	VerifyFull VerifyMode = "full"
+	// VerifyCAPinned verifies that upstream certificates chain to the CAs
+	// of the CA file, which must be given, whatever name they are issued
+	// for, e.g. for upstreams addressed by IP whose certificates are issued
+	// by a private CA that issues only to them.
+	VerifyCAPinned VerifyMode = "ca-pinned"
+	// VerifySPKIPinned verifies that the public key of upstream
+	// certificates is one of the pinned keys, whoever issued them.
+	VerifySPKIPinned VerifyMode = "spki-pinned"
+	// VerifyInsecure does not verify upstream certificates at all, so
+	// connections to upstreams may be intercepted. It is meant for lab
+	// environments only.
+	VerifyInsecure VerifyMode = "insecure-skip-verify"
+)
+
+// VerifyModes are the supported VerifyModes.
+var VerifyModes = []VerifyMode{VerifyFull, VerifyCAPinned, VerifySPKIPinned, VerifyInsecure}
+
+// SPKIPinMismatch is returned, possibly wrapped, by TLS handshakes with
+// upstreams whose certificate's public key is not pinned.
+var SPKIPinMismatch = errors.New("upstream certificate public key is not pinned")
+
+// ParseSPKIPin parses a pinned public key, given as the base64 SHA-256
+// hash of its DER SubjectPublicKeyInfo, as for HTTP public key pinning.
+func ParseSPKIPin(pin string) ([]byte, error) {
+	hash, err := base64.StdEncoding.DecodeString(pin)
+	if err != nil || len(hash) != sha256.Size {
+		return nil, fmt.Errorf("expected a base64 SHA-256 hash of a public key but got %q", pin)
+	}
+	return hash, nil
+}
+
+// UpstreamTLSConfig configures an UpstreamTLS.
+type UpstreamTLSConfig struct {
+	CertFile string // CertFile is the path of the PEM client certificate presented to upstreams. If empty, none is presented.
+	KeyFile  string // KeyFile is the path of the PEM private key of CertFile.
+	CAFile   string // CAFile is the path of PEM CA certificates that upstream certificates are verified against. If empty, the system's are used.
+	// ServerName is the name that upstream certificates must be issued
+	// for. If empty, it is the host of each upstream's address.
+	ServerName string
+	Verify     VerifyMode // Verify is how upstream certificates are verified. If empty, VerifyFull.
+	SPKIPins   []string   // SPKIPins are the public keys pinned by VerifySPKIPinned, as parsed by ParseSPKIPin.
+	// ReloadInterval bounds how often the files are checked for changes. If
+	// not positive, they are checked at every dial.
+	ReloadInterval time.Duration
+	Clock          clock.Clock     // Clock is optional. If nil, the Real clock is used.
+	ErrorHandler   func(err error) // ErrorHandler is called when changed files fail to load. Optional.
+}
+
+// UpstreamTLS is the TLS configuration of connections to the upstreams of a
+// pool. Its certificates are loaded from PEM files, which are reloaded once
+// they change, so that they can be rotated without restarting. If changed
+// files fail to load, e.g. as a certificate was replaced before its key,
+// the previous certificates remain in use until the files load.
+//
+// Multiple goroutines may invoke methods on an UpstreamTLS simultaneously.
+type UpstreamTLS struct {
+	cfg   UpstreamTLSConfig
+	clock clock.Clock
+	pins  [][]byte // pins are the hashes of the pinned public keys.
+
+	mu      sync.Mutex
+	checked time.Time        // checked is when the files were last checked for changes.
+	stamps  []fileStamp      // stamps identify the versions of the files that were loaded.
+	cert    *tls.Certificate // cert is the client certificate, or nil if there is none.
+	roots   *x509.CertPool   // roots are the CAs of upstream certificates, or nil for the system's.
+}
+
+// fileStamp identifies a version of a file.
+type fileStamp struct {
+	modTime time.Time
+	size    int64
+}
+
+// NewUpstreamTLS returns an UpstreamTLS, having loaded its files.
+func NewUpstreamTLS(cfg UpstreamTLSConfig) (*UpstreamTLS, error) {
+	if (cfg.CertFile == "") != (cfg.KeyFile == "") {
+		return nil, errors.New("upstream TLS certificate and key must be given together")
+	}
+	u := &UpstreamTLS{cfg: cfg, clock: clock.Or(cfg.Clock)}
+	switch u.cfg.Verify {
+	case "":
+		u.cfg.Verify = VerifyFull
+	case VerifyFull, VerifyInsecure:
+	case VerifyCAPinned:
+		if cfg.CAFile == "" {
+			return nil, fmt.Errorf("upstream TLS verify mode %s needs a CA file", cfg.Verify)
+		}
+	case VerifySPKIPinned:
+		if len(cfg.SPKIPins) == 0 {
+			return nil, fmt.Errorf("upstream TLS verify mode %s needs pinned public keys", cfg.Verify)
+		}
+	default:
+		return nil, fmt.Errorf("unknown upstream TLS verify mode %q", cfg.Verify)
+	}
+	for _, pin := range cfg.SPKIPins {
+		hash, err := ParseSPKIPin(pin)
+		if err != nil {
+			return nil, err
+		}
+		u.pins = append(u.pins, hash)
+	}
+	stamps, err := u.stat()
+	if err != nil {
+		return nil, err
+	}
+	if err := u.load(stamps); err != nil {
+		return nil, err
+	}
+	u.checked = u.clock.Now()
+	return u, nil
+}
+
+// files returns the paths of the files that are loaded.
+func (u *UpstreamTLS) files() []string {
+	var files []string
+	for _, f := range []string{u.cfg.CertFile, u.cfg.KeyFile, u.cfg.CAFile} {
+		if f != "" {
+			files = append(files, f)
+		}
+	}
+	return files
+}
+
+// stat returns the current stamps of the files.
+func (u *UpstreamTLS) stat() ([]fileStamp, error) {
+	files := u.files()
+	stamps := make([]fileStamp, len(files))
+	for i, f := range files {
+		info, err := os.Stat(f)
+		if err != nil {
+			return nil, err
+		}
+		stamps[i] = fileStamp{modTime: info.ModTime(), size: info.Size()}
+	}
+	return stamps, nil
+}
+
+// load loads the files, whose stamps, taken beforehand, are stamps. The
+// caller must hold u.mu, unless u is not yet shared.
+func (u *UpstreamTLS) load(stamps []fileStamp) error {
+	var cert *tls.Certificate
+	if u.cfg.CertFile != "" {
+		c, err := tls.LoadX509KeyPair(u.cfg.CertFile, u.cfg.KeyFile)
+		if err != nil {
+			return err
+		}
+		cert = &c
+	}
+	var roots *x509.CertPool
+	if u.cfg.CAFile != "" {
+		data, err := os.ReadFile(u.cfg.CAFile)
+		if err != nil {
+			return err
+		}
+		roots = x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(data) {
+			return fmt.Errorf("no certificates found in %s", u.cfg.CAFile)
+		}
+	}
+	u.stamps, u.cert, u.roots = stamps, cert, roots
+	return nil
+}
+
+// reloadIfChanged reloads the files if ReloadInterval has passed since they
+// were last checked, and they have changed since they were loaded.
+func (u *UpstreamTLS) reloadIfChanged() {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	now := u.clock.Now()
+	if u.cfg.ReloadInterval > 0 && now.Sub(u.checked) < u.cfg.ReloadInterval {
+		return
+	}
+	u.checked = now
+	stamps, err := u.stat()
+	if err == nil && stampsEqual(stamps, u.stamps) {
+		return
+	}
+	if err == nil {
+		err = u.load(stamps)
+	}
+	if err != nil && u.cfg.ErrorHandler != nil {
+		u.cfg.ErrorHandler(fmt.Errorf("reloading upstream TLS files: %w", err))
+	}
+}
+
+func stampsEqual(a, b []fileStamp) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !a[i].modTime.Equal(b[i].modTime) || a[i].size != b[i].size {
+			return false
+		}
+	}
+	return true
+}
+
+// ClientConfig returns the TLS config of a connection to upstream, having
+// reloaded the files if they changed.
+func (u *UpstreamTLS) ClientConfig(upstream core.Upstream) *tls.Config {
+	u.reloadIfChanged()
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	serverName := u.cfg.ServerName
+	if serverName == "" {
+		serverName = upstream.Address
+		if host, _, err := net.SplitHostPort(upstream.Address); err == nil {
+			serverName = host
+		}
+	}
+	config := &tls.Config{
+		ServerName: serverName,
+		RootCAs:    u.roots,
+		MinVersion: tls.VersionTLS12,
+	}
+	if u.cert != nil {
+		config.Certificates = []tls.Certificate{*u.cert}
+	}
+	switch u.cfg.Verify {
+	case VerifyCAPinned:
+		roots := u.roots
+		config.InsecureSkipVerify = true
+		config.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			return verifyChain(rawCerts, roots)
+		}
+	case VerifySPKIPinned:
+		config.InsecureSkipVerify = true
+		config.VerifyPeerCertificate = u.verifySPKI
+	case VerifyInsecure:
+		config.InsecureSkipVerify = true
+	}
+	return config
+}
+
+// verifyChain verifies that the certificate chain sent by an upstream leads
+// to one of roots, whatever name its leaf is issued for.
+func verifyChain(rawCerts [][]byte, roots *x509.CertPool) error {
+	if len(rawCerts) == 0 {
+		return errors.New("upstream sent no certificate")
+	}
+	certs := make([]*x509.Certificate, len(rawCerts))
+	for i, raw := range rawCerts {
+		cert, err := x509.ParseCertificate(raw)
+		if err != nil {
+			return err
+		}
+		certs[i] = cert
+	}
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err := certs[0].Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	})
+	return err
+}
+
+// verifySPKI verifies that the public key of the certificate sent by an
+// upstream is pinned.
+func (u *UpstreamTLS) verifySPKI(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+	if len(rawCerts) == 0 {
+		return errors.New("upstream sent no certificate")
+	}
+	leaf, err := x509.ParseCertificate(rawCerts[0])
+	if err != nil {
+		return err
+	}
+	hash := sha256.Sum256(leaf.RawSubjectPublicKeyInfo)
+	for _, pin := range u.pins {
+		if bytes.Equal(pin, hash[:]) {
+			return nil
+		}
+	}
+	return SPKIPinMismatch
+}
+
+// TLSDialer is an UpstreamDialer that speaks TLS over the connections of
+// Dialer, re-encrypting client traffic to upstreams that expect TLS, and
+// presenting the pool's client certificate to those that authenticate
+// their clients.
+type TLSDialer struct {
+	Dialer forwarder.UpstreamDialer
+	TLS    *UpstreamTLS
+	// Timeout bounds the TLS handshake. If not positive, there is no bound
+	// beyond that of the context.
+	Timeout time.Duration
+	Clock   clock.Clock // Clock is optional. If nil, the Real clock is used.
+}
+
+func (d *TLSDialer) DialUpstream(ctx context.Context, upstream core.Upstream) (core.DuplexConn, error) {
+	conn, err := d.Dialer.DialUpstream(ctx, upstream)
+	if err != nil {
+		return nil, err
+	}
+	if d.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = clock.WithTimeout(ctx, d.Clock, d.Timeout)
+		defer cancel()
+	}
+	tlsConn := tls.Client(conn, d.TLS.ClientConfig(upstream))
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		_ = conn.Close()
+		return nil, &forwarder.DialError{Upstream: upstream, Err: err}
+	}
+	return tlsConn, nil
+}
+
+var _ forwarder.UpstreamDialer = (*TLSDialer)(nil) // type check
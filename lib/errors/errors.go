@@ -1,7 +1,12 @@
 package errors
 
-import "fmt"
+import (
+	stderrors "errors"
+	"fmt"
+)
 
+// AggregateError bundles several errors into one. The constituent errors can
+// be matched with errors.Is and errors.As.
 type AggregateError struct {
 	Errors []error
 }
@@ -13,9 +18,59 @@ func (e *AggregateError) Error() string {
 	return fmt.Sprintf("AggregateError: %v", e.Errors)
 }
 
+// Unwrap returns the constituent errors, following the multi-error
+// convention of errors.Join.
+func (e *AggregateError) Unwrap() []error {
+	if e == nil {
+		return nil
+	}
+	return e.Errors
+}
+
+// Is reports if any constituent error matches target. It is redundant with
+// Unwrap for Go 1.20 onwards, but lets errors.Is inspect constituent errors
+// when built with earlier Go versions.
+func (e *AggregateError) Is(target error) bool {
+	for _, err := range e.Unwrap() {
+		if stderrors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// As finds the first constituent error that matches target, as errors.As
+// would. Like Is, it exists for Go versions before 1.20.
+func (e *AggregateError) As(target interface{}) bool {
+	for _, err := range e.Unwrap() {
+		if stderrors.As(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// Flatten returns the non-nil errors in errs, replacing each AggregateError,
+// however deeply nested, with its constituent errors.
+func Flatten(errs ...error) []error {
+	flat := make([]error, 0, len(errs))
+	for _, err := range errs {
+		if err == nil {
+			continue
+		}
+		if agg, ok := err.(*AggregateError); ok {
+			flat = append(flat, Flatten(agg.Unwrap()...)...)
+			continue
+		}
+		flat = append(flat, err)
+	}
+	return flat
+}
+
 // AggregateErrorFromChannel gathers non-nil error values (if any)
 // from the given channel and bundles them into an AggregateError.
 // The channel must contain some finite number of errors and be closed.
+// Nested AggregateErrors are flattened.
 // If no errors are read from the channel, nil is returned.
 func AggregateErrorFromChannel(errorchan <-chan error) error {
 	errs := make([]error, 0)
@@ -25,7 +80,7 @@ func AggregateErrorFromChannel(errorchan <-chan error) error {
 		}
 		errs = append(errs, err)
 	}
-	if len(errs) > 0 {
+	if errs = Flatten(errs...); len(errs) > 0 {
 		return &AggregateError{Errors: errs}
 	}
 	return nil
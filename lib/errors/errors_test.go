@@ -0,0 +1,57 @@
+package errors
+
+import (
+	stderrors "errors"
+	"fmt"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+type codeError struct {
+	Code int
+}
+
+func (e *codeError) Error() string {
+	return fmt.Sprintf("code %d", e.Code)
+}
+
+func TestAggregateErrorIsAndAs(t *testing.T) {
+	sentinel := stderrors.New("sentinel")
+	other := stderrors.New("other")
+	err := &AggregateError{Errors: []error{
+		fmt.Errorf("wrapped: %w", sentinel),
+		&AggregateError{Errors: []error{&codeError{Code: 7}}},
+	}}
+
+	require.ErrorIs(t, err, sentinel)
+	require.NotErrorIs(t, err, other)
+
+	var codeErr *codeError
+	require.ErrorAs(t, err, &codeErr)
+	require.Equal(t, 7, codeErr.Code)
+
+	// Constituent errors are also found through further wrapping.
+	require.ErrorIs(t, fmt.Errorf("outer: %w", err), sentinel)
+}
+
+func TestFlatten(t *testing.T) {
+	a, b, c := stderrors.New("a"), stderrors.New("b"), stderrors.New("c")
+	nested := &AggregateError{Errors: []error{a, &AggregateError{Errors: []error{b, nil}}}}
+	require.Equal(t, []error{a, b, c}, Flatten(nested, nil, c))
+	require.Empty(t, Flatten())
+}
+
+func TestAggregateErrorFromChannel(t *testing.T) {
+	a, b := stderrors.New("a"), stderrors.New("b")
+	errorchan := make(chan error, 3)
+	errorchan <- a
+	errorchan <- nil
+	errorchan <- &AggregateError{Errors: []error{b}}
+	close(errorchan)
+	err := AggregateErrorFromChannel(errorchan)
+	require.Equal(t, &AggregateError{Errors: []error{a, b}}, err)
+
+	empty := make(chan error)
+	close(empty)
+	require.NoError(t, AggregateErrorFromChannel(empty))
+}
@@ -0,0 +1,282 @@
+// Package events publishes the lifecycle events of client connections as a
+// stream of newline-delimited JSON, to which external consumers such as
+// SIEM or billing systems may subscribe by connecting to a socket.
+package events
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"sync"
+	"tcplb/lib/accesslog"
+	"tcplb/lib/core"
+	"tcplb/lib/forwarder"
+	"tcplb/lib/metrics"
+	"time"
+)
+
+// StreamClosed is returned by Serve once Close has been called.
+var StreamClosed = errors.New("event stream closed")
+
+// Types of Events.
+const (
+	TypeOpen          = "open"
+	TypeClose         = "close"
+	TypeBudgetWarning = "budget_warning"
+)
+
+// Event is a lifecycle event of a client connection, or a warning that a
+// client is nearing the limit of a budget, as written to subscribers.
+// Connections are identified by their listener and ConnID, as each
+// listener numbers its connections separately.
+type Event struct {
+	Type            string               `json:"event"`                       // Type is TypeOpen, TypeClose or TypeBudgetWarning.
+	Time            string               `json:"time"`                        // Time is when the connection opened or closed, or the client was warned, RFC3339.
+	ConnID          forwarder.ConnID     `json:"conn_id"`                     // ConnID identifies the connection among those of its listener.
+	Listener        string               `json:"listener,omitempty"`          // Listener is the name of the listener that accepted the connection, if it has one.
+	SourceAddr      string               `json:"source_addr"`                 // SourceAddr is the client's remote address.
+	LocalAddr       string               `json:"local_addr,omitempty"`        // LocalAddr is the address the client connected to, if known. Only set on open.
+	ClientID        *core.ClientID       `json:"clientid,omitempty"`          // ClientID is the authenticated client, if known. Only set on close and budget warnings.
+	Pool            string               `json:"pool,omitempty"`              // Pool is the upstream pool the connection was routed to, if any. Only set on close.
+	Upstream        *core.Upstream       `json:"upstream,omitempty"`          // Upstream is the upstream forwarded to, if any. Only set on close.
+	BytesFromClient int64                `json:"bytes_from_client,omitempty"` // BytesFromClient is the number of bytes forwarded client->upstream. Only set on close.
+	BytesToClient   int64                `json:"bytes_to_client,omitempty"`   // BytesToClient is the number of bytes forwarded upstream->client. Only set on close.
+	DurationMillis  int64                `json:"duration_ms,omitempty"`       // DurationMillis is the lifetime of the connection. Only set on close.
+	Reason          accesslog.ReasonCode `json:"reason,omitempty"`            // Reason is why the connection was terminated. Only set on close.
+	Budget          string               `json:"budget,omitempty"`            // Budget is what the client is nearing the limit of. Only set on budget warnings.
+	WindowMillis    int64                `json:"window_ms,omitempty"`         // WindowMillis is the period usage of the budget is counted within, if it is a quota. Only set on budget warnings.
+	Usage           int64                `json:"usage,omitempty"`             // Usage is the usage of the budget by the client. Only set on budget warnings.
+	Limit           int64                `json:"limit,omitempty"`             // Limit is the usage at which the client is rejected. Only set on budget warnings.
+}
+
+// StreamConfig configures a Stream.
+type StreamConfig struct {
+	// Buffer is the number of events buffered for each subscriber. Events
+	// published while the buffer of a subscriber is full are dropped for
+	// that subscriber, so that a slow subscriber does not slow down
+	// forwarding. If not positive, DefaultBuffer is used.
+	Buffer int
+	// WriteTimeout bounds each write of events to a subscriber. Subscribers
+	// whose writes time out are disconnected. If not positive, writes are
+	// not bounded.
+	WriteTimeout time.Duration
+}
+
+// DefaultBuffer is the number of events buffered for each subscriber, if
+// StreamConfig.Buffer is not positive.
+const DefaultBuffer = 1024
+
+// StreamMetrics holds the metrics recorded by a Stream.
+type StreamMetrics struct {
+	Published   *metrics.Counter // Published counts events published, whether or not there were subscribers.
+	Dropped     *metrics.Counter // Dropped counts events dropped for subscribers whose buffers were full.
+	Subscribers *metrics.Gauge   // Subscribers is the number of connected subscribers.
+}
+
+// NewStreamMetrics returns StreamMetrics registered in the given Registry.
+func NewStreamMetrics(r *metrics.Registry) *StreamMetrics {
+	return &StreamMetrics{
+		Published:   r.Counter("conn_events_published_total"),
+		Dropped:     r.Counter("conn_events_dropped_total"),
+		Subscribers: r.Gauge("conn_event_subscribers"),
+	}
+}
+
+// Stream is a forwarder.ConnEventPublisher that writes each event, as a
+// line of JSON, to every subscriber connected at the time it is published.
+// Subscribers receive only events published after they connect, and
+// anything they send is ignored.
+//
+// Multiple goroutines may invoke methods on a Stream simultaneously.
+type Stream struct {
+	cfg     StreamConfig
+	metrics *StreamMetrics
+
+	mu          sync.Mutex // mu guards the fields below
+	closed      bool
+	listeners   map[net.Listener]struct{}
+	subscribers map[*subscriber]struct{}
+}
+
+// subscriber is a connection to a consumer of events, written to by its own
+// goroutine from the buffer of events.
+type subscriber struct {
+	conn   net.Conn
+	buffer chan []byte
+}
+
+// NewStream returns a Stream configured by cfg. m is optional. If nil, no
+// metrics are recorded.
+func NewStream(cfg StreamConfig, m *StreamMetrics) *Stream {
+	if m == nil {
+		m = &StreamMetrics{}
+	}
+	if cfg.Buffer <= 0 {
+		cfg.Buffer = DefaultBuffer
+	}
+	return &Stream{
+		cfg:         cfg,
+		metrics:     m,
+		listeners:   make(map[net.Listener]struct{}),
+		subscribers: make(map[*subscriber]struct{}),
+	}
+}
+
+// Serve accepts subscribers from listener until it fails, or until Close
+// is called, at which point StreamClosed is returned. Serve closes
+// listener before it returns.
+func (s *Stream) Serve(listener net.Listener) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		_ = listener.Close()
+		return StreamClosed
+	}
+	s.listeners[listener] = struct{}{}
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.listeners, listener)
+		s.mu.Unlock()
+		_ = listener.Close()
+	}()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			s.mu.Lock()
+			closed := s.closed
+			s.mu.Unlock()
+			if closed {
+				return StreamClosed
+			}
+			return err
+		}
+		sub := &subscriber{conn: conn, buffer: make(chan []byte, s.cfg.Buffer)}
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			_ = conn.Close()
+			return StreamClosed
+		}
+		s.subscribers[sub] = struct{}{}
+		s.metrics.Subscribers.Inc()
+		s.mu.Unlock()
+		go s.write(sub)
+	}
+}
+
+// write writes the events buffered for sub to its connection, until the
+// subscriber is removed or a write fails.
+func (s *Stream) write(sub *subscriber) {
+	defer s.metrics.Subscribers.Dec()
+	defer func() { _ = sub.conn.Close() }()
+	for data := range sub.buffer {
+		if s.cfg.WriteTimeout > 0 {
+			_ = sub.conn.SetWriteDeadline(time.Now().Add(s.cfg.WriteTimeout))
+		}
+		if _, err := sub.conn.Write(data); err != nil {
+			s.remove(sub)
+			return
+		}
+	}
+}
+
+// remove disconnects sub, if it is still subscribed.
+func (s *Stream) remove(sub *subscriber) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.subscribers[sub]; ok {
+		delete(s.subscribers, sub)
+		close(sub.buffer)
+	}
+}
+
+// Subscribers returns the number of connected subscribers.
+func (s *Stream) Subscribers() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.subscribers)
+}
+
+// Publish writes event to every subscriber, without waiting for them.
+func (s *Stream) Publish(event *Event) {
+	s.metrics.Published.Inc()
+	data, err := json.Marshal(event)
+	if err != nil {
+		return
+	}
+	data = append(data, '\n')
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for sub := range s.subscribers {
+		select {
+		case sub.buffer <- data:
+		default:
+			s.metrics.Dropped.Inc()
+		}
+	}
+}
+
+func (s *Stream) PublishOpened(event forwarder.ConnOpenedEvent) {
+	s.Publish(&Event{
+		Type:       TypeOpen,
+		Time:       event.Time.UTC().Format(time.RFC3339Nano),
+		ConnID:     event.ConnID,
+		Listener:   event.Listener,
+		SourceAddr: event.SourceAddr,
+		LocalAddr:  event.LocalAddr,
+	})
+}
+
+func (s *Stream) PublishClosed(event forwarder.ConnClosedEvent) {
+	s.Publish(&Event{
+		Type:            TypeClose,
+		Time:            event.Time.UTC().Format(time.RFC3339Nano),
+		ConnID:          event.ConnID,
+		Listener:        event.Listener,
+		SourceAddr:      event.SourceAddr,
+		ClientID:        event.Outcome.ClientID,
+		Pool:            event.Outcome.Pool,
+		Upstream:        event.Outcome.Upstream,
+		BytesFromClient: event.Outcome.BytesFromClient,
+		BytesToClient:   event.Outcome.BytesToClient,
+		DurationMillis:  event.Duration.Milliseconds(),
+		Reason:          event.Outcome.Reason,
+	})
+}
+
+// PublishBudgetWarning publishes w, so that the teams operating clients
+// may react before connections are rejected.
+func (s *Stream) PublishBudgetWarning(w forwarder.BudgetWarning) {
+	s.Publish(&Event{
+		Type:         TypeBudgetWarning,
+		Time:         w.Time.UTC().Format(time.RFC3339Nano),
+		ConnID:       w.ConnID,
+		Listener:     w.Listener,
+		ClientID:     &w.ClientID,
+		Budget:       w.Budget,
+		WindowMillis: w.Window.Milliseconds(),
+		Usage:        w.Usage,
+		Limit:        w.Limit,
+	})
+}
+
+// Close stops serving subscribers and disconnects them, once the events
+// buffered for them are written.
+func (s *Stream) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	for l := range s.listeners {
+		_ = l.Close()
+	}
+	for sub := range s.subscribers {
+		delete(s.subscribers, sub)
+		close(sub.buffer)
+	}
+	return nil
+}
+
+var _ forwarder.ConnEventPublisher = (*Stream)(nil)     // type check
+var _ forwarder.BudgetWarningPublisher = (*Stream)(nil) // type check
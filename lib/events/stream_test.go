@@ -0,0 +1,177 @@
+package events
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"tcplb/lib/accesslog"
+	"tcplb/lib/core"
+	"tcplb/lib/forwarder"
+	"tcplb/lib/metrics"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// startTestStream serves a Stream on a loopback listener, returning the
+// address subscribers may connect to.
+func startTestStream(t *testing.T, cfg StreamConfig, m *StreamMetrics) (*Stream, string) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	stream := NewStream(cfg, m)
+	served := make(chan error, 1)
+	go func() {
+		served <- stream.Serve(listener)
+	}()
+	t.Cleanup(func() {
+		require.NoError(t, stream.Close())
+		require.ErrorIs(t, <-served, StreamClosed)
+	})
+	return stream, listener.Addr().String()
+}
+
+// subscribe connects to the Stream at addr, and waits until it is
+// subscribed.
+func subscribe(t *testing.T, stream *Stream, addr string) *bufio.Scanner {
+	n := stream.Subscribers()
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = conn.Close() })
+	require.Eventually(t, func() bool { return stream.Subscribers() > n }, time.Second, time.Millisecond)
+	return bufio.NewScanner(conn)
+}
+
+func readEvent(t *testing.T, lines *bufio.Scanner) Event {
+	require.True(t, lines.Scan(), lines.Err())
+	var event Event
+	require.NoError(t, json.Unmarshal(lines.Bytes(), &event))
+	return event
+}
+
+func TestStreamPublishesToSubscribers(t *testing.T) {
+	m := NewStreamMetrics(metrics.NewRegistry())
+	stream, addr := startTestStream(t, StreamConfig{}, m)
+
+	// Events published before anyone subscribes are not kept.
+	stream.PublishOpened(forwarder.ConnOpenedEvent{ConnID: 1})
+
+	first := subscribe(t, stream, addr)
+	second := subscribe(t, stream, addr)
+	require.Equal(t, int64(2), m.Subscribers.Value())
+
+	accepted := time.Date(2022, 6, 1, 12, 0, 0, 0, time.UTC)
+	clientID := core.ClientID{Namespace: "events-test", Key: "alice"}
+	upstream := core.Upstream{Network: "tcp", Address: "10.0.0.1:80"}
+	stream.PublishOpened(forwarder.ConnOpenedEvent{
+		ConnID:     2,
+		Listener:   "main",
+		SourceAddr: "192.0.2.1:5000",
+		LocalAddr:  "10.0.0.9:4321",
+		Time:       accepted,
+	})
+	stream.PublishClosed(forwarder.ConnClosedEvent{
+		ConnID:     2,
+		Listener:   "main",
+		SourceAddr: "192.0.2.1:5000",
+		Time:       accepted.Add(3 * time.Second),
+		Duration:   3 * time.Second,
+		Outcome: accesslog.Summary{
+			ClientID:        &clientID,
+			Pool:            "web",
+			Upstream:        &upstream,
+			BytesFromClient: 10,
+			BytesToClient:   20,
+			Reason:          accesslog.ReasonForwarded,
+		},
+	})
+
+	for _, lines := range []*bufio.Scanner{first, second} {
+		require.Equal(t, Event{
+			Type:       TypeOpen,
+			Time:       "2022-06-01T12:00:00Z",
+			ConnID:     2,
+			Listener:   "main",
+			SourceAddr: "192.0.2.1:5000",
+			LocalAddr:  "10.0.0.9:4321",
+		}, readEvent(t, lines))
+		require.Equal(t, Event{
+			Type:            TypeClose,
+			Time:            "2022-06-01T12:00:03Z",
+			ConnID:          2,
+			Listener:        "main",
+			SourceAddr:      "192.0.2.1:5000",
+			ClientID:        &clientID,
+			Pool:            "web",
+			Upstream:        &upstream,
+			BytesFromClient: 10,
+			BytesToClient:   20,
+			DurationMillis:  3000,
+			Reason:          accesslog.ReasonForwarded,
+		}, readEvent(t, lines))
+	}
+	require.Equal(t, int64(3), m.Published.Value())
+	require.Equal(t, int64(0), m.Dropped.Value())
+}
+
+func TestStreamDropsEventsForSlowSubscribers(t *testing.T) {
+	m := NewStreamMetrics(metrics.NewRegistry())
+	stream := NewStream(StreamConfig{Buffer: 2}, m)
+	// Nothing writes the events buffered for this subscriber, as if it
+	// were too slow to read them.
+	conn, peer := net.Pipe()
+	defer conn.Close()
+	defer peer.Close()
+	sub := &subscriber{conn: conn, buffer: make(chan []byte, 2)}
+	stream.subscribers[sub] = struct{}{}
+	for i := 0; i < 5; i++ {
+		stream.Publish(&Event{Type: TypeOpen, ConnID: forwarder.ConnID(i)})
+	}
+	require.Equal(t, int64(5), m.Published.Value())
+	require.Equal(t, int64(3), m.Dropped.Value())
+	require.NoError(t, stream.Close())
+	require.Zero(t, stream.Subscribers())
+}
+
+func TestStreamRemovesDisconnectedSubscribers(t *testing.T) {
+	m := NewStreamMetrics(metrics.NewRegistry())
+	stream, addr := startTestStream(t, StreamConfig{}, m)
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	require.Eventually(t, func() bool { return stream.Subscribers() == 1 }, time.Second, time.Millisecond)
+	require.NoError(t, conn.Close())
+
+	// Writes to the subscriber fail once it has gone, removing it.
+	require.Eventually(t, func() bool {
+		stream.Publish(&Event{Type: TypeOpen})
+		return stream.Subscribers() == 0
+	}, 5*time.Second, 10*time.Millisecond)
+	require.Eventually(t, func() bool { return m.Subscribers.Value() == 0 }, time.Second, time.Millisecond)
+}
+
+func TestStreamPublishesBudgetWarnings(t *testing.T) {
+	stream, addr := startTestStream(t, StreamConfig{}, nil)
+	lines := subscribe(t, stream, addr)
+	clientID := core.ClientID{Namespace: "events-test", Key: "alice"}
+	stream.PublishBudgetWarning(forwarder.BudgetWarning{
+		ClientID: clientID,
+		Budget:   "bytes",
+		Window:   time.Hour,
+		Usage:    80,
+		Limit:    100,
+		Time:     time.Date(2022, 6, 1, 12, 0, 0, 0, time.UTC),
+		ConnID:   3,
+		Listener: "main",
+	})
+	require.Equal(t, Event{
+		Type:         TypeBudgetWarning,
+		Time:         "2022-06-01T12:00:00Z",
+		ConnID:       3,
+		Listener:     "main",
+		ClientID:     &clientID,
+		Budget:       "bytes",
+		WindowMillis: 3600000,
+		Usage:        80,
+		Limit:        100,
+	}, readEvent(t, lines))
+}
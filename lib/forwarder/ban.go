@@ -0,0 +1,137 @@
+package forwarder
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"sync/atomic"
+	"tcplb/lib/accesslog"
+	"tcplb/lib/clock"
+	"tcplb/lib/core"
+	"tcplb/lib/metrics"
+	"tcplb/lib/slog"
+	"time"
+)
+
+// SourceBanner tracks failures by the source IP address of client
+// connections, and bans sources that fail repeatedly.
+//
+// Multiple goroutines may invoke methods on a SourceBanner simultaneously.
+type SourceBanner interface {
+	// RecordFailure records a failure by the source addr, and reports if
+	// the source is now banned.
+	RecordFailure(addr netip.Addr) (banned bool)
+	// Banned reports if the source addr is currently banned.
+	Banned(addr netip.Addr) bool
+}
+
+// Tarpit holds connections from banned sources open for Duration, doing
+// nothing, to slow down scanners that would otherwise retry at once. At most
+// MaxConns connections are held at once, so that banned sources cannot
+// exhaust the server's file descriptors through the tarpit itself;
+// connections beyond it are dropped at once.
+//
+// A Tarpit may be shared by several BanningHandlers, e.g. one per listener,
+// to bound the connections held by all of them.
+type Tarpit struct {
+	Duration time.Duration
+	MaxConns int32            // MaxConns bounds the connections held at once. If not positive, none are held.
+	Full     *metrics.Counter // Full is optional. If set, it counts connections dropped as the tarpit was full.
+	Clock    clock.Clock      // Clock is optional. If nil, the system clock is used.
+
+	held int32 // held is the number of connections held. It is accessed atomically.
+}
+
+// Hold holds a connection until Duration elapses or ctx is done, unless
+// the tarpit is full, in which case it returns at once.
+func (t *Tarpit) Hold(ctx context.Context) {
+	if t.Duration <= 0 {
+		return
+	}
+	if atomic.AddInt32(&t.held, 1) > t.MaxConns {
+		atomic.AddInt32(&t.held, -1)
+		t.Full.Inc()
+		return
+	}
+	defer atomic.AddInt32(&t.held, -1)
+	timer := clock.Or(t.Clock).NewTimer(t.Duration)
+	defer timer.Stop()
+	select {
+	case <-timer.C():
+	case <-ctx.Done():
+	}
+}
+
+// junkClasses are the classes of handshake failure, as recorded by the
+// SniffingHandler or by ClassifyHandshakeError, that positively identify a
+// client as speaking something other than TLS, or as presenting a
+// certificate that is not trusted. Timeouts and hang-ups are not among them,
+// nor are missing client certificates, as load balancer health checks
+// commonly connect and close, or complete a handshake without one.
+var junkClasses = map[string]bool{
+	SniffHTTP:                     true,
+	SniffSSH:                      true,
+	SniffNotClientHello:           true,
+	SniffOversizedClientHello:     true,
+	SniffBinary:                   true,
+	HandshakeErrorNotTLS:          true,
+	HandshakeErrorProtocolVersion: true,
+	HandshakeErrorUnknownCA:       true,
+	HandshakeErrorExpiredCert:     true,
+	HandshakeErrorBadCert:         true,
+}
+
+// BanningHandler is a handler that reports connections that fail to
+// authenticate with junk, i.e. connections that are positively classified
+// as not TLS or whose TLS handshake fails on an untrusted certificate, to
+// the Banner, by source IP address. Connections that time out or close
+// before completing a handshake are not reported, so that health checks
+// are not banned. It should wrap the handlers that do TLS work.
+//
+// Connections from banned sources are not passed to the Inner handler. If
+// Tarpit is set, they are held in it first. Banned connections are
+// recorded with the termination reason "banned", which is deliberately not
+// a rejection reason, so banned clients are not told why.
+//
+// Banned sources may also be dropped as soon as they are accepted, by
+// using the Banner as the Server's ConnFilter.
+type BanningHandler struct {
+	Logger slog.Logger
+	Banner SourceBanner
+	Tarpit *Tarpit // Tarpit is optional. If nil, connections from banned sources are dropped at once.
+	Inner  Handler
+}
+
+func (h *BanningHandler) Handle(ctx context.Context, conn core.DuplexConn) {
+	remote, ok := conn.RemoteAddr().(*net.TCPAddr)
+	if !ok {
+		h.Inner.Handle(ctx, conn)
+		return
+	}
+	source := remote.AddrPort().Addr()
+	if h.Banner.Banned(source) {
+		accesslog.SetReason(ctx, accesslog.ReasonBanned)
+		if h.Tarpit != nil {
+			h.Tarpit.Hold(ctx)
+		}
+		return
+	}
+
+	record := accesslog.RecordFromContext(ctx)
+	if record == nil {
+		record = accesslog.NewRecord(remote.String(), time.Now())
+		ctx = accesslog.NewContextWithRecord(ctx, record)
+	}
+	h.Inner.Handle(ctx, conn)
+	if reason := record.Reason(); reason != accesslog.ReasonAuthnFailed && reason != accesslog.ReasonNotTLS {
+		return
+	}
+	if !junkClasses[record.HandshakeError()] {
+		return
+	}
+	if h.Banner.RecordFailure(source) {
+		h.Logger.Warn(&slog.LogRecord{Msg: "BanningHandler: banned source after repeated failures", Details: source.String()})
+	}
+}
+
+var _ Handler = (*BanningHandler)(nil) // type check
@@ -0,0 +1,89 @@
+package forwarder
+
+import (
+	"context"
+	"github.com/stretchr/testify/require"
+	"net"
+	"net/netip"
+	"sync/atomic"
+	"tcplb/lib/accesslog"
+	"tcplb/lib/metrics"
+	"tcplb/lib/slog"
+	"testing"
+	"time"
+)
+
+func TestBanningHandler(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+	client, err := net.Dial("tcp", listener.Addr().String())
+	require.NoError(t, err)
+	defer client.Close()
+	accepted, err := listener.Accept()
+	require.NoError(t, err)
+	defer accepted.Close()
+	conn := accepted.(*net.TCPConn)
+
+	banner := &countingBanner{failures: make(map[netip.Addr]int)}
+	h := &BanningHandler{
+		Logger: &slog.RecordingLogger{},
+		Banner: banner,
+		Inner:  rejectingHandler{reason: accesslog.ReasonForwarded},
+	}
+	source := netip.MustParseAddr("127.0.0.1")
+
+	// Successful connections are not counted as failures.
+	require.Equal(t, accesslog.ReasonForwarded, handleRecordingReason(h, conn))
+	require.Equal(t, 0, banner.failures[source])
+
+	// Nor are connections that close or time out before their handshake,
+	// such as health checks.
+	for _, class := range []string{"", HandshakeErrorClientClosed, HandshakeErrorTimeout, SniffTimeout, HandshakeErrorNoClientCert} {
+		h.Inner = rejectingHandler{reason: accesslog.ReasonAuthnFailed, handshakeError: class}
+		require.Equal(t, accesslog.ReasonAuthnFailed, handleRecordingReason(h, conn))
+		h.Inner = rejectingHandler{reason: accesslog.ReasonNotTLS, handshakeError: class}
+		require.Equal(t, accesslog.ReasonNotTLS, handleRecordingReason(h, conn))
+	}
+	require.Equal(t, 0, banner.failures[source])
+
+	// Connections positively classified as junk are counted.
+	h.Inner = rejectingHandler{reason: accesslog.ReasonNotTLS, handshakeError: SniffHTTP}
+	require.Equal(t, accesslog.ReasonNotTLS, handleRecordingReason(h, conn))
+	require.Equal(t, 1, banner.failures[source])
+
+	// Once banned, the source is not passed to the Inner handler.
+	h.Inner = rejectingHandler{reason: accesslog.ReasonForwarded}
+	require.Equal(t, accesslog.ReasonBanned, handleRecordingReason(h, conn))
+
+	// A tarpit holds the connection until it elapses or ctx is done.
+	full := &metrics.Counter{}
+	h.Tarpit = &Tarpit{Duration: time.Hour, MaxConns: 1, Full: full}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	record := accesslog.NewRecord("client", time.Now())
+	h.Handle(accesslog.NewContextWithRecord(ctx, record), conn)
+	require.Equal(t, accesslog.ReasonBanned, record.Reason())
+	require.Error(t, ctx.Err())
+	require.Equal(t, int64(0), full.Value())
+}
+
+func TestTarpitDropsConnectionsBeyondMaxConns(t *testing.T) {
+	full := &metrics.Counter{}
+	tarpit := &Tarpit{Duration: time.Hour, MaxConns: 1, Full: full}
+	ctx, cancel := context.WithCancel(context.Background())
+	held := make(chan struct{})
+	go func() {
+		defer close(held)
+		tarpit.Hold(ctx)
+	}()
+	require.Eventually(t, func() bool { return atomic.LoadInt32(&tarpit.held) == 1 }, time.Second, time.Millisecond)
+
+	// The tarpit is full, so further connections return at once.
+	tarpit.Hold(context.Background())
+	require.Equal(t, int64(1), full.Value())
+
+	cancel()
+	<-held
+	require.Equal(t, int32(0), atomic.LoadInt32(&tarpit.held))
+}
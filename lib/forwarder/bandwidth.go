@@ -0,0 +1,36 @@
+package forwarder
+
+import (
+	"context"
+	"io"
+	"tcplb/lib/core"
+)
+
+// BandwidthScheduler is core.BandwidthScheduler, sharing a ceiling on the
+// bandwidth of data sent to upstreams between the clients sending it.
+type BandwidthScheduler = core.BandwidthScheduler
+
+// scheduledWriter is an io.Writer that writes only as much as a
+// BandwidthScheduler allows at a time, waiting for it to allow more.
+type scheduledWriter struct {
+	ctx       context.Context
+	w         io.Writer
+	scheduler BandwidthScheduler
+	client    core.ClientID
+}
+
+func (s *scheduledWriter) Write(p []byte) (int, error) {
+	written := 0
+	for written < len(p) {
+		granted, err := s.scheduler.WaitBandwidth(s.ctx, s.client, len(p)-written)
+		if err != nil {
+			return written, err
+		}
+		n, err := s.w.Write(p[written : written+granted])
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
@@ -0,0 +1,81 @@
+package forwarder
+
+import (
+	"context"
+	"github.com/stretchr/testify/require"
+	"io"
+	"sync"
+	"tcplb/lib/core"
+	"testing"
+	"time"
+)
+
+// trickleScheduler grants up to 3 bytes at a time, recording the clients
+// granted bandwidth, until it is blocked.
+type trickleScheduler struct {
+	mu      sync.Mutex
+	clients []core.ClientID
+	blocked bool
+}
+
+func (s *trickleScheduler) WaitBandwidth(ctx context.Context, c core.ClientID, n int) (int, error) {
+	s.mu.Lock()
+	s.clients = append(s.clients, c)
+	blocked := s.blocked
+	s.mu.Unlock()
+	if blocked {
+		<-ctx.Done()
+		return 0, ctx.Err()
+	}
+	if n > 3 {
+		n = 3
+	}
+	return n, nil
+}
+
+func TestMediocreForwarderBandwidth(t *testing.T) {
+	alice := core.ClientID{Namespace: "test", Key: "alice"}
+	scheduler := &trickleScheduler{}
+	f := MediocreForwarder{Bandwidth: scheduler}
+	client, clientPeer := newPipeConns()
+	upstream, upstreamPeer := newPipeConns()
+	ctx, cancel := context.WithCancel(NewContextWithClientID(context.Background(), alice))
+	defer cancel()
+	result := make(chan error, 1)
+	go func() {
+		result <- f.Forward(ctx, client, upstream)
+	}()
+
+	// Data from the client is sent to the upstream as the scheduler allows.
+	go func() { _, _ = clientPeer.Write([]byte("hello world")) }()
+	buf := make([]byte, 11)
+	_, err := io.ReadFull(upstreamPeer, buf)
+	require.NoError(t, err)
+	require.Equal(t, "hello world", string(buf))
+	scheduler.mu.Lock()
+	require.Equal(t, []core.ClientID{alice, alice, alice, alice}, scheduler.clients)
+	scheduler.blocked = true
+	scheduler.mu.Unlock()
+
+	// Data from the upstream is not scheduled.
+	go func() { _, _ = upstreamPeer.Write([]byte("hi")) }()
+	buf = make([]byte, 2)
+	_, err = io.ReadFull(clientPeer, buf)
+	require.NoError(t, err)
+	require.Equal(t, "hi", string(buf))
+
+	// Sends waiting for bandwidth give up once forwarding stops.
+	go func() { _, _ = clientPeer.Write([]byte("more")) }()
+	require.Eventually(t, func() bool {
+		scheduler.mu.Lock()
+		defer scheduler.mu.Unlock()
+		return len(scheduler.clients) == 5
+	}, time.Second, time.Millisecond)
+	cancel()
+	select {
+	case err := <-result:
+		require.ErrorIs(t, err, context.Canceled)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Forward did not return")
+	}
+}
@@ -0,0 +1,166 @@
+package forwarder
+
+import (
+	"context"
+	"crypto/tls"
+	"github.com/stretchr/testify/require"
+	"io"
+	"net"
+	"tcplb/lib/core"
+	"tcplb/lib/slog"
+	"tcplb/lib/testbed"
+	"testing"
+)
+
+// benchChunkSize is the size of each write in the throughput benchmarks.
+const benchChunkSize = 32 * 1024
+
+// newTCPConnPair returns both ends of a loopback TCP connection.
+func newTCPConnPair(tb testing.TB) (*net.TCPConn, *net.TCPConn) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(tb, err)
+	defer listener.Close()
+	a, err := net.Dial("tcp", listener.Addr().String())
+	require.NoError(tb, err)
+	c, err := listener.Accept()
+	require.NoError(tb, err)
+	return a.(*net.TCPConn), c.(*net.TCPConn)
+}
+
+// benchmarkForward measures the throughput of forwarding from client to
+// upstream. Each operation is a write of benchChunkSize bytes by the client.
+func benchmarkForward(b *testing.B, client io.WriteCloser, clientConn, upstreamConn core.DuplexConn, upstreamPeer net.Conn) {
+	forwarded := make(chan error, 1)
+	go func() {
+		forwarded <- MediocreForwarder{}.Forward(context.Background(), clientConn, upstreamConn)
+	}()
+	drained := make(chan int64, 1)
+	go func() {
+		n, _ := io.Copy(io.Discard, upstreamPeer)
+		// Let Forward finish copying the upstream to the client.
+		_ = upstreamPeer.Close()
+		drained <- n
+	}()
+
+	chunk := make([]byte, benchChunkSize)
+	b.SetBytes(benchChunkSize)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := client.Write(chunk); err != nil {
+			b.Fatal(err)
+		}
+	}
+	if cw, ok := client.(core.CloseWriter); ok {
+		require.NoError(b, cw.CloseWrite())
+	}
+	require.Equal(b, int64(b.N)*benchChunkSize, <-drained)
+	b.StopTimer()
+
+	_ = client.Close()
+	<-forwarded
+	_ = clientConn.Close()
+	_ = upstreamConn.Close()
+}
+
+func BenchmarkForwardTCPToTCP(b *testing.B) {
+	client, clientConn := newTCPConnPair(b)
+	upstreamConn, upstreamPeer := newTCPConnPair(b)
+	benchmarkForward(b, client, clientConn, upstreamConn, upstreamPeer)
+}
+
+func BenchmarkForwardTLSToTCP(b *testing.B) {
+	tb := testbed.New(b)
+	server := tb.Server(b, "tcplb.test")
+	client, clientConn := newTCPConnPair(b)
+	clientConfig := tb.ClientTLSConfig(tb.Client(b, "bench"))
+	clientConfig.ServerName = "tcplb.test"
+	tlsClient := tls.Client(client, clientConfig)
+	tlsClientConn := tls.Server(clientConn, tb.ServerTLSConfig(server))
+	handshaken := make(chan error, 1)
+	go func() {
+		handshaken <- tlsClientConn.Handshake()
+	}()
+	require.NoError(b, tlsClient.Handshake())
+	require.NoError(b, <-handshaken)
+
+	upstreamConn, upstreamPeer := newTCPConnPair(b)
+	benchmarkForward(b, tlsClient, tlsClientConn, upstreamConn, upstreamPeer)
+}
+
+// benchmarkConnectionSetup measures the latency and allocations of serving
+// a connection with the given authentication handler, from dialing the
+// server until the first byte is echoed back by the upstream. The
+// allocations include those of the server, as it runs in-process.
+func benchmarkConnectionSetup(b *testing.B, listener net.Listener, authn func(logger slog.Logger, inner Handler) Handler, dial func() (net.Conn, error)) {
+	logger := slog.NewLogger(slog.Options{Level: slog.ErrorLevel, Output: io.Discard})
+	upstream := startEchoUpstream(b)
+	s := &Server{
+		Logger:   logger,
+		Listener: listener,
+		Handler: &ConnCloserHandler{
+			Inner: authn(logger, &AuthorizedUpstreamsHandler{
+				Logger:     logger,
+				Authorizer: stubAuthorizer{upstreams: core.NewUpstreamSet(upstream)},
+				Inner: &ForwardingHandler{
+					Logger:    logger,
+					Dialer:    anyUpstreamDialer{},
+					Forwarder: MediocreForwarder{},
+				},
+			}),
+		},
+	}
+	go func() {
+		_ = s.Serve()
+	}()
+	defer s.Close()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	buf := make([]byte, 1)
+	for i := 0; i < b.N; i++ {
+		conn, err := dial()
+		if err != nil {
+			b.Fatal(err)
+		}
+		if _, err := conn.Write(buf); err != nil {
+			b.Fatal(err)
+		}
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			b.Fatal(err)
+		}
+		_ = conn.Close()
+	}
+}
+
+func BenchmarkConnectionSetupTCP(b *testing.B) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(b, err)
+	authn := func(logger slog.Logger, inner Handler) Handler {
+		return &AnonymousAuthenticationHandler{
+			Logger:    logger,
+			Anonymous: core.ClientID{Namespace: "bench", Key: "anonymous"},
+			Inner:     inner,
+		}
+	}
+	benchmarkConnectionSetup(b, listener, authn, func() (net.Conn, error) {
+		return net.Dial("tcp", listener.Addr().String())
+	})
+}
+
+func BenchmarkConnectionSetupMTLS(b *testing.B) {
+	tb := testbed.New(b)
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", tb.ServerTLSConfig(tb.Server(b, "tcplb.test")))
+	require.NoError(b, err)
+	authn := func(logger slog.Logger, inner Handler) Handler {
+		return &HandshakeLimitingHandler{
+			Logger: logger,
+			Inner:  &MTLSAuthenticationHandler{Logger: logger, Inner: inner},
+		}
+	}
+	// Each connection makes a full handshake, as sessions are not cached.
+	clientConfig := tb.ClientTLSConfig(tb.Client(b, "bench"))
+	benchmarkConnectionSetup(b, listener, authn, func() (net.Conn, error) {
+		return tls.Dial("tcp", listener.Addr().String(), clientConfig)
+	})
+}
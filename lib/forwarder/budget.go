@@ -0,0 +1,137 @@
+package forwarder
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"tcplb/lib/clock"
+	"tcplb/lib/core"
+	"tcplb/lib/metrics"
+	"tcplb/lib/slog"
+	"time"
+)
+
+// BudgetReservations is core.BudgetReservations, the Budget of
+// BudgetWarnings about the connections a client holds at once.
+const BudgetReservations = core.BudgetReservations
+
+// BudgetWarning is core.BudgetWarning, so that limiters, e.g. in package
+// limiter, need not depend on this package.
+type BudgetWarning = core.BudgetWarning
+
+// BudgetWarner is core.BudgetWarner.
+type BudgetWarner = core.BudgetWarner
+
+// BudgetWarningPublisher publishes BudgetWarnings to consumers outside the
+// process, e.g. the teams operating clients. Implementations must not
+// block.
+type BudgetWarningPublisher interface {
+	PublishBudgetWarning(w BudgetWarning)
+}
+
+// BudgetWarnings is a BudgetWarner that logs and counts each warning, and
+// publishes it to Publisher. The connection of the warning is read from
+// the context.
+//
+// Warnings only reach operators and the consumers of Publisher, not the
+// client itself: the data forwarded is opaque, so nothing can be added to
+// it without corrupting it.
+//
+// Multiple goroutines may invoke methods on a BudgetWarnings
+// simultaneously.
+type BudgetWarnings struct {
+	Logger    slog.Logger            // Logger is optional. If set, warnings are logged.
+	Warned    *metrics.Counter       // Warned is optional. If set, it counts warnings.
+	Publisher BudgetWarningPublisher // Publisher is optional. If set, warnings are published to it.
+	Clock     clock.Clock            // Clock is optional. If nil, the Real clock is used.
+
+	// Interval is optional. If positive, each client is warned of each
+	// budget at most once per Interval, and later warnings within it are
+	// dropped, e.g. those of a client that reconnects at the threshold.
+	Interval time.Duration
+	// MaxClients bounds the clients whose latest warnings are remembered
+	// to enforce Interval. Once it is reached, those warned longer ago than
+	// Interval, or else an arbitrary client, are forgotten. If not
+	// positive, there is no bound.
+	MaxClients int
+
+	mu     sync.Mutex // mu guards warned
+	warned map[budgetWarningKey]time.Time
+}
+
+// budgetWarningKey identifies the budget of a client that it is warned of.
+type budgetWarningKey struct {
+	clientID core.ClientID
+	budget   string
+}
+
+// BudgetWarningThreshold is core.BudgetWarningThreshold.
+func BudgetWarningThreshold(limit int64, fraction float64) int64 {
+	return core.BudgetWarningThreshold(limit, fraction)
+}
+
+func (b *BudgetWarnings) WarnBudget(ctx context.Context, w BudgetWarning) {
+	w.Time = clock.Or(b.Clock).Now()
+	if !b.due(budgetWarningKey{clientID: w.ClientID, budget: w.Budget}, w.Time) {
+		return
+	}
+	w.ConnID = ConnIDFromContext(ctx)
+	w.Listener = ListenerNameFromContext(ctx)
+	b.Warned.Inc()
+	if b.Logger != nil {
+		details := fmt.Sprintf("used %d of %d %s", w.Usage, w.Limit, w.Budget)
+		if w.Window > 0 {
+			details += fmt.Sprintf(" within %s", w.Window)
+		}
+		b.Logger.Warn(&slog.LogRecord{
+			Msg:      "BudgetWarnings: client nearing limit, connections will be rejected at the limit",
+			ClientID: &w.ClientID,
+			Details:  details,
+		})
+	}
+	if b.Publisher != nil {
+		b.Publisher.PublishBudgetWarning(w)
+	}
+}
+
+// due reports whether the client and budget of key may be warned at now,
+// as it was last warned at least Interval ago, and if so, records that it
+// is warned.
+func (b *BudgetWarnings) due(key budgetWarningKey, now time.Time) bool {
+	if b.Interval <= 0 {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if last, ok := b.warned[key]; ok && now.Sub(last) < b.Interval {
+		return false
+	}
+	if b.warned == nil {
+		b.warned = make(map[budgetWarningKey]time.Time)
+	}
+	if _, ok := b.warned[key]; !ok && b.MaxClients > 0 && len(b.warned) >= b.MaxClients {
+		b.evict(now)
+	}
+	b.warned[key] = now
+	return true
+}
+
+// evict forgets the warnings older than Interval, or if there are none, an
+// arbitrary warning. The caller must hold b.mu.
+func (b *BudgetWarnings) evict(now time.Time) {
+	before := len(b.warned)
+	for key, last := range b.warned {
+		if now.Sub(last) >= b.Interval {
+			delete(b.warned, key)
+		}
+	}
+	if len(b.warned) < before {
+		return
+	}
+	for key := range b.warned {
+		delete(b.warned, key)
+		return
+	}
+}
+
+var _ BudgetWarner = (*BudgetWarnings)(nil) // type check
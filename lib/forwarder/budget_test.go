@@ -0,0 +1,69 @@
+package forwarder
+
+import (
+	"context"
+	"github.com/stretchr/testify/require"
+	"tcplb/lib/clock"
+	"tcplb/lib/core"
+	"tcplb/lib/metrics"
+	"tcplb/lib/slog"
+	"testing"
+	"time"
+)
+
+// recordingBudgetPublisher is a BudgetWarningPublisher that records the
+// warnings published to it.
+type recordingBudgetPublisher struct {
+	warnings []BudgetWarning
+}
+
+func (p *recordingBudgetPublisher) PublishBudgetWarning(w BudgetWarning) {
+	p.warnings = append(p.warnings, w)
+}
+
+func TestBudgetWarnings(t *testing.T) {
+	require.Equal(t, int64(0), BudgetWarningThreshold(0, 0.8))
+	require.Equal(t, int64(0), BudgetWarningThreshold(10, 0))
+	require.Equal(t, int64(8), BudgetWarningThreshold(10, 0.8))
+	require.Equal(t, int64(0), BudgetWarningThreshold(1, 0.8), "the threshold of small limits would be the limit")
+	require.Equal(t, int64(0), BudgetWarningThreshold(10, 1))
+
+	alice := core.ClientID{Namespace: "test", Key: "alice"}
+	c := clock.NewFake(time.Unix(1000, 0))
+	logger := &slog.RecordingLogger{}
+	registry := metrics.NewRegistry()
+	publisher := &recordingBudgetPublisher{}
+	warnings := &BudgetWarnings{Logger: logger, Warned: registry.Counter("budget_warnings_total"), Publisher: publisher, Clock: c}
+	ctx := NewContextWithListenerName(NewContextWithConnID(context.Background(), 7), "main")
+	warnings.WarnBudget(ctx, BudgetWarning{ClientID: alice, Budget: BudgetReservations, Usage: 8, Limit: 10})
+
+	require.Equal(t, []BudgetWarning{{
+		ClientID: alice,
+		Budget:   BudgetReservations,
+		Usage:    8,
+		Limit:    10,
+		Time:     c.Now(),
+		ConnID:   7,
+		Listener: "main",
+	}}, publisher.warnings)
+	require.Equal(t, int64(1), registry.Snapshot()["budget_warnings_total"])
+	require.Len(t, logger.Events, 1)
+
+	// Each client is warned of each budget at most once per Interval.
+	bob := core.ClientID{Namespace: "test", Key: "bob"}
+	limited := &BudgetWarnings{Logger: logger, Publisher: publisher, Clock: c, Interval: time.Minute, MaxClients: 2}
+	publisher.warnings = nil
+	limited.WarnBudget(ctx, BudgetWarning{ClientID: alice, Budget: BudgetReservations})
+	c.Advance(30 * time.Second)
+	limited.WarnBudget(ctx, BudgetWarning{ClientID: alice, Budget: BudgetReservations})
+	limited.WarnBudget(ctx, BudgetWarning{ClientID: alice, Budget: "bytes"})
+	limited.WarnBudget(ctx, BudgetWarning{ClientID: bob, Budget: BudgetReservations})
+	require.Len(t, publisher.warnings, 3)
+	c.Advance(30 * time.Second)
+	limited.WarnBudget(ctx, BudgetWarning{ClientID: alice, Budget: BudgetReservations})
+	require.Len(t, publisher.warnings, 4)
+	require.LessOrEqual(t, len(limited.warned), 2)
+
+	// Logger, Warned and Publisher are optional.
+	(&BudgetWarnings{}).WarnBudget(ctx, BudgetWarning{ClientID: alice})
+}
@@ -0,0 +1,152 @@
+package forwarder
+
+import (
+	"errors"
+	"fmt"
+)
+
+// UnknownStage is returned by Chain methods given the name of a Stage that
+// is not in the Chain.
+var UnknownStage = errors.New("unknown handler stage")
+
+// DuplicateStage is returned by Chain methods given a Stage whose name is
+// already in the Chain.
+var DuplicateStage = errors.New("duplicate handler stage")
+
+// Names of the stages of the handler stacks built by NewServer and by
+// cmd/tcplb, so that embedders may insert stages relative to them.
+const (
+	StageClose           = "close"
+	StageAccessLog       = "access-log"
+	StageEvents          = "events"
+	StageReasonMetrics   = "reason-metrics"
+	StageSignal          = "signal"
+	StageConnTable       = "conn-table"
+	StageMemoryShed      = "memory-shed"
+	StageRecover         = "recover"
+	StageIPFilter        = "ip-filter"
+	StageBan             = "ban"
+	StageGeoIP           = "geoip"
+	StagePreAuthDeadline = "pre-auth-deadline"
+	StageSniff           = "sniff"
+	StageFingerprint     = "fingerprint"
+	StageHandshakeLimit  = "handshake-limit"
+	StageEarlyDial       = "early-dial"
+	StageAuthn           = "authn"
+	StagePriority        = "priority"
+	StageQuota           = "quota"
+	StageRoute           = "route"
+	StageRateLimit       = "rate-limit"
+	StageAuthz           = "authz"
+	StageSOCKS5          = "socks5"
+	StageMirror          = "mirror"
+)
+
+// Middleware returns a Handler that does some work before, after or instead
+// of invoking the inner Handler.
+type Middleware func(inner Handler) Handler
+
+// Stage is a named Middleware in a Chain.
+type Stage struct {
+	Name       string
+	Middleware Middleware
+}
+
+// Chain is an ordered list of Stages, from outermost to innermost, that
+// composes a stack of Handlers. Names identify Stages, so that stages may be
+// inserted relative to others, e.g. by programs embedding this package that
+// add Handlers of their own.
+//
+// A Chain is not safe for concurrent modification. The Handler returned by
+// Then does not change when the Chain is later modified.
+type Chain struct {
+	stages []Stage
+}
+
+// NewChain returns a Chain of the given Stages, from outermost to innermost.
+// Stage names must be unique.
+func NewChain(stages ...Stage) (*Chain, error) {
+	c := &Chain{}
+	if err := c.Append(stages...); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *Chain) index(name string) int {
+	for i, s := range c.stages {
+		if s.Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+func (c *Chain) insert(i int, stages []Stage) error {
+	for j, s := range stages {
+		if c.index(s.Name) >= 0 {
+			return fmt.Errorf("%w: %q", DuplicateStage, s.Name)
+		}
+		for _, other := range stages[:j] {
+			if other.Name == s.Name {
+				return fmt.Errorf("%w: %q", DuplicateStage, s.Name)
+			}
+		}
+	}
+	rest := append(stages, c.stages[i:]...)
+	c.stages = append(c.stages[:i], rest...)
+	return nil
+}
+
+// Append adds stages at the innermost end of the Chain.
+func (c *Chain) Append(stages ...Stage) error {
+	return c.insert(len(c.stages), append([]Stage(nil), stages...))
+}
+
+// InsertBefore adds stages immediately outside the stage with the given
+// name, so they see each connection before it does.
+func (c *Chain) InsertBefore(name string, stages ...Stage) error {
+	i := c.index(name)
+	if i < 0 {
+		return fmt.Errorf("%w: %q", UnknownStage, name)
+	}
+	return c.insert(i, append([]Stage(nil), stages...))
+}
+
+// InsertAfter adds stages immediately inside the stage with the given name,
+// so they see each connection after it does.
+func (c *Chain) InsertAfter(name string, stages ...Stage) error {
+	i := c.index(name)
+	if i < 0 {
+		return fmt.Errorf("%w: %q", UnknownStage, name)
+	}
+	return c.insert(i+1, append([]Stage(nil), stages...))
+}
+
+// Remove removes the stage with the given name.
+func (c *Chain) Remove(name string) error {
+	i := c.index(name)
+	if i < 0 {
+		return fmt.Errorf("%w: %q", UnknownStage, name)
+	}
+	c.stages = append(c.stages[:i], c.stages[i+1:]...)
+	return nil
+}
+
+// Names returns the names of the stages, from outermost to innermost.
+func (c *Chain) Names() []string {
+	names := make([]string, len(c.stages))
+	for i, s := range c.stages {
+		names[i] = s.Name
+	}
+	return names
+}
+
+// Then returns the Handler composed of every stage of the Chain, wrapping
+// the innermost Handler h.
+func (c *Chain) Then(h Handler) Handler {
+	for i := len(c.stages) - 1; i >= 0; i-- {
+		h = c.stages[i].Middleware(h)
+	}
+	return h
+}
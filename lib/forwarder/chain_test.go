@@ -0,0 +1,58 @@
+package forwarder
+
+import (
+	"context"
+	"github.com/stretchr/testify/require"
+	"tcplb/lib/core"
+	"testing"
+)
+
+// tracingHandler appends its name to the trace of each connection it
+// handles, then invokes its Inner handler, if any.
+type tracingHandler struct {
+	name  string
+	trace *[]string
+	Inner Handler
+}
+
+func (h *tracingHandler) Handle(ctx context.Context, conn core.DuplexConn) {
+	*h.trace = append(*h.trace, h.name)
+	if h.Inner != nil {
+		h.Inner.Handle(ctx, conn)
+	}
+}
+
+func TestChain(t *testing.T) {
+	var trace []string
+	stage := func(name string) Stage {
+		return Stage{Name: name, Middleware: func(inner Handler) Handler {
+			return &tracingHandler{name: name, trace: &trace, Inner: inner}
+		}}
+	}
+
+	chain, err := NewChain(stage("a"), stage("c"))
+	require.NoError(t, err)
+	require.NoError(t, chain.InsertAfter("a", stage("b")))
+	require.NoError(t, chain.InsertBefore("a", stage("outer")))
+	require.NoError(t, chain.Append(stage("inner")))
+	require.Equal(t, []string{"outer", "a", "b", "c", "inner"}, chain.Names())
+
+	h := chain.Then(&tracingHandler{name: "final", trace: &trace})
+	h.Handle(context.Background(), nil)
+	require.Equal(t, []string{"outer", "a", "b", "c", "inner", "final"}, trace)
+
+	// Handlers already built are unaffected by later changes to the chain.
+	require.NoError(t, chain.Remove("b"))
+	require.Equal(t, []string{"outer", "a", "c", "inner"}, chain.Names())
+	trace = nil
+	h.Handle(context.Background(), nil)
+	require.Equal(t, []string{"outer", "a", "b", "c", "inner", "final"}, trace)
+
+	require.ErrorIs(t, chain.InsertAfter("b", stage("x")), UnknownStage)
+	require.ErrorIs(t, chain.Remove("b"), UnknownStage)
+	require.ErrorIs(t, chain.Append(stage("a")), DuplicateStage)
+	require.ErrorIs(t, chain.Append(stage("x"), stage("x")), DuplicateStage)
+	require.Equal(t, []string{"outer", "a", "c", "inner"}, chain.Names())
+	_, err = NewChain(stage("a"), stage("a"))
+	require.ErrorIs(t, err, DuplicateStage)
+}
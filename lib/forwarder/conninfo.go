@@ -0,0 +1,78 @@
+package forwarder
+
+import (
+	"context"
+	"net"
+	"syscall"
+	"tcplb/lib/core"
+	"time"
+)
+
+// ConnInfo describes the socket of a client connection as it was accepted,
+// to help debug network issues such as asymmetric routing, where replies
+// leave by a different path than requests arrived by.
+type ConnInfo struct {
+	Listener   string    `json:"listener,omitempty"` // Listener is the name of the listener that accepted the connection, if it has one.
+	LocalAddr  string    `json:"local_addr"`         // LocalAddr is the address the client connected to, which tells apart listeners bound to wildcard addresses.
+	RemoteAddr string    `json:"remote_addr"`
+	AcceptedAt time.Time `json:"accepted_at"`
+	TCP        *TCPInfo  `json:"tcp,omitempty"` // TCP is nil unless the Server reads TCP state and the platform reports it for the socket.
+}
+
+// TCPInfo is the TCP state of a client connection's socket, as negotiated
+// with the client during the TCP handshake.
+type TCPInfo struct {
+	MSS     int           `json:"mss"`               // MSS is the maximum segment size sent to the client.
+	RTT     time.Duration `json:"rtt"`               // RTT is the smoothed round-trip time, as measured by the handshake.
+	Options []string      `json:"options,omitempty"` // Options are the TCP options negotiated, of TCPOptionTimestamps, TCPOptionSACK, TCPOptionWindowScale and TCPOptionECN.
+}
+
+// Names of the TCP options reported in TCPInfo.
+const (
+	TCPOptionTimestamps  = "timestamps"
+	TCPOptionSACK        = "sack"
+	TCPOptionWindowScale = "wscale"
+	TCPOptionECN         = "ecn"
+)
+
+type connInfoContextKeyType struct{}
+
+var connInfoContextKey = connInfoContextKeyType{}
+
+// NewContextWithConnInfo returns a child context of parent that carries the
+// ConnInfo of the client connection.
+func NewContextWithConnInfo(parent context.Context, info *ConnInfo) context.Context {
+	return context.WithValue(parent, connInfoContextKey, info)
+}
+
+// ConnInfoFromContext returns the ConnInfo stored in ctx, if any.
+func ConnInfoFromContext(ctx context.Context) (*ConnInfo, bool) {
+	info, ok := ctx.Value(connInfoContextKey).(*ConnInfo)
+	return info, ok && info != nil
+}
+
+// newConnInfo returns the ConnInfo of the client connection conn, accepted
+// by the named listener at the given time. Its TCP state is only read if
+// readTCP is set.
+func newConnInfo(conn net.Conn, listener string, acceptedAt time.Time, readTCP bool) *ConnInfo {
+	info := &ConnInfo{
+		Listener:   listener,
+		LocalAddr:  conn.LocalAddr().String(),
+		RemoteAddr: conn.RemoteAddr().String(),
+		AcceptedAt: acceptedAt,
+	}
+	if !readTCP {
+		return info
+	}
+	if sc, ok := socketOf(conn); ok {
+		info.TCP = readTCPInfo(sc)
+	}
+	return info
+}
+
+// socketOf returns the socket underneath conn, unwrapping TLS, peeking and
+// other wrapping connections, if there is one.
+func socketOf(conn net.Conn) (syscall.Conn, bool) {
+	sc, ok := core.TransportConn(conn).(syscall.Conn)
+	return sc, ok
+}
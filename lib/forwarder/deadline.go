@@ -0,0 +1,106 @@
+package forwarder
+
+import (
+	"context"
+	"sync"
+	"tcplb/lib/accesslog"
+	"tcplb/lib/clock"
+	"tcplb/lib/core"
+	"tcplb/lib/slog"
+	"time"
+)
+
+// preAuthDeadline tracks whether a connection began forwarding before its
+// pre-authentication budget was spent.
+type preAuthDeadline struct {
+	mu      sync.Mutex // mu guards expired and ended
+	expired bool       // expired is set once the budget is spent.
+	ended   bool       // ended is set once forwarding begins.
+}
+
+// expire marks the budget as spent, and reports whether forwarding had not
+// yet begun.
+func (d *preAuthDeadline) expire() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.ended {
+		return false
+	}
+	d.expired = true
+	return true
+}
+
+// end marks forwarding as begun, and reports whether the budget was not
+// yet spent.
+func (d *preAuthDeadline) end() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.expired {
+		return false
+	}
+	d.ended = true
+	return true
+}
+
+type preAuthDeadlineContextKeyType struct{}
+
+var preAuthDeadlineContextKey = preAuthDeadlineContextKeyType{}
+
+// endPreAuthDeadline stops the pre-authentication deadline stored in ctx,
+// if any, as forwarding is about to begin. It returns false if the deadline
+// has already passed, in which case the connection should be abandoned.
+func endPreAuthDeadline(ctx context.Context) bool {
+	d, ok := ctx.Value(preAuthDeadlineContextKey).(*preAuthDeadline)
+	if !ok {
+		return true
+	}
+	return d.end()
+}
+
+// PreAuthDeadlineHandler is a handler that bounds the total time a client
+// connection may spend between being accepted and being forwarded, i.e.
+// across the TLS handshake, authentication, authorization, routing and
+// dialing together. Each of these stages may have its own timeout, but a
+// client that is slow at every stage could otherwise linger for their sum.
+//
+// If Budget is spent before the ForwardingHandler begins forwarding, the
+// context passed to the Inner handler is cancelled and reads and writes on
+// the client connection fail at once, and the connection is recorded with
+// the termination reason "pre_auth_timeout". Once forwarding begins the
+// budget no longer applies. If Budget is not positive, connections are
+// passed to Inner unchanged.
+type PreAuthDeadlineHandler struct {
+	Logger slog.Logger
+	Budget time.Duration
+	Clock  clock.Clock // Clock is optional. If nil, the system clock is used.
+	Inner  Handler
+}
+
+func (h *PreAuthDeadlineHandler) Handle(ctx context.Context, conn core.DuplexConn) {
+	if h.Budget <= 0 {
+		h.Inner.Handle(ctx, conn)
+		return
+	}
+	d := &preAuthDeadline{}
+	innerCtx, cancel := context.WithCancel(context.WithValue(ctx, preAuthDeadlineContextKey, d))
+	defer cancel()
+	timer := clock.Or(h.Clock).AfterFunc(h.Budget, func() {
+		if !d.expire() {
+			return
+		}
+		// Record the reason first, as later stages fail because of it.
+		accesslog.SetReason(ctx, accesslog.ReasonPreAuthTimeout)
+		h.Logger.Warn(&slog.LogRecord{Msg: "PreAuthDeadlineHandler: connection not forwarded within budget", Reason: accesslog.ReasonPreAuthTimeout, Details: h.Budget.String()})
+		cancel()
+		// Unblock any stage waiting on the client. The connection is
+		// abandoned, so its deadline need not be restored.
+		_ = conn.SetDeadline(time.Now())
+	})
+	defer timer.Stop()
+	// Once Inner returns, the timer must not record a reason.
+	defer d.end()
+
+	h.Inner.Handle(innerCtx, conn)
+}
+
+var _ Handler = (*PreAuthDeadlineHandler)(nil) // type check
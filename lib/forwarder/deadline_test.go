@@ -0,0 +1,66 @@
+package forwarder
+
+import (
+	"context"
+	"github.com/stretchr/testify/require"
+	"tcplb/lib/accesslog"
+	"tcplb/lib/clock"
+	"tcplb/lib/core"
+	"tcplb/lib/slog"
+	"testing"
+	"time"
+)
+
+// slowHandler reads from the client, then records whether its context was
+// cancelled.
+type slowHandler struct {
+	forward    bool          // forward ends the pre-authentication deadline before reading.
+	forwarding chan struct{} // forwarding is optional. If set, it is closed once the deadline is ended.
+	ctxErr     error
+	readErr    error
+}
+
+func (h *slowHandler) Handle(ctx context.Context, conn core.DuplexConn) {
+	if h.forward && !endPreAuthDeadline(ctx) {
+		return
+	}
+	if h.forwarding != nil {
+		close(h.forwarding)
+	}
+	_, h.readErr = conn.Read(make([]byte, 1))
+	h.ctxErr = ctx.Err()
+	accesslog.SetReason(ctx, accesslog.ReasonForwarded)
+}
+
+func TestPreAuthDeadlineHandler(t *testing.T) {
+	inner := &slowHandler{}
+	c := clock.NewFake(time.Unix(1000, 0))
+	h := &PreAuthDeadlineHandler{
+		Logger: &slog.RecordingLogger{},
+		Budget: 20 * time.Millisecond,
+		Clock:  c,
+		Inner:  inner,
+	}
+
+	// A client that never sends anything is dropped once the budget is spent.
+	conn, _ := newPipeConns()
+	reason := make(chan accesslog.ReasonCode)
+	go func() { reason <- handleRecordingReason(h, conn) }()
+	c.BlockUntil(1)
+	c.Advance(20 * time.Millisecond)
+	require.Equal(t, accesslog.ReasonPreAuthTimeout, <-reason)
+	require.Error(t, inner.readErr)
+	require.ErrorIs(t, inner.ctxErr, context.Canceled)
+
+	// Once forwarding begins, the budget no longer applies.
+	inner = &slowHandler{forward: true, forwarding: make(chan struct{})}
+	h.Inner = inner
+	conn, peer := newPipeConns()
+	go func() { reason <- handleRecordingReason(h, conn) }()
+	<-inner.forwarding
+	c.Advance(time.Minute)
+	_, _ = peer.Write([]byte("x"))
+	require.Equal(t, accesslog.ReasonForwarded, <-reason)
+	require.NoError(t, inner.readErr)
+	require.NoError(t, inner.ctxErr)
+}
@@ -0,0 +1,81 @@
+package forwarder
+
+import (
+	"context"
+	"net"
+	"sync"
+	"tcplb/lib/clock"
+	"tcplb/lib/core"
+	"tcplb/lib/metrics"
+	"time"
+)
+
+// DeniedClientLimiter bounds the connections of each client that
+// authenticated, and so completed a TLS handshake, but is not authorized
+// for any upstream. Such a client cannot be served, but would otherwise be
+// free to spend the server's handshake CPU by reconnecting indefinitely.
+//
+// Denied connections of a client within MaxPerClient are held open for
+// Hold, doing nothing, to slow down clients that reconnect at once. Each
+// denied connection beyond it is closed at once and, if there is a Banner,
+// its source is recorded as failing, so that once the source is banned its
+// connections are dropped before their handshakes.
+//
+// Multiple goroutines may invoke methods on a DeniedClientLimiter
+// simultaneously.
+type DeniedClientLimiter struct {
+	MaxPerClient int              // MaxPerClient bounds the denied connections each client may hold open at once.
+	Hold         time.Duration    // Hold is how long denied connections within the bound are held open. If not positive, they are closed at once, and only those denied at the same moment count against the bound.
+	Banner       SourceBanner     // Banner is optional. If set, the sources of denied connections beyond the bound are recorded as failing.
+	Exceeded     *metrics.Counter // Exceeded is optional. If set, it counts denied connections beyond the bound.
+	Clock        clock.Clock      // Clock is optional. If nil, the Real clock is used.
+
+	mu   sync.Mutex // mu guards open
+	open map[core.ClientID]int
+}
+
+// Deny holds the denied connection conn of clientID open for Hold, or until
+// ctx is done, and reports true, unless the client already holds
+// MaxPerClient denied connections open. In that case, it records the
+// source of conn as failing, and reports false at once.
+func (l *DeniedClientLimiter) Deny(ctx context.Context, clientID core.ClientID, conn core.DuplexConn) bool {
+	l.mu.Lock()
+	if l.open == nil {
+		l.open = make(map[core.ClientID]int)
+	}
+	if l.open[clientID] >= l.MaxPerClient {
+		l.mu.Unlock()
+		l.Exceeded.Inc()
+		if remote, ok := conn.RemoteAddr().(*net.TCPAddr); ok && l.Banner != nil {
+			l.Banner.RecordFailure(remote.AddrPort().Addr())
+		}
+		return false
+	}
+	l.open[clientID]++
+	l.mu.Unlock()
+
+	defer func() {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		l.open[clientID]--
+		if l.open[clientID] == 0 {
+			delete(l.open, clientID)
+		}
+	}()
+	if l.Hold > 0 {
+		timer := clock.Or(l.Clock).NewTimer(l.Hold)
+		defer timer.Stop()
+		select {
+		case <-timer.C():
+		case <-ctx.Done():
+		}
+	}
+	return true
+}
+
+// Open returns the number of denied connections that clientID holds open.
+func (l *DeniedClientLimiter) Open(clientID core.ClientID) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.open[clientID]
+}
@@ -0,0 +1,73 @@
+package forwarder
+
+import (
+	"context"
+	"github.com/stretchr/testify/require"
+	"io"
+	"net"
+	"net/netip"
+	"tcplb/lib/accesslog"
+	"tcplb/lib/clock"
+	"tcplb/lib/core"
+	"tcplb/lib/metrics"
+	"tcplb/lib/slog"
+	"testing"
+	"time"
+)
+
+func TestAuthorizedUpstreamsHandlerLimitsDeniedClients(t *testing.T) {
+	c := clock.NewFake(time.Now())
+	banner := &countingBanner{failures: make(map[netip.Addr]int)}
+	denied := &DeniedClientLimiter{MaxPerClient: 2, Hold: time.Second, Banner: banner, Exceeded: &metrics.Counter{}, Clock: c}
+	logger := slog.NewLogger(slog.Options{Output: io.Discard})
+	h := &AuthorizedUpstreamsHandler{
+		Logger:     logger,
+		Authorizer: stubAuthorizer{upstreams: core.EmptyUpstreamSet()},
+		Denied:     denied,
+		Inner:      &ForwardingHandler{Logger: logger, Dialer: stubDialer{}, Forwarder: stubForwarder{}},
+	}
+	clientID := core.ClientID{Namespace: "handler-test", Key: "mallory"}
+	ctx := NewContextWithClientID(context.Background(), clientID)
+	source := netip.MustParseAddr("192.0.2.1")
+	conn, _ := newPipeConns()
+	conn = addrConn{DuplexConn: conn, remote: net.TCPAddrFromAddrPort(netip.AddrPortFrom(source, 50000))}
+	deny := func(ctx context.Context) accesslog.ReasonCode {
+		record := accesslog.NewRecord("client", time.Now())
+		h.Handle(accesslog.NewContextWithRecord(ctx, record), conn)
+		return record.Reason()
+	}
+
+	// Denied connections within the bound are held open.
+	done := make(chan accesslog.ReasonCode, 2)
+	for i := 0; i < 2; i++ {
+		go func() { done <- deny(ctx) }()
+	}
+	c.BlockUntil(2)
+	require.Equal(t, 2, denied.Open(clientID))
+
+	// Further denied connections are closed at once, and their source is
+	// recorded as failing.
+	require.Equal(t, accesslog.ReasonNotAuthorized, deny(ctx))
+	require.Equal(t, 1, banner.failures[source])
+	require.Equal(t, int64(1), denied.Exceeded.Value())
+
+	// Other clients are not affected.
+	other := NewContextWithClientID(context.Background(), core.ClientID{Namespace: "handler-test", Key: "alice"})
+	go func() { done <- deny(other) }()
+	c.BlockUntil(3)
+
+	c.Advance(time.Second)
+	for i := 0; i < 3; i++ {
+		require.Equal(t, accesslog.ReasonNotAuthorized, <-done)
+	}
+	require.Equal(t, 0, denied.Open(clientID))
+
+	// Authorized clients routed to a pool without any of their upstreams
+	// find no upstream available, and are not denied.
+	web1 := core.Upstream{Network: "handler-test", Address: "web1"}
+	h.Authorizer = stubAuthorizer{upstreams: core.NewUpstreamSet(web1)}
+	pool := &Pool{Name: "web", Upstreams: core.EmptyUpstreamSet()}
+	require.Equal(t, accesslog.ReasonNoUpstream, deny(NewContextWithPool(ctx, pool)))
+	require.Equal(t, 1, banner.failures[source])
+	require.Equal(t, int64(1), denied.Exceeded.Value())
+}
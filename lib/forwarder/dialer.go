@@ -0,0 +1,36 @@
+package forwarder
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"tcplb/lib/core"
+)
+
+// NoUpstreamAvailable is returned by a BestUpstreamDialer if none of the
+// candidate upstreams are available to dial, e.g. as all are drained.
+var NoUpstreamAvailable = errors.New("no upstream available")
+
+// DialError is returned by an UpstreamDialer when an upstream could not be
+// dialed. Err is the cause.
+type DialError struct {
+	Upstream core.Upstream
+	Err      error
+}
+
+func (e *DialError) Error() string {
+	return fmt.Sprintf("failed to dial upstream %s: %v", e.Upstream.Address, e.Err)
+}
+
+func (e *DialError) Unwrap() error {
+	return e.Err
+}
+
+// UpstreamDialer dials a connection to a given upstream.
+//
+// Multiple goroutines may invoke methods on an UpstreamDialer simultaneously.
+type UpstreamDialer interface {
+	// DialUpstream connects to upstream. If error is nil, the caller is
+	// responsible for closing the returned DuplexConn.
+	DialUpstream(ctx context.Context, upstream core.Upstream) (core.DuplexConn, error)
+}
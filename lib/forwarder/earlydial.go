@@ -0,0 +1,164 @@
+package forwarder
+
+import (
+	"context"
+	"crypto/tls"
+	"sync"
+	"tcplb/lib/core"
+	"tcplb/lib/routing"
+	"tcplb/lib/trace"
+)
+
+// PreAuthRouter selects the name of the pool to forward a connection to,
+// using only what is known about the connection before the client is
+// authenticated.
+//
+// Multiple goroutines may invoke methods on a PreAuthRouter simultaneously.
+type PreAuthRouter interface {
+	// RouteIgnoringGroups returns the pool that the connection described by
+	// req will be routed to, whatever groups the client belongs to and
+	// whatever its certificate. If that cannot be known before
+	// authentication, ok is false.
+	RouteIgnoringGroups(req routing.Request) (pool string, ok bool)
+}
+
+// earlyDial is a dial of an upstream started before the client connection
+// was authenticated and authorized.
+type earlyDial struct {
+	pool   *Pool
+	done   chan struct{} // done is closed once the dial completes.
+	cancel context.CancelFunc
+
+	// upstream, conn and err are the results of the dial, valid once done is closed.
+	upstream core.Upstream
+	conn     core.DuplexConn
+	err      error
+
+	mu      sync.Mutex // mu guards claimed
+	claimed bool
+}
+
+// claim waits for the dial to complete, then returns its results. ok is
+// false if the dial was already claimed or ctx was cancelled first.
+func (d *earlyDial) claim(ctx context.Context) (upstream core.Upstream, conn core.DuplexConn, err error, ok bool) {
+	select {
+	case <-d.done:
+	case <-ctx.Done():
+		return core.Upstream{}, nil, ctx.Err(), false
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.claimed {
+		return core.Upstream{}, nil, nil, false
+	}
+	d.claimed = true
+	return d.upstream, d.conn, d.err, true
+}
+
+// discard abandons the dial. If it has not been claimed, the upstream
+// connection is closed once the dial completes.
+func (d *earlyDial) discard() {
+	// Cancelling the dial does not affect a connection that was claimed.
+	d.cancel()
+	d.mu.Lock()
+	claimed := d.claimed
+	d.claimed = true
+	d.mu.Unlock()
+	if claimed {
+		return
+	}
+	go func() {
+		<-d.done
+		if d.conn != nil {
+			_ = d.conn.Close()
+		}
+	}()
+}
+
+// claimEarlyDial returns the result of the early dial stored in ctx, if
+// there is one, it was made in the Pool that the connection has been routed
+// to, and it succeeded in connecting to one of the candidates.
+func claimEarlyDial(ctx context.Context, candidates core.UpstreamSet) (core.Upstream, core.DuplexConn, bool) {
+	d, ok := earlyDialFromContext(ctx)
+	if !ok {
+		return core.Upstream{}, nil, false
+	}
+	if pool, ok := PoolFromContext(ctx); !ok || pool != d.pool {
+		return core.Upstream{}, nil, false
+	}
+	upstream, conn, err, ok := d.claim(ctx)
+	if !ok || err != nil {
+		return core.Upstream{}, nil, false
+	}
+	if _, ok := candidates[upstream]; !ok {
+		// The client is not authorized for this upstream.
+		_ = conn.Close()
+		return core.Upstream{}, nil, false
+	}
+	return upstream, conn, true
+}
+
+type earlyDialContextKeyType struct{}
+
+var earlyDialContextKey = earlyDialContextKeyType{}
+
+func earlyDialFromContext(ctx context.Context) (*earlyDial, bool) {
+	d, ok := ctx.Value(earlyDialContextKey).(*earlyDial)
+	return d, ok
+}
+
+// EarlyDialHandler is a handler that reduces connection setup latency by
+// starting to dial an upstream before the client connection has been
+// authenticated and authorized, instead of afterwards. It should wrap the
+// authentication handler.
+//
+// The dial is only started if the Pool the connection will be routed to is
+// known from the listener name and the TLS server name alone. The upstream is
+// chosen from every upstream of the Pool, without knowing the client, so
+// dial policies that depend on the ClientID cannot be honoured. The
+// ForwardingHandler uses the early dial only if the upstream turns out to be
+// authorized for the client. Otherwise, e.g. if the client is rejected, the
+// upstream connection is discarded. Pools that send a PROXY header are not
+// dialed early, as the header describes the authenticated client.
+type EarlyDialHandler struct {
+	Router PreAuthRouter
+	Pools  map[string]*Pool
+	Inner  Handler
+}
+
+func (h *EarlyDialHandler) Handle(ctx context.Context, conn core.DuplexConn) {
+	req := routing.Request{Listener: ListenerNameFromContext(ctx)}
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		// The server name is only known once the handshake completes. If it
+		// fails, the authentication handler will report the error.
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			h.Inner.Handle(ctx, conn)
+			return
+		}
+		req.SNI = tlsConn.ConnectionState().ServerName
+	}
+	name, ok := h.Router.RouteIgnoringGroups(req)
+	if !ok {
+		h.Inner.Handle(ctx, conn)
+		return
+	}
+	pool, ok := h.Pools[name]
+	if !ok || pool.ProxyHeader != nil {
+		h.Inner.Handle(ctx, conn)
+		return
+	}
+
+	dialCtx, cancel := context.WithCancel(ctx)
+	d := &earlyDial{pool: pool, done: make(chan struct{}), cancel: cancel}
+	go func() {
+		defer close(d.done)
+		spanCtx, span := trace.StartClientSpan(dialCtx, "early_dial")
+		d.upstream, d.conn, d.err = pool.Dialer.DialBestUpstream(spanCtx, pool.CurrentUpstreams())
+		span.RecordError(d.err)
+		span.End()
+	}()
+	defer d.discard()
+	h.Inner.Handle(context.WithValue(ctx, earlyDialContextKey, d), conn)
+}
+
+var _ Handler = (*EarlyDialHandler)(nil) // type check
@@ -0,0 +1,52 @@
+package forwarder
+
+import (
+	"context"
+	"github.com/stretchr/testify/require"
+	"io"
+	"tcplb/lib/core"
+	"tcplb/lib/routing"
+	"tcplb/lib/slog"
+	"testing"
+	"time"
+)
+
+func TestEarlyDialHandler(t *testing.T) {
+	web1 := core.Upstream{Network: "handler-test", Address: "web1"}
+	newStack := func(authorizer Authorizer, dialer *peerKeepingDialer) Handler {
+		pools := map[string]*Pool{
+			"web": {Name: "web", Upstreams: core.NewUpstreamSet(web1), Dialer: dialer, Reserver: unboundedReserver{}},
+		}
+		router := routing.NewTable(routing.Rule{Pool: "web"})
+		inner := newTestHandlerStack(authorizer, PoolDialer{}, func(inner Handler) Handler {
+			return &RoutingHandler{Logger: &slog.RecordingLogger{}, Router: router, Pools: pools, Inner: inner}
+		})
+		return &EarlyDialHandler{Router: router, Pools: pools, Inner: inner}
+	}
+
+	// The early dial is used to forward the authorized client.
+	dialer := &peerKeepingDialer{}
+	clientConn, _ := newPipeConns()
+	newStack(stubAuthorizer{upstreams: core.NewUpstreamSet(web1)}, dialer).Handle(context.Background(), clientConn)
+	require.Len(t, dialer.Peers(), 1)
+
+	// The early dial is discarded when the client is not authorized.
+	dialer = &peerKeepingDialer{}
+	newStack(stubAuthorizer{upstreams: core.EmptyUpstreamSet()}, dialer).Handle(context.Background(), clientConn)
+	require.Eventually(t, func() bool { return len(dialer.Peers()) == 1 }, time.Second, time.Millisecond)
+	_, err := dialer.Peers()[0].Read(make([]byte, 1))
+	require.ErrorIs(t, err, io.EOF)
+
+	// Pools that send a PROXY header are dialed once the client is known.
+	recorder := &clientConnRecordingDialer{}
+	pools := map[string]*Pool{
+		"web": {Name: "web", Upstreams: core.NewUpstreamSet(web1), Dialer: recorder, Reserver: unboundedReserver{}, ProxyHeader: &ProxyHeaderConfig{}},
+	}
+	router := routing.NewTable(routing.Rule{Pool: "web"})
+	inner := newTestHandlerStack(stubAuthorizer{upstreams: core.NewUpstreamSet(web1)}, PoolDialer{}, func(inner Handler) Handler {
+		return &RoutingHandler{Logger: &slog.RecordingLogger{}, Router: router, Pools: pools, Inner: inner}
+	})
+	(&EarlyDialHandler{Router: router, Pools: pools, Inner: inner}).Handle(context.Background(), clientConn)
+	require.Len(t, recorder.Peers(), 1)
+	require.Equal(t, []core.DuplexConn{clientConn}, recorder.clientConns)
+}
@@ -0,0 +1,87 @@
+package forwarder
+
+import (
+	"context"
+	"tcplb/lib/accesslog"
+	"tcplb/lib/clock"
+	"tcplb/lib/core"
+	"time"
+)
+
+// ConnOpenedEvent describes a client connection as it starts to be handled.
+type ConnOpenedEvent struct {
+	ConnID     ConnID
+	Listener   string // Listener is the name of the listener that accepted the connection, if it has one.
+	SourceAddr string
+	LocalAddr  string // LocalAddr is the address the client connected to, if known.
+	Time       time.Time
+}
+
+// ConnClosedEvent describes a client connection once it has been handled
+// and closed.
+type ConnClosedEvent struct {
+	ConnID     ConnID
+	Listener   string
+	SourceAddr string
+	Time       time.Time
+	Duration   time.Duration
+	Outcome    accesslog.Summary // Outcome is the outcome of the connection, as recorded by the handlers.
+}
+
+// ConnEventPublisher publishes the opening and closing of client
+// connections to consumers outside the process, e.g. SIEM or billing
+// systems, so that they need not scrape logs.
+//
+// Publish methods are called synchronously from the goroutine handling
+// the connection, so implementations must not block.
+//
+// Multiple goroutines may invoke methods on a ConnEventPublisher
+// simultaneously.
+type ConnEventPublisher interface {
+	PublishOpened(event ConnOpenedEvent)
+	PublishClosed(event ConnClosedEvent)
+}
+
+// EventPublishingHandler is a handler that publishes an event to Publisher
+// when it starts handling each client connection, and another once the
+// Inner handler has finished handling it. The outcome of the connection is
+// read from the accesslog.Record stored in the context, so it must wrap
+// the handlers that record it. If there is no Record in the context, one
+// is created for the Inner handler to use.
+type EventPublishingHandler struct {
+	Publisher ConnEventPublisher
+	Clock     clock.Clock // Clock is optional. If nil, the Real clock is used.
+	Inner     Handler
+}
+
+func (h *EventPublishingHandler) Handle(ctx context.Context, conn core.DuplexConn) {
+	c := clock.Or(h.Clock)
+	opened := ConnOpenedEvent{
+		ConnID:     ConnIDFromContext(ctx),
+		Listener:   ListenerNameFromContext(ctx),
+		SourceAddr: conn.RemoteAddr().String(),
+		Time:       c.Now(),
+	}
+	if info, ok := ConnInfoFromContext(ctx); ok {
+		opened.LocalAddr = info.LocalAddr
+		opened.Time = info.AcceptedAt
+	}
+	record := accesslog.RecordFromContext(ctx)
+	if record == nil {
+		record = accesslog.NewRecord(opened.SourceAddr, opened.Time)
+		ctx = accesslog.NewContextWithRecord(ctx, record)
+	}
+	h.Publisher.PublishOpened(opened)
+	h.Inner.Handle(ctx, conn)
+	now := c.Now()
+	h.Publisher.PublishClosed(ConnClosedEvent{
+		ConnID:     opened.ConnID,
+		Listener:   opened.Listener,
+		SourceAddr: opened.SourceAddr,
+		Time:       now,
+		Duration:   now.Sub(opened.Time),
+		Outcome:    record.Summary(),
+	})
+}
+
+var _ Handler = (*EventPublishingHandler)(nil) // type check
@@ -0,0 +1,59 @@
+package forwarder
+
+import (
+	"context"
+	"github.com/stretchr/testify/require"
+	"tcplb/lib/accesslog"
+	"tcplb/lib/core"
+	"testing"
+)
+
+// recordingPublisher records the events published to it.
+type recordingPublisher struct {
+	opened []ConnOpenedEvent
+	closed []ConnClosedEvent
+}
+
+func (p *recordingPublisher) PublishOpened(event ConnOpenedEvent) {
+	p.opened = append(p.opened, event)
+}
+
+func (p *recordingPublisher) PublishClosed(event ConnClosedEvent) {
+	p.closed = append(p.closed, event)
+}
+
+func TestEventPublishingHandler(t *testing.T) {
+	a := core.Upstream{Network: "handler-test", Address: "a"}
+	publisher := &recordingPublisher{}
+	ctx := NewContextWithListenerName(NewContextWithConnID(context.Background(), 7), "internal")
+
+	clientConn, _ := newPipeConns()
+	h := &EventPublishingHandler{
+		Publisher: publisher,
+		Inner:     newTestHandlerStack(stubAuthorizer{upstreams: core.NewUpstreamSet(a)}, stubDialer{}),
+	}
+	h.Handle(ctx, clientConn)
+
+	require.Len(t, publisher.opened, 1)
+	require.Equal(t, ConnID(7), publisher.opened[0].ConnID)
+	require.Equal(t, "internal", publisher.opened[0].Listener)
+	require.Equal(t, clientConn.RemoteAddr().String(), publisher.opened[0].SourceAddr)
+	require.Len(t, publisher.closed, 1)
+	closed := publisher.closed[0]
+	require.Equal(t, ConnID(7), closed.ConnID)
+	require.Equal(t, "internal", closed.Listener)
+	require.Equal(t, core.ClientID{Namespace: "handler-test", Key: "anon"}, *closed.Outcome.ClientID)
+	require.Equal(t, a, *closed.Outcome.Upstream)
+	require.Equal(t, accesslog.ReasonForwarded, closed.Outcome.Reason)
+	require.False(t, closed.Time.Before(publisher.opened[0].Time))
+
+	// Connections rejected before forwarding are published too.
+	publisher = &recordingPublisher{}
+	conn, _ := newPipeConns()
+	h = &EventPublishingHandler{Publisher: publisher, Inner: rejectingHandler{reason: accesslog.ReasonRateLimited}}
+	h.Handle(context.Background(), conn)
+	require.Len(t, publisher.opened, 1)
+	require.Len(t, publisher.closed, 1)
+	require.Nil(t, publisher.closed[0].Outcome.ClientID)
+	require.Equal(t, accesslog.ReasonRateLimited, publisher.closed[0].Outcome.Reason)
+}
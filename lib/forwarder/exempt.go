@@ -0,0 +1,76 @@
+package forwarder
+
+import (
+	"context"
+	"tcplb/lib/core"
+	"tcplb/lib/metrics"
+)
+
+// LimitExemptions selects clients that are exempt from per-client limits,
+// e.g. health-check probes from an external monitor, or internal admin
+// tooling: the connection limits of RateLimitingHandler, and the quotas of
+// QuotaHandler. A client is exempt if it is listed in Clients, or belongs
+// to any of Groups.
+//
+// A nil *LimitExemptions exempts no client.
+//
+// Multiple goroutines may invoke methods on a LimitExemptions
+// simultaneously, provided its fields are not modified.
+type LimitExemptions struct {
+	Clients map[core.ClientID]bool
+	Groups  map[string]bool
+	// Resolver resolves the groups that clients belong to. It is required
+	// if Groups is not empty.
+	Resolver GroupResolver
+	Metrics  *ExemptionMetrics // Metrics is optional. If nil, no metrics are recorded.
+}
+
+// IsExempt reports if the client c is exempt from per-client limits.
+func (e *LimitExemptions) IsExempt(ctx context.Context, c core.ClientID) (bool, error) {
+	if e == nil {
+		return false, nil
+	}
+	if e.Clients[c] {
+		return true, nil
+	}
+	if len(e.Groups) == 0 || e.Resolver == nil {
+		return false, nil
+	}
+	groups, err := e.Resolver.ClientGroups(ctx, c)
+	if err != nil {
+		return false, err
+	}
+	for _, g := range groups {
+		if e.Groups[g] {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// ExemptionMetrics counts the connections of exempt clients that were not
+// subject to each kind of limit.
+type ExemptionMetrics struct {
+	RateLimit *metrics.Counter // RateLimit counts connections exempt from connection limits.
+	Quota     *metrics.Counter // Quota counts connections exempt from quotas.
+}
+
+// NewExemptionMetrics returns ExemptionMetrics registered in the given Registry.
+func NewExemptionMetrics(r *metrics.Registry) *ExemptionMetrics {
+	return &ExemptionMetrics{
+		RateLimit: r.Counter("limit_exemptions_rate_limit_total"),
+		Quota:     r.Counter("limit_exemptions_quota_total"),
+	}
+}
+
+func (e *LimitExemptions) recordRateLimit() {
+	if e != nil && e.Metrics != nil {
+		e.Metrics.RateLimit.Inc()
+	}
+}
+
+func (e *LimitExemptions) recordQuota() {
+	if e != nil && e.Metrics != nil {
+		e.Metrics.Quota.Inc()
+	}
+}
@@ -0,0 +1,64 @@
+package forwarder
+
+import (
+	"context"
+	"github.com/stretchr/testify/require"
+	"tcplb/lib/accesslog"
+	"tcplb/lib/core"
+	"tcplb/lib/metrics"
+	"tcplb/lib/slog"
+	"testing"
+	"time"
+)
+
+func TestLimitExemptions(t *testing.T) {
+	monitor := core.ClientID{Namespace: "test", Key: "monitor"}
+	admin := core.ClientID{Namespace: "test", Key: "admin"}
+	other := core.ClientID{Namespace: "test", Key: "other"}
+	exemptions := &LimitExemptions{
+		Clients:  map[core.ClientID]bool{monitor: true},
+		Groups:   map[string]bool{"ops": true},
+		Resolver: groupsByClient{admin: {"web", "ops"}, other: {"web"}},
+		Metrics:  NewExemptionMetrics(metrics.NewRegistry()),
+	}
+	for _, c := range []core.ClientID{monitor, admin, other} {
+		exempt, err := exemptions.IsExempt(context.Background(), c)
+		require.NoError(t, err)
+		require.Equal(t, c != other, exempt, c)
+	}
+	exempt, err := (*LimitExemptions)(nil).IsExempt(context.Background(), monitor)
+	require.NoError(t, err)
+	require.False(t, exempt)
+
+	handle := func(h Handler, c core.ClientID) accesslog.ReasonCode {
+		clientConn, _ := newPipeConns()
+		record := accesslog.NewRecord("client", time.Now())
+		h.Handle(accesslog.NewContextWithRecord(NewContextWithClientID(context.Background(), c), record), clientConn)
+		return record.Reason()
+	}
+
+	rateLimiter := &RateLimitingHandler{
+		Logger:     &slog.RecordingLogger{},
+		Reserver:   limitedReserver{err: ReservationLimitExceeded},
+		Inner:      &clientIDRecordingHandler{},
+		Exemptions: exemptions,
+	}
+	require.Equal(t, accesslog.ReasonForwarded, handle(rateLimiter, monitor))
+	require.Equal(t, accesslog.ReasonForwarded, handle(rateLimiter, admin))
+	require.Equal(t, accesslog.ReasonRateLimited, handle(rateLimiter, other))
+	require.Equal(t, int64(2), exemptions.Metrics.RateLimit.Value())
+
+	accountant := &recordingAccountant{err: QuotaExceeded}
+	quota := &QuotaHandler{
+		Logger:     &slog.RecordingLogger{},
+		Accountant: accountant,
+		Inner:      &clientIDRecordingHandler{},
+		Exemptions: exemptions,
+	}
+	require.Equal(t, accesslog.ReasonForwarded, handle(quota, monitor))
+	require.Equal(t, accesslog.ReasonQuotaExceeded, handle(quota, other))
+	require.Equal(t, int64(1), exemptions.Metrics.Quota.Value())
+	// The usage of exempt clients is still recorded.
+	_, calls := accountant.usage()
+	require.Equal(t, 1, calls)
+}
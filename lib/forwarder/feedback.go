@@ -0,0 +1,64 @@
+package forwarder
+
+import (
+	"context"
+	"io"
+	"sync"
+	"tcplb/lib/core"
+)
+
+// UpstreamFailureReporter is told when forwarding to an upstream is cut
+// short by an error on the upstream connection, e.g. because the upstream
+// reset it, so that future choices of upstream can take the failure into
+// account.
+//
+// Multiple goroutines may invoke methods on an UpstreamFailureReporter simultaneously.
+type UpstreamFailureReporter interface {
+	ReportUpstreamFailure(ctx context.Context, u core.Upstream, err error)
+}
+
+// errorRecordingConn is a DuplexConn that records the first error returned
+// by reading from or writing to the underlying connection. io.EOF is not
+// an error: it means the peer finished writing.
+type errorRecordingConn struct {
+	core.WrappedConn
+
+	mu  sync.Mutex // mu guards err
+	err error
+}
+
+func (c *errorRecordingConn) record(err error) {
+	if err == nil || err == io.EOF {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err == nil {
+		c.err = err
+	}
+}
+
+func (c *errorRecordingConn) Read(p []byte) (int, error) {
+	n, err := c.DuplexConn.Read(p)
+	c.record(err)
+	return n, err
+}
+
+func (c *errorRecordingConn) Write(p []byte) (int, error) {
+	n, err := c.DuplexConn.Write(p)
+	c.record(err)
+	return n, err
+}
+
+func (c *errorRecordingConn) CloseWrite() error {
+	err := c.DuplexConn.CloseWrite()
+	c.record(err)
+	return err
+}
+
+// Err returns the first error recorded, if any.
+func (c *errorRecordingConn) Err() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
@@ -0,0 +1,33 @@
+package forwarder
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/require"
+	"tcplb/lib/core"
+	"tcplb/lib/slog"
+	"testing"
+)
+
+func TestForwardingHandlerReportsUpstreamFailures(t *testing.T) {
+	a := core.Upstream{Network: "handler-test", Address: "a"}
+	ctx := NewContextWithClientID(context.Background(), core.ClientID{Namespace: "handler-test", Key: "anon"})
+	ctx = NewContextWithUpstreams(ctx, core.NewUpstreamSet(a))
+	reporter := &recordingFailureReporter{}
+	h := &ForwardingHandler{
+		Logger:          &slog.RecordingLogger{},
+		Dialer:          &flakyDialer{Fail: core.NewUpstreamSet(a)},
+		Forwarder:       writingForwarder{},
+		FailureReporter: reporter,
+	}
+	clientConn, _ := newPipeConns()
+	h.Handle(ctx, clientConn)
+	require.Equal(t, []core.Upstream{a}, reporter.failed)
+
+	// Forwarding errors that are not caused by the upstream are not reported.
+	reporter.failed = nil
+	h.Forwarder = stubForwarder{err: errors.New("client went away")}
+	h.Dialer = &flakyDialer{}
+	h.Handle(ctx, clientConn)
+	require.Empty(t, reporter.failed)
+}
@@ -0,0 +1,32 @@
+package forwarder
+
+import (
+	"context"
+	"tcplb/lib/accesslog"
+	"tcplb/lib/core"
+)
+
+// ConnFilterHandler is a handler that passes a connection to the Inner
+// handler only if the Filter allows its remote address, e.g. an
+// ipfilter.Filter. Other connections are recorded with the termination
+// reason "filtered", which is deliberately not a rejection reason, so
+// filtered clients are not told why.
+//
+// Unlike the Server's Filter, it may be ordered among the other stages of
+// a Chain, and the stages outside it, e.g. the access log, see the
+// connections it drops. It should wrap the handlers that do TLS work, so
+// that filtered clients are cheap.
+type ConnFilterHandler struct {
+	Filter ConnFilter
+	Inner  Handler
+}
+
+func (h *ConnFilterHandler) Handle(ctx context.Context, conn core.DuplexConn) {
+	if !h.Filter.AllowConn(conn.RemoteAddr()) {
+		accesslog.SetReason(ctx, accesslog.ReasonFiltered)
+		return
+	}
+	h.Inner.Handle(ctx, conn)
+}
+
+var _ Handler = (*ConnFilterHandler)(nil) // type check
@@ -0,0 +1,44 @@
+package forwarder
+
+import (
+	"context"
+	"github.com/stretchr/testify/require"
+	"net"
+	"tcplb/lib/accesslog"
+	"tcplb/lib/core"
+	"testing"
+)
+
+// addrFilter allows only connections from allowed.
+type addrFilter struct {
+	allowed string
+}
+
+func (f addrFilter) AllowConn(remote net.Addr) bool {
+	return remote.String() == f.allowed
+}
+
+type countingHandler struct {
+	handled int
+}
+
+func (h *countingHandler) Handle(ctx context.Context, conn core.DuplexConn) {
+	h.handled++
+}
+
+func TestConnFilterHandler(t *testing.T) {
+	client, server := newPipeConns()
+	defer client.Close()
+	defer server.Close()
+	allowed := &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 1234}
+	denied := &net.TCPAddr{IP: net.IPv4(198, 51, 100, 1), Port: 1234}
+	inner := &countingHandler{}
+	h := &ConnFilterHandler{Filter: addrFilter{allowed: allowed.String()}, Inner: inner}
+
+	require.Empty(t, handleRecordingReason(h, addrConn{DuplexConn: server, remote: allowed}))
+	require.Equal(t, 1, inner.handled)
+
+	require.Equal(t, accesslog.ReasonFiltered, handleRecordingReason(h, addrConn{DuplexConn: server, remote: denied}))
+	require.Equal(t, 1, inner.handled)
+	require.False(t, rejectionReasons[accesslog.ReasonFiltered], "filtered clients are not told why")
+}
@@ -0,0 +1,479 @@
+package forwarder
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"tcplb/lib/accesslog"
+	"tcplb/lib/core"
+	"tcplb/lib/metrics"
+	"tcplb/lib/slog"
+	"tcplb/lib/trace"
+	"time"
+)
+
+// MalformedClientHello is returned, possibly wrapped, when a ClientHello
+// cannot be parsed to compute its fingerprint, e.g. because it is
+// truncated, or spans more than one TLS record.
+var MalformedClientHello = errors.New("malformed ClientHello")
+
+// TLS extensions whose contents are part of a JA3 or JA4 fingerprint.
+const (
+	tlsExtensionServerName          = 0
+	tlsExtensionSupportedGroups     = 10
+	tlsExtensionECPointFormats      = 11
+	tlsExtensionSignatureAlgorithms = 13
+	tlsExtensionALPN                = 16
+	tlsExtensionSupportedVersions   = 43
+)
+
+// maxTLSRecordLength is the largest length of a TLS record, including the
+// expansion allowed for ciphertext.
+const maxTLSRecordLength = 16384 + 2048
+
+// isGREASE reports whether v is one of the values reserved by RFC 8701 for
+// clients to advertise at random, which are left out of fingerprints so
+// that they do not vary between connections.
+func isGREASE(v uint16) bool {
+	return v&0x0f0f == 0x0a0a && v>>8 == v&0xff
+}
+
+// helloReader reads the fields of a ClientHello, remembering if any read
+// ran past the end.
+type helloReader struct {
+	b         []byte
+	truncated bool
+}
+
+func (r *helloReader) bytes(n int) []byte {
+	if n > len(r.b) {
+		r.truncated = true
+		r.b = nil
+		return nil
+	}
+	b := r.b[:n]
+	r.b = r.b[n:]
+	return b
+}
+
+func (r *helloReader) uint8() int {
+	b := r.bytes(1)
+	if b == nil {
+		return 0
+	}
+	return int(b[0])
+}
+
+func (r *helloReader) uint16() int {
+	b := r.bytes(2)
+	if b == nil {
+		return 0
+	}
+	return int(b[0])<<8 | int(b[1])
+}
+
+// uint16s returns the list of 16 bit values of the given length in bytes,
+// without GREASE values.
+func (r *helloReader) uint16s(length int) []uint16 {
+	list := &helloReader{b: r.bytes(length)}
+	var values []uint16
+	for len(list.b) >= 2 {
+		if v := uint16(list.uint16()); !isGREASE(v) {
+			values = append(values, v)
+		}
+	}
+	return values
+}
+
+// clientHello holds the fields of a ClientHello that fingerprints are
+// computed from. GREASE values are left out.
+type clientHello struct {
+	version             uint16
+	ciphers             []uint16
+	extensions          []uint16 // extensions are the types of the extensions, in the order offered.
+	groups              []uint16
+	pointFormats        []byte
+	supportedVersions   []uint16
+	signatureAlgorithms []uint16
+	alpn                string // alpn is the first protocol offered by ALPN, if any.
+}
+
+// parseClientHello parses the ClientHello that begins record, a TLS
+// handshake record.
+func parseClientHello(record []byte) (*clientHello, error) {
+	if len(record) < sniffLength || record[0] != tlsRecordTypeHandshake || record[tlsRecordHeaderLength] != tlsHandshakeTypeClientHello {
+		return nil, MalformedClientHello
+	}
+	header := &helloReader{b: record[tlsRecordHeaderLength+1 : sniffLength]}
+	length := header.uint8()<<16 | header.uint16()
+	r := &helloReader{b: record[sniffLength:]}
+	r.b = r.bytes(length)
+
+	hello := &clientHello{version: uint16(r.uint16())}
+	r.bytes(32) // random
+	r.bytes(r.uint8())
+	hello.ciphers = r.uint16s(r.uint16())
+	r.bytes(r.uint8())
+	if len(r.b) > 0 {
+		exts := &helloReader{b: r.bytes(r.uint16())}
+		for len(exts.b) > 0 && !exts.truncated {
+			typ := uint16(exts.uint16())
+			data := &helloReader{b: exts.bytes(exts.uint16())}
+			if isGREASE(typ) {
+				continue
+			}
+			hello.extensions = append(hello.extensions, typ)
+			switch typ {
+			case tlsExtensionSupportedGroups:
+				hello.groups = data.uint16s(data.uint16())
+			case tlsExtensionECPointFormats:
+				hello.pointFormats = data.bytes(data.uint8())
+			case tlsExtensionSignatureAlgorithms:
+				hello.signatureAlgorithms = data.uint16s(data.uint16())
+			case tlsExtensionSupportedVersions:
+				hello.supportedVersions = data.uint16s(data.uint8())
+			case tlsExtensionALPN:
+				protocols := &helloReader{b: data.bytes(data.uint16())}
+				hello.alpn = string(protocols.bytes(protocols.uint8()))
+				data.truncated = data.truncated || protocols.truncated
+			}
+			r.truncated = r.truncated || data.truncated
+		}
+		r.truncated = r.truncated || exts.truncated
+	}
+	if r.truncated {
+		return nil, MalformedClientHello
+	}
+	return hello, nil
+}
+
+// JA3 returns the JA3 fingerprint of the ClientHello that begins record, a
+// TLS handshake record: the hex MD5 hash of the client's TLS version, and
+// the cipher suites, extensions, supported groups and EC point formats it
+// offers, in the order offered. Clients built with the same TLS stack and
+// settings share a fingerprint, whichever certificate they present, so
+// fingerprints help to tell apart the software of clients.
+func JA3(record []byte) (string, error) {
+	hello, err := parseClientHello(record)
+	if err != nil {
+		return "", err
+	}
+	decimal := func(values []uint16) string {
+		s := make([]string, len(values))
+		for i, v := range values {
+			s[i] = strconv.Itoa(int(v))
+		}
+		return strings.Join(s, "-")
+	}
+	pointFormats := make([]uint16, len(hello.pointFormats))
+	for i, f := range hello.pointFormats {
+		pointFormats[i] = uint16(f)
+	}
+	s := strings.Join([]string{
+		strconv.Itoa(int(hello.version)),
+		decimal(hello.ciphers),
+		decimal(hello.extensions),
+		decimal(hello.groups),
+		decimal(pointFormats),
+	}, ",")
+	sum := md5.Sum([]byte(s))
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// JA4 returns the JA4 fingerprint of the ClientHello that begins record, a
+// TLS handshake record, e.g. "t13d1516h2_8daaf6152771_e5627efa2ab1": the
+// highest TLS version offered, whether a server name is given, the numbers
+// of cipher suites and extensions, and the first ALPN protocol, followed
+// by truncated SHA-256 hashes of the sorted cipher suites, and of the
+// sorted extensions and the signature algorithms. Unlike JA3, it does not
+// vary as clients shuffle the order of their extensions.
+func JA4(record []byte) (string, error) {
+	hello, err := parseClientHello(record)
+	if err != nil {
+		return "", err
+	}
+	// Clients offering TLS 1.3 give a legacy version in the ClientHello,
+	// and the versions they support in an extension.
+	version := hello.version
+	if len(hello.supportedVersions) > 0 {
+		version = 0
+		for _, v := range hello.supportedVersions {
+			if v > version {
+				version = v
+			}
+		}
+	}
+	sni := "i"
+	var extensions []uint16
+	for _, typ := range hello.extensions {
+		switch typ {
+		case tlsExtensionServerName:
+			sni = "d"
+		case tlsExtensionALPN:
+		default:
+			extensions = append(extensions, typ)
+		}
+	}
+	a := fmt.Sprintf("t%s%s%02d%02d%s", ja4Version(version), sni, ja4Count(hello.ciphers), ja4Count(hello.extensions), ja4ALPN(hello.alpn))
+
+	b := ja4Hash(sortedHex(hello.ciphers))
+	c := sortedHex(extensions)
+	if len(hello.signatureAlgorithms) > 0 {
+		algorithms := make([]string, len(hello.signatureAlgorithms))
+		for i, v := range hello.signatureAlgorithms {
+			algorithms[i] = fmt.Sprintf("%04x", v)
+		}
+		c += "_" + strings.Join(algorithms, ",")
+	}
+	if len(extensions) == 0 {
+		c = ""
+	}
+	return a + "_" + b + "_" + ja4Hash(c), nil
+}
+
+// ja4Version returns the two characters that stand for a TLS version in a
+// JA4 fingerprint.
+func ja4Version(v uint16) string {
+	switch v {
+	case tls.VersionTLS13:
+		return "13"
+	case tls.VersionTLS12:
+		return "12"
+	case tls.VersionTLS11:
+		return "11"
+	case tls.VersionTLS10:
+		return "10"
+	case 0x0300:
+		return "s3"
+	case 0x0002:
+		return "s2"
+	default:
+		return "00"
+	}
+}
+
+// ja4ALPN returns the two characters that stand for the first ALPN
+// protocol offered in a JA4 fingerprint: its first and last characters, or
+// the first and last hex digits of the protocol if either is not
+// alphanumeric, or "00" if none is offered.
+func ja4ALPN(protocol string) string {
+	if protocol == "" {
+		return "00"
+	}
+	first, last := protocol[0], protocol[len(protocol)-1]
+	if !isAlphanumeric(first) || !isAlphanumeric(last) {
+		digits := hex.EncodeToString([]byte(protocol))
+		return digits[:1] + digits[len(digits)-1:]
+	}
+	return string([]byte{first, last})
+}
+
+func isAlphanumeric(c byte) bool {
+	return '0' <= c && c <= '9' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z'
+}
+
+// ja4Count returns the number of values, at most 99, so that it fits in
+// the two digits of a JA4 fingerprint.
+func ja4Count(values []uint16) int {
+	if len(values) > 99 {
+		return 99
+	}
+	return len(values)
+}
+
+// sortedHex returns values as 4 digit hex numbers, sorted and separated by
+// commas.
+func sortedHex(values []uint16) string {
+	s := make([]string, len(values))
+	for i, v := range values {
+		s[i] = fmt.Sprintf("%04x", v)
+	}
+	sort.Strings(s)
+	return strings.Join(s, ",")
+}
+
+// ja4Hash returns the first 12 hex digits of the SHA-256 hash of s, or
+// zeros if s is empty.
+func ja4Hash(s string) string {
+	if s == "" {
+		return "000000000000"
+	}
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])[:12]
+}
+
+// Names of the fingerprints computed by a FingerprintingHandler.
+const (
+	FingerprintJA3 = "ja3"
+	FingerprintJA4 = "ja4"
+)
+
+// FingerprintMethods lists the names of the fingerprints computed by a
+// FingerprintingHandler.
+var FingerprintMethods = []string{FingerprintJA3, FingerprintJA4}
+
+// UnknownFingerprintMethod is returned by Fingerprint for names not in
+// FingerprintMethods.
+var UnknownFingerprintMethod = errors.New("unknown TLS fingerprint method")
+
+// Fingerprint returns the fingerprint of the ClientHello that begins
+// record, computed by the method of the given name, one of
+// FingerprintMethods.
+func Fingerprint(method string, record []byte) (string, error) {
+	switch method {
+	case FingerprintJA3:
+		return JA3(record)
+	case FingerprintJA4:
+		return JA4(record)
+	default:
+		return "", fmt.Errorf("%w: %q (expected one of %v)", UnknownFingerprintMethod, method, FingerprintMethods)
+	}
+}
+
+// ja4Pattern matches JA4 fingerprints.
+var ja4Pattern = regexp.MustCompile(`^[tq](13|12|11|10|s3|s2|00)[di][0-9]{4}[0-9a-zA-Z]{2}_[0-9a-f]{12}_[0-9a-f]{12}$`)
+
+// ParseFingerprint returns s, a fingerprint computed by the method of the
+// given name, as computed by Fingerprint, e.g. with hex digits in lower
+// case, or an error if s is not such a fingerprint.
+func ParseFingerprint(method, s string) (string, error) {
+	switch method {
+	case FingerprintJA3:
+		if b, err := hex.DecodeString(s); err != nil || len(b) != md5.Size {
+			return "", fmt.Errorf("expected a JA3 fingerprint, as a hex MD5 hash, but got %q", s)
+		}
+		return strings.ToLower(s), nil
+	case FingerprintJA4:
+		if !ja4Pattern.MatchString(s) {
+			return "", fmt.Errorf("expected a JA4 fingerprint, e.g. t13d1516h2_8daaf6152771_e5627efa2ab1, but got %q", s)
+		}
+		return s, nil
+	default:
+		return "", fmt.Errorf("%w: %q (expected one of %v)", UnknownFingerprintMethod, method, FingerprintMethods)
+	}
+}
+
+// FingerprintMetrics holds the metrics recorded by a FingerprintingHandler.
+type FingerprintMetrics struct {
+	Fingerprinted *metrics.Counter // Fingerprinted counts connections whose ClientHello was fingerprinted.
+	Failed        *metrics.Counter // Failed counts connections whose ClientHello could not be read or parsed.
+	Denied        *metrics.Counter // Denied counts connections dropped because their fingerprint is denied.
+}
+
+// NewFingerprintMetrics returns FingerprintMetrics registered in the given
+// Registry.
+func NewFingerprintMetrics(r *metrics.Registry) *FingerprintMetrics {
+	return &FingerprintMetrics{
+		Fingerprinted: r.Counter("tls_fingerprinted_total"),
+		Failed:        r.Counter("tls_fingerprint_failed_total"),
+		Denied:        r.Counter("tls_fingerprint_denied_total"),
+	}
+}
+
+func (m *FingerprintMetrics) recordFingerprinted() {
+	if m == nil {
+		return
+	}
+	m.Fingerprinted.Inc()
+}
+
+func (m *FingerprintMetrics) recordFailed() {
+	if m == nil {
+		return
+	}
+	m.Failed.Inc()
+}
+
+func (m *FingerprintMetrics) recordDenied() {
+	if m == nil {
+		return
+	}
+	m.Denied.Inc()
+}
+
+// FingerprintingHandler is a handler that computes the JA3 or JA4
+// fingerprint of each client's ClientHello before its TLS handshake, records it in the
+// access log and in the context, and drops connections whose fingerprint
+// is denied, e.g. that of a scanner, or of software that should never
+// connect even with a valid certificate. Connections whose ClientHello
+// cannot be fingerprinted are passed on without a fingerprint.
+//
+// Only TLS connections accepted from a PeekListener are fingerprinted.
+// Other connections are passed to Inner unchanged.
+type FingerprintingHandler struct {
+	Logger  slog.Logger
+	Timeout time.Duration       // Timeout bounds the wait for the ClientHello. If not positive, there is no bound.
+	Method  string              // Method is one of FingerprintMethods. If empty, JA3 fingerprints are computed.
+	Denied  map[string]bool     // Denied is optional. It holds the fingerprints of clients to drop.
+	Metrics *FingerprintMetrics // Metrics is optional. If nil, no metrics are recorded.
+	Inner   Handler
+}
+
+func (h *FingerprintingHandler) Handle(ctx context.Context, conn core.DuplexConn) {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		h.Inner.Handle(ctx, conn)
+		return
+	}
+	peekConn, ok := tlsConn.NetConn().(*PeekConn)
+	if !ok {
+		h.Inner.Handle(ctx, conn)
+		return
+	}
+
+	_, span := trace.StartSpan(ctx, "fingerprint")
+	fingerprint, err := h.fingerprint(peekConn)
+	span.RecordError(err)
+	span.SetAttribute("tcplb.tls_fingerprint", fingerprint)
+	span.End()
+	if err != nil {
+		h.Metrics.recordFailed()
+		h.Logger.Debug(&slog.LogRecord{Msg: "FingerprintingHandler: ClientHello not fingerprinted", Error: err})
+		h.Inner.Handle(ctx, conn)
+		return
+	}
+	h.Metrics.recordFingerprinted()
+	accesslog.RecordFromContext(ctx).SetTLSFingerprint(fingerprint)
+	if h.Denied[fingerprint] {
+		h.Metrics.recordDenied()
+		h.Logger.Warn(&slog.LogRecord{Msg: "FingerprintingHandler: client TLS fingerprint denied", Reason: accesslog.ReasonFingerprintDenied, Details: fingerprint})
+		accesslog.SetReason(ctx, accesslog.ReasonFingerprintDenied)
+		return
+	}
+	h.Inner.Handle(core.NewContextWithTLSFingerprint(ctx, fingerprint), conn)
+}
+
+// fingerprint peeks the first TLS record of the connection, and returns
+// the fingerprint of the ClientHello it holds.
+func (h *FingerprintingHandler) fingerprint(conn *PeekConn) (string, error) {
+	if h.Timeout > 0 {
+		_ = conn.SetReadDeadline(time.Now().Add(h.Timeout))
+		defer func() { _ = conn.SetReadDeadline(time.Time{}) }()
+	}
+	header, err := conn.Peek(tlsRecordHeaderLength)
+	if err != nil {
+		return "", err
+	}
+	length := int(header[3])<<8 | int(header[4])
+	if length > maxTLSRecordLength {
+		return "", MalformedClientHello
+	}
+	record, err := conn.Peek(tlsRecordHeaderLength + length)
+	if err != nil {
+		return "", err
+	}
+	if h.Method == "" {
+		return JA3(record)
+	}
+	return Fingerprint(h.Method, record)
+}
+
+var _ Handler = (*FingerprintingHandler)(nil) // type check
@@ -0,0 +1,168 @@
+package forwarder
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"github.com/stretchr/testify/require"
+	"net"
+	"tcplb/lib/accesslog"
+	"tcplb/lib/core"
+	"tcplb/lib/metrics"
+	"tcplb/lib/slog"
+	"tcplb/lib/testbed"
+	"testing"
+	"time"
+)
+
+func TestJA3(t *testing.T) {
+	grease := []byte{0x0a, 0x0a}
+	hello := []byte{0x03, 0x03}
+	hello = append(hello, make([]byte, 32)...)                                           // random
+	hello = append(hello, 0)                                                             // session ID
+	hello = append(hello, 0, 6, grease[0], grease[1], 0x13, 0x01, 0x13, 0x02)            // cipher suites
+	hello = append(hello, 1, 0)                                                          // compression methods
+	hello = append(hello, 0, 24, grease[0], grease[1], 0, 0, 0, 0, 0, 0)                 // extensions, beginning with GREASE and an empty server name
+	hello = append(hello, 0, tlsExtensionSupportedGroups, 0, 6, 0, 4, 0x00, 0x1d, 0, 23) // supported groups
+	hello = append(hello, 0, tlsExtensionECPointFormats, 0, 2, 1, 0)                     // EC point formats
+	record := append([]byte{tlsRecordTypeHandshake, 0x03, 0x01, 0, byte(len(hello) + 4), tlsHandshakeTypeClientHello, 0, 0, byte(len(hello))}, hello...)
+
+	fingerprint, err := JA3(record)
+	require.NoError(t, err)
+	sum := md5.Sum([]byte("771,4865-4866,0-10-11,29-23,0"))
+	require.Equal(t, hex.EncodeToString(sum[:]), fingerprint)
+
+	_, err = JA3(record[:len(record)-1])
+	require.ErrorIs(t, err, MalformedClientHello)
+	_, err = JA3([]byte("GET / HTTP/1.1\r\n"))
+	require.ErrorIs(t, err, MalformedClientHello)
+}
+
+// clientHelloRecord returns a TLS record holding a ClientHello offering the
+// TLS 1.3 cipher suites, with the given extensions, each of which is its
+// type followed by its data.
+func clientHelloRecord(extensions ...[]byte) []byte {
+	hello := []byte{0x03, 0x03}
+	hello = append(hello, make([]byte, 32)...)                      // random
+	hello = append(hello, 0)                                        // session ID
+	hello = append(hello, 0, 6, 0x1a, 0x1a, 0x13, 0x01, 0x13, 0x02) // cipher suites, beginning with GREASE
+	hello = append(hello, 1, 0)                                     // compression methods
+	var exts []byte
+	for _, ext := range extensions {
+		exts = append(exts, ext[0], ext[1], 0, byte(len(ext)-2))
+		exts = append(exts, ext[2:]...)
+	}
+	hello = append(hello, 0, byte(len(exts)))
+	hello = append(hello, exts...)
+	return append([]byte{tlsRecordTypeHandshake, 0x03, 0x01, 0, byte(len(hello) + 4), tlsHandshakeTypeClientHello, 0, 0, byte(len(hello))}, hello...)
+}
+
+func TestJA4(t *testing.T) {
+	serverName := []byte{0, tlsExtensionServerName, 0, 9, 0, 0, 6, 'a', '.', 't', 'e', 's', 't'}
+	alpn := []byte{0, tlsExtensionALPN, 0, 6, 2, 'h', '2', 3, 'f', 'o', 'o'}
+	versions := []byte{0, tlsExtensionSupportedVersions, 4, 0x03, 0x04, 0x03, 0x03}
+	algorithms := []byte{0, tlsExtensionSignatureAlgorithms, 0, 4, 0x04, 0x03, 0x08, 0x04}
+	groups := []byte{0, tlsExtensionSupportedGroups, 0, 2, 0, 0x1d}
+	grease := []byte{0x2a, 0x2a}
+
+	fingerprint, err := JA4(clientHelloRecord(grease, serverName, alpn, versions, algorithms, groups))
+	require.NoError(t, err)
+	ciphers := sha256.Sum256([]byte("1301,1302"))
+	extensions := sha256.Sum256([]byte("000a,000d,002b_0403,0804"))
+	require.Equal(t, "t13d0205h2_"+hex.EncodeToString(ciphers[:])[:12]+"_"+hex.EncodeToString(extensions[:])[:12], fingerprint)
+
+	// Unlike JA3, JA4 does not depend on the order of the extensions.
+	shuffled, err := JA4(clientHelloRecord(groups, algorithms, versions, alpn, serverName))
+	require.NoError(t, err)
+	require.Equal(t, fingerprint, shuffled)
+	ja3, err := JA3(clientHelloRecord(serverName, alpn, versions, algorithms, groups))
+	require.NoError(t, err)
+	ja3Shuffled, err := JA3(clientHelloRecord(groups, algorithms, versions, alpn, serverName))
+	require.NoError(t, err)
+	require.NotEqual(t, ja3, ja3Shuffled)
+
+	// Without a server name, ALPN or extensions, and with TLS 1.2.
+	fingerprint, err = JA4(clientHelloRecord())
+	require.NoError(t, err)
+	require.Equal(t, "t12i020000_"+hex.EncodeToString(ciphers[:])[:12]+"_000000000000", fingerprint)
+
+	_, err = JA4([]byte("GET / HTTP/1.1\r\n"))
+	require.ErrorIs(t, err, MalformedClientHello)
+	_, err = Fingerprint("ja5", clientHelloRecord())
+	require.ErrorIs(t, err, UnknownFingerprintMethod)
+
+	// Fingerprints given in configuration are checked.
+	parsed, err := ParseFingerprint(FingerprintJA4, fingerprint)
+	require.NoError(t, err)
+	require.Equal(t, fingerprint, parsed)
+	parsed, err = ParseFingerprint(FingerprintJA3, "6734F37431670B3AB4292B8F60F29984")
+	require.NoError(t, err)
+	require.Equal(t, "6734f37431670b3ab4292b8f60f29984", parsed)
+	_, err = ParseFingerprint(FingerprintJA4, "6734f37431670b3ab4292b8f60f29984")
+	require.Error(t, err)
+	_, err = ParseFingerprint(FingerprintJA3, fingerprint)
+	require.Error(t, err)
+}
+
+// fingerprintRecordingHandler records the TLS fingerprint in the context,
+// then completes the TLS handshake.
+type fingerprintRecordingHandler struct {
+	fingerprint string
+}
+
+func (h *fingerprintRecordingHandler) Handle(ctx context.Context, conn core.DuplexConn) {
+	h.fingerprint, _ = core.TLSFingerprintFromContext(ctx)
+	handshakingHandler{}.Handle(ctx, conn)
+}
+
+func TestFingerprintingHandler(t *testing.T) {
+	tb := testbed.New(t)
+	serverConfig := tb.ServerTLSConfig(tb.Server(t, "tcplb.test"))
+	clientConfig := tb.ClientTLSConfig(tb.Client(t, "client"))
+	clientConfig.ServerName = "tcplb.test"
+	fingerprintMetrics := NewFingerprintMetrics(metrics.NewRegistry())
+	inner := &fingerprintRecordingHandler{}
+	h := &FingerprintingHandler{
+		Logger:  &slog.RecordingLogger{},
+		Timeout: 100 * time.Millisecond,
+		Metrics: fingerprintMetrics,
+		Inner:   inner,
+	}
+	// handshake returns the reason h records for a TLS client.
+	handshake := func() accesslog.ReasonCode {
+		client, server := net.Pipe()
+		defer client.Close()
+		defer server.Close()
+		go func() { _ = tls.Client(client, clientConfig).Handshake() }()
+		record := accesslog.NewRecord("client", time.Now())
+		h.Handle(accesslog.NewContextWithRecord(context.Background(), record), tls.Server(&PeekConn{Conn: server}, serverConfig))
+		return record.Reason()
+	}
+
+	// The ClientHello is fingerprinted, then replayed to the TLS server.
+	require.Equal(t, accesslog.ReasonForwarded, handshake())
+	require.Len(t, inner.fingerprint, 32)
+	require.Equal(t, int64(1), fingerprintMetrics.Fingerprinted.Value())
+
+	// Clients with the same TLS settings have the same fingerprint, and are
+	// dropped if it is denied.
+	fingerprint := inner.fingerprint
+	h.Denied = map[string]bool{fingerprint: true}
+	inner.fingerprint = ""
+	require.Equal(t, accesslog.ReasonFingerprintDenied, handshake())
+	require.Empty(t, inner.fingerprint)
+	require.Equal(t, int64(1), fingerprintMetrics.Denied.Value())
+
+	// JA4 fingerprints may be computed instead.
+	h.Denied = nil
+	h.Method = FingerprintJA4
+	require.Equal(t, accesslog.ReasonForwarded, handshake())
+	require.Regexp(t, `^t13d\d{4}00_[0-9a-f]{12}_[0-9a-f]{12}$`, inner.fingerprint)
+
+	// Connections that were not accepted from a PeekListener are passed on.
+	clientConn, _ := newPipeConns()
+	h.Inner = &clientIDRecordingHandler{}
+	require.Equal(t, accesslog.ReasonForwarded, handleRecordingReason(h, clientConn))
+}
@@ -2,42 +2,240 @@ package forwarder
 
 import (
 	"context"
+	"fmt"
 	"io"
 	"sync"
+	"sync/atomic"
+	"tcplb/lib/accesslog"
+	"tcplb/lib/conntable"
+	"tcplb/lib/core"
 	"tcplb/lib/errors"
+	"time"
 )
 
-// MediocreForwarder is a implementation of the Forward operation.
-// This is a placeholder implementation that lacks robustness.
-type MediocreForwarder struct{}
+// countingWriter is an io.Writer that reports the number of bytes
+// written to it as they are written.
+type countingWriter struct {
+	w     io.Writer
+	count func(n int64)
+}
+
+func (c countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.count(int64(n))
+	return n, err
+}
 
-func (f MediocreForwarder) Forward(ctx context.Context, clientConn, upstreamConn DuplexConn) error {
+// MediocreForwarder implements the Forward operation by copying data in
+// both directions between the client and upstream connections. It bounds
+// how long a connection may be idle, be forwarded, and stay half-open,
+// propagates upstream resets to the client, deals with slow consumers, and
+// schedules the bandwidth of data sent by clients.
+//
+// If IdleTimeout or MaxDuration are positive, forwarding stops with an
+// error wrapping IdleTimeoutExceeded or MaxDurationExceeded once the
+// connection times out. Data copied in either direction counts as progress
+// towards the idle timeout, so that a connection where one party is silent
+// while the other is busy is not idle.
+//
+// If the upstream resets the connection, forwarding stops at once with an
+// error wrapping UpstreamReset, and the client connection is reset, if it
+// is a TCP connection. If the upstream merely stops reading, e.g. as it
+// closes the connection after sending an error response, the response is
+// still forwarded to the client.
+//
+// Once copying in one direction finishes, e.g. as one party closes its end
+// for writing, copying in the other direction must finish within the
+// half-open timeout, or forwarding stops with an error wrapping
+// HalfOpenTimeoutExceeded. The half-open timeout is that of the Pool the
+// connection has been routed to, if any, or else HalfOpenTimeout.
+//
+// If SlowConsumer.WriteTimeout is positive, a peer whose writes block for
+// that long, while the other peer has more to send, is a slow consumer, and
+// is dealt with by SlowConsumer.Policy. Forwarding may then stop with an
+// error wrapping SlowConsumerExceeded.
+//
+// If Bandwidth is set, each write of data from the client to the upstream
+// waits for Bandwidth to schedule it, and gives up once forwarding stops.
+type MediocreForwarder struct {
+	IdleTimeout     time.Duration      // IdleTimeout bounds the time without data copied in either direction. If not positive, there is no bound.
+	MaxDuration     time.Duration      // MaxDuration bounds the time spent forwarding. If not positive, there is no bound.
+	HalfOpenTimeout time.Duration      // HalfOpenTimeout bounds the time spent forwarding in one direction after the other has finished, for connections not routed to a Pool. If not positive, there is no bound.
+	SlowConsumer    SlowConsumerConfig // SlowConsumer configures how peers that do not take data as fast as it is sent are handled.
+	Bandwidth       BandwidthScheduler // Bandwidth is optional. If set, data from clients is sent to upstreams only as fast as it allows.
+	Deadlines       *DeadlineManager   // Deadlines is optional. If nil, timeouts are enforced by a DeadlineManager shared by all Forwarders.
+}
+
+// halfOpenTimeout returns the half-open timeout of connections forwarded
+// with ctx.
+func (f MediocreForwarder) halfOpenTimeout(ctx context.Context) time.Duration {
+	if pool, ok := PoolFromContext(ctx); ok {
+		return pool.HalfOpenTimeout
+	}
+	return f.HalfOpenTimeout
+}
+
+func (f MediocreForwarder) Forward(ctx context.Context, clientConn, upstreamConn core.DuplexConn) error {
 	// Caller is responsible for closing both DuplexConns, not us.
 	out := make(chan error, 4)
 	wg := sync.WaitGroup{}
+	record := accesslog.RecordFromContext(ctx)
+	entry := conntable.EntryFromContext(ctx)
+
+	// Forwarding is stopped by closing the transports beneath both
+	// connections, rather than by expiring their deadlines: a *tls.Conn
+	// whose write times out is corrupt, and closing it would block while
+	// writing a close_notify alert.
+	var stopErr error
+	var stopOnce sync.Once
+	// Writes waiting for bandwidth give up once forwarding stops.
+	scheduleCtx, cancelSchedule := context.WithCancel(ctx)
+	defer cancelSchedule()
+	stop := func(err error) {
+		stopOnce.Do(func() {
+			stopErr = err
+			cancelSchedule()
+			_ = core.TransportConn(clientConn).Close()
+			_ = core.TransportConn(upstreamConn).Close()
+		})
+	}
 
-	copy := func(dst, src DuplexConn, out chan<- error) {
+	var progress func(n int64)
+	if f.IdleTimeout > 0 || f.MaxDuration > 0 {
+		deadlines := f.Deadlines
+		if deadlines == nil {
+			deadlines = defaultDeadlineManager()
+		}
+		w := deadlines.watch(f.IdleTimeout, f.MaxDuration, stop)
+		defer w.Stop()
+		progress = w.Progress
+	}
+	countFromClient := func(n int64) {
+		record.AddBytesFromClient(n)
+		entry.AddBytesFromClient(n)
+		if progress != nil {
+			progress(n)
+		}
+	}
+	countToClient := func(n int64) {
+		record.AddBytesToClient(n)
+		entry.AddBytesToClient(n)
+		if progress != nil {
+			progress(n)
+		}
+	}
+
+	// Once both directions have finished copying, forwarding is over, and
+	// stop must not override why, e.g. as the half-open timer fires late.
+	copying := int32(2) // copying is the number of directions still copying, accessed atomically.
+	finishCopying := func() {
+		if atomic.AddInt32(&copying, -1) == 0 {
+			stopOnce.Do(func() {})
+		}
+	}
+
+	// Once the first direction finishes, bound the time left for the
+	// other, so that a peer cannot hold the connection half-open forever.
+	var halfOpenTimer *time.Timer
+	var halfOpenOnce sync.Once
+	halfOpenTimeout := f.halfOpenTimeout(ctx)
+	halfClosed := func() {
+		if halfOpenTimeout <= 0 || atomic.LoadInt32(&copying) == 0 {
+			return
+		}
+		halfOpenOnce.Do(func() {
+			halfOpenTimer = time.AfterFunc(halfOpenTimeout, func() { stop(HalfOpenTimeoutExceeded) })
+		})
+	}
+
+	// If the upstream resets the connection, the client's session is over,
+	// even if the client is waiting for data rather than sending it. Reset
+	// the client at once, so that it does not mistake the cut for an
+	// orderly finish. A failed write to the upstream is not a reset: what
+	// the upstream sent before it closed is still on its way to the client.
+	abort := func(err error) {
+		resetOnClose(clientConn)
+		stop(err)
+	}
+
+	// A slow consumer is dealt with in the copy that writes to it.
+	slowConsumer := func(dst string) error {
+		f.SlowConsumer.Metrics.recordTerminated()
+		return fmt.Errorf("%w: %s did not take data within %s", SlowConsumerExceeded, dst, f.SlowConsumer.WriteTimeout)
+	}
+
+	copy := func(dst, src core.DuplexConn, out chan<- error, countBytes func(n int64), fromUpstream bool) {
 		defer wg.Done()
-		// TODO FIXME add an idle timeout here that detects if neither
-		// of the two directions of copying have made any progress in
-		// some time window.
-		// TODO FIXME also honour cancellation by ctx
-		_, err := io.Copy(dst, src)
+		var w io.Writer = dst
+		var r io.Reader = src
+		if timeout := f.SlowConsumer.WriteTimeout; timeout > 0 {
+			name := "upstream"
+			if fromUpstream {
+				name = "client"
+			}
+			onSlow := func() {}
+			switch f.SlowConsumer.Policy {
+			case SlowConsumerTerminate:
+				onSlow = func() { stop(slowConsumer(name)) }
+			case SlowConsumerBuffer:
+				ahead := newReadAhead(src, f.SlowConsumer.BufferSize, func() { stop(slowConsumer(name)) })
+				defer ahead.Close()
+				r = ahead
+				onSlow = ahead.start
+			}
+			sw := newSlowWriter(dst, timeout, f.SlowConsumer.Metrics, onSlow)
+			defer sw.Stop()
+			w = sw
+		}
+		if f.Bandwidth != nil && !fromUpstream {
+			clientID, _ := ClientIDFromContext(ctx)
+			w = &scheduledWriter{ctx: scheduleCtx, w: w, scheduler: f.Bandwidth, client: clientID}
+		}
+		// Count bytes as they are copied, not afterwards, so that
+		// progress of long-lived connections can be observed, and so
+		// that the idle timeout sees progress in both directions.
+		reader := &errorRecordingReader{r: r}
+		_, err := io.Copy(countingWriter{w: w, count: countBytes}, reader)
+		switch {
+		case err == nil:
+		case fromUpstream && reader.failed && isReset(err):
+			abort(fmt.Errorf("%w: %v", UpstreamReset, err))
+		}
+		finishCopying()
 		cwErr := dst.CloseWrite() // Inform peer at dst end that we're done writing.
+		halfClosed()
 		out <- err
 		out <- cwErr
 	}
 
+	// If ctx is cancelled, unblock both copies.
+	stopWatching := make(chan struct{})
+	defer close(stopWatching)
+	go func() {
+		select {
+		case <-ctx.Done():
+			stop(ctx.Err())
+		case <-stopWatching:
+		}
+	}()
+
 	wg.Add(1)
-	go copy(upstreamConn, clientConn, out)
+	go copy(upstreamConn, clientConn, out, countFromClient, false)
 	wg.Add(1)
-	go copy(clientConn, upstreamConn, out)
+	go copy(clientConn, upstreamConn, out, countToClient, true)
 
 	// Note that if upstream and client keep talking to each other without ever
 	// closing their connection, we may block here forever, while one or both
 	// goroutines copy application data. This is a feature, as this server is
 	// doing useful work.
 	wg.Wait()
+	if halfOpenTimer != nil {
+		halfOpenTimer.Stop()
+	}
+	if stopErr != nil {
+		// Report why forwarding was stopped rather than the resulting errors.
+		return stopErr
+	}
 	close(out)
 
 	return errors.AggregateErrorFromChannel(out)
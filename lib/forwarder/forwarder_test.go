@@ -0,0 +1,97 @@
+package forwarder
+
+import (
+	"context"
+	"github.com/stretchr/testify/require"
+	"io"
+	"tcplb/lib/core"
+	"testing"
+	"time"
+)
+
+func TestMediocreForwarderHonoursCancellation(t *testing.T) {
+	client, _ := newPipeConns()
+	upstream, _ := newPipeConns()
+	ctx, cancel := context.WithCancel(context.Background())
+
+	result := make(chan error, 1)
+	go func() {
+		result <- MediocreForwarder{}.Forward(ctx, client, upstream)
+	}()
+
+	// Neither peer sends or closes anything, so only cancellation can end Forward.
+	cancel()
+	select {
+	case err := <-result:
+		require.ErrorIs(t, err, context.Canceled)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Forward did not return after ctx was cancelled")
+	}
+}
+
+func TestMediocreForwarderTimeouts(t *testing.T) {
+	deadlines := NewDeadlineManager(5 * time.Millisecond)
+	defer deadlines.Start()()
+
+	forward := func(f MediocreForwarder, talk func(client, upstream core.DuplexConn)) error {
+		client, clientPeer := newPipeConns()
+		upstream, upstreamPeer := newPipeConns()
+		go talk(clientPeer, upstreamPeer)
+		result := make(chan error, 1)
+		go func() {
+			result <- f.Forward(context.Background(), client, upstream)
+		}()
+		select {
+		case err := <-result:
+			return err
+		case <-time.After(5 * time.Second):
+			t.Fatal("Forward did not time out")
+			return nil
+		}
+	}
+	silent := func(client, upstream core.DuplexConn) {}
+	err := forward(MediocreForwarder{IdleTimeout: 20 * time.Millisecond, Deadlines: deadlines}, silent)
+	require.ErrorIs(t, err, IdleTimeoutExceeded)
+
+	// The client talks, while the upstream listens, for longer than the
+	// idle timeout.
+	chatty := func(client, upstream core.DuplexConn) {
+		go func() { _, _ = io.Copy(io.Discard, upstream) }()
+		for {
+			if _, err := client.Write([]byte("x")); err != nil {
+				return
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+	err = forward(MediocreForwarder{IdleTimeout: 20 * time.Millisecond, MaxDuration: 100 * time.Millisecond, Deadlines: deadlines}, chatty)
+	require.ErrorIs(t, err, MaxDurationExceeded)
+}
+
+func TestMediocreForwarderHalfOpenTimeout(t *testing.T) {
+	forward := func(ctx context.Context, f MediocreForwarder) error {
+		client, clientPeer := newPipeConns()
+		upstream, _ := newPipeConns()
+		// The client finishes sending, while the upstream never responds
+		// nor closes its end.
+		_ = clientPeer.Close()
+		result := make(chan error, 1)
+		go func() {
+			result <- f.Forward(ctx, client, upstream)
+		}()
+		select {
+		case err := <-result:
+			return err
+		case <-time.After(5 * time.Second):
+			t.Fatal("Forward did not time out")
+			return nil
+		}
+	}
+	err := forward(context.Background(), MediocreForwarder{HalfOpenTimeout: 20 * time.Millisecond})
+	require.ErrorIs(t, err, HalfOpenTimeoutExceeded)
+
+	// The timeout of the pool the connection is routed to applies instead.
+	ctx := NewContextWithPool(context.Background(), &Pool{Name: "web", HalfOpenTimeout: 20 * time.Millisecond})
+	err = forward(ctx, MediocreForwarder{HalfOpenTimeout: time.Hour})
+	require.ErrorIs(t, err, HalfOpenTimeoutExceeded)
+}
@@ -0,0 +1,53 @@
+package forwarder
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"tcplb/lib/accesslog"
+	"tcplb/lib/core"
+	"tcplb/lib/geoip"
+	"tcplb/lib/slog"
+	"tcplb/lib/trace"
+)
+
+// GeoIPHandler is a handler that looks up the Location of the client's IP
+// address, records it in the access log, and rejects the connection if the
+// Policy does not allow clients from there. Otherwise the Location is
+// stored in the child context passed to the Inner handler, where it can be
+// extracted with geoip.LocationFromContext, e.g. by an Authorizer.
+//
+// It should wrap the handlers that do TLS work, so that rejected clients
+// are cheap. If the Location cannot be looked up, the Policy is applied to
+// the zero Location.
+type GeoIPHandler struct {
+	Logger  slog.Logger
+	Locator geoip.Locator
+	Policy  geoip.Policy
+	Inner   Handler
+}
+
+func (h *GeoIPHandler) Handle(ctx context.Context, conn core.DuplexConn) {
+	var loc geoip.Location
+	if remote, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		_, span := trace.StartSpan(ctx, "geoip")
+		var err error
+		loc, err = h.Locator.Locate(remote.AddrPort().Addr())
+		if err != nil {
+			h.Logger.Error(&slog.LogRecord{Msg: "GeoIPHandler: Locate error", Details: remote.String(), Error: err})
+		}
+		span.RecordError(err)
+		span.SetAttribute("tcplb.geo.country", loc.Country)
+		span.SetAttribute("tcplb.geo.asn", fmt.Sprint(loc.ASN))
+		span.End()
+	}
+	accesslog.RecordFromContext(ctx).SetLocation(loc.Country, loc.ASN)
+	if !h.Policy.Allowed(loc) {
+		h.Logger.Warn(&slog.LogRecord{Msg: "GeoIPHandler: client location not allowed", Reason: accesslog.ReasonGeoDenied, Details: loc})
+		accesslog.SetReason(ctx, accesslog.ReasonGeoDenied)
+		return
+	}
+	h.Inner.Handle(geoip.NewContextWithLocation(ctx, loc), conn)
+}
+
+var _ Handler = (*GeoIPHandler)(nil) // type check
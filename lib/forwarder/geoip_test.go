@@ -0,0 +1,63 @@
+package forwarder
+
+import (
+	"context"
+	"github.com/stretchr/testify/require"
+	"net"
+	"net/netip"
+	"tcplb/lib/accesslog"
+	"tcplb/lib/core"
+	"tcplb/lib/geoip"
+	"tcplb/lib/slog"
+	"testing"
+	"time"
+)
+
+type stubLocator struct {
+	loc geoip.Location
+}
+
+func (l stubLocator) Locate(addr netip.Addr) (geoip.Location, error) {
+	return l.loc, nil
+}
+
+// locationRecordingHandler records the Location in its context.
+type locationRecordingHandler struct {
+	loc geoip.Location
+	ok  bool
+}
+
+func (h *locationRecordingHandler) Handle(ctx context.Context, conn core.DuplexConn) {
+	h.loc, h.ok = geoip.LocationFromContext(ctx)
+}
+
+func TestGeoIPHandler(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+	client, err := net.Dial("tcp", listener.Addr().String())
+	require.NoError(t, err)
+	defer client.Close()
+	accepted, err := listener.Accept()
+	require.NoError(t, err)
+	defer accepted.Close()
+	conn := accepted.(*net.TCPConn)
+
+	nz := geoip.Location{Country: "NZ", ASN: 64500}
+	inner := &locationRecordingHandler{}
+	h := &GeoIPHandler{
+		Logger:  &slog.RecordingLogger{},
+		Locator: stubLocator{loc: nz},
+		Policy:  geoip.Policy{AllowCountries: []string{"NZ"}},
+		Inner:   inner,
+	}
+	record := accesslog.NewRecord("client", time.Now())
+	h.Handle(accesslog.NewContextWithRecord(context.Background(), record), conn)
+	require.True(t, inner.ok)
+	require.Equal(t, nz, inner.loc)
+
+	h.Policy = geoip.Policy{DenyASNs: []uint32{64500}}
+	inner.ok = false
+	require.Equal(t, accesslog.ReasonGeoDenied, handleRecordingReason(h, conn))
+	require.False(t, inner.ok)
+}
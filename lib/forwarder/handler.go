@@ -3,10 +3,15 @@ package forwarder
 import (
 	"context"
 	"crypto/tls"
+	"errors"
+	"tcplb/lib/accesslog"
 	"tcplb/lib/authn"
+	"tcplb/lib/clock"
+	"tcplb/lib/conntable"
 	"tcplb/lib/core"
-	"tcplb/lib/limiter"
 	"tcplb/lib/slog"
+	"tcplb/lib/trace"
+	"time"
 )
 
 type clientIdContextKeyType struct{}
@@ -35,7 +40,7 @@ func UpstreamsFromContext(ctx context.Context) (core.UpstreamSet, bool) {
 
 type Handler interface {
 	// Handle accepts the given AuthenticatedConn from the client.
-	Handle(ctx context.Context, conn DuplexConn)
+	Handle(ctx context.Context, conn core.DuplexConn)
 }
 
 // ConnCloserHandler is a handler that closes the client connection
@@ -45,7 +50,7 @@ type ConnCloserHandler struct {
 	Inner Handler
 }
 
-func (h *ConnCloserHandler) Handle(ctx context.Context, conn DuplexConn) {
+func (h *ConnCloserHandler) Handle(ctx context.Context, conn core.DuplexConn) {
 	defer func() {
 		// If there are errors closing the client connection, it is
 		// likely due to client or network. Ignore them.
@@ -56,35 +61,153 @@ func (h *ConnCloserHandler) Handle(ctx context.Context, conn DuplexConn) {
 
 var _ Handler = (*ConnCloserHandler)(nil) // type check
 
+// AccessLogHandler is a handler that writes an access log record for
+// each client connection once the Inner handler has finished handling it.
+// Inner handlers record details of the connection by updating the
+// accesslog.Record stored in the context.
+type AccessLogHandler struct {
+	AccessLogger accesslog.Logger
+	Inner        Handler
+}
+
+func (h *AccessLogHandler) Handle(ctx context.Context, conn core.DuplexConn) {
+	record := accesslog.NewRecord(conn.RemoteAddr().String(), time.Now())
+	if info, ok := ConnInfoFromContext(ctx); ok {
+		var options []string
+		if info.TCP != nil {
+			options = info.TCP.Options
+		}
+		record.SetSocket(info.LocalAddr, options)
+	}
+	defer h.AccessLogger.Log(record)
+	h.Inner.Handle(accesslog.NewContextWithRecord(ctx, record), conn)
+}
+
+var _ Handler = (*AccessLogHandler)(nil) // type check
+
+// ConnTableHandler is a handler that registers each client connection in
+// a conntable.Table while the Inner handler is handling it. Inner handlers
+// record details of the connection by updating the conntable.Entry stored
+// in the context.
+//
+// If an operator terminates the connection via the Table, the client
+// connection is closed, which causes the Inner handler to stop. If an
+// operator evicts the client, or the server drains the connection, the
+// connection is closed for writing, so that the client sees the end of the
+// stream, e.g. a TLS close_notify alert, and is closed once the grace
+// period passes, so that data in flight from the client may still be
+// forwarded.
+type ConnTableHandler struct {
+	Table  *conntable.Table
+	Logger slog.Logger // Logger is optional. If set, evictions are logged.
+	Clock  clock.Clock // Clock is optional. If nil, the Real clock is used.
+	Inner  Handler
+}
+
+func (h *ConnTableHandler) Handle(ctx context.Context, conn core.DuplexConn) {
+	terminate := func() {
+		accesslog.SetReason(ctx, accesslog.ReasonTerminated)
+		_ = conn.Close()
+	}
+	entry := h.Table.Register(conn.RemoteAddr().String(), time.Now(), terminate)
+	defer h.Table.Remove(entry)
+	closeGracefully := func(msg string, reason accesslog.ReasonCode, grace time.Duration) {
+		accesslog.SetReason(ctx, reason)
+		if h.Logger != nil {
+			info := entry.Info()
+			h.Logger.Info(&slog.LogRecord{Msg: msg, Reason: reason, ClientID: info.ClientID, Upstream: info.Upstream, Details: grace.String()})
+		}
+		_ = conn.CloseWrite()
+		clock.Or(h.Clock).AfterFunc(grace, func() { _ = conn.Close() })
+	}
+	entry.SetEvict(func(grace time.Duration) {
+		closeGracefully("ConnTableHandler: evicting client connection", accesslog.ReasonAdminEvicted, grace)
+	})
+	entry.SetDrain(func(grace time.Duration) {
+		closeGracefully("ConnTableHandler: draining idle client connection", accesslog.ReasonDrained, grace)
+	})
+	h.Inner.Handle(conntable.NewContextWithEntry(ctx, entry), conn)
+}
+
+var _ Handler = (*ConnTableHandler)(nil) // type check
+
 type AnonymousAuthenticationHandler struct {
 	Logger    slog.Logger
 	Anonymous core.ClientID
 	Inner     Handler
 }
 
-func (h *AnonymousAuthenticationHandler) Handle(ctx context.Context, conn DuplexConn) {
+func (h *AnonymousAuthenticationHandler) Handle(ctx context.Context, conn core.DuplexConn) {
+	_, span := trace.StartSpan(ctx, "authn")
 	h.Logger.Warn(&slog.LogRecord{Msg: "AnonymousAuthenticationHandler: using insecure anonymous client connection"})
+	span.SetAttribute("tcplb.client_id", h.Anonymous.Key)
+	span.End()
+	accesslog.RecordFromContext(ctx).SetClientID(h.Anonymous)
+	conntable.EntryFromContext(ctx).SetClientID(h.Anonymous)
+	ObserverFromContext(ctx).OnAuthenticated(ctx, AuthenticatedEvent{ConnID: ConnIDFromContext(ctx), ClientID: h.Anonymous})
 	h.Inner.Handle(NewContextWithClientID(ctx, h.Anonymous), conn)
 }
 
 var _ Handler = (*AnonymousAuthenticationHandler)(nil) // type check
 
+// MTLSAuthenticationHandler identifies the client by the certificate it
+// presented during the TLS handshake, completing the handshake first if
+// need be.
 type MTLSAuthenticationHandler struct {
 	Logger slog.Logger
 	Inner  Handler
+
+	// Unauthenticated is optional. If set, clients that present no
+	// certificate are identified as Unauthenticated, instead of failing
+	// authentication, e.g. authn.Unauthenticated. The TLS config must then
+	// verify client certificates only if given, so that clients that do
+	// present one are still authenticated by it.
+	Unauthenticated *core.ClientID
 }
 
-func (h *MTLSAuthenticationHandler) Handle(ctx context.Context, conn DuplexConn) {
+func (h *MTLSAuthenticationHandler) Handle(ctx context.Context, conn core.DuplexConn) {
+	spanCtx, span := trace.StartSpan(ctx, "authn")
 	tlsConn, ok := conn.(*tls.Conn)
 	if !ok {
-		h.Logger.Error(&slog.LogRecord{Msg: "MTLSAuthenticationHandler: client connection is not using TLS"})
+		h.Logger.Error(&slog.LogRecord{Msg: "MTLSAuthenticationHandler: client connection is not using TLS", Reason: accesslog.ReasonAuthnFailed})
+		accesslog.SetReason(ctx, accesslog.ReasonAuthnFailed)
+		ObserverFromContext(ctx).OnAuthenticated(ctx, AuthenticatedEvent{ConnID: ConnIDFromContext(ctx), Err: core.ConnectionTypeUnsupported})
+		span.RecordError(core.ConnectionTypeUnsupported)
+		span.End()
 		return
 	}
-	clientID, err := authn.ExtractCanonicalClientID(tlsConn.ConnectionState().VerifiedChains)
+	if !tlsConn.ConnectionState().HandshakeComplete {
+		if err := tlsConn.HandshakeContext(spanCtx); err != nil {
+			h.Logger.Warn(&slog.LogRecord{Msg: "MTLSAuthenticationHandler: handshake failed", Reason: accesslog.ReasonAuthnFailed, Error: err})
+			record := accesslog.RecordFromContext(ctx)
+			record.SetHandshakeError(ClassifyHandshakeError(err))
+			record.SetReason(accesslog.ReasonAuthnFailed)
+			ObserverFromContext(ctx).OnAuthenticated(ctx, AuthenticatedEvent{ConnID: ConnIDFromContext(ctx), Err: err})
+			span.RecordError(err)
+			span.End()
+			return
+		}
+	}
+	state := tlsConn.ConnectionState()
+	accesslog.RecordFromContext(ctx).SetSNI(state.ServerName)
+	clientID, err := authn.ExtractCanonicalClientID(state.VerifiedChains)
+	if h.Unauthenticated != nil && len(state.PeerCertificates) == 0 {
+		clientID, err = *h.Unauthenticated, nil
+		span.SetAttribute("tcplb.unauthenticated", "true")
+	}
 	if err != nil {
-		h.Logger.Error(&slog.LogRecord{Msg: "MTLSAuthenticationHandler: failed to extract ClientID", Error: err})
+		h.Logger.Error(&slog.LogRecord{Msg: "MTLSAuthenticationHandler: failed to extract ClientID", Reason: accesslog.ReasonAuthnFailed, Error: err})
+		accesslog.SetReason(ctx, accesslog.ReasonAuthnFailed)
+		ObserverFromContext(ctx).OnAuthenticated(ctx, AuthenticatedEvent{ConnID: ConnIDFromContext(ctx), Err: err})
+		span.RecordError(err)
+		span.End()
 		return
 	}
+	span.SetAttribute("tcplb.client_id", clientID.Key)
+	span.End()
+	accesslog.RecordFromContext(ctx).SetClientID(clientID)
+	conntable.EntryFromContext(ctx).SetClientID(clientID)
+	ObserverFromContext(ctx).OnAuthenticated(ctx, AuthenticatedEvent{ConnID: ConnIDFromContext(ctx), ClientID: clientID})
 	h.Inner.Handle(NewContextWithClientID(ctx, clientID), conn)
 }
 
@@ -97,24 +220,60 @@ type RateLimitingHandler struct {
 	Logger   slog.Logger
 	Reserver ClientReserver
 	Inner    Handler
+
+	// RenewInterval is optional. If positive, and Reserver is a
+	// ReservationRenewer, the reservation is renewed once per RenewInterval
+	// while the Inner handler runs.
+	RenewInterval time.Duration
+
+	// Exemptions is optional. Connections of exempt clients are passed to
+	// the Inner handler without a reservation.
+	Exemptions *LimitExemptions
+
+	// Clock is optional. If nil, the system clock is used.
+	Clock clock.Clock
 }
 
-func (h *RateLimitingHandler) Handle(ctx context.Context, conn DuplexConn) {
+func (h *RateLimitingHandler) Handle(ctx context.Context, conn core.DuplexConn) {
 	clientID, ok := ClientIDFromContext(ctx)
 	if !ok {
-		h.Logger.Error(&slog.LogRecord{Msg: "RateLimitingHandler: Failed to get ClientID from context"})
+		h.Logger.Error(&slog.LogRecord{Msg: "RateLimitingHandler: Failed to get ClientID from context", Reason: accesslog.ReasonInternalError})
+		accesslog.SetReason(ctx, accesslog.ReasonInternalError)
 		return
 	}
 
-	// Clients are subject to rate-limiting.
-	err := h.Reserver.TryReserve(ctx, clientID)
+	// Clients are subject to rate-limiting, unless exempt.
+	_, span := trace.StartSpan(ctx, "ratelimit")
+	exempt, err := h.Exemptions.IsExempt(ctx, clientID)
 	if err != nil {
-		switch err {
-		// TODO: refactor to break dep on package lib/limiter
-		case limiter.MaxReservationsExceeded:
-			h.Logger.Warn(&slog.LogRecord{Msg: "RateLimitingHandler: Client rate limited", ClientID: &clientID})
+		span.RecordError(err)
+		span.End()
+		h.Logger.Error(&slog.LogRecord{Msg: "RateLimitingHandler: IsExempt error", Reason: accesslog.ReasonInternalError, ClientID: &clientID, Error: err})
+		accesslog.SetReason(ctx, accesslog.ReasonInternalError)
+		return
+	}
+	if exempt {
+		span.SetAttribute("tcplb.limit_exempt", "true")
+		span.End()
+		h.Exemptions.recordRateLimit()
+		h.Logger.Info(&slog.LogRecord{Msg: "RateLimitingHandler: Client exempt from connection limits", ClientID: &clientID})
+		h.Inner.Handle(ctx, conn)
+		return
+	}
+	err = h.Reserver.TryReserve(ctx, clientID)
+	span.RecordError(err)
+	span.End()
+	if err != nil {
+		switch {
+		case errors.Is(err, ReservationLimitExceeded):
+			h.Logger.Warn(&slog.LogRecord{Msg: "RateLimitingHandler: Client rate limited", Reason: accesslog.ReasonRateLimited, ClientID: &clientID})
+			accesslog.SetReason(ctx, accesslog.ReasonRateLimited)
+		case errors.Is(err, ReserverOverloaded):
+			h.Logger.Warn(&slog.LogRecord{Msg: "RateLimitingHandler: Reserver overloaded", Reason: accesslog.ReasonReserverOverloaded, ClientID: &clientID})
+			accesslog.SetReason(ctx, accesslog.ReasonReserverOverloaded)
 		default:
-			h.Logger.Error(&slog.LogRecord{Msg: "RateLimitingHandler: TryReserve error", ClientID: &clientID, Error: err})
+			h.Logger.Error(&slog.LogRecord{Msg: "RateLimitingHandler: TryReserve error", Reason: accesslog.ReasonInternalError, ClientID: &clientID, Error: err})
+			accesslog.SetReason(ctx, accesslog.ReasonInternalError)
 		}
 		return
 	}
@@ -125,9 +284,39 @@ func (h *RateLimitingHandler) Handle(ctx context.Context, conn DuplexConn) {
 		}
 	}()
 
+	if renewer, ok := h.Reserver.(ReservationRenewer); ok && h.RenewInterval > 0 {
+		stop := make(chan struct{})
+		renewed := make(chan struct{})
+		go func() {
+			defer close(renewed)
+			h.renew(ctx, renewer, clientID, stop)
+		}()
+		defer func() {
+			close(stop)
+			<-renewed
+		}()
+	}
+
 	h.Inner.Handle(ctx, conn)
 }
 
+// renew renews the reservation of clientID once per RenewInterval until
+// stop is closed.
+func (h *RateLimitingHandler) renew(ctx context.Context, renewer ReservationRenewer, clientID core.ClientID, stop <-chan struct{}) {
+	ticker := clock.Or(h.Clock).NewTicker(h.RenewInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C():
+			if err := renewer.RenewReservation(ctx, clientID); err != nil {
+				h.Logger.Error(&slog.LogRecord{Msg: "RateLimitingHandler: RenewReservation error", ClientID: &clientID, Error: err})
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
 var _ Handler = (*RateLimitingHandler)(nil) // type check
 
 // AuthorizedUpstreamsHandler is a handler that determines which upstreams
@@ -138,26 +327,56 @@ var _ Handler = (*RateLimitingHandler)(nil) // type check
 type AuthorizedUpstreamsHandler struct {
 	Logger     slog.Logger
 	Authorizer Authorizer
-	Inner      Handler
+	// Denied is optional. If set, it bounds the connections of clients
+	// that are not authorized for any upstream.
+	Denied *DeniedClientLimiter
+	Inner  Handler
 }
 
-func (h *AuthorizedUpstreamsHandler) Handle(ctx context.Context, conn DuplexConn) {
+func (h *AuthorizedUpstreamsHandler) Handle(ctx context.Context, conn core.DuplexConn) {
 	clientID, ok := ClientIDFromContext(ctx)
 	if !ok {
-		h.Logger.Error(&slog.LogRecord{Msg: "AuthorizedUpstreamsHandler: Failed to get ClientID from context"})
+		h.Logger.Error(&slog.LogRecord{Msg: "AuthorizedUpstreamsHandler: Failed to get ClientID from context", Reason: accesslog.ReasonInternalError})
+		accesslog.SetReason(ctx, accesslog.ReasonInternalError)
 		return
 	}
 
 	// Clients are only authorized to forward to certain upstreams.
+	_, span := trace.StartSpan(ctx, "authz")
 	authzUpstreams, err := h.Authorizer.AuthorizedUpstreams(ctx, clientID)
+	span.RecordError(err)
+	span.End()
+	ObserverFromContext(ctx).OnAuthorized(ctx, AuthorizedEvent{
+		ConnID:    ConnIDFromContext(ctx),
+		ClientID:  clientID,
+		Upstreams: authzUpstreams,
+		Err:       err,
+	})
 	if err != nil {
-		h.Logger.Error(&slog.LogRecord{Msg: "AuthorizedUpstreamsHandler: AuthorizedUpstreams error", ClientID: &clientID, Error: err})
+		h.Logger.Error(&slog.LogRecord{Msg: "AuthorizedUpstreamsHandler: AuthorizedUpstreams error", Reason: accesslog.ReasonInternalError, ClientID: &clientID, Error: err})
+		accesslog.SetReason(ctx, accesslog.ReasonInternalError)
 		return
 	}
 	if len(authzUpstreams) == 0 {
-		h.Logger.Warn(&slog.LogRecord{Msg: "Client not authorized for forwarding", ClientID: &clientID, Error: err})
+		h.Logger.Warn(&slog.LogRecord{Msg: "Client not authorized for forwarding", Reason: accesslog.ReasonNotAuthorized, ClientID: &clientID, Error: err})
+		accesslog.SetReason(ctx, accesslog.ReasonNotAuthorized)
+		if h.Denied != nil {
+			// Connections beyond the bound are counted by Denied.Exceeded.
+			_ = h.Denied.Deny(ctx, clientID, conn)
+		}
 		return
 	}
+	if pool, ok := PoolFromContext(ctx); ok {
+		// Only consider authorized upstreams in the pool the connection was
+		// routed to. The client is authorized, so if none are in the pool,
+		// e.g. as its upstreams are being replaced, none is available.
+		authzUpstreams = core.Intersection(authzUpstreams, pool.CurrentUpstreams())
+		if len(authzUpstreams) == 0 {
+			h.Logger.Warn(&slog.LogRecord{Msg: "AuthorizedUpstreamsHandler: no authorized upstream in pool", Reason: accesslog.ReasonNoUpstream, ClientID: &clientID})
+			accesslog.SetReason(ctx, accesslog.ReasonNoUpstream)
+			return
+		}
+	}
 
 	childCtx := NewContextWithUpstreams(ctx, authzUpstreams)
 
@@ -169,28 +388,75 @@ var _ Handler = (*AuthorizedUpstreamsHandler)(nil) // type check
 // ForwardingHandler is the terminal handler that dials the best upstream to
 // serve the client connection, then forwards the client connection to that upstream.
 // It expects to find clientID and upstreams (the set of candidate upstreams to
-// consider forwarding to) in the given context.
+// consider forwarding to) in the given context. The client connection is
+// added to the context of the dial, so that the Dialer may describe it to
+// the upstream, e.g. in a PROXY header.
 type ForwardingHandler struct {
 	Logger    slog.Logger
 	Dialer    BestUpstreamDialer
 	Forwarder Forwarder
+	Registry  *core.UpstreamRegistry // Registry is optional. If set, upstream labels are recorded in the access log.
+
+	// RedialWindow is optional. If positive, forwarding waits up to
+	// RedialWindow after dialing for the upstream connection to fail, before
+	// any client data is sent to it. If it does fail, e.g. the upstream
+	// resets the connection as soon as it is accepted, another candidate is
+	// dialed instead, transparently to the client. This delays forwarding of
+	// client data by up to RedialWindow, unless the upstream speaks first.
+	RedialWindow time.Duration
+
+	// FailureReporter is optional. If set, it is told of upstreams whose
+	// connections fail while forwarding.
+	FailureReporter UpstreamFailureReporter
 }
 
-func (h *ForwardingHandler) Handle(ctx context.Context, conn DuplexConn) {
+func (h *ForwardingHandler) Handle(ctx context.Context, conn core.DuplexConn) {
 	clientID, ok := ClientIDFromContext(ctx)
 	if !ok {
-		h.Logger.Error(&slog.LogRecord{Msg: "ForwardingHandler: Failed to get ClientID from context"})
+		h.Logger.Error(&slog.LogRecord{Msg: "ForwardingHandler: Failed to get ClientID from context", Reason: accesslog.ReasonInternalError})
+		accesslog.SetReason(ctx, accesslog.ReasonInternalError)
 		return
 	}
 	candidateUpstreams, ok := UpstreamsFromContext(ctx)
 	if !ok {
-		h.Logger.Error(&slog.LogRecord{Msg: "ForwardingHandler: Failed to get candidate Upstreams from context"})
+		h.Logger.Error(&slog.LogRecord{Msg: "ForwardingHandler: Failed to get candidate Upstreams from context", Reason: accesslog.ReasonInternalError})
+		accesslog.SetReason(ctx, accesslog.ReasonInternalError)
 		return
 	}
-	upstream, upstreamConn, err := h.Dialer.DialBestUpstream(ctx, candidateUpstreams)
+	observer := ObserverFromContext(ctx)
+	connID := ConnIDFromContext(ctx)
+	dialCtx, dialSpan := trace.StartClientSpan(NewContextWithClientConn(ctx, conn), "dial")
+	dialStart := time.Now()
+	upstream, upstreamConn, early := claimEarlyDial(dialCtx, candidateUpstreams)
+	var err error
+	if early {
+		dialSpan.SetAttribute("tcplb.early_dial", "true")
+	} else {
+		upstream, upstreamConn, err = h.Dialer.DialBestUpstream(dialCtx, candidateUpstreams)
+	}
+	if err == nil && h.RedialWindow > 0 {
+		upstream, upstreamConn, err = h.redialOnImmediateFailure(dialCtx, candidateUpstreams, upstream, upstreamConn)
+	}
+	dialSpan.RecordError(err)
+	dialSpan.End()
+	observer.OnDial(ctx, DialEvent{
+		ConnID:   connID,
+		ClientID: clientID,
+		Upstream: upstream,
+		Duration: time.Since(dialStart),
+		Err:      err,
+	})
 	if err != nil {
-		// TODO many failure modes end up here. Improve logging to help the operator triage.
-		h.Logger.Error(&slog.LogRecord{Msg: "ForwardingHandler: DialBestUpstream error", ClientID: &clientID, Error: err})
+		// Every upstream refusing or timing out, the dialer giving up after
+		// its maximum attempts, and the client's context ending mid-dial are
+		// not told apart by reason: all are ReasonDialFailed, and the logged
+		// error holds each upstream's failure.
+		reason := accesslog.ReasonDialFailed
+		if errors.Is(err, NoUpstreamAvailable) {
+			reason = accesslog.ReasonNoUpstream
+		}
+		h.Logger.Error(&slog.LogRecord{Msg: "ForwardingHandler: DialBestUpstream error", Reason: reason, ClientID: &clientID, Error: err})
+		accesslog.SetReason(ctx, reason)
 		return
 	}
 	defer func() {
@@ -198,19 +464,72 @@ func (h *ForwardingHandler) Handle(ctx context.Context, conn DuplexConn) {
 		// likely due to upstream or network. Ignore them.
 		_ = upstreamConn.Close()
 	}()
+	if !endPreAuthDeadline(ctx) {
+		return
+	}
+	accesslog.RecordFromContext(ctx).SetUpstream(upstream)
+	if labels := h.Registry.Labels(upstream); len(labels) > 0 {
+		accesslog.RecordFromContext(ctx).SetUpstreamLabels(labels)
+	}
+	entry := conntable.EntryFromContext(ctx)
+	entry.SetUpstream(upstream)
+	entry.StartForwarding()
 	h.Logger.Info(&slog.LogRecord{Msg: "ForwardingHandler: Attempting Forward", ClientID: &clientID, Upstream: &upstream})
-	err = h.Forwarder.Forward(ctx, conn, upstreamConn)
+	var recorder *errorRecordingConn
+	if h.FailureReporter != nil {
+		recorder = &errorRecordingConn{WrappedConn: core.WrappedConn{DuplexConn: upstreamConn}}
+		upstreamConn = recorder
+	}
+	forwardCtx, forwardSpan := trace.StartSpan(ctx, "forward")
+	forwardSpan.SetAttribute("tcplb.upstream", upstream.Address)
+	forwardStart := time.Now()
+	err = h.Forwarder.Forward(forwardCtx, conn, upstreamConn)
+	forwardSpan.RecordError(err)
+	forwardSpan.End()
+	observer.OnForwardDone(ctx, ForwardDoneEvent{
+		ConnID:   connID,
+		ClientID: clientID,
+		Upstream: upstream,
+		Duration: time.Since(forwardStart),
+		Err:      err,
+	})
 	if err != nil {
-		// TODO if upstreamConn is established successfully but later experiences an error that
-		// causes Forward to terminate abnormally, then arguably we could sense that here and
-		// lodge a HealthReport about that upstream.
-		// An alternative approach could be to handle it internally within the BestUpstreamDialer
-		// abstraction, which could wrap & instrument the returned upstreamConn to report health.
-
-		h.Logger.Error(&slog.LogRecord{Msg: "ForwardingHandler: Forward complete with error", ClientID: &clientID, Upstream: &upstream, Error: err})
+		reason := accesslog.ReasonForwardError
+		timedOut := true
+		switch {
+		case errors.Is(err, IdleTimeoutExceeded):
+			reason = accesslog.ReasonIdleTimeout
+		case errors.Is(err, MaxDurationExceeded):
+			reason = accesslog.ReasonMaxDuration
+		case errors.Is(err, HalfOpenTimeoutExceeded):
+			reason = accesslog.ReasonHalfOpenTimeout
+		case errors.Is(err, SlowConsumerExceeded):
+			reason = accesslog.ReasonSlowConsumer
+		case errors.Is(err, UpstreamReset):
+			reason, timedOut = accesslog.ReasonUpstreamReset, false
+		default:
+			timedOut = false
+		}
+		// Errors caused by cancellation, e.g. shutdown, or by timeouts, are
+		// not the upstream's fault.
+		if recorder != nil && ctx.Err() == nil && !timedOut {
+			if upstreamErr := recorder.Err(); upstreamErr != nil {
+				h.FailureReporter.ReportUpstreamFailure(ctx, upstream, upstreamErr)
+			}
+		}
+		switch {
+		case timedOut:
+			h.Logger.Info(&slog.LogRecord{Msg: "ForwardingHandler: Forward timed out", Reason: reason, ClientID: &clientID, Upstream: &upstream, Error: err})
+		case reason == accesslog.ReasonForwardError:
+			h.Logger.Error(&slog.LogRecord{Msg: "ForwardingHandler: Forward complete with error", Reason: reason, ClientID: &clientID, Upstream: &upstream, Error: err})
+		default:
+			h.Logger.Warn(&slog.LogRecord{Msg: "ForwardingHandler: Forward cut short by upstream", Reason: reason, ClientID: &clientID, Upstream: &upstream, Error: err})
+		}
+		accesslog.SetReason(ctx, reason)
 		return
 	}
-	h.Logger.Info(&slog.LogRecord{Msg: "ForwardingHandler: Forward complete", ClientID: &clientID, Upstream: &upstream})
+	accesslog.SetReason(ctx, accesslog.ReasonForwarded)
+	h.Logger.Info(&slog.LogRecord{Msg: "ForwardingHandler: Forward complete", Reason: accesslog.ReasonForwarded, ClientID: &clientID, Upstream: &upstream})
 }
 
 var _ Handler = (*ForwardingHandler)(nil) // type check
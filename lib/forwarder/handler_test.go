@@ -1,10 +1,25 @@
 package forwarder
 
 import (
+	"bytes"
 	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
 	"github.com/stretchr/testify/require"
+	"io"
+	"net"
+	"net/netip"
+	"sync"
+	"tcplb/lib/accesslog"
+	"tcplb/lib/authn"
+	"tcplb/lib/clock"
+	"tcplb/lib/conntable"
 	"tcplb/lib/core"
+	"tcplb/lib/slog"
+	"tcplb/lib/testbed"
 	"testing"
+	"time"
 )
 
 func TestClientIDFromContext(t *testing.T) {
@@ -65,3 +80,539 @@ func TestClientIDAndUpstreamsFromContext(t *testing.T) {
 	require.True(t, ok)
 	require.Equal(t, upstreams, upstreamsPrime)
 }
+
+// pipeConn adapts one end of a net.Pipe into a DuplexConn.
+type pipeConn struct {
+	net.Conn
+}
+
+func (c pipeConn) CloseWrite() error { return nil }
+
+func newPipeConns() (core.DuplexConn, core.DuplexConn) {
+	a, b := net.Pipe()
+	return pipeConn{a}, pipeConn{b}
+}
+
+type stubAuthorizer struct {
+	upstreams core.UpstreamSet
+}
+
+func (a stubAuthorizer) AuthorizedUpstreams(ctx context.Context, c core.ClientID) (core.UpstreamSet, error) {
+	return a.upstreams, nil
+}
+
+type stubDialer struct {
+	err error
+}
+
+func (d stubDialer) DialBestUpstream(ctx context.Context, candidates core.UpstreamSet) (core.Upstream, core.DuplexConn, error) {
+	if d.err != nil {
+		return core.Upstream{}, nil, d.err
+	}
+	for u := range candidates {
+		conn, _ := newPipeConns()
+		return u, conn, nil
+	}
+	return core.Upstream{}, nil, errors.New("no candidates")
+}
+
+// unboundedReserver allows every reservation.
+type unboundedReserver struct{}
+
+func (unboundedReserver) TryReserve(ctx context.Context, c core.ClientID) error         { return nil }
+func (unboundedReserver) ReleaseReservation(ctx context.Context, c core.ClientID) error { return nil }
+
+type stubForwarder struct {
+	err error
+}
+
+func (f stubForwarder) Forward(ctx context.Context, clientConn, upstreamConn core.DuplexConn) error {
+	return f.err
+}
+
+// newTestHandlerStack returns a handler stack that authenticates anonymously,
+// then authorizes and forwards. Each wrap, if any, is applied in order to
+// the handlers following authentication.
+func newTestHandlerStack(authorizer Authorizer, dialer BestUpstreamDialer, wraps ...func(inner Handler) Handler) Handler {
+	logger := &slog.RecordingLogger{}
+	var inner Handler = &AuthorizedUpstreamsHandler{
+		Logger:     logger,
+		Authorizer: authorizer,
+		Inner: &ForwardingHandler{
+			Logger:    logger,
+			Dialer:    dialer,
+			Forwarder: stubForwarder{},
+		},
+	}
+	for _, wrap := range wraps {
+		inner = wrap(inner)
+	}
+	return &AnonymousAuthenticationHandler{
+		Logger:    logger,
+		Anonymous: core.ClientID{Namespace: "handler-test", Key: "anon"},
+		Inner:     inner,
+	}
+}
+
+// recordingDialer records the candidates it was asked to dial.
+type recordingDialer struct {
+	candidates []core.UpstreamSet
+}
+
+func (d *recordingDialer) DialBestUpstream(ctx context.Context, candidates core.UpstreamSet) (core.Upstream, core.DuplexConn, error) {
+	d.candidates = append(d.candidates, candidates)
+	return stubDialer{}.DialBestUpstream(ctx, candidates)
+}
+
+// halfClosingConn is a DuplexConn that signals when it is closed for
+// writing.
+type halfClosingConn struct {
+	core.DuplexConn
+	closedWrite chan struct{}
+}
+
+func (c halfClosingConn) CloseWrite() error {
+	close(c.closedWrite)
+	return nil
+}
+
+// authenticatedReadingHandler authenticates the client as clientID, then
+// reads from the client until the connection is closed.
+type authenticatedReadingHandler struct {
+	clientID core.ClientID
+	started  chan struct{}
+}
+
+func (h authenticatedReadingHandler) Handle(ctx context.Context, conn core.DuplexConn) {
+	entry := conntable.EntryFromContext(ctx)
+	entry.SetClientID(h.clientID)
+	entry.StartForwarding()
+	close(h.started)
+	_, _ = io.Copy(io.Discard, conn)
+}
+
+func TestConnTableHandlerEvictsClient(t *testing.T) {
+	clientID := core.ClientID{Namespace: "handler-test", Key: "compromised"}
+	table := conntable.NewTable(conntable.Config{})
+	c := clock.NewFake(time.Unix(1000, 0))
+	logger := &slog.RecordingLogger{}
+	inner := authenticatedReadingHandler{clientID: clientID, started: make(chan struct{})}
+	h := &ConnTableHandler{Table: table, Logger: logger, Clock: c, Inner: inner}
+
+	clientConn, peerConn := newPipeConns()
+	conn := halfClosingConn{DuplexConn: clientConn, closedWrite: make(chan struct{})}
+	record := accesslog.NewRecord("client", time.Now())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		h.Handle(accesslog.NewContextWithRecord(context.Background(), record), conn)
+	}()
+	<-inner.started
+
+	ids := table.EvictClient(clientID, time.Second)
+	require.Len(t, ids, 1)
+	<-conn.closedWrite
+	require.Len(t, logger.Events, 1)
+	require.Equal(t, "ConnTableHandler: evicting client connection", logger.Events[0].Msg)
+	require.Equal(t, accesslog.ReasonAdminEvicted, logger.Events[0].Reason)
+
+	// Data in flight from the client is still read during the grace period.
+	_, err := peerConn.Write([]byte("in flight"))
+	require.NoError(t, err)
+	c.BlockUntil(1)
+	c.Advance(time.Second)
+	<-done
+	require.Equal(t, accesslog.ReasonAdminEvicted, record.Reason())
+	require.Zero(t, table.Len())
+}
+
+func TestConnTableHandlerDrainsIdleConnection(t *testing.T) {
+	clientID := core.ClientID{Namespace: "handler-test", Key: "idle"}
+	// Connections are registered as started at the time of the system
+	// clock.
+	c := clock.NewFake(time.Now())
+	table := conntable.NewTable(conntable.Config{IdleAfter: time.Minute, Clock: c})
+	logger := &slog.RecordingLogger{}
+	inner := authenticatedReadingHandler{clientID: clientID, started: make(chan struct{})}
+	h := &ConnTableHandler{Table: table, Logger: logger, Clock: c, Inner: inner}
+
+	clientConn, _ := newPipeConns()
+	conn := halfClosingConn{DuplexConn: clientConn, closedWrite: make(chan struct{})}
+	record := accesslog.NewRecord("client", time.Now())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		h.Handle(accesslog.NewContextWithRecord(context.Background(), record), conn)
+	}()
+	<-inner.started
+
+	c.Advance(2 * time.Minute)
+	require.Equal(t, 1, table.DrainIdle(time.Second))
+	<-conn.closedWrite
+	require.Len(t, logger.Events, 1)
+	require.Equal(t, "ConnTableHandler: draining idle client connection", logger.Events[0].Msg)
+	require.Equal(t, accesslog.ReasonDrained, logger.Events[0].Reason)
+
+	// The connection is closed once the grace period passes.
+	c.BlockUntil(1)
+	c.Advance(time.Second)
+	<-done
+	require.Equal(t, accesslog.ReasonDrained, record.Reason())
+	require.Zero(t, table.Len())
+}
+
+type rejectingHandler struct {
+	reason         accesslog.ReasonCode
+	handshakeError string // handshakeError is optional. If set, it is recorded as the class of handshake failure.
+}
+
+func (h rejectingHandler) Handle(ctx context.Context, conn core.DuplexConn) {
+	if h.handshakeError != "" {
+		accesslog.RecordFromContext(ctx).SetHandshakeError(h.handshakeError)
+	}
+	accesslog.SetReason(ctx, h.reason)
+}
+
+func TestForwardingHandlerRecordsNoUpstreamAvailable(t *testing.T) {
+	a := core.Upstream{Network: "handler-test", Address: "a"}
+	record := accesslog.NewRecord("client", time.Now())
+	ctx := accesslog.NewContextWithRecord(context.Background(), record)
+	clientConn, _ := newPipeConns()
+	h := newTestHandlerStack(stubAuthorizer{upstreams: core.NewUpstreamSet(a)}, stubDialer{err: NoUpstreamAvailable})
+	h.Handle(ctx, clientConn)
+	require.Equal(t, accesslog.ReasonNoUpstream, record.Reason())
+}
+
+// peerKeepingDialer dials pipe conns, keeping the upstream end of each.
+type peerKeepingDialer struct {
+	mu    sync.Mutex
+	peers []core.DuplexConn
+}
+
+func (d *peerKeepingDialer) DialBestUpstream(ctx context.Context, candidates core.UpstreamSet) (core.Upstream, core.DuplexConn, error) {
+	for u := range candidates {
+		conn, peer := newPipeConns()
+		d.mu.Lock()
+		d.peers = append(d.peers, peer)
+		d.mu.Unlock()
+		return u, conn, nil
+	}
+	return core.Upstream{}, nil, errors.New("no candidates")
+}
+
+func (d *peerKeepingDialer) Peers() []core.DuplexConn {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([]core.DuplexConn(nil), d.peers...)
+}
+
+type limitedReserver struct {
+	err error // err is wrapped by TryReserve.
+}
+
+func (r limitedReserver) TryReserve(ctx context.Context, c core.ClientID) error {
+	return fmt.Errorf("pool web: %w", r.err)
+}
+
+func (limitedReserver) ReleaseReservation(ctx context.Context, c core.ClientID) error {
+	return NoPoolInContext
+}
+
+func TestRateLimitingHandlerRecognisesWrappedLimitErrors(t *testing.T) {
+	record := accesslog.NewRecord("client", time.Now())
+	ctx := accesslog.NewContextWithRecord(context.Background(), record)
+	clientConn, _ := newPipeConns()
+	h := newTestHandlerStack(stubAuthorizer{}, stubDialer{}, func(inner Handler) Handler {
+		return &RateLimitingHandler{Logger: &slog.RecordingLogger{}, Reserver: limitedReserver{err: ReservationLimitExceeded}, Inner: inner}
+	})
+	h.Handle(ctx, clientConn)
+	require.Equal(t, accesslog.ReasonRateLimited, record.Reason())
+
+	h = newTestHandlerStack(stubAuthorizer{}, stubDialer{}, func(inner Handler) Handler {
+		return &RateLimitingHandler{Logger: &slog.RecordingLogger{}, Reserver: limitedReserver{err: ReserverOverloaded}, Inner: inner}
+	})
+	require.Equal(t, accesslog.ReasonReserverOverloaded, handleRecordingReason(h, clientConn))
+}
+
+// renewingReserver counts the renewals of its reservations.
+type renewingReserver struct {
+	unboundedReserver
+	renewals chan core.ClientID
+}
+
+func (r renewingReserver) RenewReservation(ctx context.Context, c core.ClientID) error {
+	select {
+	case r.renewals <- c:
+	default:
+	}
+	return nil
+}
+
+// renewalWaitingHandler returns once the reservation has been renewed twice.
+type renewalWaitingHandler struct {
+	renewals chan core.ClientID
+}
+
+func (h renewalWaitingHandler) Handle(ctx context.Context, conn core.DuplexConn) {
+	<-h.renewals
+	<-h.renewals
+}
+
+func TestRateLimitingHandlerRenewsReservations(t *testing.T) {
+	renewals := make(chan core.ClientID, 1)
+	clientID := core.ClientID{Namespace: "test", Key: "client"}
+	c := clock.NewFake(time.Unix(1000, 0))
+	h := &RateLimitingHandler{
+		Logger:        &slog.RecordingLogger{},
+		Reserver:      renewingReserver{renewals: renewals},
+		Inner:         renewalWaitingHandler{renewals: renewals},
+		RenewInterval: time.Minute,
+		Clock:         c,
+	}
+	conn, _ := newPipeConns()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		h.Handle(NewContextWithClientID(context.Background(), clientID), conn)
+	}()
+	// Ticks are dropped while a renewal is in progress, so keep time passing
+	// until both renewals are made.
+	require.Eventually(t, func() bool {
+		c.Advance(time.Minute)
+		select {
+		case <-done:
+			return true
+		default:
+			return false
+		}
+	}, 5*time.Second, time.Millisecond)
+}
+
+// flakyDialer dials pipe conns to the first of the sorted candidates. The
+// upstream end of conns to upstreams in Fail is closed at once, while other
+// upstreams greet the client.
+type flakyDialer struct {
+	Fail   core.UpstreamSet
+	dialed []core.Upstream
+}
+
+func (d *flakyDialer) DialBestUpstream(ctx context.Context, candidates core.UpstreamSet) (core.Upstream, core.DuplexConn, error) {
+	sorted := candidates.Sorted()
+	if len(sorted) == 0 {
+		return core.Upstream{}, nil, NoUpstreamAvailable
+	}
+	u := sorted[0]
+	d.dialed = append(d.dialed, u)
+	conn, peer := newPipeConns()
+	if _, fail := d.Fail[u]; fail {
+		_ = peer.Close()
+	} else {
+		go func() { _, _ = peer.Write([]byte("hello")) }()
+	}
+	return u, conn, nil
+}
+
+// writingForwarder writes to the upstream instead of forwarding.
+type writingForwarder struct{}
+
+func (writingForwarder) Forward(ctx context.Context, clientConn, upstreamConn core.DuplexConn) error {
+	_, err := upstreamConn.Write([]byte("hello"))
+	return err
+}
+
+type recordingFailureReporter struct {
+	failed []core.Upstream
+}
+
+func (r *recordingFailureReporter) ReportUpstreamFailure(ctx context.Context, u core.Upstream, err error) {
+	r.failed = append(r.failed, u)
+}
+
+// addrConn is a DuplexConn with the given addresses.
+type addrConn struct {
+	core.DuplexConn
+	local, remote net.Addr
+}
+
+func (c addrConn) LocalAddr() net.Addr  { return c.local }
+func (c addrConn) RemoteAddr() net.Addr { return c.remote }
+
+// clientConnRecordingDialer is a peerKeepingDialer that records the client
+// connection carried by the context of each dial.
+type clientConnRecordingDialer struct {
+	peerKeepingDialer
+	clientConns []core.DuplexConn
+}
+
+func (d *clientConnRecordingDialer) DialBestUpstream(ctx context.Context, candidates core.UpstreamSet) (core.Upstream, core.DuplexConn, error) {
+	conn, _ := ClientConnFromContext(ctx)
+	d.mu.Lock()
+	d.clientConns = append(d.clientConns, conn)
+	d.mu.Unlock()
+	return d.peerKeepingDialer.DialBestUpstream(ctx, candidates)
+}
+
+// handleRecordingReason returns the termination reason that h records.
+func handleRecordingReason(h Handler, conn core.DuplexConn) accesslog.ReasonCode {
+	record := accesslog.NewRecord("client", time.Now())
+	h.Handle(accesslog.NewContextWithRecord(context.Background(), record), conn)
+	return record.Reason()
+}
+
+// countingBanner bans every source after a single failure.
+type countingBanner struct {
+	failures map[netip.Addr]int
+}
+
+func (b *countingBanner) RecordFailure(addr netip.Addr) bool {
+	b.failures[addr]++
+	return true
+}
+
+func (b *countingBanner) Banned(addr netip.Addr) bool {
+	return b.failures[addr] > 0
+}
+
+// handshakeError returns the error of a server handshake with a client that
+// runs the given function on its end of the connection.
+func handshakeError(t *testing.T, client func(conn net.Conn)) error {
+	serverConn, clientConn := net.Pipe()
+	defer serverConn.Close()
+	go func() {
+		defer clientConn.Close()
+		client(clientConn)
+	}()
+	server := tls.Server(serverConn, &tls.Config{MinVersion: tls.VersionTLS13})
+	err := server.Handshake()
+	require.Error(t, err)
+	return err
+}
+
+// clientIDRecordingHandler records the ClientID in its context.
+type clientIDRecordingHandler struct {
+	clientID core.ClientID
+	ok       bool
+}
+
+func (h *clientIDRecordingHandler) Handle(ctx context.Context, conn core.DuplexConn) {
+	h.clientID, h.ok = ClientIDFromContext(ctx)
+	accesslog.SetReason(ctx, accesslog.ReasonForwarded)
+}
+
+func TestMTLSAuthenticationHandler(t *testing.T) {
+	tb := testbed.New(t)
+	serverConfig := tb.ServerTLSConfig(tb.Server(t, "tcplb.test"))
+	// authenticate returns the ClientID that h identifies a client with the
+	// given TLS config as, if any.
+	authenticate := func(h *MTLSAuthenticationHandler, serverConfig, clientConfig *tls.Config) (core.ClientID, bool, accesslog.ReasonCode) {
+		inner := &clientIDRecordingHandler{}
+		h.Logger = &slog.RecordingLogger{}
+		h.Inner = inner
+		conn, peer := newPipeConns()
+		go func() {
+			client := tls.Client(peer, clientConfig)
+			// Wait for the server to accept or reject the certificate.
+			_, _ = client.Read(make([]byte, 1))
+			_ = client.Close()
+		}()
+		tlsConn := tls.Server(conn, serverConfig)
+		reason := handleRecordingReason(h, tlsConn)
+		_ = tlsConn.Close()
+		return inner.clientID, inner.ok, reason
+	}
+	alice := tb.ClientTLSConfig(tb.Client(t, "alice"))
+	alice.ServerName = "tcplb.test"
+	anonymous := tb.ClientTLSConfig(testbed.Identity{})
+	anonymous.ServerName = "tcplb.test"
+
+	// Certificates are required.
+	clientID, ok, _ := authenticate(&MTLSAuthenticationHandler{}, serverConfig, alice)
+	require.True(t, ok)
+	require.Equal(t, core.ClientID{Namespace: authn.DefaultNamespace, Key: "alice"}, clientID)
+	_, ok, reason := authenticate(&MTLSAuthenticationHandler{}, serverConfig, anonymous)
+	require.False(t, ok)
+	require.Equal(t, accesslog.ReasonAuthnFailed, reason)
+
+	// Certificates are optional.
+	optional := serverConfig.Clone()
+	optional.ClientAuth = tls.VerifyClientCertIfGiven
+	h := &MTLSAuthenticationHandler{Unauthenticated: &authn.Unauthenticated}
+	clientID, ok, _ = authenticate(h, optional, alice)
+	require.True(t, ok)
+	require.Equal(t, core.ClientID{Namespace: authn.DefaultNamespace, Key: "alice"}, clientID)
+	clientID, ok, _ = authenticate(h, optional, anonymous)
+	require.True(t, ok)
+	require.Equal(t, authn.Unauthenticated, clientID)
+	// Certificates that are given must still be valid.
+	other := testbed.New(t)
+	mallory := tb.ClientTLSConfig(testbed.Identity{})
+	mallory.ServerName = "tcplb.test"
+	mallory.Certificates = []tls.Certificate{other.Client(t, "alice").Certificate}
+	_, ok, reason = authenticate(h, optional, mallory)
+	require.False(t, ok)
+	require.Equal(t, accesslog.ReasonAuthnFailed, reason)
+}
+
+func TestMTLSAuthenticationHandlerRecordsSNI(t *testing.T) {
+	tb := testbed.New(t)
+	serverConfig := tb.ServerTLSConfig(tb.Server(t, "tcplb.test"))
+	clientConfig := tb.ClientTLSConfig(tb.Client(t, "alice"))
+	clientConfig.ServerName = "tcplb.test"
+	h := &MTLSAuthenticationHandler{Logger: &slog.RecordingLogger{}, Inner: rejectingHandler{reason: accesslog.ReasonForwarded}}
+	conn, peer := newPipeConns()
+	go func() {
+		client := tls.Client(peer, clientConfig)
+		_, _ = client.Read(make([]byte, 1))
+		_ = client.Close()
+	}()
+	tlsConn := tls.Server(conn, serverConfig)
+	record := accesslog.NewRecord("client", time.Now())
+	h.Handle(accesslog.NewContextWithRecord(context.Background(), record), tlsConn)
+	_ = tlsConn.Close()
+
+	var out bytes.Buffer
+	accesslog.NewJSONLogger(&out).Log(record)
+	require.Contains(t, out.String(), `"sni":"tcplb.test"`)
+}
+
+// recordingAccountant records usage, and rejects clients with err, if set.
+type recordingAccountant struct {
+	err   error
+	mu    sync.Mutex
+	bytes int64
+	calls int
+}
+
+func (a *recordingAccountant) CheckQuota(ctx context.Context, c core.ClientID) error {
+	return a.err
+}
+
+func (a *recordingAccountant) RecordUsage(ctx context.Context, c core.ClientID, bytes int64, connected time.Duration) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.bytes += bytes
+	a.calls++
+}
+
+func (a *recordingAccountant) usage() (int64, int) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.bytes, a.calls
+}
+
+type groupsByClient map[core.ClientID][]string
+
+func (g groupsByClient) ClientGroups(ctx context.Context, c core.ClientID) ([]string, error) {
+	return g[c], nil
+}
+
+// handshakingHandler completes the TLS handshake of the connection.
+type handshakingHandler struct{}
+
+func (handshakingHandler) Handle(ctx context.Context, conn core.DuplexConn) {
+	if err := conn.(*tls.Conn).HandshakeContext(ctx); err != nil {
+		accesslog.SetReason(ctx, accesslog.ReasonAuthnFailed)
+		return
+	}
+	accesslog.SetReason(ctx, accesslog.ReasonForwarded)
+}
@@ -0,0 +1,168 @@
+package forwarder
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"sync"
+	"tcplb/lib/accesslog"
+	"tcplb/lib/clock"
+	"tcplb/lib/core"
+	"tcplb/lib/slog"
+	"tcplb/lib/trace"
+	"time"
+)
+
+// HandshakeLimitExceeded is returned when a TLS handshake could not start
+// because too many handshakes were already in progress.
+var HandshakeLimitExceeded = errors.New("too many concurrent TLS handshakes")
+
+// HandshakeRateLimiter is core.HandshakeRateLimiter, limiting the rate of
+// TLS handshakes with separate budgets for full handshakes and for resumed
+// sessions.
+type HandshakeRateLimiter = core.HandshakeRateLimiter
+
+// HandshakeStartLimiter is core.HandshakeStartLimiter, limiting the rate at
+// which TLS handshakes start.
+type HandshakeStartLimiter = core.HandshakeStartLimiter
+
+// HandshakeLimitingHandler is a handler that completes the TLS handshake of
+// client connections before the Inner handler is invoked, with at most
+// MaxConcurrent handshakes in progress at a time. Handshakes are
+// CPU-expensive, so this prevents a burst of new clients from starving
+// connections that are already being forwarded.
+//
+// Connections beyond the limit wait up to QueueTimeout for a handshake to
+// finish. If QueueTimeout is not positive, they are rejected at once.
+// Connections that are not using TLS are passed to Inner unchanged.
+//
+// Failed handshakes are classified by ClassifyHandshakeError, and the class
+// is logged, recorded in the access log and counted in Metrics.
+//
+// If RateLimiter is set, each handshake is charged against its budget
+// before it starts, and connections beyond the budget are dropped without
+// a handshake. Whether a session resumes is only known once the handshake
+// completes, so each is charged as a full handshake first, and the charge
+// moves to the budget for resumed sessions if it resumes one. Once the
+// budget for full handshakes is spent, clients that would resume a session
+// are dropped too.
+//
+// If StartLimiter is set, it is consulted before each handshake starts, and
+// connections beyond its budget are dropped without a handshake, sparing
+// the server its cost. Unlike the RateLimiter, it cannot tell full
+// handshakes from resumed sessions, so it is a coarse guard of the CPU
+// rather than a per-kind budget.
+type HandshakeLimitingHandler struct {
+	Logger        slog.Logger
+	MaxConcurrent int                   // MaxConcurrent bounds the number of handshakes in progress. If not positive, there is no bound.
+	QueueTimeout  time.Duration         // QueueTimeout bounds the wait for a handshake to start.
+	Timeout       time.Duration         // Timeout bounds each handshake. If not positive, handshakes are bounded only by the connection's context.
+	Metrics       *HandshakeMetrics     // Metrics is optional. If nil, no metrics are recorded.
+	RateLimiter   HandshakeRateLimiter  // RateLimiter is optional. If nil, handshakes are not rate limited.
+	StartLimiter  HandshakeStartLimiter // StartLimiter is optional. If nil, the rate at which handshakes start is not limited.
+	Clock         clock.Clock           // Clock is optional. If nil, the system clock is used.
+	Inner         Handler
+
+	initOnce sync.Once
+	sem      chan struct{} // sem holds a token for each handshake in progress.
+}
+
+func (h *HandshakeLimitingHandler) semaphore() chan struct{} {
+	h.initOnce.Do(func() { h.sem = make(chan struct{}, h.MaxConcurrent) })
+	return h.sem
+}
+
+func (h *HandshakeLimitingHandler) acquire(ctx context.Context) error {
+	if h.MaxConcurrent <= 0 {
+		return nil
+	}
+	sem := h.semaphore()
+	select {
+	case sem <- struct{}{}:
+		return nil
+	default:
+	}
+	if h.QueueTimeout <= 0 {
+		return HandshakeLimitExceeded
+	}
+	timer := clock.Or(h.Clock).NewTimer(h.QueueTimeout)
+	defer timer.Stop()
+	select {
+	case sem <- struct{}{}:
+		return nil
+	case <-timer.C():
+		return HandshakeLimitExceeded
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (h *HandshakeLimitingHandler) release() {
+	if h.MaxConcurrent > 0 {
+		<-h.semaphore()
+	}
+}
+
+func (h *HandshakeLimitingHandler) Handle(ctx context.Context, conn core.DuplexConn) {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		h.Inner.Handle(ctx, conn)
+		return
+	}
+	if h.StartLimiter != nil && !h.StartLimiter.Allow() {
+		h.Metrics.recordThrottled()
+		h.Logger.Warn(&slog.LogRecord{Msg: "HandshakeLimitingHandler: handshake start rate limit exceeded", Reason: accesslog.ReasonHandshakeThrottled})
+		accesslog.SetReason(ctx, accesslog.ReasonHandshakeThrottled)
+		return
+	}
+	if h.RateLimiter != nil && !h.RateLimiter.AllowHandshake() {
+		h.rateLimited(ctx, "full")
+		return
+	}
+	spanCtx, span := trace.StartSpan(ctx, "handshake")
+	if err := h.acquire(spanCtx); err != nil {
+		span.RecordError(err)
+		span.End()
+		h.Logger.Warn(&slog.LogRecord{Msg: "HandshakeLimitingHandler: handshake not started", Reason: accesslog.ReasonHandshakeLimited, Error: err})
+		accesslog.SetReason(ctx, accesslog.ReasonHandshakeLimited)
+		return
+	}
+	handshakeCtx := spanCtx
+	if h.Timeout > 0 {
+		var cancel context.CancelFunc
+		handshakeCtx, cancel = clock.WithTimeout(spanCtx, h.Clock, h.Timeout)
+		defer cancel()
+	}
+	err := tlsConn.HandshakeContext(handshakeCtx)
+	h.release()
+	span.RecordError(err)
+	span.End()
+	if err != nil {
+		class := ClassifyHandshakeError(err)
+		h.Metrics.recordFailure(class)
+		h.Logger.Warn(&slog.LogRecord{Msg: "HandshakeLimitingHandler: handshake failed", Reason: accesslog.ReasonAuthnFailed, Error: err, Details: class})
+		record := accesslog.RecordFromContext(ctx)
+		record.SetHandshakeError(class)
+		record.SetReason(accesslog.ReasonAuthnFailed)
+		return
+	}
+	state := tlsConn.ConnectionState()
+	accesslog.RecordFromContext(ctx).SetSNI(state.ServerName)
+	resumed := state.DidResume
+	h.Metrics.recordCompleted(resumed)
+	if resumed && h.RateLimiter != nil && !h.RateLimiter.AllowResumed() {
+		h.rateLimited(ctx, "resumed")
+		return
+	}
+	h.Inner.Handle(ctx, conn)
+}
+
+// rateLimited records a connection dropped by the RateLimiter for a
+// handshake of the given kind.
+func (h *HandshakeLimitingHandler) rateLimited(ctx context.Context, kind string) {
+	h.Metrics.recordRateLimited()
+	h.Logger.Warn(&slog.LogRecord{Msg: "HandshakeLimitingHandler: handshake rate limit exceeded", Reason: accesslog.ReasonHandshakeRateLimited, Details: kind})
+	accesslog.SetReason(ctx, accesslog.ReasonHandshakeRateLimited)
+}
+
+var _ Handler = (*HandshakeLimitingHandler)(nil) // type check
@@ -0,0 +1,195 @@
+package forwarder
+
+import (
+	"crypto/tls"
+	"github.com/stretchr/testify/require"
+	"sync"
+	"tcplb/lib/accesslog"
+	"tcplb/lib/clock"
+	"tcplb/lib/metrics"
+	"tcplb/lib/slog"
+	"tcplb/lib/testbed"
+	"testing"
+	"time"
+)
+
+func TestHandshakeLimitingHandler(t *testing.T) {
+	h := &HandshakeLimitingHandler{
+		Logger:        &slog.RecordingLogger{},
+		MaxConcurrent: 1,
+		Inner:         rejectingHandler{reason: accesslog.ReasonForwarded},
+	}
+
+	// Connections not using TLS are not limited.
+	plainConn, _ := newPipeConns()
+	require.Equal(t, accesslog.ReasonForwarded, handleRecordingReason(h, plainConn))
+
+	// The first handshake occupies the only slot until the client gives up.
+	conn, peer := newPipeConns()
+	first := make(chan accesslog.ReasonCode)
+	go func() { first <- handleRecordingReason(h, tls.Server(conn, &tls.Config{})) }()
+	require.Eventually(t, func() bool { return len(h.semaphore()) == 1 }, time.Second, time.Millisecond)
+
+	otherConn, _ := newPipeConns()
+	require.Equal(t, accesslog.ReasonHandshakeLimited, handleRecordingReason(h, tls.Server(otherConn, &tls.Config{})))
+
+	// A queued handshake starts once the slot is released.
+	h.QueueTimeout = time.Minute
+	queued := make(chan accesslog.ReasonCode)
+	queuedConn, queuedPeer := newPipeConns()
+	go func() { queued <- handleRecordingReason(h, tls.Server(queuedConn, &tls.Config{})) }()
+	require.NoError(t, peer.Close())
+	require.Equal(t, accesslog.ReasonAuthnFailed, <-first)
+	require.Eventually(t, func() bool { return len(h.semaphore()) == 1 }, time.Second, time.Millisecond)
+	require.NoError(t, queuedPeer.Close())
+	require.Equal(t, accesslog.ReasonAuthnFailed, <-queued)
+	require.Len(t, h.semaphore(), 0)
+}
+
+func TestHandshakeLimitingHandlerQueueTimeout(t *testing.T) {
+	c := clock.NewFake(time.Unix(1000, 0))
+	h := &HandshakeLimitingHandler{
+		Logger:        &slog.RecordingLogger{},
+		MaxConcurrent: 1,
+		QueueTimeout:  time.Second,
+		Clock:         c,
+		Inner:         rejectingHandler{reason: accesslog.ReasonForwarded},
+	}
+	// Another handshake occupies the only slot.
+	h.semaphore() <- struct{}{}
+
+	conn, _ := newPipeConns()
+	queued := make(chan accesslog.ReasonCode)
+	go func() { queued <- handleRecordingReason(h, tls.Server(conn, &tls.Config{})) }()
+	c.BlockUntil(1)
+	c.Advance(time.Second)
+	require.Equal(t, accesslog.ReasonHandshakeLimited, <-queued)
+}
+
+// newTestServerTLSConfig returns a server TLS config with a certificate
+// from a testbed, for tests that need handshakes to succeed.
+func newTestServerTLSConfig(t *testing.T) *tls.Config {
+	server := testbed.New(t).Server(t, "tcplb.test")
+	return &tls.Config{Certificates: []tls.Certificate{server.Certificate}}
+}
+
+// budgetRateLimiter allows a fixed number of full and resumed handshakes.
+type budgetRateLimiter struct {
+	mu      sync.Mutex
+	full    int
+	resumed int
+}
+
+func (l *budgetRateLimiter) AllowHandshake() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.full == 0 {
+		return false
+	}
+	l.full--
+	return true
+}
+
+func (l *budgetRateLimiter) AllowResumed() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.full++
+	if l.resumed == 0 {
+		return false
+	}
+	l.resumed--
+	return true
+}
+
+func TestHandshakeLimitingHandlerRateLimitsHandshakes(t *testing.T) {
+	registry := metrics.NewRegistry()
+	h := &HandshakeLimitingHandler{
+		Logger:  &slog.RecordingLogger{},
+		Metrics: NewHandshakeMetrics(registry),
+		// Each handshake is charged as full before it starts, so resuming
+		// a session needs a full token too, if only until it resumes.
+		RateLimiter: &budgetRateLimiter{full: 2, resumed: 1},
+		Inner:       rejectingHandler{reason: accesslog.ReasonForwarded},
+	}
+	serverConfig := newTestServerTLSConfig(t)
+	handshake := func(sessions tls.ClientSessionCache) accesslog.ReasonCode {
+		conn, peer := newPipeConns()
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			// Session tickets are sent during TLS 1.2 handshakes, so are
+			// available to the next connection once this one completes.
+			_ = tls.Client(peer, &tls.Config{
+				InsecureSkipVerify: true,
+				MaxVersion:         tls.VersionTLS12,
+				ClientSessionCache: sessions,
+			}).Handshake()
+			_ = peer.Close()
+		}()
+		reason := handleRecordingReason(h, tls.Server(conn, serverConfig))
+		_ = conn.Close()
+		<-done
+		return reason
+	}
+
+	sessions := tls.NewLRUClientSessionCache(1)
+	require.Equal(t, accesslog.ReasonForwarded, handshake(sessions))
+	// The resumed session is charged to its own budget.
+	require.Equal(t, accesslog.ReasonForwarded, handshake(sessions))
+	require.Equal(t, int64(1), h.Metrics.Resumed.Value())
+	// The resumed budget is spent, so a further resumed session is dropped
+	// once it resumes.
+	require.Equal(t, accesslog.ReasonHandshakeRateLimited, handshake(sessions))
+	require.Equal(t, int64(3), h.Metrics.Completed.Value())
+	// A client without a session is charged before its handshake starts,
+	// so once the full budget is spent, no handshake is made.
+	h.RateLimiter = &budgetRateLimiter{}
+	require.Equal(t, accesslog.ReasonHandshakeRateLimited, handshake(tls.NewLRUClientSessionCache(1)))
+	require.Equal(t, int64(3), h.Metrics.Completed.Value())
+	require.Equal(t, int64(2), h.Metrics.RateLimited.Value())
+}
+
+// startBudget is a HandshakeStartLimiter that allows a fixed number of
+// handshakes to start.
+type startBudget struct {
+	mu        sync.Mutex
+	remaining int
+}
+
+func (b *startBudget) Allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.remaining == 0 {
+		return false
+	}
+	b.remaining--
+	return true
+}
+
+func TestHandshakeLimitingHandlerThrottlesHandshakeStarts(t *testing.T) {
+	registry := metrics.NewRegistry()
+	h := &HandshakeLimitingHandler{
+		Logger:       &slog.RecordingLogger{},
+		Metrics:      NewHandshakeMetrics(registry),
+		StartLimiter: &startBudget{remaining: 1},
+		Inner:        rejectingHandler{reason: accesslog.ReasonForwarded},
+	}
+	serverConfig := newTestServerTLSConfig(t)
+
+	conn, peer := newPipeConns()
+	go func() {
+		_ = tls.Client(peer, &tls.Config{InsecureSkipVerify: true}).Handshake()
+		_ = peer.Close()
+	}()
+	require.Equal(t, accesslog.ReasonForwarded, handleRecordingReason(h, tls.Server(conn, serverConfig)))
+
+	// The budget is spent, so the next client is dropped without a handshake.
+	conn, _ = newPipeConns()
+	require.Equal(t, accesslog.ReasonHandshakeThrottled, handleRecordingReason(h, tls.Server(conn, serverConfig)))
+	require.Equal(t, int64(1), h.Metrics.Completed.Value())
+	require.Equal(t, int64(1), h.Metrics.Throttled.Value())
+
+	// Connections not using TLS are not throttled.
+	plainConn, _ := newPipeConns()
+	require.Equal(t, accesslog.ReasonForwarded, handleRecordingReason(h, plainConn))
+}
@@ -0,0 +1,150 @@
+package forwarder
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"tcplb/lib/metrics"
+)
+
+// Classes of TLS handshake failure, as returned by ClassifyHandshakeError.
+const (
+	HandshakeErrorNoClientCert    = "no_client_cert"   // HandshakeErrorNoClientCert means the client did not present a certificate.
+	HandshakeErrorUnknownCA       = "unknown_ca"       // HandshakeErrorUnknownCA means a certificate was not signed by a trusted authority.
+	HandshakeErrorExpiredCert     = "expired_cert"     // HandshakeErrorExpiredCert means a certificate has expired or is not yet valid.
+	HandshakeErrorBadCert         = "bad_cert"         // HandshakeErrorBadCert means a certificate was rejected for another reason.
+	HandshakeErrorProtocolVersion = "protocol_version" // HandshakeErrorProtocolVersion means the client and server share no TLS version.
+	HandshakeErrorNotTLS          = "not_tls"          // HandshakeErrorNotTLS means the client did not send TLS, e.g. plaintext or garbage bytes.
+	HandshakeErrorTimeout         = "timeout"          // HandshakeErrorTimeout means the handshake did not complete in time.
+	HandshakeErrorClientClosed    = "client_closed"    // HandshakeErrorClientClosed means the client hung up during the handshake.
+	HandshakeErrorOther           = "other"            // HandshakeErrorOther means the failure was not recognised.
+)
+
+// handshakeErrorClasses lists every class returned by ClassifyHandshakeError.
+var handshakeErrorClasses = []string{
+	HandshakeErrorNoClientCert,
+	HandshakeErrorUnknownCA,
+	HandshakeErrorExpiredCert,
+	HandshakeErrorBadCert,
+	HandshakeErrorProtocolVersion,
+	HandshakeErrorNotTLS,
+	HandshakeErrorTimeout,
+	HandshakeErrorClientClosed,
+	HandshakeErrorOther,
+}
+
+// ClassifyHandshakeError returns the class of the TLS handshake failure err,
+// so that operators can tell scanners and attacks (not_tls, client_closed)
+// apart from legitimate clients that are misconfigured (no_client_cert,
+// unknown_ca, expired_cert, protocol_version).
+//
+// crypto/tls reports many failures, including alerts sent by the client,
+// only as error strings, so some classes are recognised by their message.
+func ClassifyHandshakeError(err error) string {
+	var recordErr tls.RecordHeaderError
+	if errors.As(err, &recordErr) {
+		return HandshakeErrorNotTLS
+	}
+	var unknownAuthority x509.UnknownAuthorityError
+	if errors.As(err, &unknownAuthority) {
+		return HandshakeErrorUnknownCA
+	}
+	var invalid x509.CertificateInvalidError
+	if errors.As(err, &invalid) {
+		if invalid.Reason == x509.Expired {
+			return HandshakeErrorExpiredCert
+		}
+		return HandshakeErrorBadCert
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return HandshakeErrorTimeout
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return HandshakeErrorTimeout
+	}
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, net.ErrClosed) {
+		return HandshakeErrorClientClosed
+	}
+
+	msg := err.Error()
+	switch {
+	case strings.Contains(msg, "didn't provide a certificate"),
+		strings.Contains(msg, "certificate required"):
+		return HandshakeErrorNoClientCert
+	case strings.Contains(msg, "unknown authority"),
+		strings.Contains(msg, "unknown certificate authority"):
+		return HandshakeErrorUnknownCA
+	case strings.Contains(msg, "certificate has expired"),
+		strings.Contains(msg, "expired certificate"):
+		return HandshakeErrorExpiredCert
+	case strings.Contains(msg, "unsupported versions"),
+		strings.Contains(msg, "protocol version not supported"):
+		return HandshakeErrorProtocolVersion
+	case strings.Contains(msg, "bad certificate"),
+		strings.Contains(msg, "failed to verify"):
+		return HandshakeErrorBadCert
+	case strings.Contains(msg, "connection reset"):
+		return HandshakeErrorClientClosed
+	}
+	return HandshakeErrorOther
+}
+
+// HandshakeMetrics holds the metrics recorded by a HandshakeLimitingHandler.
+type HandshakeMetrics struct {
+	Completed   *metrics.Counter            // Completed counts TLS handshakes that succeeded.
+	Resumed     *metrics.Counter            // Resumed counts TLS handshakes that succeeded by resuming a session.
+	RateLimited *metrics.Counter            // RateLimited counts connections dropped by the RateLimiter.
+	Throttled   *metrics.Counter            // Throttled counts connections dropped before their handshake by the StartLimiter.
+	Failures    map[string]*metrics.Counter // Failures counts failed TLS handshakes, by ClassifyHandshakeError class.
+}
+
+// NewHandshakeMetrics returns HandshakeMetrics registered in the given Registry.
+func NewHandshakeMetrics(r *metrics.Registry) *HandshakeMetrics {
+	m := &HandshakeMetrics{
+		Completed:   r.Counter("tls_handshakes_completed_total"),
+		Resumed:     r.Counter("tls_handshakes_resumed_total"),
+		RateLimited: r.Counter("tls_handshakes_rate_limited_total"),
+		Throttled:   r.Counter("tls_handshakes_throttled_total"),
+		Failures:    make(map[string]*metrics.Counter, len(handshakeErrorClasses)),
+	}
+	for _, class := range handshakeErrorClasses {
+		m.Failures[class] = r.Counter("tls_handshake_failures_" + class + "_total")
+	}
+	return m
+}
+
+func (m *HandshakeMetrics) recordCompleted(resumed bool) {
+	if m == nil {
+		return
+	}
+	m.Completed.Inc()
+	if resumed {
+		m.Resumed.Inc()
+	}
+}
+
+func (m *HandshakeMetrics) recordRateLimited() {
+	if m != nil {
+		m.RateLimited.Inc()
+	}
+}
+
+func (m *HandshakeMetrics) recordThrottled() {
+	if m != nil {
+		m.Throttled.Inc()
+	}
+}
+
+func (m *HandshakeMetrics) recordFailure(class string) {
+	if m == nil {
+		return
+	}
+	if c, ok := m.Failures[class]; ok {
+		c.Inc()
+	}
+}
@@ -0,0 +1,67 @@
+package forwarder
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"github.com/stretchr/testify/require"
+	"net"
+	"tcplb/lib/accesslog"
+	"tcplb/lib/metrics"
+	"tcplb/lib/slog"
+	"testing"
+	"time"
+)
+
+func TestClassifyHandshakeError(t *testing.T) {
+	notTLS := handshakeError(t, func(conn net.Conn) {
+		_, _ = conn.Write([]byte("GET / HTTP/1.1\r\n\r\n"))
+	})
+	require.Equal(t, HandshakeErrorNotTLS, ClassifyHandshakeError(notTLS))
+
+	closed := handshakeError(t, func(conn net.Conn) {})
+	require.Equal(t, HandshakeErrorClientClosed, ClassifyHandshakeError(closed))
+
+	oldVersion := handshakeError(t, func(conn net.Conn) {
+		_ = tls.Client(conn, &tls.Config{InsecureSkipVerify: true, MaxVersion: tls.VersionTLS12}).Handshake()
+	})
+	require.Equal(t, HandshakeErrorProtocolVersion, ClassifyHandshakeError(oldVersion))
+
+	for msg, class := range map[string]string{
+		"tls: client didn't provide a certificate":                         HandshakeErrorNoClientCert,
+		"remote error: tls: unknown certificate authority":                 HandshakeErrorUnknownCA,
+		"tls: failed to verify certificate: x509: certificate has expired": HandshakeErrorExpiredCert,
+		"remote error: tls: bad certificate":                               HandshakeErrorBadCert,
+		"tls: something unexpected":                                        HandshakeErrorOther,
+	} {
+		require.Equal(t, class, ClassifyHandshakeError(errors.New(msg)), msg)
+	}
+	require.Equal(t, HandshakeErrorUnknownCA, ClassifyHandshakeError(fmt.Errorf("verify: %w", x509.UnknownAuthorityError{})))
+	require.Equal(t, HandshakeErrorTimeout, ClassifyHandshakeError(context.DeadlineExceeded))
+}
+
+func TestHandshakeLimitingHandlerClassifiesFailures(t *testing.T) {
+	registry := metrics.NewRegistry()
+	h := &HandshakeLimitingHandler{
+		Logger:  &slog.RecordingLogger{},
+		Metrics: NewHandshakeMetrics(registry),
+		Inner:   rejectingHandler{reason: accesslog.ReasonForwarded},
+	}
+	conn, peer := newPipeConns()
+	go func() {
+		_, _ = peer.Write([]byte("SSH-2.0-OpenSSH\r\n"))
+		_ = peer.Close()
+	}()
+	record := accesslog.NewRecord("client", time.Now())
+	h.Handle(accesslog.NewContextWithRecord(context.Background(), record), tls.Server(conn, &tls.Config{}))
+	require.Equal(t, accesslog.ReasonAuthnFailed, record.Reason())
+	require.Equal(t, int64(1), h.Metrics.Failures[HandshakeErrorNotTLS].Value())
+	require.Equal(t, int64(0), h.Metrics.Completed.Value())
+
+	var buf bytes.Buffer
+	accesslog.NewJSONLogger(&buf).Log(record)
+	require.Contains(t, buf.String(), `"handshake_error":"not_tls"`)
+}
@@ -0,0 +1,41 @@
+package forwarder
+
+import (
+	"context"
+	"tcplb/lib/accesslog"
+	"tcplb/lib/core"
+	"tcplb/lib/metrics"
+)
+
+// MemoryPressureSignal reports if the heap of the process is too large to
+// take on new client connections.
+//
+// Multiple goroutines may invoke methods on a MemoryPressureSignal
+// simultaneously.
+type MemoryPressureSignal interface {
+	Overloaded() bool
+}
+
+// MemoryShedHandler is a handler that drops client connections at once,
+// before the memory-hungry work of their TLS handshakes, while Signal
+// reports memory pressure, so that a flood of connections cannot grow the
+// heap until the process is killed for running out of memory. Connections
+// already being handled are unaffected. Dropped connections are not logged
+// one by one, as logging would add to the memory pressure, but are counted
+// in Dropped; the Signal may log when memory pressure starts and ends.
+type MemoryShedHandler struct {
+	Signal  MemoryPressureSignal
+	Dropped *metrics.Counter // Dropped is optional. If set, it counts the connections dropped.
+	Inner   Handler
+}
+
+func (h *MemoryShedHandler) Handle(ctx context.Context, conn core.DuplexConn) {
+	if h.Signal.Overloaded() {
+		h.Dropped.Inc()
+		accesslog.SetReason(ctx, accesslog.ReasonMemoryPressure)
+		return
+	}
+	h.Inner.Handle(ctx, conn)
+}
+
+var _ Handler = (*MemoryShedHandler)(nil) // type check
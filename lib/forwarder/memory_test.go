@@ -0,0 +1,32 @@
+package forwarder
+
+import (
+	"github.com/stretchr/testify/require"
+	"tcplb/lib/accesslog"
+	"tcplb/lib/metrics"
+	"testing"
+)
+
+// fixedMemoryPressure signals memory pressure if it is true.
+type fixedMemoryPressure bool
+
+func (p fixedMemoryPressure) Overloaded() bool {
+	return bool(p)
+}
+
+func TestMemoryShedHandler(t *testing.T) {
+	dropped := &metrics.Counter{}
+	for pressure, expected := range map[fixedMemoryPressure]accesslog.ReasonCode{
+		true:  accesslog.ReasonMemoryPressure,
+		false: accesslog.ReasonForwarded,
+	} {
+		conn, _ := newPipeConns()
+		h := &MemoryShedHandler{
+			Signal:  pressure,
+			Dropped: dropped,
+			Inner:   rejectingHandler{reason: accesslog.ReasonForwarded},
+		}
+		require.Equal(t, expected, handleRecordingReason(h, conn))
+	}
+	require.Equal(t, int64(1), dropped.Value())
+}
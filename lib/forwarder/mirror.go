@@ -0,0 +1,235 @@
+package forwarder
+
+import (
+	"context"
+	"io"
+	"sync"
+	"tcplb/lib/core"
+	"tcplb/lib/metrics"
+	"tcplb/lib/slog"
+	"time"
+)
+
+// MirrorMetrics holds the metrics recorded by a MirroringHandler.
+type MirrorMetrics struct {
+	Mirrored *metrics.Counter // Mirrored counts connections whose data was all copied to the mirror.
+	Failed   *metrics.Counter // Failed counts connections whose mirroring was abandoned.
+	Bytes    *metrics.Counter // Bytes counts bytes copied to the mirror.
+}
+
+// NewMirrorMetrics returns MirrorMetrics registered in the given Registry.
+func NewMirrorMetrics(r *metrics.Registry) *MirrorMetrics {
+	return &MirrorMetrics{
+		Mirrored: r.Counter("mirror_connections_total"),
+		Failed:   r.Counter("mirror_failed_total"),
+		Bytes:    r.Counter("mirror_bytes_total"),
+	}
+}
+
+func (m *MirrorMetrics) recordMirrored() {
+	if m == nil {
+		return
+	}
+	m.Mirrored.Inc()
+}
+
+func (m *MirrorMetrics) recordFailed() {
+	if m == nil {
+		return
+	}
+	m.Failed.Inc()
+}
+
+func (m *MirrorMetrics) recordBytes(n int) {
+	if m == nil {
+		return
+	}
+	m.Bytes.Add(int64(n))
+}
+
+// MirroringHandler is a handler that copies the data each client sends to
+// the Mirror upstream, as well as passing the connection on to the Inner
+// handler to be forwarded as usual, e.g. to try out a new deployment of an
+// upstream service with production traffic. Data the mirror sends back is
+// read and discarded.
+//
+// Mirroring is best effort and never holds up forwarding: the mirror is
+// dialed while the client's data is forwarded, and at most MaxBuffered
+// bytes wait to be written to it. If the mirror cannot be dialed, fails, or
+// falls further behind than that, mirroring of the connection is
+// abandoned.
+//
+// The Inner handler sees the connection wrapped, not as its original type,
+// e.g. *tls.Conn, so the MirroringHandler should only wrap the handlers
+// that forward data, after the client is authenticated and authorized.
+type MirroringHandler struct {
+	Logger slog.Logger
+	Dialer UpstreamDialer // Dialer dials the Mirror. It should bound the time spent dialing.
+	Mirror core.Upstream
+	// MaxBuffered bounds the bytes read from the client that wait to be
+	// written to the mirror, besides those being written. It must be
+	// positive.
+	MaxBuffered int
+	// Timeout bounds each write to the mirror, and the wait for the mirror
+	// to close its connection once the client's data is all written. If not
+	// positive, they are not bounded.
+	Timeout time.Duration
+	Metrics *MirrorMetrics // Metrics is optional. If nil, no metrics are recorded.
+	Inner   Handler
+}
+
+func (h *MirroringHandler) Handle(ctx context.Context, conn core.DuplexConn) {
+	m := newMirrorQueue(h.MaxBuffered)
+	go h.mirror(m)
+	defer m.finish()
+	h.Inner.Handle(ctx, &mirroredConn{WrappedConn: core.WrappedConn{DuplexConn: conn}, queue: m})
+}
+
+// mirror dials the Mirror and writes the data of m to it, until m is
+// finished or abandoned.
+func (h *MirroringHandler) mirror(m *mirrorQueue) {
+	// The mirror outlives the client connection while it catches up, so it
+	// is not dialed with the connection's context.
+	conn, err := h.Dialer.DialUpstream(context.Background(), h.Mirror)
+	if err != nil {
+		m.abandon()
+		h.Metrics.recordFailed()
+		h.Logger.Debug(&slog.LogRecord{Msg: "MirroringHandler: failed to dial mirror", Upstream: &h.Mirror, Error: err})
+		return
+	}
+	defer conn.Close()
+	drained := make(chan struct{})
+	go func() {
+		defer close(drained)
+		_, _ = io.Copy(io.Discard, conn)
+	}()
+
+	for {
+		chunk, ok := m.next()
+		if !ok {
+			break
+		}
+		if h.Timeout > 0 {
+			_ = conn.SetWriteDeadline(time.Now().Add(h.Timeout))
+		}
+		if _, err := conn.Write(chunk); err != nil {
+			m.abandon()
+			h.Metrics.recordFailed()
+			h.Logger.Debug(&slog.LogRecord{Msg: "MirroringHandler: mirror write error", Upstream: &h.Mirror, Error: err})
+			return
+		}
+		h.Metrics.recordBytes(len(chunk))
+	}
+	if m.abandoned() {
+		h.Metrics.recordFailed()
+		h.Logger.Debug(&slog.LogRecord{Msg: "MirroringHandler: mirror fell behind the client", Upstream: &h.Mirror})
+		return
+	}
+	// Wait for the mirror to close its end, so that closing ours does not
+	// reset the connection before the mirror has read everything.
+	_ = conn.CloseWrite()
+	if h.Timeout > 0 {
+		_ = conn.SetReadDeadline(time.Now().Add(h.Timeout))
+	}
+	<-drained
+	h.Metrics.recordMirrored()
+}
+
+// mirroredConn is a DuplexConn that queues a copy of the data read from it
+// to be written to a mirror.
+type mirroredConn struct {
+	core.WrappedConn
+	queue *mirrorQueue
+}
+
+func (c *mirroredConn) Read(p []byte) (int, error) {
+	n, err := c.DuplexConn.Read(p)
+	if n > 0 {
+		c.queue.push(p[:n])
+	}
+	return n, err
+}
+
+// mirrorQueue holds the data waiting to be written to a mirror.
+//
+// Multiple goroutines may invoke methods on a mirrorQueue simultaneously.
+type mirrorQueue struct {
+	max int // max bounds queued.
+
+	mu       sync.Mutex
+	cond     *sync.Cond // cond is signalled when chunks are pushed, or the queue is finished or abandoned.
+	chunks   [][]byte
+	queued   int  // queued is the total length of chunks.
+	finished bool // finished is set once no more chunks will be pushed.
+	failed   bool // failed is set once mirroring is abandoned.
+}
+
+func newMirrorQueue(maxQueued int) *mirrorQueue {
+	q := &mirrorQueue{max: maxQueued}
+	q.cond = sync.NewCond(&q.mu)
+	return q
+}
+
+// push queues a copy of p, or abandons mirroring if there is no room.
+func (q *mirrorQueue) push(p []byte) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.failed || q.finished {
+		return
+	}
+	if q.queued+len(p) > q.max {
+		q.abandonLocked()
+		return
+	}
+	q.chunks = append(q.chunks, append([]byte(nil), p...))
+	q.queued += len(p)
+	q.cond.Signal()
+}
+
+// next waits for the next chunk to write. It returns false once the queue
+// is finished and empty, or abandoned.
+func (q *mirrorQueue) next() ([]byte, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for len(q.chunks) == 0 && !q.finished && !q.failed {
+		q.cond.Wait()
+	}
+	if q.failed || len(q.chunks) == 0 {
+		return nil, false
+	}
+	chunk := q.chunks[0]
+	q.chunks[0] = nil
+	q.chunks = q.chunks[1:]
+	q.queued -= len(chunk)
+	return chunk, true
+}
+
+// finish marks that no more chunks will be pushed.
+func (q *mirrorQueue) finish() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.finished = true
+	q.cond.Broadcast()
+}
+
+// abandon drops the queued chunks and any pushed later.
+func (q *mirrorQueue) abandon() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.abandonLocked()
+}
+
+func (q *mirrorQueue) abandonLocked() {
+	q.failed = true
+	q.chunks = nil
+	q.queued = 0
+	q.cond.Broadcast()
+}
+
+func (q *mirrorQueue) abandoned() bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.failed
+}
+
+var _ Handler = (*MirroringHandler)(nil) // type check
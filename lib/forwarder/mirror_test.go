@@ -0,0 +1,140 @@
+package forwarder
+
+import (
+	"context"
+	"github.com/stretchr/testify/require"
+	"io"
+	"net"
+	"tcplb/lib/core"
+	"tcplb/lib/metrics"
+	"tcplb/lib/slog"
+	"testing"
+	"time"
+)
+
+// tcpUpstreamDialer dials upstreams over TCP.
+type tcpUpstreamDialer struct{}
+
+func (tcpUpstreamDialer) DialUpstream(ctx context.Context, upstream core.Upstream) (core.DuplexConn, error) {
+	conn, err := net.Dial(upstream.Network, upstream.Address)
+	if err != nil {
+		return nil, err
+	}
+	return conn.(*net.TCPConn), nil
+}
+
+// readingHandler reads everything the client sends.
+type readingHandler struct {
+	data []byte
+}
+
+func (h *readingHandler) Handle(ctx context.Context, conn core.DuplexConn) {
+	h.data, _ = io.ReadAll(conn)
+}
+
+// startMirror returns the address of a mirror that sends each connection's
+// data on the returned channel, once the connection is closed for writing.
+func startMirror(t *testing.T) (string, <-chan []byte) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = listener.Close() })
+	received := make(chan []byte, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		data, _ := io.ReadAll(conn)
+		received <- data
+	}()
+	return listener.Addr().String(), received
+}
+
+func newTestMirroringHandler(mirror string, inner Handler) (*MirroringHandler, *metrics.Registry) {
+	registry := metrics.NewRegistry()
+	return &MirroringHandler{
+		Logger:      &slog.RecordingLogger{},
+		Dialer:      tcpUpstreamDialer{},
+		Mirror:      core.Upstream{Network: "tcp", Address: mirror},
+		MaxBuffered: 1 << 20,
+		Timeout:     10 * time.Second,
+		Metrics:     NewMirrorMetrics(registry),
+		Inner:       inner,
+	}, registry
+}
+
+func TestMirroringHandler(t *testing.T) {
+	mirror, received := startMirror(t)
+	inner := &readingHandler{}
+	h, registry := newTestMirroringHandler(mirror, inner)
+	client, server := newPipeConns()
+	defer server.Close()
+	go func() {
+		_, _ = client.Write([]byte("hello "))
+		_, _ = client.Write([]byte("mirror"))
+		_ = client.Close()
+	}()
+
+	h.Handle(context.Background(), server)
+	require.Equal(t, "hello mirror", string(inner.data))
+	select {
+	case data := <-received:
+		require.Equal(t, "hello mirror", string(data))
+	case <-time.After(10 * time.Second):
+		t.Fatal("mirror did not receive the client's data")
+	}
+	require.Eventually(t, func() bool {
+		return registry.Snapshot()["mirror_connections_total"] == 1
+	}, 10*time.Second, time.Millisecond)
+	require.Equal(t, int64(len("hello mirror")), registry.Snapshot()["mirror_bytes_total"])
+	require.Equal(t, int64(0), registry.Snapshot()["mirror_failed_total"])
+}
+
+func TestMirroringHandlerForwardsIfMirrorFails(t *testing.T) {
+	// Nothing listens on the mirror's address.
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	mirror := listener.Addr().String()
+	require.NoError(t, listener.Close())
+	inner := &readingHandler{}
+	h, registry := newTestMirroringHandler(mirror, inner)
+	client, server := newPipeConns()
+	defer server.Close()
+	go func() {
+		_, _ = client.Write([]byte("hello"))
+		_ = client.Close()
+	}()
+
+	h.Handle(context.Background(), server)
+	require.Equal(t, "hello", string(inner.data))
+	require.Eventually(t, func() bool {
+		return registry.Snapshot()["mirror_failed_total"] == 1
+	}, 10*time.Second, time.Millisecond)
+}
+
+func TestMirrorQueueAbandonsWhenFull(t *testing.T) {
+	q := newMirrorQueue(8)
+	q.push([]byte("12345"))
+	q.push([]byte("678"))
+	chunk, ok := q.next()
+	require.True(t, ok)
+	require.Equal(t, "12345", string(chunk))
+
+	// Only what was written is no longer queued.
+	q.push([]byte("abcdef"))
+	require.True(t, q.abandoned())
+	_, ok = q.next()
+	require.False(t, ok)
+
+	q = newMirrorQueue(8)
+	q.push([]byte("1"))
+	q.finish()
+	q.push([]byte("2"))
+	chunk, ok = q.next()
+	require.True(t, ok)
+	require.Equal(t, "1", string(chunk))
+	_, ok = q.next()
+	require.False(t, ok)
+	require.False(t, q.abandoned())
+}
@@ -0,0 +1,156 @@
+package forwarder
+
+import (
+	"context"
+	"net"
+	"tcplb/lib/core"
+	"time"
+)
+
+// ConnID is core.ConnID, identifying a client connection accepted by a
+// Server, for the purpose of correlating lifecycle events of the same
+// connection.
+type ConnID = core.ConnID
+
+// AcceptEvent describes a client connection that has been accepted.
+type AcceptEvent struct {
+	ConnID     ConnID
+	RemoteAddr net.Addr
+	LocalAddr  net.Addr
+	Time       time.Time
+}
+
+// AuthenticatedEvent describes the outcome of authenticating a client.
+// If authentication failed, Err is non-nil and ClientID is the zero value.
+type AuthenticatedEvent struct {
+	ConnID   ConnID
+	ClientID core.ClientID
+	Err      error
+}
+
+// AuthorizedEvent describes the outcome of authorizing a client. If the
+// client is authorized for at least one upstream, Upstreams is non-empty.
+// Err is non-nil only if authorization could not be evaluated.
+type AuthorizedEvent struct {
+	ConnID    ConnID
+	ClientID  core.ClientID
+	Upstreams core.UpstreamSet
+	Err       error
+}
+
+// DialEvent describes the outcome of dialing an upstream for a client.
+type DialEvent struct {
+	ConnID   ConnID
+	ClientID core.ClientID
+	Upstream core.Upstream // Upstream is the zero value if the dial failed.
+	Duration time.Duration
+	Err      error
+}
+
+// ForwardDoneEvent describes a completed forwarding session.
+type ForwardDoneEvent struct {
+	ConnID   ConnID
+	ClientID core.ClientID
+	Upstream core.Upstream
+	Duration time.Duration
+	Err      error
+}
+
+// ConnectionLifecycleObserver receives events as client connections move
+// through the stages of the handler stack. It allows code embedding this
+// package to attach custom telemetry or policy glue.
+//
+// Observer methods are called synchronously from the goroutine handling
+// the connection, so implementations should return promptly.
+//
+// Multiple goroutines may invoke methods on a ConnectionLifecycleObserver
+// simultaneously.
+type ConnectionLifecycleObserver interface {
+	OnAccept(ctx context.Context, event AcceptEvent)
+	OnAuthenticated(ctx context.Context, event AuthenticatedEvent)
+	OnAuthorized(ctx context.Context, event AuthorizedEvent)
+	OnDial(ctx context.Context, event DialEvent)
+	OnForwardDone(ctx context.Context, event ForwardDoneEvent)
+}
+
+// NopObserver is a ConnectionLifecycleObserver that ignores all events.
+// It may be embedded by observers that are only interested in some events.
+type NopObserver struct{}
+
+func (NopObserver) OnAccept(ctx context.Context, event AcceptEvent)               {}
+func (NopObserver) OnAuthenticated(ctx context.Context, event AuthenticatedEvent) {}
+func (NopObserver) OnAuthorized(ctx context.Context, event AuthorizedEvent)       {}
+func (NopObserver) OnDial(ctx context.Context, event DialEvent)                   {}
+func (NopObserver) OnForwardDone(ctx context.Context, event ForwardDoneEvent)     {}
+
+var _ ConnectionLifecycleObserver = NopObserver{} // type check
+
+// Observers is a ConnectionLifecycleObserver that passes each event to
+// every observer in the list, in order.
+type Observers []ConnectionLifecycleObserver
+
+func (o Observers) OnAccept(ctx context.Context, event AcceptEvent) {
+	for _, obs := range o {
+		obs.OnAccept(ctx, event)
+	}
+}
+
+func (o Observers) OnAuthenticated(ctx context.Context, event AuthenticatedEvent) {
+	for _, obs := range o {
+		obs.OnAuthenticated(ctx, event)
+	}
+}
+
+func (o Observers) OnAuthorized(ctx context.Context, event AuthorizedEvent) {
+	for _, obs := range o {
+		obs.OnAuthorized(ctx, event)
+	}
+}
+
+func (o Observers) OnDial(ctx context.Context, event DialEvent) {
+	for _, obs := range o {
+		obs.OnDial(ctx, event)
+	}
+}
+
+func (o Observers) OnForwardDone(ctx context.Context, event ForwardDoneEvent) {
+	for _, obs := range o {
+		obs.OnForwardDone(ctx, event)
+	}
+}
+
+var _ ConnectionLifecycleObserver = Observers(nil) // type check
+
+type observerContextKeyType struct{}
+type connIDContextKeyType struct{}
+
+var observerContextKey = observerContextKeyType{}
+var connIDContextKey = connIDContextKeyType{}
+
+// NewContextWithObserver returns a child context of parent that carries
+// the observer that handlers should report lifecycle events to.
+func NewContextWithObserver(parent context.Context, observer ConnectionLifecycleObserver) context.Context {
+	return context.WithValue(parent, observerContextKey, observer)
+}
+
+// ObserverFromContext returns the observer stored in ctx. If there is
+// none, a NopObserver is returned.
+func ObserverFromContext(ctx context.Context) ConnectionLifecycleObserver {
+	observer, ok := ctx.Value(observerContextKey).(ConnectionLifecycleObserver)
+	if !ok {
+		return NopObserver{}
+	}
+	return observer
+}
+
+// NewContextWithConnID returns a child context of parent that carries
+// the ConnID of the client connection.
+func NewContextWithConnID(parent context.Context, id ConnID) context.Context {
+	return context.WithValue(parent, connIDContextKey, id)
+}
+
+// ConnIDFromContext returns the ConnID stored in ctx, or zero if there is none.
+func ConnIDFromContext(ctx context.Context) ConnID {
+	id, _ := ctx.Value(connIDContextKey).(ConnID)
+	return id
+}
@@ -0,0 +1,70 @@
+package forwarder
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/stretchr/testify/require"
+	"tcplb/lib/core"
+	"testing"
+)
+
+type recordingObserver struct {
+	NopObserver
+	events []string
+}
+
+func (o *recordingObserver) OnAuthenticated(ctx context.Context, event AuthenticatedEvent) {
+	o.events = append(o.events, fmt.Sprintf("authenticated %d %s", event.ConnID, event.ClientID.Key))
+}
+
+func (o *recordingObserver) OnAuthorized(ctx context.Context, event AuthorizedEvent) {
+	o.events = append(o.events, fmt.Sprintf("authorized %d %d", event.ConnID, len(event.Upstreams)))
+}
+
+func (o *recordingObserver) OnDial(ctx context.Context, event DialEvent) {
+	o.events = append(o.events, fmt.Sprintf("dial %d %s %v", event.ConnID, event.Upstream.Address, event.Err))
+}
+
+func (o *recordingObserver) OnForwardDone(ctx context.Context, event ForwardDoneEvent) {
+	o.events = append(o.events, fmt.Sprintf("forward done %d %s %v", event.ConnID, event.Upstream.Address, event.Err))
+}
+
+func TestObserverReceivesLifecycleEvents(t *testing.T) {
+	a := core.Upstream{Network: "handler-test", Address: "a"}
+	obs := &recordingObserver{}
+	ctx := NewContextWithObserver(NewContextWithConnID(context.Background(), 7), Observers{obs})
+
+	clientConn, _ := newPipeConns()
+	h := newTestHandlerStack(stubAuthorizer{upstreams: core.NewUpstreamSet(a)}, stubDialer{})
+	h.Handle(ctx, clientConn)
+
+	require.Equal(t, []string{
+		"authenticated 7 anon",
+		"authorized 7 1",
+		"dial 7 a <nil>",
+		"forward done 7 a <nil>",
+	}, obs.events)
+}
+
+func TestObserverReceivesDialFailure(t *testing.T) {
+	a := core.Upstream{Network: "handler-test", Address: "a"}
+	obs := &recordingObserver{}
+	ctx := NewContextWithObserver(context.Background(), obs)
+
+	clientConn, _ := newPipeConns()
+	h := newTestHandlerStack(stubAuthorizer{upstreams: core.NewUpstreamSet(a)}, stubDialer{err: errors.New("refused")})
+	h.Handle(ctx, clientConn)
+
+	require.Equal(t, []string{
+		"authenticated 0 anon",
+		"authorized 0 1",
+		"dial 0  refused",
+	}, obs.events)
+}
+
+func TestObserverFromContextMissingIsNop(t *testing.T) {
+	obs := ObserverFromContext(context.Background())
+	require.Equal(t, NopObserver{}, obs)
+	require.Zero(t, ConnIDFromContext(context.Background()))
+}
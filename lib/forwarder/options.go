@@ -0,0 +1,383 @@
+package forwarder
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"tcplb/lib/core"
+	"tcplb/lib/slog"
+	"tcplb/lib/trace"
+	"time"
+)
+
+// NoListener is returned by NewServer if neither WithListener nor
+// WithListenAddress is given.
+var NoListener = errors.New("server has no listener")
+
+// NoDialer is returned by NewServer if it must build the default handler
+// stack, but WithDialer is not given.
+var NoDialer = errors.New("server has no upstream dialer")
+
+// NoUpstreams is returned by NewServer if it must build the default handler
+// stack, but neither WithUpstreams nor WithAuthorizer is given.
+var NoUpstreams = errors.New("server has no upstreams")
+
+// ConflictingOptions is returned by NewServer if WithHandler is given
+// together with options that customise the default handler stack.
+var ConflictingOptions = errors.New("conflicting server options")
+
+// defaultAcceptErrorCooldown is how long NewServer's Server pauses after an
+// error accepting a connection, unless WithAcceptErrorCooldown is given.
+const defaultAcceptErrorCooldown = 100 * time.Millisecond
+
+// defaultClientID identifies every client of the default handler stack,
+// unless WithClientID is given.
+var defaultClientID = core.ClientID{Namespace: "anonymous", Key: "anonymous"}
+
+// ServerOption configures a Server built by NewServer.
+type ServerOption func(o *serverOptions) error
+
+type serverOptions struct {
+	server        *Server
+	network       string
+	address       string
+	customised    bool // customised is set by options that apply to the default handler stack.
+	edits         []func(c *Chain) error
+	upstreams     core.UpstreamSet
+	authorizer    Authorizer
+	dialer        BestUpstreamDialer
+	forwarder     Forwarder
+	reserver      ClientReserver
+	clientID      core.ClientID
+	preAuth       time.Duration
+	maxHandshakes int
+	handshakeWait time.Duration
+}
+
+// WithName sets the name that identifies the Server's Listener to handlers.
+func WithName(name string) ServerOption {
+	return func(o *serverOptions) error {
+		o.server.Name = name
+		return nil
+	}
+}
+
+// WithListener sets the Listener that the Server accepts client connections
+// from. Accepted connections must be *net.TCPConn or *tls.Conn.
+func WithListener(l net.Listener) ServerOption {
+	return func(o *serverOptions) error {
+		o.server.Listener = l
+		return nil
+	}
+}
+
+// WithListenAddress makes NewServer listen on the given network and address
+// for client connections, e.g. "tcp" and "127.0.0.1:4321".
+func WithListenAddress(network, address string) ServerOption {
+	return func(o *serverOptions) error {
+		o.network = network
+		o.address = address
+		return nil
+	}
+}
+
+// WithLogger sets the Logger of the Server and its default handler stack.
+// By default, records at InfoLevel and above are written to os.Stderr.
+func WithLogger(l slog.Logger) ServerOption {
+	return func(o *serverOptions) error {
+		o.server.Logger = l
+		return nil
+	}
+}
+
+// WithTracer sets the Tracer that traces client connections.
+func WithTracer(t *trace.Tracer) ServerOption {
+	return func(o *serverOptions) error {
+		o.server.Tracer = t
+		return nil
+	}
+}
+
+// WithMetrics sets where the Server records its metrics.
+func WithMetrics(m *ServerMetrics) ServerOption {
+	return func(o *serverOptions) error {
+		o.server.Metrics = m
+		return nil
+	}
+}
+
+// WithObserver sets the ConnectionLifecycleObserver of the Server.
+func WithObserver(observer ConnectionLifecycleObserver) ServerOption {
+	return func(o *serverOptions) error {
+		o.server.Observer = observer
+		return nil
+	}
+}
+
+// WithConnFilter sets the ConnFilter that decides which accepted
+// connections are handled.
+func WithConnFilter(f ConnFilter) ServerOption {
+	return func(o *serverOptions) error {
+		o.server.Filter = f
+		return nil
+	}
+}
+
+// WithTCPInfo makes the Server read the TCP state of each accepted socket
+// into its ConnInfo. See Server.ReadTCPInfo.
+func WithTCPInfo() ServerOption {
+	return func(o *serverOptions) error {
+		o.server.ReadTCPInfo = true
+		return nil
+	}
+}
+
+// WithAcceptErrorCooldown sets how long the Server pauses after an error
+// accepting a connection.
+func WithAcceptErrorCooldown(d time.Duration) ServerOption {
+	return func(o *serverOptions) error {
+		o.server.AcceptErrorCooldownDuration = d
+		return nil
+	}
+}
+
+// WithAcceptQueue bounds the number of client connections handled at once
+// to maxHandlers, queueing up to queueLength further accepted connections
+// until a handler is free. If the queue is full, policy decides whether to
+// stop accepting, or to drop connections. By default, every accepted
+// connection is handled at once.
+func WithAcceptQueue(maxHandlers, queueLength int, policy OverflowPolicy) ServerOption {
+	return func(o *serverOptions) error {
+		if policy != OverflowQueue && policy != OverflowReject {
+			return fmt.Errorf("unknown overflow policy %q", policy)
+		}
+		o.server.MaxHandlers = maxHandlers
+		o.server.AcceptQueueLength = queueLength
+		o.server.OverflowPolicy = policy
+		return nil
+	}
+}
+
+// WithHandler sets the Handler of each client connection, instead of the
+// default handler stack. The Handler is responsible for closing the
+// connection. It cannot be combined with options that customise the
+// default handler stack.
+func WithHandler(h Handler) ServerOption {
+	return func(o *serverOptions) error {
+		o.server.Handler = h
+		return nil
+	}
+}
+
+// customise returns a ServerOption that applies f to the default handler
+// stack.
+func customise(f func(o *serverOptions)) ServerOption {
+	return func(o *serverOptions) error {
+		o.customised = true
+		f(o)
+		return nil
+	}
+}
+
+// WithUpstreams sets the upstreams that every client may be forwarded to
+// by the default handler stack, unless WithAuthorizer is given.
+func WithUpstreams(upstreams ...core.Upstream) ServerOption {
+	return customise(func(o *serverOptions) {
+		o.upstreams = core.NewUpstreamSet(upstreams...)
+	})
+}
+
+// WithAuthorizer sets the Authorizer that decides which upstreams each
+// client may be forwarded to by the default handler stack.
+func WithAuthorizer(a Authorizer) ServerOption {
+	return customise(func(o *serverOptions) {
+		o.authorizer = a
+	})
+}
+
+// WithDialer sets the BestUpstreamDialer that the default handler stack
+// dials upstreams with, e.g. a *dialer.RetryDialer. It is required unless
+// WithHandler is given.
+func WithDialer(d BestUpstreamDialer) ServerOption {
+	return customise(func(o *serverOptions) {
+		o.dialer = d
+	})
+}
+
+// WithForwarder sets the Forwarder that the default handler stack copies
+// data between clients and upstreams with. By default, MediocreForwarder.
+func WithForwarder(f Forwarder) ServerOption {
+	return customise(func(o *serverOptions) {
+		o.forwarder = f
+	})
+}
+
+// WithClientID sets the ClientID that the default handler stack identifies
+// every client as. Embedders that authenticate clients should instead
+// replace the StageAuthn stage using WithChain.
+func WithClientID(c core.ClientID) ServerOption {
+	return customise(func(o *serverOptions) {
+		o.clientID = c
+	})
+}
+
+// WithReserver sets the ClientReserver that limits the connections each
+// client may make, e.g. a *limiter.UniformlyBoundedClientReserver. By
+// default, clients are not limited.
+func WithReserver(r ClientReserver) ServerOption {
+	return customise(func(o *serverOptions) {
+		o.reserver = r
+	})
+}
+
+// WithPreAuthTimeout bounds the time from accepting each client connection
+// until it is forwarded. By default, there is no bound.
+func WithPreAuthTimeout(d time.Duration) ServerOption {
+	return customise(func(o *serverOptions) {
+		o.preAuth = d
+	})
+}
+
+// WithHandshakeLimit bounds the number of client TLS handshakes in progress
+// at once. Further handshakes wait up to queueTimeout to start. By default,
+// there is no bound.
+func WithHandshakeLimit(maxConcurrent int, queueTimeout time.Duration) ServerOption {
+	return customise(func(o *serverOptions) {
+		o.maxHandshakes = maxConcurrent
+		o.handshakeWait = queueTimeout
+	})
+}
+
+// WithChain applies edit to the Chain of the default handler stack before
+// it is built, so that embedders may insert their own stages relative to
+// the named stages of the default stack, or remove stages. Edits are
+// applied in the order given.
+func WithChain(edit func(c *Chain) error) ServerOption {
+	return customise(func(o *serverOptions) {
+		o.edits = append(o.edits, edit)
+	})
+}
+
+// WithMiddleware inserts stages into the default handler stack, before
+// clients are authenticated.
+func WithMiddleware(stages ...Stage) ServerOption {
+	return WithChain(func(c *Chain) error {
+		return c.InsertBefore(StageAuthn, stages...)
+	})
+}
+
+// NewServer returns a Server configured by the given options, so that other
+// programs can embed the load balancer. A listener must be given by
+// WithListener or WithListenAddress.
+//
+// Unless WithHandler is given, each client connection is handled by a
+// default handler stack that identifies the client as an anonymous client,
+// limits its connections, and forwards it to the best upstream that it is
+// authorized for, as dialed by the Dialer given by WithDialer.
+func NewServer(opts ...ServerOption) (*Server, error) {
+	o := &serverOptions{
+		server:    &Server{AcceptErrorCooldownDuration: defaultAcceptErrorCooldown},
+		clientID:  defaultClientID,
+		forwarder: MediocreForwarder{},
+	}
+	for _, opt := range opts {
+		if err := opt(o); err != nil {
+			return nil, err
+		}
+	}
+	if o.server.Logger == nil {
+		o.server.Logger = slog.NewLogger(slog.Options{})
+	}
+	if o.server.Handler == nil {
+		handler, err := o.defaultHandler()
+		if err != nil {
+			return nil, err
+		}
+		o.server.Handler = handler
+	} else if o.customised {
+		return nil, ConflictingOptions
+	}
+	if o.server.Listener == nil {
+		if o.address == "" {
+			return nil, NoListener
+		}
+		listener, err := net.Listen(o.network, o.address)
+		if err != nil {
+			return nil, err
+		}
+		o.server.Listener = listener
+	}
+	return o.server, nil
+}
+
+// defaultHandler returns the default handler stack.
+func (o *serverOptions) defaultHandler() (Handler, error) {
+	if o.dialer == nil {
+		return nil, NoDialer
+	}
+	authorizer := o.authorizer
+	if authorizer == nil {
+		if len(o.upstreams) == 0 {
+			return nil, NoUpstreams
+		}
+		authorizer = staticAuthorizer{upstreams: o.upstreams}
+	}
+	logger := o.server.Logger
+
+	var stages []Stage
+	add := func(name string, m Middleware) {
+		stages = append(stages, Stage{Name: name, Middleware: m})
+	}
+	add(StageClose, func(inner Handler) Handler {
+		return &ConnCloserHandler{Inner: inner}
+	})
+	if o.preAuth > 0 {
+		add(StagePreAuthDeadline, func(inner Handler) Handler {
+			return &PreAuthDeadlineHandler{Logger: logger, Budget: o.preAuth, Inner: inner}
+		})
+	}
+	if o.maxHandshakes > 0 {
+		add(StageHandshakeLimit, func(inner Handler) Handler {
+			return &HandshakeLimitingHandler{Logger: logger, MaxConcurrent: o.maxHandshakes, QueueTimeout: o.handshakeWait, Inner: inner}
+		})
+	}
+	add(StageAuthn, func(inner Handler) Handler {
+		return &AnonymousAuthenticationHandler{Logger: logger, Anonymous: o.clientID, Inner: inner}
+	})
+	if o.reserver != nil {
+		add(StageRateLimit, func(inner Handler) Handler {
+			return &RateLimitingHandler{Logger: logger, Reserver: o.reserver, Inner: inner}
+		})
+	}
+	add(StageAuthz, func(inner Handler) Handler {
+		return &AuthorizedUpstreamsHandler{Logger: logger, Authorizer: authorizer, Inner: inner}
+	})
+
+	chain, err := NewChain(stages...)
+	if err != nil {
+		return nil, err
+	}
+	for _, edit := range o.edits {
+		if err := edit(chain); err != nil {
+			return nil, err
+		}
+	}
+	return chain.Then(&ForwardingHandler{
+		Logger:    logger,
+		Dialer:    o.dialer,
+		Forwarder: o.forwarder,
+	}), nil
+}
+
+// staticAuthorizer is an Authorizer that authorizes every client for the
+// same upstreams.
+type staticAuthorizer struct {
+	upstreams core.UpstreamSet
+}
+
+func (a staticAuthorizer) AuthorizedUpstreams(ctx context.Context, c core.ClientID) (core.UpstreamSet, error) {
+	return a.upstreams, nil
+}
+
+var _ Authorizer = staticAuthorizer{} // type check
@@ -0,0 +1,287 @@
+package forwarder
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"sort"
+	"sync"
+	"tcplb/lib/accesslog"
+	"tcplb/lib/core"
+	"tcplb/lib/routing"
+	"tcplb/lib/slog"
+	"tcplb/lib/trace"
+	"time"
+)
+
+// NoPoolInContext is returned by PoolDialer and PoolReserver when a
+// connection has not been routed to a Pool.
+var NoPoolInContext = errors.New("no pool in context")
+
+// NoSuchPool is returned when an operation refers to a pool that does not
+// exist.
+var NoSuchPool = errors.New("no such pool")
+
+// Pool is a named set of upstreams, together with the policies used to
+// forward client connections to them.
+//
+// The upstreams of a Pool may be replaced while it is in use, e.g. as
+// upstreams are discovered or retired, without disturbing connections:
+// connections already forwarded keep their upstream, while connections
+// that have yet to dial choose from the new upstreams.
+type Pool struct {
+	Name      string
+	Upstreams core.UpstreamSet   // Upstreams are the initial upstreams of the pool. Use CurrentUpstreams once the pool is in use.
+	Dialer    BestUpstreamDialer // Dialer selects and dials an upstream of the pool.
+	Reserver  ClientReserver     // Reserver limits the connections each client may make to the pool.
+
+	// ProxyHeader is optional. If set, the Dialer sends a PROXY protocol
+	// v2 header to each upstream it dials, before any client data, e.g.
+	// with dialer.WithProxyHeader.
+	ProxyHeader *ProxyHeaderConfig
+
+	// HalfOpenTimeout bounds the time a connection forwarded to the pool
+	// may keep copying in one direction after copying in the other has
+	// finished. If not positive, there is no bound.
+	HalfOpenTimeout time.Duration
+
+	mu       sync.RWMutex // mu guards replaced and current
+	replaced bool
+	current  core.UpstreamSet
+}
+
+// CurrentUpstreams returns the upstreams of the pool: those it was last
+// replaced with, or else Upstreams. The caller must not modify them.
+func (p *Pool) CurrentUpstreams() core.UpstreamSet {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if p.replaced {
+		return p.current
+	}
+	return p.Upstreams
+}
+
+// ReplaceUpstreams atomically replaces the upstreams of the pool with a
+// copy of upstreams, and returns those added and removed by the change.
+// Connections to removed upstreams are unaffected, so callers should treat
+// removed upstreams as draining until their connections finish.
+func (p *Pool) ReplaceUpstreams(upstreams core.UpstreamSet) (added, removed core.UpstreamSet) {
+	next := core.Union(upstreams, nil)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	previous := p.Upstreams
+	if p.replaced {
+		previous = p.current
+	}
+	p.replaced, p.current = true, next
+	return core.Difference(next, previous), core.Difference(previous, next)
+}
+
+type poolContextKeyType struct{}
+type listenerNameContextKeyType struct{}
+
+var poolContextKey = poolContextKeyType{}
+var listenerNameContextKey = listenerNameContextKeyType{}
+
+// NewContextWithPool returns a child context of parent that carries the
+// Pool the client connection has been routed to.
+func NewContextWithPool(parent context.Context, pool *Pool) context.Context {
+	return context.WithValue(parent, poolContextKey, pool)
+}
+
+// PoolFromContext returns the Pool stored in ctx, if any.
+func PoolFromContext(ctx context.Context) (*Pool, bool) {
+	pool, ok := ctx.Value(poolContextKey).(*Pool)
+	return pool, ok
+}
+
+// NewContextWithListenerName returns a child context of parent that carries
+// the name of the listener that accepted the client connection.
+func NewContextWithListenerName(parent context.Context, name string) context.Context {
+	return context.WithValue(parent, listenerNameContextKey, name)
+}
+
+// ListenerNameFromContext returns the listener name stored in ctx, or the
+// empty string if there is none.
+func ListenerNameFromContext(ctx context.Context) string {
+	name, _ := ctx.Value(listenerNameContextKey).(string)
+	return name
+}
+
+// PoolDialer is a BestUpstreamDialer that delegates to the Dialer of the
+// Pool that the connection has been routed to.
+type PoolDialer struct{}
+
+func (PoolDialer) DialBestUpstream(ctx context.Context, candidates core.UpstreamSet) (core.Upstream, core.DuplexConn, error) {
+	pool, ok := PoolFromContext(ctx)
+	if !ok {
+		return core.Upstream{}, nil, NoPoolInContext
+	}
+	return pool.Dialer.DialBestUpstream(ctx, candidates)
+}
+
+// ReportUpstreamFailure delegates to the Dialer of the Pool that the
+// connection has been routed to, if it is an UpstreamFailureReporter.
+func (PoolDialer) ReportUpstreamFailure(ctx context.Context, u core.Upstream, err error) {
+	pool, ok := PoolFromContext(ctx)
+	if !ok {
+		return
+	}
+	if reporter, ok := pool.Dialer.(UpstreamFailureReporter); ok {
+		reporter.ReportUpstreamFailure(ctx, u, err)
+	}
+}
+
+var _ BestUpstreamDialer = PoolDialer{}      // type check
+var _ UpstreamFailureReporter = PoolDialer{} // type check
+
+// PoolReserver is a ClientReserver that delegates to the Reserver of the
+// Pool that the connection has been routed to, so that each Pool limits
+// clients independently.
+type PoolReserver struct {
+	Pools map[string]*Pool // Pools are consulted by Reservations.
+}
+
+func (r PoolReserver) TryReserve(ctx context.Context, c core.ClientID) error {
+	pool, ok := PoolFromContext(ctx)
+	if !ok {
+		return NoPoolInContext
+	}
+	return pool.Reserver.TryReserve(ctx, c)
+}
+
+func (r PoolReserver) ReleaseReservation(ctx context.Context, c core.ClientID) error {
+	pool, ok := PoolFromContext(ctx)
+	if !ok {
+		return NoPoolInContext
+	}
+	return pool.Reserver.ReleaseReservation(ctx, c)
+}
+
+// RenewReservation delegates to the Reserver of the Pool that the
+// connection has been routed to, if it is a ReservationRenewer.
+func (r PoolReserver) RenewReservation(ctx context.Context, c core.ClientID) error {
+	pool, ok := PoolFromContext(ctx)
+	if !ok {
+		return NoPoolInContext
+	}
+	if renewer, ok := pool.Reserver.(ReservationRenewer); ok {
+		return renewer.RenewReservation(ctx, c)
+	}
+	return nil
+}
+
+// Reservations returns the reservations held by each client in each Pool.
+func (r PoolReserver) Reservations() []ClientReservations {
+	var result []ClientReservations
+	for name, pool := range r.Pools {
+		lister, ok := pool.Reserver.(interface {
+			Reservations() []ClientReservations
+		})
+		if !ok {
+			continue
+		}
+		for _, res := range lister.Reservations() {
+			res.Pool = name
+			result = append(result, res)
+		}
+	}
+	return result
+}
+
+// ClientReservations returns the reservations held by client c in each
+// Pool, with the limit that applies to it, including Pools where it holds
+// none.
+func (r PoolReserver) ClientReservations(c core.ClientID) []ClientReservations {
+	var result []ClientReservations
+	for name, pool := range r.Pools {
+		lister, ok := pool.Reserver.(interface {
+			ClientReservations(c core.ClientID) ClientReservations
+		})
+		if !ok {
+			continue
+		}
+		res := lister.ClientReservations(c)
+		res.Pool = name
+		result = append(result, res)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Pool < result[j].Pool })
+	return result
+}
+
+var _ ClientReserver = PoolReserver{}     // type check
+var _ ReservationRenewer = PoolReserver{} // type check
+
+// GroupResolver resolves the groups that a client belongs to.
+//
+// Multiple goroutines may invoke methods on a GroupResolver simultaneously.
+type GroupResolver interface {
+	ClientGroups(ctx context.Context, c core.ClientID) ([]string, error)
+}
+
+// Router selects the name of the pool to forward a connection to.
+//
+// Multiple goroutines may invoke methods on a Router simultaneously.
+type Router interface {
+	Route(req routing.Request) (pool string, ok bool)
+}
+
+// RoutingHandler is a handler that selects the Pool that the client
+// connection will be forwarded to. The Pool is stored in the child context
+// passed to the Inner Handler, and can be extracted with PoolFromContext.
+// A ClientID is expected to be found in the context.
+type RoutingHandler struct {
+	Logger slog.Logger
+	Router Router
+	Groups GroupResolver // Groups is optional. If nil, clients belong to no groups.
+	Pools  map[string]*Pool
+	Inner  Handler
+}
+
+func (h *RoutingHandler) Handle(ctx context.Context, conn core.DuplexConn) {
+	clientID, ok := ClientIDFromContext(ctx)
+	if !ok {
+		h.Logger.Error(&slog.LogRecord{Msg: "RoutingHandler: Failed to get ClientID from context", Reason: accesslog.ReasonInternalError})
+		accesslog.SetReason(ctx, accesslog.ReasonInternalError)
+		return
+	}
+
+	_, span := trace.StartSpan(ctx, "route")
+	req := routing.Request{Listener: ListenerNameFromContext(ctx)}
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		state := tlsConn.ConnectionState()
+		req.SNI = state.ServerName
+		if len(state.PeerCertificates) > 0 {
+			req.SetCertificate(state.PeerCertificates[0])
+		}
+	}
+	if h.Groups != nil {
+		groups, err := h.Groups.ClientGroups(ctx, clientID)
+		if err != nil {
+			span.RecordError(err)
+			span.End()
+			h.Logger.Error(&slog.LogRecord{Msg: "RoutingHandler: ClientGroups error", Reason: accesslog.ReasonInternalError, ClientID: &clientID, Error: err})
+			accesslog.SetReason(ctx, accesslog.ReasonInternalError)
+			return
+		}
+		req.ClientGroups = groups
+	}
+	name, ok := h.Router.Route(req)
+	span.SetAttribute("tcplb.pool", name)
+	span.End()
+	if !ok {
+		h.Logger.Warn(&slog.LogRecord{Msg: "RoutingHandler: No route matches connection", Reason: accesslog.ReasonNoRoute, ClientID: &clientID, Details: req})
+		accesslog.SetReason(ctx, accesslog.ReasonNoRoute)
+		return
+	}
+	pool, ok := h.Pools[name]
+	if !ok {
+		h.Logger.Error(&slog.LogRecord{Msg: "RoutingHandler: Route refers to unknown pool", Reason: accesslog.ReasonInternalError, ClientID: &clientID, Details: name})
+		accesslog.SetReason(ctx, accesslog.ReasonInternalError)
+		return
+	}
+	accesslog.RecordFromContext(ctx).SetPool(name)
+	h.Inner.Handle(NewContextWithPool(ctx, pool), conn)
+}
+
+var _ Handler = (*RoutingHandler)(nil) // type check
@@ -0,0 +1,92 @@
+package forwarder
+
+import (
+	"bytes"
+	"context"
+	"github.com/stretchr/testify/require"
+	"tcplb/lib/accesslog"
+	"tcplb/lib/core"
+	"tcplb/lib/routing"
+	"tcplb/lib/slog"
+	"testing"
+	"time"
+)
+
+type stubGroups []string
+
+func (g stubGroups) ClientGroups(ctx context.Context, c core.ClientID) ([]string, error) {
+	return g, nil
+}
+
+func TestRoutingHandlerSelectsPool(t *testing.T) {
+	web1 := core.Upstream{Network: "handler-test", Address: "web1"}
+	admin1 := core.Upstream{Network: "handler-test", Address: "admin1"}
+	webDialer := &recordingDialer{}
+	adminDialer := &recordingDialer{}
+	pools := map[string]*Pool{
+		"web":   {Name: "web", Upstreams: core.NewUpstreamSet(web1), Dialer: webDialer, Reserver: unboundedReserver{}},
+		"admin": {Name: "admin", Upstreams: core.NewUpstreamSet(admin1), Dialer: adminDialer, Reserver: unboundedReserver{}},
+	}
+	router := routing.NewTable(
+		routing.Rule{Pool: "admin", ClientGroup: "staff"},
+		routing.Rule{Pool: "web", Listener: "main"},
+	)
+	// The client is authorized for upstreams of both pools.
+	authorizer := stubAuthorizer{upstreams: core.NewUpstreamSet(web1, admin1)}
+	newRoutingHandler := func(groups GroupResolver) Handler {
+		return newTestHandlerStack(authorizer, PoolDialer{}, func(inner Handler) Handler {
+			return &RoutingHandler{
+				Logger: &slog.RecordingLogger{},
+				Router: router,
+				Groups: groups,
+				Pools:  pools,
+				Inner:  &RateLimitingHandler{Logger: &slog.RecordingLogger{}, Reserver: PoolReserver{Pools: pools}, Inner: inner},
+			}
+		})
+	}
+
+	ctx := NewContextWithListenerName(context.Background(), "main")
+	clientConn, _ := newPipeConns()
+	newRoutingHandler(stubGroups{"staff"}).Handle(ctx, clientConn)
+	require.Equal(t, []core.UpstreamSet{core.NewUpstreamSet(admin1)}, adminDialer.candidates)
+
+	newRoutingHandler(nil).Handle(ctx, clientConn)
+	require.Equal(t, []core.UpstreamSet{core.NewUpstreamSet(web1)}, webDialer.candidates)
+
+	// Neither rule matches, so the connection is rejected.
+	record := accesslog.NewRecord("client", time.Now())
+	ctx = accesslog.NewContextWithRecord(context.Background(), record)
+	newRoutingHandler(nil).Handle(ctx, clientConn)
+	require.Len(t, webDialer.candidates, 1)
+	var buf bytes.Buffer
+	accesslog.NewJSONLogger(&buf).Log(record)
+	require.Contains(t, buf.String(), `"reason":"no_route"`)
+}
+
+func TestPoolReplaceUpstreams(t *testing.T) {
+	web1 := core.Upstream{Network: "handler-test", Address: "web1"}
+	web2 := core.Upstream{Network: "handler-test", Address: "web2"}
+	web3 := core.Upstream{Network: "handler-test", Address: "web3"}
+	webDialer := &recordingDialer{}
+	pool := &Pool{Name: "web", Upstreams: core.NewUpstreamSet(web1, web2), Dialer: webDialer, Reserver: unboundedReserver{}}
+	require.Equal(t, core.NewUpstreamSet(web1, web2), pool.CurrentUpstreams())
+
+	next := core.NewUpstreamSet(web2, web3)
+	added, removed := pool.ReplaceUpstreams(next)
+	require.Equal(t, core.NewUpstreamSet(web3), added)
+	require.Equal(t, core.NewUpstreamSet(web1), removed)
+	delete(next, web3) // The pool keeps its own copy.
+	require.Equal(t, core.NewUpstreamSet(web2, web3), pool.CurrentUpstreams())
+	require.Equal(t, core.NewUpstreamSet(web1, web2), pool.Upstreams)
+
+	// New connections dial the authorized upstreams of the new set.
+	authorizer := stubAuthorizer{upstreams: core.NewUpstreamSet(web1, web2, web3)}
+	h := newTestHandlerStack(authorizer, PoolDialer{})
+	clientConn, _ := newPipeConns()
+	h.Handle(NewContextWithPool(context.Background(), pool), clientConn)
+	require.Equal(t, []core.UpstreamSet{core.NewUpstreamSet(web2, web3)}, webDialer.candidates)
+
+	added, removed = pool.ReplaceUpstreams(core.NewUpstreamSet(web2, web3))
+	require.Empty(t, added)
+	require.Empty(t, removed)
+}
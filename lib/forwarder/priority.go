@@ -0,0 +1,169 @@
+package forwarder
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"tcplb/lib/accesslog"
+	"tcplb/lib/core"
+	"tcplb/lib/metrics"
+	"tcplb/lib/slog"
+	"tcplb/lib/trace"
+)
+
+// ServerOverloaded is core.ServerOverloaded, returned, possibly wrapped,
+// by a LoadShedder when a connection is not admitted because the server is
+// at capacity, or overloaded.
+var ServerOverloaded = core.ServerOverloaded
+
+// LoadShedder is core.LoadShedder, admitting client connections by
+// priority.
+type LoadShedder = core.LoadShedder
+
+// DefaultPriorityClass is the priority class of clients in none of the
+// classes of a PriorityClasses. It has the lowest priority.
+const DefaultPriorityClass = "default"
+
+// PriorityClasses assigns clients to priority classes by the groups they
+// belong to. Each class is named by a group. A client in several classes is
+// in the one of highest priority.
+//
+// Multiple goroutines may invoke methods on a PriorityClasses
+// simultaneously, provided its fields are not modified.
+type PriorityClasses struct {
+	Classes  []string      // Classes are the groups that are priority classes, from highest priority to lowest.
+	Resolver GroupResolver // Resolver resolves the groups that clients belong to. It is required if Classes is not empty.
+}
+
+// Names returns the names of every class, from highest priority to lowest,
+// ending with DefaultPriorityClass.
+func (p *PriorityClasses) Names() []string {
+	return append(append([]string(nil), p.Classes...), DefaultPriorityClass)
+}
+
+// Class returns the name and priority of the class of client c. Classes
+// have priorities from len(Classes), for the first, down to 0, for
+// DefaultPriorityClass.
+func (p *PriorityClasses) Class(ctx context.Context, c core.ClientID) (string, int, error) {
+	if len(p.Classes) == 0 || p.Resolver == nil {
+		return DefaultPriorityClass, 0, nil
+	}
+	groups, err := p.Resolver.ClientGroups(ctx, c)
+	if err != nil {
+		return "", 0, err
+	}
+	member := make(map[string]bool, len(groups))
+	for _, g := range groups {
+		member[g] = true
+	}
+	for i, class := range p.Classes {
+		if member[class] {
+			return class, len(p.Classes) - i, nil
+		}
+	}
+	return DefaultPriorityClass, 0, nil
+}
+
+// ShedMetrics holds the metrics recorded by a PrioritizingHandler, by
+// priority class.
+type ShedMetrics struct {
+	Admitted map[string]*metrics.Counter // Admitted counts admitted connections.
+	Rejected map[string]*metrics.Counter // Rejected counts connections not admitted, as the server was overloaded.
+	Shed     map[string]*metrics.Counter // Shed counts admitted connections later dropped in favour of connections of higher priority.
+}
+
+// NewShedMetrics returns ShedMetrics for the given classes, registered in
+// the given Registry.
+func NewShedMetrics(r *metrics.Registry, classes []string) *ShedMetrics {
+	m := &ShedMetrics{
+		Admitted: make(map[string]*metrics.Counter, len(classes)),
+		Rejected: make(map[string]*metrics.Counter, len(classes)),
+		Shed:     make(map[string]*metrics.Counter, len(classes)),
+	}
+	for _, class := range classes {
+		m.Admitted[class] = r.Counter("priority_" + class + "_admitted_total")
+		m.Rejected[class] = r.Counter("priority_" + class + "_rejected_total")
+		m.Shed[class] = r.Counter("priority_" + class + "_shed_total")
+	}
+	return m
+}
+
+func (m *ShedMetrics) recordAdmitted(class string) {
+	if m == nil {
+		return
+	}
+	m.Admitted[class].Inc()
+}
+
+func (m *ShedMetrics) recordRejected(class string) {
+	if m == nil {
+		return
+	}
+	m.Rejected[class].Inc()
+}
+
+func (m *ShedMetrics) recordShed(class string) {
+	if m == nil {
+		return
+	}
+	m.Shed[class].Inc()
+}
+
+// PrioritizingHandler is a handler that only allows the Inner handler to
+// Handle the connection if the Shedder admits it, given the priority of the
+// client's class. Once the server is at capacity or overloaded, connections
+// of lower priority classes are shed first: the client connection is
+// closed, which causes the Inner handler to stop. A ClientID is expected to
+// be found in the context.
+type PrioritizingHandler struct {
+	Logger  slog.Logger
+	Shedder LoadShedder
+	Classes *PriorityClasses
+	Metrics *ShedMetrics // Metrics is optional. If nil, no metrics are recorded.
+	Inner   Handler
+}
+
+func (h *PrioritizingHandler) Handle(ctx context.Context, conn core.DuplexConn) {
+	clientID, ok := ClientIDFromContext(ctx)
+	if !ok {
+		h.Logger.Error(&slog.LogRecord{Msg: "PrioritizingHandler: Failed to get ClientID from context", Reason: accesslog.ReasonInternalError})
+		accesslog.SetReason(ctx, accesslog.ReasonInternalError)
+		return
+	}
+
+	_, span := trace.StartSpan(ctx, "priority")
+	class, priority, err := h.Classes.Class(ctx, clientID)
+	if err != nil {
+		span.RecordError(err)
+		span.End()
+		h.Logger.Error(&slog.LogRecord{Msg: "PrioritizingHandler: Class error", Reason: accesslog.ReasonInternalError, ClientID: &clientID, Error: err})
+		accesslog.SetReason(ctx, accesslog.ReasonInternalError)
+		return
+	}
+	span.SetAttribute("tcplb.priority_class", class)
+	shed := func() {
+		h.Metrics.recordShed(class)
+		h.Logger.Warn(&slog.LogRecord{Msg: "PrioritizingHandler: Connection shed for one of higher priority", Reason: accesslog.ReasonShed, ClientID: &clientID, Details: class})
+		accesslog.SetReason(ctx, accesslog.ReasonShed)
+		_ = conn.Close()
+	}
+	release, err := h.Shedder.Admit(priority, shed)
+	span.RecordError(err)
+	span.End()
+	if err != nil {
+		if errors.Is(err, ServerOverloaded) {
+			h.Metrics.recordRejected(class)
+			h.Logger.Warn(&slog.LogRecord{Msg: "PrioritizingHandler: Server overloaded", Reason: accesslog.ReasonOverloaded, ClientID: &clientID, Details: class + " priority " + strconv.Itoa(priority)})
+			accesslog.SetReason(ctx, accesslog.ReasonOverloaded)
+		} else {
+			h.Logger.Error(&slog.LogRecord{Msg: "PrioritizingHandler: Admit error", Reason: accesslog.ReasonInternalError, ClientID: &clientID, Error: err})
+			accesslog.SetReason(ctx, accesslog.ReasonInternalError)
+		}
+		return
+	}
+	defer release()
+	h.Metrics.recordAdmitted(class)
+	h.Inner.Handle(ctx, conn)
+}
+
+var _ Handler = (*PrioritizingHandler)(nil) // type check
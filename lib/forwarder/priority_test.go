@@ -0,0 +1,92 @@
+package forwarder
+
+import (
+	"context"
+	"github.com/stretchr/testify/require"
+	"tcplb/lib/accesslog"
+	"tcplb/lib/core"
+	"tcplb/lib/metrics"
+	"tcplb/lib/slog"
+	"testing"
+	"time"
+)
+
+// fakeLoadShedder admits connections of at least MinPriority, remembering
+// the priority and shed func of the last one admitted.
+type fakeLoadShedder struct {
+	MinPriority int
+
+	priority int
+	shed     func()
+	released bool
+}
+
+func (s *fakeLoadShedder) Admit(priority int, shed func()) (func(), error) {
+	s.priority = priority
+	if priority < s.MinPriority {
+		return nil, ServerOverloaded
+	}
+	s.shed, s.released = shed, false
+	return func() { s.released = true }, nil
+}
+
+// sheddingHandler sheds its own connection, as if to admit another of higher
+// priority.
+type sheddingHandler struct {
+	shedder *fakeLoadShedder
+}
+
+func (h sheddingHandler) Handle(ctx context.Context, conn core.DuplexConn) {
+	h.shedder.shed()
+	if _, err := conn.Write([]byte("x")); err == nil {
+		accesslog.SetReason(ctx, accesslog.ReasonForwarded)
+	}
+}
+
+func TestPrioritizingHandler(t *testing.T) {
+	admin := core.ClientID{Namespace: "test", Key: "admin"}
+	staff := core.ClientID{Namespace: "test", Key: "staff"}
+	other := core.ClientID{Namespace: "test", Key: "other"}
+	classes := &PriorityClasses{
+		Classes:  []string{"ops", "staff"},
+		Resolver: groupsByClient{admin: {"staff", "ops"}, staff: {"web", "staff"}, other: {"web"}},
+	}
+	require.Equal(t, []string{"ops", "staff", DefaultPriorityClass}, classes.Names())
+	for c, want := range map[core.ClientID]int{admin: 2, staff: 1, other: 0} {
+		_, priority, err := classes.Class(context.Background(), c)
+		require.NoError(t, err)
+		require.Equal(t, want, priority, c)
+	}
+
+	shedder := &fakeLoadShedder{MinPriority: 1}
+	registry := metrics.NewRegistry()
+	h := &PrioritizingHandler{
+		Logger:  &slog.RecordingLogger{},
+		Shedder: shedder,
+		Classes: classes,
+		Metrics: NewShedMetrics(registry, classes.Names()),
+		Inner:   &clientIDRecordingHandler{},
+	}
+	handle := func(c core.ClientID) accesslog.ReasonCode {
+		clientConn, _ := newPipeConns()
+		record := accesslog.NewRecord("client", time.Now())
+		h.Handle(accesslog.NewContextWithRecord(NewContextWithClientID(context.Background(), c), record), clientConn)
+		return record.Reason()
+	}
+	require.Equal(t, accesslog.ReasonForwarded, handle(admin))
+	require.Equal(t, 2, shedder.priority)
+	require.True(t, shedder.released)
+	require.Equal(t, accesslog.ReasonOverloaded, handle(other))
+	require.Equal(t, 0, shedder.priority)
+
+	// Shed connections are closed.
+	h.Inner = sheddingHandler{shedder: shedder}
+	require.Equal(t, accesslog.ReasonShed, handle(staff))
+	require.True(t, shedder.released)
+
+	snapshot := registry.Snapshot()
+	require.Equal(t, int64(1), snapshot["priority_ops_admitted_total"])
+	require.Equal(t, int64(1), snapshot["priority_staff_admitted_total"])
+	require.Equal(t, int64(1), snapshot["priority_staff_shed_total"])
+	require.Equal(t, int64(1), snapshot["priority_default_rejected_total"])
+}
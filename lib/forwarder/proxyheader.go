@@ -0,0 +1,193 @@
+package forwarder
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"tcplb/lib/core"
+)
+
+// proxyHeaderSignature starts every PROXY protocol v2 header.
+var proxyHeaderSignature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// PROXY protocol v2 header fields.
+const (
+	proxyHeaderVersionCommand = 0x21 // proxyHeaderVersionCommand is version 2, command PROXY.
+	proxyHeaderUnspec         = 0x00 // proxyHeaderUnspec is an unknown address family and protocol.
+	proxyHeaderTCP4           = 0x11 // proxyHeaderTCP4 is TCP over IPv4.
+	proxyHeaderTCP6           = 0x21 // proxyHeaderTCP6 is TCP over IPv6.
+)
+
+// Names of the items that may be sent in PROXY protocol v2 TLVs.
+const (
+	ProxyTLVClientID = "client-id" // ProxyTLVClientID is the authenticated ClientID, as "namespace/key".
+	ProxyTLVALPN     = "alpn"      // ProxyTLVALPN is the application protocol negotiated with the client by TLS ALPN.
+	ProxyTLVConnID   = "conn-id"   // ProxyTLVConnID is the ConnID of the client connection, in decimal.
+)
+
+// ProxyHeaderTLVs are the types of the TLVs of a PROXY protocol v2 header
+// that carry metadata of the client connection. Each is 0 if the item is
+// not sent. The protocol reserves types 0xE0 to 0xEF for custom use; 0x01
+// is its standard type for ALPN.
+type ProxyHeaderTLVs struct {
+	ClientID byte
+	ALPN     byte
+	ConnID   byte
+}
+
+// ParseProxyHeaderTLVs parses comma-separated item=type pairs, e.g.
+// "client-id=0xe0,alpn=0x01,conn-id=0xe1", where each item is one of
+// ProxyTLVClientID, ProxyTLVALPN and ProxyTLVConnID, and each type is a
+// distinct number from 1 to 255, in decimal or, with a 0x prefix, in
+// hexadecimal. The empty string sends no TLVs.
+func ParseProxyHeaderTLVs(s string) (ProxyHeaderTLVs, error) {
+	var tlvs ProxyHeaderTLVs
+	if s == "" {
+		return tlvs, nil
+	}
+	used := make(map[byte]string)
+	for _, token := range strings.Split(s, ",") {
+		item, value, ok := strings.Cut(token, "=")
+		if !ok {
+			return ProxyHeaderTLVs{}, fmt.Errorf("expected item=type but got %q", token)
+		}
+		n, err := strconv.ParseUint(value, 0, 8)
+		if err != nil || n == 0 {
+			return ProxyHeaderTLVs{}, fmt.Errorf("TLV type of %s must be a number from 1 to 255 but got %q", item, value)
+		}
+		t := byte(n)
+		if other, ok := used[t]; ok {
+			return ProxyHeaderTLVs{}, fmt.Errorf("TLV type %#02x is used by both %s and %s", t, other, item)
+		}
+		used[t] = item
+		switch item {
+		case ProxyTLVClientID:
+			tlvs.ClientID = t
+		case ProxyTLVALPN:
+			tlvs.ALPN = t
+		case ProxyTLVConnID:
+			tlvs.ConnID = t
+		default:
+			return ProxyHeaderTLVs{}, fmt.Errorf("unknown TLV item %q (expected one of %s, %s, %s)", item, ProxyTLVClientID, ProxyTLVALPN, ProxyTLVConnID)
+		}
+	}
+	return tlvs, nil
+}
+
+// ProxyHeaderConfig configures the PROXY protocol v2 header that is sent to
+// upstreams before any client data, so that they learn the addresses of
+// the client connection and, in TLVs, who the client was authenticated as.
+type ProxyHeaderConfig struct {
+	TLVs ProxyHeaderTLVs
+}
+
+// proxyHeaderConnState is implemented by client connections that negotiate
+// an application protocol, e.g. *tls.Conn.
+type proxyHeaderConnState interface {
+	ConnectionState() tls.ConnectionState
+}
+
+// Header returns the PROXY protocol v2 header of the client connection
+// conn, authenticated as clientID. The addresses are those of conn, or
+// unspecified if they are not both TCP addresses. TLVs whose value is
+// empty, e.g. the ALPN of a connection that negotiated none, are omitted.
+func (c *ProxyHeaderConfig) Header(conn core.DuplexConn, clientID core.ClientID, connID ConnID) ([]byte, error) {
+	var body bytes.Buffer
+	family := byte(proxyHeaderUnspec)
+	src, srcOK := conn.RemoteAddr().(*net.TCPAddr)
+	dst, dstOK := conn.LocalAddr().(*net.TCPAddr)
+	if srcOK && dstOK {
+		if src4, dst4 := src.IP.To4(), dst.IP.To4(); src4 != nil && dst4 != nil {
+			family = proxyHeaderTCP4
+			body.Write(src4)
+			body.Write(dst4)
+		} else {
+			family = proxyHeaderTCP6
+			body.Write(src.IP.To16())
+			body.Write(dst.IP.To16())
+		}
+		_ = binary.Write(&body, binary.BigEndian, uint16(src.Port))
+		_ = binary.Write(&body, binary.BigEndian, uint16(dst.Port))
+	}
+
+	var alpn string
+	if state, ok := conn.(proxyHeaderConnState); ok {
+		alpn = state.ConnectionState().NegotiatedProtocol
+	}
+	for _, tlv := range []struct {
+		t     byte
+		value string
+	}{
+		{c.TLVs.ClientID, clientID.String()},
+		{c.TLVs.ALPN, alpn},
+		{c.TLVs.ConnID, strconv.FormatUint(uint64(connID), 10)},
+	} {
+		if tlv.t == 0 || tlv.value == "" {
+			continue
+		}
+		if len(tlv.value) > 0xffff {
+			return nil, fmt.Errorf("PROXY header TLV %#02x is too long", tlv.t)
+		}
+		body.WriteByte(tlv.t)
+		_ = binary.Write(&body, binary.BigEndian, uint16(len(tlv.value)))
+		body.WriteString(tlv.value)
+	}
+	if body.Len() > 0xffff {
+		return nil, errors.New("PROXY header is too long")
+	}
+
+	var header bytes.Buffer
+	header.Write(proxyHeaderSignature)
+	header.WriteByte(proxyHeaderVersionCommand)
+	header.WriteByte(family)
+	_ = binary.Write(&header, binary.BigEndian, uint16(body.Len()))
+	header.Write(body.Bytes())
+	return header.Bytes(), nil
+}
+
+// WriteProxyHeader writes the PROXY protocol v2 header of the client
+// connection carried by ctx to the upstream connection w, with the ClientID
+// and ConnID carried by ctx. If ctx carries no client connection, an error
+// wrapping ProxyHeaderClientUnknown is returned.
+func (c *ProxyHeaderConfig) WriteProxyHeader(ctx context.Context, w io.Writer) error {
+	conn, ok := ClientConnFromContext(ctx)
+	if !ok {
+		return ProxyHeaderClientUnknown
+	}
+	clientID, _ := ClientIDFromContext(ctx)
+	header, err := c.Header(conn, clientID, ConnIDFromContext(ctx))
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(header)
+	return err
+}
+
+// ProxyHeaderClientUnknown is returned by WriteProxyHeader when the client
+// connection to describe is not known, e.g. for a dial that is not made on
+// behalf of a client.
+var ProxyHeaderClientUnknown = errors.New("PROXY header client connection unknown")
+
+type clientConnContextKeyType struct{}
+
+var clientConnContextKey = clientConnContextKeyType{}
+
+// NewContextWithClientConn returns a child context of parent that carries
+// the client connection that an upstream is dialed for, so that dialers
+// can describe it to the upstream, e.g. in a PROXY header.
+func NewContextWithClientConn(parent context.Context, conn core.DuplexConn) context.Context {
+	return context.WithValue(parent, clientConnContextKey, conn)
+}
+
+// ClientConnFromContext returns the client connection stored in ctx, if any.
+func ClientConnFromContext(ctx context.Context) (core.DuplexConn, bool) {
+	conn, ok := ctx.Value(clientConnContextKey).(core.DuplexConn)
+	return conn, ok && conn != nil
+}
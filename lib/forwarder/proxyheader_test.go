@@ -0,0 +1,98 @@
+package forwarder
+
+import (
+	"bytes"
+	"context"
+	"github.com/stretchr/testify/require"
+	"io"
+	"net"
+	"tcplb/lib/core"
+	"tcplb/lib/slog"
+	"testing"
+	"time"
+)
+
+func TestParseProxyHeaderTLVs(t *testing.T) {
+	tlvs, err := ParseProxyHeaderTLVs("client-id=0xe0,alpn=1,conn-id=0xE1")
+	require.NoError(t, err)
+	require.Equal(t, ProxyHeaderTLVs{ClientID: 0xe0, ALPN: 0x01, ConnID: 0xe1}, tlvs)
+
+	tlvs, err = ParseProxyHeaderTLVs("")
+	require.NoError(t, err)
+	require.Equal(t, ProxyHeaderTLVs{}, tlvs)
+
+	for spec, msg := range map[string]string{
+		"client-id":                   `expected item=type but got "client-id"`,
+		"client-id=0":                 `TLV type of client-id must be a number from 1 to 255 but got "0"`,
+		"client-id=256":               `TLV type of client-id must be a number from 1 to 255 but got "256"`,
+		"client-id=0xe0,conn-id=0xe0": "TLV type 0xe0 is used by both client-id and conn-id",
+		"colour=0xe0":                 `unknown TLV item "colour" (expected one of client-id, alpn, conn-id)`,
+	} {
+		_, err := ParseProxyHeaderTLVs(spec)
+		require.EqualError(t, err, msg, spec)
+	}
+}
+
+func TestProxyHeader(t *testing.T) {
+	conn, _ := newPipeConns()
+	clientID := core.ClientID{Namespace: "handler-test", Key: "a"}
+	config := &ProxyHeaderConfig{TLVs: ProxyHeaderTLVs{ClientID: 0xe0, ALPN: 0x01, ConnID: 0xe1}}
+	prefix := "\r\n\r\n\x00\r\nQUIT\n\x21"
+	// The ALPN TLV is omitted, as the connection negotiated no protocol.
+	tlvs := "\xe0\x00\x0ehandler-test/a" + "\xe1\x00\x0242"
+
+	header, err := config.Header(addrConn{
+		DuplexConn: conn,
+		remote:     &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 50000},
+		local:      &net.TCPAddr{IP: net.ParseIP("198.51.100.1"), Port: 443},
+	}, clientID, 42)
+	require.NoError(t, err)
+	require.Equal(t, prefix+"\x11\x00\x22"+"\xc0\x00\x02\x01\xc6\x33\x64\x01\xc3\x50\x01\xbb"+tlvs, string(header))
+
+	header, err = config.Header(addrConn{
+		DuplexConn: conn,
+		remote:     &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 50000},
+		local:      &net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 443},
+	}, clientID, 42)
+	require.NoError(t, err)
+	ips := "\x20\x01\x0d\xb8" + string(make([]byte, 11)) + "\x01" + "\x20\x01\x0d\xb8" + string(make([]byte, 11)) + "\x02"
+	require.Equal(t, prefix+"\x21\x00\x3a"+ips+"\xc3\x50\x01\xbb"+tlvs, string(header))
+
+	// The addresses of connections that are not over TCP are unspecified.
+	header, err = config.Header(conn, clientID, 42)
+	require.NoError(t, err)
+	require.Equal(t, prefix+"\x00\x00\x16"+tlvs, string(header))
+
+	// A header is only written for a known client connection.
+	var b bytes.Buffer
+	require.ErrorIs(t, config.WriteProxyHeader(context.Background(), &b), ProxyHeaderClientUnknown)
+	ctx := NewContextWithConnID(NewContextWithClientID(context.Background(), clientID), 42)
+	require.NoError(t, config.WriteProxyHeader(NewContextWithClientConn(ctx, conn), &b))
+	require.Equal(t, prefix+"\x00\x00\x16"+tlvs, b.String())
+}
+
+func TestForwardingHandlerDialsWithClientConn(t *testing.T) {
+	a := core.Upstream{Network: "handler-test", Address: "a"}
+	dialer := &clientConnRecordingDialer{}
+	ctx := NewContextWithClientID(context.Background(), core.ClientID{Namespace: "handler-test", Key: "anon"})
+	ctx = NewContextWithUpstreams(ctx, core.NewUpstreamSet(a))
+	h := &ForwardingHandler{
+		Logger:    &slog.RecordingLogger{},
+		Dialer:    dialer,
+		Forwarder: writingForwarder{},
+	}
+	clientConn, _ := newPipeConns()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		h.Handle(ctx, clientConn)
+	}()
+
+	// The Dialer may describe the client connection to the upstream, e.g.
+	// in a PROXY header.
+	require.Eventually(t, func() bool { return len(dialer.Peers()) == 1 }, time.Second, time.Millisecond)
+	_, err := io.ReadFull(dialer.Peers()[0], make([]byte, len("hello")))
+	require.NoError(t, err)
+	<-done
+	require.Equal(t, []core.DuplexConn{clientConn}, dialer.clientConns)
+}
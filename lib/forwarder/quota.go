@@ -0,0 +1,132 @@
+package forwarder
+
+import (
+	"context"
+	"errors"
+	"tcplb/lib/accesslog"
+	"tcplb/lib/core"
+	"tcplb/lib/slog"
+	"time"
+)
+
+// QuotaExceeded is returned, possibly wrapped, by a QuotaAccountant when a
+// client has used up a hard limit of its quota.
+var QuotaExceeded = errors.New("client quota exceeded")
+
+// QuotaAccountant accounts for the usage of each client over time, e.g. the
+// bytes it forwards, against the client's quota.
+//
+// Multiple goroutines may invoke methods on a QuotaAccountant simultaneously.
+type QuotaAccountant interface {
+	// CheckQuota returns an error wrapping QuotaExceeded if the client may
+	// not make new connections because it has used up its quota.
+	CheckQuota(ctx context.Context, c core.ClientID) error
+	// RecordUsage adds usage by the client of bytes forwarded, and of time
+	// spent connected.
+	RecordUsage(ctx context.Context, c core.ClientID, bytes int64, connected time.Duration)
+}
+
+// QuotaHandler is a handler that only allows the Inner handler to Handle
+// the connection if the client has not used up its quota, and records the
+// usage of the connection against the quota. A ClientID is expected to be
+// found in the context.
+//
+// Usage is recorded when the connection ends, and, if Interval is positive,
+// once per Interval while it lasts, so that long-lived connections count
+// towards the quota as they go. Quotas limit new connections only: live
+// connections are not cut off when their client's quota is used up.
+//
+// Clients selected by Exemptions may connect whatever their quota, though
+// their usage is still recorded.
+type QuotaHandler struct {
+	Logger     slog.Logger
+	Accountant QuotaAccountant
+	Interval   time.Duration
+	Inner      Handler
+	Exemptions *LimitExemptions // Exemptions is optional.
+}
+
+func (h *QuotaHandler) Handle(ctx context.Context, conn core.DuplexConn) {
+	clientID, ok := ClientIDFromContext(ctx)
+	if !ok {
+		h.Logger.Error(&slog.LogRecord{Msg: "QuotaHandler: Failed to get ClientID from context", Reason: accesslog.ReasonInternalError})
+		accesslog.SetReason(ctx, accesslog.ReasonInternalError)
+		return
+	}
+	exempt, err := h.Exemptions.IsExempt(ctx, clientID)
+	if err != nil {
+		h.Logger.Error(&slog.LogRecord{Msg: "QuotaHandler: IsExempt error", Reason: accesslog.ReasonInternalError, ClientID: &clientID, Error: err})
+		accesslog.SetReason(ctx, accesslog.ReasonInternalError)
+		return
+	}
+	if exempt {
+		h.Exemptions.recordQuota()
+		h.Logger.Info(&slog.LogRecord{Msg: "QuotaHandler: Client exempt from quota", ClientID: &clientID})
+	} else if err := h.Accountant.CheckQuota(ctx, clientID); err != nil {
+		if errors.Is(err, QuotaExceeded) {
+			h.Logger.Warn(&slog.LogRecord{Msg: "QuotaHandler: Client quota exceeded", Reason: accesslog.ReasonQuotaExceeded, ClientID: &clientID, Error: err})
+			accesslog.SetReason(ctx, accesslog.ReasonQuotaExceeded)
+		} else {
+			h.Logger.Error(&slog.LogRecord{Msg: "QuotaHandler: CheckQuota error", Reason: accesslog.ReasonInternalError, ClientID: &clientID, Error: err})
+			accesslog.SetReason(ctx, accesslog.ReasonInternalError)
+		}
+		return
+	}
+
+	// Bytes are counted by the Forwarder in the access log record.
+	record := accesslog.RecordFromContext(ctx)
+	if record == nil {
+		record = accesslog.NewRecord(conn.RemoteAddr().String(), time.Now())
+		ctx = accesslog.NewContextWithRecord(ctx, record)
+	}
+	meter := &usageMeter{last: time.Now()}
+	if h.Interval > 0 {
+		stop := make(chan struct{})
+		stopped := make(chan struct{})
+		go func() {
+			defer close(stopped)
+			ticker := time.NewTicker(h.Interval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ticker.C:
+					h.record(ctx, clientID, meter, record)
+				case <-stop:
+					return
+				}
+			}
+		}()
+		defer func() {
+			close(stop)
+			<-stopped
+			h.record(ctx, clientID, meter, record)
+		}()
+	} else {
+		defer h.record(ctx, clientID, meter, record)
+	}
+
+	h.Inner.Handle(ctx, conn)
+}
+
+// record records the usage since it was last recorded.
+func (h *QuotaHandler) record(ctx context.Context, clientID core.ClientID, meter *usageMeter, record *accesslog.Record) {
+	bytes, connected := meter.take(record.Bytes(), time.Now())
+	h.Accountant.RecordUsage(ctx, clientID, bytes, connected)
+}
+
+// usageMeter tracks the usage of a connection that has already been
+// recorded. It is only used by one goroutine at a time.
+type usageMeter struct {
+	bytes int64
+	last  time.Time
+}
+
+// take returns the usage since the last call, given the bytes forwarded so
+// far and the current time.
+func (m *usageMeter) take(bytes int64, now time.Time) (int64, time.Duration) {
+	deltaBytes, connected := bytes-m.bytes, now.Sub(m.last)
+	m.bytes, m.last = bytes, now
+	return deltaBytes, connected
+}
+
+var _ Handler = (*QuotaHandler)(nil) // type check
@@ -0,0 +1,52 @@
+package forwarder
+
+import (
+	"context"
+	"fmt"
+	"github.com/stretchr/testify/require"
+	"tcplb/lib/accesslog"
+	"tcplb/lib/core"
+	"tcplb/lib/slog"
+	"testing"
+	"time"
+)
+
+// byteCountingHandler counts bytes forwarded in the access log record, and
+// waits until usage has been recorded while the connection lasts.
+type byteCountingHandler struct {
+	accountant *recordingAccountant
+}
+
+func (h byteCountingHandler) Handle(ctx context.Context, conn core.DuplexConn) {
+	accesslog.RecordFromContext(ctx).AddBytesFromClient(10)
+	for {
+		if _, calls := h.accountant.usage(); calls > 0 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	accesslog.RecordFromContext(ctx).AddBytesToClient(5)
+}
+
+func TestQuotaHandler(t *testing.T) {
+	clientID := core.ClientID{Namespace: "test", Key: "client"}
+	clientConn, _ := newPipeConns()
+
+	accountant := &recordingAccountant{}
+	h := &QuotaHandler{
+		Logger:     &slog.RecordingLogger{},
+		Accountant: accountant,
+		Interval:   time.Millisecond,
+		Inner:      byteCountingHandler{accountant: accountant},
+	}
+	h.Handle(NewContextWithClientID(context.Background(), clientID), clientConn)
+	bytes, calls := accountant.usage()
+	require.Equal(t, int64(15), bytes)
+	require.GreaterOrEqual(t, calls, 2)
+
+	h.Accountant = &recordingAccountant{err: fmt.Errorf("window 1h: %w", QuotaExceeded)}
+	record := accesslog.NewRecord("client", time.Now())
+	ctx := accesslog.NewContextWithRecord(NewContextWithClientID(context.Background(), clientID), record)
+	h.Handle(ctx, clientConn)
+	require.Equal(t, accesslog.ReasonQuotaExceeded, record.Reason())
+}
@@ -0,0 +1,152 @@
+package forwarder
+
+import (
+	"context"
+	"sync"
+	"tcplb/lib/accesslog"
+	"tcplb/lib/clock"
+	"tcplb/lib/core"
+	"tcplb/lib/metrics"
+	"time"
+)
+
+// ReasonMetrics counts client connections by the reason they ended.
+type ReasonMetrics struct {
+	Ended map[accesslog.ReasonCode]*metrics.Counter // Ended counts connections that ended, by termination reason.
+}
+
+// NewReasonMetrics returns ReasonMetrics registered in the given Registry,
+// with a counter named "connections_ended_<reason>_total" for each of
+// accesslog.ReasonCodes.
+func NewReasonMetrics(r *metrics.Registry) *ReasonMetrics {
+	m := &ReasonMetrics{Ended: make(map[accesslog.ReasonCode]*metrics.Counter, len(accesslog.ReasonCodes))}
+	for _, reason := range accesslog.ReasonCodes {
+		m.Ended[reason] = r.Counter("connections_ended_" + string(reason) + "_total")
+	}
+	return m
+}
+
+func (m *ReasonMetrics) record(reason accesslog.ReasonCode) {
+	if m == nil {
+		return
+	}
+	if reason == "" {
+		reason = accesslog.ReasonUnknown
+	}
+	if c, ok := m.Ended[reason]; ok {
+		c.Inc()
+	}
+}
+
+// RecentRejections counts the connections of a client rejected since
+// Since, by termination reason.
+type RecentRejections struct {
+	Since  time.Time                      `json:"since"`
+	Counts map[accesslog.ReasonCode]int64 `json:"counts"`
+}
+
+// ClientRejections counts the recent rejections of each authenticated
+// client, by reason, so that operators can see why a client is turned away
+// without searching the access log. The counts of a client cover Window
+// from its first rejection counted, then start over.
+//
+// Multiple goroutines may invoke methods on a ClientRejections
+// simultaneously.
+type ClientRejections struct {
+	Window     time.Duration // Window is how long the counts of a client accumulate. If not positive, they accumulate forever.
+	MaxClients int           // MaxClients bounds the clients counted. Once it is reached, a client whose counts are stale, or else an arbitrary client, is forgotten to count another. If not positive, there is no bound.
+	Clock      clock.Clock   // Clock is optional. If nil, the Real clock is used.
+
+	mu      sync.Mutex // mu guards clients
+	clients map[core.ClientID]*RecentRejections
+}
+
+// stale reports if the counts r are older than Window at time now.
+func (l *ClientRejections) stale(r *RecentRejections, now time.Time) bool {
+	return l.Window > 0 && now.Sub(r.Since) >= l.Window
+}
+
+// Record counts a rejection of client c for the given reason.
+func (l *ClientRejections) Record(c core.ClientID, reason accesslog.ReasonCode) {
+	now := clock.Or(l.Clock).Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.clients == nil {
+		l.clients = make(map[core.ClientID]*RecentRejections)
+	}
+	r, ok := l.clients[c]
+	if !ok && l.MaxClients > 0 && len(l.clients) >= l.MaxClients {
+		l.evict(now)
+	}
+	if !ok || l.stale(r, now) {
+		r = &RecentRejections{Since: now, Counts: make(map[accesslog.ReasonCode]int64)}
+		l.clients[c] = r
+	}
+	r.Counts[reason]++
+}
+
+// evict forgets the clients whose counts are stale, or if there are none,
+// an arbitrary client. The caller must hold l.mu.
+func (l *ClientRejections) evict(now time.Time) {
+	before := len(l.clients)
+	for c, r := range l.clients {
+		if l.stale(r, now) {
+			delete(l.clients, c)
+		}
+	}
+	if len(l.clients) < before {
+		return
+	}
+	for c := range l.clients {
+		delete(l.clients, c)
+		return
+	}
+}
+
+// Rejections returns the recent rejections of client c. If there are none,
+// the Counts are empty.
+func (l *ClientRejections) Rejections(c core.ClientID) RecentRejections {
+	now := clock.Or(l.Clock).Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	result := RecentRejections{Counts: make(map[accesslog.ReasonCode]int64)}
+	r, ok := l.clients[c]
+	if !ok || l.stale(r, now) {
+		return result
+	}
+	result.Since = r.Since
+	for reason, n := range r.Counts {
+		result.Counts[reason] = n
+	}
+	return result
+}
+
+// ReasonMetricsHandler is a handler that counts each client connection in
+// Metrics by the termination reason recorded once the Inner handler has
+// finished handling it. Reasons are read from the accesslog.Record stored
+// in the context, so it must wrap the handlers that record reasons. If
+// there is no Record in the context, one is created for the Inner handler
+// to use.
+type ReasonMetricsHandler struct {
+	Metrics    *ReasonMetrics
+	Rejections *ClientRejections // Rejections is optional. If set, rejections of authenticated clients are counted in it.
+	Inner      Handler
+}
+
+func (h *ReasonMetricsHandler) Handle(ctx context.Context, conn core.DuplexConn) {
+	record := accesslog.RecordFromContext(ctx)
+	if record == nil {
+		record = accesslog.NewRecord(conn.RemoteAddr().String(), time.Now())
+		ctx = accesslog.NewContextWithRecord(ctx, record)
+	}
+	h.Inner.Handle(ctx, conn)
+	reason := record.Reason()
+	h.Metrics.record(reason)
+	if _, rejected := rejectionReasons[reason]; rejected && h.Rejections != nil {
+		if clientID := record.Summary().ClientID; clientID != nil {
+			h.Rejections.Record(*clientID, reason)
+		}
+	}
+}
+
+var _ Handler = (*ReasonMetricsHandler)(nil) // type check
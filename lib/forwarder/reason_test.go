@@ -0,0 +1,74 @@
+package forwarder
+
+import (
+	"context"
+	"github.com/stretchr/testify/require"
+	"tcplb/lib/accesslog"
+	"tcplb/lib/clock"
+	"tcplb/lib/core"
+	"tcplb/lib/metrics"
+	"testing"
+	"time"
+)
+
+func TestReasonMetricsHandler(t *testing.T) {
+	registry := metrics.NewRegistry()
+	m := NewReasonMetrics(registry)
+	for _, reason := range []accesslog.ReasonCode{accesslog.ReasonRateLimited, accesslog.ReasonRateLimited, accesslog.ReasonForwarded, ""} {
+		conn, _ := newPipeConns()
+		h := &ReasonMetricsHandler{Metrics: m, Inner: rejectingHandler{reason: reason}}
+		h.Handle(context.Background(), conn)
+	}
+	snapshot := registry.Snapshot()
+	require.Equal(t, int64(2), snapshot["connections_ended_rate_limited_total"])
+	require.Equal(t, int64(1), snapshot["connections_ended_forwarded_total"])
+	require.Equal(t, int64(1), snapshot["connections_ended_unknown_total"])
+	require.Equal(t, int64(0), snapshot["connections_ended_banned_total"])
+	require.Len(t, m.Ended, len(accesslog.ReasonCodes))
+}
+
+// clientRejectingHandler authenticates each connection as its client, then
+// rejects it for reason.
+type clientRejectingHandler struct {
+	client core.ClientID
+	reason accesslog.ReasonCode
+}
+
+func (h clientRejectingHandler) Handle(ctx context.Context, conn core.DuplexConn) {
+	accesslog.RecordFromContext(ctx).SetClientID(h.client)
+	accesslog.SetReason(ctx, h.reason)
+}
+
+func TestClientRejections(t *testing.T) {
+	alice := core.ClientID{Namespace: "test", Key: "alice"}
+	bob := core.ClientID{Namespace: "test", Key: "bob"}
+	c := clock.NewFake(time.Unix(1000, 0))
+	rejections := &ClientRejections{Window: time.Minute, MaxClients: 1, Clock: c}
+	for _, inner := range []Handler{
+		clientRejectingHandler{client: alice, reason: accesslog.ReasonRateLimited},
+		clientRejectingHandler{client: alice, reason: accesslog.ReasonRateLimited},
+		clientRejectingHandler{client: alice, reason: accesslog.ReasonNotAuthorized},
+		clientRejectingHandler{client: alice, reason: accesslog.ReasonForwarded}, // Not a rejection.
+		rejectingHandler{reason: accesslog.ReasonAuthnFailed},                    // No client to count it against.
+	} {
+		conn, _ := newPipeConns()
+		h := &ReasonMetricsHandler{Rejections: rejections, Inner: inner}
+		h.Handle(context.Background(), conn)
+	}
+	require.Equal(t, RecentRejections{
+		Since:  c.Now(),
+		Counts: map[accesslog.ReasonCode]int64{accesslog.ReasonRateLimited: 2, accesslog.ReasonNotAuthorized: 1},
+	}, rejections.Rejections(alice))
+	require.Empty(t, rejections.Rejections(bob).Counts)
+
+	// Counts start over once the window passes.
+	c.Advance(time.Minute)
+	require.Empty(t, rejections.Rejections(alice).Counts)
+	rejections.Record(alice, accesslog.ReasonQuotaExceeded)
+	require.Equal(t, map[accesslog.ReasonCode]int64{accesslog.ReasonQuotaExceeded: 1}, rejections.Rejections(alice).Counts)
+
+	// Beyond MaxClients, clients are forgotten to count others.
+	rejections.Record(bob, accesslog.ReasonRateLimited)
+	require.Empty(t, rejections.Rejections(alice).Counts)
+	require.Equal(t, map[accesslog.ReasonCode]int64{accesslog.ReasonRateLimited: 1}, rejections.Rejections(bob).Counts)
+}
@@ -0,0 +1,43 @@
+package forwarder
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime/debug"
+	"tcplb/lib/accesslog"
+	"tcplb/lib/core"
+	"tcplb/lib/metrics"
+	"tcplb/lib/slog"
+)
+
+// HandlerPanicked is the error logged by a RecoveringHandler when the
+// handler it wraps panics.
+var HandlerPanicked = errors.New("handler panicked")
+
+// RecoveringHandler is a handler that recovers from panics of the Inner
+// handler, so that a bug triggered by one connection ends that connection
+// rather than the server. The panic is logged with its stack trace, and
+// the connection is recorded with the termination reason "internal_error".
+//
+// Only panics of the goroutine that invokes Handle are recovered, not
+// those of goroutines started by the Inner handler.
+type RecoveringHandler struct {
+	Logger slog.Logger
+	Panics *metrics.Counter // Panics is optional. If set, it counts recovered panics.
+	Inner  Handler
+}
+
+func (h *RecoveringHandler) Handle(ctx context.Context, conn core.DuplexConn) {
+	defer func() {
+		if r := recover(); r != nil {
+			h.Panics.Inc()
+			accesslog.SetReason(ctx, accesslog.ReasonInternalError)
+			err := fmt.Errorf("%w: %v", HandlerPanicked, r)
+			h.Logger.Error(&slog.LogRecord{Msg: "RecoveringHandler: recovered from panic", Reason: accesslog.ReasonInternalError, Error: err, StackTrace: string(debug.Stack())})
+		}
+	}()
+	h.Inner.Handle(ctx, conn)
+}
+
+var _ Handler = (*RecoveringHandler)(nil) // type check
@@ -0,0 +1,40 @@
+package forwarder
+
+import (
+	"context"
+	"github.com/stretchr/testify/require"
+	"tcplb/lib/accesslog"
+	"tcplb/lib/core"
+	"tcplb/lib/metrics"
+	"tcplb/lib/slog"
+	"testing"
+)
+
+type panickingHandler struct{}
+
+func (panickingHandler) Handle(ctx context.Context, conn core.DuplexConn) {
+	panic("bug")
+}
+
+func TestRecoveringHandler(t *testing.T) {
+	client, server := newPipeConns()
+	defer client.Close()
+	defer server.Close()
+	logger := &slog.RecordingLogger{}
+	registry := metrics.NewRegistry()
+	h := &RecoveringHandler{Logger: logger, Panics: registry.Counter("handler_panics_total"), Inner: panickingHandler{}}
+
+	require.Equal(t, accesslog.ReasonInternalError, handleRecordingReason(h, server))
+	require.Equal(t, int64(1), registry.Snapshot()["handler_panics_total"])
+	require.Len(t, logger.Events, 1)
+	require.Equal(t, slog.ErrorLevel, logger.Events[0].Level)
+	require.ErrorIs(t, logger.Events[0].Error, HandlerPanicked)
+	require.NotEmpty(t, logger.Events[0].StackTrace)
+
+	// Handlers that do not panic are unaffected.
+	inner := &countingHandler{}
+	h.Inner = inner
+	require.Empty(t, handleRecordingReason(h, server))
+	require.Equal(t, 1, inner.handled)
+	require.Len(t, logger.Events, 1)
+}
@@ -0,0 +1,82 @@
+package forwarder
+
+import (
+	"context"
+	"errors"
+	"net"
+	"tcplb/lib/core"
+	"tcplb/lib/slog"
+	"time"
+)
+
+// prefixedConn is a DuplexConn whose first reads return prefix, data that was
+// already read from the underlying connection.
+type prefixedConn struct {
+	core.WrappedConn
+	prefix []byte
+}
+
+func (c *prefixedConn) Read(p []byte) (int, error) {
+	if len(c.prefix) > 0 {
+		n := copy(p, c.prefix)
+		c.prefix = c.prefix[n:]
+		return n, nil
+	}
+	return c.DuplexConn.Read(p)
+}
+
+// probeUpstreamConn waits up to window for conn to fail, before any client
+// data has been written to it. If the upstream sends data or stays silent,
+// the connection is returned ready to forward, including any data read. If
+// the upstream closes or resets the connection, the error is returned.
+func probeUpstreamConn(conn core.DuplexConn, window time.Duration) (core.DuplexConn, error) {
+	if err := conn.SetReadDeadline(time.Now().Add(window)); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 512)
+	n, err := conn.Read(buf)
+	if resetErr := conn.SetReadDeadline(time.Time{}); resetErr != nil {
+		return nil, resetErr
+	}
+	if n > 0 {
+		return &prefixedConn{WrappedConn: core.WrappedConn{DuplexConn: conn}, prefix: buf[:n]}, nil
+	}
+	var netErr net.Error
+	if err == nil || (errors.As(err, &netErr) && netErr.Timeout()) {
+		return conn, nil
+	}
+	return nil, err
+}
+
+// redialOnImmediateFailure probes the connection to upstream for
+// h.RedialWindow. If the connection fails within that window, upstream is
+// excluded from candidates and another candidate is dialed, and so on, until
+// an upstream connection survives the window or there are no candidates left.
+// Each failed connection is told to h.FailureReporter, if set.
+func (h *ForwardingHandler) redialOnImmediateFailure(ctx context.Context, candidates core.UpstreamSet, upstream core.Upstream, conn core.DuplexConn) (core.Upstream, core.DuplexConn, error) {
+	remaining := core.Union(candidates, nil)
+	for {
+		probed, err := probeUpstreamConn(conn, h.RedialWindow)
+		if err == nil {
+			return upstream, probed, nil
+		}
+		_ = conn.Close()
+		if h.FailureReporter != nil {
+			h.FailureReporter.ReportUpstreamFailure(ctx, upstream, err)
+		}
+		h.Logger.Warn(&slog.LogRecord{Msg: "ForwardingHandler: upstream connection failed immediately, redialing", Upstream: &upstream, Error: err})
+		delete(remaining, upstream)
+		if len(remaining) == 0 {
+			return core.Upstream{}, nil, &DialError{Upstream: upstream, Err: err}
+		}
+		failed := &DialError{Upstream: upstream, Err: err}
+		upstream, conn, err = h.Dialer.DialBestUpstream(ctx, remaining)
+		if errors.Is(err, NoUpstreamAvailable) {
+			// An upstream was dialed, so the failure is that it failed.
+			return core.Upstream{}, nil, failed
+		}
+		if err != nil {
+			return core.Upstream{}, nil, err
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package forwarder
+
+import (
+	"context"
+	"github.com/stretchr/testify/require"
+	"io"
+	"tcplb/lib/accesslog"
+	"tcplb/lib/core"
+	"tcplb/lib/slog"
+	"testing"
+	"time"
+)
+
+// greetingForwarder reads the upstream's greeting instead of forwarding.
+type greetingForwarder struct {
+	greeting chan string
+}
+
+func (f greetingForwarder) Forward(ctx context.Context, clientConn, upstreamConn core.DuplexConn) error {
+	buf := make([]byte, 5)
+	_, err := io.ReadFull(upstreamConn, buf)
+	f.greeting <- string(buf)
+	return err
+}
+
+func TestForwardingHandlerRedialsOnImmediateFailure(t *testing.T) {
+	a := core.Upstream{Network: "handler-test", Address: "a"}
+	b := core.Upstream{Network: "handler-test", Address: "b"}
+	ctx := NewContextWithClientID(context.Background(), core.ClientID{Namespace: "handler-test", Key: "anon"})
+	ctx = NewContextWithUpstreams(ctx, core.NewUpstreamSet(a, b))
+
+	dialer := &flakyDialer{Fail: core.NewUpstreamSet(a)}
+	fwder := greetingForwarder{greeting: make(chan string, 1)}
+	reporter := &recordingFailureReporter{}
+	h := &ForwardingHandler{
+		Logger:          &slog.RecordingLogger{},
+		Dialer:          dialer,
+		Forwarder:       fwder,
+		RedialWindow:    time.Second,
+		FailureReporter: reporter,
+	}
+	clientConn, _ := newPipeConns()
+	record := accesslog.NewRecord("client", time.Now())
+	h.Handle(accesslog.NewContextWithRecord(ctx, record), clientConn)
+	require.Equal(t, []core.Upstream{a, b}, dialer.dialed)
+	// The failed connection to a is reported, e.g. to a circuit breaker.
+	require.Equal(t, []core.Upstream{a}, reporter.failed)
+	// The greeting read while probing b is still forwarded.
+	require.Equal(t, "hello", <-fwder.greeting)
+	require.Equal(t, accesslog.ReasonForwarded, record.Reason())
+
+	// Once every candidate has failed, the client is rejected.
+	dialer = &flakyDialer{Fail: core.NewUpstreamSet(a, b)}
+	h.Dialer = dialer
+	record = accesslog.NewRecord("client", time.Now())
+	h.Handle(accesslog.NewContextWithRecord(ctx, record), clientConn)
+	require.Equal(t, []core.Upstream{a, b}, dialer.dialed)
+	require.Equal(t, accesslog.ReasonDialFailed, record.Reason())
+}
@@ -0,0 +1,123 @@
+package forwarder
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"tcplb/lib/accesslog"
+	"tcplb/lib/core"
+	"tcplb/lib/slog"
+	"time"
+)
+
+// rejectionReasons are the termination reasons that mean the client
+// connection was refused before any data was forwarded, mapped to whether
+// the client may reasonably retry later.
+var rejectionReasons = map[accesslog.ReasonCode]bool{
+	accesslog.ReasonAuthnFailed:          false,
+	accesslog.ReasonNotAuthorized:        false,
+	accesslog.ReasonNoRoute:              false,
+	accesslog.ReasonRateLimited:          true,
+	accesslog.ReasonReserverOverloaded:   true,
+	accesslog.ReasonOverloaded:           true,
+	accesslog.ReasonMemoryPressure:       true,
+	accesslog.ReasonHandshakeLimited:     true,
+	accesslog.ReasonHandshakeRateLimited: true,
+	accesslog.ReasonHandshakeThrottled:   true,
+	accesslog.ReasonQuotaExceeded:        true,
+	accesslog.ReasonDialFailed:           true,
+	accesslog.ReasonNoUpstream:           true,
+	accesslog.ReasonInternalError:        true,
+}
+
+// RejectionSignaller tells a client why its connection was rejected,
+// before the connection is closed.
+//
+// Multiple goroutines may invoke methods on a RejectionSignaller simultaneously.
+type RejectionSignaller interface {
+	SignalRejection(conn core.DuplexConn, reason accesslog.ReasonCode) error
+}
+
+// MessageRejectionSignaller writes a single line describing the rejection
+// to the client, e.g. "tcplb: rejected: rate_limited (temporary)", where
+// "temporary" suggests that the client may retry later and "permanent"
+// that it should not.
+//
+// Once the TLS handshake has completed crypto/tls offers no way to send an
+// alert other than close_notify, so for TLS connections the line is sent as
+// application data. Clients must therefore be prepared to receive it in place
+// of the upstream's first response.
+type MessageRejectionSignaller struct {
+	Timeout time.Duration // Timeout bounds the time spent writing the message.
+}
+
+func (s MessageRejectionSignaller) SignalRejection(conn core.DuplexConn, reason accesslog.ReasonCode) error {
+	kind := "permanent"
+	if rejectionReasons[reason] {
+		kind = "temporary"
+	}
+	if err := conn.SetWriteDeadline(time.Now().Add(s.Timeout)); err != nil {
+		return err
+	}
+	_, err := fmt.Fprintf(conn, "tcplb: rejected: %s (%s)\n", reason, kind)
+	return err
+}
+
+var _ RejectionSignaller = MessageRejectionSignaller{} // type check
+
+// ResetRejectionSignaller arranges for the connection to be reset (TCP RST)
+// when it is closed, rather than closed in an orderly way, so that the
+// client fails immediately instead of waiting for a response that will
+// never come.
+type ResetRejectionSignaller struct{}
+
+func (ResetRejectionSignaller) SignalRejection(conn core.DuplexConn, reason accesslog.ReasonCode) error {
+	tcpConn, ok := core.TransportConn(conn).(*net.TCPConn)
+	if !ok {
+		return core.ConnectionTypeUnsupported
+	}
+	return tcpConn.SetLinger(0)
+}
+
+var _ RejectionSignaller = ResetRejectionSignaller{} // type check
+
+// RejectionSignallingHandler is a handler that signals the client, using
+// Signaller, if the Inner handler rejects the connection. Signallers may
+// override Signaller for particular termination reasons. Rejections are
+// detected from the termination reason recorded in the accesslog.Record
+// stored in the context, so it must wrap the handlers that record reasons.
+// If there is no Record in the context, one is created for the Inner
+// handler to use.
+type RejectionSignallingHandler struct {
+	Logger     slog.Logger
+	Signaller  RejectionSignaller                          // Signaller is optional. If nil, only reasons in Signallers are signalled.
+	Signallers map[accesslog.ReasonCode]RejectionSignaller // Signallers is optional, keyed by termination reason.
+	Inner      Handler
+}
+
+func (h *RejectionSignallingHandler) Handle(ctx context.Context, conn core.DuplexConn) {
+	record := accesslog.RecordFromContext(ctx)
+	if record == nil {
+		record = accesslog.NewRecord(conn.RemoteAddr().String(), time.Now())
+		ctx = accesslog.NewContextWithRecord(ctx, record)
+	}
+	h.Inner.Handle(ctx, conn)
+
+	reason := record.Reason()
+	if _, ok := rejectionReasons[reason]; !ok {
+		return
+	}
+	signaller, ok := h.Signallers[reason]
+	if !ok {
+		signaller = h.Signaller
+	}
+	if signaller == nil {
+		return
+	}
+	if err := signaller.SignalRejection(conn, reason); err != nil {
+		// The client may already have gone away.
+		h.Logger.Debug(&slog.LogRecord{Msg: "RejectionSignallingHandler: failed to signal rejection", Details: reason, Error: err})
+	}
+}
+
+var _ Handler = (*RejectionSignallingHandler)(nil) // type check
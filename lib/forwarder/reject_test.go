@@ -0,0 +1,63 @@
+package forwarder
+
+import (
+	"context"
+	"github.com/stretchr/testify/require"
+	"io"
+	"net"
+	"tcplb/lib/accesslog"
+	"tcplb/lib/slog"
+	"testing"
+	"time"
+)
+
+func TestRejectionSignallingHandler(t *testing.T) {
+	scenarios := map[accesslog.ReasonCode]string{
+		accesslog.ReasonRateLimited:   "tcplb: rejected: rate_limited (temporary)\n",
+		accesslog.ReasonNotAuthorized: "tcplb: rejected: not_authorized (permanent)\n",
+		accesslog.ReasonForwarded:     "",
+		accesslog.ReasonTerminated:    "",
+	}
+	for reason, expected := range scenarios {
+		clientConn, peerConn := newPipeConns()
+		h := &RejectionSignallingHandler{
+			Logger:    &slog.RecordingLogger{},
+			Signaller: MessageRejectionSignaller{Timeout: time.Second},
+			Inner:     rejectingHandler{reason: reason},
+		}
+		received := make(chan []byte, 1)
+		go func() {
+			data, _ := io.ReadAll(peerConn)
+			received <- data
+		}()
+		h.Handle(context.Background(), clientConn)
+		_ = clientConn.Close()
+		require.Equal(t, expected, string(<-received), reason)
+	}
+}
+
+func TestResetRejectionSignaller(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+	client, err := net.Dial("tcp", listener.Addr().String())
+	require.NoError(t, err)
+	defer client.Close()
+	accepted, err := listener.Accept()
+	require.NoError(t, err)
+
+	h := &RejectionSignallingHandler{
+		Logger:     &slog.RecordingLogger{},
+		Signaller:  MessageRejectionSignaller{Timeout: time.Second},
+		Signallers: map[accesslog.ReasonCode]RejectionSignaller{accesslog.ReasonNoUpstream: ResetRejectionSignaller{}},
+		Inner:      rejectingHandler{reason: accesslog.ReasonNoUpstream},
+	}
+	conn := accepted.(*net.TCPConn)
+	(&ConnCloserHandler{Inner: h}).Handle(context.Background(), conn)
+
+	// The connection is reset rather than closed in an orderly way, and no
+	// message is written as the override takes precedence.
+	_, err = client.Read(make([]byte, 1))
+	require.Error(t, err)
+	require.NotErrorIs(t, err, io.EOF)
+}
@@ -2,46 +2,39 @@ package forwarder
 
 import (
 	"context"
-	"crypto/tls"
 	"errors"
 	"net"
+	"sync"
+	"tcplb/lib/clock"
 	"tcplb/lib/core"
+	"tcplb/lib/metrics"
 	"tcplb/lib/slog"
+	"tcplb/lib/trace"
 	"time"
 )
 
-var ConnectionTypeUnsupported = errors.New("connection type unsupported")
+// ServerClosed is returned by Server.Serve after Shutdown or Close is called.
+var ServerClosed = errors.New("server closed")
 
-// CloseWriter represents something that can CloseWrite.
-//
-// Notable implementations in the standard library include:
-// - net.TCPCOnn
-// - tls.Conn
-type CloseWriter interface {
-	CloseWrite() error // CloseWrite shuts down the writer side of a connection.
-}
+// ReservationLimitExceeded is core.ReservationLimitExceeded, returned,
+// possibly wrapped, by a ClientReserver when a client already holds as many
+// reservations as it may.
+var ReservationLimitExceeded = core.ReservationLimitExceeded
 
-type DuplexConn interface {
-	net.Conn
-	CloseWriter
-}
+// ReserverOverloaded is core.ReserverOverloaded, returned, possibly
+// wrapped, by a ClientReserver when it is tracking as many distinct clients
+// as it may.
+var ReserverOverloaded = core.ReserverOverloaded
 
-// ClientReserver represents an entity that can limit "reservations"
-// by clients, as an abstraction of client rate limiting.
-//
-// Multiple goroutines may invoke methods on a ClientReserver
-// simultaneously.
-type ClientReserver interface {
-	// TryReserve attempts to acquire a reservation for the given client.
-	// If the attempt succeeds, nil is returned.
-	// If no reservations are available, the attempt returns an error.
-	// This call does not block.
-	TryReserve(ctx context.Context, c core.ClientID) error
+// ClientReserver is core.ClientReserver, so that reservers, e.g. in package
+// limiter, need not depend on this package.
+type ClientReserver = core.ClientReserver
 
-	// ReleaseReservation releases a reservation that was previously acquired
-	// for the given ClientID c by TryReserve.
-	ReleaseReservation(ctx context.Context, c core.ClientID) error
-}
+// ReservationRenewer is core.ReservationRenewer.
+type ReservationRenewer = core.ReservationRenewer
+
+// ClientReservations is core.ClientReservations.
+type ClientReservations = core.ClientReservations
 
 // Authorizer abstracts an authorization policy that
 // controls which clients are allowed to forward connections to which upstreams.
@@ -64,7 +57,7 @@ type BestUpstreamDialer interface {
 	//
 	// If error is nil, the caller is responsible for closing the returned DuplexConn
 	// once finished with it to avoid leaking resources.
-	DialBestUpstream(ctx context.Context, candidates core.UpstreamSet) (core.Upstream, DuplexConn, error)
+	DialBestUpstream(ctx context.Context, candidates core.UpstreamSet) (core.Upstream, core.DuplexConn, error)
 }
 
 // Forwarder copies data between a client DuplexConn and an upstream DuplexConn.
@@ -84,43 +77,339 @@ type Forwarder interface {
 	//
 	// Forward implementations must not Close the clientConn or upstreamConn.
 	// It may CloseWrite one or both of them.
-	Forward(ctx context.Context, clientConn, upstreamConn DuplexConn) error
+	Forward(ctx context.Context, clientConn, upstreamConn core.DuplexConn) error
+}
+
+// ConnFilter decides whether a newly accepted client connection should be
+// served, before any work is done to handle it.
+//
+// Multiple goroutines may invoke methods on a ConnFilter simultaneously.
+type ConnFilter interface {
+	AllowConn(remote net.Addr) bool
+}
+
+// ConnFilters is a ConnFilter that allows a connection only if every
+// ConnFilter it contains does.
+type ConnFilters []ConnFilter
+
+func (fs ConnFilters) AllowConn(remote net.Addr) bool {
+	for _, f := range fs {
+		if !f.AllowConn(remote) {
+			return false
+		}
+	}
+	return true
+}
+
+var _ ConnFilter = ConnFilters(nil) // type check
+
+// ServerMetrics holds the metrics recorded by a Server.
+type ServerMetrics struct {
+	Accepted     *metrics.Counter // Accepted counts client connections accepted.
+	AcceptErrors *metrics.Counter // AcceptErrors counts errors returned by Accept.
+	Filtered     *metrics.Counter // Filtered counts client connections dropped by the Filter.
+	Overflowed   *metrics.Counter // Overflowed counts client connections dropped because the accept queue was full.
+	Active       *metrics.Gauge   // Active is the number of client connections being handled.
+	Queued       *metrics.Gauge   // Queued is the number of client connections waiting in the accept queue.
+}
+
+// NewServerMetrics returns ServerMetrics registered in the given Registry.
+func NewServerMetrics(r *metrics.Registry) *ServerMetrics {
+	return &ServerMetrics{
+		Accepted:     r.Counter("server_connections_accepted_total"),
+		AcceptErrors: r.Counter("server_accept_errors_total"),
+		Filtered:     r.Counter("server_connections_filtered_total"),
+		Overflowed:   r.Counter("server_connections_overflowed_total"),
+		Active:       r.Gauge("server_connections_active"),
+		Queued:       r.Gauge("server_accept_queue_length"),
+	}
+}
+
+// OverflowPolicy decides what a Server does with accepted client
+// connections when every handler is busy and its accept queue is full.
+type OverflowPolicy string
+
+const (
+	// OverflowQueue stops accepting connections until there is room in the
+	// accept queue, leaving further connections in the listener's backlog.
+	OverflowQueue OverflowPolicy = "queue"
+	// OverflowReject closes connections that do not fit in the accept
+	// queue, so that clients fail fast.
+	OverflowReject OverflowPolicy = "reject"
+)
+
+// OverflowPolicies are the supported OverflowPolicy values.
+var OverflowPolicies = []OverflowPolicy{OverflowQueue, OverflowReject}
+
+// queuedConn is an accepted client connection waiting to be handled.
+type queuedConn struct {
+	ctx  context.Context
+	conn core.DuplexConn
+	span *trace.Span
 }
 
 type Server struct {
+	Name                        string // Name is optional. If set, it identifies the Listener to handlers.
 	Logger                      slog.Logger
 	Handler                     Handler
 	Listener                    net.Listener
 	AcceptErrorCooldownDuration time.Duration
+	Tracer                      *trace.Tracer  // Tracer is optional. If nil, connections are not traced.
+	Metrics                     *ServerMetrics // Metrics is optional. If nil, no metrics are recorded.
+	// Observer is optional. If set, it receives lifecycle events of every
+	// client connection. Use Observers to register more than one.
+	Observer ConnectionLifecycleObserver
+	// Filter is optional. If set, accepted connections that it does not
+	// allow are closed at once, without being handled.
+	Filter ConnFilter
+	// Clock is optional. If nil, the system clock is used.
+	Clock clock.Clock
+	// ReadTCPInfo reads the TCP state of each accepted socket into the TCP
+	// field of its ConnInfo. As this costs a system call per connection, it
+	// should only be set if something reports the TCP state, e.g. the
+	// access log.
+	ReadTCPInfo bool
+
+	// MaxHandlers is optional. If positive, at most MaxHandlers client
+	// connections are handled at once, by a fixed pool of goroutines, and
+	// further accepted connections wait in an accept queue of up to
+	// AcceptQueueLength connections. If not positive, each connection is
+	// handled in a new goroutine as soon as it is accepted.
+	MaxHandlers       int
+	AcceptQueueLength int
+	// OverflowPolicy decides what happens to connections accepted while the
+	// accept queue is full. Defaults to OverflowQueue.
+	OverflowPolicy OverflowPolicy
+
+	lastConnID ConnID
+
+	// mu guards closing, conns, ctx and cancel. Handler goroutines are only
+	// added to wg while holding mu and before closing is set, so that
+	// Shutdown can safely Wait.
+	mu      sync.Mutex
+	closing bool
+	conns   map[core.DuplexConn]struct{}
+	wg      sync.WaitGroup
+	ctx     context.Context // ctx is the parent of every handler's context.
+	cancel  context.CancelFunc
+}
+
+// rootContext returns the context that all handler contexts derive from.
+// It is cancelled by Close, or once Shutdown has drained all connections.
+func (s *Server) rootContext() context.Context {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.initContextLocked()
+	return s.ctx
 }
 
+func (s *Server) initContextLocked() {
+	if s.ctx == nil {
+		s.ctx, s.cancel = context.WithCancel(context.Background())
+	}
+}
+
+// cancelHandlers cancels the contexts of all handlers.
+func (s *Server) cancelHandlers() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.initContextLocked()
+	s.cancel()
+}
+
+// trackConn registers a client connection that is about to be handled.
+// If the server is closing, false is returned and the caller must not
+// handle the connection.
+func (s *Server) trackConn(conn core.DuplexConn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closing {
+		return false
+	}
+	if s.conns == nil {
+		s.conns = make(map[core.DuplexConn]struct{})
+	}
+	s.conns[conn] = struct{}{}
+	s.wg.Add(1)
+	return true
+}
+
+func (s *Server) untrackConn(conn core.DuplexConn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.conns, conn)
+	s.wg.Done()
+}
+
+func (s *Server) isClosing() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closing
+}
+
+// stopAccepting marks the server as closing and closes the Listener,
+// which causes Serve to return.
+func (s *Server) stopAccepting() {
+	s.mu.Lock()
+	s.closing = true
+	s.mu.Unlock()
+	_ = s.Listener.Close()
+}
+
+// Shutdown gracefully shuts down the server. It stops accepting new client
+// connections, then waits for the connections already accepted to finish
+// being handled. If ctx is done before then, Shutdown returns ctx.Err(),
+// and connections may still be being handled: the caller may then use
+// Close to terminate them.
+//
+// Handler contexts are not cancelled while Shutdown waits, so that
+// in-flight connections may finish normally.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.stopAccepting()
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		s.cancelHandlers()
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Close immediately shuts down the server. It stops accepting new client
+// connections, cancels the contexts of all handlers so that in-flight
+// handshakes, dials and forwards are abandoned, and closes all client
+// connections being handled.
+func (s *Server) Close() error {
+	s.stopAccepting()
+	s.cancelHandlers()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for conn := range s.conns {
+		_ = conn.Close()
+	}
+	return nil
+}
+
+// Serve accepts client connections from the Listener and handles each one
+// in a new goroutine, or queues it for the pool of handler goroutines if
+// MaxHandlers is set. Serve blocks until Shutdown or Close is called, at
+// which point ServerClosed is returned.
 func (s *Server) Serve() error {
+	m := s.Metrics
+	if m == nil {
+		m = &ServerMetrics{}
+	}
+	rootCtx := s.rootContext()
+	handle := func(ctx context.Context, conn core.DuplexConn, span *trace.Span) {
+		defer s.untrackConn(conn)
+		defer m.Active.Dec()
+		defer span.End()
+		m.Active.Inc()
+		s.Handler.Handle(ctx, conn)
+	}
+	dispatch := func(ctx context.Context, conn core.DuplexConn, span *trace.Span) {
+		go handle(ctx, conn, span)
+	}
+	if s.MaxHandlers > 0 {
+		queue := s.startHandlers(m, handle)
+		defer close(queue)
+		dispatch = func(ctx context.Context, conn core.DuplexConn, span *trace.Span) {
+			s.enqueue(m, queue, queuedConn{ctx: ctx, conn: conn, span: span})
+		}
+	}
 	for {
 		clientConn, err := s.Listener.Accept()
 		if err != nil {
+			if s.isClosing() {
+				return ServerClosed
+			}
+			m.AcceptErrors.Inc()
 			s.Logger.Error(&slog.LogRecord{Msg: "listener.Accept error", Error: err})
-			time.Sleep(s.AcceptErrorCooldownDuration)
+			<-clock.Or(s.Clock).NewTimer(s.AcceptErrorCooldownDuration).C()
+			continue
+		}
+		if s.Filter != nil && !s.Filter.AllowConn(clientConn.RemoteAddr()) {
+			m.Filtered.Inc()
+			s.Logger.Debug(&slog.LogRecord{Msg: "dropped filtered connection", Details: clientConn.RemoteAddr().String()})
+			_ = clientConn.Close()
 			continue
 		}
-		duplexClientConn, err := asDuplexConn(clientConn)
+		duplexClientConn, err := core.AsDuplexConn(clientConn)
 		if err != nil {
 			_ = clientConn.Close()
 			return err
 		}
-		ctx := context.Background() // TODO consider adding cancel
+		if !s.trackConn(duplexClientConn) {
+			_ = clientConn.Close()
+			return ServerClosed
+		}
+		m.Accepted.Inc()
+		s.lastConnID++
+		connID := s.lastConnID
+		info := newConnInfo(clientConn, s.Name, clock.Or(s.Clock).Now(), s.ReadTCPInfo)
+		s.Logger.Debug(&slog.LogRecord{Msg: "Server: accepted connection", Details: info})
+		ctx := NewContextWithConnID(rootCtx, connID)
+		ctx = NewContextWithListenerName(ctx, s.Name)
+		ctx = NewContextWithConnInfo(ctx, info)
+		if s.Observer != nil {
+			ctx = NewContextWithObserver(ctx, s.Observer)
+			s.Observer.OnAccept(ctx, AcceptEvent{
+				ConnID:     connID,
+				RemoteAddr: clientConn.RemoteAddr(),
+				LocalAddr:  clientConn.LocalAddr(),
+				Time:       info.AcceptedAt,
+			})
+		}
+		ctx, span := s.Tracer.StartRootSpan(ctx, "connection")
+		span.SetAttribute("net.peer.addr", clientConn.RemoteAddr().String())
 
 		// Handler is responsible for closing the client conn
-		go s.Handler.Handle(ctx, duplexClientConn)
+		dispatch(ctx, duplexClientConn, span)
+	}
+}
+
+// startHandlers starts MaxHandlers goroutines that handle the connections
+// sent to the returned accept queue, until it is closed and drained.
+func (s *Server) startHandlers(m *ServerMetrics, handle func(ctx context.Context, conn core.DuplexConn, span *trace.Span)) chan<- queuedConn {
+	queueLength := s.AcceptQueueLength
+	if queueLength < 0 {
+		queueLength = 0
 	}
+	queue := make(chan queuedConn, queueLength)
+	for i := 0; i < s.MaxHandlers; i++ {
+		go func() {
+			for q := range queue {
+				m.Queued.Dec()
+				handle(q.ctx, q.conn, q.span)
+			}
+		}()
+	}
+	return queue
 }
 
-func asDuplexConn(conn net.Conn) (DuplexConn, error) {
-	switch cc := conn.(type) {
-	case *tls.Conn:
-		return cc, nil
-	case *net.TCPConn:
-		return cc, nil
+// enqueue sends an accepted connection to the accept queue. If the queue is
+// full, the OverflowPolicy decides whether to wait for room, or to drop the
+// connection.
+func (s *Server) enqueue(m *ServerMetrics, queue chan<- queuedConn, q queuedConn) {
+	m.Queued.Inc()
+	if s.OverflowPolicy != OverflowReject {
+		queue <- q
+		return
+	}
+	select {
+	case queue <- q:
 	default:
-		return nil, ConnectionTypeUnsupported
+		m.Queued.Dec()
+		m.Overflowed.Inc()
+		s.Logger.Warn(&slog.LogRecord{Msg: "Server: accept queue full, dropping connection", Details: q.conn.RemoteAddr().String()})
+		q.span.SetAttribute("tcplb.overflowed", "true")
+		q.span.End()
+		_ = q.conn.Close()
+		s.untrackConn(q.conn)
 	}
 }
@@ -0,0 +1,354 @@
+package forwarder
+
+import (
+	"context"
+	"github.com/stretchr/testify/require"
+	"io"
+	"net"
+	"runtime"
+	"tcplb/lib/core"
+	"tcplb/lib/metrics"
+	"tcplb/lib/slog"
+	"testing"
+	"time"
+)
+
+// blockingHandler reads from the client until the connection is closed.
+type blockingHandler struct {
+	started chan struct{}
+}
+
+func (h *blockingHandler) Handle(ctx context.Context, conn core.DuplexConn) {
+	h.started <- struct{}{}
+	_, _ = io.Copy(io.Discard, conn)
+}
+
+func startTestServer(t *testing.T, handler Handler) (*Server, <-chan error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	s := &Server{
+		Logger:   &slog.RecordingLogger{},
+		Handler:  handler,
+		Listener: listener,
+	}
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- s.Serve()
+	}()
+	return s, serveErr
+}
+
+func TestServerShutdownWaitsForHandlers(t *testing.T) {
+	handler := &blockingHandler{started: make(chan struct{}, 1)}
+	s, serveErr := startTestServer(t, handler)
+
+	client, err := net.Dial("tcp", s.Listener.Addr().String())
+	require.NoError(t, err)
+	<-handler.started
+
+	// The handler is still busy, so shutdown cannot complete in time.
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err = s.Shutdown(ctx)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	require.ErrorIs(t, <-serveErr, ServerClosed)
+
+	// New connections are refused once shutdown has begun.
+	_, err = net.Dial("tcp", s.Listener.Addr().String())
+	require.Error(t, err)
+
+	// Once the client hangs up, the handler finishes and shutdown completes.
+	require.NoError(t, client.Close())
+	require.NoError(t, s.Shutdown(context.Background()))
+}
+
+func TestServerCloseTerminatesHandlers(t *testing.T) {
+	handler := &blockingHandler{started: make(chan struct{}, 1)}
+	s, serveErr := startTestServer(t, handler)
+
+	client, err := net.Dial("tcp", s.Listener.Addr().String())
+	require.NoError(t, err)
+	defer client.Close()
+	<-handler.started
+
+	require.NoError(t, s.Close())
+	require.ErrorIs(t, <-serveErr, ServerClosed)
+
+	// Close terminated the client connection, so the handler can finish.
+	require.NoError(t, s.Shutdown(context.Background()))
+}
+
+// ctxHandler blocks until its context is cancelled.
+type ctxHandler struct {
+	started chan struct{}
+	done    chan error
+}
+
+func (h *ctxHandler) Handle(ctx context.Context, conn core.DuplexConn) {
+	h.started <- struct{}{}
+	<-ctx.Done()
+	h.done <- ctx.Err()
+}
+
+func TestServerCloseCancelsHandlerContexts(t *testing.T) {
+	handler := &ctxHandler{started: make(chan struct{}, 1), done: make(chan error, 1)}
+	s, serveErr := startTestServer(t, handler)
+
+	client, err := net.Dial("tcp", s.Listener.Addr().String())
+	require.NoError(t, err)
+	defer client.Close()
+	<-handler.started
+
+	require.NoError(t, s.Close())
+	require.ErrorIs(t, <-handler.done, context.Canceled)
+	require.ErrorIs(t, <-serveErr, ServerClosed)
+}
+
+type denyAllFilter struct{}
+
+func (denyAllFilter) AllowConn(remote net.Addr) bool { return false }
+
+func TestServerDropsFilteredConnections(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	handler := &blockingHandler{started: make(chan struct{}, 1)}
+	s := &Server{
+		Logger:   &slog.RecordingLogger{},
+		Handler:  handler,
+		Listener: listener,
+		Filter:   denyAllFilter{},
+		Metrics:  NewServerMetrics(metrics.NewRegistry()),
+	}
+	go func() { _ = s.Serve() }()
+	defer s.Close()
+
+	client, err := net.Dial("tcp", listener.Addr().String())
+	require.NoError(t, err)
+	defer client.Close()
+	_, err = client.Read(make([]byte, 1))
+	require.Error(t, err)
+	require.Len(t, handler.started, 0)
+	require.Equal(t, int64(1), s.Metrics.Filtered.Value())
+	require.Equal(t, int64(0), s.Metrics.Accepted.Value())
+}
+
+// connInfoHandler records the ConnInfo of each connection it handles.
+type connInfoHandler struct {
+	infos chan *ConnInfo
+}
+
+func (h *connInfoHandler) Handle(ctx context.Context, conn core.DuplexConn) {
+	info, _ := ConnInfoFromContext(ctx)
+	h.infos <- info
+	_ = conn.Close()
+}
+
+func TestServerRecordsConnInfo(t *testing.T) {
+	for _, readTCPInfo := range []bool{false, true} {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		handler := &connInfoHandler{infos: make(chan *ConnInfo, 1)}
+		s := &Server{
+			Name:        "main",
+			Logger:      &slog.RecordingLogger{},
+			Handler:     handler,
+			Listener:    listener,
+			ReadTCPInfo: readTCPInfo,
+		}
+		go func() { _ = s.Serve() }()
+
+		client, err := net.Dial("tcp", listener.Addr().String())
+		require.NoError(t, err)
+		info := <-handler.infos
+		require.NotNil(t, info)
+		require.Equal(t, "main", info.Listener)
+		require.Equal(t, listener.Addr().String(), info.LocalAddr)
+		require.Equal(t, client.LocalAddr().String(), info.RemoteAddr)
+		require.False(t, info.AcceptedAt.IsZero())
+		// The TCP state is only read if asked for, as it costs a syscall.
+		if !readTCPInfo {
+			require.Nil(t, info.TCP)
+		} else if runtime.GOOS == "linux" {
+			require.NotNil(t, info.TCP)
+			require.Positive(t, info.TCP.MSS)
+		}
+		_ = client.Close()
+		_ = s.Close()
+	}
+
+	_, ok := ConnInfoFromContext(context.Background())
+	require.False(t, ok)
+}
+
+func TestServerAcceptQueue(t *testing.T) {
+	for _, policy := range OverflowPolicies {
+		t.Run(string(policy), func(t *testing.T) {
+			listener, err := net.Listen("tcp", "127.0.0.1:0")
+			require.NoError(t, err)
+			handler := &blockingHandler{started: make(chan struct{}, 3)}
+			s := &Server{
+				Logger:            &slog.RecordingLogger{},
+				Handler:           handler,
+				Listener:          listener,
+				Metrics:           NewServerMetrics(metrics.NewRegistry()),
+				MaxHandlers:       1,
+				AcceptQueueLength: 1,
+				OverflowPolicy:    policy,
+			}
+			serveErr := make(chan error, 1)
+			go func() { serveErr <- s.Serve() }()
+
+			dial := func() net.Conn {
+				client, err := net.Dial("tcp", listener.Addr().String())
+				require.NoError(t, err)
+				return client
+			}
+			first := dial()
+			<-handler.started
+			// The only handler is busy, so the second connection is queued.
+			second := dial()
+			require.Eventually(t, func() bool { return s.Metrics.Queued.Value() == 1 }, 5*time.Second, time.Millisecond)
+			third := dial()
+			if policy == OverflowReject {
+				// The queue is full, so the third connection is dropped.
+				_, err = third.Read(make([]byte, 1))
+				require.Error(t, err)
+				require.Equal(t, int64(1), s.Metrics.Overflowed.Value())
+			}
+			require.Len(t, handler.started, 0)
+
+			// Each connection is handled in turn, as handlers finish.
+			require.NoError(t, first.Close())
+			<-handler.started
+			require.NoError(t, second.Close())
+			if policy == OverflowQueue {
+				// The third connection waited to be accepted.
+				<-handler.started
+				require.Equal(t, int64(0), s.Metrics.Overflowed.Value())
+			}
+			require.NoError(t, third.Close())
+			require.NoError(t, s.Shutdown(context.Background()))
+			require.ErrorIs(t, <-serveErr, ServerClosed)
+			require.Equal(t, int64(0), s.Metrics.Queued.Value())
+			require.Equal(t, int64(0), s.Metrics.Active.Value())
+		})
+	}
+}
+
+func TestServerShutdownHandlesQueuedConnections(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	handler := &blockingHandler{started: make(chan struct{}, 2)}
+	s := &Server{
+		Logger:            &slog.RecordingLogger{},
+		Handler:           handler,
+		Listener:          listener,
+		Metrics:           NewServerMetrics(metrics.NewRegistry()),
+		MaxHandlers:       1,
+		AcceptQueueLength: 1,
+	}
+	go func() { _ = s.Serve() }()
+
+	first, err := net.Dial("tcp", listener.Addr().String())
+	require.NoError(t, err)
+	<-handler.started
+	second, err := net.Dial("tcp", listener.Addr().String())
+	require.NoError(t, err)
+	require.Eventually(t, func() bool { return s.Metrics.Queued.Value() == 1 }, 5*time.Second, time.Millisecond)
+
+	// Shutdown waits for the queued connection to be handled too.
+	shutdown := make(chan error, 1)
+	go func() { shutdown <- s.Shutdown(context.Background()) }()
+	require.NoError(t, first.Close())
+	<-handler.started
+	require.NoError(t, second.Close())
+	require.NoError(t, <-shutdown)
+}
+
+// anyUpstreamDialer dials an arbitrary candidate upstream.
+type anyUpstreamDialer struct{}
+
+func (anyUpstreamDialer) DialBestUpstream(ctx context.Context, candidates core.UpstreamSet) (core.Upstream, core.DuplexConn, error) {
+	for u := range candidates {
+		dialer := net.Dialer{Timeout: time.Second}
+		conn, err := dialer.DialContext(ctx, u.Network, u.Address)
+		if err != nil {
+			return u, nil, err
+		}
+		return u, conn.(*net.TCPConn), nil
+	}
+	return core.Upstream{}, nil, NoUpstreamAvailable
+}
+
+// startEchoUpstream starts an upstream that echoes everything it reads.
+func startEchoUpstream(t testing.TB) core.Upstream {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return core.Upstream{Network: "tcp", Address: listener.Addr().String()}
+}
+
+func TestNewServer(t *testing.T) {
+	upstream := startEchoUpstream(t)
+	var trace []string
+	s, err := NewServer(
+		WithListenAddress("tcp", "127.0.0.1:0"),
+		WithLogger(&slog.RecordingLogger{}),
+		WithUpstreams(upstream),
+		WithDialer(anyUpstreamDialer{}),
+		WithMiddleware(Stage{Name: "tracing", Middleware: func(inner Handler) Handler {
+			return &tracingHandler{name: "tracing", trace: &trace, Inner: inner}
+		}}),
+	)
+	require.NoError(t, err)
+	go func() { _ = s.Serve() }()
+	defer s.Close()
+
+	client, err := net.Dial("tcp", s.Listener.Addr().String())
+	require.NoError(t, err)
+	defer client.Close()
+	_, err = client.Write([]byte("hello"))
+	require.NoError(t, err)
+	reply := make([]byte, 5)
+	_, err = io.ReadFull(client, reply)
+	require.NoError(t, err)
+	require.Equal(t, "hello", string(reply))
+	require.Equal(t, []string{"tracing"}, trace)
+}
+
+func TestNewServerErrors(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+	upstream := core.Upstream{Network: "tcp", Address: "127.0.0.1:1"}
+
+	_, err = NewServer(WithUpstreams(upstream), WithDialer(anyUpstreamDialer{}))
+	require.ErrorIs(t, err, NoListener)
+	_, err = NewServer(WithListener(listener), WithUpstreams(upstream))
+	require.ErrorIs(t, err, NoDialer)
+	_, err = NewServer(WithListener(listener), WithDialer(anyUpstreamDialer{}))
+	require.ErrorIs(t, err, NoUpstreams)
+	_, err = NewServer(WithListener(listener), WithHandler(rejectingHandler{}), WithUpstreams(upstream))
+	require.ErrorIs(t, err, ConflictingOptions)
+	_, err = NewServer(WithListener(listener), WithUpstreams(upstream), WithDialer(anyUpstreamDialer{}), WithChain(func(c *Chain) error {
+		return c.Remove(StageRateLimit)
+	}))
+	require.ErrorIs(t, err, UnknownStage)
+
+	s, err := NewServer(WithListener(listener), WithHandler(rejectingHandler{}))
+	require.NoError(t, err)
+	require.Equal(t, listener, s.Listener)
+	require.NotNil(t, s.Logger)
+}
@@ -0,0 +1,250 @@
+package forwarder
+
+import (
+	"errors"
+	"io"
+	"sync"
+	"sync/atomic"
+	"tcplb/lib/metrics"
+	"time"
+)
+
+// SlowConsumerExceeded is returned, possibly wrapped, by a Forwarder that
+// stopped forwarding because a peer did not take the data sent to it as
+// fast as the other peer sent it.
+var SlowConsumerExceeded = errors.New("slow consumer")
+
+// SlowConsumerPolicy is what a Forwarder does about a peer whose writes
+// block, e.g. a client on a slow link downloading from a fast upstream.
+type SlowConsumerPolicy string
+
+const (
+	// SlowConsumerThrottle stops reading from the sender until the slow
+	// consumer takes the data already read, as if slow consumers were not
+	// detected, so that the sender is slowed to the consumer's pace. Slow
+	// writes are only counted.
+	SlowConsumerThrottle SlowConsumerPolicy = "throttle"
+	// SlowConsumerBuffer keeps reading from the sender once a consumer is
+	// slow, buffering up to a bound while it catches up, so that bursts do
+	// not hold up the sender. Forwarding stops with SlowConsumerExceeded if
+	// the buffer overflows. Consumers that have never been slow are not
+	// buffered for.
+	SlowConsumerBuffer SlowConsumerPolicy = "buffer"
+	// SlowConsumerTerminate stops forwarding with SlowConsumerExceeded as
+	// soon as a write blocks for the write timeout, freeing the sender.
+	SlowConsumerTerminate SlowConsumerPolicy = "terminate"
+)
+
+// SlowConsumerPolicies are the known SlowConsumerPolicy values.
+var SlowConsumerPolicies = []SlowConsumerPolicy{SlowConsumerThrottle, SlowConsumerBuffer, SlowConsumerTerminate}
+
+// SlowConsumerConfig configures how a Forwarder handles slow consumers.
+type SlowConsumerConfig struct {
+	WriteTimeout time.Duration        // WriteTimeout is how long a write to a peer may block before the peer is a slow consumer. If not positive, slow consumers are not detected.
+	Policy       SlowConsumerPolicy   // Policy is what is done about slow consumers. If empty, SlowConsumerThrottle.
+	BufferSize   int                  // BufferSize bounds the bytes buffered in each direction under SlowConsumerBuffer.
+	Metrics      *SlowConsumerMetrics // Metrics is optional. If nil, no metrics are recorded.
+}
+
+// SlowConsumerMetrics holds the metrics recorded by a Forwarder about slow
+// consumers.
+type SlowConsumerMetrics struct {
+	SlowWrites    *metrics.Counter // SlowWrites counts writes that blocked for the write timeout.
+	BlockedMillis *metrics.Counter // BlockedMillis counts the milliseconds that slow writes blocked for, in all.
+	Terminated    *metrics.Counter // Terminated counts connections stopped because of a slow consumer.
+}
+
+// NewSlowConsumerMetrics returns SlowConsumerMetrics registered in the
+// given Registry.
+func NewSlowConsumerMetrics(r *metrics.Registry) *SlowConsumerMetrics {
+	return &SlowConsumerMetrics{
+		SlowWrites:    r.Counter("slow_consumer_writes_total"),
+		BlockedMillis: r.Counter("slow_consumer_blocked_milliseconds_total"),
+		Terminated:    r.Counter("slow_consumer_terminated_total"),
+	}
+}
+
+func (m *SlowConsumerMetrics) recordSlowWrite() {
+	if m == nil {
+		return
+	}
+	m.SlowWrites.Inc()
+}
+
+func (m *SlowConsumerMetrics) recordBlocked(d time.Duration) {
+	if m == nil {
+		return
+	}
+	m.BlockedMillis.Add(d.Milliseconds())
+}
+
+func (m *SlowConsumerMetrics) recordTerminated() {
+	if m == nil {
+		return
+	}
+	m.Terminated.Inc()
+}
+
+// slowWriter is an io.Writer that calls onSlow, from another goroutine,
+// once a write to it has blocked for timeout.
+//
+// Unlike the idle timeout, which is checked by a DeadlineManager, each
+// write resets a timer, as a write may block at any moment however busy
+// the connection is. The timer is only armed if slow consumers are
+// detected.
+type slowWriter struct {
+	w       io.Writer
+	timeout time.Duration
+	metrics *SlowConsumerMetrics
+	timer   *time.Timer
+	slow    int32 // slow is 1 once the current write has blocked for timeout, accessed atomically.
+}
+
+func newSlowWriter(w io.Writer, timeout time.Duration, m *SlowConsumerMetrics, onSlow func()) *slowWriter {
+	s := &slowWriter{w: w, timeout: timeout, metrics: m}
+	s.timer = time.AfterFunc(timeout, func() {
+		atomic.StoreInt32(&s.slow, 1)
+		s.metrics.recordSlowWrite()
+		onSlow()
+	})
+	s.timer.Stop()
+	return s
+}
+
+func (s *slowWriter) Write(p []byte) (int, error) {
+	start := time.Now()
+	s.timer.Reset(s.timeout)
+	n, err := s.w.Write(p)
+	s.timer.Stop()
+	if atomic.SwapInt32(&s.slow, 0) == 1 {
+		s.metrics.recordBlocked(time.Since(start))
+	}
+	return n, err
+}
+
+// Stop stops the timer, once no more writes will be made.
+func (s *slowWriter) Stop() {
+	s.timer.Stop()
+}
+
+// readAheadChunk is the size of each read made by a readAhead.
+const readAheadChunk = 32 * 1024
+
+// readAhead is an io.Reader that reads from src. Until start is called,
+// each read is made from src directly. From then on, reads are made from
+// src in the readAhead's own goroutine, ahead of its own reads, buffering up
+// to max bytes, so that reading from src continues while whoever reads
+// from the readAhead is blocked writing. Once more than max bytes are
+// buffered, overflow is called, from the goroutine reading src, and
+// reading stops.
+//
+// Data read is buffered contiguously, so that the memory held is bounded
+// by max however small the reads from src are.
+//
+// Reads from src may continue after the readAhead is closed, until src is
+// closed, but the data read is discarded.
+type readAhead struct {
+	src      io.Reader
+	max      int
+	overflow func()
+
+	mu       sync.Mutex // mu guards the fields below
+	cond     *sync.Cond // cond is signalled as data is buffered, reading stops, or the readAhead is closed.
+	started  bool       // started is set once start is called.
+	direct   bool       // direct is set while Read reads from src directly.
+	buffered []byte
+	err      error // err is the error that stopped reading from src, if any.
+	closed   bool
+}
+
+func newReadAhead(src io.Reader, max int, overflow func()) *readAhead {
+	r := &readAhead{src: src, max: max, overflow: overflow}
+	r.cond = sync.NewCond(&r.mu)
+	return r
+}
+
+// start starts reading ahead, once any read from src in progress returns.
+func (r *readAhead) start() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.started || r.closed {
+		return
+	}
+	r.started = true
+	if !r.direct {
+		go r.run()
+	}
+}
+
+func (r *readAhead) run() {
+	buf := make([]byte, readAheadChunk)
+	for {
+		n, err := r.src.Read(buf)
+		r.mu.Lock()
+		if r.closed {
+			r.mu.Unlock()
+			return
+		}
+		r.buffered = append(r.buffered, buf[:n]...)
+		overflowed := len(r.buffered) > r.max
+		switch {
+		case err != nil:
+			r.err = err
+		case overflowed:
+			r.err = SlowConsumerExceeded
+		}
+		stopped := r.err != nil
+		r.cond.Broadcast()
+		r.mu.Unlock()
+		if overflowed && err == nil {
+			r.overflow()
+		}
+		if stopped {
+			return
+		}
+	}
+}
+
+// Read returns data read from src directly, until reading ahead starts.
+// Then it returns buffered data, waiting for some if there is none. Once
+// the buffer is empty and reading has stopped, it returns the error that
+// stopped reading.
+func (r *readAhead) Read(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.started {
+		r.direct = true
+		r.mu.Unlock()
+		n, err := r.src.Read(p)
+		r.mu.Lock()
+		r.direct = false
+		if r.started && !r.closed {
+			go r.run()
+		}
+		return n, err
+	}
+	for len(r.buffered) == 0 && r.err == nil && !r.closed {
+		r.cond.Wait()
+	}
+	if len(r.buffered) == 0 {
+		if r.closed {
+			return 0, io.ErrClosedPipe
+		}
+		return 0, r.err
+	}
+	n := copy(p, r.buffered)
+	r.buffered = r.buffered[n:]
+	if len(r.buffered) == 0 {
+		r.buffered = nil
+	}
+	return n, nil
+}
+
+// Close discards the buffered data, and any data read from src later.
+func (r *readAhead) Close() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.closed = true
+	r.buffered = nil
+	r.cond.Broadcast()
+}
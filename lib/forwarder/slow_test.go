@@ -0,0 +1,124 @@
+package forwarder
+
+import (
+	"context"
+	"github.com/stretchr/testify/require"
+	"io"
+	"sync/atomic"
+	"tcplb/lib/metrics"
+	"testing"
+	"time"
+)
+
+func TestMediocreForwarderSlowConsumer(t *testing.T) {
+	// The upstream sends size bytes, then closes its end, while the client
+	// only starts reading after wait.
+	forward := func(f MediocreForwarder, size int, wait time.Duration) (int, error) {
+		client, clientPeer := newPipeConns()
+		upstream, upstreamPeer := newPipeConns()
+		go func() {
+			_, _ = upstreamPeer.Write(make([]byte, size))
+			_ = upstreamPeer.Close()
+		}()
+		received := make(chan int, 1)
+		go func() {
+			time.Sleep(wait)
+			n, _ := io.CopyN(io.Discard, clientPeer, int64(size))
+			_ = clientPeer.Close()
+			received <- int(n)
+		}()
+		result := make(chan error, 1)
+		go func() {
+			result <- f.Forward(context.Background(), client, upstream)
+		}()
+		select {
+		case err := <-result:
+			return <-received, err
+		case <-time.After(5 * time.Second):
+			t.Fatal("Forward did not return")
+			return 0, nil
+		}
+	}
+	slow := func(policy SlowConsumerPolicy, m *SlowConsumerMetrics) MediocreForwarder {
+		return MediocreForwarder{SlowConsumer: SlowConsumerConfig{WriteTimeout: 20 * time.Millisecond, Policy: policy, BufferSize: 64 * 1024, Metrics: m}}
+	}
+
+	// Throttled slow consumers are only counted.
+	registry := metrics.NewRegistry()
+	n, err := forward(slow(SlowConsumerThrottle, NewSlowConsumerMetrics(registry)), 1000, 100*time.Millisecond)
+	require.NoError(t, err)
+	require.Equal(t, 1000, n)
+	snapshot := registry.Snapshot()
+	require.Equal(t, int64(1), snapshot["slow_consumer_writes_total"])
+	require.GreaterOrEqual(t, snapshot["slow_consumer_blocked_milliseconds_total"], int64(20))
+	require.Equal(t, int64(0), snapshot["slow_consumer_terminated_total"])
+
+	// Terminated slow consumers are cut off.
+	registry = metrics.NewRegistry()
+	_, err = forward(slow(SlowConsumerTerminate, NewSlowConsumerMetrics(registry)), 1000, 300*time.Millisecond)
+	require.ErrorIs(t, err, SlowConsumerExceeded)
+	require.Equal(t, int64(1), registry.Snapshot()["slow_consumer_terminated_total"])
+
+	// Data within the buffer is read from the upstream at once, and taken by
+	// the slow consumer later. Beyond it, the slow consumer is cut off.
+	n, err = forward(slow(SlowConsumerBuffer, nil), 16*1024, 100*time.Millisecond)
+	require.NoError(t, err)
+	require.Equal(t, 16*1024, n)
+	_, err = forward(slow(SlowConsumerBuffer, nil), 1024*1024, 300*time.Millisecond)
+	require.ErrorIs(t, err, SlowConsumerExceeded)
+
+	// Consumers that keep up are not slow, nor buffered for, however much
+	// they are sent.
+	n, err = forward(slow(SlowConsumerTerminate, nil), 1024*1024, 0)
+	require.NoError(t, err)
+	require.Equal(t, 1024*1024, n)
+	n, err = forward(slow(SlowConsumerBuffer, nil), 1024*1024, 0)
+	require.NoError(t, err)
+	require.Equal(t, 1024*1024, n)
+}
+
+// byteReader returns one byte per Read, counting the Reads.
+type byteReader struct {
+	reads int32 // reads is accessed atomically.
+}
+
+func (r *byteReader) Read(p []byte) (int, error) {
+	atomic.AddInt32(&r.reads, 1)
+	p[0] = 'x'
+	return 1, nil
+}
+
+func TestReadAheadSmallReads(t *testing.T) {
+	src := &byteReader{}
+	overflowed := make(chan struct{})
+	ahead := newReadAhead(src, 1000, func() { close(overflowed) })
+	defer ahead.Close()
+
+	// Until it starts, reads are made from src only as asked.
+	buf := make([]byte, 10)
+	n, err := ahead.Read(buf)
+	require.NoError(t, err)
+	require.Equal(t, 1, n)
+	time.Sleep(10 * time.Millisecond)
+	require.Equal(t, int32(1), atomic.LoadInt32(&src.reads))
+
+	// Once started, many small reads are buffered together, and the memory
+	// they hold is bounded by the buffer size, not by the number of reads.
+	ahead.start()
+	select {
+	case <-overflowed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("readAhead did not overflow")
+	}
+	ahead.mu.Lock()
+	require.Len(t, ahead.buffered, 1001)
+	require.LessOrEqual(t, cap(ahead.buffered), 2*1001)
+	ahead.mu.Unlock()
+
+	// The buffered data is read before the overflow is reported.
+	n, err = ahead.Read(make([]byte, 2000))
+	require.NoError(t, err)
+	require.Equal(t, 1001, n)
+	_, err = ahead.Read(buf)
+	require.ErrorIs(t, err, SlowConsumerExceeded)
+}
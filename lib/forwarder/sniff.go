@@ -0,0 +1,243 @@
+package forwarder
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"os"
+	"tcplb/lib/accesslog"
+	"tcplb/lib/core"
+	"tcplb/lib/metrics"
+	"tcplb/lib/slog"
+	"tcplb/lib/trace"
+	"time"
+)
+
+// PeekConn is a net.Conn whose first bytes can be inspected with Peek
+// before they are read. Bytes that have been peeked are returned by
+// later Reads, so that a TLS server reading from the PeekConn sees the
+// connection from the start.
+//
+// Peek must not be called concurrently with Read.
+type PeekConn struct {
+	net.Conn
+	peeked []byte
+}
+
+// Peek returns the next n bytes of the connection without consuming them,
+// reading until they arrive. If fewer than n bytes can be read, those that
+// were read are returned, with the error that ended reading.
+func (c *PeekConn) Peek(n int) ([]byte, error) {
+	for len(c.peeked) < n {
+		buf := make([]byte, n-len(c.peeked))
+		m, err := c.Conn.Read(buf)
+		c.peeked = append(c.peeked, buf[:m]...)
+		if err != nil {
+			return c.peeked, err
+		}
+	}
+	return c.peeked[:n], nil
+}
+
+func (c *PeekConn) Read(p []byte) (int, error) {
+	if len(c.peeked) > 0 {
+		n := copy(p, c.peeked)
+		c.peeked = c.peeked[n:]
+		return n, nil
+	}
+	return c.Conn.Read(p)
+}
+
+// NetConn returns the connection wrapped by c.
+func (c *PeekConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// PeekListener is a net.Listener that wraps each connection it accepts in a
+// PeekConn. It is meant to sit beneath a TLS listener, e.g.
+// tls.NewListener(&PeekListener{Listener: l}, config), so that a
+// SniffingHandler can inspect what clients send before the TLS handshake.
+type PeekListener struct {
+	net.Listener
+}
+
+func (l *PeekListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &PeekConn{Conn: conn}, nil
+}
+
+// Classes of client connections rejected by a SniffingHandler.
+const (
+	SniffHTTP                 = "http"                   // SniffHTTP means the client sent a plaintext HTTP request.
+	SniffSSH                  = "ssh"                    // SniffSSH means the client sent an SSH version banner.
+	SniffNotClientHello       = "not_client_hello"       // SniffNotClientHello means the client sent a TLS record that does not begin a handshake with a ClientHello.
+	SniffOversizedClientHello = "oversized_client_hello" // SniffOversizedClientHello means the client's ClientHello is larger than the limit.
+	SniffBinary               = "binary"                 // SniffBinary means the client sent bytes that are not TLS, nor recognised.
+	SniffTimeout              = "timeout"                // SniffTimeout means the client did not send enough bytes in time.
+	SniffClientClosed         = "client_closed"          // SniffClientClosed means the client hung up before sending enough bytes.
+)
+
+// sniffClasses lists every class of rejected connection.
+var sniffClasses = []string{
+	SniffHTTP,
+	SniffSSH,
+	SniffNotClientHello,
+	SniffOversizedClientHello,
+	SniffBinary,
+	SniffTimeout,
+	SniffClientClosed,
+}
+
+// Lengths of the headers that begin a ClientHello: a TLS record header,
+// followed by a handshake message header.
+const (
+	tlsRecordHeaderLength    = 5
+	tlsHandshakeHeaderLength = 4
+	sniffLength              = tlsRecordHeaderLength + tlsHandshakeHeaderLength
+)
+
+const (
+	tlsRecordTypeHandshake      = 0x16
+	tlsHandshakeTypeClientHello = 0x01
+)
+
+// httpMethodPrefixes are the first bytes of plaintext HTTP requests.
+var httpMethodPrefixes = [][]byte{
+	[]byte("GET "), []byte("HEAD"), []byte("POST"), []byte("PUT "), []byte("DELE"),
+	[]byte("CONN"), []byte("OPTI"), []byte("TRAC"), []byte("PATC"), []byte("PRI "),
+}
+
+// classifyFirstBytes returns the class of connection that begins with b,
+// which holds sniffLength bytes, or "" if it begins with a ClientHello of
+// at most maxClientHello bytes. If maxClientHello is not positive, the
+// size of the ClientHello is not checked.
+func classifyFirstBytes(b []byte, maxClientHello int) string {
+	if b[0] == tlsRecordTypeHandshake && b[1] == 0x03 {
+		if b[tlsRecordHeaderLength] != tlsHandshakeTypeClientHello {
+			return SniffNotClientHello
+		}
+		n := int(b[6])<<16 | int(b[7])<<8 | int(b[8])
+		if maxClientHello > 0 && n > maxClientHello {
+			return SniffOversizedClientHello
+		}
+		return ""
+	}
+	for _, prefix := range httpMethodPrefixes {
+		if bytes.HasPrefix(b, prefix) {
+			return SniffHTTP
+		}
+	}
+	if bytes.HasPrefix(b, []byte("SSH-")) {
+		return SniffSSH
+	}
+	return SniffBinary
+}
+
+// classifySniffError returns the class of connection whose first bytes
+// could not be read because of err.
+func classifySniffError(err error) string {
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		return SniffTimeout
+	}
+	return SniffClientClosed
+}
+
+// SniffMetrics holds the metrics recorded by a SniffingHandler.
+type SniffMetrics struct {
+	Passed   *metrics.Counter            // Passed counts connections that began with a ClientHello.
+	Rejected map[string]*metrics.Counter // Rejected counts rejected connections, by class.
+}
+
+// NewSniffMetrics returns SniffMetrics registered in the given Registry.
+func NewSniffMetrics(r *metrics.Registry) *SniffMetrics {
+	m := &SniffMetrics{
+		Passed:   r.Counter("sniff_passed_total"),
+		Rejected: make(map[string]*metrics.Counter, len(sniffClasses)),
+	}
+	for _, class := range sniffClasses {
+		m.Rejected[class] = r.Counter("sniff_rejected_" + class + "_total")
+	}
+	return m
+}
+
+func (m *SniffMetrics) recordPassed() {
+	if m == nil {
+		return
+	}
+	m.Passed.Inc()
+}
+
+func (m *SniffMetrics) recordRejected(class string) {
+	if m == nil {
+		return
+	}
+	m.Rejected[class].Inc()
+}
+
+// SniffingHandler is a handler that inspects the first bytes a client sends
+// before its TLS handshake begins, and drops connections that obviously do
+// not begin with a ClientHello, e.g. plaintext HTTP requests, or random
+// bytes from scanners, and those whose first bytes do not arrive within
+// Timeout. Such connections are dropped at once, instead of occupying the
+// TLS stack until the handshake times out. The class of each dropped
+// connection is logged, recorded in the access log and counted in Metrics.
+//
+// Only TLS connections accepted from a PeekListener are inspected. Other
+// connections are passed to Inner unchanged.
+type SniffingHandler struct {
+	Logger  slog.Logger
+	Timeout time.Duration // Timeout bounds the wait for the first bytes. If not positive, there is no bound.
+	// MaxClientHelloSize is optional. If positive, connections whose
+	// ClientHello is larger than MaxClientHelloSize bytes are dropped.
+	MaxClientHelloSize int
+	Metrics            *SniffMetrics // Metrics is optional. If nil, no metrics are recorded.
+	Inner              Handler
+}
+
+func (h *SniffingHandler) Handle(ctx context.Context, conn core.DuplexConn) {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		h.Inner.Handle(ctx, conn)
+		return
+	}
+	peekConn, ok := tlsConn.NetConn().(*PeekConn)
+	if !ok {
+		h.Inner.Handle(ctx, conn)
+		return
+	}
+
+	_, span := trace.StartSpan(ctx, "sniff")
+	if h.Timeout > 0 {
+		_ = peekConn.SetReadDeadline(time.Now().Add(h.Timeout))
+	}
+	b, err := peekConn.Peek(sniffLength)
+	if h.Timeout > 0 {
+		_ = peekConn.SetReadDeadline(time.Time{})
+	}
+	var class string
+	if err != nil {
+		class = classifySniffError(err)
+	} else {
+		class = classifyFirstBytes(b, h.MaxClientHelloSize)
+	}
+	if class == "" {
+		span.End()
+		h.Metrics.recordPassed()
+		h.Inner.Handle(ctx, conn)
+		return
+	}
+	span.SetAttribute("tcplb.sniff", class)
+	span.End()
+	h.Metrics.recordRejected(class)
+	h.Logger.Warn(&slog.LogRecord{Msg: "SniffingHandler: connection is not TLS", Reason: accesslog.ReasonNotTLS, Error: err, Details: class})
+	record := accesslog.RecordFromContext(ctx)
+	record.SetHandshakeError(class)
+	record.SetReason(accesslog.ReasonNotTLS)
+}
+
+var _ Handler = (*SniffingHandler)(nil) // type check
@@ -0,0 +1,67 @@
+package forwarder
+
+import (
+	"context"
+	"crypto/tls"
+	"github.com/stretchr/testify/require"
+	"net"
+	"tcplb/lib/accesslog"
+	"tcplb/lib/metrics"
+	"tcplb/lib/slog"
+	"tcplb/lib/testbed"
+	"testing"
+	"time"
+)
+
+func TestSniffingHandler(t *testing.T) {
+	tb := testbed.New(t)
+	serverConfig := tb.ServerTLSConfig(tb.Server(t, "tcplb.test"))
+	clientConfig := tb.ClientTLSConfig(tb.Client(t, "client"))
+	clientConfig.ServerName = "tcplb.test"
+	sniffMetrics := NewSniffMetrics(metrics.NewRegistry())
+	h := &SniffingHandler{
+		Logger:             &slog.RecordingLogger{},
+		Timeout:            100 * time.Millisecond,
+		MaxClientHelloSize: 4096,
+		Metrics:            sniffMetrics,
+		Inner:              handshakingHandler{},
+	}
+	// sniff returns the reason h records for a client that sends what send
+	// does.
+	sniff := func(send func(conn net.Conn)) accesslog.ReasonCode {
+		client, server := net.Pipe()
+		defer client.Close()
+		defer server.Close()
+		go send(client)
+		record := accesslog.NewRecord("client", time.Now())
+		h.Handle(accesslog.NewContextWithRecord(context.Background(), record), tls.Server(&PeekConn{Conn: server}, serverConfig))
+		return record.Reason()
+	}
+	write := func(b []byte) func(conn net.Conn) {
+		return func(conn net.Conn) { _, _ = conn.Write(b) }
+	}
+
+	// The peeked ClientHello is replayed to the TLS server.
+	require.Equal(t, accesslog.ReasonForwarded, sniff(func(conn net.Conn) {
+		_ = tls.Client(conn, clientConfig).Handshake()
+	}))
+	require.Equal(t, int64(1), sniffMetrics.Passed.Value())
+
+	for class, send := range map[string]func(conn net.Conn){
+		SniffHTTP:                 write([]byte("GET / HTTP/1.1\r\nHost: tcplb.test\r\n\r\n")),
+		SniffSSH:                  write([]byte("SSH-2.0-OpenSSH_9.0\r\n")),
+		SniffBinary:               write([]byte{0x00, 0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08, 0x09}),
+		SniffNotClientHello:       write([]byte{0x16, 0x03, 0x01, 0x00, 0x10, 0x02, 0x00, 0x00, 0x0c}),
+		SniffOversizedClientHello: write([]byte{0x16, 0x03, 0x01, 0x40, 0x00, 0x01, 0x00, 0x20, 0x00}),
+		SniffTimeout:              func(conn net.Conn) {},
+		SniffClientClosed:         func(conn net.Conn) { _ = conn.Close() },
+	} {
+		require.Equal(t, accesslog.ReasonNotTLS, sniff(send), class)
+		require.Equal(t, int64(1), sniffMetrics.Rejected[class].Value(), class)
+	}
+
+	// Connections that were not accepted from a PeekListener are passed on.
+	clientConn, _ := newPipeConns()
+	h.Inner = &clientIDRecordingHandler{}
+	require.Equal(t, accesslog.ReasonForwarded, handleRecordingReason(h, clientConn))
+}
@@ -0,0 +1,214 @@
+package forwarder
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"tcplb/lib/accesslog"
+	"tcplb/lib/core"
+	"tcplb/lib/slog"
+)
+
+// SOCKSProtocolError is returned, possibly wrapped, when a client does not
+// speak SOCKS version 5 as expected, or asks for something other than to
+// CONNECT to an address.
+var SOCKSProtocolError = errors.New("SOCKS5 protocol error")
+
+// SOCKS version 5 protocol constants (RFC 1928).
+const (
+	socksVersion5          = 0x05
+	socksMethodNoAuth      = 0x00
+	socksMethodUnavailable = 0xff
+	socksCommandConnect    = 0x01
+	socksAddressIPv4       = 0x01
+	socksAddressDomain     = 0x03
+	socksAddressIPv6       = 0x04
+)
+
+// SOCKS version 5 reply codes (RFC 1928).
+const (
+	socksReplySucceeded          = 0x00
+	socksReplyGeneralFailure     = 0x01
+	socksReplyNotAllowed         = 0x02
+	socksReplyHostUnreachable    = 0x04
+	socksReplyCommandUnsupported = 0x07
+	socksReplyAddressUnsupported = 0x08
+	socksNoReply                 = 0xff // socksNoReply is unassigned, and never sent.
+)
+
+// SOCKS5Handler is a handler that lets clients choose their upstream by
+// speaking SOCKS version 5 (RFC 1928). Each client sends a CONNECT request
+// for the address of an upstream, which must be one of the candidate
+// upstreams in the context, i.e. one that the client is authorized for,
+// so that clients select their destination dynamically while authorization
+// stays with the server. The Inner handler is given the requested upstream
+// as the only candidate.
+//
+// Clients must already be authenticated, e.g. by their TLS certificate,
+// so only the SOCKS method that requires no further authentication is
+// offered. The reply to the CONNECT request is sent once the Inner handler
+// has dialed the upstream, so that clients learn if the dial failed, or
+// once the Inner handler returns, if it did not dial.
+//
+// Clients that are slow to send their requests are only bounded by the
+// deadline of the connection, if any, e.g. the pre-authentication budget.
+type SOCKS5Handler struct {
+	Logger slog.Logger
+	Inner  Handler
+}
+
+func (h *SOCKS5Handler) Handle(ctx context.Context, conn core.DuplexConn) {
+	clientID, _ := ClientIDFromContext(ctx)
+	candidates, ok := UpstreamsFromContext(ctx)
+	if !ok {
+		h.Logger.Error(&slog.LogRecord{Msg: "SOCKS5Handler: Failed to get candidate Upstreams from context", Reason: accesslog.ReasonInternalError})
+		accesslog.SetReason(ctx, accesslog.ReasonInternalError)
+		return
+	}
+	host, port, reply, err := readSOCKSRequest(conn)
+	if err != nil {
+		if reply != socksNoReply {
+			_ = writeSOCKSReply(conn, reply)
+		}
+		h.Logger.Warn(&slog.LogRecord{Msg: "SOCKS5Handler: bad request", Reason: accesslog.ReasonSOCKSError, ClientID: &clientID, Error: err})
+		accesslog.SetReason(ctx, accesslog.ReasonSOCKSError)
+		return
+	}
+	upstream, ok := matchSOCKSUpstream(candidates, host, port)
+	if !ok {
+		_ = writeSOCKSReply(conn, socksReplyNotAllowed)
+		h.Logger.Warn(&slog.LogRecord{Msg: "SOCKS5Handler: client not authorized for requested address", Reason: accesslog.ReasonNotAuthorized, ClientID: &clientID, Details: net.JoinHostPort(host, port)})
+		accesslog.SetReason(ctx, accesslog.ReasonNotAuthorized)
+		return
+	}
+
+	replier := &socksReplier{conn: conn}
+	defer replier.reply(socksReplyGeneralFailure) // If the Inner handler did not dial.
+	observer := Observers{ObserverFromContext(ctx), replier}
+	childCtx := NewContextWithObserver(NewContextWithUpstreams(ctx, core.NewUpstreamSet(upstream)), observer)
+	h.Inner.Handle(childCtx, conn)
+}
+
+var _ Handler = (*SOCKS5Handler)(nil) // type check
+
+// socksReplier is a ConnectionLifecycleObserver that replies to the SOCKS
+// CONNECT request of a client once its upstream is dialed.
+type socksReplier struct {
+	NopObserver
+	conn core.DuplexConn
+	once sync.Once
+}
+
+func (r *socksReplier) OnDial(ctx context.Context, event DialEvent) {
+	if event.Err != nil {
+		r.reply(socksReplyHostUnreachable)
+		return
+	}
+	r.reply(socksReplySucceeded)
+}
+
+// reply sends the reply to the client, unless one was already sent.
+func (r *socksReplier) reply(code byte) {
+	r.once.Do(func() { _ = writeSOCKSReply(r.conn, code) })
+}
+
+// readSOCKSRequest negotiates the SOCKS method with the client, and reads
+// its CONNECT request. If the request cannot be served, the error returned
+// is accompanied by the code to reply with, or by socksNoReply if the
+// request was not understood well enough to reply to.
+func readSOCKSRequest(conn io.ReadWriter) (host, port string, reply byte, err error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return "", "", socksNoReply, err
+	}
+	if header[0] != socksVersion5 {
+		return "", "", socksNoReply, fmt.Errorf("%w: unsupported version %d", SOCKSProtocolError, header[0])
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return "", "", socksNoReply, err
+	}
+	method := byte(socksMethodUnavailable)
+	for _, m := range methods {
+		if m == socksMethodNoAuth {
+			method = socksMethodNoAuth
+		}
+	}
+	if _, err := conn.Write([]byte{socksVersion5, method}); err != nil {
+		return "", "", socksNoReply, err
+	}
+	if method == socksMethodUnavailable {
+		return "", "", socksNoReply, fmt.Errorf("%w: client does not offer the method without authentication", SOCKSProtocolError)
+	}
+
+	request := make([]byte, 4)
+	if _, err := io.ReadFull(conn, request); err != nil {
+		return "", "", socksNoReply, err
+	}
+	if request[0] != socksVersion5 {
+		return "", "", socksReplyGeneralFailure, fmt.Errorf("%w: unsupported version %d", SOCKSProtocolError, request[0])
+	}
+	if request[1] != socksCommandConnect {
+		return "", "", socksReplyCommandUnsupported, fmt.Errorf("%w: unsupported command %d", SOCKSProtocolError, request[1])
+	}
+	var address []byte
+	switch request[3] {
+	case socksAddressIPv4:
+		address = make([]byte, net.IPv4len)
+	case socksAddressIPv6:
+		address = make([]byte, net.IPv6len)
+	case socksAddressDomain:
+		length := make([]byte, 1)
+		if _, err := io.ReadFull(conn, length); err != nil {
+			return "", "", socksNoReply, err
+		}
+		address = make([]byte, length[0])
+	default:
+		return "", "", socksReplyAddressUnsupported, fmt.Errorf("%w: unsupported address type %d", SOCKSProtocolError, request[3])
+	}
+	portBytes := make([]byte, 2)
+	if _, err := io.ReadFull(conn, address); err != nil {
+		return "", "", socksNoReply, err
+	}
+	if _, err := io.ReadFull(conn, portBytes); err != nil {
+		return "", "", socksNoReply, err
+	}
+	host = string(address)
+	if request[3] != socksAddressDomain {
+		host = net.IP(address).String()
+	}
+	return host, strconv.Itoa(int(binary.BigEndian.Uint16(portBytes))), 0, nil
+}
+
+// writeSOCKSReply replies to a CONNECT request with the given code. The
+// bound address is not disclosed.
+func writeSOCKSReply(conn io.Writer, code byte) error {
+	_, err := conn.Write([]byte{socksVersion5, code, 0x00, socksAddressIPv4, 0, 0, 0, 0, 0, 0})
+	return err
+}
+
+// matchSOCKSUpstream returns the candidate whose address is host:port, if
+// any. Hosts match if they are the same name, ignoring case, or the same IP
+// address, however written.
+func matchSOCKSUpstream(candidates core.UpstreamSet, host, port string) (core.Upstream, bool) {
+	ip := net.ParseIP(host)
+	for _, u := range candidates.Sorted() {
+		uHost, uPort, err := net.SplitHostPort(u.Address)
+		if err != nil || uPort != port {
+			continue
+		}
+		if strings.EqualFold(uHost, host) {
+			return u, true
+		}
+		if uIP := net.ParseIP(uHost); ip != nil && uIP != nil && uIP.Equal(ip) {
+			return u, true
+		}
+	}
+	return core.Upstream{}, false
+}
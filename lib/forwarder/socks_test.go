@@ -0,0 +1,66 @@
+package forwarder
+
+import (
+	"context"
+	"github.com/stretchr/testify/require"
+	"io"
+	"net"
+	"tcplb/lib/accesslog"
+	"tcplb/lib/core"
+	"tcplb/lib/slog"
+	"testing"
+	"time"
+)
+
+func TestSOCKS5Handler(t *testing.T) {
+	web := core.Upstream{Network: "tcp", Address: "10.0.0.1:80"}
+	db := core.Upstream{Network: "tcp", Address: "db.internal:5432"}
+	// connect sends the CONNECT request to h, with the given address type
+	// and address, and returns the reply code, the candidates h dialed, and
+	// the reason h recorded.
+	connect := func(h *SOCKS5Handler, atyp byte, addr []byte, port uint16) (byte, []core.UpstreamSet, accesslog.ReasonCode) {
+		dialer := &recordingDialer{}
+		h.Inner = &ForwardingHandler{Logger: h.Logger, Dialer: dialer, Forwarder: stubForwarder{}}
+		client, server := net.Pipe()
+		defer client.Close()
+		reply := make(chan byte, 1)
+		go func() {
+			method := make([]byte, 2)
+			_, _ = client.Write([]byte{socksVersion5, 1, socksMethodNoAuth})
+			_, _ = io.ReadFull(client, method)
+			request := append([]byte{socksVersion5, socksCommandConnect, 0, atyp}, addr...)
+			// net.Pipe is unbuffered, so write the request while reading the
+			// reply, in case h replies before reading all of it.
+			go func() { _, _ = client.Write(append(request, byte(port>>8), byte(port))) }()
+			response := make([]byte, 10)
+			_, _ = io.ReadFull(client, response)
+			reply <- response[1]
+		}()
+		record := accesslog.NewRecord("client", time.Now())
+		ctx := NewContextWithUpstreams(NewContextWithClientID(accesslog.NewContextWithRecord(context.Background(), record), core.ClientID{Key: "alice"}), core.NewUpstreamSet(web, db))
+		h.Handle(ctx, pipeConn{server})
+		return <-reply, dialer.candidates, record.Reason()
+	}
+	h := &SOCKS5Handler{Logger: &slog.RecordingLogger{}}
+
+	// Clients may connect to any of their candidate upstreams, by IP address
+	// or name, and nothing else.
+	code, dialed, reason := connect(h, socksAddressIPv4, []byte{10, 0, 0, 1}, 80)
+	require.Equal(t, byte(socksReplySucceeded), code)
+	require.Equal(t, []core.UpstreamSet{core.NewUpstreamSet(web)}, dialed)
+	require.Equal(t, accesslog.ReasonForwarded, reason)
+
+	code, dialed, _ = connect(h, socksAddressDomain, append([]byte{11}, "DB.internal"...), 5432)
+	require.Equal(t, byte(socksReplySucceeded), code)
+	require.Equal(t, []core.UpstreamSet{core.NewUpstreamSet(db)}, dialed)
+
+	code, dialed, reason = connect(h, socksAddressIPv4, []byte{10, 0, 0, 1}, 443)
+	require.Equal(t, byte(socksReplyNotAllowed), code)
+	require.Empty(t, dialed)
+	require.Equal(t, accesslog.ReasonNotAuthorized, reason)
+
+	code, dialed, reason = connect(h, 0x09, nil, 80)
+	require.Equal(t, byte(socksReplyAddressUnsupported), code)
+	require.Empty(t, dialed)
+	require.Equal(t, accesslog.ReasonSOCKSError, reason)
+}
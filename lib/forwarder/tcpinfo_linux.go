@@ -0,0 +1,54 @@
+//go:build !386
+
+package forwarder
+
+import (
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// Bits of tcp_info.tcpi_options, from linux/tcp.h.
+const (
+	tcpiOptTimestamps = 1
+	tcpiOptSACK       = 2
+	tcpiOptWScale     = 4
+	tcpiOptECN        = 8
+)
+
+// readTCPInfo returns the TCP state of the socket sc, as reported by the
+// TCP_INFO socket option, or nil if it cannot be read.
+func readTCPInfo(sc syscall.Conn) *TCPInfo {
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return nil
+	}
+	var ti syscall.TCPInfo
+	var errno syscall.Errno
+	err = raw.Control(func(fd uintptr) {
+		size := uint32(syscall.SizeofTCPInfo)
+		_, _, errno = syscall.Syscall6(syscall.SYS_GETSOCKOPT, fd, syscall.IPPROTO_TCP, syscall.TCP_INFO,
+			uintptr(unsafe.Pointer(&ti)), uintptr(unsafe.Pointer(&size)), 0)
+	})
+	if err != nil || errno != 0 {
+		return nil
+	}
+	info := &TCPInfo{
+		MSS: int(ti.Snd_mss),
+		RTT: time.Duration(ti.Rtt) * time.Microsecond,
+	}
+	for _, opt := range []struct {
+		bit  uint8
+		name string
+	}{
+		{tcpiOptTimestamps, TCPOptionTimestamps},
+		{tcpiOptSACK, TCPOptionSACK},
+		{tcpiOptWScale, TCPOptionWindowScale},
+		{tcpiOptECN, TCPOptionECN},
+	} {
+		if ti.Options&opt.bit != 0 {
+			info.Options = append(info.Options, opt.name)
+		}
+	}
+	return info
+}
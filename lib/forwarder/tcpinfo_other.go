@@ -0,0 +1,11 @@
+//go:build !linux || 386
+
+package forwarder
+
+import "syscall"
+
+// readTCPInfo returns nil, as this platform does not expose the TCP state
+// of sockets via the standard library.
+func readTCPInfo(sc syscall.Conn) *TCPInfo {
+	return nil
+}
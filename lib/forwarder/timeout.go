@@ -0,0 +1,237 @@
+package forwarder
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// IdleTimeoutExceeded is returned, possibly wrapped, by a Forwarder that
+// stopped forwarding because no data was copied in either direction for too
+// long.
+var IdleTimeoutExceeded = errors.New("connection idle timeout exceeded")
+
+// MaxDurationExceeded is returned, possibly wrapped, by a Forwarder that
+// stopped forwarding because the connection had been open for too long.
+var MaxDurationExceeded = errors.New("connection max duration exceeded")
+
+// HalfOpenTimeoutExceeded is returned, possibly wrapped, by a Forwarder that
+// stopped forwarding because one direction of the connection stayed open
+// for too long after the other was closed.
+var HalfOpenTimeoutExceeded = errors.New("connection half-open timeout exceeded")
+
+// DeadlineManager enforces progress-based timeouts on connections, e.g. the
+// idle timeout and max duration of forwarded connections.
+//
+// Deadlines set with SetDeadline are no use for this: after a write on a
+// *tls.Conn times out, the TLS state is corrupt, so the deadline cannot be
+// pushed back once data flows again. Instead, whoever copies data counts
+// the bytes copied as progress, and a DeadlineManager checks each
+// connection's count from a single goroutine, with a timer wheel, so that
+// no timer is reset per read or write. A connection that times out is
+// expired by its owner, e.g. by closing the transport beneath it.
+//
+// Progress is checked when the idle timeout would next elapse, so a
+// connection that stops making progress is expired after between one and
+// two idle timeouts, give or take the resolution of the wheel.
+//
+// Multiple goroutines may invoke methods on a DeadlineManager
+// simultaneously.
+type DeadlineManager struct {
+	resolution time.Duration
+	now        func() time.Time
+	start      time.Time
+
+	mu    sync.Mutex         // mu guards slots and tick.
+	slots [][]*deadlineWatch // slots is the wheel. Watches due at tick t are in slots[t%len(slots)].
+	tick  int64              // tick is the last tick that was checked.
+}
+
+// deadlineWheelSlots is the number of slots of the timer wheel of a
+// DeadlineManager. Watches due more than one revolution of the wheel away
+// are passed over until they are due.
+const deadlineWheelSlots = 512
+
+// defaultDeadlineResolution is the resolution of the DeadlineManager used by
+// Forwarders that are not given one.
+const defaultDeadlineResolution = time.Second
+
+// NewDeadlineManager returns a DeadlineManager that checks deadlines once
+// per resolution. It must be started with Start.
+func NewDeadlineManager(resolution time.Duration) *DeadlineManager {
+	now := time.Now
+	return &DeadlineManager{
+		resolution: resolution,
+		now:        now,
+		start:      now(),
+		slots:      make([][]*deadlineWatch, deadlineWheelSlots),
+	}
+}
+
+var defaultDeadlines struct {
+	once    sync.Once
+	manager *DeadlineManager
+}
+
+// defaultDeadlineManager returns the DeadlineManager shared by Forwarders
+// that are not given one, starting it on first use. It runs until the
+// process exits.
+func defaultDeadlineManager() *DeadlineManager {
+	defaultDeadlines.once.Do(func() {
+		defaultDeadlines.manager = NewDeadlineManager(defaultDeadlineResolution)
+		defaultDeadlines.manager.Start()
+	})
+	return defaultDeadlines.manager
+}
+
+// Start starts a goroutine that checks deadlines once per resolution. The
+// returned stop function stops the goroutine.
+func (m *DeadlineManager) Start() (stop func()) {
+	ticker := time.NewTicker(m.resolution)
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		for {
+			select {
+			case <-ticker.C:
+				m.advance()
+			case <-done:
+				return
+			}
+		}
+	}()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			ticker.Stop()
+			close(done)
+			<-stopped
+		})
+	}
+}
+
+// tickAt returns the first tick at or after t.
+func (m *DeadlineManager) tickAt(t time.Time) int64 {
+	d := t.Sub(m.start)
+	tick := int64(d / m.resolution)
+	if d%m.resolution != 0 {
+		tick++
+	}
+	return tick
+}
+
+// deadlineWatch is a connection watched by a DeadlineManager.
+type deadlineWatch struct {
+	progress int64 // progress counts bytes copied, accessed atomically. It is first so that it is 64-bit aligned on 32-bit platforms.
+
+	idle    time.Duration // idle is the idle timeout. If not positive, there is none.
+	maxDue  time.Time     // maxDue is when the max duration elapses. If zero, there is none.
+	expire  func(err error)
+	stopped int32 // stopped is 1 once the watch is stopped, accessed atomically.
+
+	// Fields below are only accessed by the DeadlineManager with its mu held.
+	lastProgress int64
+	idleDue      time.Time
+	due          int64 // due is the tick the watch is next checked at.
+}
+
+// Progress records that n more bytes were copied.
+func (w *deadlineWatch) Progress(n int64) {
+	atomic.AddInt64(&w.progress, n)
+}
+
+// Stop stops watching, so that the watch does not expire. The
+// DeadlineManager forgets the watch when it is next due.
+func (w *deadlineWatch) Stop() {
+	atomic.StoreInt32(&w.stopped, 1)
+}
+
+// watch starts watching a connection that times out if it makes no
+// progress for idle, or once maxDuration has passed. If either is not
+// positive, it does not apply. When the connection times out, expire is
+// called, from the goroutine of the DeadlineManager, with
+// IdleTimeoutExceeded or MaxDurationExceeded. expire must not block.
+func (m *DeadlineManager) watch(idle, maxDuration time.Duration, expire func(err error)) *deadlineWatch {
+	now := m.now()
+	w := &deadlineWatch{idle: idle, expire: expire}
+	if idle > 0 {
+		w.idleDue = now.Add(idle)
+	}
+	if maxDuration > 0 {
+		w.maxDue = now.Add(maxDuration)
+	}
+	if idle <= 0 && maxDuration <= 0 {
+		return w
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.schedule(w)
+	return w
+}
+
+// schedule places w in the slot of the tick it is next due at.
+func (m *DeadlineManager) schedule(w *deadlineWatch) {
+	due := w.idleDue
+	if due.IsZero() || (!w.maxDue.IsZero() && w.maxDue.Before(due)) {
+		due = w.maxDue
+	}
+	w.due = m.tickAt(due)
+	if w.due <= m.tick {
+		w.due = m.tick + 1
+	}
+	slot := w.due % int64(len(m.slots))
+	m.slots[slot] = append(m.slots[slot], w)
+}
+
+// advance checks every watch due up to now, expiring those that timed out.
+func (m *DeadlineManager) advance() {
+	now := m.now()
+	type expiry struct {
+		w   *deadlineWatch
+		err error
+	}
+	var expired []expiry
+
+	m.mu.Lock()
+	target := int64(now.Sub(m.start) / m.resolution)
+	for m.tick < target {
+		m.tick++
+		tick := m.tick
+		slot := tick % int64(len(m.slots))
+		due := m.slots[slot]
+		m.slots[slot] = nil
+		for _, w := range due {
+			if atomic.LoadInt32(&w.stopped) == 1 {
+				continue
+			}
+			if w.due > tick {
+				// Due in a later revolution of the wheel.
+				m.slots[slot] = append(m.slots[slot], w)
+				continue
+			}
+			if !w.maxDue.IsZero() && !now.Before(w.maxDue) {
+				expired = append(expired, expiry{w: w, err: MaxDurationExceeded})
+				continue
+			}
+			if w.idle > 0 {
+				if progress := atomic.LoadInt64(&w.progress); progress != w.lastProgress {
+					w.lastProgress = progress
+					w.idleDue = now.Add(w.idle)
+				} else if !now.Before(w.idleDue) {
+					expired = append(expired, expiry{w: w, err: IdleTimeoutExceeded})
+					continue
+				}
+			}
+			m.schedule(w)
+		}
+	}
+	m.mu.Unlock()
+
+	for _, e := range expired {
+		if atomic.CompareAndSwapInt32(&e.w.stopped, 0, 1) {
+			e.w.expire(e.err)
+		}
+	}
+}
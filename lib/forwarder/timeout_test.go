@@ -0,0 +1,48 @@
+package forwarder
+
+import (
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestDeadlineManager(t *testing.T) {
+	now := time.Unix(0, 0)
+	m := NewDeadlineManager(time.Second)
+	m.now = func() time.Time { return now }
+	m.start = now
+	advance := func(d time.Duration) {
+		now = now.Add(d)
+		m.advance()
+	}
+	expired := make(map[string]error)
+	watch := func(name string, idle, maxDuration time.Duration) *deadlineWatch {
+		return m.watch(idle, maxDuration, func(err error) { expired[name] = err })
+	}
+
+	idle := watch("idle", 10*time.Second, 0)
+	busy := watch("busy", 10*time.Second, 0)
+	capped := watch("capped", 10*time.Second, 25*time.Second)
+	stopped := watch("stopped", 10*time.Second, 0)
+	long := watch("long", 20*time.Minute, 0)
+	stopped.Stop()
+	for i := 0; i < 30; i++ {
+		busy.Progress(1)
+		capped.Progress(1)
+		advance(time.Second)
+	}
+	require.Equal(t, map[string]error{"idle": IdleTimeoutExceeded, "capped": MaxDurationExceeded}, expired)
+	idle.Progress(1) // Progress after expiry changes nothing.
+
+	// Once progress stops, connections expire within two idle timeouts.
+	advance(20 * time.Second)
+	require.ErrorIs(t, expired["busy"], IdleTimeoutExceeded)
+	busy.Stop()
+
+	// Watches due beyond one revolution of the wheel are kept until due.
+	require.NotContains(t, expired, "long")
+	advance(25 * time.Minute)
+	require.ErrorIs(t, expired["long"], IdleTimeoutExceeded)
+	long.Stop()
+	require.NotContains(t, expired, "stopped")
+}
@@ -0,0 +1,45 @@
+package forwarder
+
+import (
+	"errors"
+	"io"
+	"net"
+	"syscall"
+	"tcplb/lib/core"
+)
+
+// UpstreamReset is returned, possibly wrapped, by a Forwarder that stopped
+// forwarding because the upstream reset the connection (TCP RST), rather
+// than finishing it in an orderly way.
+var UpstreamReset = errors.New("upstream reset the connection")
+
+// isReset reports whether err is the result of the peer resetting the
+// connection.
+func isReset(err error) bool {
+	return errors.Is(err, syscall.ECONNRESET)
+}
+
+// resetOnClose arranges for the connection beneath conn to be reset (TCP
+// RST) when it is closed, if it is a TCP connection, so that its peer
+// learns that the connection was aborted rather than finished.
+func resetOnClose(conn net.Conn) {
+	if tcpConn, ok := core.TransportConn(conn).(*net.TCPConn); ok {
+		_ = tcpConn.SetLinger(0)
+	}
+}
+
+// errorRecordingReader is an io.Reader that records whether a read from it
+// failed, so that errors returned by io.Copy may be told apart from those
+// of writes.
+type errorRecordingReader struct {
+	r      io.Reader
+	failed bool
+}
+
+func (r *errorRecordingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if err != nil && err != io.EOF {
+		r.failed = true
+	}
+	return n, err
+}
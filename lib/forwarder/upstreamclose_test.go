@@ -0,0 +1,85 @@
+package forwarder
+
+import (
+	"context"
+	"github.com/stretchr/testify/require"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestMediocreForwarderUpstreamReset(t *testing.T) {
+	client, clientConn := newTCPConnPair(t)
+	defer client.Close()
+	defer clientConn.Close()
+	upstreamConn, upstreamPeer := newTCPConnPair(t)
+	defer upstreamConn.Close()
+
+	result := make(chan error, 1)
+	go func() {
+		result <- MediocreForwarder{}.Forward(context.Background(), clientConn, upstreamConn)
+	}()
+
+	// The client is silent, so only the reset can end Forward.
+	require.NoError(t, upstreamPeer.SetLinger(0))
+	require.NoError(t, upstreamPeer.Close())
+	select {
+	case err := <-result:
+		require.ErrorIs(t, err, UpstreamReset)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Forward did not return after the upstream reset")
+	}
+	_, err := client.Read(make([]byte, 1))
+	require.True(t, isReset(err), err)
+}
+
+func TestMediocreForwarderUpstreamClosedDeliversResponse(t *testing.T) {
+	client, clientConn := newTCPConnPair(t)
+	defer client.Close()
+	defer clientConn.Close()
+	upstreamConn, upstreamPeer := newTCPConnPair(t)
+	defer upstreamConn.Close()
+
+	result := make(chan error, 1)
+	go func() {
+		result <- MediocreForwarder{}.Forward(context.Background(), clientConn, upstreamConn)
+	}()
+
+	// The upstream answers, e.g. with an error, and closes the connection
+	// without waiting for the rest of the client's request. The client
+	// keeps sending regardless, which the upstream can no longer read.
+	response := "HTTP/1.1 413 Payload Too Large\r\n\r\n"
+	_, err := upstreamPeer.Write([]byte(response))
+	require.NoError(t, err)
+	require.NoError(t, upstreamPeer.Close())
+	buf := make([]byte, len(response))
+	_, err = io.ReadFull(client, buf)
+	require.NoError(t, err)
+	require.Equal(t, response, string(buf))
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			if _, err := client.Write([]byte("x")); err != nil {
+				return
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}()
+	select {
+	case err := <-result:
+		require.NotErrorIs(t, err, UpstreamReset)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Forward did not return after the upstream closed")
+	}
+
+	// The client is not reset: it sees the end of the response.
+	n, err := client.Read(make([]byte, 1))
+	require.Equal(t, 0, n)
+	require.ErrorIs(t, err, io.EOF)
+}
@@ -0,0 +1,121 @@
+// Package geoip looks up the country and autonomous system (ASN) of client
+// IP addresses in MaxMind DB files, and decides whether to serve clients
+// according to where they connect from.
+package geoip
+
+import (
+	"context"
+	"net/netip"
+	"strings"
+)
+
+// Location is what is known about where an IP address is from. Fields are
+// zero if unknown.
+type Location struct {
+	Country string `json:"country,omitempty"` // Country is the ISO 3166-1 alpha-2 country code, e.g. "NZ".
+	ASN     uint32 `json:"asn,omitempty"`     // ASN is the autonomous system number.
+	ASOrg   string `json:"as_org,omitempty"`  // ASOrg is the organisation of the autonomous system.
+}
+
+// Locator looks up the Location of IP addresses.
+//
+// Multiple goroutines may invoke methods on a Locator simultaneously.
+type Locator interface {
+	Locate(addr netip.Addr) (Location, error)
+}
+
+// Locate returns the Location of addr, as recorded in a GeoLite2 or
+// GeoIP2 Country, City or ASN database. If the database has no record of
+// addr, the zero Location is returned.
+func (r *Reader) Locate(addr netip.Addr) (Location, error) {
+	record, ok, err := r.Lookup(addr)
+	if err != nil || !ok {
+		return Location{}, err
+	}
+	m, _ := record.(map[string]interface{})
+	var loc Location
+	for _, key := range []string{"country", "registered_country"} {
+		country, _ := m[key].(map[string]interface{})
+		if code, ok := country["iso_code"].(string); ok {
+			loc.Country = code
+			break
+		}
+	}
+	if asn, ok := m["autonomous_system_number"].(uint64); ok {
+		loc.ASN = uint32(asn)
+	}
+	loc.ASOrg, _ = m["autonomous_system_organization"].(string)
+	return loc, nil
+}
+
+// Readers is a Locator that combines the Locations found by each Reader,
+// e.g. a country database and an ASN database. Where Readers disagree, the
+// first to know a field wins.
+type Readers []*Reader
+
+func (rs Readers) Locate(addr netip.Addr) (Location, error) {
+	var loc Location
+	for _, r := range rs {
+		l, err := r.Locate(addr)
+		if err != nil {
+			return Location{}, err
+		}
+		if loc.Country == "" {
+			loc.Country = l.Country
+		}
+		if loc.ASN == 0 {
+			loc.ASN, loc.ASOrg = l.ASN, l.ASOrg
+		}
+	}
+	return loc, nil
+}
+
+var _ Locator = (*Reader)(nil) // type check
+var _ Locator = Readers(nil)   // type check
+
+// Policy decides whether to serve clients according to their Location.
+type Policy struct {
+	AllowCountries []string // AllowCountries is optional. If not empty, only clients in these countries are served.
+	DenyCountries  []string // DenyCountries are countries whose clients are not served.
+	DenyASNs       []uint32 // DenyASNs are autonomous systems whose clients are not served.
+}
+
+// Allowed reports if clients from loc may be served. Clients of unknown
+// country are denied if AllowCountries is not empty.
+func (p Policy) Allowed(loc Location) bool {
+	for _, c := range p.DenyCountries {
+		if strings.EqualFold(c, loc.Country) {
+			return false
+		}
+	}
+	for _, asn := range p.DenyASNs {
+		if asn == loc.ASN {
+			return false
+		}
+	}
+	if len(p.AllowCountries) == 0 {
+		return true
+	}
+	for _, c := range p.AllowCountries {
+		if strings.EqualFold(c, loc.Country) {
+			return true
+		}
+	}
+	return false
+}
+
+type locationContextKeyType struct{}
+
+var locationContextKey = locationContextKeyType{}
+
+// NewContextWithLocation returns a child context of parent that carries
+// the Location of the client, for use by later handlers, e.g. authorizers.
+func NewContextWithLocation(parent context.Context, loc Location) context.Context {
+	return context.WithValue(parent, locationContextKey, loc)
+}
+
+// LocationFromContext returns the Location stored in ctx, if any.
+func LocationFromContext(ctx context.Context) (Location, bool) {
+	loc, ok := ctx.Value(locationContextKey).(Location)
+	return loc, ok
+}
@@ -0,0 +1,297 @@
+package geoip
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/stretchr/testify/require"
+	"net/netip"
+	"sort"
+	"testing"
+)
+
+// pointer is encoded as a data section pointer to the given offset.
+type pointer uint64
+
+// encodeControl encodes the control byte(s) of a value of type typ and size.
+func encodeControl(typ int, size int) []byte {
+	var sizeBits byte
+	var sizeBytes []byte
+	switch {
+	case size < 29:
+		sizeBits = byte(size)
+	case size < 285:
+		sizeBits, sizeBytes = 29, []byte{byte(size - 29)}
+	default:
+		sizeBits, sizeBytes = 30, []byte{byte((size - 285) >> 8), byte(size - 285)}
+	}
+	var out []byte
+	if typ <= typeMap {
+		out = []byte{byte(typ)<<5 | sizeBits}
+	} else {
+		out = []byte{sizeBits, byte(typ - 7)}
+	}
+	return append(out, sizeBytes...)
+}
+
+func encodeUint(typ int, n uint64) []byte {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], n)
+	payload := b[:]
+	for len(payload) > 0 && payload[0] == 0 {
+		payload = payload[1:]
+	}
+	return append(encodeControl(typ, len(payload)), payload...)
+}
+
+// encodeValue encodes v in the MaxMind DB data section format.
+func encodeValue(t *testing.T, v interface{}) []byte {
+	switch v := v.(type) {
+	case string:
+		return append(encodeControl(typeString, len(v)), v...)
+	case uint16:
+		return encodeUint(typeUint16, uint64(v))
+	case uint32:
+		return encodeUint(typeUint32, uint64(v))
+	case uint64:
+		return encodeUint(typeUint64, v)
+	case bool:
+		if v {
+			return encodeControl(typeBool, 1)
+		}
+		return encodeControl(typeBool, 0)
+	case pointer:
+		if v < 2048 {
+			return []byte{typePointer<<5 | byte(v>>8)&0x7, byte(v)}
+		}
+		v -= 2048
+		return []byte{typePointer<<5 | 1<<3 | byte(v>>16)&0x7, byte(v >> 8), byte(v)}
+	case []interface{}:
+		out := encodeControl(typeArray, len(v))
+		for _, item := range v {
+			out = append(out, encodeValue(t, item)...)
+		}
+		return out
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		out := encodeControl(typeMap, len(v))
+		for _, k := range keys {
+			out = append(out, encodeValue(t, k)...)
+			out = append(out, encodeValue(t, v[k])...)
+		}
+		return out
+	}
+	t.Fatalf("cannot encode %T", v)
+	return nil
+}
+
+type testNetwork struct {
+	prefix string
+	record interface{}
+}
+
+// buildDatabase returns a MaxMind DB mapping each network to its record.
+// Networks must not overlap.
+func buildDatabase(t *testing.T, ipVersion int, recordSize int, networks []testNetwork) []byte {
+	// Records of nodes are child node indices, emptyRecord, or the data
+	// offset of a network's record encoded as -(2+offset).
+	const emptyRecord = -1
+	nodes := [][2]int64{{emptyRecord, emptyRecord}}
+	var data []byte
+	for _, n := range networks {
+		prefix := netip.MustParsePrefix(n.prefix)
+		var bits []byte
+		bitLen := prefix.Bits()
+		if ipVersion == 6 && prefix.Addr().Is4() {
+			// IPv4 networks live under ::/96 in IPv6 trees.
+			var b [16]byte
+			v4 := prefix.Addr().As4()
+			copy(b[12:], v4[:])
+			bits = b[:]
+			bitLen += 96
+		} else if prefix.Addr().Is4() {
+			b := prefix.Addr().As4()
+			bits = b[:]
+		} else {
+			b := prefix.Addr().As16()
+			bits = b[:]
+		}
+		offset := int64(len(data))
+		data = append(data, encodeValue(t, n.record)...)
+
+		node := 0
+		for i := 0; i < bitLen; i++ {
+			bit := (bits[i/8] >> (7 - uint(i%8))) & 1
+			if i == bitLen-1 {
+				nodes[node][bit] = -(2 + offset)
+				break
+			}
+			if nodes[node][bit] == emptyRecord {
+				nodes = append(nodes, [2]int64{emptyRecord, emptyRecord})
+				nodes[node][bit] = int64(len(nodes) - 1)
+			}
+			node = int(nodes[node][bit])
+		}
+	}
+
+	nodeCount := uint64(len(nodes))
+	value := func(r int64) uint64 {
+		switch {
+		case r == emptyRecord:
+			return nodeCount
+		case r < 0:
+			return nodeCount + dataSectionSeparatorSize + uint64(-(r + 2))
+		default:
+			return uint64(r)
+		}
+	}
+	var buf []byte
+	for _, n := range nodes {
+		left, right := value(n[0]), value(n[1])
+		switch recordSize {
+		case 24:
+			buf = append(buf, byte(left>>16), byte(left>>8), byte(left), byte(right>>16), byte(right>>8), byte(right))
+		case 28:
+			buf = append(buf, byte(left>>16), byte(left>>8), byte(left), byte(left>>24)<<4|byte(right>>24)&0x0F, byte(right>>16), byte(right>>8), byte(right))
+		case 32:
+			var b [8]byte
+			binary.BigEndian.PutUint32(b[:4], uint32(left))
+			binary.BigEndian.PutUint32(b[4:], uint32(right))
+			buf = append(buf, b[:]...)
+		}
+	}
+	buf = append(buf, make([]byte, dataSectionSeparatorSize)...)
+	buf = append(buf, data...)
+	buf = append(buf, metadataStartMarker...)
+	buf = append(buf, encodeValue(t, map[string]interface{}{
+		"binary_format_major_version": uint16(2),
+		"database_type":               "Test",
+		"ip_version":                  uint16(ipVersion),
+		"node_count":                  uint32(nodeCount),
+		"record_size":                 uint16(recordSize),
+	})...)
+	return buf
+}
+
+func countryRecord(code string) map[string]interface{} {
+	return map[string]interface{}{"country": map[string]interface{}{"iso_code": code}}
+}
+
+func TestReaderLocatesCountries(t *testing.T) {
+	for _, recordSize := range []int{24, 28, 32} {
+		db := buildDatabase(t, 6, recordSize, []testNetwork{
+			{"192.0.2.0/24", countryRecord("NZ")},
+			{"2001:db8::/32", countryRecord("AU")},
+			{"198.51.100.0/24", map[string]interface{}{"registered_country": map[string]interface{}{"iso_code": "FR"}}},
+		})
+		r, err := FromBytes(db)
+		require.NoError(t, err, recordSize)
+		require.Equal(t, "Test", r.DatabaseType)
+
+		scenarios := map[string]Location{
+			"192.0.2.7":        {Country: "NZ"},
+			"::ffff:192.0.2.7": {Country: "NZ"},
+			"2001:db8::1":      {Country: "AU"},
+			"198.51.100.1":     {Country: "FR"},
+			"203.0.113.1":      {},
+			"2001:db9::1":      {},
+		}
+		for addr, expected := range scenarios {
+			loc, err := r.Locate(netip.MustParseAddr(addr))
+			require.NoError(t, err, addr)
+			require.Equal(t, expected, loc, "%s with record size %d", addr, recordSize)
+		}
+	}
+}
+
+func TestReadersCombineDatabases(t *testing.T) {
+	countries, err := FromBytes(buildDatabase(t, 6, 24, []testNetwork{
+		{"203.0.113.0/24", countryRecord("NZ")},
+	}))
+	require.NoError(t, err)
+	asnRecord := map[string]interface{}{
+		"autonomous_system_number":       uint32(64500),
+		"autonomous_system_organization": "Example Networks",
+	}
+	// The second network's record points to the first network's record.
+	asns, err := FromBytes(buildDatabase(t, 4, 28, []testNetwork{
+		{"203.0.113.0/24", asnRecord},
+		{"198.51.100.0/24", pointer(0)},
+	}))
+	require.NoError(t, err)
+
+	loc, err := Readers{countries, asns}.Locate(netip.MustParseAddr("203.0.113.9"))
+	require.NoError(t, err)
+	require.Equal(t, Location{Country: "NZ", ASN: 64500, ASOrg: "Example Networks"}, loc)
+
+	loc, err = Readers{countries, asns}.Locate(netip.MustParseAddr("198.51.100.9"))
+	require.NoError(t, err)
+	require.Equal(t, Location{ASN: 64500, ASOrg: "Example Networks"}, loc)
+
+	// IPv6 addresses cannot be found in IPv4 databases.
+	loc, err = asns.Locate(netip.MustParseAddr("2001:db8::1"))
+	require.NoError(t, err)
+	require.Equal(t, Location{}, loc)
+}
+
+func TestReaderDecodesDataTypes(t *testing.T) {
+	record := map[string]interface{}{
+		"array": []interface{}{"a", uint16(1), true},
+		"long":  string(make([]byte, 300)),
+		"big":   uint64(1 << 40),
+		"false": false,
+	}
+	r, err := FromBytes(buildDatabase(t, 4, 24, []testNetwork{{"10.0.0.0/8", record}}))
+	require.NoError(t, err)
+	value, ok, err := r.Lookup(netip.MustParseAddr("10.1.2.3"))
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, map[string]interface{}{
+		"array": []interface{}{"a", uint64(1), true},
+		"long":  string(make([]byte, 300)),
+		"big":   uint64(1 << 40),
+		"false": false,
+	}, value)
+}
+
+func TestFromBytesRejectsInvalidDatabases(t *testing.T) {
+	_, err := FromBytes([]byte("not a database"))
+	require.ErrorIs(t, err, InvalidDatabase)
+
+	db := buildDatabase(t, 4, 24, []testNetwork{{"10.0.0.0/8", countryRecord("NZ")}})
+	// The metadata describes a search tree larger than what remains.
+	_, err = FromBytes(db[bytes.LastIndex(db, metadataStartMarker)-10:])
+	require.ErrorIs(t, err, InvalidDatabase)
+
+	// A truncated record cannot be decoded.
+	r, err := FromBytes(db)
+	require.NoError(t, err)
+	r.data = r.data[:3]
+	_, _, err = r.Lookup(netip.MustParseAddr("10.0.0.1"))
+	require.ErrorIs(t, err, InvalidDatabase)
+}
+
+func TestPolicyAllowed(t *testing.T) {
+	scenarios := []struct {
+		name    string
+		policy  Policy
+		loc     Location
+		allowed bool
+	}{
+		{"empty policy allows all", Policy{}, Location{}, true},
+		{"allowed country", Policy{AllowCountries: []string{"NZ"}}, Location{Country: "NZ"}, true},
+		{"country codes ignore case", Policy{AllowCountries: []string{"nz"}}, Location{Country: "NZ"}, true},
+		{"other country", Policy{AllowCountries: []string{"NZ"}}, Location{Country: "AU"}, false},
+		{"unknown country with allowlist", Policy{AllowCountries: []string{"NZ"}}, Location{}, false},
+		{"denied country", Policy{DenyCountries: []string{"AU"}}, Location{Country: "AU"}, false},
+		{"denied asn", Policy{AllowCountries: []string{"NZ"}, DenyASNs: []uint32{64500}}, Location{Country: "NZ", ASN: 64500}, false},
+	}
+	for _, s := range scenarios {
+		t.Run(s.name, func(t *testing.T) {
+			require.Equal(t, s.allowed, s.policy.Allowed(s.loc))
+		})
+	}
+}
@@ -0,0 +1,374 @@
+package geoip
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"net/netip"
+	"os"
+)
+
+// InvalidDatabase is returned, possibly wrapped, when a MaxMind DB is
+// malformed or uses features that are not supported.
+var InvalidDatabase = errors.New("invalid MaxMind DB")
+
+// metadataStartMarker precedes the metadata at the end of a MaxMind DB.
+var metadataStartMarker = []byte("\xAB\xCD\xEFMaxMind.com")
+
+// dataSectionSeparatorSize is the number of zero bytes between the search
+// tree and the data section.
+const dataSectionSeparatorSize = 16
+
+// maxDecodeDepth bounds the nesting of maps and arrays, so that malformed
+// databases cannot exhaust the stack.
+const maxDecodeDepth = 32
+
+// Reader looks up IP addresses in a MaxMind DB (MMDB) file, such as the
+// GeoLite2 Country, City and ASN databases. The whole file is held in
+// memory.
+//
+// Multiple goroutines may invoke methods on a Reader simultaneously.
+type Reader struct {
+	DatabaseType string // DatabaseType is taken from the metadata, e.g. "GeoLite2-Country".
+
+	tree       []byte // tree is the binary search tree section.
+	data       []byte // data is the data section.
+	nodeCount  uint64
+	recordSize uint64 // recordSize is the size of each record in bits: 24, 28 or 32.
+	ipVersion  uint64
+	ipv4Start  uint64 // ipv4Start is the node at which IPv4 lookups start in IPv6 trees.
+}
+
+// Open reads the MaxMind DB file at path.
+func Open(path string) (*Reader, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	r, err := FromBytes(buf)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return r, nil
+}
+
+// FromBytes returns a Reader of the MaxMind DB held in buf.
+func FromBytes(buf []byte) (*Reader, error) {
+	i := bytes.LastIndex(buf, metadataStartMarker)
+	if i < 0 {
+		return nil, fmt.Errorf("%w: metadata not found", InvalidDatabase)
+	}
+	value, _, err := decoder{buf: buf[i+len(metadataStartMarker):]}.decode(0, 0)
+	if err != nil {
+		return nil, err
+	}
+	metadata, ok := value.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%w: metadata is not a map", InvalidDatabase)
+	}
+	r := &Reader{}
+	r.DatabaseType, _ = metadata["database_type"].(string)
+	r.nodeCount, _ = metadata["node_count"].(uint64)
+	r.recordSize, _ = metadata["record_size"].(uint64)
+	r.ipVersion, _ = metadata["ip_version"].(uint64)
+	if major, _ := metadata["binary_format_major_version"].(uint64); major != 2 {
+		return nil, fmt.Errorf("%w: unsupported binary format version %d", InvalidDatabase, major)
+	}
+	switch r.recordSize {
+	case 24, 28, 32:
+	default:
+		return nil, fmt.Errorf("%w: unsupported record size %d", InvalidDatabase, r.recordSize)
+	}
+	if r.ipVersion != 4 && r.ipVersion != 6 {
+		return nil, fmt.Errorf("%w: unsupported IP version %d", InvalidDatabase, r.ipVersion)
+	}
+	treeSize := r.nodeCount * r.recordSize / 4
+	if treeSize+dataSectionSeparatorSize > uint64(i) {
+		return nil, fmt.Errorf("%w: search tree larger than file", InvalidDatabase)
+	}
+	r.tree = buf[:treeSize]
+	r.data = buf[treeSize+dataSectionSeparatorSize : i]
+
+	if r.ipVersion == 6 {
+		// IPv4 addresses are found under ::/96.
+		node := uint64(0)
+		for bit := 0; bit < 96 && node < r.nodeCount; bit++ {
+			node = r.readRecord(node, 0)
+		}
+		r.ipv4Start = node
+	}
+	return r, nil
+}
+
+// readRecord returns the left (bit 0) or right (bit 1) record of node.
+func (r *Reader) readRecord(node uint64, bit byte) uint64 {
+	switch r.recordSize {
+	case 24:
+		b := r.tree[node*6+uint64(bit)*3:]
+		return uint64(b[0])<<16 | uint64(b[1])<<8 | uint64(b[2])
+	case 28:
+		b := r.tree[node*7:]
+		if bit == 0 {
+			return uint64(b[3]&0xF0)<<20 | uint64(b[0])<<16 | uint64(b[1])<<8 | uint64(b[2])
+		}
+		return uint64(b[3]&0x0F)<<24 | uint64(b[4])<<16 | uint64(b[5])<<8 | uint64(b[6])
+	default:
+		return uint64(binary.BigEndian.Uint32(r.tree[node*8+uint64(bit)*4:]))
+	}
+}
+
+// Lookup returns the data recorded for the network containing addr,
+// decoded into maps, slices, strings, numbers and booleans. Unsigned
+// integers are decoded as uint64, except uint128 as *big.Int, and signed
+// integers as int64. If the database has no data for addr, ok is false.
+func (r *Reader) Lookup(addr netip.Addr) (record interface{}, ok bool, err error) {
+	addr = addr.Unmap()
+	var bits []byte
+	node := uint64(0)
+	switch {
+	case addr.Is4() && r.ipVersion == 6:
+		a := addr.As4()
+		bits = a[:]
+		node = r.ipv4Start
+	case addr.Is4():
+		a := addr.As4()
+		bits = a[:]
+	case addr.Is6() && r.ipVersion == 6:
+		a := addr.As16()
+		bits = a[:]
+	default:
+		return nil, false, nil
+	}
+	for i := 0; i < len(bits)*8 && node < r.nodeCount; i++ {
+		bit := (bits[i/8] >> (7 - uint(i%8))) & 1
+		node = r.readRecord(node, bit)
+	}
+	switch {
+	case node == r.nodeCount:
+		return nil, false, nil
+	case node < r.nodeCount:
+		return nil, false, fmt.Errorf("%w: search tree deeper than address", InvalidDatabase)
+	}
+	offset := node - r.nodeCount - dataSectionSeparatorSize
+	record, _, err = decoder{buf: r.data}.decode(offset, 0)
+	if err != nil {
+		return nil, false, err
+	}
+	return record, true, nil
+}
+
+// Data types of the MaxMind DB data section.
+const (
+	typeExtended = 0
+	typePointer  = 1
+	typeString   = 2
+	typeDouble   = 3
+	typeBytes    = 4
+	typeUint16   = 5
+	typeUint32   = 6
+	typeMap      = 7
+	typeInt32    = 8
+	typeUint64   = 9
+	typeUint128  = 10
+	typeArray    = 11
+	typeBool     = 14
+	typeFloat    = 15
+)
+
+// decoder decodes values from a MaxMind DB data section.
+type decoder struct {
+	buf []byte
+}
+
+func (d decoder) bytes(offset, size uint64) ([]byte, error) {
+	if offset+size > uint64(len(d.buf)) || offset+size < offset {
+		return nil, fmt.Errorf("%w: value at offset %d overruns section", InvalidDatabase, offset)
+	}
+	return d.buf[offset : offset+size], nil
+}
+
+func uintFromBytes(b []byte) uint64 {
+	var n uint64
+	for _, c := range b {
+		n = n<<8 | uint64(c)
+	}
+	return n
+}
+
+// decodeControl decodes the control byte, and any extended type and size
+// bytes, of the value at offset. It returns the type, the size and the
+// offset of the payload. For pointers, size holds the low 5 bits of the
+// control byte, which decodePointer interprets.
+func (d decoder) decodeControl(offset uint64) (typ int, size uint64, next uint64, err error) {
+	b, err := d.bytes(offset, 1)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	ctrl := b[0]
+	next = offset + 1
+	typ = int(ctrl >> 5)
+	if typ == typeExtended {
+		b, err := d.bytes(next, 1)
+		if err != nil {
+			return 0, 0, 0, err
+		}
+		typ = 7 + int(b[0])
+		next++
+		if typ <= typeMap {
+			return 0, 0, 0, fmt.Errorf("%w: invalid extended type %d", InvalidDatabase, typ)
+		}
+	}
+	size = uint64(ctrl & 0x1F)
+	if typ == typePointer || size < 29 {
+		return typ, size, next, nil
+	}
+	n := size - 28
+	b, err = d.bytes(next, n)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	next += n
+	switch n {
+	case 1:
+		size = 29 + uintFromBytes(b)
+	case 2:
+		size = 285 + uintFromBytes(b)
+	default:
+		size = 65821 + uintFromBytes(b)
+	}
+	return typ, size, next, nil
+}
+
+// decodePointer returns the offset that a pointer refers to, and the
+// offset following the pointer.
+func (d decoder) decodePointer(bits uint64, offset uint64) (target uint64, next uint64, err error) {
+	n := (bits>>3)&0x3 + 1
+	b, err := d.bytes(offset, n)
+	if err != nil {
+		return 0, 0, err
+	}
+	next = offset + n
+	v := bits & 0x7
+	switch n {
+	case 1:
+		return v<<8 | uintFromBytes(b), next, nil
+	case 2:
+		return (v<<16 | uintFromBytes(b)) + 2048, next, nil
+	case 3:
+		return (v<<24 | uintFromBytes(b)) + 526336, next, nil
+	default:
+		return uintFromBytes(b), next, nil
+	}
+}
+
+// maxIntSize returns the maximum payload size of integer types.
+func maxIntSize(typ int) uint64 {
+	switch typ {
+	case typeUint16:
+		return 2
+	case typeUint32, typeInt32:
+		return 4
+	case typeUint64:
+		return 8
+	default:
+		return 16
+	}
+}
+
+// decode decodes the value at offset, returning it and the offset of the
+// following value.
+func (d decoder) decode(offset uint64, depth int) (interface{}, uint64, error) {
+	if depth > maxDecodeDepth {
+		return nil, 0, fmt.Errorf("%w: values nested too deeply", InvalidDatabase)
+	}
+	typ, size, next, err := d.decodeControl(offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	switch typ {
+	case typePointer:
+		target, next, err := d.decodePointer(size, next)
+		if err != nil {
+			return nil, 0, err
+		}
+		if t, _, _, err := d.decodeControl(target); err == nil && t == typePointer {
+			return nil, 0, fmt.Errorf("%w: pointer to pointer at offset %d", InvalidDatabase, offset)
+		}
+		value, _, err := d.decode(target, depth+1)
+		return value, next, err
+	case typeMap:
+		m := make(map[string]interface{})
+		for i := uint64(0); i < size; i++ {
+			key, after, err := d.decode(next, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			k, ok := key.(string)
+			if !ok {
+				return nil, 0, fmt.Errorf("%w: map key at offset %d is not a string", InvalidDatabase, next)
+			}
+			value, after, err := d.decode(after, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			m[k] = value
+			next = after
+		}
+		return m, next, nil
+	case typeArray:
+		var a []interface{}
+		for i := uint64(0); i < size; i++ {
+			value, after, err := d.decode(next, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			a = append(a, value)
+			next = after
+		}
+		return a, next, nil
+	case typeBool:
+		if size > 1 {
+			return nil, 0, fmt.Errorf("%w: invalid boolean at offset %d", InvalidDatabase, offset)
+		}
+		return size == 1, next, nil
+	}
+
+	b, err := d.bytes(next, size)
+	if err != nil {
+		return nil, 0, err
+	}
+	next += size
+	switch typ {
+	case typeString:
+		return string(b), next, nil
+	case typeBytes:
+		return append([]byte(nil), b...), next, nil
+	case typeDouble:
+		if size != 8 {
+			return nil, 0, fmt.Errorf("%w: invalid double at offset %d", InvalidDatabase, offset)
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), next, nil
+	case typeFloat:
+		if size != 4 {
+			return nil, 0, fmt.Errorf("%w: invalid float at offset %d", InvalidDatabase, offset)
+		}
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(b))), next, nil
+	case typeUint16, typeUint32, typeUint64, typeUint128, typeInt32:
+		if size > maxIntSize(typ) {
+			return nil, 0, fmt.Errorf("%w: invalid integer at offset %d", InvalidDatabase, offset)
+		}
+		switch typ {
+		case typeUint128:
+			return new(big.Int).SetBytes(b), next, nil
+		case typeInt32:
+			return int64(int32(uint32(uintFromBytes(b)))), next, nil
+		default:
+			return uintFromBytes(b), next, nil
+		}
+	default:
+		return nil, 0, fmt.Errorf("%w: unsupported data type %d at offset %d", InvalidDatabase, typ, offset)
+	}
+}
@@ -0,0 +1,256 @@
+// Package handoff implements zero-downtime binary upgrades by passing
+// listening sockets from a running server process to a newly started one.
+//
+// The old process calls Upgrade, which starts a new copy of the executable
+// with the old process's listening sockets as inherited file descriptors.
+// The new process obtains the sockets with Inherited instead of binding
+// fresh ones, starts serving, then calls Ready. Once the new process is
+// ready, Upgrade returns and the old process may stop accepting connections
+// and drain in-flight ones. Both processes accept connections on the shared
+// sockets during the overlap, so no connection attempts are refused.
+//
+// Packet sockets, such as UDP sockets, are handed over likewise. Both
+// processes read datagrams from a shared packet socket during the overlap.
+//
+// Per-client state, such as connection limiter counts, is not transferred:
+// during the overlap each process enforces limits for its own connections.
+package handoff
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Environment variables used to describe inherited file descriptors to
+// the new process.
+const (
+	ListenersEnv   = "TCPLB_HANDOFF_LISTENERS"    // ListenersEnv holds comma-separated listener names, in fd order.
+	PacketConnsEnv = "TCPLB_HANDOFF_PACKET_CONNS" // PacketConnsEnv holds comma-separated packet socket names, in fd order, after the listeners.
+	ReadyFDEnv     = "TCPLB_HANDOFF_READY_FD"     // ReadyFDEnv holds the fd of the pipe used to signal readiness.
+)
+
+// firstInheritedFD is the fd number of the first entry of exec.Cmd.ExtraFiles.
+const firstInheritedFD = 3
+
+var NotReady = errors.New("new process did not become ready")
+var UnsupportedListener = errors.New("listener does not support handoff")
+
+// filer is implemented by sockets backed by an os.File, such as
+// *net.TCPListener, *net.UnixListener and *net.UDPConn.
+type filer interface {
+	File() (*os.File, error)
+}
+
+// Inherited returns the listeners and packet sockets passed to this process
+// by Upgrade, keyed by name. If this process was not started by Upgrade,
+// the returned maps are empty.
+//
+// The environment variables describing the sockets are cleared, so they
+// are not passed on to unrelated child processes.
+func Inherited() (map[string]net.Listener, map[string]net.PacketConn, error) {
+	listeners := make(map[string]net.Listener)
+	packetConns := make(map[string]net.PacketConn)
+	listenerNames := inheritedNames(ListenersEnv)
+	packetConnNames := inheritedNames(PacketConnsEnv)
+	for i, name := range listenerNames {
+		fd := uintptr(firstInheritedFD + i)
+		f := os.NewFile(fd, name)
+		listener, err := net.FileListener(f)
+		// FileListener dups the fd, so our copy is no longer needed.
+		_ = f.Close()
+		if err != nil {
+			closeAll(listeners, packetConns)
+			return nil, nil, fmt.Errorf("inherited listener %q on fd %d: %w", name, fd, err)
+		}
+		listeners[name] = listener
+	}
+	for i, name := range packetConnNames {
+		fd := uintptr(firstInheritedFD + len(listenerNames) + i)
+		f := os.NewFile(fd, name)
+		conn, err := net.FilePacketConn(f)
+		// FilePacketConn dups the fd too.
+		_ = f.Close()
+		if err != nil {
+			closeAll(listeners, packetConns)
+			return nil, nil, fmt.Errorf("inherited packet socket %q on fd %d: %w", name, fd, err)
+		}
+		packetConns[name] = conn
+	}
+	return listeners, packetConns, nil
+}
+
+// inheritedNames returns the comma-separated names held by the environment
+// variable key, and clears it.
+func inheritedNames(key string) []string {
+	value, ok := os.LookupEnv(key)
+	if !ok {
+		return nil
+	}
+	_ = os.Unsetenv(key)
+	if value == "" {
+		return nil
+	}
+	return strings.Split(value, ",")
+}
+
+func closeAll(listeners map[string]net.Listener, packetConns map[string]net.PacketConn) {
+	for _, listener := range listeners {
+		_ = listener.Close()
+	}
+	for _, conn := range packetConns {
+		_ = conn.Close()
+	}
+}
+
+// Ready notifies the parent process that called Upgrade that this process
+// is serving on its inherited listeners. If this process was not started
+// by Upgrade, Ready does nothing.
+func Ready() error {
+	value, ok := os.LookupEnv(ReadyFDEnv)
+	if !ok {
+		return nil
+	}
+	_ = os.Unsetenv(ReadyFDEnv)
+	fd, err := strconv.Atoi(value)
+	if err != nil {
+		return fmt.Errorf("invalid %s: %w", ReadyFDEnv, err)
+	}
+	f := os.NewFile(uintptr(fd), "handoff-ready")
+	defer f.Close()
+	_, err = f.Write([]byte{1})
+	return err
+}
+
+// Upgrader starts a new server process and hands it listening sockets.
+type Upgrader struct {
+	Listeners   map[string]net.Listener   // Listeners are passed to the new process, keyed by name.
+	PacketConns map[string]net.PacketConn // PacketConns are passed to the new process, keyed by name.
+	Argv        []string                  // Argv is the new process's arguments, including argv[0].
+	Timeout     time.Duration             // Timeout bounds how long to wait for the new process to become ready.
+}
+
+// Upgrade starts a new process running the current executable with the
+// Upgrader's listeners and packet sockets, and waits until it calls Ready.
+// If the new process fails to become ready before ctx is done or the
+// Upgrader's Timeout elapses, it is killed and an error is returned; the
+// sockets remain usable by the current process either way.
+func (u *Upgrader) Upgrade(ctx context.Context) error {
+	executable, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	names := make([]string, 0, len(u.Listeners))
+	for name := range u.Listeners {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	packetConnNames := make([]string, 0, len(u.PacketConns))
+	for name := range u.PacketConns {
+		packetConnNames = append(packetConnNames, name)
+	}
+	sort.Strings(packetConnNames)
+
+	var files []*os.File
+	defer func() {
+		for _, f := range files {
+			_ = f.Close()
+		}
+	}()
+	for _, name := range names {
+		l, ok := u.Listeners[name].(filer)
+		if !ok {
+			return fmt.Errorf("%w: %q is %T", UnsupportedListener, name, u.Listeners[name])
+		}
+		f, err := l.File()
+		if err != nil {
+			return fmt.Errorf("listener %q: %w", name, err)
+		}
+		files = append(files, f)
+	}
+	for _, name := range packetConnNames {
+		c, ok := u.PacketConns[name].(filer)
+		if !ok {
+			return fmt.Errorf("%w: %q is %T", UnsupportedListener, name, u.PacketConns[name])
+		}
+		f, err := c.File()
+		if err != nil {
+			return fmt.Errorf("packet socket %q: %w", name, err)
+		}
+		files = append(files, f)
+	}
+
+	readyR, readyW, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer readyR.Close()
+	readyFD := firstInheritedFD + len(files)
+
+	cmd := exec.Command(executable, u.Argv[1:]...)
+	cmd.Args = u.Argv
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = append(files, readyW)
+	cmd.Env = append(filterEnv(os.Environ()),
+		ListenersEnv+"="+strings.Join(names, ","),
+		PacketConnsEnv+"="+strings.Join(packetConnNames, ","),
+		ReadyFDEnv+"="+strconv.Itoa(readyFD))
+	err = cmd.Start()
+	// The new process holds its own copy of the write end. Closing ours
+	// means the read below sees EOF if the new process exits early.
+	_ = readyW.Close()
+	if err != nil {
+		return err
+	}
+
+	if u.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, u.Timeout)
+		defer cancel()
+	}
+	ready := make(chan error, 1)
+	go func() {
+		_, err := readyR.Read(make([]byte, 1))
+		if err == io.EOF {
+			err = NotReady
+		}
+		ready <- err
+	}()
+
+	select {
+	case err = <-ready:
+	case <-ctx.Done():
+		err = fmt.Errorf("%w: %s", NotReady, ctx.Err())
+	}
+	if err != nil {
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+		return err
+	}
+	// The new process outlives this one, so it is deliberately not waited on.
+	return cmd.Process.Release()
+}
+
+// filterEnv returns env without any handoff variables inherited from an
+// earlier upgrade.
+func filterEnv(env []string) []string {
+	filtered := make([]string, 0, len(env))
+	for _, kv := range env {
+		if strings.HasPrefix(kv, ListenersEnv+"=") || strings.HasPrefix(kv, PacketConnsEnv+"=") || strings.HasPrefix(kv, ReadyFDEnv+"=") {
+			continue
+		}
+		filtered = append(filtered, kv)
+	}
+	return filtered
+}
@@ -0,0 +1,153 @@
+package handoff
+
+import (
+	"context"
+	"github.com/stretchr/testify/require"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+// childModeEnv selects the behaviour of the test binary when it is
+// re-executed by Upgrade as the "new" process.
+const childModeEnv = "TCPLB_HANDOFF_TEST_CHILD"
+
+func TestMain(m *testing.M) {
+	switch os.Getenv(childModeEnv) {
+	case "serve":
+		os.Exit(serveOneGreeting())
+	case "serve-udp":
+		os.Exit(echoOneDatagram())
+	case "fail":
+		os.Exit(1)
+	}
+	os.Exit(m.Run())
+}
+
+// serveOneGreeting accepts a single connection on the inherited "main"
+// listener and greets it.
+func serveOneGreeting() int {
+	listeners, _, err := Inherited()
+	if err != nil {
+		return 2
+	}
+	listener, ok := listeners["main"]
+	if !ok {
+		return 3
+	}
+	if err := Ready(); err != nil {
+		return 4
+	}
+	conn, err := listener.Accept()
+	if err != nil {
+		return 5
+	}
+	defer conn.Close()
+	_, _ = conn.Write([]byte("hello from new process"))
+	return 0
+}
+
+// echoOneDatagram echoes a single datagram received on the inherited "udp"
+// packet socket.
+func echoOneDatagram() int {
+	_, packetConns, err := Inherited()
+	if err != nil {
+		return 2
+	}
+	conn, ok := packetConns["udp"]
+	if !ok {
+		return 3
+	}
+	defer conn.Close()
+	if err := Ready(); err != nil {
+		return 4
+	}
+	buf := make([]byte, 64)
+	n, addr, err := conn.ReadFrom(buf)
+	if err != nil {
+		return 5
+	}
+	_, _ = conn.WriteTo(append([]byte("echo from new process: "), buf[:n]...), addr)
+	return 0
+}
+
+func newTestUpgrader(t *testing.T) *Upgrader {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = listener.Close() })
+	return &Upgrader{
+		Listeners: map[string]net.Listener{"main": listener},
+		Argv:      []string{os.Args[0], "-test.run=^$"},
+		Timeout:   10 * time.Second,
+	}
+}
+
+func TestUpgradeHandsOffListener(t *testing.T) {
+	t.Setenv(childModeEnv, "serve")
+	u := newTestUpgrader(t)
+
+	require.NoError(t, u.Upgrade(context.Background()))
+
+	// This process is not accepting, so the new process must serve the client.
+	conn, err := net.Dial("tcp", u.Listeners["main"].Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	greeting, err := io.ReadAll(conn)
+	require.NoError(t, err)
+	require.Equal(t, "hello from new process", string(greeting))
+}
+
+func TestUpgradeHandsOffPacketConn(t *testing.T) {
+	t.Setenv(childModeEnv, "serve-udp")
+	packetConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer packetConn.Close()
+	u := newTestUpgrader(t)
+	u.PacketConns = map[string]net.PacketConn{"udp": packetConn}
+
+	require.NoError(t, u.Upgrade(context.Background()))
+	// Stop this process reading, so that the new process must echo.
+	require.NoError(t, packetConn.Close())
+
+	conn, err := net.Dial("udp", packetConn.LocalAddr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	require.NoError(t, conn.SetDeadline(time.Now().Add(10*time.Second)))
+	_, err = conn.Write([]byte("ping"))
+	require.NoError(t, err)
+	buf := make([]byte, 64)
+	n, err := conn.Read(buf)
+	require.NoError(t, err)
+	require.Equal(t, "echo from new process: ping", string(buf[:n]))
+}
+
+func TestUpgradeFailsIfNewProcessExits(t *testing.T) {
+	t.Setenv(childModeEnv, "fail")
+	u := newTestUpgrader(t)
+
+	err := u.Upgrade(context.Background())
+	require.ErrorIs(t, err, NotReady)
+}
+
+func TestUpgradeRejectsUnsupportedListener(t *testing.T) {
+	u := &Upgrader{
+		Listeners: map[string]net.Listener{"main": &fakeListener{}},
+		Argv:      []string{os.Args[0]},
+	}
+	err := u.Upgrade(context.Background())
+	require.ErrorIs(t, err, UnsupportedListener)
+}
+
+func TestInheritedWithoutParent(t *testing.T) {
+	listeners, packetConns, err := Inherited()
+	require.NoError(t, err)
+	require.Empty(t, listeners)
+	require.Empty(t, packetConns)
+	require.NoError(t, Ready())
+}
+
+type fakeListener struct {
+	net.Listener
+}
@@ -0,0 +1,351 @@
+package healthcheck
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/require"
+	"net"
+	"path/filepath"
+	"sync"
+	"tcplb/lib/clock"
+	"tcplb/lib/core"
+	"tcplb/lib/slog"
+	"testing"
+	"time"
+)
+
+func DummyUpstream(key string) core.Upstream {
+	return core.Upstream{Network: "healthcheck_test_network", Address: key}
+}
+
+func TestTrackerThresholds(t *testing.T) {
+	a := DummyUpstream("a")
+	tracker := NewTracker(TrackerConfig{HealthyThreshold: 2, UnhealthyThreshold: 2}, core.NewUpstreamSet(a))
+	require.Equal(t, BeliefUnknown, tracker.Belief(a))
+
+	pass := HealthReport{Upstream: a, Result: CheckPass}
+	fail := HealthReport{Upstream: a, Result: CheckFail, Symptom: errors.New("refused")}
+
+	tracker.ReportHealth(pass)
+	require.Equal(t, BeliefUnknown, tracker.Belief(a))
+	tracker.ReportHealth(pass)
+	require.Equal(t, BeliefHealthy, tracker.Belief(a))
+	require.Equal(t, 1, tracker.CountHealthy())
+
+	tracker.ReportHealth(fail)
+	require.Equal(t, BeliefHealthy, tracker.Belief(a))
+	tracker.ReportHealth(pass) // resets the run of failures
+	tracker.ReportHealth(fail)
+	require.Equal(t, BeliefHealthy, tracker.Belief(a))
+	tracker.ReportHealth(fail)
+	require.Equal(t, BeliefUnhealthy, tracker.Belief(a))
+	require.Equal(t, 0, tracker.CountHealthy())
+
+	snapshot := tracker.Snapshot()
+	require.Len(t, snapshot, 1)
+	require.Equal(t, "refused", snapshot[0].LastSymptom)
+}
+
+func TestTrackerHistory(t *testing.T) {
+	a := DummyUpstream("a")
+	tracker := NewTracker(TrackerConfig{UnhealthyThreshold: 1, HistoryLength: 3}, core.NewUpstreamSet(a))
+	history, err := tracker.History(a)
+	require.NoError(t, err)
+	require.Empty(t, history)
+
+	start := time.Unix(1000, 0)
+	for i, result := range []CheckResult{CheckPass, CheckFail, CheckPass, CheckFail} {
+		report := HealthReport{Upstream: a, Result: result, Time: start.Add(time.Duration(i) * time.Second)}
+		if result == CheckFail {
+			report.Symptom = errors.New("refused")
+		}
+		tracker.ReportHealth(report)
+	}
+
+	// Only the last 3 checks are remembered, oldest first.
+	history, err = tracker.History(a)
+	require.NoError(t, err)
+	require.Equal(t, []HealthEvent{
+		{Time: start.Add(1 * time.Second), Result: CheckFail, Symptom: "refused", Belief: BeliefUnhealthy},
+		{Time: start.Add(2 * time.Second), Result: CheckPass, Belief: BeliefHealthy},
+		{Time: start.Add(3 * time.Second), Result: CheckFail, Symptom: "refused", Belief: BeliefUnhealthy},
+	}, history)
+
+	_, err = tracker.History(DummyUpstream("nope"))
+	require.ErrorIs(t, err, NoSuchUpstream)
+}
+
+func TestTrackerIgnoresUntrackedUpstreams(t *testing.T) {
+	a := DummyUpstream("a")
+	b := DummyUpstream("b")
+	tracker := NewTracker(TrackerConfig{}, core.NewUpstreamSet(a))
+	tracker.ReportHealth(HealthReport{Upstream: b, Result: CheckPass})
+	require.Equal(t, BeliefUnknown, tracker.Belief(b))
+	require.Equal(t, core.NewUpstreamSet(a), tracker.Upstreams())
+}
+
+func TestTrackerTrackRetiresUnusedUpstreams(t *testing.T) {
+	a := DummyUpstream("a")
+	b := DummyUpstream("b")
+	tracker := NewTracker(TrackerConfig{}, core.NewUpstreamSet(a))
+	tracker.ReportHealth(HealthReport{Upstream: a, Result: CheckPass})
+	require.Equal(t, 1, tracker.CountHealthy())
+
+	tracker.Track(core.NewUpstreamSet(b))
+	require.Equal(t, core.NewUpstreamSet(a, b), tracker.Upstreams())
+	require.True(t, tracker.Drained(a))
+	require.False(t, tracker.Drained(b))
+	require.Equal(t, BeliefUnknown, tracker.Belief(b))
+	// Retired upstreams keep their health, but do not count towards readiness.
+	require.Equal(t, BeliefHealthy, tracker.Belief(a))
+	require.Equal(t, 0, tracker.CountHealthy())
+
+	// Upstreams back in use are no longer retired, but stay drained if
+	// drained by operators.
+	require.NoError(t, tracker.SetDrained(b, true))
+	tracker.Track(core.NewUpstreamSet(a, b))
+	require.False(t, tracker.Drained(a))
+	require.True(t, tracker.Drained(b))
+	require.Equal(t, 1, tracker.CountHealthy())
+	history, err := tracker.History(a)
+	require.NoError(t, err)
+	require.Len(t, history, 1)
+
+	// Upstreams are forgotten once still retired when upstreams are next
+	// replaced.
+	tracker.Track(core.NewUpstreamSet(b))
+	require.Equal(t, core.NewUpstreamSet(a, b), tracker.Upstreams())
+	tracker.Track(core.NewUpstreamSet(b))
+	require.Equal(t, core.NewUpstreamSet(b), tracker.Upstreams())
+	require.False(t, tracker.Drained(a))
+	_, err = tracker.History(a)
+	require.ErrorIs(t, err, NoSuchUpstream)
+}
+
+// netDialer dials upstreams with a net.Dialer.
+type netDialer struct{}
+
+func (netDialer) DialUpstream(ctx context.Context, upstream core.Upstream) (net.Conn, error) {
+	dialer := net.Dialer{Timeout: time.Second}
+	return dialer.DialContext(ctx, upstream.Network, upstream.Address)
+}
+
+type recordingReporter struct {
+	mu      sync.Mutex
+	reports []HealthReport
+}
+
+func (r *recordingReporter) ReportHealth(report HealthReport) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.reports = append(r.reports, report)
+}
+
+func (r *recordingReporter) resultsFor(u core.Upstream) []CheckResult {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var results []CheckResult
+	for _, report := range r.reports {
+		if report.Upstream == u {
+			results = append(results, report.Result)
+		}
+	}
+	return results
+}
+
+func TestTrackerDrain(t *testing.T) {
+	a := DummyUpstream("a")
+	b := DummyUpstream("b")
+	tracker := NewTracker(TrackerConfig{}, core.NewUpstreamSet(a))
+	require.False(t, tracker.Drained(a))
+
+	require.NoError(t, tracker.SetDrained(a, true))
+	require.True(t, tracker.Drained(a))
+	require.True(t, tracker.Snapshot()[0].Drained)
+
+	require.NoError(t, tracker.SetDrained(a, false))
+	require.False(t, tracker.Drained(a))
+
+	require.ErrorIs(t, tracker.SetDrained(b, true), NoSuchUpstream)
+	require.False(t, tracker.Drained(b))
+}
+
+func TestTrackerPersistsBeliefs(t *testing.T) {
+	a := DummyUpstream("a")
+	b := DummyUpstream("b")
+	store := &FileStore{Path: filepath.Join(t.TempDir(), "health.json")}
+	c := clock.NewFake(time.Unix(1000, 0))
+	cfg := TrackerConfig{UnhealthyThreshold: 1, MaxStateAge: time.Minute, Clock: c}
+	tracker := NewTracker(cfg, core.NewUpstreamSet(a, b))
+	tracker.Store = store
+	require.NoError(t, tracker.Load()) // There is nothing to load yet.
+
+	// Beliefs are saved as they change.
+	stop := tracker.StartPersister()
+	tracker.ReportHealth(HealthReport{Upstream: a, Result: CheckFail})
+	require.Eventually(t, func() bool {
+		state, err := store.Load()
+		return err == nil && len(state.Upstreams) == 2
+	}, time.Second, time.Millisecond)
+	tracker.ReportHealth(HealthReport{Upstream: b, Result: CheckPass})
+	stop()
+
+	// A restarted tracker believes what was saved, until its own checks say
+	// otherwise.
+	restarted := NewTracker(cfg, core.NewUpstreamSet(a, b))
+	restarted.Store = store
+	require.NoError(t, restarted.Load())
+	require.Equal(t, BeliefUnhealthy, restarted.Belief(a))
+	require.Equal(t, BeliefHealthy, restarted.Belief(b))
+	restarted.ReportHealth(HealthReport{Upstream: a, Result: CheckPass})
+	require.Equal(t, BeliefHealthy, restarted.Belief(a))
+
+	// Upstreams already checked keep their beliefs.
+	checked := NewTracker(cfg, core.NewUpstreamSet(a, b))
+	checked.Store = store
+	checked.ReportHealth(HealthReport{Upstream: b, Result: CheckFail})
+	require.NoError(t, checked.Load())
+	require.Equal(t, BeliefUnhealthy, checked.Belief(a))
+	require.Equal(t, BeliefUnhealthy, checked.Belief(b))
+
+	// Stale beliefs are not restored.
+	c.Advance(2 * time.Minute)
+	stale := NewTracker(cfg, core.NewUpstreamSet(a, b))
+	stale.Store = store
+	require.NoError(t, stale.Load())
+	require.Equal(t, BeliefUnknown, stale.Belief(a))
+}
+
+func TestProbePoolReportsPassAndFail(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			_ = conn.Close()
+		}
+	}()
+
+	// Grab a free port and close it so that dials to it are refused.
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	closedAddr := closed.Addr().String()
+	require.NoError(t, closed.Close())
+
+	up := core.Upstream{Network: "tcp", Address: listener.Addr().String()}
+	down := core.Upstream{Network: "tcp", Address: closedAddr}
+
+	reporter := &recordingReporter{}
+	pool := &ProbePool{
+		Dialer:   netDialer{},
+		Reporter: reporter,
+		Interval: 10 * time.Millisecond,
+	}
+	pool.Start(core.NewUpstreamSet(up, down))
+	require.Eventually(t, func() bool {
+		return len(reporter.resultsFor(up)) >= 2 && len(reporter.resultsFor(down)) >= 2
+	}, 5*time.Second, 10*time.Millisecond)
+	pool.Stop()
+
+	require.Equal(t, CheckPass, reporter.resultsFor(up)[0])
+	require.Equal(t, CheckFail, reporter.resultsFor(down)[0])
+}
+
+func TestProbePoolStopWithoutStart(t *testing.T) {
+	pool := &ProbePool{}
+	pool.Stop()
+}
+
+type refusingDialer struct{}
+
+func (d refusingDialer) DialUpstream(ctx context.Context, upstream core.Upstream) (net.Conn, error) {
+	return nil, errors.New("refused")
+}
+
+func TestProbePoolProbesOncePerInterval(t *testing.T) {
+	a := DummyUpstream("a")
+	c := clock.NewFake(time.Unix(1000, 0))
+	reporter := &recordingReporter{}
+	pool := &ProbePool{Dialer: refusingDialer{}, Reporter: reporter, Interval: time.Minute, Clock: c}
+	pool.Start(core.NewUpstreamSet(a))
+	defer pool.Stop()
+
+	// The upstream is probed at once, then once per Interval.
+	for i := 1; i <= 3; i++ {
+		require.Eventually(t, func() bool { return len(reporter.resultsFor(a)) == i }, 5*time.Second, time.Millisecond)
+		c.BlockUntil(1)
+		c.Advance(time.Minute)
+	}
+	require.Eventually(t, func() bool { return len(reporter.resultsFor(a)) == 4 }, 5*time.Second, time.Millisecond)
+}
+
+func TestProbePoolUpdate(t *testing.T) {
+	a := DummyUpstream("a")
+	b := DummyUpstream("b")
+	c := clock.NewFake(time.Unix(1000, 0))
+	reporter := &recordingReporter{}
+	pool := &ProbePool{Dialer: refusingDialer{}, Reporter: reporter, Interval: time.Minute, Clock: c}
+	pool.Start(core.NewUpstreamSet(a))
+	defer pool.Stop()
+	require.Eventually(t, func() bool { return len(reporter.resultsFor(a)) == 1 }, 5*time.Second, time.Millisecond)
+	c.BlockUntil(1)
+
+	// b is probed at once, and a no longer.
+	pool.Update(core.NewUpstreamSet(b))
+	require.Eventually(t, func() bool { return len(reporter.resultsFor(b)) == 1 }, 5*time.Second, time.Millisecond)
+	c.BlockUntil(1)
+	c.Advance(time.Minute)
+	require.Eventually(t, func() bool { return len(reporter.resultsFor(b)) == 2 }, 5*time.Second, time.Millisecond)
+	require.Len(t, reporter.resultsFor(a), 1)
+}
+
+type panickingDialer struct{}
+
+func (d panickingDialer) DialUpstream(ctx context.Context, upstream core.Upstream) (net.Conn, error) {
+	panic("boom")
+}
+
+func TestProbeRecoversFromPanickingDialer(t *testing.T) {
+	a := DummyUpstream("a")
+	logger := &slog.RecordingLogger{}
+	report := Probe(context.Background(), logger, panickingDialer{}, a)
+	require.Equal(t, a, report.Upstream)
+	require.Equal(t, CheckFail, report.Result)
+	require.ErrorIs(t, report.Symptom, ProbePanicked)
+	require.ErrorContains(t, report.Symptom, "boom")
+
+	require.Len(t, logger.Events, 2)
+	require.Equal(t, slog.DebugLevel, logger.Events[0].Level)
+	require.Equal(t, slog.ErrorLevel, logger.Events[1].Level)
+	require.Equal(t, "Probe: UpstreamDialer panicked", logger.Events[1].Msg)
+	require.NotEmpty(t, logger.Events[1].StackTrace)
+}
+
+func TestProbeLogsResults(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+	up := core.Upstream{Network: "tcp", Address: listener.Addr().String()}
+
+	logger := &slog.RecordingLogger{}
+	report := Probe(context.Background(), logger, netDialer{}, up)
+	require.Equal(t, CheckPass, report.Result)
+	require.Len(t, logger.Events, 2)
+	require.Equal(t, "Probe: upstream passed health check", logger.Events[1].Msg)
+
+	require.NoError(t, listener.Close())
+	logger = &slog.RecordingLogger{}
+	report = Probe(context.Background(), logger, netDialer{}, up)
+	require.Equal(t, CheckFail, report.Result)
+	require.Len(t, logger.Events, 2)
+	require.Equal(t, slog.WarnLevel, logger.Events[1].Level)
+	require.Equal(t, "Probe: upstream failed health check", logger.Events[1].Msg)
+
+	// Probes without a Logger log nothing.
+	report = Probe(context.Background(), nil, panickingDialer{}, up)
+	require.Equal(t, CheckFail, report.Result)
+}
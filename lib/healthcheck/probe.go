@@ -0,0 +1,200 @@
+package healthcheck
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"runtime/debug"
+	"sync"
+	"tcplb/lib/clock"
+	"tcplb/lib/core"
+	"tcplb/lib/slog"
+	"time"
+)
+
+// ProbePanicked is the error wrapped by the Symptom of a failed probe whose
+// UpstreamDialer panicked.
+var ProbePanicked = errors.New("health probe panicked")
+
+// UpstreamDialer dials a connection to a given upstream, e.g. a
+// dialer.ProbeDialer, which dials upstreams the way they are dialed for
+// forwarding.
+type UpstreamDialer interface {
+	DialUpstream(ctx context.Context, upstream core.Upstream) (net.Conn, error)
+}
+
+// HealthReporter is something that can receive HealthReports.
+type HealthReporter interface {
+	ReportHealth(report HealthReport)
+}
+
+var _ HealthReporter = (*Tracker)(nil) // type check
+
+// ProbePool periodically probes each of a set of upstreams by dialing a
+// TCP connection to it, and reports the results to a HealthReporter.
+// A probe passes if the connection is established.
+//
+// There is one worker goroutine per upstream.
+type ProbePool struct {
+	Dialer   UpstreamDialer
+	Reporter HealthReporter
+	Interval time.Duration // Interval is the time between probes of each upstream.
+	Logger   slog.Logger   // Logger is optional. If set, probe attempts and results are logged.
+	Clock    clock.Clock   // Clock is optional. If nil, the system clock is used.
+
+	wg      sync.WaitGroup
+	mu      sync.Mutex // mu guards workers
+	workers map[core.Upstream]context.CancelFunc
+}
+
+// Start starts probing the given upstreams. Each upstream is probed once
+// immediately, then once per Interval, until Stop is called.
+func (p *ProbePool) Start(upstreams core.UpstreamSet) {
+	p.Update(upstreams)
+}
+
+// Update changes the upstreams that are probed to upstreams, e.g. once the
+// upstreams of a pool are replaced. Upstreams that were not probed are
+// probed once immediately, then once per Interval. Upstreams that are not
+// in upstreams are no longer probed, and probes of them in progress are not
+// reported.
+func (p *ProbePool) Update(upstreams core.UpstreamSet) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.workers == nil {
+		p.workers = make(map[core.Upstream]context.CancelFunc)
+	}
+	for u, cancel := range p.workers {
+		if _, ok := upstreams[u]; !ok {
+			cancel()
+			delete(p.workers, u)
+		}
+	}
+	for u := range upstreams {
+		if _, ok := p.workers[u]; ok {
+			continue
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		p.workers[u] = cancel
+		p.wg.Add(1)
+		go p.worker(ctx, u)
+	}
+}
+
+// Stop stops all probe workers and waits for them to exit.
+func (p *ProbePool) Stop() {
+	p.mu.Lock()
+	for u, cancel := range p.workers {
+		cancel()
+		delete(p.workers, u)
+	}
+	p.mu.Unlock()
+	p.wg.Wait()
+}
+
+func (p *ProbePool) probe(ctx context.Context, upstream core.Upstream) HealthReport {
+	return probe(ctx, clock.Or(p.Clock), p.Logger, p.Dialer, upstream)
+}
+
+// Probe probes upstream once by dialing a connection to it with dialer.
+// If dialer panics, the probe fails with a Symptom wrapping ProbePanicked.
+// logger is optional. If set, the attempt and its result are logged.
+func Probe(ctx context.Context, logger slog.Logger, dialer UpstreamDialer, upstream core.Upstream) HealthReport {
+	return probe(ctx, clock.Real{}, logger, dialer, upstream)
+}
+
+// probe is Probe, timed by clk.
+func probe(ctx context.Context, clk clock.Clock, logger slog.Logger, dialer UpstreamDialer, upstream core.Upstream) HealthReport {
+	if logger != nil {
+		logger.Debug(&slog.LogRecord{Msg: "Probe: probing upstream", Upstream: &upstream})
+	}
+	start := clk.Now()
+	conn, err := dialSafely(ctx, logger, dialer, upstream)
+	report := HealthReport{Upstream: upstream, Time: clk.Now()}
+	if err != nil {
+		report.Result = CheckFail
+		report.Symptom = err
+		// Panics were logged already, with the stack trace.
+		if logger != nil && ctx.Err() == nil && !errors.Is(err, ProbePanicked) {
+			logger.Warn(&slog.LogRecord{Msg: "Probe: upstream failed health check", Upstream: &upstream, Error: err})
+		}
+		return report
+	}
+	_ = conn.Close()
+	report.Result = CheckPass
+	if logger != nil {
+		logger.Debug(&slog.LogRecord{Msg: "Probe: upstream passed health check", Upstream: &upstream, Details: report.Time.Sub(start).String()})
+	}
+	return report
+}
+
+// dialSafely dials upstream with dialer, returning an error wrapping
+// ProbePanicked if dialer panics.
+func dialSafely(ctx context.Context, logger slog.Logger, dialer UpstreamDialer, upstream core.Upstream) (conn net.Conn, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			conn, err = nil, fmt.Errorf("%w: %v", ProbePanicked, r)
+			if logger != nil {
+				logger.Error(&slog.LogRecord{Msg: "Probe: UpstreamDialer panicked", Upstream: &upstream, Error: err, StackTrace: string(debug.Stack())})
+			}
+		}
+	}()
+	return dialer.DialUpstream(ctx, upstream)
+}
+
+func (p *ProbePool) worker(ctx context.Context, upstream core.Upstream) {
+	defer p.wg.Done()
+	ticker := clock.Or(p.Clock).NewTicker(p.Interval)
+	defer ticker.Stop()
+	for {
+		report := p.probe(ctx, upstream)
+		if ctx.Err() != nil {
+			// Probe may have failed because we are stopping. Don't report it.
+			return
+		}
+		p.Reporter.ReportHealth(report)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C():
+		}
+	}
+}
+
+// OnDemandProber probes upstreams when asked, outside of any ProbePool's
+// schedule, e.g. so that operators can confirm that an upstream has
+// recovered after maintenance before undraining it.
+type OnDemandProber struct {
+	Dialer   UpstreamDialer
+	Reporter HealthReporter
+	Logger   slog.Logger // Logger is optional. If set, probe attempts and results are logged.
+	Clock    clock.Clock // Clock is optional. If nil, the system clock is used.
+}
+
+// ProbeUpstream probes upstream once, reports the result to Reporter, and
+// returns it. If ctx is done before the probe finishes, the result is not
+// reported, as the probe may have failed because it was cut short.
+func (p *OnDemandProber) ProbeUpstream(ctx context.Context, upstream core.Upstream) HealthReport {
+	report := probe(ctx, clock.Or(p.Clock), p.Logger, p.Dialer, upstream)
+	if ctx.Err() == nil {
+		p.Reporter.ReportHealth(report)
+	}
+	return report
+}
+
+// ProbeUpstreams probes each of upstreams once, concurrently, as by
+// ProbeUpstream, and returns the results in the same order.
+func (p *OnDemandProber) ProbeUpstreams(ctx context.Context, upstreams []core.Upstream) []HealthReport {
+	reports := make([]HealthReport, len(upstreams))
+	var wg sync.WaitGroup
+	for i, u := range upstreams {
+		wg.Add(1)
+		go func(i int, u core.Upstream) {
+			defer wg.Done()
+			reports[i] = p.ProbeUpstream(ctx, u)
+		}(i, u)
+	}
+	wg.Wait()
+	return reports
+}
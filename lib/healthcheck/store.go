@@ -0,0 +1,173 @@
+package healthcheck
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"tcplb/lib/core"
+	"tcplb/lib/slog"
+	"time"
+)
+
+// State is the beliefs of a Tracker, as persisted by a Store.
+type State struct {
+	Time      time.Time       `json:"time"` // Time is when the beliefs were saved.
+	Upstreams []UpstreamState `json:"upstreams"`
+}
+
+// UpstreamState is the belief about the health of an upstream.
+type UpstreamState struct {
+	Upstream core.Upstream `json:"upstream"`
+	Belief   Belief        `json:"belief"`
+}
+
+// Store persists the beliefs of a Tracker, so that a restarted load
+// balancer does not forget which upstreams are unhealthy, and forward
+// clients to them until probes find out again.
+//
+// A Store could be shared by several load balancers, e.g. one backed by a
+// database, but a Tracker only loads beliefs at startup, so it does not see
+// beliefs that others save afterwards.
+type Store interface {
+	Load() (State, error)
+	Save(s State) error
+}
+
+// FileStore is a Store that keeps a State in a JSON file at Path. The
+// file is replaced atomically on each Save.
+type FileStore struct {
+	Path string
+}
+
+// Load returns the State in the file, or an empty State if the file does
+// not exist.
+func (s *FileStore) Load() (State, error) {
+	var state State
+	data, err := os.ReadFile(s.Path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return state, nil
+	}
+	if err != nil {
+		return state, err
+	}
+	err = json.Unmarshal(data, &state)
+	return state, err
+}
+
+func (s *FileStore) Save(state State) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(s.Path), filepath.Base(s.Path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.Path)
+}
+
+var _ Store = (*FileStore)(nil) // type check
+
+func (b *Belief) UnmarshalText(text []byte) error {
+	for _, belief := range []Belief{BeliefUnknown, BeliefHealthy, BeliefUnhealthy} {
+		if string(text) == belief.String() {
+			*b = belief
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown belief %q", text)
+}
+
+// State returns the belief about the health of each upstream in use.
+func (t *Tracker) State() State {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	state := State{Time: t.now(), Upstreams: make([]UpstreamState, 0, len(t.states))}
+	for u, s := range t.states {
+		if !s.retired {
+			state.Upstreams = append(state.Upstreams, UpstreamState{Upstream: u, Belief: s.belief})
+		}
+	}
+	return state
+}
+
+// Restore adopts the beliefs in state about tracked upstreams that have not
+// yet been checked, unless state is older than MaxStateAge. The beliefs
+// then change as usual, once the upstreams are checked.
+func (t *Tracker) Restore(state State) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.cfg.MaxStateAge > 0 && t.now().Sub(state.Time) > t.cfg.MaxStateAge {
+		return
+	}
+	for _, saved := range state.Upstreams {
+		if s, ok := t.states[saved.Upstream]; ok && s.consecutive == 0 {
+			s.belief = saved.Belief
+		}
+	}
+}
+
+// Load restores the beliefs saved in Store, if set.
+func (t *Tracker) Load() error {
+	if t.Store == nil {
+		return nil
+	}
+	state, err := t.Store.Load()
+	if err != nil {
+		return err
+	}
+	t.Restore(state)
+	return nil
+}
+
+// Save saves the current beliefs to Store, if set.
+func (t *Tracker) Save() error {
+	if t.Store == nil {
+		return nil
+	}
+	return t.Store.Save(t.State())
+}
+
+// StartPersister starts a goroutine that calls Save whenever a belief
+// changes. The returned stop function stops the goroutine, then calls Save
+// a final time. Errors are logged to Logger, if set.
+func (t *Tracker) StartPersister() (stop func()) {
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	save := func() {
+		if err := t.Save(); err != nil && t.Logger != nil {
+			t.Logger.Error(&slog.LogRecord{Msg: "Tracker: failed to save health state", Error: err})
+		}
+	}
+	go func() {
+		defer close(stopped)
+		for {
+			select {
+			case <-t.changed:
+				save()
+			case <-done:
+				return
+			}
+		}
+	}()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			close(done)
+			<-stopped
+			save()
+		})
+	}
+}
@@ -0,0 +1,345 @@
+// Package healthcheck actively probes upstreams and tracks a belief about
+// the health of each upstream, based upon the results of recent probes.
+package healthcheck
+
+import (
+	"errors"
+	"sync"
+	"tcplb/lib/clock"
+	"tcplb/lib/core"
+	"tcplb/lib/slog"
+	"time"
+)
+
+// CheckResult is the outcome of a single health check of an upstream.
+type CheckResult int
+
+const (
+	CheckPass CheckResult = iota
+	CheckFail
+)
+
+func (r CheckResult) String() string {
+	switch r {
+	case CheckPass:
+		return "pass"
+	case CheckFail:
+		return "fail"
+	default:
+		return "invalid"
+	}
+}
+
+func (r CheckResult) MarshalText() ([]byte, error) {
+	return []byte(r.String()), nil
+}
+
+// HealthReport is the outcome of a single health check of an Upstream.
+type HealthReport struct {
+	Upstream core.Upstream
+	Result   CheckResult
+	Symptom  error // Symptom optionally describes why a check failed.
+	Time     time.Time
+}
+
+// Belief is the current belief about the health of an upstream.
+type Belief int
+
+const (
+	BeliefUnknown   Belief = iota // BeliefUnknown means there is not yet enough evidence.
+	BeliefHealthy                 // BeliefHealthy means recent checks have passed.
+	BeliefUnhealthy               // BeliefUnhealthy means recent checks have failed.
+)
+
+func (b Belief) String() string {
+	switch b {
+	case BeliefUnknown:
+		return "unknown"
+	case BeliefHealthy:
+		return "healthy"
+	case BeliefUnhealthy:
+		return "unhealthy"
+	default:
+		return "invalid"
+	}
+}
+
+func (b Belief) MarshalText() ([]byte, error) {
+	return []byte(b.String()), nil
+}
+
+// TrackerConfig configures a Tracker.
+type TrackerConfig struct {
+	// HealthyThreshold is the number of consecutive passing checks needed
+	// to believe an upstream is healthy.
+	HealthyThreshold int
+	// UnhealthyThreshold is the number of consecutive failing checks needed
+	// to believe an upstream is unhealthy.
+	UnhealthyThreshold int
+	// HistoryLength is the number of recent checks of each upstream that
+	// are remembered, so that operators can see if its health flaps.
+	HistoryLength int
+	// MaxStateAge is optional. If positive, saved beliefs older than
+	// MaxStateAge are not restored, as upstreams may have recovered or
+	// failed since.
+	MaxStateAge time.Duration
+	Clock       clock.Clock // Clock is optional. If nil, the Real clock is used.
+}
+
+const (
+	DefaultHealthyThreshold   = 1
+	DefaultUnhealthyThreshold = 2
+	DefaultHistoryLength      = 32
+)
+
+// NoSuchUpstream is returned when an operation refers to an upstream that
+// is not tracked.
+var NoSuchUpstream = errors.New("no such upstream")
+
+type upstreamState struct {
+	drained     bool // drained is set by operators to stop new connections to the upstream.
+	retired     bool // retired is set once the upstream is no longer in use, which also stops new connections to it.
+	belief      Belief
+	consecutive int         // consecutive is the length of the current run of equal results
+	last        CheckResult // last is the most recent result
+	lastReport  time.Time
+	lastSymptom error
+	history     []HealthEvent // history is a ring of recent checks. Once full, next is the oldest.
+	next        int
+}
+
+// record adds e to the history of the upstream, forgetting the oldest check
+// once the history has length checks.
+func (s *upstreamState) record(e HealthEvent, length int) {
+	if len(s.history) < length {
+		s.history = append(s.history, e)
+		return
+	}
+	s.history[s.next] = e
+	s.next = (s.next + 1) % length
+}
+
+// recent returns the history of the upstream, from oldest to newest.
+func (s *upstreamState) recent() []HealthEvent {
+	result := make([]HealthEvent, 0, len(s.history))
+	result = append(result, s.history[s.next:]...)
+	return append(result, s.history[:s.next]...)
+}
+
+// HealthEvent is a check of an upstream remembered by a Tracker.
+type HealthEvent struct {
+	Time    time.Time   `json:"time"`
+	Result  CheckResult `json:"result"`
+	Symptom string      `json:"symptom,omitempty"`
+	Belief  Belief      `json:"belief"` // Belief is the belief about the health of the upstream once the check was reported.
+}
+
+// UpstreamHealth is a snapshot of the tracked health of an upstream.
+type UpstreamHealth struct {
+	Upstream    core.Upstream `json:"upstream"`
+	Belief      Belief        `json:"belief"`
+	Drained     bool          `json:"drained"`
+	Retired     bool          `json:"retired,omitempty"`
+	LastReport  time.Time     `json:"last_report,omitempty"`
+	LastSymptom string        `json:"last_symptom,omitempty"`
+}
+
+// Tracker maintains beliefs about the health of a set of upstreams, as
+// informed by HealthReports.
+//
+// Multiple goroutines may invoke methods on a Tracker simultaneously.
+type Tracker struct {
+	Store  Store       // Store is optional. If set, beliefs are saved to it by StartPersister, and loaded from it by Load.
+	Logger slog.Logger // Logger is optional. If set, failures to save beliefs are logged.
+
+	cfg     TrackerConfig
+	now     func() time.Time
+	changed chan struct{} // changed has a value once a belief changes, until StartPersister saves the beliefs.
+
+	mu     sync.Mutex // mu guards states
+	states map[core.Upstream]*upstreamState
+}
+
+// NewTracker returns a Tracker for the given upstreams, with an initial
+// belief of BeliefUnknown for each.
+func NewTracker(cfg TrackerConfig, upstreams core.UpstreamSet) *Tracker {
+	if cfg.HealthyThreshold <= 0 {
+		cfg.HealthyThreshold = DefaultHealthyThreshold
+	}
+	if cfg.UnhealthyThreshold <= 0 {
+		cfg.UnhealthyThreshold = DefaultUnhealthyThreshold
+	}
+	if cfg.HistoryLength <= 0 {
+		cfg.HistoryLength = DefaultHistoryLength
+	}
+	states := make(map[core.Upstream]*upstreamState, len(upstreams))
+	for u := range upstreams {
+		states[u] = &upstreamState{belief: BeliefUnknown}
+	}
+	return &Tracker{cfg: cfg, now: clock.Or(cfg.Clock).Now, changed: make(chan struct{}, 1), states: states}
+}
+
+// ReportHealth updates the belief about the health of the reported upstream.
+// Reports for upstreams that are not tracked are ignored.
+func (t *Tracker) ReportHealth(report HealthReport) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s, ok := t.states[report.Upstream]
+	if !ok {
+		return
+	}
+	if s.consecutive > 0 && s.last == report.Result {
+		s.consecutive++
+	} else {
+		s.consecutive = 1
+	}
+	s.last = report.Result
+	s.lastReport = report.Time
+	s.lastSymptom = report.Symptom
+	before := s.belief
+	switch report.Result {
+	case CheckPass:
+		if s.consecutive >= t.cfg.HealthyThreshold {
+			s.belief = BeliefHealthy
+		}
+	case CheckFail:
+		if s.consecutive >= t.cfg.UnhealthyThreshold {
+			s.belief = BeliefUnhealthy
+		}
+	}
+	if s.belief != before {
+		select {
+		case t.changed <- struct{}{}:
+		default:
+		}
+	}
+	e := HealthEvent{Time: report.Time, Result: report.Result, Belief: s.belief}
+	if report.Symptom != nil {
+		e.Symptom = report.Symptom.Error()
+	}
+	s.record(e, t.cfg.HistoryLength)
+}
+
+// History returns the most recent checks of upstream u, from oldest to
+// newest, at most HistoryLength of them. NoSuchUpstream is returned if u is
+// not tracked.
+func (t *Tracker) History(u core.Upstream) ([]HealthEvent, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s, ok := t.states[u]
+	if !ok {
+		return nil, NoSuchUpstream
+	}
+	return s.recent(), nil
+}
+
+// Belief returns the current belief about the health of upstream u.
+// Untracked upstreams are BeliefUnknown.
+func (t *Tracker) Belief(u core.Upstream) Belief {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s, ok := t.states[u]
+	if !ok {
+		return BeliefUnknown
+	}
+	return s.belief
+}
+
+// SetDrained marks upstream u as drained, or no longer drained. New
+// connections should not be forwarded to drained upstreams, while existing
+// connections are unaffected. NoSuchUpstream is returned if u is not tracked.
+func (t *Tracker) SetDrained(u core.Upstream, drained bool) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s, ok := t.states[u]
+	if !ok {
+		return NoSuchUpstream
+	}
+	s.drained = drained
+	return nil
+}
+
+// Drained reports if upstream u is drained, or retired. A nil *Tracker
+// drains nothing.
+func (t *Tracker) Drained(u core.Upstream) bool {
+	if t == nil {
+		return false
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s, ok := t.states[u]
+	return ok && (s.drained || s.retired)
+}
+
+// Track makes upstreams the set of upstreams in use, e.g. once the
+// upstreams of pools are replaced. Upstreams that were not tracked are
+// tracked with an initial belief of BeliefUnknown. Tracked upstreams that
+// are not in upstreams are retired: they remain tracked, so that their
+// health stays visible while their connections finish, but are drained.
+// Retired upstreams that come back into use are no longer retired, and
+// keep their history. Upstreams that were already retired, and are still
+// not in use, are no longer tracked, so that replacing upstreams does not
+// grow the Tracker without bound.
+func (t *Tracker) Track(upstreams core.UpstreamSet) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for u, s := range t.states {
+		_, ok := upstreams[u]
+		if !ok && s.retired {
+			delete(t.states, u)
+			continue
+		}
+		s.retired = !ok
+	}
+	for u := range upstreams {
+		if _, ok := t.states[u]; !ok {
+			t.states[u] = &upstreamState{belief: BeliefUnknown}
+		}
+	}
+}
+
+// CountHealthy returns the number of upstreams in use that are believed to
+// be healthy.
+func (t *Tracker) CountHealthy() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	n := 0
+	for _, s := range t.states {
+		if s.belief == BeliefHealthy && !s.retired {
+			n++
+		}
+	}
+	return n
+}
+
+// Upstreams returns the set of tracked upstreams.
+func (t *Tracker) Upstreams() core.UpstreamSet {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	result := core.EmptyUpstreamSet()
+	for u := range t.states {
+		result[u] = struct{}{}
+	}
+	return result
+}
+
+// Snapshot returns the tracked health of every upstream.
+func (t *Tracker) Snapshot() []UpstreamHealth {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	result := make([]UpstreamHealth, 0, len(t.states))
+	for u, s := range t.states {
+		h := UpstreamHealth{
+			Upstream:   u,
+			Belief:     s.belief,
+			Drained:    s.drained || s.retired,
+			Retired:    s.retired,
+			LastReport: s.lastReport,
+		}
+		if s.lastSymptom != nil {
+			h.LastSymptom = s.lastSymptom.Error()
+		}
+		result = append(result, h)
+	}
+	return result
+}
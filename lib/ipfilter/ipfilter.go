@@ -0,0 +1,188 @@
+// Package ipfilter decides whether to serve client connections according to
+// their remote IP address, using allowlists and denylists of CIDR prefixes.
+// It is cheap enough to apply to every accepted connection, before any TLS
+// work is done.
+package ipfilter
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Rules are allowlists and denylists of CIDR prefixes. An address is denied
+// if it is in any Deny prefix. Otherwise it is allowed if Allow is empty or
+// it is in any Allow prefix.
+type Rules struct {
+	Allow []netip.Prefix
+	Deny  []netip.Prefix
+}
+
+// Empty reports if r has no prefixes, and so allows every address.
+func (r Rules) Empty() bool {
+	return len(r.Allow) == 0 && len(r.Deny) == 0
+}
+
+// Merge returns the Rules with the prefixes of both r and other.
+func (r Rules) Merge(other Rules) Rules {
+	return Rules{
+		Allow: append(append([]netip.Prefix(nil), r.Allow...), other.Allow...),
+		Deny:  append(append([]netip.Prefix(nil), r.Deny...), other.Deny...),
+	}
+}
+
+// Allowed reports if the rules allow addr.
+func (r Rules) Allowed(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, p := range r.Deny {
+		if p.Contains(addr) {
+			return false
+		}
+	}
+	if len(r.Allow) == 0 {
+		return true
+	}
+	for _, p := range r.Allow {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// ParsePrefix parses a CIDR prefix, e.g. "10.0.0.0/8", or a single IP
+// address, which is treated as a prefix containing only that address.
+func ParsePrefix(s string) (netip.Prefix, error) {
+	if strings.Contains(s, "/") {
+		p, err := netip.ParsePrefix(s)
+		if err != nil {
+			return netip.Prefix{}, err
+		}
+		return p.Masked(), nil
+	}
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	addr = addr.Unmap()
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+// ParsePrefixList parses a comma-separated list of prefixes, as accepted by
+// ParsePrefix. Empty items are ignored.
+func ParsePrefixList(s string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, token := range strings.Split(s, ",") {
+		token = strings.TrimSpace(token)
+		if token == "" {
+			continue
+		}
+		p, err := ParsePrefix(token)
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, p)
+	}
+	return prefixes, nil
+}
+
+// ParseRules reads Rules from r, one per line, of the form "allow PREFIX" or
+// "deny PREFIX". Blank lines and lines starting with # are ignored.
+func ParseRules(r io.Reader) (Rules, error) {
+	var rules Rules
+	scanner := bufio.NewScanner(r)
+	for lineno := 1; scanner.Scan(); lineno++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return Rules{}, fmt.Errorf("line %d: expected \"allow PREFIX\" or \"deny PREFIX\" but got %q", lineno, line)
+		}
+		p, err := ParsePrefix(fields[1])
+		if err != nil {
+			return Rules{}, fmt.Errorf("line %d: %w", lineno, err)
+		}
+		switch fields[0] {
+		case "allow":
+			rules.Allow = append(rules.Allow, p)
+		case "deny":
+			rules.Deny = append(rules.Deny, p)
+		default:
+			return Rules{}, fmt.Errorf("line %d: expected \"allow\" or \"deny\" but got %q", lineno, fields[0])
+		}
+	}
+	return rules, scanner.Err()
+}
+
+// LoadRules reads Rules from the file at path, as parsed by ParseRules.
+func LoadRules(path string) (Rules, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return Rules{}, err
+	}
+	defer f.Close()
+	rules, err := ParseRules(f)
+	if err != nil {
+		return Rules{}, fmt.Errorf("%s: %w", path, err)
+	}
+	return rules, nil
+}
+
+// Filter applies Rules to the remote addresses of connections. Its Rules
+// may be replaced while it is in use, e.g. when they are reloaded.
+//
+// Multiple goroutines may invoke methods on a Filter simultaneously.
+type Filter struct {
+	mu    sync.RWMutex // mu guards rules
+	rules Rules
+}
+
+// NewFilter returns a Filter that applies rules.
+func NewFilter(rules Rules) *Filter {
+	return &Filter{rules: rules}
+}
+
+// SetRules replaces the Rules applied by f.
+func (f *Filter) SetRules(rules Rules) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.rules = rules
+}
+
+// AllowConn reports if the connection from remote should be served.
+// Addresses that are not IP addresses are only allowed if the Rules are
+// empty.
+func (f *Filter) AllowConn(remote net.Addr) bool {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	if f.rules.Empty() {
+		return true
+	}
+	addr, ok := ipOf(remote)
+	if !ok {
+		return false
+	}
+	return f.rules.Allowed(addr)
+}
+
+func ipOf(remote net.Addr) (netip.Addr, bool) {
+	switch a := remote.(type) {
+	case *net.TCPAddr:
+		return netip.AddrFromSlice(a.IP)
+	case *net.UDPAddr:
+		return netip.AddrFromSlice(a.IP)
+	}
+	host, _, err := net.SplitHostPort(remote.String())
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	addr, err := netip.ParseAddr(host)
+	return addr, err == nil
+}
@@ -0,0 +1,92 @@
+package ipfilter
+
+import (
+	"github.com/stretchr/testify/require"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func mustParsePrefixList(t *testing.T, s string) []netip.Prefix {
+	prefixes, err := ParsePrefixList(s)
+	require.NoError(t, err)
+	return prefixes
+}
+
+func TestRulesAllowed(t *testing.T) {
+	scenarios := []struct {
+		name    string
+		rules   Rules
+		addr    string
+		allowed bool
+	}{
+		{"empty rules allow everything", Rules{}, "192.0.2.1", true},
+		{"in allowlist", Rules{Allow: mustParsePrefixList(t, "10.0.0.0/8")}, "10.1.2.3", true},
+		{"not in allowlist", Rules{Allow: mustParsePrefixList(t, "10.0.0.0/8")}, "192.0.2.1", false},
+		{"in denylist", Rules{Deny: mustParsePrefixList(t, "192.0.2.0/24")}, "192.0.2.1", false},
+		{"not in denylist", Rules{Deny: mustParsePrefixList(t, "192.0.2.0/24")}, "198.51.100.1", true},
+		{"deny takes precedence", Rules{Allow: mustParsePrefixList(t, "10.0.0.0/8"), Deny: mustParsePrefixList(t, "10.0.0.1")}, "10.0.0.1", false},
+		{"ipv4-mapped ipv6", Rules{Allow: mustParsePrefixList(t, "10.0.0.0/8")}, "::ffff:10.0.0.1", true},
+		{"ipv6", Rules{Allow: mustParsePrefixList(t, "2001:db8::/32")}, "2001:db8::1", true},
+	}
+	for _, s := range scenarios {
+		t.Run(s.name, func(t *testing.T) {
+			require.Equal(t, s.allowed, s.rules.Allowed(netip.MustParseAddr(s.addr)))
+		})
+	}
+}
+
+func TestParsePrefixList(t *testing.T) {
+	prefixes, err := ParsePrefixList("10.1.2.3/8, 192.0.2.1,,2001:db8::1")
+	require.NoError(t, err)
+	require.Equal(t, []netip.Prefix{
+		netip.MustParsePrefix("10.0.0.0/8"),
+		netip.MustParsePrefix("192.0.2.1/32"),
+		netip.MustParsePrefix("2001:db8::1/128"),
+	}, prefixes)
+
+	_, err = ParsePrefixList("10.0.0.0/33")
+	require.Error(t, err)
+	_, err = ParsePrefixList("example.com")
+	require.Error(t, err)
+}
+
+func TestParseRules(t *testing.T) {
+	rules, err := ParseRules(strings.NewReader("# office\nallow 10.0.0.0/8\n\ndeny 10.0.0.1\n"))
+	require.NoError(t, err)
+	require.Equal(t, Rules{
+		Allow: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")},
+		Deny:  []netip.Prefix{netip.MustParsePrefix("10.0.0.1/32")},
+	}, rules)
+
+	_, err = ParseRules(strings.NewReader("permit 10.0.0.0/8\n"))
+	require.ErrorContains(t, err, "line 1")
+	_, err = ParseRules(strings.NewReader("allow\n"))
+	require.ErrorContains(t, err, "line 1")
+}
+
+func TestFilterReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rules")
+	require.NoError(t, os.WriteFile(path, []byte("deny 127.0.0.1\n"), 0o600))
+	rules, err := LoadRules(path)
+	require.NoError(t, err)
+
+	f := NewFilter(rules)
+	local := &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 1234}
+	require.False(t, f.AllowConn(local))
+
+	require.NoError(t, os.WriteFile(path, []byte("allow 127.0.0.0/8\n"), 0o600))
+	rules, err = LoadRules(path)
+	require.NoError(t, err)
+	f.SetRules(rules)
+	require.True(t, f.AllowConn(local))
+
+	// Non-IP addresses are only allowed when there are no rules.
+	unix := &net.UnixAddr{Name: "/tmp/sock", Net: "unix"}
+	require.False(t, f.AllowConn(unix))
+	f.SetRules(Rules{})
+	require.True(t, f.AllowConn(unix))
+}
@@ -0,0 +1,14 @@
+//go:build windows || plan9
+
+package limiter
+
+import (
+	"errors"
+	"time"
+)
+
+// processCPUTime returns the CPU time used by this process, which cannot be
+// measured on this platform.
+func processCPUTime() (time.Duration, error) {
+	return 0, errors.New("measuring process CPU time is unsupported on this platform")
+}
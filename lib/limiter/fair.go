@@ -0,0 +1,231 @@
+package limiter
+
+import (
+	"context"
+	"math"
+	"sync"
+	"tcplb/lib/clock"
+	"tcplb/lib/core"
+	"tcplb/lib/metrics"
+	"time"
+)
+
+// DefaultBandwidthQuantum is the default FairBandwidthConfig.Quantum.
+const DefaultBandwidthQuantum = 16 * 1024
+
+// FairBandwidthConfig configures a FairBandwidthScheduler.
+type FairBandwidthConfig struct {
+	Rate    float64     // Rate is the ceiling on the bytes sent per second, across all clients.
+	Burst   int         // Burst is the most bytes sent at once after a lull. If not positive, a hundredth of a second's worth of Rate. It is at least Quantum.
+	Quantum int         // Quantum is the bytes that each client with data waiting may send per round. If not positive, DefaultBandwidthQuantum.
+	Clock   clock.Clock // Clock is optional. If nil, the Real clock is used.
+}
+
+// FairBandwidthMetrics holds the metrics recorded by a
+// FairBandwidthScheduler.
+type FairBandwidthMetrics struct {
+	Waits   *metrics.Counter // Waits counts sends that waited for bandwidth.
+	Waiting *metrics.Gauge   // Waiting is the number of clients with sends waiting for bandwidth.
+}
+
+// NewFairBandwidthMetrics returns FairBandwidthMetrics registered in the
+// given Registry.
+func NewFairBandwidthMetrics(r *metrics.Registry) *FairBandwidthMetrics {
+	return &FairBandwidthMetrics{
+		Waits:   r.Counter("bandwidth_waits_total"),
+		Waiting: r.Gauge("bandwidth_waiting_clients"),
+	}
+}
+
+func (m *FairBandwidthMetrics) recordWait() {
+	if m == nil {
+		return
+	}
+	m.Waits.Inc()
+}
+
+func (m *FairBandwidthMetrics) setWaiting(n int) {
+	if m == nil {
+		return
+	}
+	m.Waiting.Set(int64(n))
+}
+
+// FairBandwidthScheduler is a BandwidthScheduler that bounds the bytes sent
+// by all clients to Rate per second, with a token bucket. While the bucket
+// has tokens, sends proceed at once. Once it runs dry, sends wait, and as
+// tokens accrue they are shared between the clients with sends waiting by
+// deficit round robin: in each round, every such client may send up to
+// Quantum bytes, so a client with a bulk transfer gets the same share as a
+// client sending a few bytes at a time, rather than whatever it asks for
+// first.
+//
+// Multiple goroutines may invoke methods on a FairBandwidthScheduler
+// simultaneously.
+type FairBandwidthScheduler struct {
+	cfg     FairBandwidthConfig
+	clock   clock.Clock
+	metrics *FairBandwidthMetrics
+
+	mu     sync.Mutex // mu guards the fields below
+	tokens float64
+	last   time.Time
+	flows  map[core.ClientID]*bandwidthFlow // flows are those of clients with sends waiting.
+	active []*bandwidthFlow                 // active is the round of flows, from the flow being served.
+	timer  clock.Timer                      // timer is pending while sends wait for tokens.
+}
+
+// bandwidthFlow is the sends of a client waiting for bandwidth.
+type bandwidthFlow struct {
+	client  core.ClientID
+	deficit int // deficit is the bytes the client may still send in this round.
+	waiting []*bandwidthRequest
+}
+
+type bandwidthRequest struct {
+	n       int
+	granted int           // granted is set once the request is granted, before done is closed.
+	done    chan struct{} // done is closed once the request is granted.
+}
+
+// NewFairBandwidthScheduler returns a FairBandwidthScheduler configured by
+// cfg, whose bucket is full. m is optional. If nil, no metrics are recorded.
+func NewFairBandwidthScheduler(cfg FairBandwidthConfig, m *FairBandwidthMetrics) *FairBandwidthScheduler {
+	if cfg.Quantum <= 0 {
+		cfg.Quantum = DefaultBandwidthQuantum
+	}
+	if cfg.Burst <= 0 {
+		cfg.Burst = int(math.Ceil(cfg.Rate / 100))
+	}
+	if cfg.Burst < cfg.Quantum {
+		cfg.Burst = cfg.Quantum
+	}
+	clk := clock.Or(cfg.Clock)
+	return &FairBandwidthScheduler{
+		cfg:     cfg,
+		clock:   clk,
+		metrics: m,
+		tokens:  float64(cfg.Burst),
+		last:    clk.Now(),
+		flows:   make(map[core.ClientID]*bandwidthFlow),
+	}
+}
+
+func (s *FairBandwidthScheduler) WaitBandwidth(ctx context.Context, c core.ClientID, n int) (int, error) {
+	if n <= 0 {
+		return 0, nil
+	}
+	s.mu.Lock()
+	s.refillLocked()
+	if len(s.active) == 0 && s.tokens >= 1 {
+		granted := n
+		if available := int(s.tokens); granted > available {
+			granted = available
+		}
+		s.tokens -= float64(granted)
+		s.mu.Unlock()
+		return granted, nil
+	}
+	r := &bandwidthRequest{n: n, done: make(chan struct{})}
+	f, ok := s.flows[c]
+	if !ok {
+		f = &bandwidthFlow{client: c}
+		s.flows[c] = f
+		s.active = append(s.active, f)
+		s.metrics.setWaiting(len(s.active))
+	}
+	f.waiting = append(f.waiting, r)
+	s.dispatchLocked()
+	s.mu.Unlock()
+	s.metrics.recordWait()
+
+	select {
+	case <-r.done:
+		return r.granted, nil
+	case <-ctx.Done():
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if r.granted > 0 {
+		return r.granted, nil
+	}
+	for i, w := range f.waiting {
+		if w == r {
+			f.waiting = append(f.waiting[:i], f.waiting[i+1:]...)
+			break
+		}
+	}
+	if len(f.waiting) == 0 {
+		s.removeLocked(f)
+	}
+	s.dispatchLocked()
+	return 0, ctx.Err()
+}
+
+func (s *FairBandwidthScheduler) refillLocked() {
+	now := s.clock.Now()
+	if elapsed := now.Sub(s.last); elapsed > 0 {
+		s.tokens = math.Min(float64(s.cfg.Burst), s.tokens+elapsed.Seconds()*s.cfg.Rate)
+	}
+	s.last = now
+}
+
+// dispatchLocked grants waiting sends, flow by flow, as far as the tokens
+// allow, then arranges to be called again once enough tokens accrue for
+// the next grant.
+func (s *FairBandwidthScheduler) dispatchLocked() {
+	for len(s.active) > 0 {
+		f := s.active[0]
+		if f.deficit <= 0 {
+			f.deficit += s.cfg.Quantum
+		}
+		r := f.waiting[0]
+		granted := r.n
+		if granted > f.deficit {
+			granted = f.deficit
+		}
+		if s.tokens < float64(granted) {
+			if s.timer == nil {
+				wait := time.Duration((float64(granted) - s.tokens) / s.cfg.Rate * float64(time.Second))
+				s.timer = s.clock.AfterFunc(wait, s.onTimer)
+			}
+			return
+		}
+		s.tokens -= float64(granted)
+		f.deficit -= granted
+		r.granted = granted
+		close(r.done)
+		f.waiting = f.waiting[1:]
+		switch {
+		case len(f.waiting) == 0:
+			s.removeLocked(f)
+		case f.deficit <= 0:
+			// The flow has had its share of this round. Serve the next.
+			s.active = append(s.active[1:], f)
+		}
+	}
+}
+
+func (s *FairBandwidthScheduler) onTimer() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.timer = nil
+	s.refillLocked()
+	s.dispatchLocked()
+}
+
+// removeLocked removes f, which has no sends waiting, from the round. Its
+// deficit is forgotten, so that a client cannot save up bandwidth while it
+// has nothing to send.
+func (s *FairBandwidthScheduler) removeLocked(f *bandwidthFlow) {
+	for i, g := range s.active {
+		if g == f {
+			s.active = append(s.active[:i], s.active[i+1:]...)
+			break
+		}
+	}
+	delete(s.flows, f.client)
+	s.metrics.setWaiting(len(s.active))
+}
+
+var _ core.BandwidthScheduler = (*FairBandwidthScheduler)(nil) // type check
@@ -0,0 +1,79 @@
+package limiter
+
+import (
+	"context"
+	"github.com/stretchr/testify/require"
+	"tcplb/lib/clock"
+	"tcplb/lib/core"
+	"tcplb/lib/metrics"
+	"testing"
+	"time"
+)
+
+func TestFairBandwidthScheduler(t *testing.T) {
+	c := clock.NewFake(time.Unix(0, 0))
+	registry := metrics.NewRegistry()
+	m := NewFairBandwidthMetrics(registry)
+	s := NewFairBandwidthScheduler(FairBandwidthConfig{Rate: 1000, Quantum: 100, Clock: c}, m)
+	bulk := core.ClientID{Namespace: "test", Key: "bulk"}
+	interactive := core.ClientID{Namespace: "test", Key: "interactive"}
+	ctx := context.Background()
+
+	// Without contention, sends proceed at once, as far as the bucket allows.
+	granted, err := s.WaitBandwidth(ctx, bulk, 1000)
+	require.NoError(t, err)
+	require.Equal(t, 100, granted)
+
+	type grant struct {
+		client  core.ClientID
+		granted int
+	}
+	grants := make(chan grant, 4)
+	wait := func(client core.ClientID, n int, waits int64) {
+		go func() {
+			granted, err := s.WaitBandwidth(ctx, client, n)
+			require.NoError(t, err)
+			grants <- grant{client, granted}
+		}()
+		require.Eventually(t, func() bool { return m.Waits.Value() == waits }, time.Second, time.Millisecond)
+	}
+	// The bulk client queues several sends before the interactive client
+	// queues one, but each gets a quantum per round, so the interactive
+	// client does not wait for all of the bulk client's sends.
+	wait(bulk, 100, 1)
+	wait(bulk, 100, 2)
+	wait(bulk, 100, 3)
+	wait(interactive, 50, 4)
+	require.Equal(t, int64(2), registry.Snapshot()["bandwidth_waiting_clients"])
+
+	c.BlockUntil(1)
+	c.Advance(100 * time.Millisecond)
+	require.Equal(t, grant{bulk, 100}, <-grants)
+	c.BlockUntil(1)
+	c.Advance(50 * time.Millisecond)
+	require.Equal(t, grant{interactive, 50}, <-grants)
+	for i := 0; i < 2; i++ {
+		c.BlockUntil(1)
+		c.Advance(100 * time.Millisecond)
+		require.Equal(t, grant{bulk, 100}, <-grants)
+	}
+	require.Eventually(t, func() bool { return registry.Snapshot()["bandwidth_waiting_clients"] == 0 }, time.Second, time.Millisecond)
+
+	// Sends larger than a quantum are granted a quantum at a time, so that
+	// others need not wait for them.
+	go func() {
+		granted, err := s.WaitBandwidth(ctx, bulk, 1000)
+		require.NoError(t, err)
+		grants <- grant{bulk, granted}
+	}()
+	c.BlockUntil(1)
+	c.Advance(100 * time.Millisecond)
+	require.Equal(t, grant{bulk, 100}, <-grants)
+
+	// Sends that give up waiting are not granted.
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	_, err = s.WaitBandwidth(cancelled, interactive, 50)
+	require.ErrorIs(t, err, context.Canceled)
+	require.Eventually(t, func() bool { return registry.Snapshot()["bandwidth_waiting_clients"] == 0 }, time.Second, time.Millisecond)
+}
@@ -0,0 +1,101 @@
+package limiter
+
+import (
+	"fmt"
+	runtimemetrics "runtime/metrics"
+	"sync"
+	"sync/atomic"
+	"tcplb/lib/metrics"
+	"tcplb/lib/slog"
+	"time"
+)
+
+// heapObjectsMetric is the runtime metric of the bytes of heap memory
+// occupied by objects, live or not yet collected.
+const heapObjectsMetric = "/memory/classes/heap/objects:bytes"
+
+// MemoryWatchdog is an OverloadSignal that signals overload while the heap
+// of this process exceeds Threshold bytes, as measured by the last Sample.
+// The heap includes garbage not yet collected, so Threshold should leave
+// room for the garbage that accumulates between collections, e.g. by being
+// set below a memory limit that makes the collector run more often as the
+// heap approaches it.
+//
+// Multiple goroutines may invoke methods on a MemoryWatchdog
+// simultaneously.
+type MemoryWatchdog struct {
+	Threshold uint64
+	HeapBytes *metrics.Gauge // HeapBytes is optional. If set, it tracks the heap measured by the last Sample.
+	Logger    slog.Logger    // Logger is optional. If set, overload starting and ending are logged, once each time.
+
+	overloaded int32 // overloaded is 1 while overloaded, accessed atomically.
+	heapBytes  func() uint64
+}
+
+// NewMemoryWatchdog returns a MemoryWatchdog with the given threshold, in
+// bytes of heap.
+func NewMemoryWatchdog(threshold uint64) *MemoryWatchdog {
+	return &MemoryWatchdog{Threshold: threshold, heapBytes: readHeapBytes}
+}
+
+// readHeapBytes returns the bytes of heap memory occupied by objects.
+func readHeapBytes() uint64 {
+	samples := []runtimemetrics.Sample{{Name: heapObjectsMetric}}
+	runtimemetrics.Read(samples)
+	if samples[0].Value.Kind() != runtimemetrics.KindUint64 {
+		return 0
+	}
+	return samples[0].Value.Uint64()
+}
+
+func (w *MemoryWatchdog) Overloaded() bool {
+	return atomic.LoadInt32(&w.overloaded) == 1
+}
+
+// Sample measures the heap of this process, and updates whether overload
+// is signalled.
+func (w *MemoryWatchdog) Sample() {
+	heap := w.heapBytes()
+	w.HeapBytes.Set(int64(heap))
+	var overloaded int32
+	if heap > w.Threshold {
+		overloaded = 1
+	}
+	if atomic.SwapInt32(&w.overloaded, overloaded) == overloaded || w.Logger == nil {
+		return
+	}
+	if overloaded == 1 {
+		w.Logger.Warn(&slog.LogRecord{Msg: fmt.Sprintf("MemoryWatchdog: heap of %d bytes is over the threshold of %d bytes, dropping new connections", heap, w.Threshold)})
+	} else {
+		w.Logger.Info(&slog.LogRecord{Msg: fmt.Sprintf("MemoryWatchdog: heap of %d bytes is back under the threshold of %d bytes, accepting new connections", heap, w.Threshold)})
+	}
+}
+
+// StartSampler starts a goroutine that calls Sample once per interval. The
+// returned stop function stops the goroutine.
+func (w *MemoryWatchdog) StartSampler(interval time.Duration) (stop func()) {
+	ticker := time.NewTicker(interval)
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		for {
+			select {
+			case <-ticker.C:
+				w.Sample()
+			case <-done:
+				return
+			}
+		}
+	}()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			ticker.Stop()
+			close(done)
+			<-stopped
+		})
+	}
+}
+
+var _ OverloadSignal = (*MemoryWatchdog)(nil) // type check
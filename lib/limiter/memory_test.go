@@ -0,0 +1,43 @@
+package limiter
+
+import (
+	"github.com/stretchr/testify/require"
+	"tcplb/lib/metrics"
+	"tcplb/lib/slog"
+	"testing"
+	"time"
+)
+
+func TestMemoryWatchdog(t *testing.T) {
+	heap := uint64(0)
+	logger := &slog.RecordingLogger{}
+	w := &MemoryWatchdog{
+		Threshold: 1000,
+		HeapBytes: metrics.NewRegistry().Gauge("heap"),
+		Logger:    logger,
+		heapBytes: func() uint64 { return heap },
+	}
+	require.False(t, w.Overloaded())
+
+	heap = 1001
+	w.Sample()
+	require.True(t, w.Overloaded())
+	require.Equal(t, int64(1001), w.HeapBytes.Value())
+	w.Sample()
+	require.Len(t, logger.Events, 1)
+
+	heap = 1000
+	w.Sample()
+	require.False(t, w.Overloaded())
+	w.Sample()
+	// Overload starting and ending are each logged once.
+	require.Len(t, logger.Events, 2)
+	require.Equal(t, slog.WarnLevel, logger.Events[0].Level)
+	require.Equal(t, slog.InfoLevel, logger.Events[1].Level)
+
+	// The heap of this process can be measured.
+	w = NewMemoryWatchdog(1)
+	stop := w.StartSampler(time.Millisecond)
+	defer stop()
+	require.Eventually(t, w.Overloaded, time.Second, time.Millisecond)
+}
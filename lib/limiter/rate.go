@@ -0,0 +1,85 @@
+package limiter
+
+import (
+	"math"
+	"sync"
+	"tcplb/lib/core"
+	"time"
+)
+
+// TokenBucket limits the rate of events to Rate per second on average,
+// allowing bursts of up to Burst events at once.
+//
+// Multiple goroutines may invoke methods on a TokenBucket simultaneously.
+type TokenBucket struct {
+	rate  float64
+	burst float64
+	now   func() time.Time
+
+	mu     sync.Mutex // mu guards tokens and last.
+	tokens float64
+	last   time.Time
+}
+
+// NewTokenBucket returns a full TokenBucket that allows rate events per
+// second, in bursts of up to burst events. If burst is not positive, bursts
+// of up to rate events, rounded up, are allowed.
+func NewTokenBucket(rate float64, burst int) *TokenBucket {
+	b := float64(burst)
+	if burst <= 0 {
+		b = math.Max(1, math.Ceil(rate))
+	}
+	now := time.Now
+	return &TokenBucket{rate: rate, burst: b, now: now, tokens: b, last: now()}
+}
+
+// Allow reports if an event may happen now, taking a token if so.
+func (b *TokenBucket) Allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := b.now()
+	if elapsed := now.Sub(b.last); elapsed > 0 {
+		b.tokens = math.Min(b.burst, b.tokens+elapsed.Seconds()*b.rate)
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// Refund returns a token taken by Allow for an event that did not happen.
+func (b *TokenBucket) Refund() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.tokens = math.Min(b.burst, b.tokens+1)
+}
+
+// HandshakeRateLimiter limits the rate of TLS handshakes, with
+// separate budgets for full handshakes and for resumed sessions. Resumed
+// sessions skip the expensive public key operations of a full handshake,
+// so typically warrant a larger budget.
+type HandshakeRateLimiter struct {
+	Full    *TokenBucket // Full is optional. If set, it limits the rate of full handshakes.
+	Resumed *TokenBucket // Resumed is optional. If set, it limits the rate of resumed sessions.
+}
+
+// AllowHandshake reports if a handshake may start, charging it against the
+// budget for full handshakes.
+func (l *HandshakeRateLimiter) AllowHandshake() bool {
+	return l.Full == nil || l.Full.Allow()
+}
+
+// AllowResumed reports if a handshake that resumed a session may proceed,
+// refunding its charge to the budget for full handshakes and charging it
+// against the budget for resumed sessions instead.
+func (l *HandshakeRateLimiter) AllowResumed() bool {
+	if l.Full != nil {
+		l.Full.Refund()
+	}
+	return l.Resumed == nil || l.Resumed.Allow()
+}
+
+var _ core.HandshakeRateLimiter = (*HandshakeRateLimiter)(nil) // type check
+var _ core.HandshakeStartLimiter = (*TokenBucket)(nil)         // type check
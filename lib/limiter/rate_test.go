@@ -0,0 +1,60 @@
+package limiter
+
+import (
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	now := time.Unix(0, 0)
+	b := NewTokenBucket(2, 3)
+	b.now = func() time.Time { return now }
+	b.last = now
+
+	// A full bucket allows a burst.
+	for i := 0; i < 3; i++ {
+		require.True(t, b.Allow(), i)
+	}
+	require.False(t, b.Allow())
+
+	// Tokens are replenished at the rate, up to the burst.
+	now = now.Add(500 * time.Millisecond)
+	require.True(t, b.Allow())
+	require.False(t, b.Allow())
+	now = now.Add(time.Hour)
+	for i := 0; i < 3; i++ {
+		require.True(t, b.Allow(), i)
+	}
+	require.False(t, b.Allow())
+
+	// By default, bursts are as large as the rate per second.
+	require.Equal(t, float64(5), NewTokenBucket(4.5, 0).burst)
+	require.Equal(t, float64(1), NewTokenBucket(0.1, 0).burst)
+}
+
+func TestHandshakeRateLimiter(t *testing.T) {
+	l := &HandshakeRateLimiter{Full: NewTokenBucket(0.001, 1), Resumed: NewTokenBucket(0.001, 1)}
+	// Resumed sessions are charged to their own budget, refunding the
+	// budget for full handshakes.
+	require.True(t, l.AllowHandshake())
+	require.True(t, l.AllowResumed())
+	require.True(t, l.AllowHandshake())
+	require.False(t, l.AllowResumed())
+	// Full handshakes are charged until they resume a session.
+	require.True(t, l.AllowHandshake())
+	require.False(t, l.AllowHandshake())
+}
+
+func TestTokenBucketRefund(t *testing.T) {
+	b := NewTokenBucket(0.001, 1)
+	require.True(t, b.Allow())
+	require.False(t, b.Allow())
+	b.Refund()
+	require.True(t, b.Allow())
+	// Refunds do not grow the bucket beyond its burst.
+	b.Refund()
+	b.Refund()
+	require.True(t, b.Allow())
+	require.False(t, b.Allow())
+}
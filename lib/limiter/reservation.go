@@ -3,13 +3,42 @@ package limiter
 import (
 	"context"
 	"errors"
+	"fmt"
 	"sync"
+	"sync/atomic"
+	"tcplb/lib/clock"
 	"tcplb/lib/core"
+	"tcplb/lib/metrics"
+	"time"
 )
 
-// MaxReservationsExceeded is the error returned by UniformlyBoundedClientReserver
-// when an attempted reservation fails because the client has too  many reservations.
-var MaxReservationsExceeded = errors.New("maximum client reservations exceeded")
+// MaxReservationsExceeded is the error wrapped by a LimitExceededError when
+// an attempted reservation fails because the client has too many reservations.
+// It is core.ReservationLimitExceeded, so that handlers recognise it.
+var MaxReservationsExceeded = core.ReservationLimitExceeded
+
+// LimitExceededError is the error returned by UniformlyBoundedClientReserver
+// when an attempted reservation fails because the client has too many
+// reservations. It wraps MaxReservationsExceeded.
+type LimitExceededError struct {
+	ClientID core.ClientID
+	Limit    int64
+}
+
+func (e *LimitExceededError) Error() string {
+	return fmt.Sprintf("%s: client %s holds %d reservations", MaxReservationsExceeded, e.ClientID, e.Limit)
+}
+
+func (e *LimitExceededError) Unwrap() error {
+	return MaxReservationsExceeded
+}
+
+// ReservationsOverloaded is the error returned by
+// UniformlyBoundedClientReserver when an attempted reservation by a client
+// that holds none fails because MaxConcurrentClients clients already hold
+// reservations. It is core.ReserverOverloaded, so that handlers
+// recognise it.
+var ReservationsOverloaded = core.ReserverOverloaded
 
 // NoReservationExists is the error returned by UniformlyBoundedClientReserver if
 // a caller attempts to release a reservation that wasn't previously acquired.
@@ -31,6 +60,15 @@ func (u UnboundedClientReserver) ReleaseReservation(ctx context.Context, c core.
 	return nil
 }
 
+// Reservations returns nil, as an UnboundedClientReserver does not track
+// reservations.
+func (u UnboundedClientReserver) Reservations() []ClientReservations {
+	return nil
+}
+
+// ClientReservations is a snapshot of the reservations held by a client.
+type ClientReservations = core.ClientReservations
+
 // UniformlyBoundedClientReserver is a ClientReserver where all clients are
 // subject to a uniform maximum limit on the number of reservations they can
 // acquire at once.
@@ -38,63 +76,223 @@ func (u UnboundedClientReserver) ReleaseReservation(ctx context.Context, c core.
 // Multiple goroutines may invoke methods on a UniformlyBoundedClientReserver
 // simultaneously.
 type UniformlyBoundedClientReserver struct {
+	// clients is the number of clients holding reservations, accessed
+	// atomically. It is first so that it is 64-bit aligned on 32-bit
+	// platforms.
+	clients int64
+
 	MaxReservationsPerClient int64
 
-	// TODO consider also adding MaxConcurrentClients to bound amount of memory that
-	// resByClient map can consume. This could return a "reservations overloaded" error
-	// to signal to the caller that reservation system is currently overloaded.
-
-	// mu guards resByClient.
-	//
-	// TODO investigate fine-grain locking per ClientID to reduce lock contention.
-	// One naive idea is to use a two-level hierarchy of reservers where the top-level
-	// reserver hashes by ClientID to figure out which sub-reserver to delegate to.
-	// If the top-level reserver used a pre-specified pre-allocated fixed number of
-	// sub-reservers then that avoids the need to modify (and hence lock) the top
-	// level reserver at all, at the cost of creating a new parameter (fixed number
-	// of sub reservers) to tune to usage patterns.
-	//
-	// See also: https://github.com/golang/go/issues/21035
-	// See also: https://pkg.go.dev/crypto/sha256
-	mu          sync.Mutex
+	// MaxConcurrentClients bounds the number of distinct clients holding
+	// reservations at once, and so the memory that the resByClient maps can
+	// consume, e.g. when anonymous clients are identified by source address
+	// and an attacker churns through many. If not positive, there is no
+	// bound.
+	MaxConcurrentClients int64
+
+	// Overloaded is optional. If set, it counts reservations refused with
+	// ReservationsOverloaded.
+	Overloaded *metrics.Counter
+
+	// LeaseTTL is optional. If positive, each client's reservations are a
+	// lease that lapses unless renewed by RenewReservation within LeaseTTL.
+	// Reservations of lapsed leases are reclaimed by SweepExpiredLeases, so
+	// that reservations leaked by a bug do not consume a client's quota
+	// forever. As long as any connection of a client renews its lease, none
+	// of the client's reservations lapse.
+	LeaseTTL time.Duration
+
+	// Expired is optional. If set, it counts reservations reclaimed from
+	// lapsed leases.
+	Expired *metrics.Counter
+
+	// Clock is optional. If nil, the system clock is used.
+	Clock clock.Clock
+
+	// WarnFraction is optional. If positive, and Warner is set, Warner is
+	// warned each time a client comes to hold WarnFraction of
+	// MaxReservationsPerClient, rounded up, so that it may react before its
+	// reservations are refused with MaxReservationsExceeded. Clients are not
+	// warned if that is MaxReservationsPerClient itself. Warner should
+	// limit how often it passes on the warnings of a client, as a client
+	// holding about that many reservations is warned on each reconnection.
+	WarnFraction float64
+	Warner       core.BudgetWarner
+
+	// Reservations are sharded by ClientID hash, so that concurrent
+	// reservations by different clients rarely contend for the same lock.
+	// The number of shards is fixed, so the shards themselves never need
+	// to be locked.
+	shards [reserverShardCount]reserverShard
+}
+
+// reserverShardCount is the number of shards of a UniformlyBoundedClientReserver.
+const reserverShardCount = 64
+
+type reserverShard struct {
+	mu          sync.Mutex // mu guards resByClient and leases.
 	resByClient map[core.ClientID]int64
+	leases      map[core.ClientID]time.Time // leases holds when each client's lease lapses, if LeaseTTL is positive.
 }
 
 func NewUniformlyBoundedClientReserver(maxReservationsPerClient int64) *UniformlyBoundedClientReserver {
-	return &UniformlyBoundedClientReserver{
+	b := &UniformlyBoundedClientReserver{
 		MaxReservationsPerClient: maxReservationsPerClient,
-		resByClient:              make(map[core.ClientID]int64),
 	}
+	for i := range b.shards {
+		b.shards[i].resByClient = make(map[core.ClientID]int64)
+		b.shards[i].leases = make(map[core.ClientID]time.Time)
+	}
+	return b
+}
+
+// shard returns the shard that holds the reservations of c.
+func (b *UniformlyBoundedClientReserver) shard(c core.ClientID) *reserverShard {
+	return &b.shards[c.Hash()%reserverShardCount]
 }
 
 // TryReserve attempts to acquire a reservation for the given client.
 // If the attempt succeeds, nil is returned.
 // If the attempt fails because the client has exceeded the maximum number
-// of reservations, MaxReservationsExceeded error will be returned.
+// of reservations, a *LimitExceededError wrapping MaxReservationsExceeded
+// will be returned. If the attempt fails because MaxConcurrentClients other
+// clients hold reservations, ReservationsOverloaded will be returned.
 //
 // If no reservations are available, this call does not block.
 func (b *UniformlyBoundedClientReserver) TryReserve(ctx context.Context, c core.ClientID) error {
-	b.mu.Lock()
-	defer b.mu.Unlock()
-	n := b.resByClient[c]
+	s := b.shard(c)
+	s.mu.Lock()
+	n, err := b.reserveLocked(s, c)
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	if b.Warner != nil && n == core.BudgetWarningThreshold(b.MaxReservationsPerClient, b.WarnFraction) {
+		b.Warner.WarnBudget(ctx, core.BudgetWarning{
+			ClientID: c,
+			Budget:   core.BudgetReservations,
+			Usage:    n,
+			Limit:    b.MaxReservationsPerClient,
+		})
+	}
+	return nil
+}
+
+// reserveLocked acquires a reservation for c, returning the number it then
+// holds. s.mu must be held.
+func (b *UniformlyBoundedClientReserver) reserveLocked(s *reserverShard, c core.ClientID) (int64, error) {
+	n := s.resByClient[c]
 	// check invariant 0 <= n <= MaxReservationsPerClient
 	if n < 0 || n > b.MaxReservationsPerClient {
-		return InvariantFailure
+		return n, InvariantFailure
 	}
 	if n == b.MaxReservationsPerClient {
-		return MaxReservationsExceeded
+		return n, &LimitExceededError{ClientID: c, Limit: b.MaxReservationsPerClient}
+	}
+	if n == 0 && !b.admitClient() {
+		b.Overloaded.Inc()
+		return n, ReservationsOverloaded
+	}
+	s.resByClient[c] = n + 1
+	b.renewLocked(s, c)
+	return n + 1, nil
+}
+
+// renewLocked extends the lease of c, if leases are enabled. s.mu must be held.
+func (b *UniformlyBoundedClientReserver) renewLocked(s *reserverShard, c core.ClientID) {
+	if b.LeaseTTL > 0 {
+		s.leases[c] = clock.Or(b.Clock).Now().Add(b.LeaseTTL)
+	}
+}
+
+// RenewReservation extends the lease on the reservations held by the given
+// client by LeaseTTL. Live connections should renew well within LeaseTTL.
+// If the client holds no reservations, e.g. because its lease has already
+// lapsed, NoReservationExists will be returned.
+func (b *UniformlyBoundedClientReserver) RenewReservation(ctx context.Context, c core.ClientID) error {
+	s := b.shard(c)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.resByClient[c] == 0 {
+		return NoReservationExists
 	}
-	b.resByClient[c] = n + 1
+	b.renewLocked(s, c)
 	return nil
 }
 
+// SweepExpiredLeases reclaims all reservations of clients whose lease has
+// lapsed, and returns the number of reservations reclaimed. It does nothing
+// if LeaseTTL is not positive.
+func (b *UniformlyBoundedClientReserver) SweepExpiredLeases() int64 {
+	if b.LeaseTTL <= 0 {
+		return 0
+	}
+	now := clock.Or(b.Clock).Now()
+	var reclaimed int64
+	for i := range b.shards {
+		s := &b.shards[i]
+		s.mu.Lock()
+		for c, expiry := range s.leases {
+			if now.Before(expiry) {
+				continue
+			}
+			reclaimed += s.resByClient[c]
+			delete(s.resByClient, c)
+			delete(s.leases, c)
+			atomic.AddInt64(&b.clients, -1)
+		}
+		s.mu.Unlock()
+	}
+	b.Expired.Add(reclaimed)
+	return reclaimed
+}
+
+// StartLeaseSweeper starts a goroutine that calls SweepExpiredLeases once
+// per interval. The returned stop function stops the goroutine.
+func (b *UniformlyBoundedClientReserver) StartLeaseSweeper(interval time.Duration) (stop func()) {
+	ticker := clock.Or(b.Clock).NewTicker(interval)
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		for {
+			select {
+			case <-ticker.C():
+				b.SweepExpiredLeases()
+			case <-done:
+				return
+			}
+		}
+	}()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			ticker.Stop()
+			close(done)
+			<-stopped
+		})
+	}
+}
+
+// admitClient counts a client that is about to acquire its first
+// reservation, and reports whether there is room for it.
+func (b *UniformlyBoundedClientReserver) admitClient() bool {
+	clients := atomic.AddInt64(&b.clients, 1)
+	if b.MaxConcurrentClients > 0 && clients > b.MaxConcurrentClients {
+		atomic.AddInt64(&b.clients, -1)
+		return false
+	}
+	return true
+}
+
 // ReleaseReservation releases a reservation that was previously acquired
 // by TryReserve. If a caller has incorrectly attempted to release a
 // reservation that does not exist, NoReservationExists will be returned.
 func (b *UniformlyBoundedClientReserver) ReleaseReservation(ctx context.Context, c core.ClientID) error {
-	b.mu.Lock()
-	defer b.mu.Unlock()
-	n := b.resByClient[c]
+	s := b.shard(c)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := s.resByClient[c]
 	// check invariant 0 <= n <= MaxReservationsPerClient
 	if n < 0 || n > b.MaxReservationsPerClient {
 		return InvariantFailure
@@ -109,9 +307,45 @@ func (b *UniformlyBoundedClientReserver) ReleaseReservation(ctx context.Context,
 	// each acquire and release a small number of reservations, the memory
 	// required for our map will be unbounded.
 	if n == 0 {
-		delete(b.resByClient, c)
+		delete(s.resByClient, c)
+		delete(s.leases, c)
+		atomic.AddInt64(&b.clients, -1)
 	} else {
-		b.resByClient[c] = n
+		s.resByClient[c] = n
 	}
 	return nil
 }
+
+// Reservations returns a snapshot of the reservations held by each client
+// that currently holds at least one reservation.
+//
+// Shards are visited one at a time, so the snapshot is not atomic across
+// clients, but it is consistent for each client.
+func (b *UniformlyBoundedClientReserver) Reservations() []ClientReservations {
+	var result []ClientReservations
+	for i := range b.shards {
+		s := &b.shards[i]
+		s.mu.Lock()
+		for c, n := range s.resByClient {
+			result = append(result, ClientReservations{
+				ClientID:     c,
+				Reservations: n,
+				Limit:        b.MaxReservationsPerClient,
+			})
+		}
+		s.mu.Unlock()
+	}
+	return result
+}
+
+// ClientReservations returns the reservations held by client c, which may
+// be none.
+func (b *UniformlyBoundedClientReserver) ClientReservations(c core.ClientID) ClientReservations {
+	s := b.shard(c)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return ClientReservations{ClientID: c, Reservations: s.resByClient[c], Limit: b.MaxReservationsPerClient}
+}
+
+var _ core.ClientReserver = (*UniformlyBoundedClientReserver)(nil)     // type check
+var _ core.ReservationRenewer = (*UniformlyBoundedClientReserver)(nil) // type check
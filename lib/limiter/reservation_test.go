@@ -2,9 +2,12 @@ package limiter
 
 import (
 	"context"
+	"errors"
 	"github.com/stretchr/testify/require"
 	"sync"
+	"tcplb/lib/clock"
 	"tcplb/lib/core"
+	"tcplb/lib/metrics"
 	"testing"
 	"time"
 )
@@ -14,10 +17,13 @@ func DummyClientID(key string) core.ClientID {
 }
 
 func requireAllCountsZero(t *testing.T, r *UniformlyBoundedClientReserver) {
-	r.mu.Lock()
-	defer r.mu.Unlock()
-	for c, m := range r.resByClient {
-		require.Equal(t, int64(0), m, c)
+	for i := range r.shards {
+		s := &r.shards[i]
+		s.mu.Lock()
+		for c, m := range s.resByClient {
+			require.Equal(t, int64(0), m, c)
+		}
+		s.mu.Unlock()
 	}
 }
 
@@ -49,7 +55,9 @@ func TestUniformlyBoundedClientReserverReleasesMapItems(t *testing.T) {
 	err = rsvr.ReleaseReservation(ctx, alice)
 	require.NoError(t, err)
 
-	require.Zero(t, len(rsvr.resByClient))
+	for i := range rsvr.shards {
+		require.Zero(t, len(rsvr.shards[i].resByClient))
+	}
 }
 
 func TestUniformlyBoundedClientReserverSingleSequentialClient(t *testing.T) {
@@ -71,7 +79,7 @@ func TestUniformlyBoundedClientReserverSingleSequentialClient(t *testing.T) {
 	require.NoError(t, err)
 
 	err = rsvr.TryReserve(ctx, alice)
-	require.Equal(t, MaxReservationsExceeded, err)
+	require.ErrorIs(t, err, MaxReservationsExceeded)
 
 	err = rsvr.ReleaseReservation(ctx, alice)
 	require.NoError(t, err)
@@ -120,13 +128,13 @@ func TestUniformlyBoundedClientReserverMultipleSequentialClients(t *testing.T) {
 	require.NoError(t, err)
 
 	err = rsvr.TryReserve(ctx, alice)
-	require.Equal(t, MaxReservationsExceeded, err)
+	require.ErrorIs(t, err, MaxReservationsExceeded)
 
 	err = rsvr.ReleaseReservation(ctx, alice)
 	require.NoError(t, err)
 
 	err = rsvr.TryReserve(ctx, bob)
-	require.Equal(t, MaxReservationsExceeded, err)
+	require.ErrorIs(t, err, MaxReservationsExceeded)
 
 	err = rsvr.ReleaseReservation(ctx, alice)
 	require.NoError(t, err)
@@ -186,10 +194,10 @@ func TestUniformlyBoundedClientReserverConcurrent(t *testing.T) {
 
 		for i := int64(0); i < iters; i++ {
 			err := rsvr.TryReserve(ctx, c)
-			switch err {
-			case nil:
+			switch {
+			case err == nil:
 				s.Reserved += 1
-			case MaxReservationsExceeded:
+			case errors.Is(err, MaxReservationsExceeded):
 				s.Limited += 1
 			default:
 				s.Errors += 1
@@ -247,3 +255,139 @@ func TestUniformlyBoundedClientReserverConcurrent(t *testing.T) {
 		require.LessOrEqual(t, successfulAttemptsLowerBound, aggStatsByClient[c].Reserved)
 	}
 }
+
+func TestUniformlyBoundedClientReserverReservations(t *testing.T) {
+	rsvr := NewUniformlyBoundedClientReserver(3)
+	alice := DummyClientID("alice")
+	bob := DummyClientID("bob")
+	ctx := context.Background()
+
+	require.Empty(t, rsvr.Reservations())
+	require.NoError(t, rsvr.TryReserve(ctx, alice))
+	require.NoError(t, rsvr.TryReserve(ctx, alice))
+	require.NoError(t, rsvr.TryReserve(ctx, bob))
+	require.NoError(t, rsvr.ReleaseReservation(ctx, bob))
+
+	require.Equal(t, []ClientReservations{{ClientID: alice, Reservations: 2, Limit: 3}}, rsvr.Reservations())
+	require.Equal(t, ClientReservations{ClientID: alice, Reservations: 2, Limit: 3}, rsvr.ClientReservations(alice))
+	require.Equal(t, ClientReservations{ClientID: bob, Reservations: 0, Limit: 3}, rsvr.ClientReservations(bob))
+}
+
+func TestUniformlyBoundedClientReserverMaxConcurrentClients(t *testing.T) {
+	rsvr := NewUniformlyBoundedClientReserver(2)
+	rsvr.MaxConcurrentClients = 2
+	rsvr.Overloaded = metrics.NewRegistry().Counter("overloaded")
+	ctx := context.Background()
+	alice := DummyClientID("alice")
+	bob := DummyClientID("bob")
+	carol := DummyClientID("carol")
+
+	require.NoError(t, rsvr.TryReserve(ctx, alice))
+	require.NoError(t, rsvr.TryReserve(ctx, bob))
+
+	// Clients already holding reservations may take more, up to their limit.
+	require.NoError(t, rsvr.TryReserve(ctx, alice))
+
+	// No further clients may be tracked.
+	err := rsvr.TryReserve(ctx, carol)
+	require.ErrorIs(t, err, ReservationsOverloaded)
+	require.ErrorIs(t, err, core.ReserverOverloaded)
+	require.Equal(t, int64(1), rsvr.Overloaded.Value())
+
+	// Once a client releases all of its reservations, another may take its place.
+	require.NoError(t, rsvr.ReleaseReservation(ctx, bob))
+	require.NoError(t, rsvr.TryReserve(ctx, carol))
+	require.ErrorIs(t, rsvr.TryReserve(ctx, bob), ReservationsOverloaded)
+}
+
+func TestUniformlyBoundedClientReserverLeases(t *testing.T) {
+	c := clock.NewFake(time.Unix(1000, 0))
+	rsvr := NewUniformlyBoundedClientReserver(2)
+	rsvr.MaxConcurrentClients = 2
+	rsvr.LeaseTTL = time.Minute
+	rsvr.Expired = metrics.NewRegistry().Counter("expired")
+	rsvr.Clock = c
+	ctx := context.Background()
+	alice := DummyClientID("alice")
+	bob := DummyClientID("bob")
+
+	require.ErrorIs(t, rsvr.RenewReservation(ctx, alice), NoReservationExists)
+	require.NoError(t, rsvr.TryReserve(ctx, alice))
+	require.NoError(t, rsvr.TryReserve(ctx, alice))
+	require.NoError(t, rsvr.TryReserve(ctx, bob))
+
+	// Bob renews his lease, but alice's reservations leaked and lapse.
+	c.Advance(40 * time.Second)
+	require.NoError(t, rsvr.RenewReservation(ctx, bob))
+	c.Advance(40 * time.Second)
+	require.Equal(t, int64(2), rsvr.SweepExpiredLeases())
+	require.Equal(t, int64(2), rsvr.Expired.Value())
+	require.ErrorIs(t, rsvr.ReleaseReservation(ctx, alice), NoReservationExists)
+
+	// Alice's quota, and her place among the concurrent clients, are reclaimed.
+	require.NoError(t, rsvr.TryReserve(ctx, alice))
+	require.NoError(t, rsvr.TryReserve(ctx, alice))
+	require.NoError(t, rsvr.ReleaseReservation(ctx, bob))
+	require.Equal(t, int64(0), rsvr.SweepExpiredLeases())
+	require.Len(t, rsvr.Reservations(), 1)
+}
+
+func TestUniformlyBoundedClientReserverLeaseSweeper(t *testing.T) {
+	c := clock.NewFake(time.Unix(1000, 0))
+	rsvr := NewUniformlyBoundedClientReserver(1)
+	rsvr.LeaseTTL = time.Minute
+	rsvr.Expired = metrics.NewRegistry().Counter("expired")
+	rsvr.Clock = c
+	require.NoError(t, rsvr.TryReserve(context.Background(), DummyClientID("alice")))
+
+	stop := rsvr.StartLeaseSweeper(30 * time.Second)
+	defer stop()
+	c.Advance(time.Minute)
+	require.Eventually(t, func() bool { return rsvr.Expired.Value() == 1 }, 5*time.Second, time.Millisecond)
+	require.Empty(t, rsvr.Reservations())
+}
+
+// recordingWarner is a BudgetWarner that records the warnings it is given.
+type recordingWarner struct {
+	mu       sync.Mutex
+	warnings []core.BudgetWarning
+}
+
+func (w *recordingWarner) WarnBudget(ctx context.Context, warning core.BudgetWarning) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.warnings = append(w.warnings, warning)
+}
+
+func TestUniformlyBoundedClientReserverWarnings(t *testing.T) {
+	rsvr := NewUniformlyBoundedClientReserver(5)
+	warner := &recordingWarner{}
+	rsvr.WarnFraction = 0.8
+	rsvr.Warner = warner
+	alice := DummyClientID("alice")
+	ctx := context.Background()
+
+	for i := 0; i < 3; i++ {
+		require.NoError(t, rsvr.TryReserve(ctx, alice))
+	}
+	require.Empty(t, warner.warnings)
+	require.NoError(t, rsvr.TryReserve(ctx, alice))
+	expected := core.BudgetWarning{ClientID: alice, Budget: core.BudgetReservations, Usage: 4, Limit: 5}
+	require.Equal(t, []core.BudgetWarning{expected}, warner.warnings)
+
+	// Clients are warned once each time they reach the threshold.
+	require.NoError(t, rsvr.TryReserve(ctx, alice))
+	require.ErrorIs(t, rsvr.TryReserve(ctx, alice), MaxReservationsExceeded)
+	require.Len(t, warner.warnings, 1)
+	require.NoError(t, rsvr.ReleaseReservation(ctx, alice))
+	require.NoError(t, rsvr.ReleaseReservation(ctx, alice))
+	require.NoError(t, rsvr.TryReserve(ctx, alice))
+	require.Equal(t, []core.BudgetWarning{expected, expected}, warner.warnings)
+
+	// Clients whose threshold is their limit are not warned.
+	single := NewUniformlyBoundedClientReserver(1)
+	single.WarnFraction = 0.8
+	single.Warner = &recordingWarner{}
+	require.NoError(t, single.TryReserve(ctx, alice))
+	require.Empty(t, single.Warner.(*recordingWarner).warnings)
+}
@@ -0,0 +1,225 @@
+package limiter
+
+import (
+	"container/list"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"tcplb/lib/core"
+	"tcplb/lib/metrics"
+	"time"
+)
+
+// OverloadSignal reports if the server is overloaded, e.g. short of CPU.
+//
+// Multiple goroutines may invoke methods on an OverloadSignal simultaneously.
+type OverloadSignal interface {
+	Overloaded() bool
+}
+
+// PriorityShedder is a core.LoadShedder that admits at most
+// MaxConnections client connections at once, and, while Overload signals
+// overload, admits no more connections than it already has. Beyond either
+// limit, a connection is admitted only in place of one of lower priority,
+// which is shed: the most recently admitted connection of the lowest
+// priority, as it has likely done the least work. Otherwise the connection
+// is not admitted.
+//
+// Multiple goroutines may invoke methods on a PriorityShedder
+// simultaneously.
+type PriorityShedder struct {
+	MaxConnections int            // MaxConnections bounds the connections admitted at once. If not positive, there is no bound.
+	Overload       OverloadSignal // Overload is optional. If nil, the server is never overloaded.
+	Active         *metrics.Gauge // Active is optional. If set, it tracks the connections admitted.
+
+	mu         sync.Mutex         // mu guards byPriority and n.
+	byPriority map[int]*list.List // byPriority holds the admitted connections of each priority, in the order admitted.
+	n          int
+}
+
+// shedEntry is a connection admitted by a PriorityShedder.
+type shedEntry struct {
+	priority int
+	shed     func()
+	element  *list.Element
+}
+
+// NewPriorityShedder returns a PriorityShedder that admits at most
+// maxConnections connections at once, and sheds connections of lower
+// priority while overload, which is optional, signals overload.
+func NewPriorityShedder(maxConnections int, overload OverloadSignal) *PriorityShedder {
+	return &PriorityShedder{MaxConnections: maxConnections, Overload: overload, byPriority: make(map[int]*list.List)}
+}
+
+func (s *PriorityShedder) Admit(priority int, shed func()) (func(), error) {
+	s.mu.Lock()
+	full := s.MaxConnections > 0 && s.n >= s.MaxConnections
+	overloaded := s.Overload != nil && s.Overload.Overloaded()
+	var victim *shedEntry
+	if full || overloaded {
+		victim = s.lowest(priority)
+		if victim == nil {
+			s.mu.Unlock()
+			return nil, core.ServerOverloaded
+		}
+		s.remove(victim)
+	}
+	e := &shedEntry{priority: priority, shed: shed}
+	s.add(e)
+	s.mu.Unlock()
+
+	if victim != nil {
+		victim.shed()
+	}
+	var once sync.Once
+	release := func() {
+		once.Do(func() {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			// Shed entries were removed already.
+			if e.element != nil {
+				s.remove(e)
+			}
+		})
+	}
+	return release, nil
+}
+
+// lowest returns the most recently admitted connection of the lowest
+// priority below the given priority, or nil if there is none.
+func (s *PriorityShedder) lowest(below int) *shedEntry {
+	var victims *list.List
+	victimPriority := below
+	for p, l := range s.byPriority {
+		if p < victimPriority && l.Len() > 0 {
+			victims, victimPriority = l, p
+		}
+	}
+	if victims == nil {
+		return nil
+	}
+	return victims.Back().Value.(*shedEntry)
+}
+
+func (s *PriorityShedder) add(e *shedEntry) {
+	l, ok := s.byPriority[e.priority]
+	if !ok {
+		l = list.New()
+		s.byPriority[e.priority] = l
+	}
+	e.element = l.PushBack(e)
+	s.n++
+	s.Active.Inc()
+}
+
+func (s *PriorityShedder) remove(e *shedEntry) {
+	s.byPriority[e.priority].Remove(e.element)
+	e.element = nil
+	s.n--
+	s.Active.Dec()
+}
+
+var _ core.LoadShedder = (*PriorityShedder)(nil) // type check
+
+// CPUOverloadSignal is an OverloadSignal that signals overload while the
+// CPU utilisation of this process exceeds Threshold, as a fraction of all
+// CPUs. Utilisation is measured over each interval between samples, taken
+// by Sample.
+//
+// Multiple goroutines may invoke methods on a CPUOverloadSignal
+// simultaneously.
+type CPUOverloadSignal struct {
+	Threshold float64
+	Percent   *metrics.Gauge // Percent is optional. If set, it tracks the utilisation measured by the last Sample, in percent.
+
+	overloaded  int32 // overloaded is 1 while overloaded, accessed atomically.
+	utilisation atomic.Value
+
+	mu       sync.Mutex // mu guards lastCPU and lastWall.
+	lastCPU  time.Duration
+	lastWall time.Time
+
+	cpuTime func() (time.Duration, error)
+	now     func() time.Time
+	numCPU  int
+}
+
+// NewCPUOverloadSignal returns a CPUOverloadSignal with the given threshold,
+// e.g. 0.9 to signal overload while this process uses more than 90% of all
+// CPUs. It returns an error if the CPU time of the process cannot be
+// measured on this platform.
+func NewCPUOverloadSignal(threshold float64) (*CPUOverloadSignal, error) {
+	s := &CPUOverloadSignal{Threshold: threshold, cpuTime: processCPUTime, now: time.Now, numCPU: runtime.NumCPU()}
+	cpu, err := s.cpuTime()
+	if err != nil {
+		return nil, err
+	}
+	s.lastCPU, s.lastWall = cpu, s.now()
+	s.utilisation.Store(float64(0))
+	return s, nil
+}
+
+func (s *CPUOverloadSignal) Overloaded() bool {
+	return atomic.LoadInt32(&s.overloaded) == 1
+}
+
+// Utilisation returns the CPU utilisation of this process measured by the
+// last Sample, as a fraction of all CPUs.
+func (s *CPUOverloadSignal) Utilisation() float64 {
+	return s.utilisation.Load().(float64)
+}
+
+// Sample measures the CPU utilisation of this process since the last
+// Sample, and updates whether overload is signalled.
+func (s *CPUOverloadSignal) Sample() error {
+	cpu, err := s.cpuTime()
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.now()
+	wall := now.Sub(s.lastWall)
+	if wall <= 0 {
+		return nil
+	}
+	utilisation := float64(cpu-s.lastCPU) / float64(wall) / float64(s.numCPU)
+	s.lastCPU, s.lastWall = cpu, now
+	s.utilisation.Store(utilisation)
+	s.Percent.Set(int64(utilisation * 100))
+	var overloaded int32
+	if utilisation > s.Threshold {
+		overloaded = 1
+	}
+	atomic.StoreInt32(&s.overloaded, overloaded)
+	return nil
+}
+
+// StartSampler starts a goroutine that calls Sample once per interval. The
+// returned stop function stops the goroutine.
+func (s *CPUOverloadSignal) StartSampler(interval time.Duration) (stop func()) {
+	ticker := time.NewTicker(interval)
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		for {
+			select {
+			case <-ticker.C:
+				_ = s.Sample()
+			case <-done:
+				return
+			}
+		}
+	}()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			ticker.Stop()
+			close(done)
+			<-stopped
+		})
+	}
+}
+
+var _ OverloadSignal = (*CPUOverloadSignal)(nil) // type check
@@ -0,0 +1,101 @@
+package limiter
+
+import (
+	"github.com/stretchr/testify/require"
+	"tcplb/lib/core"
+	"tcplb/lib/metrics"
+	"testing"
+	"time"
+)
+
+// fixedOverloadSignal signals overload while it is true.
+type fixedOverloadSignal bool
+
+func (s *fixedOverloadSignal) Overloaded() bool {
+	return bool(*s)
+}
+
+func TestPriorityShedder(t *testing.T) {
+	overload := new(fixedOverloadSignal)
+	s := NewPriorityShedder(3, overload)
+	s.Active = metrics.NewRegistry().Gauge("active")
+	var shed []string
+	admit := func(name string, priority int) (func(), error) {
+		return s.Admit(priority, func() { shed = append(shed, name) })
+	}
+
+	releaseLow1, err := admit("low1", 0)
+	require.NoError(t, err)
+	_, err = admit("low2", 0)
+	require.NoError(t, err)
+	releaseMid, err := admit("mid", 1)
+	require.NoError(t, err)
+	require.Equal(t, int64(3), s.Active.Value())
+
+	// At capacity, connections are admitted only in place of ones of lower
+	// priority, the most recently admitted first.
+	_, err = admit("low3", 0)
+	require.ErrorIs(t, err, core.ServerOverloaded)
+	_, err = admit("high1", 2)
+	require.NoError(t, err)
+	require.Equal(t, []string{"low2"}, shed)
+	_, err = admit("high2", 2)
+	require.NoError(t, err)
+	require.Equal(t, []string{"low2", "low1"}, shed)
+	require.Equal(t, int64(3), s.Active.Value())
+
+	// Releasing a shed connection changes nothing.
+	releaseLow1()
+	require.Equal(t, int64(3), s.Active.Value())
+	_, err = admit("mid2", 1)
+	require.ErrorIs(t, err, core.ServerOverloaded)
+
+	// Below capacity, connections of any priority are admitted, unless
+	// overloaded.
+	releaseMid()
+	releaseMid()
+	require.Equal(t, int64(2), s.Active.Value())
+	*overload = true
+	_, err = admit("low4", 0)
+	require.ErrorIs(t, err, core.ServerOverloaded)
+	*overload = false
+	_, err = admit("low4", 0)
+	require.NoError(t, err)
+	*overload = true
+	_, err = admit("mid3", 1)
+	require.NoError(t, err)
+	require.Equal(t, []string{"low2", "low1", "low4"}, shed)
+}
+
+func TestCPUOverloadSignal(t *testing.T) {
+	now := time.Unix(0, 0)
+	cpu := time.Duration(0)
+	s := &CPUOverloadSignal{
+		Threshold: 0.5,
+		Percent:   metrics.NewRegistry().Gauge("cpu"),
+		cpuTime:   func() (time.Duration, error) { return cpu, nil },
+		now:       func() time.Time { return now },
+		numCPU:    2,
+		lastWall:  now,
+	}
+	s.utilisation.Store(float64(0))
+	require.False(t, s.Overloaded())
+
+	// Utilisation is a fraction of all CPUs.
+	now = now.Add(time.Second)
+	cpu += 1500 * time.Millisecond
+	require.NoError(t, s.Sample())
+	require.Equal(t, 0.75, s.Utilisation())
+	require.Equal(t, int64(75), s.Percent.Value())
+	require.True(t, s.Overloaded())
+
+	now = now.Add(time.Second)
+	cpu += 500 * time.Millisecond
+	require.NoError(t, s.Sample())
+	require.Equal(t, 0.25, s.Utilisation())
+	require.False(t, s.Overloaded())
+
+	// The CPU time of this process can be measured.
+	_, err := NewCPUOverloadSignal(0.9)
+	require.NoError(t, err)
+}
@@ -0,0 +1,336 @@
+// Package loadgen generates load against a tcplb server, to validate the
+// behaviour of limiters, policies and shutdown under realistic load, and
+// to soak test the server.
+//
+// A Generator opens many concurrent client connections, over mutual TLS or
+// plain TCP, and sends messages of a given size over each at a given rate.
+// It expects the server to forward to an upstream that echoes what it
+// reads, so that it can measure the round trip latency of each message. If
+// a connection fails, it is counted as an error and dialed again.
+package loadgen
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// dialBackoff is how long a connection waits to dial again after failing
+// to dial.
+const dialBackoff = 100 * time.Millisecond
+
+// Phase is the step of a connection's life during which an error occurred.
+type Phase string
+
+const (
+	PhaseDial  Phase = "dial"  // PhaseDial is dialing the server, including the TLS handshake.
+	PhaseWrite Phase = "write" // PhaseWrite is sending a message.
+	PhaseRead  Phase = "read"  // PhaseRead is receiving the echo of a message.
+	PhaseEcho  Phase = "echo"  // PhaseEcho is checking that the echo matches the message.
+)
+
+// EchoMismatch is returned when the data echoed back is not the message
+// that was sent.
+var EchoMismatch = errors.New("echo does not match message")
+
+// Config configures a Generator.
+type Config struct {
+	Network     string        // Network is the network of Address. Defaults to "tcp".
+	Address     string        // Address is the address of the server.
+	TLS         *tls.Config   // TLS is optional. If set, connections use TLS, presenting its certificate to authenticate.
+	Connections int           // Connections is the number of concurrent connections to keep open. Defaults to 1.
+	MessageSize int           // MessageSize is the size of each message. Defaults to 64.
+	Rate        float64       // Rate is the messages per second sent over each connection. If not positive, messages are sent back to back.
+	Duration    time.Duration // Duration is how long to generate load for. If not positive, load is generated until the context is done.
+	Timeout     time.Duration // Timeout bounds each dial and each round trip. If not positive, they are unbounded.
+}
+
+// Generator generates load as configured by its Config.
+type Generator struct {
+	Config Config
+
+	mu      sync.Mutex // mu guards the fields below
+	dials   []time.Duration
+	trips   []time.Duration
+	errs    map[Phase]int64
+	samples map[Phase]string
+	bytes   int64
+}
+
+// Run generates load until the configured Duration has passed, or ctx is
+// done, then returns a Report of what happened.
+func (g *Generator) Run(ctx context.Context) Report {
+	cfg := g.Config
+	if cfg.Network == "" {
+		cfg.Network = "tcp"
+	}
+	if cfg.Connections <= 0 {
+		cfg.Connections = 1
+	}
+	if cfg.MessageSize <= 0 {
+		cfg.MessageSize = 64
+	}
+	if cfg.Duration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, cfg.Duration)
+		defer cancel()
+	}
+
+	g.mu.Lock()
+	g.dials, g.trips, g.bytes = nil, nil, 0
+	g.errs = make(map[Phase]int64)
+	g.samples = make(map[Phase]string)
+	g.mu.Unlock()
+
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < cfg.Connections; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			g.runConnection(ctx, cfg, i)
+		}(i)
+	}
+	wg.Wait()
+	return g.report(cfg, time.Since(start))
+}
+
+// runConnection keeps a connection open until ctx is done, sending messages
+// over it and dialing again whenever it fails.
+func (g *Generator) runConnection(ctx context.Context, cfg Config, i int) {
+	message := bytes.Repeat([]byte{byte('a' + i%26)}, cfg.MessageSize)
+	echo := make([]byte, cfg.MessageSize)
+	var tick <-chan time.Time
+	if cfg.Rate > 0 {
+		ticker := time.NewTicker(time.Duration(float64(time.Second) / cfg.Rate))
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	wait := func() bool {
+		if tick == nil {
+			return ctx.Err() == nil
+		}
+		select {
+		case <-tick:
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}
+
+	for ctx.Err() == nil {
+		conn, err := g.dial(ctx, cfg)
+		if err != nil {
+			if !stopped(ctx) {
+				g.fail(PhaseDial, err)
+				// Back off, so as not to spin while the server refuses connections.
+				backoff := time.NewTimer(dialBackoff)
+				select {
+				case <-backoff.C:
+				case <-ctx.Done():
+					backoff.Stop()
+				}
+			}
+			continue
+		}
+		for wait() {
+			if err := g.roundTrip(ctx, cfg, conn, message, echo); err != nil {
+				break
+			}
+		}
+		_ = conn.Close()
+	}
+}
+
+func (g *Generator) dial(ctx context.Context, cfg Config) (net.Conn, error) {
+	if cfg.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, cfg.Timeout)
+		defer cancel()
+	}
+	start := time.Now()
+	var conn net.Conn
+	var err error
+	if cfg.TLS != nil {
+		dialer := &tls.Dialer{Config: cfg.TLS}
+		conn, err = dialer.DialContext(ctx, cfg.Network, cfg.Address)
+	} else {
+		var dialer net.Dialer
+		conn, err = dialer.DialContext(ctx, cfg.Network, cfg.Address)
+	}
+	if err != nil {
+		return nil, err
+	}
+	g.mu.Lock()
+	g.dials = append(g.dials, time.Since(start))
+	g.mu.Unlock()
+	return conn, nil
+}
+
+// roundTrip sends message over conn and reads back its echo. Failures other
+// than those caused by ctx stopping are recorded, and returned.
+func (g *Generator) roundTrip(ctx context.Context, cfg Config, conn net.Conn, message, echo []byte) error {
+	start := time.Now()
+	deadline, _ := ctx.Deadline()
+	if cfg.Timeout > 0 && (deadline.IsZero() || start.Add(cfg.Timeout).Before(deadline)) {
+		deadline = start.Add(cfg.Timeout)
+	}
+	_ = conn.SetDeadline(deadline)
+	phase := PhaseWrite
+	_, err := conn.Write(message)
+	if err == nil {
+		phase = PhaseRead
+		_, err = io.ReadFull(conn, echo)
+	}
+	if err == nil && !bytes.Equal(message, echo) {
+		phase, err = PhaseEcho, EchoMismatch
+	}
+	if err != nil {
+		if !stopped(ctx) {
+			g.fail(phase, err)
+		}
+		return err
+	}
+	g.mu.Lock()
+	g.trips = append(g.trips, time.Since(start))
+	g.bytes += int64(len(message))
+	g.mu.Unlock()
+	return nil
+}
+
+// stopped reports whether ctx is done, or about to be as its deadline has
+// passed. Operations bounded by the deadline of ctx may fail before ctx
+// reports that it is done, without being failures of the server.
+func stopped(ctx context.Context) bool {
+	if ctx.Err() != nil {
+		return true
+	}
+	deadline, ok := ctx.Deadline()
+	return ok && !time.Now().Before(deadline)
+}
+
+func (g *Generator) fail(phase Phase, err error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.errs[phase]++
+	if _, ok := g.samples[phase]; !ok {
+		g.samples[phase] = err.Error()
+	}
+}
+
+// Latencies summarises a distribution of latencies.
+type Latencies struct {
+	Count int           `json:"count"`
+	P50   time.Duration `json:"p50_ns"`
+	P90   time.Duration `json:"p90_ns"`
+	P99   time.Duration `json:"p99_ns"`
+	Max   time.Duration `json:"max_ns"`
+}
+
+// summarise returns the Latencies of samples, sorting them.
+func summarise(samples []time.Duration) Latencies {
+	if len(samples) == 0 {
+		return Latencies{}
+	}
+	sort.Slice(samples, func(i, j int) bool { return samples[i] < samples[j] })
+	percentile := func(p float64) time.Duration {
+		// Nearest rank.
+		rank := int(math.Ceil(p*float64(len(samples)))) - 1
+		if rank < 0 {
+			rank = 0
+		}
+		return samples[rank]
+	}
+	return Latencies{
+		Count: len(samples),
+		P50:   percentile(0.50),
+		P90:   percentile(0.90),
+		P99:   percentile(0.99),
+		Max:   samples[len(samples)-1],
+	}
+}
+
+// Report is the outcome of a Run.
+type Report struct {
+	Connections int              `json:"connections"`
+	MessageSize int              `json:"message_size"`
+	Duration    time.Duration    `json:"duration_ns"`
+	Bytes       int64            `json:"bytes"`             // Bytes is the total size of the messages echoed back.
+	Dials       Latencies        `json:"dials"`             // Dials is the latency of successful dials, including TLS handshakes.
+	RoundTrips  Latencies        `json:"round_trips"`       // RoundTrips is the latency of messages echoed back.
+	Errors      map[Phase]int64  `json:"errors"`            // Errors counts failures by Phase.
+	Samples     map[Phase]string `json:"samples,omitempty"` // Samples holds the first error of each Phase.
+}
+
+func (g *Generator) report(cfg Config, elapsed time.Duration) Report {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return Report{
+		Connections: cfg.Connections,
+		MessageSize: cfg.MessageSize,
+		Duration:    elapsed,
+		Bytes:       g.bytes,
+		Dials:       summarise(g.dials),
+		RoundTrips:  summarise(g.trips),
+		Errors:      g.errs,
+		Samples:     g.samples,
+	}
+}
+
+// ErrorCount returns the number of failures in all phases.
+func (r Report) ErrorCount() int64 {
+	var n int64
+	for _, count := range r.Errors {
+		n += count
+	}
+	return n
+}
+
+// ErrorRate returns the fraction of attempted dials and round trips that
+// failed.
+func (r Report) ErrorRate() float64 {
+	failed := r.ErrorCount()
+	attempts := int64(r.Dials.Count+r.RoundTrips.Count) + failed
+	if attempts == 0 {
+		return 0
+	}
+	return float64(failed) / float64(attempts)
+}
+
+// WriteText writes r to w in a form for people to read.
+func (r Report) WriteText(w io.Writer) error {
+	seconds := r.Duration.Seconds()
+	if seconds <= 0 {
+		seconds = 1
+	}
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "connections:  %d\n", r.Connections)
+	fmt.Fprintf(&buf, "message size: %d bytes\n", r.MessageSize)
+	fmt.Fprintf(&buf, "duration:     %s\n", r.Duration.Round(time.Millisecond))
+	fmt.Fprintf(&buf, "messages:     %d (%.1f/s, %.1f KiB/s)\n", r.RoundTrips.Count, float64(r.RoundTrips.Count)/seconds, float64(r.Bytes)/1024/seconds)
+	fmt.Fprintf(&buf, "errors:       %d (%.2f%%)\n", r.ErrorCount(), 100*r.ErrorRate())
+	phases := make([]string, 0, len(r.Errors))
+	for phase := range r.Errors {
+		phases = append(phases, string(phase))
+	}
+	sort.Strings(phases)
+	for _, phase := range phases {
+		fmt.Fprintf(&buf, "  %-6s %d, e.g. %s\n", phase, r.Errors[Phase(phase)], r.Samples[Phase(phase)])
+	}
+	for _, l := range []struct {
+		name string
+		Latencies
+	}{{"dial", r.Dials}, {"round trip", r.RoundTrips}} {
+		fmt.Fprintf(&buf, "%-13s p50=%s p90=%s p99=%s max=%s (n=%d)\n", l.name+":", l.P50, l.P90, l.P99, l.Max, l.Count)
+	}
+	_, err := buf.WriteTo(w)
+	return err
+}
@@ -0,0 +1,124 @@
+package loadgen
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"github.com/stretchr/testify/require"
+	"io"
+	"net"
+	"tcplb/lib/testbed"
+	"testing"
+	"time"
+)
+
+// startEchoServer serves each connection accepted from listener with
+// serve, until listener is closed.
+func startEchoServer(t *testing.T, listener net.Listener, serve func(conn net.Conn)) {
+	t.Cleanup(func() { _ = listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				serve(conn)
+			}()
+		}
+	}()
+}
+
+func echo(conn net.Conn) {
+	_, _ = io.Copy(conn, conn)
+}
+
+func TestGeneratorOverMutualTLS(t *testing.T) {
+	tb := testbed.New(t)
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", tb.ServerTLSConfig(tb.Server(t, "tcplb.test")))
+	require.NoError(t, err)
+	startEchoServer(t, listener, echo)
+
+	g := &Generator{Config: Config{
+		Address:     listener.Addr().String(),
+		TLS:         tb.ClientTLSConfig(tb.Client(t, "loadgen")),
+		Connections: 4,
+		MessageSize: 100,
+		Rate:        200,
+		Duration:    200 * time.Millisecond,
+		Timeout:     5 * time.Second,
+	}}
+	report := g.Run(context.Background())
+	require.Zero(t, report.ErrorCount(), report.Samples)
+	require.Equal(t, 4, report.Dials.Count)
+	require.Greater(t, report.RoundTrips.Count, 4)
+	require.Equal(t, int64(report.RoundTrips.Count)*100, report.Bytes)
+	require.LessOrEqual(t, report.RoundTrips.P50, report.RoundTrips.P99)
+	require.LessOrEqual(t, report.RoundTrips.P99, report.RoundTrips.Max)
+
+	var text bytes.Buffer
+	require.NoError(t, report.WriteText(&text))
+	require.Contains(t, text.String(), "errors:       0 (0.00%)")
+}
+
+func TestGeneratorCountsErrors(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	// Each connection echoes one message, then answers the next with
+	// garbage and hangs up.
+	startEchoServer(t, listener, func(conn net.Conn) {
+		buf := make([]byte, 8)
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			return
+		}
+		_, _ = conn.Write(buf)
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			return
+		}
+		_, _ = conn.Write([]byte("garbage!"))
+	})
+
+	g := &Generator{Config: Config{
+		Address:     listener.Addr().String(),
+		MessageSize: 8,
+		Rate:        100,
+		Duration:    200 * time.Millisecond,
+	}}
+	report := g.Run(context.Background())
+	require.Greater(t, report.Errors[PhaseEcho], int64(0))
+	require.Equal(t, EchoMismatch.Error(), report.Samples[PhaseEcho])
+	// Connections are dialed again after failing.
+	require.Greater(t, report.Dials.Count, 1)
+	require.Greater(t, report.ErrorRate(), 0.0)
+	require.Less(t, report.ErrorRate(), 1.0)
+}
+
+func TestGeneratorCountsDialErrors(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	address := listener.Addr().String()
+	require.NoError(t, listener.Close())
+
+	g := &Generator{Config: Config{Address: address, Connections: 2, Duration: 150 * time.Millisecond}}
+	report := g.Run(context.Background())
+	require.Greater(t, report.Errors[PhaseDial], int64(1))
+	require.Zero(t, report.RoundTrips.Count)
+	require.Equal(t, 1.0, report.ErrorRate())
+}
+
+func TestSummarise(t *testing.T) {
+	var samples []time.Duration
+	for i := 100; i > 0; i-- {
+		samples = append(samples, time.Duration(i)*time.Millisecond)
+	}
+	require.Equal(t, Latencies{
+		Count: 100,
+		P50:   50 * time.Millisecond,
+		P90:   90 * time.Millisecond,
+		P99:   99 * time.Millisecond,
+		Max:   100 * time.Millisecond,
+	}, summarise(samples))
+	require.Equal(t, Latencies{}, summarise(nil))
+	require.Equal(t, Latencies{Count: 1, P50: 1, P90: 1, P99: 1, Max: 1}, summarise([]time.Duration{1}))
+}
@@ -0,0 +1,312 @@
+// Package metrics provides simple in-process counters, gauges and histograms,
+// grouped into a Registry that can be published via expvar and inspected
+// over HTTP.
+//
+// All methods of a nil *Counter, *Gauge or *Histogram are no-ops, and a nil
+// *Registry creates nil metrics, so instrumented code need not check whether
+// metrics are enabled.
+package metrics
+
+import (
+	"encoding/json"
+	"math"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+// Counter is a monotonically increasing count.
+//
+// Multiple goroutines may invoke methods on a Counter simultaneously.
+type Counter struct {
+	v int64
+}
+
+// Inc increments the counter by 1.
+func (c *Counter) Inc() {
+	c.Add(1)
+}
+
+// Add increments the counter by n, which should not be negative.
+func (c *Counter) Add(n int64) {
+	if c == nil {
+		return
+	}
+	atomic.AddInt64(&c.v, n)
+}
+
+// Value returns the current count.
+func (c *Counter) Value() int64 {
+	if c == nil {
+		return 0
+	}
+	return atomic.LoadInt64(&c.v)
+}
+
+// Gauge is a value that can go up and down.
+//
+// Multiple goroutines may invoke methods on a Gauge simultaneously.
+type Gauge struct {
+	v int64
+}
+
+// Inc increments the gauge by 1.
+func (g *Gauge) Inc() {
+	g.Add(1)
+}
+
+// Dec decrements the gauge by 1.
+func (g *Gauge) Dec() {
+	g.Add(-1)
+}
+
+// Add adds n to the gauge.
+func (g *Gauge) Add(n int64) {
+	if g == nil {
+		return
+	}
+	atomic.AddInt64(&g.v, n)
+}
+
+// Set sets the gauge to n.
+func (g *Gauge) Set(n int64) {
+	if g == nil {
+		return
+	}
+	atomic.StoreInt64(&g.v, n)
+}
+
+// Value returns the current value of the gauge.
+func (g *Gauge) Value() int64 {
+	if g == nil {
+		return 0
+	}
+	return atomic.LoadInt64(&g.v)
+}
+
+// LatencyBoundsMicros are bucket bounds suited to network latencies, in
+// microseconds, from 100µs to 10s.
+var LatencyBoundsMicros = []int64{
+	100, 250, 500,
+	1000, 2500, 5000,
+	10000, 25000, 50000,
+	100000, 250000, 500000,
+	1000000, 2500000, 5000000,
+	10000000,
+}
+
+// Histogram counts observed values in buckets, each holding the values at
+// most its upper bound and above the bound of the bucket before it. Values
+// above every bound are counted in a final overflow bucket.
+//
+// Multiple goroutines may invoke methods on a Histogram simultaneously.
+type Histogram struct {
+	bounds []int64 // bounds are the ascending upper bounds of the buckets.
+	counts []int64 // counts has a count for each bucket, and the overflow bucket.
+	count  int64
+	sum    int64
+}
+
+// NewHistogram returns an empty Histogram with buckets of the given
+// ascending upper bounds.
+func NewHistogram(bounds []int64) *Histogram {
+	return &Histogram{
+		bounds: append([]int64(nil), bounds...),
+		counts: make([]int64, len(bounds)+1),
+	}
+}
+
+// Observe counts the value v.
+func (h *Histogram) Observe(v int64) {
+	if h == nil {
+		return
+	}
+	i := sort.Search(len(h.bounds), func(i int) bool { return v <= h.bounds[i] })
+	atomic.AddInt64(&h.counts[i], 1)
+	atomic.AddInt64(&h.count, 1)
+	atomic.AddInt64(&h.sum, v)
+}
+
+// Snapshot returns the current counts of the Histogram. Observations made
+// during the Snapshot may be reflected in some of its fields but not
+// others.
+func (h *Histogram) Snapshot() HistogramSnapshot {
+	if h == nil {
+		return HistogramSnapshot{}
+	}
+	s := HistogramSnapshot{
+		Bounds: h.bounds,
+		Counts: make([]int64, len(h.counts)),
+		Count:  atomic.LoadInt64(&h.count),
+		Sum:    atomic.LoadInt64(&h.sum),
+	}
+	for i := range h.counts {
+		s.Counts[i] = atomic.LoadInt64(&h.counts[i])
+	}
+	return s
+}
+
+// HistogramSnapshot holds the counts of a Histogram at a point in time.
+type HistogramSnapshot struct {
+	Bounds []int64 // Bounds are the ascending upper bounds of the buckets.
+	Counts []int64 // Counts has a count for each bucket, then for the overflow bucket.
+	Count  int64   // Count is the number of values observed.
+	Sum    int64   // Sum is the sum of the values observed.
+}
+
+// Quantile returns an upper bound of the q-quantile of the observed values,
+// for q between 0 and 1: the upper bound of the bucket holding it. If it is
+// in the overflow bucket, the largest bound is returned. It reports false
+// if no values have been observed.
+func (s HistogramSnapshot) Quantile(q float64) (int64, bool) {
+	var total int64
+	for _, n := range s.Counts {
+		total += n
+	}
+	if total == 0 || len(s.Bounds) == 0 {
+		return 0, false
+	}
+	rank := int64(math.Ceil(q * float64(total)))
+	if rank < 1 {
+		rank = 1
+	}
+	var seen int64
+	for i, n := range s.Counts[:len(s.Bounds)] {
+		seen += n
+		if seen >= rank {
+			return s.Bounds[i], true
+		}
+	}
+	return s.Bounds[len(s.Bounds)-1], true
+}
+
+// Mean returns the mean of the observed values, or 0 if there are none.
+func (s HistogramSnapshot) Mean() float64 {
+	if s.Count == 0 {
+		return 0
+	}
+	return float64(s.Sum) / float64(s.Count)
+}
+
+// valuer is implemented by all metric types.
+type valuer interface {
+	Value() int64
+}
+
+// histogramField is a valuer of one field of a Histogram, so that each
+// bucket, the count and the sum can be registered as metrics.
+type histogramField struct {
+	h     *Histogram
+	value func(h *Histogram) int64
+}
+
+func (f histogramField) Value() int64 {
+	return f.value(f.h)
+}
+
+// Registry is a named collection of metrics.
+//
+// Registry implements expvar.Var, so it may be published with expvar.Publish.
+//
+// Multiple goroutines may invoke methods on a Registry simultaneously.
+type Registry struct {
+	mu         sync.Mutex
+	metrics    map[string]valuer
+	histograms map[string]*Histogram
+}
+
+// NewRegistry returns a new empty Registry.
+func NewRegistry() *Registry {
+	return &Registry{metrics: make(map[string]valuer), histograms: make(map[string]*Histogram)}
+}
+
+// Counter returns the Counter registered under name, creating it if necessary.
+// If r is nil, a nil *Counter is returned.
+func (r *Registry) Counter(name string) *Counter {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if c, ok := r.metrics[name].(*Counter); ok {
+		return c
+	}
+	c := &Counter{}
+	r.metrics[name] = c
+	return c
+}
+
+// Gauge returns the Gauge registered under name, creating it if necessary.
+// If r is nil, a nil *Gauge is returned.
+func (r *Registry) Gauge(name string) *Gauge {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if g, ok := r.metrics[name].(*Gauge); ok {
+		return g
+	}
+	g := &Gauge{}
+	r.metrics[name] = g
+	return g
+}
+
+// Histogram returns the Histogram registered under name, creating it with
+// buckets of the given bounds if necessary. Its fields are published as
+// metrics: name_bucket_le_B counts the values in the bucket with upper bound
+// B, name_bucket_le_inf those in the overflow bucket, name_count the
+// number of values and name_sum their sum. If r is nil, a nil *Histogram
+// is returned.
+func (r *Registry) Histogram(name string, bounds []int64) *Histogram {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if h, ok := r.histograms[name]; ok {
+		return h
+	}
+	h := NewHistogram(bounds)
+	r.histograms[name] = h
+	for i, b := range h.bounds {
+		i := i
+		r.metrics[name+"_bucket_le_"+strconv.FormatInt(b, 10)] = histogramField{h, func(h *Histogram) int64 { return atomic.LoadInt64(&h.counts[i]) }}
+	}
+	r.metrics[name+"_bucket_le_inf"] = histogramField{h, func(h *Histogram) int64 { return atomic.LoadInt64(&h.counts[len(h.bounds)]) }}
+	r.metrics[name+"_count"] = histogramField{h, func(h *Histogram) int64 { return atomic.LoadInt64(&h.count) }}
+	r.metrics[name+"_sum"] = histogramField{h, func(h *Histogram) int64 { return atomic.LoadInt64(&h.sum) }}
+	return h
+}
+
+// Snapshot returns the current value of every registered metric, by name.
+func (r *Registry) Snapshot() map[string]int64 {
+	result := make(map[string]int64)
+	if r == nil {
+		return result
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for name, m := range r.metrics {
+		result[name] = m.Value()
+	}
+	return result
+}
+
+// Names returns the sorted names of all registered metrics.
+func (r *Registry) Names() []string {
+	snapshot := r.Snapshot()
+	names := make([]string, 0, len(snapshot))
+	for name := range snapshot {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// String returns the Snapshot encoded as a JSON object. This implements expvar.Var.
+func (r *Registry) String() string {
+	data, _ := json.Marshal(r.Snapshot())
+	return string(data)
+}
@@ -0,0 +1,91 @@
+package metrics
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/require"
+	"sync"
+	"testing"
+)
+
+func TestNilMetricsAreNoops(t *testing.T) {
+	var r *Registry
+	c := r.Counter("c")
+	g := r.Gauge("g")
+	require.Nil(t, c)
+	require.Nil(t, g)
+	c.Inc()
+	g.Inc()
+	g.Set(3)
+	require.Zero(t, c.Value())
+	require.Zero(t, g.Value())
+	require.Empty(t, r.Snapshot())
+}
+
+func TestRegistryReturnsSameMetricForName(t *testing.T) {
+	r := NewRegistry()
+	r.Counter("accepted").Inc()
+	r.Counter("accepted").Add(2)
+	r.Gauge("active").Inc()
+	r.Gauge("active").Dec()
+	r.Gauge("active").Add(5)
+	require.Equal(t, map[string]int64{"accepted": 3, "active": 5}, r.Snapshot())
+	require.Equal(t, []string{"accepted", "active"}, r.Names())
+}
+
+func TestRegistryStringIsJSON(t *testing.T) {
+	r := NewRegistry()
+	r.Counter("accepted").Add(7)
+	var got map[string]int64
+	require.NoError(t, json.Unmarshal([]byte(r.String()), &got))
+	require.Equal(t, int64(7), got["accepted"])
+}
+
+func TestCounterConcurrentIncrements(t *testing.T) {
+	r := NewRegistry()
+	wg := sync.WaitGroup{}
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				r.Counter("n").Inc()
+			}
+		}()
+	}
+	wg.Wait()
+	require.Equal(t, int64(8000), r.Counter("n").Value())
+}
+
+func TestHistogram(t *testing.T) {
+	r := NewRegistry()
+	h := r.Histogram("latency_us", []int64{10, 100, 1000})
+	require.Same(t, h, r.Histogram("latency_us", nil))
+	for _, v := range []int64{5, 10, 50, 60, 70, 500, 5000} {
+		h.Observe(v)
+	}
+	require.Equal(t, map[string]int64{
+		"latency_us_bucket_le_10":   2,
+		"latency_us_bucket_le_100":  3,
+		"latency_us_bucket_le_1000": 1,
+		"latency_us_bucket_le_inf":  1,
+		"latency_us_count":          7,
+		"latency_us_sum":            5695,
+	}, r.Snapshot())
+
+	s := h.Snapshot()
+	require.Equal(t, []int64{2, 3, 1, 1}, s.Counts)
+	require.InDelta(t, 5695.0/7, s.Mean(), 1e-9)
+	for q, expected := range map[float64]int64{0: 10, 0.25: 10, 0.5: 100, 0.7: 100, 0.8: 1000, 1: 1000} {
+		got, ok := s.Quantile(q)
+		require.True(t, ok)
+		require.Equal(t, expected, got, q)
+	}
+	_, ok := NewHistogram([]int64{10}).Snapshot().Quantile(0.5)
+	require.False(t, ok)
+
+	var nilRegistry *Registry
+	nilHistogram := nilRegistry.Histogram("latency_us", []int64{10})
+	require.Nil(t, nilHistogram)
+	nilHistogram.Observe(1)
+	require.Zero(t, nilHistogram.Snapshot().Count)
+}
@@ -0,0 +1,331 @@
+// Package quota accounts for the usage of each client, in bytes forwarded
+// and in time spent connected, over rolling time windows such as an hour or
+// a day, and enforces limits on that usage. Soft limits are only reported,
+// while clients over hard limits may not make new connections.
+package quota
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"tcplb/lib/core"
+	"tcplb/lib/forwarder"
+	"tcplb/lib/metrics"
+	"tcplb/lib/slog"
+	"time"
+)
+
+// Resource is a kind of usage that quotas limit.
+type Resource string
+
+const (
+	Bytes             Resource = "bytes"              // Bytes is the number of bytes forwarded in both directions.
+	ConnectionSeconds Resource = "connection_seconds" // ConnectionSeconds is the time spent connected, summed over connections.
+)
+
+// Window configures the limits on the usage of each client within a
+// rolling time window. Limits that are not positive do not apply.
+type Window struct {
+	Duration              time.Duration
+	SoftBytes             int64
+	HardBytes             int64
+	SoftConnectionSeconds int64
+	HardConnectionSeconds int64
+}
+
+// limit returns the soft and hard limits of the window on r.
+func (w Window) limit(r Resource) (soft, hard int64) {
+	if r == Bytes {
+		return w.SoftBytes, w.HardBytes
+	}
+	return w.SoftConnectionSeconds, w.HardConnectionSeconds
+}
+
+// ExceededError is the error returned by Ledger when a client may not make
+// new connections because its usage has reached a hard limit. It wraps
+// forwarder.QuotaExceeded.
+type ExceededError struct {
+	ClientID core.ClientID
+	Window   time.Duration
+	Resource Resource
+	Usage    int64
+	Limit    int64
+}
+
+func (e *ExceededError) Error() string {
+	return fmt.Sprintf("%s: client %s used %d %s within %s, limit %d", forwarder.QuotaExceeded, e.ClientID, e.Usage, e.Resource, e.Window, e.Limit)
+}
+
+func (e *ExceededError) Unwrap() error {
+	return forwarder.QuotaExceeded
+}
+
+// Metrics holds the metrics recorded by a Ledger.
+type Metrics struct {
+	SoftExceeded *metrics.Counter // SoftExceeded counts the times clients went over a soft limit.
+	HardExceeded *metrics.Counter // HardExceeded counts the times clients went over a hard limit.
+	Rejected     *metrics.Counter // Rejected counts connections refused as their client was over a hard limit.
+}
+
+// NewMetrics returns Metrics registered in the given Registry.
+func NewMetrics(r *metrics.Registry) *Metrics {
+	return &Metrics{
+		SoftExceeded: r.Counter("quota_soft_exceeded_total"),
+		HardExceeded: r.Counter("quota_hard_exceeded_total"),
+		Rejected:     r.Counter("quota_rejected_total"),
+	}
+}
+
+// bucketsPerWindow is the number of buckets that the usage within each
+// window is counted in. Usage expires from a window one bucket at a time,
+// so the window rolls forward in steps of 1/bucketsPerWindow of its length.
+const bucketsPerWindow = 60
+
+// bucket is the usage within a period of a window.
+type bucket struct {
+	epoch     int64 // epoch is the number of the period, counted in bucket lengths since the Unix epoch.
+	bytes     int64
+	connected time.Duration
+}
+
+// windowUsage is the usage of a client within a window.
+type windowUsage struct {
+	buckets      [bucketsPerWindow]bucket
+	softExceeded map[Resource]bool // softExceeded is set while usage is over a soft limit, so that crossing it is reported once.
+	warned       map[Resource]bool // warned is set while usage is over WarnFraction of a hard limit, so that crossing it is warned of once.
+	hardExceeded map[Resource]bool // hardExceeded is set while usage is over a hard limit, so that crossing it is reported once.
+}
+
+// Ledger is a forwarder.QuotaAccountant that accounts for the usage of each
+// client within each of its Windows, with the same limits for every client.
+//
+// Usage is held in memory. If Store is set, usage may be loaded from and
+// saved to it, so that quotas outlast restarts.
+//
+// Multiple goroutines may invoke methods on a Ledger simultaneously.
+type Ledger struct {
+	// Logger is optional. If set, clients going over limits are logged.
+	Logger slog.Logger
+
+	// Store is optional. If set, Load and Save load and save usage with it.
+	Store Store
+
+	// WarnFraction is optional. If positive, and Warner is set, Warner is
+	// warned each time the usage of a client within a window goes over
+	// WarnFraction of a hard limit, rounded up, so that it may react before
+	// its connections are refused.
+	WarnFraction float64
+	Warner       forwarder.BudgetWarner
+
+	windows []Window
+	metrics *Metrics
+	now     func() time.Time
+
+	mu        sync.Mutex // mu guards clients and lastSweep
+	clients   map[core.ClientID][]*windowUsage
+	lastSweep time.Time
+}
+
+// NewLedger returns a Ledger with no recorded usage that limits usage
+// within the given windows. m is optional. If nil, no metrics are recorded.
+func NewLedger(windows []Window, m *Metrics) *Ledger {
+	if m == nil {
+		m = &Metrics{}
+	}
+	return &Ledger{
+		windows: append([]Window(nil), windows...),
+		metrics: m,
+		now:     time.Now,
+		clients: make(map[core.ClientID][]*windowUsage),
+	}
+}
+
+// bucketLength returns the length of the buckets of w.
+func bucketLength(w Window) time.Duration {
+	if d := w.Duration / bucketsPerWindow; d > 0 {
+		return d
+	}
+	return 1
+}
+
+// epoch returns the number of the bucket of w that now falls within.
+func epoch(w Window, now time.Time) int64 {
+	return now.UnixNano() / int64(bucketLength(w))
+}
+
+// total returns the usage within w as of now, in units of each Resource.
+func (u *windowUsage) total(w Window, now time.Time) map[Resource]int64 {
+	current := epoch(w, now)
+	var bytes int64
+	var connected time.Duration
+	for _, b := range u.buckets {
+		if b.epoch > current-bucketsPerWindow && b.epoch <= current {
+			bytes += b.bytes
+			connected += b.connected
+		}
+	}
+	return map[Resource]int64{Bytes: bytes, ConnectionSeconds: int64(connected / time.Second)}
+}
+
+// CheckQuota returns an *ExceededError if c has reached a hard limit of any
+// window.
+func (l *Ledger) CheckQuota(ctx context.Context, c core.ClientID) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	usages, ok := l.clients[c]
+	if !ok {
+		return nil
+	}
+	now := l.now()
+	for i, w := range l.windows {
+		totals := usages[i].total(w, now)
+		for _, r := range []Resource{Bytes, ConnectionSeconds} {
+			if _, hard := w.limit(r); hard > 0 && totals[r] >= hard {
+				l.metrics.Rejected.Inc()
+				return &ExceededError{ClientID: c, Window: w.Duration, Resource: r, Usage: totals[r], Limit: hard}
+			}
+		}
+	}
+	return nil
+}
+
+// RecordUsage adds usage by c to the current bucket of each window, and
+// reports c going over any limit.
+func (l *Ledger) RecordUsage(ctx context.Context, c core.ClientID, bytes int64, connected time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	l.sweepLocked(now)
+	usages := l.usagesLocked(c)
+	for i, w := range l.windows {
+		u := usages[i]
+		e := epoch(w, now)
+		b := &u.buckets[e%bucketsPerWindow]
+		if b.epoch != e {
+			*b = bucket{epoch: e}
+		}
+		b.bytes += bytes
+		b.connected += connected
+		l.checkLimitsLocked(ctx, c, w, u, now)
+	}
+}
+
+// usagesLocked returns the usage of c within each window, adding c if it
+// has none.
+func (l *Ledger) usagesLocked(c core.ClientID) []*windowUsage {
+	usages, ok := l.clients[c]
+	if !ok {
+		usages = make([]*windowUsage, len(l.windows))
+		for i := range usages {
+			usages[i] = &windowUsage{softExceeded: make(map[Resource]bool), warned: make(map[Resource]bool), hardExceeded: make(map[Resource]bool)}
+		}
+		l.clients[c] = usages
+	}
+	return usages
+}
+
+// checkLimitsLocked reports c going over the limits of w.
+func (l *Ledger) checkLimitsLocked(ctx context.Context, c core.ClientID, w Window, u *windowUsage, now time.Time) {
+	totals := u.total(w, now)
+	for _, r := range []Resource{Bytes, ConnectionSeconds} {
+		soft, hard := w.limit(r)
+		if crossed(u.softExceeded, r, soft, totals[r]) {
+			l.metrics.SoftExceeded.Inc()
+			l.warn("Ledger: client went over soft quota", c, w, r, totals[r], soft)
+		}
+		if l.Warner != nil && crossed(u.warned, r, forwarder.BudgetWarningThreshold(hard, l.WarnFraction), totals[r]) {
+			l.Warner.WarnBudget(ctx, forwarder.BudgetWarning{
+				ClientID: c,
+				Budget:   string(r),
+				Window:   w.Duration,
+				Usage:    totals[r],
+				Limit:    hard,
+			})
+		}
+		if crossed(u.hardExceeded, r, hard, totals[r]) {
+			l.metrics.HardExceeded.Inc()
+			l.warn("Ledger: client went over hard quota, new connections will be rejected", c, w, r, totals[r], hard)
+		}
+	}
+}
+
+// crossed updates whether usage is over limit, and reports if it has just
+// gone over it.
+func crossed(exceeded map[Resource]bool, r Resource, limit, usage int64) bool {
+	if limit <= 0 {
+		return false
+	}
+	over := usage >= limit
+	was := exceeded[r]
+	exceeded[r] = over
+	return over && !was
+}
+
+// warn logs c going over the limit of w on r, if Logger is set.
+func (l *Ledger) warn(msg string, c core.ClientID, w Window, r Resource, usage, limit int64) {
+	if l.Logger == nil {
+		return
+	}
+	l.Logger.Warn(&slog.LogRecord{
+		Msg:      msg,
+		ClientID: &c,
+		Details:  fmt.Sprintf("used %d %s within %s, limit %d", usage, r, w.Duration, limit),
+	})
+}
+
+// sweepLocked forgets clients with no usage within any window, at most once
+// per the shortest window, so that memory use is bounded by the number of
+// recently active clients.
+func (l *Ledger) sweepLocked(now time.Time) {
+	if len(l.windows) == 0 {
+		return
+	}
+	shortest := l.windows[0].Duration
+	for _, w := range l.windows[1:] {
+		if w.Duration < shortest {
+			shortest = w.Duration
+		}
+	}
+	if now.Sub(l.lastSweep) < shortest {
+		return
+	}
+	l.lastSweep = now
+	for c, usages := range l.clients {
+		if !l.activeLocked(usages, now) {
+			delete(l.clients, c)
+		}
+	}
+}
+
+// activeLocked reports if usages has any usage within its window.
+func (l *Ledger) activeLocked(usages []*windowUsage, now time.Time) bool {
+	for i, w := range l.windows {
+		current := epoch(w, now)
+		for _, b := range usages[i].buckets {
+			if b.epoch > current-bucketsPerWindow && (b.bytes > 0 || b.connected > 0) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Usage returns the usage of c within each window, in the order of the
+// windows given to NewLedger.
+func (l *Ledger) Usage(c core.ClientID) []map[Resource]int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	result := make([]map[Resource]int64, len(l.windows))
+	usages := l.clients[c]
+	for i, w := range l.windows {
+		if usages == nil {
+			result[i] = map[Resource]int64{Bytes: 0, ConnectionSeconds: 0}
+			continue
+		}
+		result[i] = usages[i].total(w, now)
+	}
+	return result
+}
+
+var _ forwarder.QuotaAccountant = (*Ledger)(nil) // type check
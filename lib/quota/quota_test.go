@@ -0,0 +1,170 @@
+package quota
+
+import (
+	"context"
+	"github.com/stretchr/testify/require"
+	"path/filepath"
+	"tcplb/lib/core"
+	"tcplb/lib/forwarder"
+	"tcplb/lib/metrics"
+	"tcplb/lib/slog"
+	"testing"
+	"time"
+)
+
+var alice = core.ClientID{Namespace: "test", Key: "alice"}
+var bob = core.ClientID{Namespace: "test", Key: "bob"}
+
+func newTestLedger(windows ...Window) (*Ledger, *time.Time) {
+	now := time.Unix(1_000_000, 0)
+	l := NewLedger(windows, NewMetrics(metrics.NewRegistry()))
+	l.now = func() time.Time { return now }
+	return l, &now
+}
+
+func TestLedgerHardLimits(t *testing.T) {
+	ctx := context.Background()
+	l, now := newTestLedger(
+		Window{Duration: time.Hour, HardBytes: 100},
+		Window{Duration: 24 * time.Hour, HardConnectionSeconds: 60},
+	)
+
+	require.NoError(t, l.CheckQuota(ctx, alice))
+	l.RecordUsage(ctx, alice, 99, 30*time.Second)
+	require.NoError(t, l.CheckQuota(ctx, alice))
+	l.RecordUsage(ctx, alice, 1, 0)
+	err := l.CheckQuota(ctx, alice)
+	require.ErrorIs(t, err, forwarder.QuotaExceeded)
+	var exceeded *ExceededError
+	require.ErrorAs(t, err, &exceeded)
+	require.Equal(t, ExceededError{ClientID: alice, Window: time.Hour, Resource: Bytes, Usage: 100, Limit: 100}, *exceeded)
+	// Other clients are unaffected.
+	require.NoError(t, l.CheckQuota(ctx, bob))
+
+	// Usage expires from the hourly window as it rolls forward, but not
+	// from the daily window.
+	*now = now.Add(time.Hour)
+	require.NoError(t, l.CheckQuota(ctx, alice))
+	l.RecordUsage(ctx, alice, 0, 30*time.Second)
+	err = l.CheckQuota(ctx, alice)
+	require.ErrorAs(t, err, &exceeded)
+	require.Equal(t, ConnectionSeconds, exceeded.Resource)
+	require.Equal(t, int64(2), l.metrics.HardExceeded.Value())
+	require.Equal(t, int64(2), l.metrics.Rejected.Value())
+}
+
+func TestLedgerRollsForwardBucketByBucket(t *testing.T) {
+	ctx := context.Background()
+	l, now := newTestLedger(Window{Duration: time.Hour, HardBytes: 100})
+	l.RecordUsage(ctx, alice, 60, 0)
+	*now = now.Add(30 * time.Minute)
+	l.RecordUsage(ctx, alice, 40, 0)
+	require.Error(t, l.CheckQuota(ctx, alice))
+	// Once the first usage is over an hour old, only the later counts.
+	*now = now.Add(31 * time.Minute)
+	require.NoError(t, l.CheckQuota(ctx, alice))
+	require.Equal(t, int64(40), l.Usage(alice)[0][Bytes])
+}
+
+func TestLedgerReportsSoftLimitsOnce(t *testing.T) {
+	ctx := context.Background()
+	l, now := newTestLedger(Window{Duration: time.Hour, SoftBytes: 10})
+	logger := &slog.RecordingLogger{}
+	l.Logger = logger
+	for i := 0; i < 3; i++ {
+		l.RecordUsage(ctx, alice, 10, 0)
+	}
+	// Soft limits do not reject connections.
+	require.NoError(t, l.CheckQuota(ctx, alice))
+	require.Equal(t, int64(1), l.metrics.SoftExceeded.Value())
+	require.Len(t, logger.Events, 1)
+
+	// Once usage falls below the limit, going over it again is reported.
+	*now = now.Add(time.Hour)
+	l.RecordUsage(ctx, alice, 10, 0)
+	require.Equal(t, int64(2), l.metrics.SoftExceeded.Value())
+}
+
+// recordingWarner is a BudgetWarner that records the warnings it is given.
+type recordingWarner struct {
+	warnings []forwarder.BudgetWarning
+}
+
+func (w *recordingWarner) WarnBudget(ctx context.Context, warning forwarder.BudgetWarning) {
+	w.warnings = append(w.warnings, warning)
+}
+
+func TestLedgerWarnsBeforeHardLimits(t *testing.T) {
+	ctx := context.Background()
+	l, now := newTestLedger(Window{Duration: time.Hour, HardBytes: 100, SoftConnectionSeconds: 60})
+	warner := &recordingWarner{}
+	l.WarnFraction = 0.8
+	l.Warner = warner
+	l.RecordUsage(ctx, alice, 79, time.Hour)
+	require.Empty(t, warner.warnings)
+	l.RecordUsage(ctx, alice, 1, 0)
+	l.RecordUsage(ctx, alice, 10, 0)
+	// Connections are not yet refused.
+	require.NoError(t, l.CheckQuota(ctx, alice))
+	expected := forwarder.BudgetWarning{ClientID: alice, Budget: string(Bytes), Window: time.Hour, Usage: 80, Limit: 100}
+	require.Equal(t, []forwarder.BudgetWarning{expected}, warner.warnings)
+
+	// Once usage falls below the threshold, going over it again is warned of.
+	*now = now.Add(time.Hour)
+	l.RecordUsage(ctx, alice, 80, 0)
+	require.Len(t, warner.warnings, 2)
+}
+
+func TestLedgerForgetsIdleClients(t *testing.T) {
+	ctx := context.Background()
+	l, now := newTestLedger(Window{Duration: time.Hour, HardBytes: 100})
+	l.RecordUsage(ctx, alice, 1, 0)
+	*now = now.Add(2 * time.Hour)
+	l.RecordUsage(ctx, bob, 1, 0)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	require.Len(t, l.clients, 1)
+	require.Contains(t, l.clients, bob)
+}
+
+func TestLedgerPersistsUsage(t *testing.T) {
+	ctx := context.Background()
+	store := &FileStore{Path: filepath.Join(t.TempDir(), "quota.json")}
+	windows := []Window{{Duration: time.Hour, HardBytes: 100}, {Duration: 24 * time.Hour, SoftConnectionSeconds: 10}}
+
+	l, now := newTestLedger(windows...)
+	l.Store = store
+	require.NoError(t, l.Load())
+	l.RecordUsage(ctx, alice, 100, 5*time.Second)
+	l.RecordUsage(ctx, bob, 1, 0)
+	require.NoError(t, l.Save())
+
+	restored, restoredNow := newTestLedger(windows...)
+	*restoredNow = *now
+	restored.Store = store
+	require.NoError(t, restored.Load())
+	require.ErrorIs(t, restored.CheckQuota(ctx, alice), forwarder.QuotaExceeded)
+	require.Equal(t, l.Usage(alice), restored.Usage(alice))
+	require.Equal(t, l.Usage(bob), restored.Usage(bob))
+
+	// Usage within windows that are no longer configured is ignored.
+	changed, changedNow := newTestLedger(Window{Duration: 2 * time.Hour, HardBytes: 100})
+	*changedNow = *now
+	changed.Store = store
+	require.NoError(t, changed.Load())
+	require.NoError(t, changed.CheckQuota(ctx, alice))
+}
+
+func TestLedgerRejectsInvalidSnapshots(t *testing.T) {
+	l, _ := newTestLedger(Window{Duration: time.Hour, HardBytes: 100})
+	snapshot := Snapshot{Clients: []ClientSnapshot{{
+		ClientID: alice,
+		Windows: []WindowSnapshot{{Window: time.Hour.String(), Buckets: []BucketSnapshot{
+			{Epoch: 1, Bytes: 100},
+			{Epoch: -1, Bytes: 100},
+		}}},
+	}}}
+	require.ErrorIs(t, l.Restore(snapshot), InvalidSnapshot)
+	// No usage is restored from an invalid snapshot.
+	require.NoError(t, l.CheckQuota(context.Background(), alice))
+}
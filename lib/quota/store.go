@@ -0,0 +1,221 @@
+package quota
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"tcplb/lib/core"
+	"tcplb/lib/slog"
+	"time"
+)
+
+// InvalidSnapshot is returned when restoring a Snapshot that no Ledger could
+// have saved, e.g. one with a negative epoch.
+var InvalidSnapshot = errors.New("invalid quota snapshot")
+
+// Snapshot is the usage recorded by a Ledger, as persisted by a Store.
+type Snapshot struct {
+	Clients []ClientSnapshot `json:"clients"`
+}
+
+// ClientSnapshot is the usage of a client within each window.
+type ClientSnapshot struct {
+	ClientID core.ClientID    `json:"client_id"`
+	Windows  []WindowSnapshot `json:"windows"`
+}
+
+// WindowSnapshot is the usage of a client within a window, bucket by bucket.
+type WindowSnapshot struct {
+	Window  string           `json:"window"` // Window is the duration of the window, e.g. "24h0m0s".
+	Buckets []BucketSnapshot `json:"buckets"`
+}
+
+// BucketSnapshot is the usage of a client within one bucket of a window.
+type BucketSnapshot struct {
+	Epoch          int64 `json:"epoch"`
+	Bytes          int64 `json:"bytes"`
+	ConnectedNanos int64 `json:"connected_ns"`
+}
+
+// Store persists the usage recorded by a Ledger.
+//
+// A Store could be shared by several load balancers, e.g. one backed by a
+// database, but a Ledger only loads usage at startup, so it does not see
+// usage that others record afterwards.
+type Store interface {
+	Load() (Snapshot, error)
+	Save(s Snapshot) error
+}
+
+// FileStore is a Store that keeps a Snapshot in a JSON file at Path. The
+// file is replaced atomically on each Save.
+type FileStore struct {
+	Path string
+}
+
+// Load returns the Snapshot in the file, or an empty Snapshot if the file
+// does not exist.
+func (s *FileStore) Load() (Snapshot, error) {
+	var snapshot Snapshot
+	data, err := os.ReadFile(s.Path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return snapshot, nil
+	}
+	if err != nil {
+		return snapshot, err
+	}
+	err = json.Unmarshal(data, &snapshot)
+	return snapshot, err
+}
+
+func (s *FileStore) Save(snapshot Snapshot) error {
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(s.Path), filepath.Base(s.Path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.Path)
+}
+
+var _ Store = (*FileStore)(nil) // type check
+
+// Snapshot returns the usage recorded within each window that has not yet
+// expired.
+func (l *Ledger) Snapshot() Snapshot {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	snapshot := Snapshot{Clients: make([]ClientSnapshot, 0, len(l.clients))}
+	for c, usages := range l.clients {
+		client := ClientSnapshot{ClientID: c}
+		for i, w := range l.windows {
+			window := WindowSnapshot{Window: w.Duration.String()}
+			current := epoch(w, now)
+			for _, b := range usages[i].buckets {
+				if b.epoch > current-bucketsPerWindow && b.epoch <= current {
+					window.Buckets = append(window.Buckets, BucketSnapshot{Epoch: b.epoch, Bytes: b.bytes, ConnectedNanos: int64(b.connected)})
+				}
+			}
+			client.Windows = append(client.Windows, window)
+		}
+		snapshot.Clients = append(snapshot.Clients, client)
+	}
+	return snapshot
+}
+
+// validate returns an error wrapping InvalidSnapshot if s has a negative
+// epoch or usage.
+func (s Snapshot) validate() error {
+	for _, client := range s.Clients {
+		for _, window := range client.Windows {
+			for _, b := range window.Buckets {
+				if b.Epoch < 0 || b.Bytes < 0 || b.ConnectedNanos < 0 {
+					return fmt.Errorf("%w: client %s has negative epoch or usage in window %s", InvalidSnapshot, client.ClientID, window.Window)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// Restore adds the usage in snapshot to the usage recorded by l. Usage
+// within windows that l does not have is ignored. If snapshot is invalid,
+// an error wrapping InvalidSnapshot is returned and no usage is restored.
+func (l *Ledger) Restore(snapshot Snapshot) error {
+	if err := snapshot.validate(); err != nil {
+		return err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	for _, client := range snapshot.Clients {
+		usages := l.usagesLocked(client.ClientID)
+		for _, window := range client.Windows {
+			for i, w := range l.windows {
+				if w.Duration.String() != window.Window {
+					continue
+				}
+				for _, saved := range window.Buckets {
+					b := &usages[i].buckets[saved.Epoch%bucketsPerWindow]
+					if b.epoch != saved.Epoch {
+						*b = bucket{epoch: saved.Epoch}
+					}
+					b.bytes += saved.Bytes
+					b.connected += time.Duration(saved.ConnectedNanos)
+				}
+				l.checkLimitsLocked(context.Background(), client.ClientID, w, usages[i], now)
+			}
+		}
+	}
+	return nil
+}
+
+// Load restores the usage saved in Store, if set.
+func (l *Ledger) Load() error {
+	if l.Store == nil {
+		return nil
+	}
+	snapshot, err := l.Store.Load()
+	if err != nil {
+		return err
+	}
+	return l.Restore(snapshot)
+}
+
+// Save saves the usage recorded so far to Store, if set.
+func (l *Ledger) Save() error {
+	if l.Store == nil {
+		return nil
+	}
+	return l.Store.Save(l.Snapshot())
+}
+
+// StartPersister starts a goroutine that calls Save once per interval. The
+// returned stop function stops the goroutine, then calls Save a final time.
+// Errors are logged to Logger, if set.
+func (l *Ledger) StartPersister(interval time.Duration) (stop func()) {
+	ticker := time.NewTicker(interval)
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	save := func() {
+		if err := l.Save(); err != nil && l.Logger != nil {
+			l.Logger.Error(&slog.LogRecord{Msg: "Ledger: failed to save quota usage", Error: err})
+		}
+	}
+	go func() {
+		defer close(stopped)
+		for {
+			select {
+			case <-ticker.C:
+				save()
+			case <-done:
+				return
+			}
+		}
+	}()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			ticker.Stop()
+			close(done)
+			<-stopped
+			save()
+		})
+	}
+}
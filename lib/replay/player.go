@@ -0,0 +1,225 @@
+package replay
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"tcplb/lib/core"
+	"tcplb/lib/forwarder"
+	"time"
+)
+
+// MismatchError is returned by Play when the connection under test does not
+// send the data that the recorded connection sent.
+type MismatchError struct {
+	Index    int    // Index is the index of the Event that was not matched.
+	Expected []byte // Expected is the recorded data. It is nil if EOF was expected.
+	Got      []byte // Got is the data received instead. It is shorter than Expected if EOF was received first.
+}
+
+func (e *MismatchError) Error() string {
+	if e.Expected == nil {
+		return fmt.Sprintf("replay: event %d: expected EOF but got %q", e.Index, e.Got)
+	}
+	return fmt.Sprintf("replay: event %d: expected %q but got %q", e.Index, e.Expected, e.Got)
+}
+
+// Player plays back recorded Events, acting as the peer of the recorded
+// connection.
+type Player struct {
+	// Speed scales the recorded timing. If positive, data is sent no
+	// earlier than its recorded Offset divided by Speed, e.g. 1 plays back
+	// in real time. If not positive, Events are played back as fast as
+	// possible.
+	Speed float64
+}
+
+// Play plays back events over conn, in order: data that the recorded
+// connection received is sent, and data that it sent is expected to be
+// received, or a *MismatchError is returned. Play returns once every Event
+// has been played back, without closing conn.
+func (p Player) Play(ctx context.Context, conn core.DuplexConn, events []Event) error {
+	// Unblock reads and writes if ctx is done.
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = conn.SetDeadline(time.Unix(1, 0))
+		case <-done:
+		}
+	}()
+
+	start := time.Now()
+	wait := func(e Event) error {
+		if p.Speed <= 0 {
+			return nil
+		}
+		timer := time.NewTimer(time.Until(start.Add(time.Duration(float64(e.Offset) / p.Speed))))
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	for i, e := range events {
+		var err error
+		switch e.Direction {
+		case Received:
+			if err = wait(e); err == nil {
+				_, err = conn.Write(e.Data)
+			}
+		case PeerClosed:
+			if err = wait(e); err == nil {
+				err = conn.CloseWrite()
+			}
+		case Sent:
+			got := make([]byte, len(e.Data))
+			var n int
+			n, err = io.ReadFull(conn, got)
+			if err == nil || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+				if !bytes.Equal(got[:n], e.Data) {
+					return &MismatchError{Index: i, Expected: e.Data, Got: got[:n]}
+				}
+				err = nil
+			}
+		case Closed:
+			var got [1]byte
+			var n int
+			n, err = conn.Read(got[:])
+			if n > 0 {
+				return &MismatchError{Index: i, Got: got[:n]}
+			}
+			if errors.Is(err, io.EOF) {
+				err = nil
+			}
+		default:
+			err = fmt.Errorf("unknown direction %q", e.Direction)
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				err = ctx.Err()
+			}
+			return fmt.Errorf("replay: event %d: %w", i, err)
+		}
+	}
+	return nil
+}
+
+// Server plays back Events to each connection that it accepts, acting as
+// the peer of the recorded connection, e.g. as an upstream.
+//
+// Multiple goroutines may invoke methods on a Server simultaneously.
+type Server struct {
+	Events []Event
+	Player Player
+
+	wg   sync.WaitGroup
+	mu   sync.Mutex // mu guards errs
+	errs []error
+}
+
+// Serve accepts connections from l until it is closed, playing back Events
+// to each, then waits for every play back to finish. Connections are closed
+// once played back.
+func (s *Server) Serve(l net.Listener) error {
+	defer s.wg.Wait()
+	for {
+		conn, err := l.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			defer conn.Close()
+			duplex, ok := conn.(core.DuplexConn)
+			if !ok {
+				s.fail(fmt.Errorf("replay: %T does not support CloseWrite", conn))
+				return
+			}
+			if err := s.Player.Play(context.Background(), duplex, s.Events); err != nil {
+				s.fail(err)
+			}
+		}()
+	}
+}
+
+func (s *Server) fail(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.errs = append(s.errs, err)
+}
+
+// Errors returns the errors that play backs have failed with so far.
+func (s *Server) Errors() []error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]error(nil), s.errs...)
+}
+
+// Dialer is a forwarder.BestUpstreamDialer whose connections are played
+// back by a Server listening on a loopback address. The best upstream is
+// the first of the candidates in sorted order.
+type Dialer struct {
+	Server *Server
+
+	listener net.Listener
+	served   chan error
+}
+
+// NewDialer returns a Dialer that plays back events with player to each of
+// its connections. It should be closed once no longer needed.
+func NewDialer(events []Event, player Player) (*Dialer, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	d := &Dialer{
+		Server:   &Server{Events: events, Player: player},
+		listener: listener,
+		served:   make(chan error, 1),
+	}
+	go func() {
+		d.served <- d.Server.Serve(listener)
+	}()
+	return d, nil
+}
+
+func (d *Dialer) DialBestUpstream(ctx context.Context, candidates core.UpstreamSet) (core.Upstream, core.DuplexConn, error) {
+	if len(candidates) == 0 {
+		return core.Upstream{}, nil, forwarder.NoUpstreamAvailable
+	}
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", d.listener.Addr().String())
+	if err != nil {
+		return core.Upstream{}, nil, err
+	}
+	return candidates.Sorted()[0], conn.(*net.TCPConn), nil
+}
+
+// Close stops accepting connections, then waits for play backs of existing
+// ones to finish. It returns the first error that a play back failed with.
+func (d *Dialer) Close() error {
+	if err := d.listener.Close(); err != nil {
+		return err
+	}
+	if err := <-d.served; err != nil {
+		return err
+	}
+	if errs := d.Server.Errors(); len(errs) > 0 {
+		return errs[0]
+	}
+	return nil
+}
+
+var _ forwarder.BestUpstreamDialer = (*Dialer)(nil) // type check
@@ -0,0 +1,185 @@
+// Package replay records the byte streams of connections, with their
+// timing, and plays them back, so that the behaviour of the forwarder can
+// be regression tested deterministically against real captured sessions.
+//
+// A Conn records the data that a connection sends and receives as a
+// sequence of Events. Playing the Events back over another connection acts
+// out the recorded peer: the data the recorded connection received is sent,
+// and the data it sent is expected, in the recorded order. A Server plays
+// back a session recorded from an upstream connection to each client that
+// connects to it, and a Dialer does the same for a forwarder that dials it.
+//
+// This package is intended for use in tests and tools, not in the serving
+// path.
+package replay
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"sync"
+	"tcplb/lib/core"
+	"tcplb/lib/forwarder"
+	"time"
+)
+
+// Direction is the kind of an Event, from the point of view of the
+// recorded connection.
+type Direction string
+
+const (
+	Received   Direction = "received"    // Received is data received from the peer.
+	Sent       Direction = "sent"        // Sent is data sent to the peer.
+	PeerClosed Direction = "peer_closed" // PeerClosed is the peer closing its side of the connection, i.e. reading EOF.
+	Closed     Direction = "closed"      // Closed is closing the sending side of the connection, by CloseWrite or Close.
+)
+
+// Event is an event in the life of a recorded connection.
+type Event struct {
+	Offset    time.Duration `json:"offset_ns"` // Offset is the time since the connection was wrapped.
+	Direction Direction     `json:"direction"`
+	Data      []byte        `json:"data,omitempty"`
+}
+
+// Recorder writes Events to an io.Writer as JSON, one per line.
+//
+// Multiple goroutines may invoke methods on a Recorder simultaneously.
+type Recorder struct {
+	mu  sync.Mutex // mu guards enc and err
+	enc *json.Encoder
+	err error
+}
+
+// NewRecorder returns a Recorder that writes Events to w.
+func NewRecorder(w io.Writer) *Recorder {
+	return &Recorder{enc: json.NewEncoder(w)}
+}
+
+// Record writes e. Once writing has failed, further Events are dropped.
+func (r *Recorder) Record(e Event) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.err != nil {
+		return
+	}
+	r.err = r.enc.Encode(e)
+}
+
+// Err returns the error that writing Events failed with, if any.
+func (r *Recorder) Err() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.err
+}
+
+// Load reads the Events written by a Recorder.
+func Load(r io.Reader) ([]Event, error) {
+	var events []Event
+	dec := json.NewDecoder(bufio.NewReader(r))
+	for {
+		var e Event
+		err := dec.Decode(&e)
+		if errors.Is(err, io.EOF) {
+			return events, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, e)
+	}
+}
+
+// Conn is a core.DuplexConn that records the data sent and received
+// by the wrapped connection.
+type Conn struct {
+	core.WrappedConn
+	recorder *Recorder
+	start    time.Time
+	closed   sync.Once
+}
+
+// NewConn returns a Conn that records conn with recorder.
+func NewConn(conn core.DuplexConn, recorder *Recorder) *Conn {
+	return &Conn{WrappedConn: core.WrappedConn{DuplexConn: conn}, recorder: recorder, start: time.Now()}
+}
+
+func (c *Conn) record(d Direction, data []byte) {
+	e := Event{Offset: time.Since(c.start), Direction: d}
+	if len(data) > 0 {
+		e.Data = append([]byte(nil), data...)
+	}
+	c.recorder.Record(e)
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	n, err := c.DuplexConn.Read(b)
+	if n > 0 {
+		c.record(Received, b[:n])
+	}
+	if errors.Is(err, io.EOF) {
+		c.record(PeerClosed, nil)
+	}
+	return n, err
+}
+
+func (c *Conn) Write(b []byte) (int, error) {
+	n, err := c.DuplexConn.Write(b)
+	if n > 0 {
+		c.record(Sent, b[:n])
+	}
+	return n, err
+}
+
+func (c *Conn) CloseWrite() error {
+	c.closed.Do(func() { c.record(Closed, nil) })
+	return c.DuplexConn.CloseWrite()
+}
+
+func (c *Conn) Close() error {
+	c.closed.Do(func() { c.record(Closed, nil) })
+	return c.DuplexConn.Close()
+}
+
+var _ core.DuplexConn = (*Conn)(nil) // type check
+
+// RecordingDialer is a forwarder.BestUpstreamDialer that records each
+// upstream connection made by the Inner dialer, e.g. to capture real
+// sessions to play back in tests.
+type RecordingDialer struct {
+	Inner forwarder.BestUpstreamDialer
+
+	// Open returns where to write the Events of a new connection to u. It
+	// is closed when the connection is closed.
+	Open func(u core.Upstream) (io.WriteCloser, error)
+}
+
+func (d *RecordingDialer) DialBestUpstream(ctx context.Context, candidates core.UpstreamSet) (core.Upstream, core.DuplexConn, error) {
+	u, conn, err := d.Inner.DialBestUpstream(ctx, candidates)
+	if err != nil {
+		return u, conn, err
+	}
+	w, err := d.Open(u)
+	if err != nil {
+		_ = conn.Close()
+		return core.Upstream{}, nil, err
+	}
+	return u, &closingConn{Conn: NewConn(conn, NewRecorder(w)), w: w}, nil
+}
+
+var _ forwarder.BestUpstreamDialer = (*RecordingDialer)(nil) // type check
+
+// closingConn is a Conn that closes the writer of its Events once closed.
+type closingConn struct {
+	*Conn
+	w io.Closer
+}
+
+func (c *closingConn) Close() error {
+	err := c.Conn.Close()
+	if closeErr := c.w.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
@@ -0,0 +1,158 @@
+package replay
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"github.com/stretchr/testify/require"
+	"io"
+	"net"
+	"tcplb/lib/core"
+	"tcplb/lib/forwarder"
+	"testing"
+	"time"
+)
+
+var upstream = core.Upstream{Network: "tcp", Address: "upstream.test:80"}
+
+// newTCPConns returns both ends of a loopback TCP connection.
+func newTCPConns(t *testing.T) (*net.TCPConn, *net.TCPConn) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+	a, err := net.Dial("tcp", listener.Addr().String())
+	require.NoError(t, err)
+	b, err := listener.Accept()
+	require.NoError(t, err)
+	return a.(*net.TCPConn), b.(*net.TCPConn)
+}
+
+// pongDialer dials an upstream that answers each line with "pong", until
+// it reads EOF.
+type pongDialer struct {
+	t *testing.T
+}
+
+func (d pongDialer) DialBestUpstream(ctx context.Context, candidates core.UpstreamSet) (core.Upstream, core.DuplexConn, error) {
+	conn, peer := newTCPConns(d.t)
+	go func() {
+		defer peer.Close()
+		lines := bufio.NewScanner(peer)
+		for lines.Scan() {
+			_, _ = peer.Write([]byte("pong\n"))
+		}
+		_ = peer.CloseWrite()
+	}()
+	return upstream, conn, nil
+}
+
+// nopWriteCloser is a buffer that may be closed.
+type nopWriteCloser struct {
+	*bytes.Buffer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+// forwardPing forwards a client that sends "ping" lines to an upstream from
+// d, returning what the client receives.
+func forwardPing(t *testing.T, d forwarder.BestUpstreamDialer, request string) string {
+	client, clientPeer := newTCPConns(t)
+	defer client.Close()
+	u, upstreamConn, err := d.DialBestUpstream(context.Background(), core.NewUpstreamSet(upstream))
+	require.NoError(t, err)
+	require.Equal(t, upstream, u)
+
+	forwarded := make(chan error, 1)
+	go func() {
+		forwarded <- forwarder.MediocreForwarder{}.Forward(context.Background(), clientPeer, upstreamConn)
+		_ = clientPeer.Close()
+		_ = upstreamConn.Close()
+	}()
+	_, err = client.Write([]byte(request))
+	require.NoError(t, err)
+	require.NoError(t, client.CloseWrite())
+	response, err := io.ReadAll(client)
+	require.NoError(t, err)
+	require.NoError(t, <-forwarded)
+	return string(response)
+}
+
+func TestRecordAndReplay(t *testing.T) {
+	var recording bytes.Buffer
+	recorder := &RecordingDialer{
+		Inner: pongDialer{t: t},
+		Open: func(u core.Upstream) (io.WriteCloser, error) {
+			return nopWriteCloser{&recording}, nil
+		},
+	}
+	require.Equal(t, "pong\npong\n", forwardPing(t, recorder, "ping\nping\n"))
+
+	events, err := Load(&recording)
+	require.NoError(t, err)
+	require.NotEmpty(t, events)
+	require.Equal(t, Sent, events[0].Direction)
+	directions := make(map[Direction]int)
+	for _, e := range events {
+		directions[e.Direction]++
+	}
+	require.Equal(t, 1, directions[Closed])
+	require.Equal(t, 1, directions[PeerClosed])
+
+	// Playing back the recording behaves as the upstream did.
+	d, err := NewDialer(events, Player{})
+	require.NoError(t, err)
+	require.Equal(t, "pong\npong\n", forwardPing(t, d, "ping\nping\n"))
+	require.NoError(t, d.Close())
+
+	// Different requests are detected.
+	d, err = NewDialer(events, Player{})
+	require.NoError(t, err)
+	forwardPing(t, d, "PING\nping\n")
+	var mismatch *MismatchError
+	require.ErrorAs(t, d.Close(), &mismatch)
+	require.Equal(t, 0, mismatch.Index)
+	require.True(t, bytes.HasPrefix(mismatch.Got, []byte("PING\n")), string(mismatch.Got))
+}
+
+func TestPlayerTiming(t *testing.T) {
+	events := []Event{
+		{Offset: 0, Direction: Sent, Data: []byte("hello")},
+		{Offset: 100 * time.Millisecond, Direction: Received, Data: []byte("world")},
+		{Offset: 100 * time.Millisecond, Direction: PeerClosed},
+	}
+	conn, peer := newTCPConns(t)
+	defer conn.Close()
+	defer peer.Close()
+	_, err := conn.Write([]byte("hello"))
+	require.NoError(t, err)
+
+	start := time.Now()
+	played := make(chan error, 1)
+	go func() {
+		played <- Player{Speed: 2}.Play(context.Background(), peer, events)
+	}()
+	data, err := io.ReadAll(conn)
+	require.NoError(t, err)
+	require.Equal(t, "world", string(data))
+	require.NoError(t, <-played)
+	require.GreaterOrEqual(t, time.Since(start), 50*time.Millisecond)
+}
+
+func TestPlayerHonoursCancellation(t *testing.T) {
+	conn, peer := newTCPConns(t)
+	defer conn.Close()
+	defer peer.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	played := make(chan error, 1)
+	go func() {
+		// The connection under test never sends the expected data.
+		played <- Player{}.Play(ctx, peer, []Event{{Direction: Sent, Data: []byte("hello")}})
+	}()
+	cancel()
+	select {
+	case err := <-played:
+		require.ErrorIs(t, err, context.Canceled)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Play did not return after ctx was cancelled")
+	}
+}
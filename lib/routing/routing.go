@@ -0,0 +1,221 @@
+// Package routing selects the upstream pool that each client connection is
+// forwarded to, according to an ordered list of rules.
+package routing
+
+import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+)
+
+var InvalidRule = errors.New("invalid routing rule")
+
+// Request describes a client connection to be routed.
+type Request struct {
+	Listener     string   // Listener is the name of the listener that accepted the connection.
+	SNI          string   // SNI is the TLS server name requested by the client, if any.
+	ClientGroups []string // ClientGroups are the groups the authenticated client belongs to.
+	CertOUs      []string // CertOUs are the organizational units of the client's certificate subject, if any.
+	CertSANs     []string // CertSANs are the subject alternative names of the client's certificate, if any.
+}
+
+// SetCertificate sets the certificate attributes of req from the client's
+// certificate. SANs of every type are included: DNS names, email
+// addresses, IP addresses and URIs.
+func (req *Request) SetCertificate(cert *x509.Certificate) {
+	req.CertOUs = cert.Subject.OrganizationalUnit
+	req.CertSANs = nil
+	req.CertSANs = append(req.CertSANs, cert.DNSNames...)
+	req.CertSANs = append(req.CertSANs, cert.EmailAddresses...)
+	for _, ip := range cert.IPAddresses {
+		req.CertSANs = append(req.CertSANs, ip.String())
+	}
+	for _, uri := range cert.URIs {
+		req.CertSANs = append(req.CertSANs, uri.String())
+	}
+}
+
+// Rule routes matching connections to the named Pool. Each non-empty match
+// field must match the connection for the Rule to match. A Rule with no
+// match fields matches every connection.
+type Rule struct {
+	Pool        string // Pool is the name of the pool to route to.
+	Listener    string // Listener optionally matches the name of the accepting listener.
+	SNI         string // SNI optionally matches the TLS server name. A leading "*." matches any subdomain.
+	ClientGroup string // ClientGroup optionally matches one of the client's groups.
+	CertOU      string // CertOU optionally matches one of the organizational units of the client's certificate.
+	CertSAN     string // CertSAN optionally matches one of the SANs of the client's certificate. It is a pattern as for path.Match.
+}
+
+// Matches reports if the Rule matches the connection described by req.
+func (r Rule) Matches(req Request) bool {
+	if r.Listener != "" && r.Listener != req.Listener {
+		return false
+	}
+	if r.SNI != "" && !matchServerName(r.SNI, req.SNI) {
+		return false
+	}
+	if r.ClientGroup != "" && !contains(req.ClientGroups, r.ClientGroup) {
+		return false
+	}
+	if r.CertOU != "" && !contains(req.CertOUs, r.CertOU) {
+		return false
+	}
+	if r.CertSAN != "" && !matchAny(r.CertSAN, req.CertSANs) {
+		return false
+	}
+	return true
+}
+
+// dependsOnClient reports if the Rule matches connections according to
+// who the client is, which is only known once it is authenticated.
+func (r Rule) dependsOnClient() bool {
+	return r.ClientGroup != "" || r.CertOU != "" || r.CertSAN != ""
+}
+
+func (r Rule) String() string {
+	fields := []string{"pool=" + r.Pool}
+	if r.Listener != "" {
+		fields = append(fields, "listener="+r.Listener)
+	}
+	if r.SNI != "" {
+		fields = append(fields, "sni="+r.SNI)
+	}
+	if r.ClientGroup != "" {
+		fields = append(fields, "client-group="+r.ClientGroup)
+	}
+	if r.CertOU != "" {
+		fields = append(fields, "cert-ou="+r.CertOU)
+	}
+	if r.CertSAN != "" {
+		fields = append(fields, "cert-san="+r.CertSAN)
+	}
+	return strings.Join(fields, " ")
+}
+
+func matchServerName(pattern, name string) bool {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	pattern = strings.ToLower(pattern)
+	if suffix := strings.TrimPrefix(pattern, "*"); suffix != pattern {
+		// "*.example.com" matches "a.example.com" but not "example.com".
+		return strings.HasSuffix(name, suffix) && len(name) > len(suffix)
+	}
+	return name == pattern
+}
+
+// matchAny reports if any of the values matches pattern. Patterns are
+// validated by ParseRule, so malformed patterns match nothing.
+func matchAny(pattern string, values []string) bool {
+	for _, v := range values {
+		if ok, _ := path.Match(pattern, v); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseRule parses a Rule from space-separated key=value fields, e.g.
+// "pool=web sni=*.example.com client-group=staff cert-ou=prod
+// cert-san=spiffe://example.com/tenant/*". The pool field is required.
+func ParseRule(s string) (Rule, error) {
+	var rule Rule
+	for _, field := range strings.Fields(s) {
+		key, value, ok := strings.Cut(field, "=")
+		if !ok || value == "" {
+			return Rule{}, fmt.Errorf("%w: expected key=value but got %q", InvalidRule, field)
+		}
+		switch key {
+		case "pool":
+			rule.Pool = value
+		case "listener":
+			rule.Listener = value
+		case "sni":
+			rule.SNI = value
+		case "client-group":
+			rule.ClientGroup = value
+		case "cert-ou":
+			rule.CertOU = value
+		case "cert-san":
+			if _, err := path.Match(value, ""); err != nil {
+				return Rule{}, fmt.Errorf("%w: bad cert-san pattern %q", InvalidRule, value)
+			}
+			rule.CertSAN = value
+		default:
+			return Rule{}, fmt.Errorf("%w: unknown key %q (expected one of pool, listener, sni, client-group, cert-ou, cert-san)", InvalidRule, key)
+		}
+	}
+	if rule.Pool == "" {
+		return Rule{}, fmt.Errorf("%w: %q does not name a pool", InvalidRule, s)
+	}
+	return rule, nil
+}
+
+// Table is an ordered list of Rules. The first matching Rule decides the
+// route of a connection.
+//
+// Multiple goroutines may invoke methods on a Table simultaneously.
+type Table struct {
+	rules []Rule
+}
+
+// NewTable returns a Table of the given Rules, in priority order.
+func NewTable(rules ...Rule) *Table {
+	return &Table{rules: append([]Rule(nil), rules...)}
+}
+
+// Route returns the name of the pool that the connection described by req
+// should be forwarded to. If no Rule matches, ok is false.
+func (t *Table) Route(req Request) (pool string, ok bool) {
+	for _, r := range t.rules {
+		if r.Matches(req) {
+			return r.Pool, true
+		}
+	}
+	return "", false
+}
+
+// RouteIgnoringGroups returns the name of the pool that the connection
+// described by req should be forwarded to, if that does not depend on which
+// groups the client belongs to or on its certificate. This allows the route
+// to be known before the client is authenticated. req.ClientGroups,
+// req.CertOUs and req.CertSANs are ignored. If the route depends on the
+// client, or no Rule would match, ok is false.
+func (t *Table) RouteIgnoringGroups(req Request) (pool string, ok bool) {
+	var groupPools []string
+	for _, r := range t.rules {
+		if r.Listener != "" && r.Listener != req.Listener {
+			continue
+		}
+		if r.SNI != "" && !matchServerName(r.SNI, req.SNI) {
+			continue
+		}
+		if r.dependsOnClient() {
+			// Some clients may match this rule, others may not.
+			groupPools = append(groupPools, r.Pool)
+			continue
+		}
+		for _, p := range groupPools {
+			if p != r.Pool {
+				return "", false
+			}
+		}
+		return r.Pool, true
+	}
+	return "", false
+}
+
+// Rules returns the Rules of the Table, in priority order.
+func (t *Table) Rules() []Rule {
+	return append([]Rule(nil), t.rules...)
+}
@@ -0,0 +1,123 @@
+package routing
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"github.com/stretchr/testify/require"
+	"net"
+	"net/url"
+	"testing"
+)
+
+func TestParseRule(t *testing.T) {
+	rule, err := ParseRule("pool=web listener=main sni=*.example.com client-group=staff")
+	require.NoError(t, err)
+	require.Equal(t, Rule{Pool: "web", Listener: "main", SNI: "*.example.com", ClientGroup: "staff"}, rule)
+	require.Equal(t, "pool=web listener=main sni=*.example.com client-group=staff", rule.String())
+
+	for _, s := range []string{"", "sni=a.example.com", "pool=", "pool=web colour=blue", "pool web"} {
+		_, err := ParseRule(s)
+		require.ErrorIs(t, err, InvalidRule, s)
+	}
+}
+
+func TestRuleMatches(t *testing.T) {
+	scenarios := []struct {
+		name     string
+		rule     Rule
+		req      Request
+		expected bool
+	}{
+		{"catch all", Rule{Pool: "p"}, Request{}, true},
+		{"listener match", Rule{Pool: "p", Listener: "main"}, Request{Listener: "main"}, true},
+		{"listener mismatch", Rule{Pool: "p", Listener: "main"}, Request{Listener: "other"}, false},
+		{"exact sni", Rule{Pool: "p", SNI: "a.example.com"}, Request{SNI: "A.Example.com."}, true},
+		{"exact sni mismatch", Rule{Pool: "p", SNI: "a.example.com"}, Request{SNI: "b.example.com"}, false},
+		{"wildcard sni", Rule{Pool: "p", SNI: "*.example.com"}, Request{SNI: "a.b.example.com"}, true},
+		{"wildcard sni excludes apex", Rule{Pool: "p", SNI: "*.example.com"}, Request{SNI: "example.com"}, false},
+		{"sni required", Rule{Pool: "p", SNI: "a.example.com"}, Request{}, false},
+		{"group match", Rule{Pool: "p", ClientGroup: "staff"}, Request{ClientGroups: []string{"guests", "staff"}}, true},
+		{"group mismatch", Rule{Pool: "p", ClientGroup: "staff"}, Request{ClientGroups: []string{"guests"}}, false},
+		{"cert ou match", Rule{Pool: "p", CertOU: "prod"}, Request{CertOUs: []string{"eng", "prod"}}, true},
+		{"cert ou mismatch", Rule{Pool: "p", CertOU: "prod"}, Request{CertOUs: []string{"staging"}}, false},
+		{"cert san pattern", Rule{Pool: "p", CertSAN: "spiffe://example.com/prod/*"}, Request{CertSANs: []string{"a.example.com", "spiffe://example.com/prod/api"}}, true},
+		{"cert san pattern mismatch", Rule{Pool: "p", CertSAN: "spiffe://example.com/prod/*"}, Request{CertSANs: []string{"spiffe://example.com/staging/api"}}, false},
+		{"cert san required", Rule{Pool: "p", CertSAN: "*"}, Request{}, false},
+		{"all fields must match", Rule{Pool: "p", Listener: "main", ClientGroup: "staff"}, Request{Listener: "main"}, false},
+	}
+	for _, s := range scenarios {
+		t.Run(s.name, func(t *testing.T) {
+			require.Equal(t, s.expected, s.rule.Matches(s.req))
+		})
+	}
+}
+
+func TestTableRouteFirstMatchWins(t *testing.T) {
+	table := NewTable(
+		Rule{Pool: "admin", ClientGroup: "staff"},
+		Rule{Pool: "web", SNI: "*.example.com"},
+		Rule{Pool: "default"},
+	)
+	pool, ok := table.Route(Request{SNI: "www.example.com", ClientGroups: []string{"staff"}})
+	require.True(t, ok)
+	require.Equal(t, "admin", pool)
+
+	pool, ok = table.Route(Request{SNI: "www.example.com"})
+	require.True(t, ok)
+	require.Equal(t, "web", pool)
+
+	pool, ok = table.Route(Request{})
+	require.True(t, ok)
+	require.Equal(t, "default", pool)
+
+	_, ok = NewTable(Rule{Pool: "web", SNI: "*.example.com"}).Route(Request{})
+	require.False(t, ok)
+}
+
+func TestTableRouteIgnoringGroups(t *testing.T) {
+	table := NewTable(
+		Rule{Pool: "admin", Listener: "internal", ClientGroup: "staff"},
+		Rule{Pool: "internal", Listener: "internal"},
+		Rule{Pool: "web", SNI: "*.example.com", ClientGroup: "staff"},
+		Rule{Pool: "web", SNI: "*.example.com"},
+	)
+	// The route of connections to the internal listener depends on the client's groups.
+	_, ok := table.RouteIgnoringGroups(Request{Listener: "internal"})
+	require.False(t, ok)
+
+	// Every client is routed to the web pool, whatever its groups.
+	pool, ok := table.RouteIgnoringGroups(Request{Listener: "main", SNI: "www.example.com"})
+	require.True(t, ok)
+	require.Equal(t, "web", pool)
+
+	_, ok = table.RouteIgnoringGroups(Request{Listener: "main"})
+	require.False(t, ok)
+
+	// Routes depending on the client's certificate are unknown until it is authenticated.
+	table = NewTable(Rule{Pool: "prod", CertOU: "prod"}, Rule{Pool: "default"})
+	_, ok = table.RouteIgnoringGroups(Request{CertOUs: []string{"prod"}})
+	require.False(t, ok)
+}
+
+func TestRequestSetCertificate(t *testing.T) {
+	uri, err := url.Parse("spiffe://example.com/prod/api")
+	require.NoError(t, err)
+	cert := &x509.Certificate{
+		Subject:        pkix.Name{OrganizationalUnit: []string{"prod"}},
+		DNSNames:       []string{"api.example.com"},
+		EmailAddresses: []string{"api@example.com"},
+		IPAddresses:    []net.IP{net.ParseIP("10.0.0.1")},
+		URIs:           []*url.URL{uri},
+	}
+	req := Request{Listener: "main"}
+	req.SetCertificate(cert)
+	require.Equal(t, []string{"prod"}, req.CertOUs)
+	require.Equal(t, []string{"api.example.com", "api@example.com", "10.0.0.1", "spiffe://example.com/prod/api"}, req.CertSANs)
+
+	pool, ok := NewTable(
+		Rule{Pool: "staging", CertOU: "staging"},
+		Rule{Pool: "prod", CertSAN: "spiffe://example.com/prod/*"},
+	).Route(req)
+	require.True(t, ok)
+	require.Equal(t, "prod", pool)
+}
@@ -0,0 +1,95 @@
+package slog
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	JournaldOutput = "journald" // JournaldOutput selects systemd-journald, see NewJournaldLogger.
+
+	journaldSocketPath = "/run/systemd/journal/socket"
+	journaldIdentifier = "tcplb"
+)
+
+var NoJournaldSocket = errors.New("could not connect to journald socket")
+
+// journaldAppendField appends a field to buf in the journald native
+// protocol format. Values containing newlines use the length-prefixed
+// binary encoding.
+func journaldAppendField(buf *bytes.Buffer, name, value string) {
+	buf.WriteString(name)
+	if strings.ContainsRune(value, '\n') {
+		buf.WriteByte('\n')
+		var size [8]byte
+		binary.LittleEndian.PutUint64(size[:], uint64(len(value)))
+		buf.Write(size[:])
+	} else {
+		buf.WriteByte('=')
+	}
+	buf.WriteString(value)
+	buf.WriteByte('\n')
+}
+
+// encodeJournald formats records as journald native protocol datagrams.
+// Record fields are mapped to TCPLB_* journal fields so they can be
+// matched with journalctl, e.g. journalctl TCPLB_CLIENTID_KEY=alice.
+func encodeJournald(payload *recordPayload) []byte {
+	var buf bytes.Buffer
+	journaldAppendField(&buf, "MESSAGE", payload.Msg)
+	journaldAppendField(&buf, "PRIORITY", strconv.Itoa(syslogSeverity(payload.Level)))
+	journaldAppendField(&buf, "SYSLOG_IDENTIFIER", journaldIdentifier)
+	journaldAppendField(&buf, "TCPLB_LEVEL", string(payload.Level))
+	if payload.ClientID != nil {
+		journaldAppendField(&buf, "TCPLB_CLIENTID_NAMESPACE", payload.ClientID.Namespace)
+		journaldAppendField(&buf, "TCPLB_CLIENTID_KEY", payload.ClientID.Key)
+	}
+	if payload.Upstream != nil {
+		journaldAppendField(&buf, "TCPLB_UPSTREAM_NETWORK", payload.Upstream.Network)
+		journaldAppendField(&buf, "TCPLB_UPSTREAM_ADDRESS", payload.Upstream.Address)
+	}
+	if payload.Reason != "" {
+		journaldAppendField(&buf, "TCPLB_REASON", string(payload.Reason))
+	}
+	if payload.Error != nil {
+		journaldAppendField(&buf, "TCPLB_ERROR", payload.Error.Error)
+		journaldAppendField(&buf, "TCPLB_ERROR_TYPE", payload.Error.Type)
+	}
+	if payload.Details != nil {
+		details, err := json.Marshal(payload.Details)
+		if err != nil {
+			details = []byte(fmt.Sprintf("%+v", payload.Details))
+		}
+		journaldAppendField(&buf, "TCPLB_DETAILS", string(details))
+	}
+	if payload.StackTrace != "" {
+		journaldAppendField(&buf, "TCPLB_STACKTRACE", payload.StackTrace)
+	}
+	return buf.Bytes()
+}
+
+// NewJournaldLogger returns a StreamLogger that writes records to
+// systemd-journald using its native protocol, with record fields mapped
+// to structured journal fields.
+//
+// The caller is responsible for closing the returned io.Closer.
+func NewJournaldLogger(level Level) (*StreamLogger, io.Closer, error) {
+	conn, err := dialUnixgram([]string{journaldSocketPath})
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %v", NoJournaldSocket, err)
+	}
+	logger := &StreamLogger{
+		severity: level.severity(),
+		encode:   encodeJournald,
+		now:      time.Now,
+		out:      conn,
+	}
+	return logger, conn, nil
+}
@@ -0,0 +1,213 @@
+package slog
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultSamplingMaxClasses = 1024
+)
+
+// SamplingOptions configures a SamplingLogger.
+type SamplingOptions struct {
+	// Burst is the maximum number of records of each message class that
+	// are written per Interval. Records beyond this are suppressed.
+	Burst int
+	// Interval is the length of the sampling window.
+	Interval time.Duration
+	// MaxClasses bounds the number of message classes tracked at once, to
+	// bound memory use. Records of untracked classes are not sampled.
+	// Defaults to DefaultSamplingMaxClasses.
+	MaxClasses int
+}
+
+type sampleClass struct {
+	level       Level
+	msg         string
+	windowStart time.Time
+	count       int
+	suppressed  int
+}
+
+// SamplingLogger is a Logger that rate limits records per message class
+// before passing them to an Inner Logger. A message class is the pair of
+// level and Msg. Once more than Burst records of a class have been logged
+// within an Interval, further records of that class are suppressed until
+// the next Interval begins, at which point a single summary record with the
+// count of suppressed records is written.
+//
+// This prevents noisy events (e.g. scanner traffic failing handshakes, or
+// every connection failing to dial a dead upstream) from flooding the log.
+//
+// Multiple goroutines may invoke methods on a SamplingLogger simultaneously.
+type SamplingLogger struct {
+	Inner Logger
+
+	opts SamplingOptions
+	now  func() time.Time
+
+	mu      sync.Mutex // mu guards classes
+	classes map[string]*sampleClass
+}
+
+// NewSamplingLogger returns a new SamplingLogger wrapping inner.
+func NewSamplingLogger(inner Logger, opts SamplingOptions) *SamplingLogger {
+	if opts.MaxClasses <= 0 {
+		opts.MaxClasses = DefaultSamplingMaxClasses
+	}
+	return &SamplingLogger{
+		Inner:   inner,
+		opts:    opts,
+		now:     time.Now,
+		classes: make(map[string]*sampleClass),
+	}
+}
+
+type suppressedSummary struct {
+	Msg        string `json:"msg"`
+	Suppressed int    `json:"suppressed"`
+}
+
+func (s *SamplingLogger) summarise(c *sampleClass) *LogRecord {
+	return &LogRecord{
+		Msg:     fmt.Sprintf("SamplingLogger: suppressed %d records", c.suppressed),
+		Details: suppressedSummary{Msg: c.msg, Suppressed: c.suppressed},
+	}
+}
+
+func (s *SamplingLogger) emit(level Level, record *LogRecord) {
+	switch level {
+	case DebugLevel:
+		s.Inner.Debug(record)
+	case InfoLevel:
+		s.Inner.Info(record)
+	case WarnLevel:
+		s.Inner.Warn(record)
+	default:
+		s.Inner.Error(record)
+	}
+}
+
+// admit decides if a record should be written. If a summary of a previous
+// window is due, it is returned.
+func (s *SamplingLogger) admit(level Level, record *LogRecord) (bool, *LogRecord) {
+	msg := ""
+	if record != nil {
+		msg = record.Msg
+	}
+	key := string(level) + "\x00" + msg
+	now := s.now()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, exists := s.classes[key]
+	if !exists {
+		if len(s.classes) >= s.opts.MaxClasses {
+			return true, nil
+		}
+		c = &sampleClass{level: level, msg: msg, windowStart: now}
+		s.classes[key] = c
+	}
+	var summary *LogRecord
+	if now.Sub(c.windowStart) >= s.opts.Interval {
+		if c.suppressed > 0 {
+			summary = s.summarise(c)
+		}
+		c.windowStart = now
+		c.count = 0
+		c.suppressed = 0
+	}
+	if c.count >= s.opts.Burst {
+		c.suppressed++
+		return false, summary
+	}
+	c.count++
+	return true, summary
+}
+
+func (s *SamplingLogger) log(level Level, record *LogRecord) {
+	ok, summary := s.admit(level, record)
+	if summary != nil {
+		s.emit(level, summary)
+	}
+	if ok {
+		s.emit(level, record)
+	}
+}
+
+// Flush writes summaries for message classes whose sampling window has
+// ended with suppressed records, and forgets classes that have been idle
+// for a whole window. It should be called periodically, so suppressed
+// records are reported even if their message class falls silent.
+func (s *SamplingLogger) Flush() {
+	s.flush(false)
+}
+
+func (s *SamplingLogger) flush(force bool) {
+	now := s.now()
+	var summaries []*sampleClass
+	s.mu.Lock()
+	for key, c := range s.classes {
+		if !force && now.Sub(c.windowStart) < s.opts.Interval {
+			continue
+		}
+		if c.suppressed > 0 {
+			summary := *c
+			summaries = append(summaries, &summary)
+		}
+		delete(s.classes, key)
+	}
+	s.mu.Unlock()
+	for _, c := range summaries {
+		s.emit(c.level, s.summarise(c))
+	}
+}
+
+// StartFlusher starts a goroutine that calls Flush once per Interval.
+// The returned stop function stops the goroutine and writes summaries for
+// all suppressed records, including those of windows that have not ended.
+func (s *SamplingLogger) StartFlusher() (stop func()) {
+	ticker := time.NewTicker(s.opts.Interval)
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		for {
+			select {
+			case <-ticker.C:
+				s.Flush()
+			case <-done:
+				return
+			}
+		}
+	}()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			ticker.Stop()
+			close(done)
+			<-stopped
+			s.flush(true)
+		})
+	}
+}
+
+func (s *SamplingLogger) Debug(record *LogRecord) {
+	s.log(DebugLevel, record)
+}
+
+func (s *SamplingLogger) Info(record *LogRecord) {
+	s.log(InfoLevel, record)
+}
+
+func (s *SamplingLogger) Warn(record *LogRecord) {
+	s.log(WarnLevel, record)
+}
+
+func (s *SamplingLogger) Error(record *LogRecord) {
+	s.log(ErrorLevel, record)
+}
+
+var _ Logger = (*SamplingLogger)(nil) // type check
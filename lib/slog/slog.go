@@ -1,44 +1,110 @@
-// Package slog is a logger interface offering a uniformly unpleasant
-// and wearying experience for application developers, users and operators.
+// Package slog is the structured, leveled logger used for operational
+// log messages by the server.
 //
-// TODO replace this entirely with something else. Maybe zerolog?
+// Records are written one per line, either as JSON (for machines) or as
+// a human-readable console format, to a configurable destination. Records
+// below the configured minimum Level are discarded. The level may be changed
+// at runtime with SetLevel.
 package slog
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"tcplb/lib/core"
+	"time"
 )
 
+// Level is the severity of a log record.
+type Level string
+
+const (
+	DebugLevel Level = "debug"
+	InfoLevel  Level = "info"
+	WarnLevel  Level = "warn"
+	ErrorLevel Level = "error"
+)
+
+// Format is the encoding used to write log records.
+type Format string
+
 const (
-	InfoLevel  = "info"
-	WarnLevel  = "warn"
-	ErrorLevel = "error"
+	JSONFormat    Format = "json"    // JSONFormat writes one JSON object per line.
+	ConsoleFormat Format = "console" // ConsoleFormat writes human-readable lines.
 )
 
+// Output destinations for OpenOutput that are not file paths.
+const (
+	StdoutOutput = "stdout"
+	StderrOutput = "stderr"
+)
+
+var InvalidLevel = errors.New("invalid log level")
+var InvalidFormat = errors.New("invalid log format")
+
+func (l Level) severity() int32 {
+	switch l {
+	case DebugLevel:
+		return 0
+	case InfoLevel:
+		return 1
+	case WarnLevel:
+		return 2
+	case ErrorLevel:
+		return 3
+	default:
+		return 3
+	}
+}
+
+var levelsBySeverity = [...]Level{DebugLevel, InfoLevel, WarnLevel, ErrorLevel}
+
+// ParseLevel parses a Level from its name, e.g. "warn".
+func ParseLevel(s string) (Level, error) {
+	switch l := Level(strings.ToLower(s)); l {
+	case DebugLevel, InfoLevel, WarnLevel, ErrorLevel:
+		return l, nil
+	default:
+		return "", fmt.Errorf("%w: %q (expected one of debug, info, warn, error)", InvalidLevel, s)
+	}
+}
+
+// ParseFormat parses a Format from its name, e.g. "json".
+func ParseFormat(s string) (Format, error) {
+	switch f := Format(strings.ToLower(s)); f {
+	case JSONFormat, ConsoleFormat:
+		return f, nil
+	default:
+		return "", fmt.Errorf("%w: %q (expected one of json, console)", InvalidFormat, s)
+	}
+}
+
 // LogRecord holds data for a single server log record.
 type LogRecord struct {
-	Msg        string         `json:"msg,omitempty"`        // Msg is an optional log message
-	Error      error          `json:"error,omitempty"`      // Error is an optional error
-	Details    any            `json:"details,omitempty"`    // Details are optional details
-	StackTrace string         `json:"stacktrace,omitempty"` // StackTrace is optional stack trace
-	ClientID   *core.ClientID `json:"clientid,omitempty"`   // ClientID is optional id of client, if known.
-	Upstream   *core.Upstream `json:"upstream,omitempty"`   // Upstream is optional upstream, if known.
+	Msg        string          `json:"msg,omitempty"`        // Msg is an optional log message
+	Error      error           `json:"error,omitempty"`      // Error is an optional error
+	Details    any             `json:"details,omitempty"`    // Details are optional details
+	StackTrace string          `json:"stacktrace,omitempty"` // StackTrace is optional stack trace
+	ClientID   *core.ClientID  `json:"clientid,omitempty"`   // ClientID is optional id of client, if known.
+	Upstream   *core.Upstream  `json:"upstream,omitempty"`   // Upstream is optional upstream, if known.
+	Reason     core.ReasonCode `json:"reason,omitempty"`     // Reason is optional code of why the connection was rejected or ended.
 }
 
 // Logger is an abstract log interface for the server.
 //
 // Multiple goroutines may invoke methods on a Logger simultaneously.
 type Logger interface {
+	Debug(record *LogRecord)
 	Info(record *LogRecord)
 	Warn(record *LogRecord)
 	Error(record *LogRecord)
 }
 
-// TODO make the log output less awful to read by humans and machines.
-type stdlibLogShim struct{}
-
 type errorPayload struct {
 	Type  string `json:"type,omitempty"`  // Type is the error type
 	Error string `json:"error,omitempty"` // Error is the error message
@@ -55,18 +121,22 @@ func asErrorPayload(err error) *errorPayload {
 }
 
 type recordPayload struct {
-	Msg        string         `json:"msg,omitempty"`        // Msg is an optional log message
-	Error      *errorPayload  `json:"error,omitempty"`      // Error is an optional error
-	Details    any            `json:"details,omitempty"`    // Details are optional details
-	StackTrace string         `json:"stacktrace,omitempty"` // StackTrace is optional stack trace
-	ClientID   *core.ClientID `json:"clientid,omitempty"`   // ClientID is optional id of client, if known.
-	Upstream   *core.Upstream `json:"upstream,omitempty"`   // Upstream is optional upstream, if known.
-	Level      string         `json:"level,omitempty"`
-}
-
-func logRecordAsSemiJSON(level string, record *LogRecord) {
-	var payload recordPayload
-	payload.Level = level
+	Time       string          `json:"time"`                 // Time is the RFC3339 timestamp of the record
+	Level      Level           `json:"level"`                // Level is the severity of the record
+	Msg        string          `json:"msg,omitempty"`        // Msg is an optional log message
+	Error      *errorPayload   `json:"error,omitempty"`      // Error is an optional error
+	Details    any             `json:"details,omitempty"`    // Details are optional details
+	StackTrace string          `json:"stacktrace,omitempty"` // StackTrace is optional stack trace
+	ClientID   *core.ClientID  `json:"clientid,omitempty"`   // ClientID is optional id of client, if known.
+	Upstream   *core.Upstream  `json:"upstream,omitempty"`   // Upstream is optional upstream, if known.
+	Reason     core.ReasonCode `json:"reason,omitempty"`     // Reason is optional code of why the connection was rejected or ended.
+}
+
+func newRecordPayload(t time.Time, level Level, record *LogRecord) *recordPayload {
+	payload := &recordPayload{
+		Time:  t.UTC().Format(time.RFC3339Nano),
+		Level: level,
+	}
 	if record != nil {
 		payload.Msg = record.Msg
 		payload.Error = asErrorPayload(record.Error)
@@ -74,29 +144,161 @@ func logRecordAsSemiJSON(level string, record *LogRecord) {
 		payload.StackTrace = record.StackTrace
 		payload.ClientID = record.ClientID
 		payload.Upstream = record.Upstream
+		payload.Reason = record.Reason
 	}
+	return payload
+}
 
-	data, _ := json.Marshal(&payload)
+func encodeJSON(payload *recordPayload) []byte {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		// Details may hold values that cannot be marshalled. Don't lose the rest.
+		payload.Details = fmt.Sprintf("%+v", payload.Details)
+		data, _ = json.Marshal(payload)
+	}
+	return append(data, '\n')
+}
 
-	// TODO put the timestamps in the JSON as well.
-	log.Println(string(data))
+func encodeConsole(payload *recordPayload) []byte {
+	var b strings.Builder
+	b.WriteString(payload.Time)
+	b.WriteByte(' ')
+	b.WriteString(strings.ToUpper(string(payload.Level)))
+	b.WriteByte(' ')
+	b.WriteString(payload.Msg)
+	if payload.ClientID != nil {
+		fmt.Fprintf(&b, " clientid=%s", payload.ClientID)
+	}
+	if payload.Upstream != nil {
+		fmt.Fprintf(&b, " upstream=%s/%s", payload.Upstream.Network, payload.Upstream.Address)
+	}
+	if payload.Reason != "" {
+		fmt.Fprintf(&b, " reason=%s", payload.Reason)
+	}
+	if payload.Error != nil {
+		fmt.Fprintf(&b, " error=%q", payload.Error.Error)
+	}
+	if payload.Details != nil {
+		fmt.Fprintf(&b, " details=%+v", payload.Details)
+	}
+	if payload.StackTrace != "" {
+		b.WriteString("\n")
+		b.WriteString(payload.StackTrace)
+	}
+	b.WriteByte('\n')
+	return []byte(b.String())
 }
 
-func (s *stdlibLogShim) Info(record *LogRecord) {
-	logRecordAsSemiJSON(InfoLevel, record)
+// Options configures a StreamLogger.
+type Options struct {
+	Level  Level     // Level is the minimum level of records to write. Defaults to InfoLevel.
+	Format Format    // Format is the encoding of written records. Defaults to JSONFormat.
+	Output io.Writer // Output is where records are written. Defaults to os.Stderr.
 }
 
-func (s *stdlibLogShim) Warn(record *LogRecord) {
-	logRecordAsSemiJSON(WarnLevel, record)
+// StreamLogger is a Logger that encodes records and writes them to an
+// io.Writer, discarding records below its minimum level.
+//
+// Multiple goroutines may invoke methods on a StreamLogger simultaneously.
+type StreamLogger struct {
+	severity int32 // severity is the minimum severity to log. Accessed atomically.
+	encode   func(payload *recordPayload) []byte
+	now      func() time.Time
+
+	mu  sync.Mutex // mu guards out
+	out io.Writer
+}
+
+// NewLogger returns a new StreamLogger configured by opts.
+func NewLogger(opts Options) *StreamLogger {
+	if opts.Level == "" {
+		opts.Level = InfoLevel
+	}
+	if opts.Output == nil {
+		opts.Output = os.Stderr
+	}
+	encode := encodeJSON
+	if opts.Format == ConsoleFormat {
+		encode = encodeConsole
+	}
+	return &StreamLogger{
+		severity: opts.Level.severity(),
+		encode:   encode,
+		now:      time.Now,
+		out:      opts.Output,
+	}
+}
+
+// SetLevel changes the minimum level of records to write.
+func (s *StreamLogger) SetLevel(level Level) {
+	atomic.StoreInt32(&s.severity, level.severity())
+}
+
+// Level returns the minimum level of records to write.
+func (s *StreamLogger) Level() Level {
+	return levelsBySeverity[atomic.LoadInt32(&s.severity)]
+}
+
+// Enabled reports if records at the given level would be written.
+func (s *StreamLogger) Enabled(level Level) bool {
+	return level.severity() >= atomic.LoadInt32(&s.severity)
+}
+
+func (s *StreamLogger) log(level Level, record *LogRecord) {
+	if !s.Enabled(level) {
+		return
+	}
+	data := s.encode(newRecordPayload(s.now(), level, record))
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// There is nowhere sensible to report a failure to write a log record.
+	_, _ = s.out.Write(data)
 }
 
-func (s *stdlibLogShim) Error(record *LogRecord) {
-	logRecordAsSemiJSON(ErrorLevel, record)
+func (s *StreamLogger) Debug(record *LogRecord) {
+	s.log(DebugLevel, record)
 }
 
-// GetDefaultLogger returns the default Logger.
+func (s *StreamLogger) Info(record *LogRecord) {
+	s.log(InfoLevel, record)
+}
+
+func (s *StreamLogger) Warn(record *LogRecord) {
+	s.log(WarnLevel, record)
+}
+
+func (s *StreamLogger) Error(record *LogRecord) {
+	s.log(ErrorLevel, record)
+}
+
+var _ Logger = (*StreamLogger)(nil) // type check
+
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error { return nil }
+
+// OpenOutput opens the named log output destination for writing. The output
+// is one of StdoutOutput, StderrOutput, or otherwise is interpreted as the
+// path of a file to append to.
+//
+// The caller is responsible for closing the returned io.WriteCloser.
+func OpenOutput(output string) (io.WriteCloser, error) {
+	switch output {
+	case StdoutOutput:
+		return nopCloser{os.Stdout}, nil
+	case StderrOutput:
+		return nopCloser{os.Stderr}, nil
+	default:
+		return os.OpenFile(output, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	}
+}
+
+// GetDefaultLogger returns the default Logger, which writes records at
+// InfoLevel and above as JSON to stderr.
 func GetDefaultLogger() Logger {
-	return &stdlibLogShim{}
+	return NewLogger(Options{})
 }
 
 // RecordingLogger captures all logged events in memory.
@@ -106,10 +308,14 @@ type RecordingLogger struct {
 }
 
 type Event struct {
-	Level string
+	Level Level
 	*LogRecord
 }
 
+func (l *RecordingLogger) Debug(record *LogRecord) {
+	l.Events = append(l.Events, Event{Level: DebugLevel, LogRecord: record})
+}
+
 func (l *RecordingLogger) Info(record *LogRecord) {
 	l.Events = append(l.Events, Event{Level: InfoLevel, LogRecord: record})
 }
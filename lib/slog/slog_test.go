@@ -0,0 +1,170 @@
+package slog
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"github.com/stretchr/testify/require"
+	"strings"
+	"tcplb/lib/core"
+	"testing"
+	"time"
+)
+
+func fixedTime() time.Time {
+	return time.Date(2022, 5, 1, 12, 30, 0, 0, time.UTC)
+}
+
+func TestParseLevel(t *testing.T) {
+	level, err := ParseLevel("WARN")
+	require.NoError(t, err)
+	require.Equal(t, WarnLevel, level)
+
+	_, err = ParseLevel("loud")
+	require.ErrorIs(t, err, InvalidLevel)
+}
+
+func TestParseFormat(t *testing.T) {
+	format, err := ParseFormat("console")
+	require.NoError(t, err)
+	require.Equal(t, ConsoleFormat, format)
+
+	_, err = ParseFormat("xml")
+	require.ErrorIs(t, err, InvalidFormat)
+}
+
+func TestStreamLoggerFiltersByLevel(t *testing.T) {
+	var buf bytes.Buffer
+	logger := NewLogger(Options{Level: WarnLevel, Output: &buf})
+
+	logger.Debug(&LogRecord{Msg: "d"})
+	logger.Info(&LogRecord{Msg: "i"})
+	logger.Warn(&LogRecord{Msg: "w"})
+	logger.Error(&LogRecord{Msg: "e"})
+	require.Equal(t, 2, strings.Count(buf.String(), "\n"))
+
+	buf.Reset()
+	logger.SetLevel(DebugLevel)
+	require.True(t, logger.Enabled(DebugLevel))
+	logger.Debug(&LogRecord{Msg: "d"})
+	require.Equal(t, 1, strings.Count(buf.String(), "\n"))
+}
+
+func TestStreamLoggerJSONFormat(t *testing.T) {
+	var buf bytes.Buffer
+	logger := NewLogger(Options{Format: JSONFormat, Output: &buf})
+	logger.now = fixedTime
+
+	clientID := core.ClientID{Namespace: "slog_test", Key: "alice"}
+	logger.Error(&LogRecord{Msg: "boom", Error: errors.New("bad"), ClientID: &clientID, Reason: "internal_error"})
+
+	var got map[string]any
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &got))
+	require.Equal(t, "2022-05-01T12:30:00Z", got["time"])
+	require.Equal(t, "error", got["level"])
+	require.Equal(t, "boom", got["msg"])
+	require.Equal(t, "bad", got["error"].(map[string]any)["error"])
+	require.Equal(t, "alice", got["clientid"].(map[string]any)["Key"])
+	require.Equal(t, "internal_error", got["reason"])
+}
+
+func TestStreamLoggerJSONFormatUnmarshallableDetails(t *testing.T) {
+	var buf bytes.Buffer
+	logger := NewLogger(Options{Format: JSONFormat, Output: &buf})
+	logger.Info(&LogRecord{Msg: "chan", Details: make(chan int)})
+
+	var got map[string]any
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &got))
+	require.Equal(t, "chan", got["msg"])
+	require.NotEmpty(t, got["details"])
+}
+
+func TestStreamLoggerConsoleFormat(t *testing.T) {
+	var buf bytes.Buffer
+	logger := NewLogger(Options{Format: ConsoleFormat, Output: &buf})
+	logger.now = fixedTime
+
+	upstream := core.Upstream{Network: "tcp", Address: "localhost:1234"}
+	logger.Warn(&LogRecord{Msg: "slow", Upstream: &upstream, Reason: "dial_failed", Error: errors.New("timeout")})
+
+	require.Equal(t, "2022-05-01T12:30:00Z WARN slow upstream=tcp/localhost:1234 reason=dial_failed error=\"timeout\"\n", buf.String())
+}
+
+func TestSamplingLoggerSuppressesBeyondBurst(t *testing.T) {
+	inner := &RecordingLogger{}
+	logger := NewSamplingLogger(inner, SamplingOptions{Burst: 2, Interval: time.Second})
+	now := fixedTime()
+	logger.now = func() time.Time { return now }
+
+	for i := 0; i < 5; i++ {
+		logger.Warn(&LogRecord{Msg: "noisy"})
+	}
+	logger.Warn(&LogRecord{Msg: "quiet"})
+	logger.Error(&LogRecord{Msg: "noisy"}) // different level is a different class
+	require.Len(t, inner.Events, 4)
+
+	// Next window: first record of the class triggers a summary.
+	now = now.Add(time.Second)
+	logger.Warn(&LogRecord{Msg: "noisy"})
+	require.Len(t, inner.Events, 6)
+	summary := inner.Events[4]
+	require.Equal(t, WarnLevel, summary.Level)
+	require.Equal(t, suppressedSummary{Msg: "noisy", Suppressed: 3}, summary.Details)
+	require.Equal(t, "noisy", inner.Events[5].Msg)
+}
+
+func TestSamplingLoggerFlushReportsSilentClasses(t *testing.T) {
+	inner := &RecordingLogger{}
+	logger := NewSamplingLogger(inner, SamplingOptions{Burst: 1, Interval: time.Second})
+	now := fixedTime()
+	logger.now = func() time.Time { return now }
+
+	logger.Info(&LogRecord{Msg: "noisy"})
+	logger.Info(&LogRecord{Msg: "noisy"})
+	logger.Flush() // window has not ended yet
+	require.Len(t, inner.Events, 1)
+
+	now = now.Add(2 * time.Second)
+	logger.Flush()
+	require.Len(t, inner.Events, 2)
+	require.Equal(t, suppressedSummary{Msg: "noisy", Suppressed: 1}, inner.Events[1].Details)
+
+	logger.mu.Lock()
+	require.Empty(t, logger.classes)
+	logger.mu.Unlock()
+}
+
+func TestSamplingLoggerMaxClasses(t *testing.T) {
+	inner := &RecordingLogger{}
+	logger := NewSamplingLogger(inner, SamplingOptions{Burst: 1, Interval: time.Second, MaxClasses: 1})
+	logger.Info(&LogRecord{Msg: "a"})
+	for i := 0; i < 3; i++ {
+		logger.Info(&LogRecord{Msg: "b"}) // untracked class, never sampled
+	}
+	require.Len(t, inner.Events, 4)
+}
+
+func TestSyslogEncoderRFC5424(t *testing.T) {
+	encode := newSyslogEncoder("host1", 42)
+	clientID := core.ClientID{Namespace: "slog_test", Key: `ali"ce]`}
+	payload := newRecordPayload(fixedTime().Add(1234567), WarnLevel, &LogRecord{Msg: "rate limited", ClientID: &clientID})
+	got := string(encode(payload))
+	require.Equal(t, `<28>1 2022-05-01T12:30:00.001234Z host1 tcplb 42 - [tcplb@32473 clientid="slog_test/ali\"ce\]"] rate limited`, got)
+
+	payload = newRecordPayload(fixedTime(), InfoLevel, &LogRecord{Msg: "plain"})
+	require.Equal(t, `<30>1 2022-05-01T12:30:00Z host1 tcplb 42 - - plain`, string(encode(payload)))
+}
+
+func TestJournaldEncoderFields(t *testing.T) {
+	upstream := core.Upstream{Network: "tcp", Address: "localhost:1234"}
+	payload := newRecordPayload(fixedTime(), ErrorLevel, &LogRecord{
+		Msg:        "dial failed",
+		Upstream:   &upstream,
+		StackTrace: "a\nb",
+	})
+	got := encodeJournald(payload)
+	require.True(t, bytes.HasPrefix(got, []byte("MESSAGE=dial failed\nPRIORITY=3\nSYSLOG_IDENTIFIER=tcplb\nTCPLB_LEVEL=error\n")))
+	require.Contains(t, string(got), "TCPLB_UPSTREAM_ADDRESS=localhost:1234\n")
+	// multi-line values use the binary length-prefixed encoding
+	require.True(t, bytes.HasSuffix(got, []byte("TCPLB_STACKTRACE\n\x03\x00\x00\x00\x00\x00\x00\x00a\nb\n")))
+}
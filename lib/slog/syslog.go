@@ -0,0 +1,136 @@
+package slog
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	SyslogOutput = "syslog" // SyslogOutput selects the local syslog daemon, see NewSyslogLogger.
+
+	syslogAppName        = "tcplb"
+	syslogFacilityDaemon = 3
+	// syslogSDID is the structured data ID for tcplb fields, of the form
+	// name@<private enterprise number>. 32473 is reserved for documentation
+	// by RFC5612.
+	syslogSDID = "tcplb@32473"
+	// syslogTimeFormat is RFC3339 limited to microseconds, as per RFC5424.
+	syslogTimeFormat = "2006-01-02T15:04:05.999999Z07:00"
+)
+
+// syslogSocketPaths are the usual locations of the local syslog socket.
+var syslogSocketPaths = []string{"/dev/log", "/var/run/syslog", "/var/run/log"}
+
+var NoSyslogSocket = errors.New("could not connect to local syslog socket")
+
+func syslogSeverity(level Level) int {
+	switch level {
+	case DebugLevel:
+		return 7
+	case InfoLevel:
+		return 6
+	case WarnLevel:
+		return 4
+	default:
+		return 3
+	}
+}
+
+// syslogEscapeParamValue escapes a structured data PARAM-VALUE as per
+// RFC5424 section 6.3.3.
+func syslogEscapeParamValue(s string) string {
+	r := strings.NewReplacer(`\`, `\\`, `"`, `\"`, `]`, `\]`)
+	return r.Replace(s)
+}
+
+func syslogNilValue(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// newSyslogEncoder returns an encoder that formats records as RFC5424
+// syslog messages. Record fields other than Msg are written as structured
+// data parameters.
+func newSyslogEncoder(hostname string, pid int) func(payload *recordPayload) []byte {
+	hostname = syslogNilValue(hostname)
+	return func(payload *recordPayload) []byte {
+		var params []string
+		param := func(name, value string) {
+			params = append(params, fmt.Sprintf(`%s="%s"`, name, syslogEscapeParamValue(value)))
+		}
+		if payload.ClientID != nil {
+			param("clientid", payload.ClientID.String())
+		}
+		if payload.Upstream != nil {
+			param("upstream", payload.Upstream.Network+":"+payload.Upstream.Address)
+		}
+		if payload.Reason != "" {
+			param("reason", string(payload.Reason))
+		}
+		if payload.Error != nil {
+			param("error", payload.Error.Error)
+			param("error_type", payload.Error.Type)
+		}
+		if payload.Details != nil {
+			details, err := json.Marshal(payload.Details)
+			if err != nil {
+				details = []byte(fmt.Sprintf("%+v", payload.Details))
+			}
+			param("details", string(details))
+		}
+		sd := "-"
+		if len(params) > 0 {
+			sd = "[" + syslogSDID + " " + strings.Join(params, " ") + "]"
+		}
+		timestamp := payload.Time
+		if t, err := time.Parse(time.RFC3339Nano, payload.Time); err == nil {
+			timestamp = t.Format(syslogTimeFormat)
+		}
+		pri := syslogFacilityDaemon*8 + syslogSeverity(payload.Level)
+		msg := fmt.Sprintf("<%d>1 %s %s %s %d - %s %s",
+			pri, timestamp, hostname, syslogAppName, pid, sd, payload.Msg)
+		if payload.StackTrace != "" {
+			msg += "\n" + payload.StackTrace
+		}
+		return []byte(msg)
+	}
+}
+
+func dialUnixgram(paths []string) (net.Conn, error) {
+	var lastErr error
+	for _, path := range paths {
+		conn, err := net.Dial("unixgram", path)
+		if err == nil {
+			return conn, nil
+		}
+		lastErr = err
+	}
+	return nil, lastErr
+}
+
+// NewSyslogLogger returns a StreamLogger that writes RFC5424 formatted
+// records to the local syslog daemon over its unix datagram socket.
+//
+// The caller is responsible for closing the returned io.Closer.
+func NewSyslogLogger(level Level) (*StreamLogger, io.Closer, error) {
+	conn, err := dialUnixgram(syslogSocketPaths)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %v", NoSyslogSocket, err)
+	}
+	hostname, _ := os.Hostname()
+	logger := &StreamLogger{
+		severity: level.severity(),
+		encode:   newSyslogEncoder(hostname, os.Getpid()),
+		now:      time.Now,
+		out:      conn,
+	}
+	return logger, conn, nil
+}
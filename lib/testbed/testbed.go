@@ -0,0 +1,185 @@
+// Package testbed generates the certificates that tests of TLS and mutual
+// TLS authentication need, so that tests do not depend on fixtures outside
+// of the repository.
+//
+// A Testbed is a CA that issues server and client certificates, writing
+// each as PEM files into a temporary directory that is removed when the
+// test finishes. Servers are valid for localhost and the loopback
+// addresses. Clients carry their client ID as the common name of their
+// certificate, as authn.ExtractCanonicalClientID expects.
+//
+// This package is intended for use in tests, not in the serving path.
+package testbed
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// validity is how long before and after the time of issue that
+// certificates are valid for.
+const validity = 24 * time.Hour
+
+// Testbed is a CA issuing certificates into the directory Root.
+//
+// Multiple goroutines may invoke methods on a Testbed simultaneously.
+type Testbed struct {
+	Root   string            // Root is the directory that certificates and keys are written to.
+	CA     *x509.Certificate // CA is the certificate of the CA.
+	CAFile string            // CAFile is the path of the PEM certificate of the CA.
+
+	key    *ecdsa.PrivateKey
+	mu     sync.Mutex // mu guards serial
+	serial int64
+}
+
+// Identity is a certificate issued by a Testbed, with its key.
+type Identity struct {
+	Name        string          // Name is the common name of the certificate.
+	CertFile    string          // CertFile is the path of the PEM certificate.
+	KeyFile     string          // KeyFile is the path of the PEM private key.
+	Certificate tls.Certificate // Certificate is the certificate and key, ready for use in a tls.Config.
+}
+
+// New returns a Testbed with a new CA, whose certificate is written into a
+// temporary directory that is removed when t finishes.
+func New(t testing.TB) *Testbed {
+	t.Helper()
+	key := generateKey(t)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "tcplb testbed CA"},
+		NotBefore:             time.Now().Add(-validity),
+		NotAfter:              time.Now().Add(validity),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("testbed: creating CA certificate: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("testbed: parsing CA certificate: %v", err)
+	}
+	tb := &Testbed{Root: t.TempDir(), CA: cert, key: key, serial: 1}
+	tb.CAFile = tb.write(t, "ca.pem", "CERTIFICATE", der)
+	return tb
+}
+
+// CertPool returns a pool holding the certificate of the CA.
+func (tb *Testbed) CertPool() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(tb.CA)
+	return pool
+}
+
+// Server issues a certificate for a server with the given name, valid for
+// name, localhost, 127.0.0.1 and ::1.
+func (tb *Testbed) Server(t testing.TB, name string) Identity {
+	t.Helper()
+	return tb.issue(t, name, x509.ExtKeyUsageServerAuth)
+}
+
+// Client issues a certificate for a client with the given name.
+func (tb *Testbed) Client(t testing.TB, name string) Identity {
+	t.Helper()
+	return tb.issue(t, name, x509.ExtKeyUsageClientAuth)
+}
+
+// ServerTLSConfig returns the TLS config of a server presenting the given
+// identity, that requires clients to present a certificate issued by the
+// CA.
+func (tb *Testbed) ServerTLSConfig(server Identity) *tls.Config {
+	return &tls.Config{
+		Certificates: []tls.Certificate{server.Certificate},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    tb.CertPool(),
+		MinVersion:   tls.VersionTLS12,
+	}
+}
+
+// ClientTLSConfig returns the TLS config of a client presenting the given
+// identity, that trusts servers whose certificate was issued by the CA. If
+// client has no Certificate, no certificate is presented.
+func (tb *Testbed) ClientTLSConfig(client Identity) *tls.Config {
+	config := &tls.Config{
+		RootCAs:    tb.CertPool(),
+		MinVersion: tls.VersionTLS12,
+	}
+	if client.Certificate.Certificate != nil {
+		config.Certificates = []tls.Certificate{client.Certificate}
+	}
+	return config
+}
+
+func (tb *Testbed) issue(t testing.TB, name string, usage x509.ExtKeyUsage) Identity {
+	t.Helper()
+	key := generateKey(t)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(tb.nextSerial()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-validity),
+		NotAfter:     time.Now().Add(validity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+	}
+	if usage == x509.ExtKeyUsageServerAuth {
+		template.DNSNames = []string{name, "localhost"}
+		template.IPAddresses = []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, tb.CA, &key.PublicKey, tb.key)
+	if err != nil {
+		t.Fatalf("testbed: creating certificate %q: %v", name, err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("testbed: marshalling key of %q: %v", name, err)
+	}
+	return Identity{
+		Name:        name,
+		CertFile:    tb.write(t, name+".pem", "CERTIFICATE", der),
+		KeyFile:     tb.write(t, name+"-key.pem", "EC PRIVATE KEY", keyDER),
+		Certificate: tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key},
+	}
+}
+
+func (tb *Testbed) nextSerial() int64 {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+	tb.serial++
+	return tb.serial
+}
+
+// write writes a PEM block of the given type into Root, returning its path.
+func (tb *Testbed) write(t testing.TB, name, blockType string, der []byte) string {
+	t.Helper()
+	path := filepath.Join(tb.Root, filepath.Base(name))
+	data := pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der})
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatalf("testbed: %v", err)
+	}
+	return path
+}
+
+func generateKey(t testing.TB) *ecdsa.PrivateKey {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("testbed: generating key: %v", err)
+	}
+	return key
+}
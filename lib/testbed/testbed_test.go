@@ -0,0 +1,88 @@
+package testbed
+
+import (
+	"crypto/tls"
+	"github.com/stretchr/testify/require"
+	"net"
+	"tcplb/lib/authn"
+	"tcplb/lib/core"
+	"testing"
+)
+
+func TestTestbedMutualTLS(t *testing.T) {
+	tb := New(t)
+	server := tb.Server(t, "tcplb.test")
+	client := tb.Client(t, "alice")
+
+	// The files written load as they would from fixtures.
+	for _, identity := range []Identity{server, client} {
+		_, err := tls.LoadX509KeyPair(identity.CertFile, identity.KeyFile)
+		require.NoError(t, err)
+	}
+	require.FileExists(t, tb.CAFile)
+
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", tb.ServerTLSConfig(server))
+	require.NoError(t, err)
+	defer listener.Close()
+	clientIDs := make(chan core.ClientID, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			close(clientIDs)
+			return
+		}
+		defer conn.Close()
+		tlsConn := conn.(*tls.Conn)
+		if tlsConn.Handshake() != nil {
+			close(clientIDs)
+			return
+		}
+		clientID, _ := authn.ExtractCanonicalClientID(tlsConn.ConnectionState().VerifiedChains)
+		clientIDs <- clientID
+	}()
+
+	conn, err := tls.Dial("tcp", listener.Addr().String(), tb.ClientTLSConfig(client))
+	require.NoError(t, err)
+	defer conn.Close()
+	require.Equal(t, core.ClientID{Namespace: authn.DefaultNamespace, Key: "alice"}, <-clientIDs)
+}
+
+func TestTestbedRejectsOtherCAs(t *testing.T) {
+	tb, other := New(t), New(t)
+	server := tb.Server(t, "tcplb.test")
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", tb.ServerTLSConfig(server))
+	require.NoError(t, err)
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			_ = conn.(*tls.Conn).Handshake()
+			_ = conn.Close()
+		}
+	}()
+
+	handshake := func(config *tls.Config) error {
+		conn, err := net.Dial("tcp", listener.Addr().String())
+		require.NoError(t, err)
+		defer conn.Close()
+		tlsConn := tls.Client(conn, config)
+		if err := tlsConn.Handshake(); err != nil {
+			return err
+		}
+		// With TLS 1.3, the server rejects the client certificate after
+		// the client considers the handshake complete.
+		_, err = tlsConn.Read(make([]byte, 1))
+		return err
+	}
+	// The server is not trusted by clients of the other CA.
+	require.Error(t, handshake(other.ClientTLSConfig(other.Client(t, "alice"))))
+	// Clients of the other CA are not trusted by the server.
+	config := tb.ClientTLSConfig(Identity{})
+	config.Certificates = []tls.Certificate{other.Client(t, "alice").Certificate}
+	require.Error(t, handshake(config))
+	// Neither are clients without a certificate.
+	require.Error(t, handshake(tb.ClientTLSConfig(Identity{})))
+}
@@ -0,0 +1,364 @@
+// Package trace records spans describing the lifecycle of forwarded
+// connections, so the latency of each stage (accept, handshake,
+// authentication, authorization, dial, forward) can be inspected with
+// a distributed tracing backend.
+//
+// A Tracer is only needed to start the root span for a connection. Stages
+// further down the handler stack call StartSpan with the context they were
+// given, which creates a child of whatever span is stored in that context.
+// If there is no span in the context, StartSpan returns a nil *Span, and
+// all methods of a nil *Span are no-ops, so handlers need not check whether
+// tracing is enabled.
+package trace
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"sync"
+	"time"
+)
+
+// TraceID identifies a single trace, i.e. a tree of spans.
+type TraceID [16]byte
+
+// SpanID identifies a single span within a trace.
+type SpanID [8]byte
+
+func (t TraceID) String() string { return hex.EncodeToString(t[:]) }
+
+func (s SpanID) String() string { return hex.EncodeToString(s[:]) }
+
+// IsZero reports if s is the zero SpanID, which denotes "no span".
+func (s SpanID) IsZero() bool { return s == SpanID{} }
+
+// SpanKind describes the relationship of a span to the connection it is
+// part of.
+type SpanKind int
+
+const (
+	// SpanKindInternal is the kind of spans for stages within tcplb.
+	SpanKindInternal SpanKind = iota
+	// SpanKindServer is the kind of root spans, for handling a client's connection.
+	SpanKindServer
+	// SpanKindClient is the kind of spans for connecting to an upstream.
+	SpanKindClient
+)
+
+// SpanData is an immutable record of a completed span, as handed to an Exporter.
+type SpanData struct {
+	TraceID      TraceID
+	SpanID       SpanID
+	ParentSpanID SpanID
+	Name         string
+	Kind         SpanKind
+	Start        time.Time
+	End          time.Time
+	Attributes   map[string]string
+	Err          error // Err is the error recorded against the span, if any.
+}
+
+// Span represents a single timed operation. Spans are created by
+// Tracer.StartRootSpan or StartSpan and must be completed by calling End.
+//
+// A nil *Span is valid and ignores all method calls.
+//
+// Multiple goroutines may invoke methods on a Span simultaneously.
+type Span struct {
+	tracer *Tracer
+
+	mu    sync.Mutex
+	data  SpanData
+	ended bool
+}
+
+// SetAttribute records a key-value attribute against the span.
+func (s *Span) SetAttribute(key, value string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.data.Attributes == nil {
+		s.data.Attributes = make(map[string]string)
+	}
+	s.data.Attributes[key] = value
+}
+
+// RecordError marks the span as failed with the given error.
+// A nil err is ignored.
+func (s *Span) RecordError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.data.Err = err
+}
+
+// End completes the span and hands it to the Tracer for export.
+// Calls to End after the first are ignored.
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.data.End = s.tracer.now()
+	data := s.data
+	s.mu.Unlock()
+	s.tracer.enqueue(&data)
+}
+
+type spanContextKeyType struct{}
+
+var spanContextKey = spanContextKeyType{}
+
+// NewContextWithSpan returns a child context of parent that carries span.
+func NewContextWithSpan(parent context.Context, span *Span) context.Context {
+	return context.WithValue(parent, spanContextKey, span)
+}
+
+// SpanFromContext returns the span stored in ctx, or nil if there is none.
+func SpanFromContext(ctx context.Context) *Span {
+	span, _ := ctx.Value(spanContextKey).(*Span)
+	return span
+}
+
+// StartSpan starts a new span named name as a child of the span stored in
+// ctx, and returns a child context carrying the new span. If ctx does not
+// carry a span, then ctx is returned unchanged alongside a nil *Span.
+func StartSpan(ctx context.Context, name string) (context.Context, *Span) {
+	return startChildSpan(ctx, name, SpanKindInternal)
+}
+
+// StartClientSpan is like StartSpan, but the new span is of kind
+// SpanKindClient, for connecting to an upstream.
+func StartClientSpan(ctx context.Context, name string) (context.Context, *Span) {
+	return startChildSpan(ctx, name, SpanKindClient)
+}
+
+func startChildSpan(ctx context.Context, name string, kind SpanKind) (context.Context, *Span) {
+	parent := SpanFromContext(ctx)
+	if parent == nil {
+		return ctx, nil
+	}
+	span := parent.tracer.newSpan(name, kind, parent.data.TraceID, parent.data.SpanID)
+	return NewContextWithSpan(ctx, span), span
+}
+
+// Exporter sends batches of completed spans to a tracing backend.
+type Exporter interface {
+	ExportSpans(ctx context.Context, spans []*SpanData) error
+}
+
+// Sampler decides if a new trace should be recorded.
+type Sampler interface {
+	ShouldSample(traceID TraceID) bool
+}
+
+// RatioSampler samples a deterministic fraction of traces, based upon the
+// value of the TraceID. Ratios <= 0 sample nothing, ratios >= 1 sample everything.
+type RatioSampler struct {
+	Ratio float64
+}
+
+func (s RatioSampler) ShouldSample(traceID TraceID) bool {
+	if s.Ratio >= 1.0 {
+		return true
+	}
+	if s.Ratio <= 0.0 {
+		return false
+	}
+	// Compare the low 63 bits of the trace ID against a threshold, the same
+	// way as the OpenTelemetry TraceIdRatioBased sampler.
+	x := binary.BigEndian.Uint64(traceID[8:16]) >> 1
+	threshold := uint64(s.Ratio * (1 << 63))
+	return x < threshold
+}
+
+// Config configures a Tracer.
+type Config struct {
+	Exporter      Exporter
+	Sampler       Sampler
+	ErrorHandler  func(err error) // ErrorHandler is called on export failure. Optional.
+	BatchSize     int             // BatchSize is the max number of spans per export.
+	QueueSize     int             // QueueSize is the max number of spans buffered. Excess spans are dropped.
+	FlushInterval time.Duration   // FlushInterval is the max delay before buffered spans are exported.
+}
+
+const (
+	DefaultBatchSize     = 512
+	DefaultQueueSize     = 2048
+	DefaultFlushInterval = 5 * time.Second
+)
+
+// Tracer creates root spans and exports completed spans in batches
+// from a background goroutine.
+//
+// Multiple goroutines may invoke methods on a Tracer simultaneously.
+type Tracer struct {
+	cfg      Config
+	queue    chan *SpanData
+	flushReq chan chan struct{}
+	done     chan struct{}
+	stopOnce sync.Once
+}
+
+// NewTracer creates a new Tracer and starts its export goroutine.
+// Shutdown must be called to stop the goroutine and flush buffered spans.
+func NewTracer(cfg Config) *Tracer {
+	if cfg.Sampler == nil {
+		cfg.Sampler = RatioSampler{Ratio: 1.0}
+	}
+	if cfg.BatchSize <= 0 {
+		cfg.BatchSize = DefaultBatchSize
+	}
+	if cfg.QueueSize <= 0 {
+		cfg.QueueSize = DefaultQueueSize
+	}
+	if cfg.FlushInterval <= 0 {
+		cfg.FlushInterval = DefaultFlushInterval
+	}
+	t := &Tracer{
+		cfg:      cfg,
+		queue:    make(chan *SpanData, cfg.QueueSize),
+		flushReq: make(chan chan struct{}),
+		done:     make(chan struct{}),
+	}
+	go t.run()
+	return t
+}
+
+// StartRootSpan starts a new trace, subject to sampling, and returns a child
+// context of ctx carrying its root span, of kind SpanKindServer. If the trace is not sampled, or t is
+// nil, ctx is returned unchanged alongside a nil *Span.
+func (t *Tracer) StartRootSpan(ctx context.Context, name string) (context.Context, *Span) {
+	if t == nil {
+		return ctx, nil
+	}
+	var traceID TraceID
+	_, _ = rand.Read(traceID[:])
+	if !t.cfg.Sampler.ShouldSample(traceID) {
+		return ctx, nil
+	}
+	span := t.newSpan(name, SpanKindServer, traceID, SpanID{})
+	return NewContextWithSpan(ctx, span), span
+}
+
+func (t *Tracer) newSpan(name string, kind SpanKind, traceID TraceID, parent SpanID) *Span {
+	var spanID SpanID
+	_, _ = rand.Read(spanID[:])
+	return &Span{
+		tracer: t,
+		data: SpanData{
+			TraceID:      traceID,
+			SpanID:       spanID,
+			ParentSpanID: parent,
+			Name:         name,
+			Kind:         kind,
+			Start:        t.now(),
+		},
+	}
+}
+
+func (t *Tracer) now() time.Time {
+	return time.Now()
+}
+
+func (t *Tracer) enqueue(span *SpanData) {
+	select {
+	case t.queue <- span:
+	default:
+		// Queue is full. Drop the span rather than block the connection.
+	}
+}
+
+func (t *Tracer) export(batch []*SpanData) {
+	if len(batch) == 0 || t.cfg.Exporter == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), t.cfg.FlushInterval)
+	defer cancel()
+	err := t.cfg.Exporter.ExportSpans(ctx, batch)
+	if err != nil && t.cfg.ErrorHandler != nil {
+		t.cfg.ErrorHandler(err)
+	}
+}
+
+func (t *Tracer) run() {
+	ticker := time.NewTicker(t.cfg.FlushInterval)
+	defer ticker.Stop()
+	batch := make([]*SpanData, 0, t.cfg.BatchSize)
+	flush := func() {
+		t.export(batch)
+		batch = make([]*SpanData, 0, t.cfg.BatchSize)
+	}
+	drain := func() {
+		for {
+			select {
+			case span := <-t.queue:
+				batch = append(batch, span)
+				if len(batch) >= t.cfg.BatchSize {
+					flush()
+				}
+			default:
+				flush()
+				return
+			}
+		}
+	}
+	for {
+		select {
+		case span := <-t.queue:
+			batch = append(batch, span)
+			if len(batch) >= t.cfg.BatchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		case ack := <-t.flushReq:
+			drain()
+			close(ack)
+		case <-t.done:
+			drain()
+			return
+		}
+	}
+}
+
+// Flush blocks until all spans ended before the call have been exported,
+// or ctx is done.
+func (t *Tracer) Flush(ctx context.Context) error {
+	ack := make(chan struct{})
+	select {
+	case t.flushReq <- ack:
+	case <-t.done:
+		return nil // Already shut down.
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case <-ack:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Shutdown flushes buffered spans and stops the export goroutine.
+func (t *Tracer) Shutdown(ctx context.Context) error {
+	if t == nil {
+		return nil
+	}
+	err := t.Flush(ctx)
+	t.stopOnce.Do(func() {
+		close(t.done)
+	})
+	return err
+}
@@ -0,0 +1,167 @@
+package trace
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// RecordingExporter captures all exported spans in memory.
+type RecordingExporter struct {
+	mu    sync.Mutex
+	Spans []*SpanData
+}
+
+func (e *RecordingExporter) ExportSpans(ctx context.Context, spans []*SpanData) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.Spans = append(e.Spans, spans...)
+	return nil
+}
+
+func TestStartSpanWithoutParentIsNoop(t *testing.T) {
+	ctx := context.Background()
+	childCtx, span := StartSpan(ctx, "orphan")
+	require.Nil(t, span)
+	require.Equal(t, ctx, childCtx)
+
+	// Methods on nil spans must not panic.
+	span.SetAttribute("k", "v")
+	span.RecordError(errors.New("boom"))
+	span.End()
+}
+
+func TestNilTracerStartRootSpanIsNoop(t *testing.T) {
+	var tracer *Tracer
+	_, span := tracer.StartRootSpan(context.Background(), "root")
+	require.Nil(t, span)
+	require.NoError(t, tracer.Shutdown(context.Background()))
+}
+
+func TestChildSpansShareTraceAndLinkToParent(t *testing.T) {
+	exporter := &RecordingExporter{}
+	tracer := NewTracer(Config{Exporter: exporter})
+
+	ctx, root := tracer.StartRootSpan(context.Background(), "root")
+	require.NotNil(t, root)
+	_, child := StartSpan(ctx, "child")
+	require.NotNil(t, child)
+	child.SetAttribute("k", "v")
+	child.RecordError(errors.New("boom"))
+	child.End()
+	child.End() // second End is ignored
+	root.End()
+
+	require.NoError(t, tracer.Shutdown(context.Background()))
+
+	require.Len(t, exporter.Spans, 2)
+	childData, rootData := exporter.Spans[0], exporter.Spans[1]
+	require.Equal(t, "child", childData.Name)
+	require.Equal(t, "root", rootData.Name)
+	require.Equal(t, rootData.TraceID, childData.TraceID)
+	require.Equal(t, rootData.SpanID, childData.ParentSpanID)
+	require.True(t, rootData.ParentSpanID.IsZero())
+	require.Equal(t, SpanKindInternal, childData.Kind)
+	require.Equal(t, SpanKindServer, rootData.Kind)
+	require.Equal(t, "v", childData.Attributes["k"])
+	require.EqualError(t, childData.Err, "boom")
+	require.False(t, childData.End.Before(childData.Start))
+}
+
+func TestClientSpanKind(t *testing.T) {
+	exporter := &RecordingExporter{}
+	tracer := NewTracer(Config{Exporter: exporter})
+
+	ctx, root := tracer.StartRootSpan(context.Background(), "root")
+	_, dial := StartClientSpan(ctx, "dial")
+	require.NotNil(t, dial)
+	dial.End()
+	root.End()
+
+	require.NoError(t, tracer.Shutdown(context.Background()))
+
+	require.Len(t, exporter.Spans, 2)
+	require.Equal(t, SpanKindClient, exporter.Spans[0].Kind)
+	require.Equal(t, root.data.SpanID, exporter.Spans[0].ParentSpanID)
+}
+
+func TestRatioSamplerBounds(t *testing.T) {
+	var lo, hi TraceID
+	for i := range hi {
+		hi[i] = 0xff
+	}
+	require.False(t, RatioSampler{Ratio: 0.0}.ShouldSample(lo))
+	require.True(t, RatioSampler{Ratio: 1.0}.ShouldSample(hi))
+	require.True(t, RatioSampler{Ratio: 0.5}.ShouldSample(lo))
+	require.False(t, RatioSampler{Ratio: 0.5}.ShouldSample(hi))
+}
+
+func TestUnsampledRootSpanIsNoop(t *testing.T) {
+	exporter := &RecordingExporter{}
+	tracer := NewTracer(Config{Exporter: exporter, Sampler: RatioSampler{Ratio: 0.0}})
+	ctx, root := tracer.StartRootSpan(context.Background(), "root")
+	require.Nil(t, root)
+	_, child := StartSpan(ctx, "child")
+	require.Nil(t, child)
+	require.NoError(t, tracer.Shutdown(context.Background()))
+	require.Empty(t, exporter.Spans)
+}
+
+func TestOTLPExporterPostsJSON(t *testing.T) {
+	var got otlpExportRequest
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&got))
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	exporter := &OTLPExporter{Endpoint: srv.URL, ServiceName: "trace-test"}
+	span := &SpanData{
+		TraceID:    TraceID{1},
+		SpanID:     SpanID{2},
+		Name:       "dial",
+		Kind:       SpanKindClient,
+		Start:      time.Unix(1, 0),
+		End:        time.Unix(2, 0),
+		Attributes: map[string]string{"k": "v"},
+		Err:        errors.New("refused"),
+	}
+	err := exporter.ExportSpans(context.Background(), []*SpanData{span})
+	require.NoError(t, err)
+
+	require.Len(t, got.ResourceSpans, 1)
+	require.Equal(t, "trace-test", got.ResourceSpans[0].Resource.Attributes[0].Value.StringValue)
+	spans := got.ResourceSpans[0].ScopeSpans[0].Spans
+	require.Len(t, spans, 1)
+	require.Equal(t, "01000000000000000000000000000000", spans[0].TraceID)
+	require.Equal(t, "0200000000000000", spans[0].SpanID)
+	require.Empty(t, spans[0].ParentSpanID)
+	require.Equal(t, otlpSpanKindClient, spans[0].Kind)
+	require.Equal(t, "1000000000", spans[0].StartTimeUnixNano)
+	require.Equal(t, otlpStatusCodeErr, spans[0].Status.Code)
+	require.Equal(t, "refused", spans[0].Status.Message)
+}
+
+func TestAsOTLPSpanKind(t *testing.T) {
+	require.Equal(t, otlpSpanKindServer, asOTLPSpan(&SpanData{Kind: SpanKindServer}).Kind)
+	require.Equal(t, otlpSpanKindInternal, asOTLPSpan(&SpanData{Kind: SpanKindInternal}).Kind)
+	require.Equal(t, otlpSpanKindClient, asOTLPSpan(&SpanData{Kind: SpanKindClient}).Kind)
+}
+
+func TestOTLPExporterReportsHTTPError(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer srv.Close()
+
+	exporter := &OTLPExporter{Endpoint: srv.URL}
+	err := exporter.ExportSpans(context.Background(), []*SpanData{{Name: "x"}})
+	require.Error(t, err)
+}
@@ -0,0 +1,397 @@
+// Package udp load balances UDP datagrams across upstreams.
+//
+// Datagrams from each client address form a session, which is forwarded to
+// a single upstream chosen by a dialer.DialPolicy when the session begins.
+// Replies from the upstream are relayed back to the client. A session ends
+// once no datagrams have been received from its client for the idle
+// timeout. DTLS is not supported.
+package udp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"tcplb/lib/core"
+	"tcplb/lib/dialer"
+	"tcplb/lib/forwarder"
+	"tcplb/lib/metrics"
+	"tcplb/lib/slog"
+	"time"
+)
+
+// ProxyClosed is returned by Proxy.Serve after Close is called.
+var ProxyClosed = errors.New("udp proxy closed")
+
+// SessionLimitExceeded is the error logged when a datagram is dropped
+// because MaxSessions sessions are already open.
+var SessionLimitExceeded = errors.New("udp session limit exceeded")
+
+// PendingLimitExceeded is the error logged when a datagram is dropped
+// because maxPendingDatagrams datagrams of its session already wait for
+// the session's upstream to be dialed.
+var PendingLimitExceeded = errors.New("udp session pending datagram limit exceeded")
+
+// maxDatagramSize is the largest UDP payload.
+const maxDatagramSize = 65535
+
+// maxPendingDatagrams bounds the datagrams of a session that wait for its
+// upstream to be dialed.
+const maxPendingDatagrams = 16
+
+// defaultDropLogInterval is how often dropped datagrams are logged, unless
+// Proxy.DropLogInterval is given.
+const defaultDropLogInterval = 10 * time.Second
+
+// clientIDNamespace is the namespace of the ClientIDs of UDP clients, which
+// are identified by their address rather than authenticated.
+const clientIDNamespace = "udp"
+
+// ProxyMetrics holds the metrics recorded by a Proxy.
+type ProxyMetrics struct {
+	Sessions             *metrics.Gauge   // Sessions is the number of open sessions.
+	DatagramsFromClients *metrics.Counter // DatagramsFromClients counts datagrams forwarded to upstreams.
+	DatagramsToClients   *metrics.Counter // DatagramsToClients counts datagrams relayed back to clients.
+	DatagramsDropped     *metrics.Counter // DatagramsDropped counts client datagrams that could not be forwarded.
+	SessionsLimited      *metrics.Counter // SessionsLimited counts client datagrams dropped because MaxSessions sessions were open.
+}
+
+// NewProxyMetrics returns ProxyMetrics registered in the given Registry.
+func NewProxyMetrics(r *metrics.Registry) *ProxyMetrics {
+	return &ProxyMetrics{
+		Sessions:             r.Gauge("udp_sessions_active"),
+		DatagramsFromClients: r.Counter("udp_datagrams_from_clients_total"),
+		DatagramsToClients:   r.Counter("udp_datagrams_to_clients_total"),
+		DatagramsDropped:     r.Counter("udp_datagrams_dropped_total"),
+		SessionsLimited:      r.Counter("udp_sessions_limited_total"),
+	}
+}
+
+// session forwards the datagrams of one client to one upstream.
+type session struct {
+	lastActive int64 // lastActive is when the client last sent a datagram, in unix nanoseconds, accessed atomically.
+
+	client net.Addr
+	cancel context.CancelFunc // cancel stops dialing the upstream.
+
+	mu       sync.Mutex // mu guards upstream, conn and pending.
+	upstream core.Upstream
+	conn     net.Conn // conn is nil until the upstream is dialed.
+	pending  [][]byte // pending holds the datagrams received while the upstream is dialed.
+}
+
+func (s *session) touch(now time.Time) {
+	atomic.StoreInt64(&s.lastActive, now.UnixNano())
+}
+
+func (s *session) idleSince() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&s.lastActive))
+}
+
+// forward writes datagram to the upstream of s, or if the upstream is still
+// being dialed, queues a copy of it to be written once it is dialed. It
+// reports if datagram was written.
+func (s *session) forward(datagram []byte) (bool, error) {
+	s.mu.Lock()
+	conn := s.conn
+	if conn == nil {
+		defer s.mu.Unlock()
+		if len(s.pending) >= maxPendingDatagrams {
+			return false, PendingLimitExceeded
+		}
+		s.pending = append(s.pending, append([]byte(nil), datagram...))
+		return false, nil
+	}
+	s.mu.Unlock()
+	_, err := conn.Write(datagram)
+	return err == nil, err
+}
+
+// Proxy forwards datagrams received on Conn to Upstreams.
+type Proxy struct {
+	Logger    slog.Logger
+	Conn      net.PacketConn
+	Upstreams core.UpstreamSet
+	Policy    dialer.DialPolicy // Policy chooses the upstream of each new session.
+
+	// IdleTimeout is how long a session stays open without receiving a
+	// datagram from its client. It must be positive.
+	IdleTimeout time.Duration
+	// MaxSessions bounds the number of open sessions. Datagrams from new
+	// clients beyond the bound are dropped. If not positive, there is no
+	// bound.
+	MaxSessions int
+	// DropLogInterval is how often datagrams dropped without a session are
+	// logged, with the count dropped since the last log, so that a flood
+	// of new clients does not flood the log too. If not positive,
+	// defaultDropLogInterval is used.
+	DropLogInterval time.Duration
+	// Metrics is optional. If nil, no metrics are recorded.
+	Metrics *ProxyMetrics
+	// Dial is optional. If nil, upstreams are dialed with a net.Dialer.
+	Dial func(ctx context.Context, network, address string) (net.Conn, error)
+
+	mu       sync.Mutex // mu guards closing and sessions.
+	closing  bool
+	sessions map[string]*session // sessions are keyed by client address.
+	wg       sync.WaitGroup      // wg tracks session goroutines.
+
+	dropsMu       sync.Mutex // dropsMu guards dropsLoggedAt and dropsUnlogged.
+	dropsLoggedAt time.Time  // dropsLoggedAt is when dropped datagrams were last logged.
+	dropsUnlogged int        // dropsUnlogged counts datagrams dropped since then.
+}
+
+// Serve reads datagrams from Conn and forwards them until Close is called,
+// after which ProxyClosed is returned.
+//
+// The upstream of each new session is dialed on a goroutine of its own, so
+// that a slow dial does not hold up other clients. Meanwhile, up to
+// maxPendingDatagrams datagrams from the session's client are queued, and
+// any more are dropped.
+func (p *Proxy) Serve() error {
+	m := p.metrics()
+	buf := make([]byte, maxDatagramSize)
+	for {
+		n, client, err := p.Conn.ReadFrom(buf)
+		if err != nil {
+			if p.isClosing() {
+				return ProxyClosed
+			}
+			return err
+		}
+		s, err := p.session(client)
+		if err != nil {
+			m.DatagramsDropped.Inc()
+			if errors.Is(err, SessionLimitExceeded) {
+				m.SessionsLimited.Inc()
+			}
+			p.logDrop(err, 1, time.Now())
+			continue
+		}
+		s.touch(time.Now())
+		written, err := s.forward(buf[:n])
+		if err != nil {
+			m.DatagramsDropped.Inc()
+			if errors.Is(err, PendingLimitExceeded) {
+				p.logDrop(err, 1, time.Now())
+				continue
+			}
+			p.Logger.Warn(&slog.LogRecord{Msg: "UDP Proxy: upstream write error", Upstream: &s.upstream, Error: err})
+			continue
+		}
+		if written {
+			m.DatagramsFromClients.Inc()
+		}
+	}
+}
+
+// logDrop logs dropped datagrams that were not forwarded to an upstream
+// because of err, at most once per DropLogInterval, with the count dropped
+// since the last log.
+func (p *Proxy) logDrop(err error, dropped int, now time.Time) {
+	p.dropsMu.Lock()
+	defer p.dropsMu.Unlock()
+	p.dropsUnlogged += dropped
+	interval := p.DropLogInterval
+	if interval <= 0 {
+		interval = defaultDropLogInterval
+	}
+	if !p.dropsLoggedAt.IsZero() && now.Sub(p.dropsLoggedAt) < interval {
+		return
+	}
+	p.Logger.Warn(&slog.LogRecord{Msg: fmt.Sprintf("UDP Proxy: dropped %d datagrams", p.dropsUnlogged), Error: err})
+	p.dropsLoggedAt = now
+	p.dropsUnlogged = 0
+}
+
+// metrics returns Metrics, or if it is nil, ProxyMetrics that record nothing.
+func (p *Proxy) metrics() *ProxyMetrics {
+	if p.Metrics == nil {
+		return &ProxyMetrics{}
+	}
+	return p.Metrics
+}
+
+func (p *Proxy) isClosing() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.closing
+}
+
+// session returns the session of client, beginning one if necessary.
+// Only Serve begins sessions, so no other session for client can begin
+// while the upstream is being dialed.
+func (p *Proxy) session(client net.Addr) (*session, error) {
+	key := client.String()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if s, ok := p.sessions[key]; ok {
+		return s, nil
+	}
+	if p.closing {
+		return nil, ProxyClosed
+	}
+	if p.MaxSessions > 0 && len(p.sessions) >= p.MaxSessions {
+		return nil, SessionLimitExceeded
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &session{client: client, cancel: cancel}
+	s.touch(time.Now())
+	if p.sessions == nil {
+		p.sessions = make(map[string]*session)
+	}
+	p.sessions[key] = s
+	p.metrics().Sessions.Inc()
+	p.wg.Add(1)
+	go p.run(ctx, key, s)
+	return s, nil
+}
+
+// run dials the upstream of s, forwards the datagrams queued meanwhile,
+// then relays replies until the session ends.
+func (p *Proxy) run(ctx context.Context, key string, s *session) {
+	defer p.wg.Done()
+	defer s.cancel()
+	upstream, conn, err := p.dialUpstream(ctx, s.client)
+	if err != nil {
+		s.mu.Lock()
+		dropped := len(s.pending)
+		s.pending = nil
+		s.mu.Unlock()
+		p.endSession(key, s)
+		p.metrics().DatagramsDropped.Add(int64(dropped))
+		if !p.isClosing() {
+			p.logDrop(err, dropped, time.Now())
+		}
+		return
+	}
+
+	p.mu.Lock()
+	if p.closing {
+		p.mu.Unlock()
+		_ = conn.Close()
+		p.endSession(key, s)
+		return
+	}
+	if observer, ok := p.Policy.(dialer.LoadObserver); ok {
+		observer.ConnectionOpened(upstream)
+	}
+	s.mu.Lock()
+	p.mu.Unlock()
+	s.upstream = upstream
+	s.conn = conn
+	pending := s.pending
+	s.pending = nil
+	// Forward the queued datagrams before any more are written, so that
+	// the upstream receives them in order.
+	for _, datagram := range pending {
+		if _, err := conn.Write(datagram); err != nil {
+			p.metrics().DatagramsDropped.Inc()
+			p.Logger.Warn(&slog.LogRecord{Msg: "UDP Proxy: upstream write error", Upstream: &upstream, Error: err})
+			continue
+		}
+		p.metrics().DatagramsFromClients.Inc()
+	}
+	s.mu.Unlock()
+
+	p.relay(key, s)
+}
+
+// dialUpstream chooses and dials the upstream of a session of client.
+func (p *Proxy) dialUpstream(ctx context.Context, client net.Addr) (core.Upstream, net.Conn, error) {
+	// Identify the client by its IP address, so that policies such as
+	// dialer.HashDialPolicy send its sessions to the same upstream.
+	clientID := core.ClientID{Namespace: clientIDNamespace, Key: client.String()}
+	if udpAddr, ok := client.(*net.UDPAddr); ok {
+		clientID.Key = udpAddr.IP.String()
+	}
+	ctx = forwarder.NewContextWithClientID(ctx, clientID)
+	upstream, err := p.Policy.ChooseUpstream(ctx, p.Upstreams)
+	if err != nil {
+		return core.Upstream{}, nil, err
+	}
+	dial := p.Dial
+	if dial == nil {
+		var d net.Dialer
+		dial = d.DialContext
+	}
+	conn, err := dial(ctx, upstream.Network, upstream.Address)
+	if err != nil {
+		return core.Upstream{}, nil, err
+	}
+	return upstream, conn, nil
+}
+
+// relay copies replies from the upstream of s back to its client, until
+// the session is idle for IdleTimeout or the upstream connection fails.
+func (p *Proxy) relay(key string, s *session) {
+	defer p.endSession(key, s)
+	buf := make([]byte, maxDatagramSize)
+	for {
+		deadline := s.idleSince().Add(p.IdleTimeout)
+		if !time.Now().Before(deadline) {
+			return
+		}
+		if err := s.conn.SetReadDeadline(deadline); err != nil {
+			return
+		}
+		n, err := s.conn.Read(buf)
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				// The client may have sent datagrams since the deadline
+				// was set. If so, the session is not yet idle.
+				continue
+			}
+			if !p.isClosing() {
+				p.Logger.Warn(&slog.LogRecord{Msg: "UDP Proxy: upstream read error", Upstream: &s.upstream, Error: err})
+			}
+			return
+		}
+		if _, err := p.Conn.WriteTo(buf[:n], s.client); err != nil {
+			p.Logger.Warn(&slog.LogRecord{Msg: "UDP Proxy: client write error", Error: err, Details: s.client.String()})
+			continue
+		}
+		p.metrics().DatagramsToClients.Inc()
+	}
+}
+
+// endSession forgets s, and if its upstream was dialed, closes the
+// connection to it.
+func (p *Proxy) endSession(key string, s *session) {
+	p.mu.Lock()
+	if p.sessions[key] == s {
+		delete(p.sessions, key)
+	}
+	p.mu.Unlock()
+	s.mu.Lock()
+	conn := s.conn
+	s.mu.Unlock()
+	if conn != nil {
+		_ = conn.Close()
+		if observer, ok := p.Policy.(dialer.LoadObserver); ok {
+			observer.ConnectionClosed(s.upstream)
+		}
+	}
+	p.metrics().Sessions.Dec()
+}
+
+// Close stops Serve, ends all sessions and closes Conn.
+func (p *Proxy) Close() error {
+	p.mu.Lock()
+	p.closing = true
+	for _, s := range p.sessions {
+		s.cancel()
+		s.mu.Lock()
+		if s.conn != nil {
+			_ = s.conn.Close()
+		}
+		s.mu.Unlock()
+	}
+	p.mu.Unlock()
+	err := p.Conn.Close()
+	p.wg.Wait()
+	return err
+}
@@ -0,0 +1,188 @@
+package udp
+
+import (
+	"context"
+	"github.com/stretchr/testify/require"
+	"net"
+	"sync/atomic"
+	"tcplb/lib/core"
+	"tcplb/lib/dialer"
+	"tcplb/lib/metrics"
+	"tcplb/lib/slog"
+	"testing"
+	"time"
+)
+
+// startEchoUpstream starts a UDP server that replies to each datagram with
+// its own address followed by the datagram.
+func startEchoUpstream(t *testing.T) core.Upstream {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = conn.Close() })
+	go func() {
+		buf := make([]byte, maxDatagramSize)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			reply := append([]byte(conn.LocalAddr().String()+" "), buf[:n]...)
+			_, _ = conn.WriteTo(reply, addr)
+		}
+	}()
+	return core.Upstream{Network: "udp", Address: conn.LocalAddr().String()}
+}
+
+func startTestProxy(t *testing.T, p *Proxy) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	p.Conn = conn
+	p.Logger = &slog.RecordingLogger{}
+	p.Metrics = NewProxyMetrics(metrics.NewRegistry())
+	serveErr := make(chan error, 1)
+	go func() { serveErr <- p.Serve() }()
+	t.Cleanup(func() {
+		require.NoError(t, p.Close())
+		require.ErrorIs(t, <-serveErr, ProxyClosed)
+	})
+}
+
+// exchange sends msg to the proxy from client and returns the reply.
+func exchange(t *testing.T, client net.Conn, msg string) string {
+	_, err := client.Write([]byte(msg))
+	require.NoError(t, err)
+	require.NoError(t, client.SetReadDeadline(time.Now().Add(time.Second)))
+	buf := make([]byte, maxDatagramSize)
+	n, err := client.Read(buf)
+	require.NoError(t, err)
+	return string(buf[:n])
+}
+
+func dialProxy(t *testing.T, p *Proxy) net.Conn {
+	client, err := net.Dial("udp", p.Conn.LocalAddr().String())
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = client.Close() })
+	return client
+}
+
+func TestProxyForwardsSessions(t *testing.T) {
+	a := startEchoUpstream(t)
+	b := startEchoUpstream(t)
+	p := &Proxy{
+		Upstreams:   core.NewUpstreamSet(a, b),
+		Policy:      &dialer.RoundRobinDialPolicy{},
+		IdleTimeout: time.Minute,
+	}
+	startTestProxy(t, p)
+
+	// Each client's datagrams stay with the upstream chosen for its session.
+	alice := dialProxy(t, p)
+	first := exchange(t, alice, "hello")
+	require.Equal(t, first, exchange(t, alice, "hello"))
+	bob := dialProxy(t, p)
+	second := exchange(t, bob, "hello")
+	require.NotEqual(t, first, second)
+	require.ElementsMatch(t, []string{a.Address + " hello", b.Address + " hello"}, []string{first, second})
+
+	require.Equal(t, int64(2), p.Metrics.Sessions.Value())
+	require.Equal(t, int64(3), p.Metrics.DatagramsFromClients.Value())
+	require.Equal(t, int64(3), p.Metrics.DatagramsToClients.Value())
+}
+
+func TestProxyExpiresIdleSessions(t *testing.T) {
+	p := &Proxy{
+		Upstreams:   core.NewUpstreamSet(startEchoUpstream(t)),
+		Policy:      &dialer.RoundRobinDialPolicy{},
+		IdleTimeout: 50 * time.Millisecond,
+		MaxSessions: 1,
+	}
+	startTestProxy(t, p)
+
+	alice := dialProxy(t, p)
+	exchange(t, alice, "hello")
+
+	// Only one session may be open, so bob's datagram is dropped.
+	bob := dialProxy(t, p)
+	_, err := bob.Write([]byte("hello"))
+	require.NoError(t, err)
+	require.Eventually(t, func() bool { return p.Metrics.DatagramsDropped.Value() == 1 }, time.Second, time.Millisecond)
+	require.Equal(t, int64(1), p.Metrics.SessionsLimited.Value())
+
+	// Once alice's session expires, bob may begin one.
+	require.Eventually(t, func() bool { return p.Metrics.Sessions.Value() == 0 }, time.Second, time.Millisecond)
+	exchange(t, bob, "hello")
+}
+
+func TestProxyDialsSessionsConcurrently(t *testing.T) {
+	upstream := startEchoUpstream(t)
+	var dials int32
+	release := make(chan struct{})
+	p := &Proxy{
+		Upstreams:   core.NewUpstreamSet(upstream),
+		Policy:      &dialer.RoundRobinDialPolicy{},
+		IdleTimeout: time.Minute,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			// The first session's upstream is slow to dial.
+			if atomic.AddInt32(&dials, 1) == 1 {
+				select {
+				case <-release:
+				case <-ctx.Done():
+					return nil, ctx.Err()
+				}
+			}
+			var d net.Dialer
+			return d.DialContext(ctx, network, address)
+		},
+	}
+	startTestProxy(t, p)
+
+	alice := dialProxy(t, p)
+	_, err := alice.Write([]byte("hello"))
+	require.NoError(t, err)
+	_, err = alice.Write([]byte("again"))
+	require.NoError(t, err)
+	require.Eventually(t, func() bool { return atomic.LoadInt32(&dials) == 1 }, time.Second, time.Millisecond)
+
+	// Bob's session is served while alice's upstream is still dialed.
+	bob := dialProxy(t, p)
+	require.Equal(t, upstream.Address+" hi", exchange(t, bob, "hi"))
+
+	// Once dialed, alice's queued datagrams are forwarded in order.
+	close(release)
+	require.NoError(t, alice.SetReadDeadline(time.Now().Add(time.Second)))
+	buf := make([]byte, maxDatagramSize)
+	for _, want := range []string{"hello", "again"} {
+		n, err := alice.Read(buf)
+		require.NoError(t, err)
+		require.Equal(t, upstream.Address+" "+want, string(buf[:n]))
+	}
+	require.Equal(t, int64(3), p.Metrics.DatagramsFromClients.Value())
+}
+
+func TestProxyDropsDatagramsBeyondPendingLimit(t *testing.T) {
+	s := &session{}
+	for i := 0; i < maxPendingDatagrams; i++ {
+		written, err := s.forward([]byte("x"))
+		require.NoError(t, err)
+		require.False(t, written)
+	}
+	_, err := s.forward([]byte("x"))
+	require.ErrorIs(t, err, PendingLimitExceeded)
+	require.Len(t, s.pending, maxPendingDatagrams)
+}
+
+func TestProxyLogsDropsOncePerInterval(t *testing.T) {
+	logger := &slog.RecordingLogger{}
+	p := &Proxy{Logger: logger, DropLogInterval: time.Minute}
+	now := time.Now()
+	p.logDrop(SessionLimitExceeded, 1, now)
+	p.logDrop(SessionLimitExceeded, 1, now.Add(time.Second))
+	p.logDrop(SessionLimitExceeded, 1, now.Add(2*time.Second))
+	require.Len(t, logger.Events, 1)
+	require.Equal(t, "UDP Proxy: dropped 1 datagrams", logger.Events[0].Msg)
+
+	// Once the interval has passed, the drops since the last log are logged.
+	p.logDrop(SessionLimitExceeded, 1, now.Add(time.Minute))
+	require.Len(t, logger.Events, 2)
+	require.Equal(t, "UDP Proxy: dropped 3 datagrams", logger.Events[1].Msg)
+}